@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAlertManager returns an alert manager started at start with the
+// refused authentications counter at count
+func newTestAlertManager(start time.Time, count uint64) *alertManager {
+	return &alertManager{
+		firing:      make(map[string]alert),
+		authSamples: []counterSample{{at: start, count: count}},
+		lastIPCheck: start,
+	}
+}
+
+// The growth is measured against the newest sample at least a minute old
+func TestAuthFailuresLastMinute(t *testing.T) {
+	start := time.Now()
+	m := newTestAlertManager(start, 1000)
+	// One check every 30 seconds, like the alerting goroutine
+	steps := []struct {
+		count uint64
+		want  uint64
+	}{
+		{1010, 10},  // 30s: against the start
+		{1100, 100}, // 60s: still against the start, a minute old
+		{1150, 140}, // 90s: against 30s
+		{1150, 50},  // 120s: against 60s
+		{1150, 0},   // 150s: against 90s
+	}
+	for i, step := range steps {
+		now := start.Add(time.Duration(i+1) * alertInterval)
+		if got := m.authFailuresLastMinute(step.count, now); got != step.want {
+			t.Fatalf("check %d: %d failures in the last minute, want %d", i+1, got, step.want)
+		}
+	}
+	if len(m.authSamples) > 3 {
+		t.Fatalf("%d samples kept, want at most the last minute's", len(m.authSamples))
+	}
+}
+
+// An alert fires when its condition starts, stays quiet while it lasts and
+// is resolved once when it clears
+func TestAlertTransitions(t *testing.T) {
+	start := time.Now()
+	m := newTestAlertManager(start, 0)
+	spike := alertCondition{"auth-failure-spike", "warning", "spike"}
+	failed := alertCondition{"component-failed", "critical", "Component stunturn-tls failed"}
+	ticks := []struct {
+		found map[string]alertCondition
+		want  []string // key status of the alerts delivered
+	}{
+		{map[string]alertCondition{}, nil},
+		{map[string]alertCondition{"auth-failure-spike": spike}, []string{"auth-failure-spike firing"}},
+		{map[string]alertCondition{"auth-failure-spike": spike}, nil},
+		{map[string]alertCondition{"auth-failure-spike": spike, "component-failed:stunturn-tls": failed}, []string{"component-failed:stunturn-tls firing"}},
+		{map[string]alertCondition{"component-failed:stunturn-tls": failed}, []string{"auth-failure-spike resolved"}},
+		{map[string]alertCondition{"auth-failure-spike": spike}, []string{"auth-failure-spike firing", "component-failed:stunturn-tls resolved"}},
+		{map[string]alertCondition{}, []string{"auth-failure-spike resolved"}},
+		{map[string]alertCondition{}, nil},
+	}
+	for i, tick := range ticks {
+		now := start.Add(time.Duration(i) * alertInterval)
+		var got []string
+		for _, a := range m.transitions(tick.found, now) {
+			got = append(got, a.Key+" "+a.Status)
+			if a.Time != now {
+				t.Fatalf("tick %d: %s at %s, want %s", i, a.Key, a.Time, now)
+			}
+			// A resolved alert says when it started firing
+			if a.Status == "resolved" && a.Key == "component-failed:stunturn-tls" && a.Since != start.Add(3*alertInterval) {
+				t.Fatalf("tick %d: resolved alert since %s, want %s", i, a.Since, start.Add(3*alertInterval))
+			}
+		}
+		if !reflect.DeepEqual(got, tick.want) {
+			t.Fatalf("tick %d: delivered %q, want %q", i, got, tick.want)
+		}
+	}
+}
+
+// The rules read the counters, the allocation ceiling, the component
+// statuses and the re-detected public IP
+func TestAlertConditions(t *testing.T) {
+	savedThreshold, savedIP := alertAuthFailures, publicIP
+	t.Cleanup(func() { alertAuthFailures, publicIP = savedThreshold, savedIP })
+	alertAuthFailures, publicIP = 50, "203.0.113.7"
+	start := time.Now()
+	m := newTestAlertManager(start, authFailuresTotal.Load())
+	check := func(step int) []string {
+		var keys []string
+		for key := range m.conditions(start.Add(time.Duration(step) * alertInterval)) {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	authFailuresTotal.Add(49)
+	if keys := check(1); len(keys) != 0 {
+		t.Fatalf("conditions %q below every threshold", keys)
+	}
+	authFailuresTotal.Add(1)
+	if keys := check(2); !reflect.DeepEqual(keys, []string{"auth-failure-spike"}) {
+		t.Fatalf("conditions %q at 50 failures in a minute, want auth-failure-spike", keys)
+	}
+
+	// A minute later without failures the spike is over; the relay ceiling
+	// is reached and the TLS listener fails
+	useAllocationCap(t, 1)
+	relayUsage.relaysMu.Lock()
+	relayUsage.relays[-1] = &usagePacketConn{}
+	relayUsage.relaysMu.Unlock()
+	t.Cleanup(func() {
+		relayUsage.relaysMu.Lock()
+		delete(relayUsage.relays, -1)
+		relayUsage.relaysMu.Unlock()
+	})
+	useComponentHealth(t, componentTLS, componentFailed, "listener closed")
+	m.detectedIP = "198.51.100.9"
+	keys := check(5)
+	sort.Strings(keys)
+	want := []string{"allocation-cap", "component-failed:" + componentTLS, "public-ip-changed"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("conditions %q, want %q", keys, want)
+	}
+}
+
+// useComponentHealth sets a component's status until the test ends
+func useComponentHealth(t *testing.T, name, status, reason string) {
+	t.Helper()
+	componentsMu.Lock()
+	var savedStatus, savedReason string
+	for _, c := range components {
+		if c.Name == name {
+			savedStatus, savedReason = c.setStatus, c.setReason
+		}
+	}
+	componentsMu.Unlock()
+	setComponentHealth(name, status, reason)
+	t.Cleanup(func() { setComponentHealth(name, savedStatus, savedReason) })
+}
+
+// An alert is POSTed to -alert-webhook and written to the stdin of
+// -alert-command
+func TestDeliverAlert(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test command is a shell script")
+	}
+	logs := captureLogs(t)
+	posted := make(chan alert, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &a); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s (%s): %v", body, r.Header.Get("Content-Type"), err)
+		}
+		posted <- a
+	}))
+	defer webhook.Close()
+	dir := t.TempDir()
+	written := filepath.Join(dir, "alert.json")
+	command := filepath.Join(dir, "alert.sh")
+	if err := os.WriteFile(command, []byte("#!/bin/sh\ncat > "+written+".tmp && mv "+written+".tmp "+written+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	savedWebhook, savedCommand := alertWebhook, alertCommand
+	t.Cleanup(func() { alertWebhook, alertCommand = savedWebhook, savedCommand })
+	alertWebhook, alertCommand = webhook.URL, command
+
+	now := time.Now().UTC().Truncate(time.Second)
+	sent := alert{Rule: "allocation-cap", Key: "allocation-cap", Status: "firing", Severity: "critical", Summary: "5 allocations open", Server: "203.0.113.7", Since: now, Time: now}
+	deliverAlert(sent)
+	if got := await(t, posted, "webhook POST"); got != sent {
+		t.Fatalf("webhook got %+v, want %+v", got, sent)
+	}
+	var body []byte
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if body, err = os.ReadFile(written); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("-alert-command didn't get the alert")
+		}
+	}
+	var got alert
+	if err := json.Unmarshal(body, &got); err != nil || got != sent {
+		t.Fatalf("-alert-command got %s, want %+v", body, sent)
+	}
+	if !strings.Contains(logs.String(), "ALERT allocation-cap firing: 5 allocations open") {
+		t.Fatalf("alert not logged:\n%s", logs)
+	}
+}
+
+// A failing webhook is reported without its URL, which holds its key
+func TestPostAlertHidesURL(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	saved := alertWebhook
+	t.Cleanup(func() { alertWebhook = saved })
+
+	alertWebhook = failing.URL + "/services/T000/B000/secret-key"
+	if err := postAlert([]byte("{}")); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("posting to a refusing webhook: %v, want its 403", err)
+	}
+	failing.Close()
+	if err := postAlert([]byte("{}")); err == nil || strings.Contains(err.Error(), "secret-key") {
+		t.Fatalf("posting to a closed webhook: %v, want an error without the URL", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// useAllocationCap sets -max-total-allocations until the test ends
+func useAllocationCap(t *testing.T, limit int) {
+	t.Helper()
+	saved := maxTotalAllocations
+	maxTotalAllocations = limit
+	t.Cleanup(func() { maxTotalAllocations = saved })
+}
+
+// Concurrent allocations never overshoot the ceiling, and a released relay
+// makes room for the next one
+func TestAllocationCapConcurrent(t *testing.T) {
+	logs := captureLogs(t)
+	useAllocationCap(t, 5)
+	generator := &usageRelayGenerator{&turn.RelayAddressGeneratorStatic{RelayAddress: net.IPv4(127, 0, 0, 1), Address: "127.0.0.1"}}
+	if err := generator.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	refusedBefore := relayUsage.refused.Load()
+	// The warning is logged once a minute, whatever earlier tests refused
+	relayUsage.relaysMu.Lock()
+	relayUsage.lastSaturationWarning = time.Time{}
+	relayUsage.relaysMu.Unlock()
+
+	var (
+		mu      sync.Mutex
+		relays  []net.PacketConn
+		refused int
+		wg      sync.WaitGroup
+	)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := generator.AllocatePacketConn("udp4", 0)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				relays = append(relays, conn)
+			case errors.Is(err, errAllocationCapacity):
+				refused++
+			default:
+				t.Errorf("allocate: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	t.Cleanup(func() {
+		for _, relay := range relays {
+			relay.Close()
+		}
+	})
+
+	if len(relays) != 5 || refused != 15 {
+		t.Fatalf("%d allocations and %d refusals, want 5 and 15", len(relays), refused)
+	}
+	if got := relayUsage.refused.Load() - refusedBefore; got != 15 {
+		t.Fatalf("%d refusals counted, want 15", got)
+	}
+	if !relayUsage.saturated() {
+		t.Fatal("not saturated at the ceiling")
+	}
+	if !strings.Contains(logs.String(), "the -max-total-allocations limit; refused") {
+		t.Fatalf("no saturation warning in %q", logs.String())
+	}
+
+	relays[0].Close()
+	if relayUsage.saturated() {
+		t.Fatal("still saturated after a relay closed")
+	}
+	conn, _, err := generator.AllocatePacketConn("udp4", 0)
+	if err != nil {
+		t.Fatalf("allocate after a relay closed: %v", err)
+	}
+	relays[0] = conn
+}
+
+// At the ceiling the TURN server refuses the Allocate, and serves it again
+// once the allocation holding the slot is deleted
+func TestAllocationCapRefusesAllocate(t *testing.T) {
+	useAllocationCap(t, 1)
+	server := startIntegrationServers(t).STUNTURNAddr()
+
+	allocate := func() (*turn.Client, net.PacketConn, error) {
+		t.Helper()
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		c, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: server,
+			TURNServerAddr: server,
+			Conn:           conn,
+			Username:       "alice",
+			Password:       "secret",
+			Realm:          "pion.ly",
+		})
+		if err != nil {
+			t.Fatalf("create TURN client: %v", err)
+		}
+		t.Cleanup(c.Close)
+		if err := c.Listen(); err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		relay, err := c.Allocate()
+		return c, relay, err
+	}
+
+	_, first, err := allocate()
+	if err != nil {
+		t.Fatalf("first allocation: %v", err)
+	}
+	if _, _, err := allocate(); err == nil || !strings.Contains(err.Error(), "508") {
+		t.Fatalf("allocation at the ceiling: %v, want 508", err)
+	}
+
+	// Closing the relay deletes the allocation with a zero-lifetime Refresh
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for relayUsage.saturated() {
+		if time.Now().After(deadline) {
+			t.Fatal("slot still taken after the allocation was deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, relay, err := allocate(); err != nil {
+		t.Fatalf("allocation after the slot was freed: %v", err)
+	} else {
+		relay.Close()
+	}
+}
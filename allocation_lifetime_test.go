@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+// useAllocationLifetime sets the allocation lifetime policy and a TURN user
+// until the test ends, and returns the user's key
+func useAllocationLifetime(t *testing.T, maximum, fallback time.Duration) []byte {
+	t.Helper()
+	if err := configureAllocationLifetime(maximum, fallback); err != nil {
+		t.Fatal(err)
+	}
+	key := stun.NewLongTermIntegrity("alice", "test.realm", "secret")
+	usersMapMu.Lock()
+	saved := usersMap
+	usersMap = map[string]map[string][]byte{"test.realm": {"alice": key}}
+	usersMapMu.Unlock()
+	t.Cleanup(func() {
+		configureAllocationLifetime(0, defaultTURNLifetime)
+		usersMapMu.Lock()
+		usersMap = saved
+		usersMapMu.Unlock()
+	})
+	return key
+}
+
+// allocateRequest builds a signed Allocate request, asking for lifetime
+// unless it is negative
+func allocateRequest(t *testing.T, key []byte, lifetime time.Duration) []byte {
+	t.Helper()
+	setters := []stun.Setter{
+		stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername("alice"), stun.NewRealm("test.realm"), stun.NewNonce("nonce"),
+		stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}},
+	}
+	if lifetime >= 0 {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+		setters = append(setters, stun.RawAttribute{Type: stun.AttrLifetime, Value: value})
+	}
+	setters = append(setters, stun.MessageIntegrity(key), stun.Fingerprint)
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Raw
+}
+
+// Requests above the maximum, and without a lifetime when the default
+// isn't the TURN server's, are rewritten; everything else is left alone
+func TestEnforceAllocationLifetime(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50123}
+	tests := []struct {
+		name      string
+		maximum   time.Duration
+		fallback  time.Duration
+		requested time.Duration // Negative: no LIFETIME
+		granted   time.Duration // 0: left alone
+	}{
+		{"above the maximum", 10 * time.Minute, 5 * time.Minute, 50 * time.Minute, 10 * time.Minute},
+		{"at the maximum", 10 * time.Minute, 5 * time.Minute, 10 * time.Minute, 0},
+		{"no maximum", 0, defaultTURNLifetime, 50 * time.Minute, 0},
+		{"deletion", 10 * time.Minute, 5 * time.Minute, 0, 0},
+		{"no lifetime, own default", 0, 5 * time.Minute, -1, 5 * time.Minute},
+		{"no lifetime, default capped", 2 * time.Minute, 5 * time.Minute, -1, 2 * time.Minute},
+		{"no lifetime, server default", 0, defaultTURNLifetime, -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := useAllocationLifetime(t, tt.maximum, tt.fallback)
+			request := allocateRequest(t, key, tt.requested)
+			rewritten := enforceAllocationLifetime(request, addr)
+			if tt.granted == 0 {
+				if rewritten != nil {
+					t.Fatal("request rewritten, want it left alone")
+				}
+				return
+			}
+			if rewritten == nil {
+				t.Fatalf("request left alone, want %s granted", tt.granted)
+			}
+
+			msg := &stun.Message{Raw: rewritten}
+			if err := msg.Decode(); err != nil {
+				t.Fatalf("rewritten request: %v", err)
+			}
+			value, err := msg.Get(stun.AttrLifetime)
+			if err != nil || len(value) != 4 {
+				t.Fatalf("LIFETIME %x, %v", value, err)
+			}
+			if got := time.Duration(binary.BigEndian.Uint32(value)) * time.Second; got != tt.granted {
+				t.Fatalf("LIFETIME %s, want %s", got, tt.granted)
+			}
+			// Signed again, so the TURN server accepts it
+			if err := stun.MessageIntegrity(key).Check(msg); err != nil {
+				t.Fatalf("MESSAGE-INTEGRITY of the rewritten request: %v", err)
+			}
+			if err := stun.Fingerprint.Check(msg); err != nil {
+				t.Fatalf("FINGERPRINT of the rewritten request: %v", err)
+			}
+			original := &stun.Message{Raw: request}
+			original.Decode()
+			if msg.Type != original.Type || msg.TransactionID != original.TransactionID {
+				t.Fatalf("rewritten %s %x, want %s %x", msg.Type, msg.TransactionID, original.Type, original.TransactionID)
+			}
+			for _, attr := range []stun.AttrType{stun.AttrUsername, stun.AttrRealm, stun.AttrNonce, stun.AttrRequestedTransport} {
+				if !msg.Contains(attr) {
+					t.Fatalf("rewritten request lost %s", attr)
+				}
+			}
+		})
+	}
+}
+
+func TestEnforceAllocationLifetimeLogsClamp(t *testing.T) {
+	logs := captureLogs(t)
+	key := useAllocationLifetime(t, 10*time.Minute, 5*time.Minute)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50123}
+	if enforceAllocationLifetime(allocateRequest(t, key, 50*time.Minute), addr) == nil {
+		t.Fatal("request left alone")
+	}
+	if want := "Clamped allocation lifetime for user alice from 192.0.2.1:50123: requested 50m0s, granted 10m0s"; !strings.Contains(logs.String(), want) {
+		t.Fatalf("logged %q, want %q", logs.String(), want)
+	}
+}
+
+// A request the rewrite can't vouch for is passed on untouched, so signing
+// it again never makes it valid
+func TestEnforceAllocationLifetimeUntrusted(t *testing.T) {
+	useAllocationLifetime(t, 10*time.Minute, 5*time.Minute)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50123}
+
+	forged := allocateRequest(t, stun.NewLongTermIntegrity("alice", "test.realm", "guess"), 50*time.Minute)
+	if enforceAllocationLifetime(forged, addr) != nil {
+		t.Fatal("request with a wrong MESSAGE-INTEGRITY rewritten")
+	}
+	unauthenticated, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enforceAllocationLifetime(unauthenticated.Raw, addr) != nil {
+		t.Fatal("unauthenticated request rewritten")
+	}
+	binding, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enforceAllocationLifetime(binding.Raw, addr) != nil {
+		t.Fatal("Binding request rewritten")
+	}
+	if enforceAllocationLifetime([]byte{0, 3, 0, 8}, addr) != nil {
+		t.Fatal("truncated request rewritten")
+	}
+}
+
+// /ice-config tells frontends the allocation lifetime policy on its TURN
+// entries
+func TestICEConfigAllocationLifetime(t *testing.T) {
+	savedEnabled, savedMode, savedIP := stunturnEnabled, serverMode, publicIP
+	savedUDP, savedTCP := udpBoundPorts, tcpBoundPorts
+	t.Cleanup(func() {
+		stunturnEnabled, serverMode, publicIP = savedEnabled, savedMode, savedIP
+		udpBoundPorts, tcpBoundPorts = savedUDP, savedTCP
+	})
+	stunturnEnabled, serverMode, publicIP = true, modeBoth, "203.0.113.1"
+	udpBoundPorts, tcpBoundPorts = []int{3478}, []int{3478}
+
+	for _, tt := range []struct {
+		maximum     time.Duration
+		wantDefault int
+		wantMax     int
+	}{
+		{0, 600, 3599},
+		{5 * time.Minute, 300, 300},
+	} {
+		useAllocationLifetime(t, tt.maximum, defaultTURNLifetime)
+		rec := httptest.NewRecorder()
+		handleICEConfig(rec, httptest.NewRequest(http.MethodGet, "/ice-config", nil))
+		var servers []iceServer
+		if err := json.Unmarshal(rec.Body.Bytes(), &servers); err != nil {
+			t.Fatalf("/ice-config: %v", err)
+		}
+		if len(servers) != 2 {
+			t.Fatalf("/ice-config listed %+v, want a STUN and a TURN entry", servers)
+		}
+		if stunEntry := servers[0]; stunEntry.DefaultAllocationLifetime != 0 || stunEntry.MaxAllocationLifetime != 0 {
+			t.Fatalf("STUN entry %+v carries a lifetime policy", stunEntry)
+		}
+		turnEntry := servers[1]
+		if turnEntry.DefaultAllocationLifetime != tt.wantDefault || turnEntry.MaxAllocationLifetime != tt.wantMax {
+			t.Fatalf("max %s: TURN entry has default %d, max %d; want %d, %d", tt.maximum,
+				turnEntry.DefaultAllocationLifetime, turnEntry.MaxAllocationLifetime, tt.wantDefault, tt.wantMax)
+		}
+	}
+}
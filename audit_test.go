@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+
+	"github.com/pion/turn/v4"
+)
+
+// useAuditLog writes the audit log to a new file until the test ends, and
+// returns its path
+func useAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	saved := auditLog
+	auditLog = logger
+	t.Cleanup(func() {
+		auditLog = saved
+		logger.file.Close()
+	})
+	return path
+}
+
+// readAuditLog checks the audit log's integrity and returns its entries
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	n, err := verifyAuditLog(path)
+	if err != nil {
+		t.Fatalf("verify audit log: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	entries := make([]auditEntry, 0, n)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != n {
+		t.Fatalf("verifyAuditLog counted %d entries, the file has %d", n, len(entries))
+	}
+	return entries
+}
+
+// findAuthEntry returns the first turn_auth entry with the given result
+// and transport
+func findAuthEntry(entries []auditEntry, result, transport string) (auditEntry, bool) {
+	for _, entry := range entries {
+		if entry.Event == "turn_auth" && entry.Result == result && entry.Transport == transport {
+			return entry, true
+		}
+	}
+	return auditEntry{}, false
+}
+
+// TURN authentications over UDP and TCP, successful or not, are recorded
+// with the user, realm, source IP and transport
+func TestAuditTURNAuthentication(t *testing.T) {
+	logs := captureLogs(t)
+	path := useAuditLog(t)
+	server := startIntegrationServers(t).STUNTURNAddr()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	checkBindingAndAllocation(t, server, conn, conn.LocalAddr())
+
+	// The auth handler only looks the user up: a wrong password is caught
+	// by pion's integrity check, an unknown user by the handler
+	unknown, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer unknown.Close()
+	c, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: server,
+		TURNServerAddr: server,
+		Conn:           unknown,
+		Username:       "mallory",
+		Password:       "secret",
+		Realm:          "pion.ly",
+	})
+	if err != nil {
+		t.Fatalf("create TURN client: %v", err)
+	}
+	if err := c.Listen(); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if _, err := c.Allocate(); err == nil {
+		t.Fatal("allocation for an unknown user succeeded")
+	}
+	c.Close()
+
+	tcpConn, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	checkBindingAndAllocation(t, server, turn.NewSTUNConn(tcpConn), tcpConn.LocalAddr())
+	tcpConn.Close()
+	waitClosed(t, logs, time.Now())
+
+	entries := readAuditLog(t, path)
+	for _, want := range []struct{ result, transport, username string }{
+		{"success", "UDP", "alice"},
+		{"failure", "UDP", "mallory"},
+		{"success", "TCP", "alice"},
+	} {
+		entry, ok := findAuthEntry(entries, want.result, want.transport)
+		if !ok {
+			t.Fatalf("no %s %s authentication in %+v", want.result, want.transport, entries)
+		}
+		if entry.Username != want.username || entry.Realm != "pion.ly" || entry.SourceIP != "127.0.0.1" {
+			t.Fatalf("%s %s entry %+v, want %s in pion.ly from 127.0.0.1", want.result, want.transport, entry, want.username)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Time); err != nil {
+			t.Fatalf("entry time %q isn't RFC3339: %v", entry.Time, err)
+		}
+	}
+}
+
+// Admin requests to the server and to the signaling package are recorded
+// with their action, origin and details
+func TestAuditAdminActions(t *testing.T) {
+	path := useAuditLog(t)
+	webrtc.ConfigureAudit(auditAdminAction)
+	t.Cleanup(func() { webrtc.ConfigureAudit(nil) })
+	signalingLogger := log.New(io.Discard, "", 0)
+
+	req := httptest.NewRequest(http.MethodDelete, "/admin/droplist", nil)
+	req.RemoteAddr = "198.51.100.2:40000"
+	handleDropList(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/capture?user=bob&duration=1m", nil)
+	req.RemoteAddr = "198.51.100.3:40000"
+	recorder := httptest.NewRecorder()
+	webrtc.HandleCapture(recorder, req, signalingLogger)
+	var info webrtc.CaptureInfo
+	if err := json.NewDecoder(recorder.Body).Decode(&info); err != nil {
+		t.Fatalf("decode capture: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodDelete, "/admin/capture/"+info.ID, nil)
+	req.RemoteAddr = "198.51.100.3:40000"
+	webrtc.HandleCapture(httptest.NewRecorder(), req, signalingLogger)
+
+	entries := readAuditLog(t, path)
+	want := []auditEntry{
+		{Event: "admin", Action: "droplist_clear", RemoteAddr: "198.51.100.2:40000"},
+		{Event: "admin", Action: "capture_start", RemoteAddr: "198.51.100.3:40000", Details: map[string]string{"id": info.ID, "user": "bob", "duration": "1m0s"}},
+		{Event: "admin", Action: "capture_stop", RemoteAddr: "198.51.100.3:40000", Details: map[string]string{"id": info.ID, "user": "bob"}},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		entry.Time = ""
+		if fmt.Sprint(entry) != fmt.Sprint(want[i]) {
+			t.Fatalf("entry %d is %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+// Entries written at the same time never interleave
+func TestAuditConcurrentWrites(t *testing.T) {
+	path := useAuditLog(t)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				auditLog.admin("test", "192.0.2.1:1", map[string]string{"writer": fmt.Sprint(g), "entry": fmt.Sprint(i), "padding": strings.Repeat("x", 512)})
+			}
+		}()
+	}
+	wg.Wait()
+	if entries := readAuditLog(t, path); len(entries) != 800 {
+		t.Fatalf("%d entries, want 800", len(entries))
+	}
+}
+
+// verifyAuditLog names the first line that isn't a complete entry
+func TestVerifyAuditLog(t *testing.T) {
+	good := `{"time":"2025-01-02T15:04:05.123Z","event":"turn_auth","result":"success","username":"alice","realm":"pion.ly","sourceIP":"203.0.113.5","transport":"UDP"}` + "\n" +
+		`{"time":"2025-01-02T15:05:00Z","event":"admin","action":"droplist_clear","remoteAddr":"127.0.0.1:53412"}` + "\n"
+	for _, tc := range []struct {
+		name    string
+		data    string
+		entries int
+		err     string
+	}{
+		{"empty", "", 0, ""},
+		{"good", good, 2, ""},
+		{"cut short", good + `{"time":"2025-01-02T15:06:00Z","ev`, 0, "last line is incomplete"},
+		{"cut short with newline", good + `{"time":"2025-01-02T15:06:00Z","ev` + "\n", 2, "line 3: invalid entry"},
+		{"unknown field", `{"time":"2025-01-02T15:06:00Z","event":"admin","extra":1}` + "\n", 0, "line 1: invalid entry"},
+		{"two entries on a line", strings.TrimSuffix(good, "\n") + `{"time":"2025-01-02T15:06:00Z","event":"admin"}` + "\n", 1, "line 2: trailing data"},
+		{"bad time", good + `{"time":"yesterday","event":"admin"}` + "\n", 2, `line 3: invalid time "yesterday"`},
+		{"missing event", `{"time":"2025-01-02T15:06:00Z"}` + "\n" + good, 0, "line 1: missing event"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			if err := os.WriteFile(path, []byte(tc.data), 0600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			entries, err := verifyAuditLog(path)
+			if entries != tc.entries {
+				t.Errorf("%d entries, want %d", entries, tc.entries)
+			}
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("error %v, want none", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenUDP opens a loopback UDP socket, batched if batched is set
+func listenUDP(tb testing.TB, batched bool) net.PacketConn {
+	tb.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	if batched {
+		if runtime.GOOS != "linux" {
+			conn.Close()
+			tb.Skip("batched UDP I/O is Linux only")
+		}
+		saved := udpBatch
+		udpBatch = true
+		conn = newBatchPacketConn(conn)
+		udpBatch = saved
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Packets sent and received through batchPacketConn are the same bytes,
+// from the same address, as through the plain socket
+func TestBatchPacketConnRoundTrip(t *testing.T) {
+	server := listenUDP(t, true)
+	client := listenUDP(t, false)
+
+	request := stunBindingRequest()
+	for i := 0; i < 3; i++ {
+		if _, err := client.WriteTo(request, server.LocalAddr()); err != nil {
+			t.Fatalf("client write: %v", err)
+		}
+	}
+	buf := make([]byte, 1500)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("server read %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], request) || addr.String() != client.LocalAddr().String() {
+			t.Fatalf("server read %x from %s, want %x from %s", buf[:n], addr, request, client.LocalAddr())
+		}
+		if class := classifySTUNTURN(buf[:n]); class != stunClassControl {
+			t.Fatalf("batched read classified as %d, want a control message", class)
+		}
+	}
+
+	response := append(stunBindingRequest(), "reply"...)
+	if _, err := server.WriteTo(response, client.LocalAddr()); err != nil {
+		t.Fatalf("server write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], response) || addr.String() != server.LocalAddr().String() {
+		t.Fatalf("client read %x from %s, want %x from %s", buf[:n], addr, response, server.LocalAddr())
+	}
+}
+
+// benchmarkUDPRead reads relay-sized packets that a batched sender keeps
+// sending as fast as it can
+func benchmarkUDPRead(b *testing.B, batched bool) {
+	server := listenUDP(b, batched)
+	sender := listenUDP(b, true)
+	packet := make([]byte, 1200)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				sender.WriteTo(packet, server.LocalAddr())
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	buf := make([]byte, 1500)
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			b.Fatalf("read: %v", err)
+		}
+	}
+	reportBatching(b, server)
+}
+
+// benchmarkUDPWrite sends relay-sized packets from parallel goroutines, as
+// the TURN server does, to a socket nobody reads; the kernel drops what
+// doesn't fit, which doesn't slow the senders
+func benchmarkUDPWrite(b *testing.B, batched bool) {
+	server := listenUDP(b, batched)
+	sink := listenUDP(b, false)
+	packet := make([]byte, 1200)
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := server.WriteTo(packet, sink.LocalAddr()); err != nil {
+				b.Errorf("write: %v", err)
+				return
+			}
+		}
+	})
+	reportBatching(b, server)
+}
+
+// reportBatching reports how many packets each recvmmsg/sendmmsg call
+// moved, which is what saves the syscalls on a multi-core host
+func reportBatching(b *testing.B, conn net.PacketConn) {
+	batchConn, ok := conn.(*batchPacketConn)
+	if !ok {
+		return
+	}
+	if batches := batchConn.batchesIn.Load(); batches > 0 {
+		b.ReportMetric(float64(batchConn.packetsIn.Load())/float64(batches), "packets/recvmmsg")
+	}
+	if batches := batchConn.batchesOut.Load(); batches > 0 {
+		b.ReportMetric(float64(batchConn.packetsOut.Load())/float64(batches), "packets/sendmmsg")
+	}
+}
+
+func BenchmarkUDPReadPlain(b *testing.B)   { benchmarkUDPRead(b, false) }
+func BenchmarkUDPReadBatched(b *testing.B) { benchmarkUDPRead(b, true) }
+
+func BenchmarkUDPWritePlain(b *testing.B)   { benchmarkUDPWrite(b, false) }
+func BenchmarkUDPWriteBatched(b *testing.B) { benchmarkUDPWrite(b, true) }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+)
+
+// The day's counts, the success ratio without transferred calls, the
+// rollover into the daily report and the metrics
+func TestCallOutcomeCounter(t *testing.T) {
+	saved := callOutcomes
+	t.Cleanup(func() { callOutcomes = saved })
+	callOutcomes = newCallOutcomeCounter(time.Now())
+	calls := []struct {
+		outcome           string
+		answered, relayed bool
+	}{
+		{webrtc.CallCompleted, true, true},
+		{webrtc.CallCompleted, true, false},
+		{webrtc.CallCancelled, false, false},
+		{webrtc.CallDeclined, false, false},
+		{webrtc.CallTimeout, false, false},
+		{webrtc.CallPeerDisconnected, true, true},
+		{webrtc.CallTransferred, true, false},
+	}
+	for _, call := range calls {
+		callOutcomes.observe(call.outcome, call.answered, call.relayed)
+	}
+
+	day := callOutcomes.today()
+	if day.Calls != 7 || day.Answered != 4 || day.Relayed != 2 || day.Outcomes[webrtc.CallCompleted] != 2 || day.Outcomes[webrtc.CallTransferred] != 1 {
+		t.Fatalf("today %+v", day)
+	}
+	// Two of the six calls that weren't transferred completed
+	if day.SuccessRatio != 2.0/6 {
+		t.Fatalf("success ratio %g, want %g", day.SuccessRatio, 2.0/6)
+	}
+
+	var metrics bytes.Buffer
+	writeMetrics(&metrics)
+	for _, line := range []string{
+		`signaling_calls_total{outcome="completed",relayed="true"} 1`,
+		`signaling_calls_total{outcome="completed",relayed="false"} 1`,
+		`signaling_calls_total{outcome="peer-disconnected",relayed="true"} 1`,
+		`signaling_calls_today{outcome="declined"} 1`,
+		`signaling_calls_answered_today 4`,
+		`signaling_calls_relayed_today 2`,
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Fatalf("metrics without %q", line)
+		}
+	}
+
+	// Once the day is over its counts wait for the report, and the next
+	// day starts from zero; the totals since the start carry on
+	callOutcomes.mu.Lock()
+	ended := time.Now()
+	callOutcomes.end = ended
+	callOutcomes.mu.Unlock()
+	callOutcomes.observe(webrtc.CallCompleted, true, false)
+	if day := callOutcomes.today(); day.Calls != 1 || day.SuccessRatio != 1 {
+		t.Fatalf("the next day starts with %+v, want the one call", day)
+	}
+	finished := callOutcomes.takeFinished()
+	if len(finished) != 1 || finished[0].Calls != 7 || !finished[0].PeriodEnd.Equal(ended) || finished[0].SuccessRatio != 2.0/6 {
+		t.Fatalf("finished days %+v, want the first day's 7 calls", finished)
+	}
+	if finished := callOutcomes.takeFinished(); len(finished) != 0 {
+		t.Fatalf("finished days reported twice: %+v", finished)
+	}
+	if total := callOutcomes.total(webrtc.CallCompleted, false); total != 2 {
+		t.Fatalf("%d completed calls without a relay since the start, want 2", total)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertPair writes a self-signed certificate for name and its key to
+// dir, and returns the name=cert.pem:key.pem pair for -tls-cert-pair
+func writeCertPair(t *testing.T, dir, name string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := strings.ReplaceAll(name, "*", "wildcard")
+	certFile, keyFile := filepath.Join(dir, file+".pem"), filepath.Join(dir, file+"-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return name + "=" + certFile + ":" + keyFile
+}
+
+// servedName returns the common name of the certificate a TLS handshake
+// asking for serverName gets from set
+func servedName(t *testing.T, set *certificateSet, serverName string) string {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, &tls.Config{GetCertificate: set.getCertificate})
+	go server.Handshake()
+	client := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("handshake for %q: %v", serverName, err)
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// Each name gets its own certificate, a wildcard covers one label and loses
+// to an exact name, and other names get the default
+func TestCertificatesBySNI(t *testing.T) {
+	dir := t.TempDir()
+	pairs := []string{
+		writeCertPair(t, dir, "turn.customer-a.com"),
+		writeCertPair(t, dir, "*.customer-b.com"),
+		writeCertPair(t, dir, "special.customer-b.com"),
+	}
+	set, err := loadCertificates(pairs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ serverName, want string }{
+		{"turn.customer-a.com", "turn.customer-a.com"},
+		{"TURN.Customer-A.com.", "turn.customer-a.com"}, // Case and a trailing dot don't matter
+		{"turn.customer-b.com", "*.customer-b.com"},
+		{"special.customer-b.com", "special.customer-b.com"},
+		{"a.turn.customer-b.com", "turn.customer-a.com"}, // A wildcard covers one label only
+		{"customer-b.com", "turn.customer-a.com"},
+		{"", "turn.customer-a.com"}, // No SNI: the first pair, without certs/ or -tls-default-cert
+	} {
+		if got := servedName(t, set, tt.serverName); got != tt.want {
+			t.Errorf("%q got the certificate of %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+
+	set, err = loadCertificates(pairs, "Special.Customer-B.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, set, "unknown.example.org"); got != "special.customer-b.com" {
+		t.Errorf("with -tls-default-cert an unknown name got %q, want special.customer-b.com", got)
+	}
+}
+
+func TestLoadCertificatesErrors(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeCertPair(t, dir, "turn.example.com")
+	for _, tt := range []struct {
+		name        string
+		pairs       []string
+		defaultName string
+		want        string
+	}{
+		{"no files", []string{"turn.example.com"}, "", "want name=cert.pem:key.pem"},
+		{"no key", []string{"turn.example.com=cert.pem"}, "", "want name=cert.pem:key.pem"},
+		{"duplicate", []string{pair, strings.ToUpper(pair[:1]) + pair[1:]}, "", "listed twice"},
+		{"missing file", []string{"other.example.com=" + filepath.Join(dir, "none.pem") + ":" + filepath.Join(dir, "none-key.pem")}, "", "other.example.com"},
+		{"unknown default", []string{pair}, "other.example.com", "not a -tls-cert-pair name"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadCertificates(tt.pairs, tt.defaultName); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+
+	// Without any certificate the TLS listeners stay off
+	set, err := loadCertificates(nil, "")
+	if set != nil || err != nil {
+		t.Fatalf("no pairs loaded %v, %v; want nil, nil", set, err)
+	}
+}
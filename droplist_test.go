@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// floodPacketConn serves a flood of garbage from one source, with a valid
+// STUN request from another source every legitEvery packets
+type floodPacketConn struct {
+	net.PacketConn
+	flooder, legit net.Addr
+	legitEvery     int
+	reads          int // Packets served, dropped ones included
+}
+
+func (c *floodPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.reads++
+	if c.reads%c.legitEvery == 0 {
+		return copy(p, stunBindingRequest()), c.legit, nil
+	}
+	return copy(p, "GET / HTTP/1.1\r\nHost: flood\r\n"), c.flooder, nil
+}
+
+func (c *floodPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}
+}
+
+// useDropList gives the test its own drop list and unknown traffic window,
+// dropping a source after threshold offenses
+func useDropList(tb testing.TB, threshold int) {
+	tb.Helper()
+	savedThreshold, savedCooldown := dropThreshold, dropCooldown
+	savedList, savedTraffic := sourceDropList, unknownTraffic
+	tb.Cleanup(func() {
+		dropThreshold, dropCooldown = savedThreshold, savedCooldown
+		sourceDropList, unknownTraffic = savedList, savedTraffic
+	})
+	dropThreshold, dropCooldown = threshold, time.Minute
+	sourceDropList = &dropList{}
+	unknownTraffic = &unknownTrafficTracker{sources: make(map[netip.Addr]sourceOffenses)}
+}
+
+// newFloodConn wraps a floodPacketConn in a LoggingPacketConn
+func newFloodConn(legitEvery int) (*LoggingPacketConn, *floodPacketConn) {
+	flood := &floodPacketConn{
+		flooder:    &net.UDPAddr{IP: net.IPv4(198, 51, 100, 66), Port: 40000},
+		legit:      &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 50000},
+		legitEvery: legitEvery,
+	}
+	return NewLoggingPacketConn(flood, NewSTUNTurnLogger(stunTurnLog), "flood", "UDP"), flood
+}
+
+// A flooding source is dropped once it crosses the threshold: its packets
+// stop reaching the classifier and the TURN server, and a legitimate source
+// sharing the listener is unaffected
+func TestDropListStopsFlood(t *testing.T) {
+	const threshold = 50
+	useDropList(t, threshold)
+	conn, flood := newFloodConn(10)
+	unknownBefore := inboundClassCounts[stunClassUnknown].Load()
+	droppedBefore := droppedPackets.Load()
+
+	buf := make([]byte, 1500)
+	fromFlooder, fromLegit := 0, 0
+	for i := 0; i < 1000; i++ {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		switch addr {
+		case flood.flooder:
+			fromFlooder++
+		case flood.legit:
+			if classifySTUNTURN(buf[:n]) != stunClassControl {
+				t.Fatalf("legitimate packet %d came through as %x", fromLegit, buf[:n])
+			}
+			fromLegit++
+		}
+	}
+
+	if fromFlooder != threshold {
+		t.Fatalf("%d flood packets reached the TURN server, want %d", fromFlooder, threshold)
+	}
+	if fromLegit != 1000-threshold {
+		t.Fatalf("%d legitimate packets came through, want %d", fromLegit, 1000-threshold)
+	}
+	if unknown := inboundClassCounts[stunClassUnknown].Load() - unknownBefore; unknown != threshold {
+		t.Fatalf("classified %d flood packets, want only the %d before the drop", unknown, threshold)
+	}
+	dropped := droppedPackets.Load() - droppedBefore
+	if want := uint64(flood.reads - 1000); dropped != want {
+		t.Fatalf("dropped %d packets, want %d", dropped, want)
+	}
+	if !sourceDropList.contains(flood.flooder) || sourceDropList.contains(flood.legit) {
+		t.Fatalf("drop list %v, want only the flooder", sourceDropList.list())
+	}
+}
+
+// BenchmarkDropListFlood reads from a listener where 99 of every 100
+// packets come from a dropped source. The cost per packet stays that of
+// one map lookup however many sources are on the list.
+func BenchmarkDropListFlood(b *testing.B) {
+	for _, listed := range []int{1, 10000} {
+		b.Run(formatCount(uint64(listed))+" listed", func(b *testing.B) {
+			useDropList(b, 1)
+			conn, flood := newFloodConn(100)
+			expiry := time.Now().Add(time.Hour)
+			sourceDropList.update(func(entries map[netip.Addr]time.Time) {
+				entries[netip.MustParseAddr("198.51.100.66")] = expiry
+				for i := 1; i < listed; i++ {
+					entries[netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})] = expiry
+				}
+			})
+
+			buf := make([]byte, 1500)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := conn.ReadFrom(buf); err != nil {
+					b.Fatalf("read: %v", err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(flood.reads), "ns/packet")
+		})
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Server Event Bus
+================
+
+This package publishes what happens in the server, such as users joining,
+calls ending, relay allocations and failed TURN authentications, as typed
+events that Go code running in the same process can subscribe to.
+
+WHY IS THIS NEEDED?
+===================
+Programs embedding the server want to react to these events, e.g. to bill
+a call, alert on a burst of failed authentications or keep their own user
+directory up to date. Until now the only way was to scrape the logs, whose
+lines were never meant to be parsed and change with the redaction level.
+
+HOW IT WORKS:
+=============
+A Bus keeps a list of subscribers, each with a Filter and a channel. Publish
+hands an event to every subscriber whose filter accepts it, without ever
+blocking: the channel's capacity is the subscriber's buffer, and an event
+that doesn't fit is dropped and counted on the subscription (see
+Subscription.Dropped). A slow subscriber loses events; it can't stall the
+TURN server or the signaling handlers that publish them.
+
+Events are published from:
+- the signaling service (see webrtc/events.go): UserJoined, UserLeft,
+  CallStarted, CallEnded
+- the TURN auth handler and allocation callbacks (see main.go): AuthFailed,
+  AllocationCreated, AllocationDeleted
+
+A subscriber that needs every event must keep up: size its channel for
+bursts and read it from a goroutine of its own.
+
+	ch := make(chan events.Event, 256)
+	sub := bus.Subscribe(events.Kinds(events.KindCallEnded), ch)
+	go func() {
+		for event := range ch {
+			ended := event.(events.CallEnded)
+			bill(ended.Caller, ended.Callee, ended.Duration)
+		}
+	}()
+*/
+
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind names the type of an event
+type Kind string
+
+// Event kinds, one per event struct
+const (
+	KindUserJoined        Kind = "user.joined"
+	KindUserLeft          Kind = "user.left"
+	KindCallStarted       Kind = "call.started"
+	KindCallEnded         Kind = "call.ended"
+	KindAllocationCreated Kind = "allocation.created"
+	KindAllocationDeleted Kind = "allocation.deleted"
+	KindAuthFailed        Kind = "auth.failed"
+)
+
+// Event is one of the event structs below; switch on its type, or on Kind
+type Event interface {
+	Kind() Kind
+}
+
+// UserJoined is published when a user joins signaling, including a client
+// replacing its own session. A client resuming a session it lost (protocol
+// v2) never left, so its resume is not an event.
+type UserJoined struct {
+	Time      time.Time
+	Tenant    string // "" for the default tenant
+	Username  string
+	SessionID string // The connection's remote address, as in /admin/sessions
+	ClientIP  string
+	Protocol  int  // Signaling protocol version
+	Guest     bool // The name was generated, see -allow-guests
+}
+
+// UserLeft reasons
+const (
+	LeftDisconnected  = "disconnected"   // Left, or the connection closed without a resume token
+	LeftResumeExpired = "resume-expired" // The connection was lost and not resumed in time
+	LeftKicked        = "kicked"         // Kicked by an admin
+)
+
+// UserLeft is published when a user's signaling session ends
+type UserLeft struct {
+	Time     time.Time
+	Tenant   string
+	Username string
+	Reason   string // LeftDisconnected, LeftResumeExpired or LeftKicked
+}
+
+// CallStarted is published when a call starts ringing
+type CallStarted struct {
+	Time   time.Time
+	Tenant string
+	CallID string
+	Caller string
+	Callee string
+}
+
+// CallEnded is published when a call ends, however it ended
+type CallEnded struct {
+	Time     time.Time
+	Tenant   string
+	CallID   string
+	Caller   string
+	Callee   string
+	Outcome  string        // completed, cancelled, declined, timeout, peer-disconnected or transferred
+	Answered bool          // The callee accepted the call
+	Relayed  bool          // A relay candidate was forwarded, so the call likely used TURN
+	Duration time.Duration // From the start of ringing
+}
+
+// AllocationCreated is published when a TURN relay allocation is created
+type AllocationCreated struct {
+	Time       time.Time
+	Username   string
+	Realm      string
+	ClientAddr string
+	RelayAddr  string
+	Transport  string // Between client and server: UDP, TCP, ...
+}
+
+// AllocationDeleted is published when a TURN relay allocation is deleted,
+// whether it expired, was refreshed to 0 or its connection closed
+type AllocationDeleted struct {
+	Time       time.Time
+	Username   string
+	Realm      string
+	ClientAddr string
+	Transport  string
+}
+
+// AuthFailed reasons
+const (
+	AuthUnknownUser  = "unknown-user"
+	AuthUnknownRealm = "unknown-realm"
+	AuthBanned       = "banned"
+)
+
+// AuthFailed is published when a TURN authentication is refused. A wrong
+// password for a known user is caught by the TURN library's integrity
+// check afterwards and isn't reported.
+type AuthFailed struct {
+	Time       time.Time
+	Username   string
+	Realm      string
+	ClientAddr string
+	Reason     string // AuthUnknownUser, AuthUnknownRealm or AuthBanned
+}
+
+func (UserJoined) Kind() Kind        { return KindUserJoined }
+func (UserLeft) Kind() Kind          { return KindUserLeft }
+func (CallStarted) Kind() Kind       { return KindCallStarted }
+func (CallEnded) Kind() Kind         { return KindCallEnded }
+func (AllocationCreated) Kind() Kind { return KindAllocationCreated }
+func (AllocationDeleted) Kind() Kind { return KindAllocationDeleted }
+func (AuthFailed) Kind() Kind        { return KindAuthFailed }
+
+// Filter picks the events a subscriber gets; nil gets every event
+type Filter func(Event) bool
+
+// Kinds returns a filter accepting the events of the given kinds
+func Kinds(kinds ...Kind) Filter {
+	accepted := make(map[Kind]bool, len(kinds))
+	for _, kind := range kinds {
+		accepted[kind] = true
+	}
+	return func(event Event) bool {
+		return accepted[event.Kind()]
+	}
+}
+
+// Bus delivers published events to its subscribers. The zero value is not
+// usable; create one with NewBus. A nil *Bus publishes nothing.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// NewBus creates a bus without subscribers
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscription is one subscriber of a bus
+type Subscription struct {
+	bus       *Bus
+	filter    Filter
+	ch        chan<- Event
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// Subscribe delivers the events filter accepts to ch until Unsubscribe is
+// called. Events that don't fit in ch are dropped, so give it a buffer; an
+// unbuffered channel only gets the events published while it is being
+// received from.
+func (b *Bus) Subscribe(filter Filter, ch chan<- Event) *Subscription {
+	sub := &Subscription{bus: b, filter: filter, ch: ch}
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Publish delivers an event to every subscriber that accepts it, never
+// blocking
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+			sub.delivered.Add(1)
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Unsubscribe stops the delivery of events. Once it returns nothing more is
+// sent on the channel, so the subscriber may close it.
+func (s *Subscription) Unsubscribe() {
+	s.bus.mu.Lock()
+	delete(s.bus.subscribers, s)
+	s.bus.mu.Unlock()
+}
+
+// Delivered returns how many events were delivered to the subscriber
+func (s *Subscription) Delivered() uint64 {
+	return s.delivered.Load()
+}
+
+// Dropped returns how many events the subscriber missed because its channel
+// was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/pion/stun/v3"
+)
+
+// FuzzParseSTUNTURN feeds arbitrary packets, as a client could send them,
+// to the code that looks at every STUN/TURN packet before the TURN server
+// does. None of it may panic, and the responses it builds must be well
+// formed answers to the request they answer. The seed corpus in
+// testdata/fuzz/FuzzParseSTUNTURN holds captured requests, responses,
+// indications and ChannelData, DTLS and HTTP traffic, and truncated
+// messages and messages with lengths longer than the packet.
+func FuzzParseSTUNTURN(f *testing.F) {
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 50123}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		name := parseSTUNTURNMessage(data)
+		hasCookie := len(data) >= 20 && binary.BigEndian.Uint32(data[4:8]) == 0x2112A442
+		if (name != "") != hasCookie {
+			t.Fatalf("parsed %q from %x", name, data)
+		}
+		if name != "" && name != getMessageTypeName(binary.BigEndian.Uint16(data[0:2])) {
+			t.Fatalf("parsed %q from %x, not the name of its type", name, data)
+		}
+		if got := getSTUNTURNMessageType(data); got != name {
+			t.Fatalf("message type %q, parsed %q", got, name)
+		}
+		classifySTUNTURN(data)
+
+		tracker := &latencyTracker{
+			pending:    make(map[[12]byte]pendingTransaction),
+			histograms: make(map[latencyKey]*latencyHistogram),
+			orphaned:   make(map[latencyKey]uint64),
+		}
+		tracker.observe(data, "UDP", true)
+		tracker.observe(data, "UDP", false)
+
+		for _, res := range [][]byte{stunBindingResponse(data, addr), refuseTCPRelay(data, addr)} {
+			if res == nil {
+				continue
+			}
+			msg := &stun.Message{Raw: res}
+			if err := msg.Decode(); err != nil {
+				t.Fatalf("response %x to %x doesn't decode: %v", res, data, err)
+			}
+			if !bytes.Equal(msg.TransactionID[:], data[8:20]) {
+				t.Fatalf("response %x to %x has another transaction ID", res, data)
+			}
+		}
+		// No users are configured, so no request is authenticated to rewrite
+		if rewritten := enforceAllocationLifetime(data, addr); rewritten != nil {
+			t.Fatalf("rewrote %x without users to %x", data, rewritten)
+		}
+	})
+}
@@ -30,9 +30,11 @@ if %errorlevel% neq 0 (
 )
 echo.
 
-REM Build the server
+REM Build the server, stamping the commit (see -version)
 echo Building go-server.exe...
-go build -o go-server.exe -ldflags="-s -w" .
+set COMMIT=unknown
+for /f %%i in ('git rev-parse --short HEAD 2^>nul') do set COMMIT=%%i
+go build -o go-server.exe -ldflags="-s -w -X main.commit=%COMMIT%" .
 if %errorlevel% neq 0 (
     echo ERROR: Build failed
     pause
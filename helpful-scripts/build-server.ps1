@@ -43,8 +43,11 @@ Write-Host ""
 Write-Host "Building go-server.exe..." -ForegroundColor Yellow
 $buildStart = Get-Date
 
-# Build with optimizations
-go build -o go-server.exe -ldflags="-s -w" .
+# Build with optimizations, stamping the commit and build date (see -version)
+$commit = git rev-parse --short HEAD 2>$null
+if (-not $commit) { $commit = "unknown" }
+$buildDate = (Get-Date).ToUniversalTime().ToString("yyyy-MM-ddTHH:mm:ssZ")
+go build -o go-server.exe -ldflags="-s -w -X main.commit=$commit -X main.buildDate=$buildDate" .
 
 if ($LASTEXITCODE -ne 0) {
     Write-Host "ERROR: Build failed" -ForegroundColor Red
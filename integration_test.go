@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/turn/v4"
+)
+
+// The integration tests start the STUN/TURN listeners and the signaling
+// server the way main does, on ports the system picks, and drive them with
+// the pion/turn client and the Go signaling client
+
+// integrationPublicIP is the -public-ip of the test server. The relays are
+// bound on every interface, so it only shows up in the relayed addresses.
+const integrationPublicIP = "203.0.113.7"
+
+// startIntegrationServers starts the STUN/TURN listeners with one user,
+// alice, and the signaling server, until the test ends
+func startIntegrationServers(t *testing.T) *runningServers {
+	t.Helper()
+	servers, err := startServers(serverConfig{
+		Mode:      modeBoth,
+		PublicIP:  integrationPublicIP,
+		TURNUsers: "alice=secret",
+		Realm:     "pion.ly",
+		Signaling: true,
+	})
+	if err != nil {
+		t.Fatalf("start servers: %v", err)
+	}
+	t.Cleanup(servers.Close)
+	return servers
+}
+
+// waitRelaysStopped waits for the relays' packet handlers to return once
+// their allocations are gone. Until the servers close after them, nothing
+// orders the packets they forwarded through the listeners before the next
+// test changes the configuration the listeners read.
+func waitRelaysStopped(t *testing.T) {
+	t.Helper()
+	buf := make([]byte, 4<<20)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		n := runtime.Stack(buf, true)
+		if !bytes.Contains(buf[:n], []byte("(*Allocation).packetHandler")) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relays still running after their allocations were closed")
+		}
+	}
+}
+
+// checkBindingAndAllocation sends a binding request and allocates a relay
+// over conn, and checks the addresses the server reports
+func checkBindingAndAllocation(t *testing.T, server string, conn net.PacketConn, local net.Addr) {
+	t.Helper()
+	c, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: server,
+		TURNServerAddr: server,
+		Conn:           conn,
+		Username:       "alice",
+		Password:       "secret",
+		Realm:          "pion.ly",
+	})
+	if err != nil {
+		t.Fatalf("create TURN client: %v", err)
+	}
+	defer c.Close()
+	if err := c.Listen(); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	mapped, err := c.SendBindingRequest()
+	if err != nil {
+		t.Fatalf("binding request: %v", err)
+	}
+	if mapped.String() != local.String() {
+		t.Fatalf("binding response maps to %s, want %s", mapped, local)
+	}
+
+	relay, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	defer relay.Close()
+	relayed, ok := relay.LocalAddr().(*net.UDPAddr)
+	if !ok || relayed.IP.String() != integrationPublicIP || relayed.Port == 0 {
+		t.Fatalf("relayed address %s, want a port on %s", relay.LocalAddr(), integrationPublicIP)
+	}
+}
+
+func TestIntegrationSTUNTURN(t *testing.T) {
+	logs := captureLogs(t)
+	server := startIntegrationServers(t).STUNTURNAddr()
+
+	t.Run("UDP", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer conn.Close()
+		checkBindingAndAllocation(t, server, conn, conn.LocalAddr())
+	})
+
+	t.Run("TCP", func(t *testing.T) {
+		tcpConn, err := net.Dial("tcp", server)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		checkBindingAndAllocation(t, server, turn.NewSTUNConn(tcpConn), tcpConn.LocalAddr())
+		// The server's handler for the connection outlives the server, so
+		// wait for it before other tests change the configuration it reads
+		tcpConn.Close()
+		waitClosed(t, logs, time.Now())
+	})
+}
+
+// await waits for a value on ch
+func await[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	var zero T
+	return zero
+}
+
+// forwarded is a message as a client received it
+type forwarded struct {
+	from    string
+	payload json.RawMessage
+}
+
+// checkPayload fails unless a forwarded message came from the sender with
+// the payload that was sent
+func checkPayload(t *testing.T, got forwarded, from string, sent any) {
+	t.Helper()
+	var gotValue, sentValue any
+	if err := json.Unmarshal(got.payload, &gotValue); err != nil {
+		t.Fatalf("decode %s: %v", got.payload, err)
+	}
+	encoded, _ := json.Marshal(sent)
+	json.Unmarshal(encoded, &sentValue)
+	if got.from != from || !reflect.DeepEqual(gotValue, sentValue) {
+		t.Fatalf("got %s from %s, want %s from %s", got.payload, got.from, encoded, from)
+	}
+}
+
+// Two clients go through a whole call, and every message reaches the other
+// side as sent
+func TestIntegrationSignalingCall(t *testing.T) {
+	url := startIntegrationServers(t).SignalingURL()
+	alice, err := client.DialOptions(url, client.Options{Username: "alice"})
+	if err != nil {
+		t.Fatalf("join as alice: %v", err)
+	}
+	defer alice.Close()
+	bob, err := client.DialOptions(url, client.Options{Username: "bob"})
+	if err != nil {
+		t.Fatalf("join as bob: %v", err)
+	}
+	defer bob.Close()
+
+	calls, accepts, hangUps := make(chan string, 1), make(chan string, 1), make(chan string, 1)
+	offers, answers, candidates := make(chan forwarded, 1), make(chan forwarded, 1), make(chan forwarded, 1)
+	bob.OnCall(func(from string) { calls <- from })
+	alice.OnAcceptCall(func(from string) { accepts <- from })
+	bob.OnOffer(func(from string, offer json.RawMessage) { offers <- forwarded{from, offer} })
+	alice.OnAnswer(func(from string, answer json.RawMessage) { answers <- forwarded{from, answer} })
+	bob.OnCandidate(func(from string, candidate json.RawMessage) { candidates <- forwarded{from, candidate} })
+	bob.OnHangUp(func(from string) { hangUps <- from })
+
+	if err := alice.Call("bob"); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if from := await(t, calls, "call"); from != "alice" {
+		t.Fatalf("bob got a call from %q, want alice", from)
+	}
+	if err := bob.AcceptCall("alice"); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if from := await(t, accepts, "acceptCall"); from != "bob" {
+		t.Fatalf("alice got an accept from %q, want bob", from)
+	}
+
+	offer := webrtc.OfferPayload{Type: "offer", SDP: "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"}
+	if err := alice.SendOffer("bob", offer); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+	checkPayload(t, await(t, offers, "offer"), "alice", offer)
+
+	answer := webrtc.AnswerPayload{Type: "answer", SDP: offer.SDP}
+	if err := bob.SendAnswer("alice", answer); err != nil {
+		t.Fatalf("send answer: %v", err)
+	}
+	checkPayload(t, await(t, answers, "answer"), "bob", answer)
+
+	candidate := map[string]any{"candidate": "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host", "sdpMid": "0", "sdpMLineIndex": 0}
+	if err := alice.SendCandidate("bob", candidate); err != nil {
+		t.Fatalf("send candidate: %v", err)
+	}
+	checkPayload(t, await(t, candidates, "candidate"), "alice", candidate)
+
+	if err := alice.HangUp("bob"); err != nil {
+		t.Fatalf("hang up: %v", err)
+	}
+	if from := await(t, hangUps, "hangUp"); from != "alice" {
+		t.Fatalf("bob got a hangUp from %q, want alice", from)
+	}
+}
+
+// Closed servers free their ports and leave the configuration as they
+// found it, so the next test can start its own
+func TestIntegrationServersClose(t *testing.T) {
+	mode, ip := serverMode, publicIP
+	servers := startIntegrationServers(t)
+	if _, err := startServers(serverConfig{Mode: modeBoth}); err == nil {
+		t.Fatal("second set of servers started while the first runs")
+	}
+	url, addr := servers.SignalingURL(), servers.STUNTURNAddr()
+	alice, err := client.DialOptions(url, client.Options{Username: "alice"})
+	if err != nil {
+		t.Fatalf("join as alice: %v", err)
+	}
+	defer alice.Close()
+
+	servers.Close()
+	<-alice.Done()
+	if code, _ := alice.CloseCode(); code != websocket.CloseGoingAway {
+		t.Fatalf("alice's connection closed with %d, want %d", code, websocket.CloseGoingAway)
+	}
+	if _, err := client.DialOptions(url, client.Options{Username: "bob"}); err == nil {
+		t.Fatal("signaling server still accepts connections")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("STUN/TURN server still accepts connections")
+	}
+	if serverMode != mode || publicIP != ip {
+		t.Fatalf("configuration left at mode %q, IP %q; want %q, %q", serverMode, publicIP, mode, ip)
+	}
+	again := startIntegrationServers(t)
+	again.Close()
+}
+
+// allocateRelay allocates a relay for alice over UDP until the test ends
+func allocateRelay(t *testing.T, server string) (net.PacketConn, net.Addr) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: server,
+		TURNServerAddr: server,
+		Conn:           conn,
+		Username:       "alice",
+		Password:       "secret",
+		Realm:          "pion.ly",
+	})
+	if err != nil {
+		t.Fatalf("create TURN client: %v", err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.Listen(); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	relay, err := c.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	return relay, conn.LocalAddr()
+}
+
+// With -filter-host-candidates a trickle-ICE exchange still connects
+// through the relay: the host candidates are dropped, the relay candidates
+// reach the peer with their related address hidden, and data flows between
+// the two relays
+func TestIntegrationFilteredTrickleConnects(t *testing.T) {
+	webrtc.ConfigureInterceptors(webrtc.HideLocalCandidates{})
+	t.Cleanup(func() { webrtc.ConfigureInterceptors() })
+	// Relays on 127.0.0.1, so they can reach each other
+	servers, err := startServers(serverConfig{Mode: modeBoth, PublicIP: "127.0.0.1", TURNUsers: "alice=secret", Realm: "pion.ly", Signaling: true})
+	if err != nil {
+		t.Fatalf("start servers: %v", err)
+	}
+	t.Cleanup(servers.Close)
+	// Runs after the relays are closed, see allocateRelay
+	t.Cleanup(func() { waitRelaysStopped(t) })
+
+	peers := make(map[string]*client.Client)
+	received := make(map[string]chan string)
+	for _, name := range []string{"alice", "bob"} {
+		c, err := client.DialOptions(servers.SignalingURL(), client.Options{Username: name})
+		if err != nil {
+			t.Fatalf("join as %s: %v", name, err)
+		}
+		defer c.Close()
+		peers[name] = c
+		candidates := make(chan string, 4)
+		c.OnCandidate(func(from string, payload json.RawMessage) {
+			var candidate webrtc.CandidatePayload
+			json.Unmarshal(payload, &candidate)
+			candidates <- candidate.Candidate
+		})
+		received[name] = candidates
+	}
+	alice, bob := peers["alice"], peers["bob"]
+	calls, accepts := make(chan string, 1), make(chan string, 1)
+	bob.OnCall(func(from string) { calls <- from })
+	alice.OnAcceptCall(func(from string) { accepts <- from })
+	if err := alice.Call("bob"); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	await(t, calls, "call")
+	if err := bob.AcceptCall("alice"); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	await(t, accepts, "acceptCall")
+
+	// Each side trickles its host candidate, then its relay candidate
+	relays := make(map[string]net.PacketConn)
+	for name, peer := range map[string]string{"alice": "bob", "bob": "alice"} {
+		relay, local := allocateRelay(t, servers.STUNTURNAddr())
+		relays[name] = relay
+		host := local.(*net.UDPAddr)
+		relayed := relay.LocalAddr().(*net.UDPAddr)
+		for _, line := range []string{
+			fmt.Sprintf("candidate:1 1 udp 2130706431 %s %d typ host", host.IP, host.Port),
+			fmt.Sprintf("candidate:2 1 udp 16777215 %s %d typ relay raddr %s rport %d", relayed.IP, relayed.Port, host.IP, host.Port),
+		} {
+			if err := peers[name].SendCandidate(peer, map[string]any{"candidate": line, "sdpMid": "0", "sdpMLineIndex": 0}); err != nil {
+				t.Fatalf("send candidate: %v", err)
+			}
+		}
+	}
+
+	// Each side only learns the other's relay, and pairs with it
+	remote := make(map[string]*net.UDPAddr)
+	for name := range peers {
+		line := await(t, received[name], "candidate")
+		fields := strings.Fields(line)
+		if len(fields) < 12 || fields[7] != "relay" || fields[9] != "0.0.0.0" || fields[11] != "0" {
+			t.Fatalf("%s got candidate %q, want a relay candidate with its related address hidden", name, line)
+		}
+		port, _ := strconv.Atoi(fields[5])
+		remote[name] = &net.UDPAddr{IP: net.ParseIP(fields[4]), Port: port}
+	}
+	for name, ch := range received {
+		select {
+		case line := <-ch:
+			t.Fatalf("%s got a second candidate %q", name, line)
+		default:
+		}
+	}
+
+	// bob's first packet installs his permission for alice's relay; alice
+	// retries until one gets through, as ICE connectivity checks do
+	if _, err := relays["bob"].WriteTo([]byte("ping from bob"), remote["bob"]); err != nil {
+		t.Fatalf("bob's relay write: %v", err)
+	}
+	arrived := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		relays["bob"].SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := relays["bob"].ReadFrom(buf)
+		if err == nil {
+			arrived <- string(buf[:n])
+		}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := relays["alice"].WriteTo([]byte("ping from alice"), remote["alice"]); err != nil {
+			t.Fatalf("alice's relay write: %v", err)
+		}
+		select {
+		case got := <-arrived:
+			if got != "ping from alice" {
+				t.Fatalf("bob's relay got %q", got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no data through the relays")
+		}
+	}
+}
@@ -271,27 +271,66 @@ For more information, see:
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
+	_ "embed"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/bits"
+	mrand "math/rand/v2"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"go-server/events"
 	"go-server/webrtc"
-
-	"github.com/pion/turn/v4" // Pion TURN library - popular Go WebRTC implementation
+	"go-server/webrtc/demo"
+
+	"github.com/gorilla/websocket"         // WebSocket for the admin log tail
+	"github.com/oschwald/maxminddb-golang" // MaxMind DB (.mmdb) reader for the GeoIP databases
+	"github.com/pion/dtls/v3"              // DTLS listener for TURN over DTLS (RFC 7350)
+	"github.com/pion/stun/v3"              // STUN message parsing, to rewrite allocation lifetimes
+	"github.com/pion/turn/v4"              // Pion TURN library - popular Go WebRTC implementation
+	"github.com/pires/go-proxyproto"       // PROXY protocol v1/v2 parser for load-balanced TCP listeners
+	"golang.org/x/net/ipv4"                // Batched UDP reads/writes (recvmmsg/sendmmsg)
+	"golang.org/x/net/ipv6"                // Same, for dual-stack IPv6 sockets
+
+	// OpenTelemetry tracing, optional (-otel-endpoint)
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ============================================================================
@@ -304,6 +343,9 @@ import (
 const (
 	httpPort  = 8080
 	httpsPort = 443
+
+	// Port of the plain HTTP listener that redirects to HTTPS (-http-redirect)
+	httpRedirectPort = 80
 )
 
 // Standard ports for different WebRTC protocols
@@ -328,28 +370,87 @@ const (
 var (
 	publicIP string // Public IP address of the server
 
-	stunturnServer     *turn.Server      // UDP STUN/TURN server - handles both STUN discovery and TURN relay
-	stunturnTCPServer  *turn.Server      // TCP STUN/TURN server - fallback for UDP-blocked networks
-	stunturnTLSServer  *turn.Server      // TLS STUN/TURN server - secure encrypted discovery and relay
-	usersMap           map[string][]byte // Authentication credentials (username -> auth key)
-	stunturnPort       int               // STUN/TURN server port - configurable via command line
-	stunturnTLSPort    int               // STUN/TURN TLS server port - configurable via command line
-	signalingHTTPPort  int               // Signaling server port - configurable via command line
-	signalingHTTPSPort int               // Signaling server port - configurable via command line
-	signalingPort      int               // What port did we actually end up using for signaling
-
-	stunturnCertsFound  bool // Whether the STUN/TURN server has SSL certificates
-	signalingCertsFound bool // Whether the Signaling server has SSL certificates
+	stunturnServer     *turn.Server                 // UDP STUN/TURN server - handles both STUN discovery and TURN relay
+	stunturnTCPServer  *turn.Server                 // TCP STUN/TURN server - fallback for UDP-blocked networks
+	stunturnTLSServer  *turn.Server                 // TLS STUN/TURN server - secure encrypted discovery and relay
+	stunturnDTLSServer *turn.Server                 // DTLS STUN/TURN server - encrypted discovery and relay over UDP
+	stunBindingServers []*stunBindingServer         // Binding responders in place of the TURN servers with -mode=stun
+	serverMode         string                       // -mode: stun, turn or both
+	stunturnEnabled    bool                         // -enable-stunturn: whether the STUN/TURN listeners run
+	signalingEnabled   bool                         // -enable-signaling: whether the signaling server runs
+	usersMap           map[string]map[string][]byte // Authentication credentials (realm -> username -> auth key)
+	usersMapMu         sync.RWMutex                 // Guards usersMap once the servers run, see revokeTURNUser
+	turnRealm          string                       // -realm: the default realm, see probeTURNCredentials
+	stunturnPort       int                          // STUN/TURN server port - configurable via command line
+	stunturnTLSPort    int                          // STUN/TURN TLS server port - configurable via command line
+	extraUDPPorts      []int                        // -extra-udp-ports: more ports for the UDP STUN/TURN server
+	extraTCPPorts      []int                        // -extra-tcp-ports: more ports for the TCP STUN/TURN server
+	udpBoundPorts      []int                        // Ports the UDP STUN/TURN server listens on, for the banner
+	tcpBoundPorts      []int                        // Ports the TCP STUN/TURN server listens on, for the banner
+	portFallback       int                          // -port-fallback: next ports tried when a main STUN/TURN port is taken
+	startupRetries     int                          // -startup-retries: retries of a failed startup step, see retryStartup
+	startupBackoff     time.Duration                // -startup-backoff: delay before the first retry
+	signalingHTTPPort  int                          // Signaling server port - configurable via command line
+	signalingHTTPSPort int                          // Signaling server port - configurable via command line
+	signalingPort      int                          // What port did we actually end up using for signaling
+	signalingPath      string                       // Path the signaling endpoints are mounted at
+	signalingService   *webrtc.Service              // Signaling users and handlers of the default tenant, see webrtc.NewService
+	signalingTenants   *webrtc.Tenants              // Signaling services of every tenant, see webrtc/tenants.go
+	signalingHandler   http.Handler                 // Signaling HTTP routes, see webrtc.Tenants.Routes
+	signalingListening = make(chan struct{})        // Closed once the signaling server's port is bound
+	signalingServer    atomic.Pointer[http.Server]  // The signaling server once it serves, see closeSignaling
+
+	stunturnCertsFound  bool            // Whether the STUN/TURN server has SSL certificates
+	dtlsListening       bool            // Whether the DTLS STUN/TURN listener runs
+	tlsCertificates     *certificateSet // Certificates of the TURNS and HTTPS listeners by SNI, nil without any
+	signalingCertsFound bool            // Whether the Signaling server has SSL certificates
+
+	// Limits on TCP/TLS STUN/TURN connections, see TimeoutConn (0 disables each)
+	turnTCPHandshakeTimeout time.Duration
+	turnTCPIdleTimeout      time.Duration
+	turnTCPMaxLifetime      time.Duration
+
+	// Cap on live TCP/TLS STUN/TURN connections from one source IP (0 disables)
+	maxTCPConnsPerIP int
+
+	// Requested UDP STUN/TURN socket buffer sizes in bytes (0 keeps the kernel default)
+	udpRcvBuf int
+	udpSndBuf int
+
+	udpBatch bool // Whether UDP listeners use recvmmsg/sendmmsg on Linux, see batchPacketConn
+
+	logPackets bool // Whether the STUN/TURN wrappers log every packet, not just control messages
+
+	// Offenses per minute that put a source on the drop list (0 disables), and for how long
+	dropThreshold int
+	dropCooldown  time.Duration
+
+	// PROXY protocol policy for the TCP/TLS STUN/TURN listeners, nil if disabled
+	proxyProtocolPolicy proxyproto.ConnPolicyFunc
+
+	httpRedirectEnabled bool         // Whether to redirect port 80 to HTTPS when certificates exist
+	httpRedirectServer  *http.Server // Port 80 redirect listener, nil if not running
+	httpRedirectMu      sync.Mutex   // Guards httpRedirectServer, set by the signaling goroutine
 
 	// Loggers for different services
 	// Separate loggers help with debugging and monitoring
-	stunTurnLogger  *log.Logger // Logger for STUN/TURN services
-	signalingLogger *log.Logger // Logger for WebRTC signaling
+	stunTurnLogger  *log.Logger // Logger for STUN/TURN services, at info level
+	signalingLogger *log.Logger // Logger for WebRTC signaling, at info level
+
+	// The loggers of every level (see LOG LEVELS); Info is the logger above
+	stunTurnLog  *leveledLogger
+	signalingLog *leveledLogger
 
 	// Monitoring processes for log windows
 	// These help with real-time monitoring during development
 	stunturnMonitor  *os.Process // Process for STUN/TURN log monitoring window
 	signalingMonitor *os.Process // Process for signaling log monitoring window
+
+	serverStartTime = time.Now() // When the server started, for the uptime on the dashboard
+
+	// Bus the server's events are published on, shared with the signaling
+	// package, see the events package
+	eventBus = events.NewBus()
 )
 
 // ============================================================================
@@ -380,6 +481,31 @@ func main() {
 	//   Think of it as the "domain" for your TURN server
 	//   Example: "yourcompany.com" or "webrtc.example.com"
 
+	turnRealms := flag.String("turn-realms", "", "More TURN realms and their users, e.g. \"acme.example.com:alice=pass,bob=pass;globex.example.com:carol=pass\" (defaults to none)")
+	// ^ Each hosted app gets its own realm and user list, so credentials of one app don't work in another
+	//   -realm with -turn-users stays the default realm, the one the server advertises in its challenges
+
+	maxAllocationLifetimeFlag := flag.Duration("max-allocation-lifetime", 0, "Longest TURN allocation lifetime a client may request, under 1h; 0 keeps the TURN server's 1h limit (defaults to 0)")
+	defaultAllocationLifetimeFlag := flag.Duration("default-allocation-lifetime", defaultTURNLifetime, "Lifetime of TURN allocations and refreshes that don't request one, under 1h (defaults to 10m)")
+	// ^ A short maximum, e.g. 10m, makes clients refresh often, so relays of clients that vanished are freed sooner
+	//   Longer requests are granted the maximum, and the clamp is logged
+
+	modeFlag := flag.String("mode", modeBoth, "What the STUN/TURN listeners serve: stun, turn or both (defaults to both)")
+	// ^ stun answers binding requests only, with no TURN users, auth handler or relay generator loaded,
+	//   for lightweight regional STUN nodes. turn and both run the full TURN server, which answers
+	//   binding requests too, as RFC 8656 requires of TURN servers
+
+	enableSignaling := flag.Bool("enable-signaling", true, "Run the WebRTC signaling server (defaults to true)")
+	// ^ Turn off on nodes that only serve STUN/TURN, e.g. -mode=stun -enable-signaling=false runs nothing but bindings
+	//   No signaling port is bound, no signaling route registered and no signaling log opened
+
+	enableSTUNTURN := flag.Bool("enable-stunturn", true, "Run the STUN/TURN listeners (defaults to true)")
+	// ^ Turn off on signaling-only nodes whose clients use STUN/TURN servers elsewhere
+
+	maxTotalAllocationsFlag := flag.Int("max-total-allocations", 0, "Most TURN allocations open at once across all users, 0 for no limit (defaults to 0)")
+	// ^ A hard ceiling so a burst of clients can't exhaust relay ports or memory
+	//   Allocations beyond it are refused with 508 (Insufficient Capacity), and /readyz reports "degraded"
+
 	threadNum := flag.Int("thread-num", 1, "Number of server threads (defaults to 1)")
 	// ^ Number of concurrent listeners - increases throughput for high-traffic scenarios
 	//   Each thread handles connections independently
@@ -401,6 +527,22 @@ func main() {
 	// ^ Custom TURN port - useful if 3478 is blocked or in use
 	//   Standard port 3478 is recommended for maximum compatibility
 
+	portFallbackFlag := flag.Int("port-fallback", 0, "Next port numbers to try when the STUN/TURN or TLS port is already in use; 0 fails instead (defaults to 0)")
+	// ^ With -port-fallback=3 and 3478 taken, 3479-3481 are tried; the port used is logged
+	//   and shown in the banner and the demo client's ICE servers
+
+	startupRetriesFlag := flag.Int("startup-retries", 0, "Times to retry public IP detection and binding the listeners when they fail at startup; 0 fails at once (defaults to 0)")
+	startupBackoffFlag := flag.Duration("startup-backoff", time.Second, "Delay before the first startup retry, doubled for each further one up to 1m (defaults to 1s)")
+	// ^ In Kubernetes a pod can start before its network is ready; retrying beats a crash loop.
+	//   /readyz answers 503 "starting" until every listener is up
+
+	extraUDPPortsFlag := flag.String("extra-udp-ports", "", "Comma-separated extra ports for the UDP STUN/TURN server, e.g. 53 (defaults to none)")
+	// ^ Restrictive networks sometimes only let outbound UDP 53 or TCP 80 through
+	//   Ports that can't be bound (permission, in use) are skipped with a warning
+
+	extraTCPPortsFlag := flag.String("extra-tcp-ports", "", "Comma-separated extra ports for the TCP STUN/TURN server, e.g. 80,443 (defaults to none)")
+	// ^ Same as -extra-udp-ports for TURN over TCP
+
 	enableTCP := flag.Bool("enable-tcp", true, "Enable TURN/STUN over TCP (defaults to true)")
 	// ^ Enable TCP fallback - some networks block UDP, so TCP is essential
 	//   Corporate networks often block UDP, making TCP necessary
@@ -409,28 +551,380 @@ func main() {
 	// ^ Enable TLS encryption - required for secure enterprise environments
 	//   Also needed for WebRTC in browsers (HTTPS requirement)
 
+	enableDTLS := flag.Bool("enable-dtls", false, "Enable TURN/STUN over DTLS on the TLS port over UDP, with the TLS certificates (defaults to false)")
+	// ^ For embedded clients that can only do DTLS on UDP, no TCP/TLS (RFC 7350, turns:host:5349?transport=udp)
+
+	var tlsCertPairs certPairList
+	flag.Var(&tlsCertPairs, "tls-cert-pair", "Certificate for a TLS server name, name=cert.pem:key.pem; repeat it for more names (defaults to certs/fullchain.pem and certs/privkey.pem for every name)")
+	tlsDefaultCert := flag.String("tls-default-cert", "", "Name of the -tls-cert-pair served to clients whose server name has no certificate (defaults to the certs/ pair, or else the first pair)")
+	// ^ One box can serve turn.customer-a.com and turn.customer-b.com, each with its own certificate,
+	//   on the TURNS listeners and the signaling HTTPS server. A name may be a wildcard like *.example.com
+
+	proxyProtocol := flag.String("proxy-protocol", "", "Comma-separated IPs/CIDRs of load balancers allowed to send PROXY protocol headers on the TCP/TLS STUN/TURN listeners (defaults to disabled)")
+	// ^ Behind HAProxy every TURN connection comes from the proxy; with PROXY protocol the real client
+	//   address reaches the logs and the auth handler. Headers from any other source are rejected
+
+	turnTCPHandshake := flag.Duration("turn-tcp-handshake-timeout", 30*time.Second, "Close TCP/TLS STUN/TURN connections that send no STUN message within this time, 0 disables (defaults to 30s)")
+	turnTCPIdle := flag.Duration("turn-tcp-idle-timeout", 10*time.Minute, "Close TCP/TLS STUN/TURN connections with no traffic for this long, 0 disables (defaults to 10m)")
+	turnTCPLifetime := flag.Duration("turn-tcp-max-lifetime", 0, "Close TCP/TLS STUN/TURN connections after this long regardless of traffic, 0 disables (defaults to 0)")
+	// ^ A client that opens a TCP connection and never sends anything would otherwise hold a file descriptor forever
+	//   A few thousand of those exhaust the process FD limit
+
+	maxTCPConnsPerIPFlag := flag.Int("max-tcp-conns-per-ip", 64, "Maximum concurrent TCP/TLS STUN/TURN connections from one source IP, 0 disables (defaults to 64)")
+	// ^ Without a cap a single host can open tens of thousands of TURN connections and starve everyone else
+
+	udpRcvBufFlag := flag.Int("udp-rcvbuf", 0, "SO_RCVBUF size in bytes for the UDP STUN/TURN listeners, 0 keeps the kernel default (defaults to 0)")
+	udpSndBufFlag := flag.Int("udp-sndbuf", 0, "SO_SNDBUF size in bytes for the UDP STUN/TURN listeners, 0 keeps the kernel default (defaults to 0)")
+	// ^ Bursty relay traffic overflows the default kernel socket buffers and packets get dropped
+	//   The kernel caps the sizes at net.core.rmem_max / net.core.wmem_max on Linux
+
+	udpBatchFlag := flag.Bool("udp-batch", true, "Read and write UDP STUN/TURN packets in batches with recvmmsg/sendmmsg on Linux (defaults to true)")
+	// ^ One syscall per relayed packet caps throughput at a few hundred Mbps per listener
+	//   Has no effect on other platforms, which always use one syscall per packet
+
 	// New logging flags for better monitoring and debugging
-	stunturnLogFile := flag.String("stun-turn-log", "stun-turn.log", "Log file for STUN/TURN services (defaults to stdout)")
-	signalingLogFile := flag.String("signaling-log", "signaling.log", "Log file for WebRTC signaling (defaults to stdout)")
+	stunturnLogFile := flag.String("stun-turn-log", "stun-turn.log", "Destinations for STUN/TURN logs: file:path, stdout, syslog:tag or udp:host:port, each optionally followed by @level, comma-separated (defaults to stdout)")
+	signalingLogFile := flag.String("signaling-log", "signaling.log", "Destinations for WebRTC signaling logs, like -stun-turn-log (defaults to stdout)")
+	logUTCFlag := flag.Bool("log-utc", false, "Write log times in UTC instead of local time (defaults to false)")
+	logTimeFormatFlag := flag.String("log-timeformat", "", "Layout of log times: a Go time layout, or rfc3339, rfc3339nano, datetime or stamp (defaults to \"2006/01/02 15:04:05\")")
+	// ^ The default local time has no zone, which makes logs from servers in different regions hard to line up;
+	//   -log-utc -log-timeformat=rfc3339nano gives sortable, unambiguous timestamps
+	logLevelFlag := flag.String("log-level", "info", "Lowest level written to log destinations without an @level and to the live tail: debug, info, warn or error (defaults to info)")
+	logDebugBufferFlag := flag.Int("log-debug-buffer", DefaultLogDebugBuffer, "Lines of each log stream, at every level, kept in memory for /admin/logs/debug, 0 disables (defaults to 50000)")
+	// ^ Packet traces are debug lines: they stay out of the files at the default level, but the last
+	//   few minutes of them can still be fetched from the debug buffer when something goes wrong
+	logUDPPrefixFlag := flag.String("log-udp-prefix", "", "Prefix of every log line sent to a udp: log destination, e.g. a host name (defaults to none)")
+	// ^ A bare path is a file, as before. Remote destinations (syslog, udp) never block the server:
+	//   lines they can't take are dropped and counted in the connection statistics
 	separateLogs := flag.Bool("separate-logs", true, "Separate STUN/TURN and signaling logs (defaults to false)")
+	logWindowsFlag := flag.Bool("log-windows", true, "Deprecated: open terminal windows tailing the log files; use /admin/logs/stream instead (defaults to true)")
+	// ^ Only with -separate-logs and a file on both streams. The windows need a desktop session on the
+	//   server; the /admin/logs/stream WebSocket on -metrics-addr tails the same streams from anywhere
+	auditLogFile := flag.String("audit-log", "", "Append-only JSON audit log of TURN authentications and admin actions (defaults to disabled)")
+	showVersion := flag.Bool("version", false, "Print the version, commit and build date, then exit")
+	// ^ Set at build time with -ldflags, see BUILD INFORMATION
+
+	verifyAuditLogFile := flag.String("verify-audit-log", "", "Check that every line of an audit log is a complete entry, then exit")
+	// ^ Kept apart from the operational logs for compliance: never removed at startup like the
+	//   other log files, and -verify-audit-log reports the first truncated or corrupt line
+	logRedact := flag.String("log-redact", webrtc.RedactCredentials, "What to redact from the STUN/TURN and signaling logs: none, credentials (ICE ufrag/pwd) or pii (also usernames and candidate addresses) (defaults to credentials)")
+	// ^ pii replaces usernames with a stable token, so one user's lines can still be followed
+	//   The audit log always keeps the usernames
+	logPacketsFlag := flag.Bool("log-packets", true, "Log every STUN/TURN packet and relayed data indication, not just control messages (defaults to true)")
+	// ^ At relay rates the per-packet lines dominate CPU and the log; with this off the listeners
+	//   only count packets and bytes (see the connection statistics) and log STUN/TURN control messages
+
+	dropThresholdFlag := flag.Int("drop-threshold", 0, "Non-STUN packets plus failed TURN authentications per minute after which a source's packets are dropped, 0 disables (defaults to 0)")
+	dropCooldownFlag := flag.Duration("drop-cooldown", 10*time.Minute, "How long a source stays on the drop list (defaults to 10m)")
+	// ^ Protects the TURN parser from hosts flooding garbage or guessing usernames; other sources are unaffected
+	//   The list can be viewed and cleared at /admin/droplist on -metrics-addr
+	banFile := flag.String("ban-file", "", "JSON file the username and IP/CIDR ban list is kept in across restarts (defaults to none, bans kept in memory)")
+	// ^ Bans apply to TURN authentication and signaling; manage them at /admin/bans on -metrics-addr
+	geoIPDB := flag.String("geoip-db", "", "Comma-separated MaxMind GeoLite2 .mmdb files (Country or City, and ASN) to tag sources with their country and AS (defaults to disabled)")
+	// ^ Connection and authentication log lines get e.g. "[DE AS3320 Deutsche Telekom AG]" after the address,
+	//   and the admin stats and sessions gain the same fields; a missing or corrupt file is logged and skipped
+	allowCountries := flag.String("allow-countries", "", "Comma-separated ISO country codes served exclusively, e.g. \"US,CA\"; needs -geoip-db (defaults to all)")
+	denyCountries := flag.String("deny-countries", "", "Comma-separated ISO country codes refused service; needs -geoip-db (defaults to none)")
+	denyASNs := flag.String("deny-asns", "", "Comma-separated AS numbers refused service, e.g. \"AS64500,64501\"; needs -geoip-db (defaults to none)")
+	// ^ Enforced on UDP packets (dropped), TCP/TLS connections (closed on accept) and signaling upgrades (403)
+	//   Loopback and private sources are always served, so health checks keep working
+
+	usageReportDirFlag := flag.String("usage-report-dir", "", "Directory for the daily per-user relay usage reports, usage-YYYY-MM-DD.csv/.json (defaults to disabled)")
+	usageReportTime := flag.String("usage-report-time", "00:00", "Server local time (HH:MM) the daily usage report is written at (defaults to 00:00)")
+	usageReportFormat := flag.String("usage-report-format", "csv", "Usage report formats: csv, json or csv,json (defaults to csv)")
+	// ^ One row per TURN user per day: allocations, bytes relayed, peak concurrent allocations, distinct client IPs
+	//   POST /admin/usage-report on -metrics-addr writes a report of the usage so far right away
+
+	metricsAddr := flag.String("metrics-addr", "", "Address for the Prometheus metrics endpoint, e.g. \"127.0.0.1:9100\" (defaults to disabled)")
+	// ^ Serves /metrics with response latency percentiles and other counters for alerting
+	//   Served without TLS, so bind it to an internal interface
+	kickCooldownFlag := flag.Duration("kick-cooldown", webrtc.DefaultKickCooldown, "How long a user kicked with DELETE /admin/sessions/<user> can't rejoin (defaults to 10m)")
+	adminTokenFlag := flag.String("admin-token", "", "Token the /admin/ endpoints on -metrics-addr require, as \"Authorization: Bearer <token>\" or ?token= (defaults to a random token printed at startup)")
+	// ^ /metrics itself stays open for scrapers; failed admin authentications are recorded in the audit log
+
+	alertWebhookFlag := flag.String("alert-webhook", "", "URL alerts are POSTed to as JSON, e.g. a Slack or PagerDuty webhook (defaults to none)")
+	alertCommandFlag := flag.String("alert-command", "", "Program run with each alert's JSON on stdin (defaults to none)")
+	alertAuthFailuresFlag := flag.Int("alert-auth-failures", defaultAlertAuthFailures, fmt.Sprintf("Refused TURN authentications in a minute that fire an alert, 0 disables the rule (defaults to %d)", defaultAlertAuthFailures))
+	alertPublicIPIntervalFlag := flag.Duration("alert-public-ip-interval", defaultAlertPublicIPInterval, fmt.Sprintf("How often an auto-detected public IP is detected again to alert on a change, 0 disables the rule (defaults to %s)", defaultAlertPublicIPInterval))
+	// ^ Alerts on refused authentication spikes, the allocation cap, failed components and public IP changes
+	//   Each fires once when its condition starts and is resolved once when it clears
+
+	otelEndpoint := flag.String("otel-endpoint", "", "OTLP/gRPC endpoint to export OpenTelemetry traces to, host:port or an http(s):// URL, e.g. \"127.0.0.1:4317\" (defaults to disabled)")
+	// ^ Traces every signaling message, each call setup (offer, answer, first candidate) and each TURN Allocate transaction
+	//   A bare host:port is reached without TLS; off, tracing costs one check per message
+
+	signalAckBuffer := flag.Int("signal-ack-buffer", webrtc.DefaultAckBufferSize, fmt.Sprintf("Unacknowledged signaling messages kept per v2 session for replay, 0 disables (defaults to %d)", webrtc.DefaultAckBufferSize))
+	// ^ Reliability layer for protocol v2 clients - messages stay buffered until the client acks them
+	//   Oldest messages are dropped (and logged) once a session exceeds this limit
+
+	signalReplayWindow := flag.Duration("signal-replay-window", webrtc.DefaultAckReplayWindow, fmt.Sprintf("How long unacked messages of a dropped session are kept for replay (defaults to %s)", webrtc.DefaultAckReplayWindow))
+	// ^ A client reconnecting with its session token within this window gets its unacked messages replayed
+
+	resumeGrace := flag.Duration("resume-grace", webrtc.DefaultResumeGrace, fmt.Sprintf("How long a dropped v2 signaling session waits to be resumed, 0 disables (defaults to %s)", webrtc.DefaultResumeGrace))
+	// ^ Mobile clients switching networks can reconnect with ?resume=<token> and keep their call state
+	//   Other users don't see a disconnect unless the grace window expires
+
+	joinPolicy := flag.String("join-policy", webrtc.JoinPolicyReject, "What a join for a name another device is connected with does: reject or replace (defaults to reject)")
+	// ^ With replace the newest connection wins: the old one is sent sessionReplaced and closed with code 4003,
+	//   and a call in progress carries over to the new device, whose peer is told to renegotiate
+
+	chatMaxBytes := flag.Int("chat-max-bytes", webrtc.DefaultChatMaxBytes, fmt.Sprintf("Largest chat message payload relayed over signaling in bytes (defaults to %d)", webrtc.DefaultChatMaxBytes))
+	chatRate := flag.Float64("chat-rate", webrtc.DefaultChatRate, fmt.Sprintf("Chat messages per second allowed per user, 0 disables the limit (defaults to %g)", webrtc.DefaultChatRate))
+	chatHistory := flag.Int("chat-history", webrtc.DefaultChatHistory, fmt.Sprintf("Undelivered chat messages kept per user pair for late joiners, 0 disables (defaults to %d)", webrtc.DefaultChatHistory))
+	// ^ Chat lets users exchange short text messages before (or without) a peer connection
+
+	presenceSnapshot := flag.Duration("presence-snapshot-interval", webrtc.DefaultPresenceSnapshotInterval, fmt.Sprintf("How often v2 signaling clients get a full user list to resync their deltas, 0 disables (defaults to %s)", webrtc.DefaultPresenceSnapshotInterval))
+	broadcastWorkers := flag.Int("broadcast-workers", webrtc.DefaultBroadcastWorkers, fmt.Sprintf("Goroutines fanning each user list change out to the signaling clients (defaults to %d)", webrtc.DefaultBroadcastWorkers))
+	// ^ v2 clients only receive userAdded/userRemoved/userUpdated deltas between snapshots
+
+	allowGuests := flag.Bool("allow-guests", false, "Let signaling clients join without a name and get a generated guest-xxxx name (defaults to false)")
+	guestsHidden := flag.Bool("guests-hidden", false, "Leave guests out of the user lists of users who aren't guests (defaults to false)")
+	guestCallRate := flag.Float64("guest-call-rate", webrtc.DefaultGuestCallRate, fmt.Sprintf("Calls per minute a guest may place, 0 disables the limit (defaults to %g)", float64(webrtc.DefaultGuestCallRate)))
+	// ^ For quick demos where visitors shouldn't have to pick a name
+	//   While guests are allowed, explicit joins with the guest- prefix are refused so names never collide
+
+	maxConcurrentCalls := flag.Int("max-concurrent-calls", 0, "Most calls ringing or in progress on the whole server, 0 is unlimited (defaults to 0)")
+	callAttemptRate := flag.Float64("call-attempt-rate", webrtc.DefaultCallAttemptRate, fmt.Sprintf("Calls per minute a user may place, 0 disables the limit (defaults to %g)", float64(webrtc.DefaultCallAttemptRate)))
+	ringRate := flag.Float64("ring-rate", webrtc.DefaultRingRate, fmt.Sprintf("Calls per minute a user may be rung with, 0 disables the limit (defaults to %g)", float64(webrtc.DefaultRingRate)))
+	// ^ Calls over these limits fail with callFailed "rateLimited" instead of ringing
+	//   The ring rate stops many callers flooding one user; each tenant can also cap its calls with max-calls
+
+	enableProbe := flag.Bool("enable-probe", true, "Serve GET /probe and POST /probe/turn for clients to check their connectivity and TURN credentials (defaults to true)")
+	probeRate := flag.Float64("probe-rate", webrtc.DefaultProbeRate, fmt.Sprintf("Probes per minute a client IP may make, 0 disables the limit (defaults to %g)", float64(webrtc.DefaultProbeRate)))
+	// ^ /probe reports the address, TLS and proxy headers the server sees; /probe/turn dry-runs TURN authentication
+	//   Unknown users and wrong credentials get the same answer, so the probe can't list usernames
+
+	transferTimeout := flag.Duration("transfer-timeout", webrtc.DefaultTransferTimeout, fmt.Sprintf("How long the target of a call transfer rings before the transfer is abandoned, 0 disables the timeout (defaults to %s)", webrtc.DefaultTransferTimeout))
+	// ^ The transferring user and the other party stay in their call until the target accepts
+
+	ringTimeout := flag.Duration("call-ring-timeout", webrtc.DefaultRingTimeout, fmt.Sprintf("How long a call rings unanswered before it is given up as missed, 0 lets calls ring until cancelled (defaults to %s)", webrtc.DefaultRingTimeout))
+	missedCallTTL := flag.Duration("missed-call-ttl", webrtc.DefaultMissedCallTTL, fmt.Sprintf("How long missed calls are kept for their callee (defaults to %s)", webrtc.DefaultMissedCallTTL))
+	missedCallsPerUser := flag.Int("missed-calls-per-user", webrtc.DefaultMissedCallsPerUser, fmt.Sprintf("Missed calls kept per user, 0 disables the history (defaults to %d)", webrtc.DefaultMissedCallsPerUser))
+	missedCallsMax := flag.Int("missed-calls-max", webrtc.DefaultMissedCallsMax, fmt.Sprintf("Missed calls kept across all users, the oldest are dropped first (defaults to %d)", webrtc.DefaultMissedCallsMax))
+	// ^ Users who were offline, relaunching or away from the phone get the calls they missed when they next join
+	//   Anyone can call any name, so the history is bounded per user and overall
+
+	signalMaxBytes := flag.Int64("signal-max-message-bytes", webrtc.DefaultMaxMessageBytes, fmt.Sprintf("Largest signaling message a client may send in bytes (defaults to %d)", webrtc.DefaultMaxMessageBytes))
+	signalRate := flag.Float64("signal-rate", webrtc.DefaultMessageRate, fmt.Sprintf("Signaling messages per second allowed per connection, 0 disables the limit (defaults to %g)", webrtc.DefaultMessageRate))
+	signalBurst := flag.Int("signal-burst", webrtc.DefaultMessageBurst, fmt.Sprintf("Signaling messages a connection may send in a burst (defaults to %d)", webrtc.DefaultMessageBurst))
+	// ^ Protects the server from clients flooding the signaling channel
+	//   ICE candidate bursts during gathering fit comfortably under the defaults
+
+	signalWriteTimeout := flag.Duration("signal-write-timeout", webrtc.DefaultWriteTimeout, fmt.Sprintf("Longest a single signaling write may block before the client is disconnected (defaults to %s)", webrtc.DefaultWriteTimeout))
+	signalQueueSize := flag.Int("signal-queue-size", webrtc.DefaultOutboundQueueSize, fmt.Sprintf("Outgoing signaling messages queued per client before it is treated as a slow consumer (defaults to %d)", webrtc.DefaultOutboundQueueSize))
+	// ^ A client that stops reading (phone asleep, congested link) is disconnected with close code 4001
+	//   instead of stalling the server; user list broadcasts are dropped first
+
+	signalHeartbeat := flag.Duration("signal-heartbeat-interval", webrtc.DefaultHeartbeatInterval, fmt.Sprintf("How often signaling WebSocket clients are pinged, 0 disables (defaults to %s)", webrtc.DefaultHeartbeatInterval))
+	signalStaleTimeout := flag.Duration("signal-stale-timeout", webrtc.DefaultStaleSessionTimeout, fmt.Sprintf("How long a signaling session may go without a message or pong before its connection is closed, 0 disables (defaults to %s)", webrtc.DefaultStaleSessionTimeout))
+	// ^ Browsers answer pings on their own, so only clients that vanished without closing the socket go quiet
+	//   Their connection is closed with code 4002 and the session waits out -resume-grace as usual
+
+	wsCompression := flag.Bool("ws-compression", false, "Negotiate permessage-deflate compression on signaling WebSockets (defaults to false)")
+	wsCompressionThreshold := flag.Int("ws-compression-threshold", webrtc.DefaultCompressionThreshold, fmt.Sprintf("Smallest signaling message in bytes that gets compressed (defaults to %d)", webrtc.DefaultCompressionThreshold))
+	// ^ activeUsers lists and SDP offers compress well, which matters to mobile clients on metered connections
+	//   Small candidate messages aren't worth the CPU, hence the threshold
+
+	signalMaxPayload := flag.Int("signal-max-payload-bytes", webrtc.DefaultMaxPayloadBytes, fmt.Sprintf("Largest offer, answer or candidate data forwarded in bytes, 0 disables (defaults to %d)", webrtc.DefaultMaxPayloadBytes))
+	// ^ Offers and answers must also be session descriptions and candidates ICE candidate lines; others are dropped
+	//   -signal-max-message-bytes applies first; its default leaves room for the largest payload
+
+	forceRelay := flag.Bool("force-relay", false, "Forward only relay ICE candidates, in offers, answers and candidate messages, so calls always go through TURN (defaults to false)")
+	filterHostCandidates := flag.Bool("filter-host-candidates", false, "Forward only public srflx and relay ICE candidates, so peers never learn each other's LAN addresses (defaults to false)")
+	filterCodecs := flag.String("filter-codecs", "", "Codecs removed from forwarded offers and answers, e.g. \"H264,red,ulpfec\" (defaults to none)")
+	// ^ Server-side SDP policy, see webrtc/intercept.go; all of it runs after the payload checks above
+	//   A description left with a media section without codecs is rejected rather than forwarded
+
+	signalCallAuth := flag.Bool("signal-call-auth", true, "Only forward offer, answer and candidate messages between the two users of an accepted call (defaults to true)")
+	// ^ Stops a third party from injecting SDP or ICE candidates into someone else's call
+	//   Turn off for clients that set up calls out of band, without call/acceptCall messages
+
+	grpcAddr := flag.String("grpc-addr", "", "Address for the gRPC signaling API, e.g. \":50051\" (defaults to disabled)")
+	// ^ Lets gRPC-native media bots signal over a bidirectional stream; they share users with WebSocket clients
+	//   Served without TLS, so bind it to an internal interface
+
+	signalingPathFlag := flag.String("signaling-path", webrtc.DefaultSignalingPath, fmt.Sprintf("Path the signaling endpoints are served at (defaults to %s)", webrtc.DefaultSignalingPath))
+	// ^ Change it when embedding behind a gateway that already uses /signal, e.g. -signaling-path=/webrtc/ws
+	//   The SSE fallback endpoints move with it (<path>/events and <path>/send)
+	tenantsFlag := flag.String("tenants", "", "Signaling tenants served at <signaling-path>/<tenant>, e.g. \"acme:max-users=500:max-calls=50,globex\" (defaults to none)")
+	// ^ Each tenant has its own users, user lists and calls, so apps sharing the server can't see or call each other
+	//   max-users and max-calls bound what one tenant may use; the default tenant at <signaling-path> is unlimited
+
+	httpRedirect := flag.Bool("http-redirect", true, fmt.Sprintf("Redirect plain HTTP on port %d to HTTPS when signaling certificates exist (defaults to true)", httpRedirectPort))
+	// ^ Users typing the http:// URL, or clients probing port 80, get a 301 instead of connection refused
+	//   Skipped with a log line if something else already owns port 80
+
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted (defaults to none)")
+	// ^ Behind nginx or a load balancer every connection comes from the proxy; list it here (e.g. "10.0.0.0/8")
+	//   so logs show the real client IP. Headers from any other peer are ignored, since clients can forge them
+
+	iceServersFile := flag.String("ice-servers-file", "ice-servers.json", "File the STUN/TURN URLs are written to at startup as RTCIceServer JSON; empty disables (defaults to ice-servers.json)")
+	// ^ Ready to paste into a frontend's RTCPeerConnection config, with only the listeners that came up.
+	//   The TURN credential is a placeholder; passwords are never written to disk
+
+	peerServersFlag := flag.String("peer-servers", "", "Comma-separated base URLs of sibling servers' -metrics-addr, e.g. \"http://10.0.0.2:9100\", whose STUN/TURN URLs GET /ice-config adds while they are healthy (defaults to none)")
+	peerPollInterval := flag.Duration("peer-poll-interval", DefaultPeerPollInterval, fmt.Sprintf("How often the -peer-servers' /healthz is polled (defaults to %s)", DefaultPeerPollInterval))
+	// ^ For HA pairs: a frontend that knows one server gets the ICE servers of all the healthy ones, this one first
+	//   A sibling that stops answering or whose UDP listener isn't up leaves /ice-config at the next poll
+
+	skipRelayCheck := flag.Bool("skip-relay-reachability-check", false, "Don't check that the relay address can be reached from outside (defaults to false)")
+	relayCheckURLFlag := flag.String("relay-check-url", "", "URL a vantage point outside serves POST /probe/relay at, for the relay reachability check; empty uses the -peer-servers (defaults to none)")
+	relayCheckInterval := flag.Duration("relay-check-interval", DefaultRelayCheckInterval, fmt.Sprintf("How often the relay address is checked from outside, 0 checks at startup only (defaults to %s)", DefaultRelayCheckInterval))
+	// ^ Behind carrier-grade NAT or without port forwarding, allocations succeed but no media flows
+	//   An unreachable relay address is logged with the likely causes and degrades the TURN components
+
+	enableDemo := flag.Bool("enable-demo", false, "Serve a built-in demo web client under /demo (defaults to false)")
+	// ^ Two browser tabs on /demo/ can call each other through this server's signaling and STUN/TURN
+	//   Handy for checking a fresh deployment and for bug reports; keep it off in production
+
+	sseKeepalive := flag.Duration("sse-keepalive", webrtc.DefaultSSEKeepalive, fmt.Sprintf("Interval between keepalive comments on SSE signaling streams (defaults to %s)", webrtc.DefaultSSEKeepalive))
+	sseIdleTimeout := flag.Duration("sse-idle-timeout", webrtc.DefaultSSEIdleTimeout, fmt.Sprintf("How long an SSE signaling session may go without an open event stream (defaults to %s)", webrtc.DefaultSSEIdleTimeout))
+	// ^ SSE + POST is the fallback for proxies that block WebSockets; keepalives stop those proxies
+	//   from closing a quiet stream, and the idle timeout notices clients that went away
+
+	captureRedactIPs := flag.Bool("capture-redact-ips", false, "Replace IP addresses with REDACTED in signaling captures (defaults to false)")
+	captureMaxBytes := flag.Int("capture-max-bytes", webrtc.DefaultCaptureMaxBytes, fmt.Sprintf("Bytes a signaling capture may record before it stops (defaults to %d)", webrtc.DefaultCaptureMaxBytes))
+	// ^ Captures are started with POST /admin/capture?user=<name> (or ?callId=<id>) on -metrics-addr
+	//   and record every message to and from that user (or of that call), SDP and candidates
+	//   included, for debugging failed calls
+
+	callHistorySize := flag.Int("call-history-size", webrtc.DefaultHistorySize, fmt.Sprintf("Signaling events, and calls, kept in memory for /admin/calls; 0 disables (defaults to %d)", webrtc.DefaultHistorySize))
+	// ^ Every message of a call is kept as type, users, call ID, time and data size, never the data itself,
+	//   so GET /admin/calls/<callId>/events on -metrics-addr shows what happened in a call after the fact
 
 	flag.Parse() // Parse all command line arguments
+	// Flags not given on the command line may come from WEBRTC_* environment variables
+	if err := applyEnvFlags(); err != nil {
+		log.Fatalf("Invalid environment variable: %v", err)
+	}
+
+	if *showVersion {
+		fmt.Printf("go-server %s\n", versionString())
+		os.Exit(0)
+	}
+
+	// Before anything is logged, see webrtc/redact.go
+	if err := webrtc.ConfigureRedaction(*logRedact); err != nil {
+		log.Fatalf("Invalid -log-redact: %v", err)
+	}
 
 	// ========================================================================
 	// LOGGING SETUP
 	// ========================================================================
 	// Set up separate loggers for different services
 	// This helps with debugging and monitoring by separating concerns
-	setupLogging(*separateLogs, *stunturnLogFile, *signalingLogFile)
+	if *verifyAuditLogFile != "" {
+		entries, err := verifyAuditLog(*verifyAuditLogFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *verifyAuditLogFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %d entries, all lines intact\n", *verifyAuditLogFile, entries)
+		os.Exit(0)
+	}
+
+	stunturnEnabled = *enableSTUNTURN
+	signalingEnabled = *enableSignaling
+	if !stunturnEnabled && !signalingEnabled {
+		log.Fatalf("-enable-stunturn=false and -enable-signaling=false leave nothing to run")
+	}
+
+	logUDPPrefix = *logUDPPrefixFlag
+	if level, ok := parseLogLevel(*logLevelFlag); ok {
+		defaultLogLevel = level
+	} else {
+		log.Fatalf("Invalid -log-level %q: want debug, info, warn or error", *logLevelFlag)
+	}
+	if *logDebugBufferFlag < 0 {
+		log.Fatalf("Invalid -log-debug-buffer %d: must not be negative", *logDebugBufferFlag)
+	}
+	logDebugBufferLines = *logDebugBufferFlag
+	logTimeUTC = *logUTCFlag
+	logTimeFormat = resolveLogTimeFormat(*logTimeFormatFlag)
+	// Checked before setupLogging, which would clear the audit log
+	if *auditLogFile != "" && *separateLogs &&
+		(isLogFileDestination(*stunturnLogFile, *auditLogFile) || isLogFileDestination(*signalingLogFile, *auditLogFile)) {
+		log.Fatalf("-audit-log must not be one of the operational log files, which are cleared at startup")
+	}
+	setupLogging(*separateLogs, *logWindowsFlag, *stunturnLogFile, *signalingLogFile)
+	if *auditLogFile != "" {
+		logger, err := openAuditLog(*auditLogFile)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		auditLog = logger
+		webrtc.ConfigureAudit(auditAdminAction)
+	}
+	if *banFile != "" {
+		if err := bans.load(*banFile); err != nil {
+			log.Fatalf("Failed to load ban list: %v", err)
+		}
+		stunTurnLogger.Printf("Loaded %d bans from %s", len(bans.list()), *banFile)
+	}
+	webrtc.ConfigureBans(checkBan)
+	webrtc.ConfigureEvents(eventBus)
+	if *geoIPDB != "" {
+		geoIP = openGeoIP(*geoIPDB)
+	}
+	policy, err := parseGeoPolicy(*allowCountries, *denyCountries, *denyASNs)
+	if err != nil {
+		log.Fatalf("Invalid geo policy: %v", err)
+	}
+	if policy != nil {
+		// Without the databases every source would pass, so refuse to start open
+		if geoIP == nil {
+			log.Fatalf("-allow-countries, -deny-countries and -deny-asns need a usable -geoip-db")
+		}
+		sourceGeoPolicy = policy
+		webrtc.ConfigureSourcePolicy(allowsSignaling)
+		stunTurnLogger.Printf("Geo policy: allowing countries [%s], denying countries [%s] and ASNs [%s]",
+			*allowCountries, *denyCountries, *denyASNs)
+	}
+	// Optional OpenTelemetry tracing, set up before any packet or message is handled
+	var tracerProvider *sdktrace.TracerProvider
+	if *otelEndpoint != "" {
+		provider, err := setupTracing(*otelEndpoint)
+		if err != nil {
+			stunTurnLog.Error.Fatalf("Tracing setup failed: %v", err)
+		}
+		tracerProvider = provider
+		stunTurnLogger.Printf("Exporting OpenTelemetry traces to %s", *otelEndpoint)
+	}
 
 	// Set global public IP for use throughout the application
 	publicIP = *publicIPFlag
 
 	// Set global turn port for use throughout the application
 	stunturnPort = *stunturnHTTPPortFlag
+	turnTCPHandshakeTimeout = *turnTCPHandshake
+	turnTCPIdleTimeout = *turnTCPIdle
+	turnTCPMaxLifetime = *turnTCPLifetime
+	maxTCPConnsPerIP = *maxTCPConnsPerIPFlag
+	udpRcvBuf = *udpRcvBufFlag
+	udpSndBuf = *udpSndBufFlag
+	udpBatch = *udpBatchFlag
+	logPackets = *logPacketsFlag
+	dropThreshold = *dropThresholdFlag
+	dropCooldown = *dropCooldownFlag
 	stunturnTLSPort = *stunturnHTTPSPortFlag
+	if *portFallbackFlag < 0 || *portFallbackFlag > 100 {
+		stunTurnLog.Error.Fatalf("Invalid -port-fallback %d, must be between 0 and 100", *portFallbackFlag)
+	}
+	portFallback = *portFallbackFlag
+	if *startupRetriesFlag < 0 || *startupBackoffFlag <= 0 {
+		stunTurnLog.Error.Fatalf("Invalid -startup-retries %d or -startup-backoff %s, must be at least 0 and above 0", *startupRetriesFlag, *startupBackoffFlag)
+	}
+	startupRetries = *startupRetriesFlag
+	startupBackoff = *startupBackoffFlag
+	if extraUDPPorts, err = parsePortList(*extraUDPPortsFlag); err != nil {
+		stunTurnLog.Error.Fatalf("Invalid -extra-udp-ports: %v", err)
+	}
+	if extraTCPPorts, err = parsePortList(*extraTCPPortsFlag); err != nil {
+		stunTurnLog.Error.Fatalf("Invalid -extra-tcp-ports: %v", err)
+	}
 	signalingHTTPPort = *signalingHTTPPortFlag
 	signalingHTTPSPort = *signalingHTTPSPortFlag
+	httpRedirectEnabled = *httpRedirect
 
 	// ========================================================================
 	// DEFAULT CONFIGURATION
@@ -438,30 +932,55 @@ func main() {
 	// If no TURN users are provided, use a default credential
 	// In production, you should always provide your own credentials
 	// These default credentials are for educational purposes only
-	if len(*turnUsers) == 0 {
+	if *proxyProtocol != "" {
+		policy, err := proxyproto.PolicyFromRanges(strings.Split(*proxyProtocol, ","), proxyproto.USE, proxyproto.REJECT)
+		if err != nil {
+			stunTurnLog.Error.Fatalf("Invalid -proxy-protocol: %v", err)
+		}
+		proxyProtocolPolicy = policy
+	}
+
+	switch *modeFlag {
+	case modeSTUN, modeTURN, modeBoth:
+		serverMode = *modeFlag
+	default:
+		stunTurnLog.Error.Fatalf("Invalid -mode %q, want stun, turn or both", *modeFlag)
+	}
+
+	if len(*turnUsers) == 0 && serverMode != modeSTUN && stunturnEnabled {
 		*turnUsers = "username=password"
 		stunTurnLogger.Println("Using default TURN credentials - NOT recommended for production!")
 		stunTurnLogger.Println("For production, use: -turn-users \"youruser=yourpassword\"")
 	}
 
+	// Log the version and every setting, so a log says what was running and how
+	stunTurnLogger.Printf("go-server %s", versionString())
+	logEffectiveConfig()
+
 	// ========================================================================
 	// VALIDATION
 	// ========================================================================
 	// Public IP is required because TURN server needs to know its external address
 	// This is used when allocating relay addresses to clients
 	// Without this, clients won't be able to connect to the relay
-	if len(publicIP) == 0 {
+	// A signaling-only node relays nothing, so it goes without
+	if len(publicIP) == 0 && stunturnEnabled {
 		stunTurnLogger.Println("No public IP provided. Attempting to auto-detect...")
 
 		// Try multiple methods to detect public IP
 		detectedIP := ""
 
-		// Method 1: Try HTTP-based detection (most reliable)
-		if ip, err := detectPublicIPViaHTTP(); err == nil {
+		// Method 1: Try HTTP-based detection (most reliable), retried with
+		// -startup-retries since the network may not be up yet
+		var ip string
+		if err := retryStartup(stunTurnLog.Warn, "Public IP detection", func() (err error) {
+			ip, err = detectPublicIPViaHTTP()
+			return err
+		}); err == nil {
 			detectedIP = ip
 			stunTurnLogger.Printf("Detected public IP via HTTP service: %s", detectedIP)
 		} else {
-			stunTurnLogger.Printf("HTTP-based IP detection failed: %v", err)
+			stunTurnLog.Warn.Printf("HTTP-based IP detection failed: %v", err)
 
 			// Method 2: Try DNS-based detection (fallback)
 			// Try ipify.org
@@ -469,21 +988,21 @@ func main() {
 				detectedIP = ips[0].String()
 				stunTurnLogger.Printf("Detected public IP via ipify.org: %s", detectedIP)
 			} else {
-				stunTurnLogger.Printf("Failed to detect IP via ipify.org: %v", err)
+				stunTurnLog.Warn.Printf("Failed to detect IP via ipify.org: %v", err)
 
 				// Try icanhazip.com
 				if ips, err := net.LookupIP("icanhazip.com"); err == nil && len(ips) > 0 {
 					detectedIP = ips[0].String()
 					stunTurnLogger.Printf("Detected public IP via icanhazip.com: %s", detectedIP)
 				} else {
-					stunTurnLogger.Printf("Failed to detect IP via icanhazip.com: %v", err)
+					stunTurnLog.Warn.Printf("Failed to detect IP via icanhazip.com: %v", err)
 
 					// Try checkip.amazonaws.com
 					if ips, err := net.LookupIP("checkip.amazonaws.com"); err == nil && len(ips) > 0 {
 						detectedIP = ips[0].String()
 						stunTurnLogger.Printf("Detected public IP via checkip.amazonaws.com: %s", detectedIP)
 					} else {
-						stunTurnLogger.Printf("Failed to detect IP via checkip.amazonaws.com: %v", err)
+						stunTurnLog.Warn.Printf("Failed to detect IP via checkip.amazonaws.com: %v", err)
 					}
 				}
 			}
@@ -492,6 +1011,7 @@ func main() {
 		// If we successfully detected an IP, use it
 		if detectedIP != "" {
 			publicIP = detectedIP
+			publicIPDetected = true
 			stunTurnLogger.Printf("Using auto-detected public IP: %s", publicIP)
 			stunTurnLogger.Println("Note: Auto-detected IP may not be accurate in all network configurations.")
 			stunTurnLogger.Println("For production use, explicitly specify your public IP with -public-ip flag.")
@@ -501,23 +1021,23 @@ func main() {
 			if localIP, err := detectLocalIP(); err == nil {
 				publicIP = localIP
 				stunTurnLogger.Printf("Using local IP for development: %s", publicIP)
-				stunTurnLogger.Println("WARNING: This is a local IP address. TURN relay may not work properly.")
+				stunTurnLog.Warn.Println("WARNING: This is a local IP address. TURN relay may not work properly.")
 				stunTurnLogger.Println("For production use, explicitly specify your public IP with -public-ip flag.")
 			} else {
 				// If all methods failed, provide helpful error message
-				stunTurnLogger.Fatalf("Failed to auto-detect public IP and no public IP provided.")
-				stunTurnLogger.Fatalf("Please provide your public IP address using the -public-ip flag.")
-				stunTurnLogger.Fatalf("Example: -public-ip 203.0.113.1")
-				stunTurnLogger.Fatalf("")
-				stunTurnLogger.Fatalf("Common reasons for auto-detection failure:")
-				stunTurnLogger.Fatalf("- No internet connection")
-				stunTurnLogger.Fatalf("- Firewall blocking outbound HTTP/DNS queries")
-				stunTurnLogger.Fatalf("- Running behind a corporate proxy")
-				stunTurnLogger.Fatalf("- DNS resolution issues")
-				stunTurnLogger.Fatalf("- HTTPS certificate validation issues")
+				stunTurnLog.Error.Fatalf("Failed to auto-detect public IP and no public IP provided.")
+				stunTurnLog.Error.Fatalf("Please provide your public IP address using the -public-ip flag.")
+				stunTurnLog.Error.Fatalf("Example: -public-ip 203.0.113.1")
+				stunTurnLog.Error.Fatalf("")
+				stunTurnLog.Error.Fatalf("Common reasons for auto-detection failure:")
+				stunTurnLog.Error.Fatalf("- No internet connection")
+				stunTurnLog.Error.Fatalf("- Firewall blocking outbound HTTP/DNS queries")
+				stunTurnLog.Error.Fatalf("- Running behind a corporate proxy")
+				stunTurnLog.Error.Fatalf("- DNS resolution issues")
+				stunTurnLog.Error.Fatalf("- HTTPS certificate validation issues")
 			}
 		}
-	} else {
+	} else if len(publicIP) > 0 {
 		stunTurnLogger.Printf("Using provided public IP: %s", publicIP)
 	}
 
@@ -527,8 +1047,33 @@ func main() {
 	// Initialize all STUNTURN servers with the provided configuration
 	// This sets up UDP, TCP, and TLS variants based on the flags
 	// Each protocol serves different network environments
-	if err := initializeSTUNTurnServer(publicIP, *turnUsers, *realm, *threadNum, *enableTCP, *enableTLS); err != nil {
-		stunTurnLogger.Fatalf("Failed to initialize STUN/TURN server: %v", err)
+	if *maxTotalAllocationsFlag < 0 {
+		stunTurnLog.Error.Fatalf("Invalid -max-total-allocations %d: must be 0 or more", *maxTotalAllocationsFlag)
+	}
+	maxTotalAllocations = *maxTotalAllocationsFlag
+	if err := configureAllocationLifetime(*maxAllocationLifetimeFlag, *defaultAllocationLifetimeFlag); err != nil {
+		stunTurnLog.Error.Fatalf("Invalid allocation lifetime: %v", err)
+	}
+	tlsCertificates, err = loadCertificates(tlsCertPairs, *tlsDefaultCert)
+	if err != nil {
+		stunTurnLog.Error.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	turnRealm = *realm
+	realmUsers, err := parseTURNRealms(*turnRealms, *realm)
+	if err != nil {
+		stunTurnLog.Error.Fatalf("Invalid -turn-realms: %v", err)
+	}
+	if stunturnEnabled {
+		// A failed attempt closes what it bound, so it can be retried
+		if err := retryStartup(stunTurnLog.Warn, "STUN/TURN initialization", func() error {
+			return initializeSTUNTurnServer(publicIP, *turnUsers, *realm, realmUsers, *threadNum, *enableTCP, *enableTLS, *enableDTLS)
+		}); err != nil {
+			stunTurnLog.Error.Fatalf("Failed to initialize STUN/TURN server: %v", err)
+		}
+	} else {
+		for _, name := range []string{componentUDP, componentTCP, componentTLS, componentDTLS} {
+			setComponentHealth(name, componentDisabled, "-enable-stunturn=false")
+		}
 	}
 
 	// ========================================================================
@@ -537,20 +1082,128 @@ func main() {
 	// WebSocket endpoint for WebRTC signaling
 	// This is where clients exchange connection information (SDP, ICE candidates)
 	// Signaling is the "coordination" part of WebRTC - it helps peers find each other
-	http.HandleFunc("/signal", func(w http.ResponseWriter, r *http.Request) {
-		webrtc.HandleWebSocket(w, r, signalingLogger)
-	})
+	webrtc.ConfigureReliability(*signalAckBuffer, *signalReplayWindow)
+	webrtc.ConfigureResume(*resumeGrace)
+	if err := webrtc.ConfigureJoinPolicy(*joinPolicy); err != nil {
+		signalingLog.Error.Fatalf("Invalid -join-policy: %v", err)
+	}
+	webrtc.ConfigureChat(*chatMaxBytes, *chatRate, *chatHistory)
+	webrtc.ConfigurePresence(*presenceSnapshot)
+	webrtc.ConfigureBroadcastWorkers(*broadcastWorkers)
+	webrtc.ConfigureGuests(*allowGuests, *guestsHidden, *guestCallRate)
+	webrtc.ConfigureCallLimits(*maxConcurrentCalls, *callAttemptRate, *ringRate)
+	webrtc.ConfigureCallOutcomes(callOutcomes.observe)
+	if stunturnEnabled && serverMode != modeSTUN {
+		webrtc.ConfigureProbe(*enableProbe, *probeRate, probeTURNCredentials)
+	} else {
+		webrtc.ConfigureProbe(*enableProbe, *probeRate, nil)
+	}
+	webrtc.ConfigureTransfers(*transferTimeout)
+	webrtc.ConfigureRingTimeout(*ringTimeout)
+	webrtc.ConfigureMissedCalls(*missedCallTTL, *missedCallsPerUser, *missedCallsMax)
+	webrtc.ConfigureLimits(*signalMaxBytes, *signalRate, *signalBurst)
+	webrtc.ConfigureCallAuthorization(*signalCallAuth)
+	webrtc.ConfigurePayloads(*signalMaxPayload)
+	var interceptors []webrtc.MessageInterceptor
+	if *forceRelay {
+		interceptors = append(interceptors, webrtc.ForceRelay{})
+	}
+	if *filterHostCandidates {
+		interceptors = append(interceptors, webrtc.HideLocalCandidates{})
+	}
+	if *filterCodecs != "" {
+		interceptors = append(interceptors, webrtc.NewCodecFilter(strings.Split(*filterCodecs, ",")))
+	}
+	webrtc.ConfigureInterceptors(interceptors...)
+	webrtc.ConfigureOutbound(*signalWriteTimeout, *signalQueueSize)
+	webrtc.ConfigureHeartbeat(*signalHeartbeat, *signalStaleTimeout)
+	webrtc.ConfigureCompression(*wsCompression, *wsCompressionThreshold)
+	webrtc.ConfigureSSE(*sseKeepalive, *sseIdleTimeout)
+	webrtc.ConfigureCapture(*captureRedactIPs, *captureMaxBytes)
+	webrtc.ConfigureHistory(*callHistorySize)
+	webrtc.ConfigureServerInfo(buildInfo())
+	if err := webrtc.ConfigureTrustedProxies(*trustedProxies); err != nil {
+		signalingLog.Error.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	// The signaling routes get their own handler instead of http.DefaultServeMux,
+	// so nothing else in the process can add routes to the signaling server
+	signalingPath = "/" + strings.Trim(*signalingPathFlag, "/")
+	tenantSpecs, err := webrtc.ParseTenants(*tenantsFlag)
+	if err != nil {
+		signalingLog.Error.Fatalf("Invalid -tenants: %v", err)
+	}
+	initializeSignaling(tenantSpecs, *enableDemo, *enableProbe)
 	// The WebSocket handler manages:
 	// - User registration and session management
 	// - SDP offer/answer exchange
 	// - ICE candidate sharing
 	// - Call state management (join, call, hangup, etc.)
 
+	// Optional gRPC signaling API, sharing users with the WebSocket endpoint
+	if *grpcAddr != "" && signalingEnabled {
+		registerListener("Signaling", "gRPC", *grpcAddr, 1)
+		go func() {
+			if err := signalingService.ServeGRPC(*grpcAddr); err != nil {
+				signalingLog.Error.Fatalf("gRPC signaling server failed: %v", err)
+			}
+		}()
+	}
+
 	// ========================================================================
 	// CONNECTION MONITORING SETUP
 	// ========================================================================
 	// Start monitoring for connection statistics and debugging
 	startConnectionMonitoring()
+	alertWebhook, alertCommand = *alertWebhookFlag, *alertCommandFlag
+	alertAuthFailures, alertPublicIPInterval = *alertAuthFailuresFlag, *alertPublicIPIntervalFlag
+	startAlerting()
+	if *peerPollInterval <= 0 {
+		stunTurnLog.Error.Fatalf("Invalid -peer-poll-interval %s: must be positive", *peerPollInterval)
+	}
+	if peerServerList, err = parsePeerServers(*peerServersFlag); err != nil {
+		stunTurnLog.Error.Fatalf("Invalid -peer-servers: %v", err)
+	}
+	startPeerPolling(*peerPollInterval)
+	relayCheckURL, relayCheckSkip = *relayCheckURLFlag, *skipRelayCheck
+	startLatencyTracking()
+	startUnknownTrafficMonitoring()
+	if *usageReportDirFlag != "" {
+		usageReportDir = *usageReportDirFlag
+		for _, format := range strings.Split(*usageReportFormat, ",") {
+			format = strings.TrimSpace(format)
+			if format != "csv" && format != "json" {
+				stunTurnLog.Error.Fatalf("Invalid -usage-report-format %q, want csv, json or csv,json", *usageReportFormat)
+			}
+			usageReportFormats = append(usageReportFormats, format)
+		}
+		if err := startUsageReports(*usageReportTime); err != nil {
+			stunTurnLog.Error.Fatalf("Invalid -usage-report-time: %v", err)
+		}
+	}
+
+	// Optional Prometheus metrics endpoint
+	if *metricsAddr != "" {
+		adminToken = *adminTokenFlag
+		kickCooldown = *kickCooldownFlag
+		if adminToken == "" {
+			// Never leave the admin endpoints open: make up a token for
+			// this run and show it on the console only, not in the logs
+			token, err := generateAdminToken()
+			if err != nil {
+				stunTurnLog.Error.Fatalf("Failed to generate an admin token: %v", err)
+			}
+			adminToken = token
+			fmt.Printf("No -admin-token set; the /admin/ endpoints on %s require this token for this run: %s\n", *metricsAddr, adminToken)
+			stunTurnLogger.Printf("No -admin-token set; generated an admin token for this run and printed it on the console")
+		}
+		go func() {
+			if err := serveMetrics(*metricsAddr); err != nil {
+				stunTurnLog.Error.Fatalf("Metrics endpoint failed: %v", err)
+			}
+		}()
+	} else {
+		setComponentHealth(componentAdmin, componentDisabled, "no -metrics-addr")
+	}
 
 	// ========================================================================
 	// GRACEFUL SHUTDOWN SETUP
@@ -567,7 +1220,13 @@ func main() {
 	// Start the HTTP/HTTPS server in a separate goroutine
 	// This allows the main thread to handle shutdown signals
 	// Goroutines are Go's lightweight threads for concurrent execution
-	go startWebRTC_SignallingServer()
+	if signalingEnabled {
+		go startWebRTC_SignallingServer()
+		// The goroutine exits the process if the port can't be bound
+		<-signalingListening
+	} else {
+		setComponentHealth(componentSignaling, componentDisabled, "-enable-signaling=false")
+	}
 
 	// ========================================================================
 	// SERVER STATUS LOGGING
@@ -575,28 +1234,80 @@ func main() {
 	// Log all the services that are now running
 	// This helps with debugging and monitoring
 	// Users can see exactly what's available and on which ports
-	stunTurnLogger.Printf("=== STUN/TURN SERVER STATUS ===")
-	stunTurnLogger.Printf("Unified WebRTC server started:")
-	stunTurnLogger.Printf("- STUN/TURN server UDP: :%d (STUN discovery + TURN relay)", stunturnPort)
-	if *enableTCP {
-		stunTurnLogger.Printf("- STUN/TURN server TCP: :%d (STUN discovery + TURN relay)", stunturnPort)
+	if stunturnEnabled {
+		service, services := "STUN/TURN", "STUN discovery + TURN relay"
+		if serverMode == modeSTUN {
+			service, services = "STUN", "STUN discovery only"
+		}
+		stunTurnLogger.Printf("=== STUN/TURN SERVER STATUS ===")
+		stunTurnLogger.Printf("Unified WebRTC server started:")
+		stunTurnLogger.Printf("- Version: %s", versionString())
+		stunTurnLogger.Printf("- %s server UDP: %s (%s)", service, portList(udpBoundPorts), services)
+		if *enableTCP {
+			stunTurnLogger.Printf("- %s server TCP: %s (%s)", service, portList(tcpBoundPorts), services)
+		}
+		if *enableTLS && stunturnCertsFound {
+			stunTurnLogger.Printf("- %s server TLS: :%d (%s)", service, stunturnTLSPort, services)
+		}
+		if dtlsListening {
+			stunTurnLogger.Printf("- %s server DTLS: :%d/udp (%s)", service, stunturnTLSPort, services)
+		}
+		stunTurnLogger.Printf("- Public IP: %s", publicIP)
+		stunTurnLogger.Printf("- Mode: %s", serverMode)
+		if serverMode != modeSTUN {
+			stunTurnLogger.Printf("- Realm: %s", *realm)
+			if len(realmUsers) > 0 {
+				names := make([]string, 0, len(realmUsers))
+				for name := range realmUsers {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				stunTurnLogger.Printf("- More realms: %s", strings.Join(names, ", "))
+			}
+			stunTurnLogger.Printf("- Allocation lifetime: %s", allocationLifetimePolicy())
+			if maxTotalAllocations > 0 {
+				stunTurnLogger.Printf("- Max total allocations: %d", maxTotalAllocations)
+			}
+		}
+		stunURLs, turnURLs := iceServerURLs()
+		stunTurnLogger.Printf("- ICE server URLs:")
+		for _, url := range append(stunURLs, turnURLs...) {
+			stunTurnLogger.Printf("    %s", url)
+		}
+		stunTurnLogger.Printf("=== STUN/TURN SERVER READY ===")
+		if *iceServersFile != "" {
+			if err := writeICEServersFile(*iceServersFile, *turnUsers); err != nil {
+				stunTurnLog.Warn.Printf("WARNING: Failed to write %s: %v", *iceServersFile, err)
+			} else {
+				stunTurnLogger.Printf("ICE servers written to %s", *iceServersFile)
+			}
+		}
+	} else {
+		stunTurnLogger.Printf("STUN/TURN server disabled (-enable-stunturn=false)")
 	}
-	if *enableTLS && stunturnCertsFound {
-		stunTurnLogger.Printf("- STUN/TURN server TLS: :%d (STUN discovery + TURN relay)", stunturnTLSPort)
+
+	if signalingEnabled {
+		signalingLogger.Printf("=== WEBRTC SIGNALING SERVER STATUS ===")
+		signalingLogger.Printf("- Version: %s", versionString())
+		//signalingLogger.Printf("- Signaling server: :%d (HTTP/HTTPS)", httpPort)
+		signalingLogger.Printf("- WebSocket endpoint: %s", signalingPath)
+		signalingLogger.Printf("=== SIGNALING SERVER READY ===\n\n\n")
+	} else {
+		signalingLogger.Printf("Signaling server disabled (-enable-signaling=false)")
 	}
-	stunTurnLogger.Printf("- Public IP: %s", publicIP)
-	stunTurnLogger.Printf("- Realm: %s", *realm)
-	stunTurnLogger.Printf("=== STUN/TURN SERVER READY ===")
 
-	signalingLogger.Printf("=== WEBRTC SIGNALING SERVER STATUS ===")
-	//signalingLogger.Printf("- Signaling server: :%d (HTTP/HTTPS)", httpPort)
-	signalingLogger.Printf("- WebSocket endpoint: /signal")
-	signalingLogger.Printf("=== SIGNALING SERVER READY ===\n\n\n")
+	// Every listener is bound: /readyz may say so, and systemd (Type=notify) is told
+	startupComplete.Store(true)
+	notifySystemd("READY=1")
+	// Checked once every listener is up, see RELAY REACHABILITY
+	startRelayReachabilityChecks(*relayCheckInterval)
 
 	// Print shutdown instructions to main terminal
-	fmt.Println("\n" + strings.Repeat("=", 60))                              // Print a line of 60 equal signs
-	fmt.Println("🚀 WebRTC Server is now running!")                           // Print a message
-	fmt.Println("📊 Monitoring windows should have opened automatically")     // Print a message
+	fmt.Println("\n" + strings.Repeat("=", 60))    // Print a line of 60 equal signs
+	fmt.Println("🚀 WebRTC Server is now running!") // Print a message
+	if stunturnMonitor != nil || signalingMonitor != nil {
+		fmt.Println("📊 Monitoring windows should have opened automatically") // Print a message
+	}
 	fmt.Println("🛑 Press Ctrl + C to shutdown server and close all windows") // Print a message
 	fmt.Println(strings.Repeat("=", 60) + "\n")                              // Print a line of 60 equal signs
 
@@ -613,18 +1324,38 @@ func main() {
 	// ========================================================================
 	// When shutdown signal is received, close all servers cleanly
 	// This ensures no data is lost and connections are properly closed
+	notifySystemd("STOPPING=1")
 	stunTurnLogger.Println("Shutting down STUN/TURN servers...")
 	signalingLogger.Println("Shutting down signaling server...")
 
+	// Stop accepting signaling connections and tell the clients the server
+	// is going away (close code 1001), so they reconnect later instead of
+	// reporting an error
+	closeSignaling()
+
 	// Close all TURN/STUN servers to free resources and close connections
 	// This prevents resource leaks and ensures clean shutdown
-	servers := []*turn.Server{stunturnServer, stunturnTCPServer, stunturnTLSServer}
-	for _, server := range servers {
-		if server != nil {
-			if err := server.Close(); err != nil {
-				stunTurnLogger.Printf("Failed to close server: %v", err)
-			}
+	closeSTUNTURNServers()
+
+	// Export the spans still buffered before exiting
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			stunTurnLog.Warn.Printf("Failed to flush traces: %v", err)
+		}
+		cancel()
+	}
+
+	// Stop the HTTP to HTTPS redirect listener, letting in-flight redirects finish
+	httpRedirectMu.Lock()
+	redirectServer := httpRedirectServer
+	httpRedirectMu.Unlock()
+	if redirectServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			signalingLog.Warn.Printf("Failed to shut down HTTP redirect listener: %v", err)
 		}
+		cancel()
 	}
 
 	// Close monitoring windows
@@ -649,14 +1380,14 @@ func main() {
 		if stunturnMonitor != nil {
 			// Try graceful shutdown first
 			if err := stunturnMonitor.Signal(syscall.SIGTERM); err != nil {
-				stunTurnLogger.Printf("Failed to send SIGTERM to STUN/TURN monitoring window: %v", err)
+				stunTurnLog.Warn.Printf("Failed to send SIGTERM to STUN/TURN monitoring window: %v", err)
 			} else {
 				// Wait a bit for graceful shutdown
 				time.Sleep(500 * time.Millisecond)
 
 				// Force kill after timeout to ensure cleanup
 				if err := stunturnMonitor.Signal(syscall.SIGKILL); err != nil {
-					stunTurnLogger.Printf("Failed to send SIGKILL to STUN/TURN monitoring window: %v", err)
+					stunTurnLog.Warn.Printf("Failed to send SIGKILL to STUN/TURN monitoring window: %v", err)
 				} else {
 					stunTurnLogger.Printf("STUN/TURN monitoring window closed")
 				}
@@ -666,14 +1397,14 @@ func main() {
 		if signalingMonitor != nil {
 			// Try graceful shutdown first
 			if err := signalingMonitor.Signal(syscall.SIGTERM); err != nil {
-				stunTurnLogger.Printf("Failed to send SIGTERM to signaling monitoring window: %v", err)
+				stunTurnLog.Warn.Printf("Failed to send SIGTERM to signaling monitoring window: %v", err)
 			} else {
 				// Wait a bit for graceful shutdown
 				time.Sleep(500 * time.Millisecond)
 
 				// Force kill after timeout to ensure cleanup
 				if err := signalingMonitor.Signal(syscall.SIGKILL); err != nil {
-					stunTurnLogger.Printf("Failed to send SIGKILL to signaling monitoring window: %v", err)
+					stunTurnLog.Warn.Printf("Failed to send SIGKILL to signaling monitoring window: %v", err)
 				} else {
 					stunTurnLogger.Printf("Signaling monitoring window closed")
 				}
@@ -856,10 +1587,13 @@ func killBatchWindow(batchFileName string) {
 // - Filter logs by service type for better analysis
 // - Identify which component is causing problems
 //
-// MONITORING WINDOWS:
-// ===================
+// MONITORING WINDOWS (DEPRECATED):
+// ================================
 // This function can open separate terminal windows to monitor logs in real-time.
-// This is especially useful during development and debugging.
+// This is especially useful during development and debugging. The windows
+// need a desktop session on the server, so they are deprecated in favour of
+// the /admin/logs/stream WebSocket (see LOG LIVE TAIL) and only open while
+// -log-windows is set.
 //
 // CROSS-PLATFORM SUPPORT:
 // =======================
@@ -873,42 +1607,53 @@ func killBatchWindow(batchFileName string) {
 // - Creates new log files with proper permissions
 // - Handles both file and stdout logging
 // - Provides structured log prefixes for easy filtering
-func setupLogging(separateLogs bool, stunturnLogFile, signalingLogFile string) {
+// - Sends each line only to the destinations that take its level (see LOG LEVELS)
+func setupLogging(separateLogs, logWindows bool, stunturnLogDest, signalingLogDest string) {
 	if separateLogs {
-		// Clear existing log files to start fresh
-		// This prevents log files from growing indefinitely and ensures clean logs
-		if stunturnLogFile != "" {
-			os.Remove(stunturnLogFile) // Remove existing file
+		// Each stream goes to one or more destinations (see LOG DESTINATIONS)
+		// The first file destination of each is shown in the monitor windows
+		//
+		// A disabled service (-enable-stunturn, -enable-signaling) opens no
+		// destinations and no monitor window; the few lines it logs, such as
+		// a configuration error, go to the other stream under its own prefix
+		var stunturnOutput, signalingOutput []logSink
+		var stunturnLogFile, signalingLogFile string
+		if stunturnEnabled {
+			stunturnOutput, stunturnLogFile = openLogDestinations(stunturnLogDest, "STUN/TURN")
 		}
-		if signalingLogFile != "" {
-			os.Remove(signalingLogFile) // Remove existing file
+		if signalingEnabled {
+			signalingOutput, signalingLogFile = openLogDestinations(signalingLogDest, "signaling")
+		}
+		if !stunturnEnabled {
+			stunturnOutput = signalingOutput
+		}
+		if !signalingEnabled {
+			signalingOutput = stunturnOutput
 		}
 
+		// Each stream is also followed by its live tail and kept in its debug buffer
+		stunturnDebugBuffer = newLogRing(logDebugBufferLines)
+		signalingDebugBuffer = newLogRing(logDebugBufferLines)
+		stunturnOutput = withDebugBuffer(append(stunturnOutput, logSink{stunturnLogTail, defaultLogLevel}), stunturnDebugBuffer)
+		signalingOutput = withDebugBuffer(append(signalingOutput, logSink{signalingLogTail, defaultLogLevel}), signalingDebugBuffer)
+
 		// Set up STUN/TURN logger
 		// This logger handles all STUN and TURN server activities
 		// STUN/TURN logs include: authentication, relay allocation, connection events
-		if stunturnLogFile != "" {
-			file, err := os.OpenFile(stunturnLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-			if err != nil {
-				log.Fatalf("Failed to open STUN/TURN log file: %v", err)
-			}
-			stunTurnLogger = log.New(file, "[STUN/TURN] ", log.LstdFlags|log.Lshortfile)
-		} else {
-			stunTurnLogger = log.New(os.Stdout, "[STUN/TURN] ", log.LstdFlags|log.Lshortfile)
-		}
+		stunTurnLog = newLeveledLogger(stunturnOutput, "[STUN/TURN] ")
+		stunTurnLogger = stunTurnLog.Info
 
 		// Set up signaling logger
 		// This logger handles all WebSocket signaling activities
 		// Signaling logs include: user connections, SDP exchange, call management
-		if signalingLogFile != "" {
-			file, err := os.OpenFile(signalingLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-			if err != nil {
-				log.Fatalf("Failed to open signaling log file: %v", err)
-			}
-			signalingLogger = log.New(file, "[SIGNALING] ", log.LstdFlags|log.Lshortfile)
-		} else {
-			signalingLogger = log.New(os.Stdout, "[SIGNALING] ", log.LstdFlags|log.Lshortfile)
+		signalingLog = newLeveledLogger(signalingOutput, "[SIGNALING] ")
+		signalingLogger = signalingLog.Info
+
+		// The monitor windows tail the log files, so they need a file on every enabled stream
+		if !logWindows || (stunturnEnabled && stunturnLogFile == "") || (signalingEnabled && signalingLogFile == "") {
+			return
 		}
+		stunTurnLogger.Printf("The log monitor windows are deprecated; tail the logs with the /admin/logs/stream WebSocket on -metrics-addr, or disable them with -log-windows=false")
 
 		// Open a new terminal window to monitor STUN/TURN logs in real-time
 		// This helps with debugging and monitoring server activity
@@ -964,20 +1709,24 @@ exit`, signalingLogFile)
 			cmd1 := exec.Command("cmd", "/c", "start", "powershell", "-ExecutionPolicy", "Bypass", "-File", "stun-turn-monitor.ps1")
 			cmd2 := exec.Command("cmd", "/c", "start", "powershell", "-ExecutionPolicy", "Bypass", "-File", "signaling-monitor.ps1")
 
-			// Start both monitoring processes
+			// Start both monitoring processes, one per enabled service
 			// Store process references for graceful shutdown
-			if err := cmd1.Start(); err != nil {
-				stunTurnLogger.Printf("Failed to open STUN/TURN log monitor window: %v", err)
-			} else {
-				stunturnMonitor = cmd1.Process
-				stunTurnLogger.Printf("STUN/TURN log monitor window opened successfully")
+			if stunturnEnabled {
+				if err := cmd1.Start(); err != nil {
+					stunTurnLog.Warn.Printf("Failed to open STUN/TURN log monitor window: %v", err)
+				} else {
+					stunturnMonitor = cmd1.Process
+					stunTurnLogger.Printf("STUN/TURN log monitor window opened successfully")
+				}
 			}
 
-			if err := cmd2.Start(); err != nil {
-				stunTurnLogger.Printf("Failed to open signaling log monitor window: %v", err)
-			} else {
-				signalingMonitor = cmd2.Process
-				stunTurnLogger.Printf("Signaling log monitor window opened successfully")
+			if signalingEnabled {
+				if err := cmd2.Start(); err != nil {
+					stunTurnLog.Warn.Printf("Failed to open signaling log monitor window: %v", err)
+				} else {
+					signalingMonitor = cmd2.Process
+					stunTurnLogger.Printf("Signaling log monitor window opened successfully")
+				}
 			}
 		} else {
 			// For Linux/Unix, use 'gnome-terminal' to open new terminal
@@ -1005,150 +1754,538 @@ exit`, signalingLogFile)
 				return
 			}
 
-			// Start both monitoring processes
+			// Start both monitoring processes, one per enabled service
 			// Unix systems use different process management than Windows
-			if err := cmd1.Start(); err != nil {
-				stunTurnLogger.Printf("Failed to open STUN/TURN log monitor window: %v", err)
-			} else {
-				stunturnMonitor = cmd1.Process
-				stunTurnLogger.Printf("STUN/TURN log monitor window opened successfully")
+			if stunturnEnabled {
+				if err := cmd1.Start(); err != nil {
+					stunTurnLog.Warn.Printf("Failed to open STUN/TURN log monitor window: %v", err)
+				} else {
+					stunturnMonitor = cmd1.Process
+					stunTurnLogger.Printf("STUN/TURN log monitor window opened successfully")
+				}
 			}
 
-			if err := cmd2.Start(); err != nil {
-				stunTurnLogger.Printf("Failed to open signaling log monitor window: %v", err)
-			} else {
-				signalingMonitor = cmd2.Process
-				stunTurnLogger.Printf("Signaling log monitor window opened successfully")
+			if signalingEnabled {
+				if err := cmd2.Start(); err != nil {
+					stunTurnLog.Warn.Printf("Failed to open signaling log monitor window: %v", err)
+				} else {
+					signalingMonitor = cmd2.Process
+					stunTurnLogger.Printf("Signaling log monitor window opened successfully")
+				}
 			}
 		}
 	} else {
 		// Use single logger for all services
 		// This is the fallback option when separate logging is disabled
 		// All logs go to stdout with a generic [WEBRTC] prefix
-		logger := log.New(os.Stdout, "[WEBRTC] ", log.LstdFlags|log.Lshortfile)
-		stunTurnLogger = logger
-		signalingLogger = logger
+		// Both live tail sources and both debug buffers carry the combined log
+		stunturnDebugBuffer = newLogRing(logDebugBufferLines)
+		signalingDebugBuffer = stunturnDebugBuffer
+		logger := newLeveledLogger(withDebugBuffer([]logSink{
+			{os.Stdout, defaultLogLevel},
+			{io.MultiWriter(stunturnLogTail, signalingLogTail), defaultLogLevel},
+		}, stunturnDebugBuffer), "[WEBRTC] ")
+		stunTurnLog, signalingLog = logger, logger
+		stunTurnLogger, signalingLogger = logger.Info, logger.Info
 	}
 }
 
 // ============================================================================
-// TURN SERVER INITIALIZATION
+// LOG TIMESTAMPS
 // ============================================================================
 
-// initializeTURNServer sets up the STUN and TURN servers with all protocol variants
-// This is the main initialization function that creates all server instances
-//
-// WHAT IS A TURN SERVER?
-// ======================
-// TURN (Traversal Using Relays around NAT) servers help WebRTC clients establish
-// peer-to-peer connections when direct connection is impossible due to NAT/firewall.
-//
-// TURN servers act as "relay points" that forward data between clients when they
-// cannot connect directly. This is essential for WebRTC to work in all network
-// environments.
-//
-// AUTHENTICATION SYSTEM:
-// =====================
-// TURN servers require authentication to prevent abuse and unauthorized relay usage.
-// This implementation uses the standard TURN authentication mechanism:
-// - Username/password pairs are provided via command line
-// - Cryptographic keys are generated using TURN protocol specification
-// - Authentication is validated on every relay request
-//
-// PROTOCOL VARIANTS:
-// ==================
-// This server supports multiple transport protocols to handle different network
-// environments:
-// - UDP: Standard protocol, fastest, works with most NATs
-// - TCP: Fallback for UDP-blocked networks (corporate firewalls)
-// - TLS: Encrypted connections for secure environments
-//
-// RELAY ADDRESS GENERATION:
-// =========================
-// TURN servers allocate relay addresses for clients. These addresses must be
-// reachable from the internet, so the server needs to know its public IP.
-//
-// THREADING MODEL:
-// ================
-// Multiple threads can be used to handle concurrent connections. Each thread
-// gets its own listener, improving performance under high load.
-func initializeTURNServer(publicIP, users, realm string, threadNum int, enableTCP, enableTLS bool) error {
-	// ========================================================================
-	// USER AUTHENTICATION SETUP
-	// ========================================================================
-	// Parse TURN user credentials from the command line argument
-	// Format: "user1=pass1,user2=pass2"
-	// This creates a map of username -> cryptographic auth key
-	usersMap = make(map[string][]byte)
-
-	// Use regex to parse username=password pairs
-	// This regex finds all patterns like "username=password"
-	// The regex (\w+)=(\w+) captures:
-	// - Group 1: username (word characters)
-	// - Group 2: password (word characters)
-	for _, kv := range regexp.MustCompile(`(\w+)=(\w+)`).FindAllStringSubmatch(users, -1) {
-		// Generate authentication key using TURN protocol specification
-		// This creates a cryptographic key from username, realm, and password
-		// The key is used to validate TURN requests from clients
-		usersMap[kv[1]] = turn.GenerateAuthKey(kv[1], realm, kv[2])
-		stunTurnLogger.Printf("Added TURN user: %s", kv[1])
-	}
-
-	// ========================================================================
-	// RELAY ADDRESS GENERATOR
-	// ========================================================================
-	// This tells the TURN server what IP address to use for relay allocation
-	// When a client requests a relay, the server will allocate an address on this IP
-	// The publicIP must be reachable from the internet for relay to work
-	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
-		RelayAddress: net.ParseIP(publicIP), // Public IP for relay allocation
-		Address:      "0.0.0.0",             // Listen on all interfaces
-	}
-
-	// ========================================================================
-	// AUTHENTICATION HANDLER
-	// ========================================================================
-	// This function is called whenever a client tries to authenticate
-	// It validates the username and returns the corresponding auth key
-	// If authentication fails, the client cannot use relay services
-	authHandler := createEnhancedAuthHandler(usersMap)
+// By default log lines carry the log package's local time without a zone
+// ("2006/01/02 15:04:05"), as they always have. -log-utc switches them to
+// UTC and -log-timeformat to any Go time layout, or one of the names in
+// logTimeFormats, so logs from servers in different regions line up.
+// The audit log is JSON and always uses RFC3339Nano in UTC.
+
+// logTimeFormats are the layouts -log-timeformat accepts by name
+var logTimeFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"datetime":    time.DateTime,
+	"stamp":       time.StampMilli,
+}
 
-	// ========================================================================
-	// SERVER INITIALIZATION SEQUENCE
-	// ========================================================================
-	// Initialize servers in order of importance and dependency
-	// Each protocol variant serves different network environments
+var (
+	logTimeUTC    bool   // Log times in UTC
+	logTimeFormat string // Layout of log times, "" for the log package default
+)
 
-	// 2. UDP TURN server - main relay service, handles most WebRTC traffic
-	// UDP is the standard protocol for TURN and works with most NAT types
-	// It's the fastest and most efficient option
-	if err := initializeUDPTURNServer(relayAddressGenerator, authHandler, realm, threadNum); err != nil {
-		return fmt.Errorf("failed to initialize UDP STUN/TURN server: %w", err)
+// resolveLogTimeFormat turns a -log-timeformat value into a layout
+func resolveLogTimeFormat(format string) string {
+	if layout, ok := logTimeFormats[strings.ToLower(format)]; ok {
+		return layout
 	}
+	return format
+}
 
-	// 4. TCP TURN server (if enabled) - fallback relay service
-	// TCP is used when UDP is blocked by firewalls or NATs
-	// Common in corporate networks that block UDP traffic
-	if enableTCP {
-		if err := initializeTCPTURNServer(relayAddressGenerator, authHandler, realm, threadNum); err != nil {
-			return fmt.Errorf("failed to initialize TCP STUN/TURN server: %w", err)
+// newLogger creates a logger that stamps its lines as configured
+func newLogger(out io.Writer, prefix string) *log.Logger {
+	// Credentials, and with -log-redact=pii personal data, never reach a log
+	out = webrtc.NewRedactingWriter(out)
+	if logTimeFormat == "" {
+		flags := log.LstdFlags | log.Lshortfile
+		if logTimeUTC {
+			flags |= log.LUTC
 		}
+		return log.New(out, prefix, flags)
 	}
+	// The log package only knows its own layout, so the timestamp and the
+	// prefix in front of it are written by timestampWriter instead
+	return log.New(&timestampWriter{out: out, prefix: prefix}, "", log.Lshortfile)
+}
 
-	// 6. TLS TURN server (if enabled) - secure relay service
-	// TLS provides encrypted relay connections
-	// Required for secure enterprise environments and browser compatibility
-	if enableTLS {
-		if err := initializeTLSTURNServer(relayAddressGenerator, authHandler, realm, threadNum); err != nil {
-			return fmt.Errorf("failed to initialize TLS STUN/TURN server: %w", err)
-		}
+// formatLogTime formats a time the way log lines show it, for the stats
+// blocks that print the current time themselves
+func formatLogTime(t time.Time) string {
+	if logTimeUTC {
+		t = t.UTC()
+	}
+	if logTimeFormat == "" {
+		return t.Format("2006-01-02 15:04:05")
 	}
+	return t.Format(logTimeFormat)
+}
 
-	return nil
+// timestampWriter prefixes each log line with the prefix and the current
+// time in the configured layout
+type timestampWriter struct {
+	out    io.Writer
+	prefix string
+}
+
+func (w *timestampWriter) Write(line []byte) (int, error) {
+	stamped := make([]byte, 0, len(w.prefix)+len(logTimeFormat)+8+len(line))
+	stamped = append(stamped, w.prefix...)
+	stamped = append(stamped, formatLogTime(time.Now())...)
+	stamped = append(stamped, ' ')
+	stamped = append(stamped, line...)
+	if _, err := w.out.Write(stamped); err != nil {
+		return 0, err
+	}
+	return len(line), nil
 }
 
 // ============================================================================
-// UDP TURN SERVER IMPLEMENTATION
+// LOG LEVELS
+// ============================================================================
+
+// Every log line has a level, and every destination takes the lines at or
+// above its own level:
+//
+//	debug  packet traces: STUN/TURN messages, packets and data sent and received
+//	info   authentications, allocations, connections, signaling (the default)
+//	warn   failures the server carries on after, and "WARNING:" lines
+//	error  startup failures and fatal errors
+//
+// A destination's level follows an @, e.g.
+// -stun-turn-log=file:stun-turn.log@info,stdout@warn; destinations without
+// one, and the live tail, take -log-level. Each stream's debug buffer (see
+// LOG DEBUG BUFFER) takes every level, so the files stay small while the
+// packet traces of the last few minutes can still be fetched.
+//
+// HOW IT WORKS:
+// =============
+// A stream has one log.Logger per level, built by newLeveledLogger. Each
+// writes to the destinations that take its level, and a level no
+// destination takes gets a logger on io.Discard, which the log package
+// skips before formatting anything. stunTurnLogger and signalingLogger are
+// the info loggers, so code that doesn't pick a level logs at info; the
+// STUNTurnLogger methods pick theirs.
+
+// logLevel is the level of a log line, lowest first
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevelNames are the levels as written in -log-level and @level
+var logLevelNames = [...]string{"debug", "info", "warn", "error"}
+
+// defaultLogLevel is the level of destinations without an @level, set once
+// at startup from -log-level
+var defaultLogLevel = levelInfo
+
+// parseLogLevel parses a level name
+func parseLogLevel(name string) (logLevel, bool) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return logLevel(level), true
+		}
+	}
+	return 0, false
+}
+
+// logSink is one destination of a log stream and the lowest level it takes
+type logSink struct {
+	out   io.Writer
+	level logLevel
+}
+
+// leveledLogger is a log stream's loggers, one per level
+type leveledLogger struct {
+	Debug *log.Logger
+	Info  *log.Logger
+	Warn  *log.Logger
+	Error *log.Logger
+}
+
+// newLeveledLogger creates the loggers of a stream writing to sinks
+func newLeveledLogger(sinks []logSink, prefix string) *leveledLogger {
+	var loggers [len(logLevelNames)]*log.Logger
+	for level := range loggers {
+		var outs []io.Writer
+		for _, sink := range sinks {
+			if logLevel(level) >= sink.level {
+				outs = append(outs, sink.out)
+			}
+		}
+		if len(outs) == 0 {
+			loggers[level] = log.New(io.Discard, "", 0)
+		} else {
+			loggers[level] = newLogger(io.MultiWriter(outs...), prefix)
+		}
+	}
+	return &leveledLogger{Debug: loggers[levelDebug], Info: loggers[levelInfo], Warn: loggers[levelWarn], Error: loggers[levelError]}
+}
+
+// splitLogLevel splits the @level off a log destination, returning
+// defaultLogLevel if it has none
+func splitLogLevel(dest string) (string, logLevel, error) {
+	at := strings.LastIndex(dest, "@")
+	if at < 0 {
+		return dest, defaultLogLevel, nil
+	}
+	level, ok := parseLogLevel(dest[at+1:])
+	if !ok {
+		return dest, 0, fmt.Errorf("unknown level %q: want debug, info, warn or error", dest[at+1:])
+	}
+	return dest[:at], level, nil
+}
+
+// ============================================================================
+// LOG DESTINATIONS
+// ============================================================================
+
+// Each log stream (-stun-turn-log, -signaling-log) is a comma-separated list
+// of destinations, and every line is written to all of them:
+//
+//	file:path      append to a file, cleared at startup (a bare path works too)
+//	stdout         standard output
+//	syslog:tag     the local syslog daemon, facility LOCAL0 (not on Windows or Plan 9)
+//	udp:host:port  one datagram per line, prefixed with -log-udp-prefix
+//
+// e.g. -stun-turn-log=file:stun-turn.log,syslog:stunturn. Any of them may
+// end in @level to take only the lines at or above that level (see LOG
+// LEVELS).
+//
+// REMOTE DESTINATIONS NEVER BLOCK:
+// ================================
+// syslog and udp lines are queued and written by a goroutine per
+// destination. When the destination can't keep up, or can't be reached,
+// the queue fills and further lines are dropped and counted instead of
+// stalling whatever goroutine is logging. Unreachable destinations are
+// retried every remoteLogRetry.
+
+const (
+	remoteLogQueue = 4096             // Lines queued per remote destination
+	remoteLogRetry = 10 * time.Second // Delay between connection attempts
+)
+
+var (
+	logUDPPrefix string // Prepended to every line sent to udp: destinations
+
+	// remoteLogWriters are the remote destinations, for the statistics
+	remoteLogWriters   []*remoteLogWriter
+	remoteLogWritersMu sync.Mutex
+)
+
+// openLogDestinations opens the destinations of one log stream and returns
+// them with their levels, plus the path of the first file destination (""
+// if there is none). An empty list logs to stdout. stream names the stream
+// in error messages.
+func openLogDestinations(list, stream string) ([]logSink, string) {
+	var sinks []logSink
+	firstFile := ""
+	for _, dest := range strings.Split(list, ",") {
+		dest = strings.TrimSpace(dest)
+		if dest == "" {
+			continue
+		}
+		dest, level, err := splitLogLevel(dest)
+		if err != nil {
+			log.Fatalf("Invalid %s log destination %q: %v", stream, dest, err)
+		}
+		kind, arg, _ := strings.Cut(dest, ":")
+		switch kind {
+		case "stdout":
+			sinks = append(sinks, logSink{os.Stdout, level})
+		case "syslog":
+			if errNoSyslog != nil {
+				log.Fatalf("Invalid %s log destination %q: %v", stream, dest, errNoSyslog)
+			}
+			sinks = append(sinks, logSink{newRemoteLogWriter(dest, func() (io.WriteCloser, error) {
+				return openSyslog(arg)
+			}), level})
+		case "udp":
+			if _, _, err := net.SplitHostPort(arg); err != nil {
+				log.Fatalf("Invalid %s log destination %q: %v", stream, dest, err)
+			}
+			sinks = append(sinks, logSink{newRemoteLogWriter(dest, func() (io.WriteCloser, error) {
+				conn, err := net.Dial("udp", arg)
+				if err != nil {
+					return nil, err
+				}
+				return &udpLogConn{conn: conn}, nil
+			}), level})
+		default:
+			// "file:path", or a bare path as before destinations existed
+			path := dest
+			if kind == "file" {
+				path = arg
+			}
+			// Clear existing log files to start fresh
+			// This prevents log files from growing indefinitely and ensures clean logs
+			os.Remove(path)
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+			if err != nil {
+				log.Fatalf("Failed to open %s log file: %v", stream, err)
+			}
+			sinks = append(sinks, logSink{file, level})
+			if firstFile == "" {
+				firstFile = path
+			}
+		}
+	}
+
+	if len(sinks) == 0 {
+		return []logSink{{os.Stdout, defaultLogLevel}}, ""
+	}
+	return sinks, firstFile
+}
+
+// isLogFileDestination reports whether a destination list writes to path
+func isLogFileDestination(list, path string) bool {
+	for _, dest := range strings.Split(list, ",") {
+		dest, _, _ = splitLogLevel(strings.TrimSpace(dest))
+		if dest == path || dest == "file:"+path {
+			return true
+		}
+	}
+	return false
+}
+
+// udpLogConn sends each log line as one datagram, without its newline
+type udpLogConn struct {
+	conn net.Conn
+}
+
+func (u *udpLogConn) Write(line []byte) (int, error) {
+	datagram := make([]byte, 0, len(logUDPPrefix)+len(line))
+	datagram = append(datagram, logUDPPrefix...)
+	datagram = append(datagram, bytes.TrimSuffix(line, []byte("\n"))...)
+	if _, err := u.conn.Write(datagram); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+func (u *udpLogConn) Close() error {
+	return u.conn.Close()
+}
+
+// remoteLogWriter queues log lines for a destination that may be slow or
+// unreachable and writes them from its own goroutine
+type remoteLogWriter struct {
+	name    string
+	dial    func() (io.WriteCloser, error)
+	lines   chan []byte
+	dropped atomic.Uint64 // Lines lost to a full queue or a failed write
+}
+
+// newRemoteLogWriter starts the writer goroutine for a destination.
+// dial connects to the destination; it is called again after a failure.
+func newRemoteLogWriter(name string, dial func() (io.WriteCloser, error)) *remoteLogWriter {
+	w := &remoteLogWriter{
+		name:  name,
+		dial:  dial,
+		lines: make(chan []byte, remoteLogQueue),
+	}
+	remoteLogWritersMu.Lock()
+	remoteLogWriters = append(remoteLogWriters, w)
+	remoteLogWritersMu.Unlock()
+	go w.run()
+	return w
+}
+
+// Write queues one log line; it never blocks. log.Logger writes each entry
+// with a single Write call, so every call is one complete line.
+func (w *remoteLogWriter) Write(line []byte) (int, error) {
+	select {
+	case w.lines <- append([]byte(nil), line...):
+	default:
+		w.dropped.Add(1)
+	}
+	return len(line), nil
+}
+
+// run writes queued lines, reconnecting after a failed write. While the
+// destination can't be reached, lines are dropped until the next attempt.
+func (w *remoteLogWriter) run() {
+	var dest io.WriteCloser
+	var retryAt time.Time
+	for line := range w.lines {
+		if dest == nil {
+			if time.Now().Before(retryAt) {
+				w.dropped.Add(1)
+				continue
+			}
+			conn, err := w.dial()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Log destination %s unreachable, retrying in %s: %v\n", w.name, remoteLogRetry, err)
+				retryAt = time.Now().Add(remoteLogRetry)
+				w.dropped.Add(1)
+				continue
+			}
+			dest = conn
+		}
+		if _, err := dest.Write(line); err != nil {
+			// Reconnect for the next line; only failed connects wait to retry
+			w.dropped.Add(1)
+			dest.Close()
+			dest = nil
+		}
+	}
+}
+
+// logRemoteLogDrops writes the lines each remote destination lost, if any,
+// to the STUN/TURN log with the connection statistics
+func logRemoteLogDrops() {
+	remoteLogWritersMu.Lock()
+	writers := append([]*remoteLogWriter(nil), remoteLogWriters...)
+	remoteLogWritersMu.Unlock()
+	for _, w := range writers {
+		if dropped := w.dropped.Load(); dropped > 0 {
+			stunTurnLogger.Printf("Log destination %s: %d lines dropped", w.name, dropped)
+		}
+	}
+}
+
+// ============================================================================
+// TURN SERVER INITIALIZATION
+// ============================================================================
+
+// initializeTURNServer sets up the STUN and TURN servers with all protocol variants
+// This is the main initialization function that creates all server instances
+//
+// WHAT IS A TURN SERVER?
+// ======================
+// TURN (Traversal Using Relays around NAT) servers help WebRTC clients establish
+// peer-to-peer connections when direct connection is impossible due to NAT/firewall.
+//
+// TURN servers act as "relay points" that forward data between clients when they
+// cannot connect directly. This is essential for WebRTC to work in all network
+// environments.
+//
+// AUTHENTICATION SYSTEM:
+// =====================
+// TURN servers require authentication to prevent abuse and unauthorized relay usage.
+// This implementation uses the standard TURN authentication mechanism:
+// - Username/password pairs are provided via command line
+// - Cryptographic keys are generated using TURN protocol specification
+// - Authentication is validated on every relay request
+//
+// PROTOCOL VARIANTS:
+// ==================
+// This server supports multiple transport protocols to handle different network
+// environments:
+// - UDP: Standard protocol, fastest, works with most NATs
+// - TCP: Fallback for UDP-blocked networks (corporate firewalls)
+// - TLS: Encrypted connections for secure environments
+//
+// RELAY ADDRESS GENERATION:
+// =========================
+// TURN servers allocate relay addresses for clients. These addresses must be
+// reachable from the internet, so the server needs to know its public IP.
+//
+// THREADING MODEL:
+// ================
+// Multiple threads can be used to handle concurrent connections. Each thread
+// gets its own listener, improving performance under high load.
+func initializeTURNServer(publicIP, users, realm string, realmUsers map[string]string, threadNum int, enableTCP, enableTLS bool) error {
+	// ========================================================================
+	// USER AUTHENTICATION SETUP
+	// ========================================================================
+	// Parse TURN user credentials from the command line arguments
+	// Format: "user1=pass1,user2=pass2" for the default realm, and the same
+	// list for every realm in -turn-realms (see parseTURNRealms)
+	// This creates a map of realm -> username -> cryptographic auth key
+	usersMap = map[string]map[string][]byte{realm: turnUserKeys(users, realm)}
+	for name, list := range realmUsers {
+		usersMap[name] = turnUserKeys(list, name)
+	}
+
+	// ========================================================================
+	// RELAY ADDRESS GENERATOR
+	// ========================================================================
+	// This tells the TURN server what IP address to use for relay allocation
+	// When a client requests a relay, the server will allocate an address on this IP
+	// The publicIP must be reachable from the internet for relay to work
+	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP(publicIP), // Public IP for relay allocation
+		Address:      "0.0.0.0",             // Listen on all interfaces
+	}
+
+	// ========================================================================
+	// AUTHENTICATION HANDLER
+	// ========================================================================
+	// This function is called whenever a client tries to authenticate
+	// It validates the username and returns the corresponding auth key
+	// If authentication fails, the client cannot use relay services
+	authHandler := createEnhancedAuthHandler(usersMap)
+
+	// ========================================================================
+	// SERVER INITIALIZATION SEQUENCE
+	// ========================================================================
+	// Initialize servers in order of importance and dependency
+	// Each protocol variant serves different network environments
+
+	// 2. UDP TURN server - main relay service, handles most WebRTC traffic
+	// UDP is the standard protocol for TURN and works with most NAT types
+	// It's the fastest and most efficient option
+	if err := initializeUDPTURNServer(relayAddressGenerator, authHandler, realm, threadNum); err != nil {
+		return fmt.Errorf("failed to initialize UDP STUN/TURN server: %w", err)
+	}
+
+	// 4. TCP TURN server (if enabled) - fallback relay service
+	// TCP is used when UDP is blocked by firewalls or NATs
+	// Common in corporate networks that block UDP traffic
+	if enableTCP {
+		if err := initializeTCPTURNServer(relayAddressGenerator, authHandler, realm, threadNum); err != nil {
+			return fmt.Errorf("failed to initialize TCP STUN/TURN server: %w", err)
+		}
+	}
+
+	// 6. TLS TURN server (if enabled) - secure relay service
+	// TLS provides encrypted relay connections
+	// Required for secure enterprise environments and browser compatibility
+	if enableTLS {
+		if err := initializeTLSTURNServer(relayAddressGenerator, authHandler, realm, threadNum); err != nil {
+			return fmt.Errorf("failed to initialize TLS STUN/TURN server: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================
+// UDP TURN SERVER IMPLEMENTATION
 // ============================================================================
 
 // initializeUDPTURNServer sets up UDP TURN server
@@ -1244,9 +2381,10 @@ func initializeUDPTURNServer(relayGen *turn.RelayAddressGeneratorStatic, authHan
 	// The server combines all UDP listeners into a single TURN server instance
 	// This provides unified authentication and relay management
 	stunturnServer, err = turn.NewServer(turn.ServerConfig{
-		Realm:             realm,             // Authentication realm
-		AuthHandler:       authHandler,       // Authentication function
-		PacketConnConfigs: packetConnConfigs, // UDP listeners
+		Realm:             realm,              // Authentication realm
+		AuthHandler:       authHandler,        // Authentication function
+		PacketConnConfigs: packetConnConfigs,  // UDP listeners
+		EventHandler:      allocationEvents(), // Allocation created/deleted callbacks
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create UDP TURN server: %w", err)
@@ -1351,9 +2489,10 @@ func initializeTCPTURNServer(relayGen *turn.RelayAddressGeneratorStatic, authHan
 	// The server combines all TCP listeners into a single TURN server instance
 	// This provides unified authentication and relay management
 	stunturnTCPServer, err = turn.NewServer(turn.ServerConfig{
-		Realm:           realm,           // Authentication realm
-		AuthHandler:     authHandler,     // Authentication function
-		ListenerConfigs: listenerConfigs, // TCP listeners
+		Realm:           realm,              // Authentication realm
+		AuthHandler:     authHandler,        // Authentication function
+		ListenerConfigs: listenerConfigs,    // TCP listeners
+		EventHandler:    allocationEvents(), // Allocation created/deleted callbacks
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create TCP TURN server: %w", err)
@@ -1507,9 +2646,10 @@ func initializeTLSTURNServer(relayGen *turn.RelayAddressGeneratorStatic, authHan
 	// The server combines all TLS listeners into a single TURN server instance
 	// This provides unified authentication and relay management
 	stunturnTLSServer, err = turn.NewServer(turn.ServerConfig{
-		Realm:           realm,           // Authentication realm
-		AuthHandler:     authHandler,     // Authentication function
-		ListenerConfigs: listenerConfigs, // TLS listeners
+		Realm:           realm,              // Authentication realm
+		AuthHandler:     authHandler,        // Authentication function
+		ListenerConfigs: listenerConfigs,    // TLS listeners
+		EventHandler:    allocationEvents(), // Allocation created/deleted callbacks
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create TLS TURN server: %w", err)
@@ -1521,6 +2661,29 @@ func initializeTLSTURNServer(relayGen *turn.RelayAddressGeneratorStatic, authHan
 // HTTP/HTTPS SERVER FOR WEBSOCKET SIGNALING
 // ============================================================================
 
+// initializeSignaling creates the signaling services and, with
+// -enable-signaling, the handler serving them. The services exist without
+// -enable-signaling too, empty, so the admin endpoints can list their (no)
+// sessions.
+func initializeSignaling(tenantSpecs []webrtc.TenantSpec, enableDemo, enableProbe bool) {
+	signalingService = webrtc.NewService(webrtc.NewRegistry(), signalingLogger)
+	signalingTenants = webrtc.NewTenants(signalingService, tenantSpecs, signalingLogger)
+	if signalingEnabled {
+		signalingHandler = signalingTenants.Routes(signalingPath)
+		for _, spec := range tenantSpecs {
+			signalingLogger.Printf("Signaling tenant %s at %s/%s (max users %d, max calls %d, 0 is unlimited)", spec.Name, signalingPath, spec.Name, spec.Limits.MaxUsers, spec.Limits.MaxCalls)
+		}
+		if enableDemo {
+			signalingHandler = withDemo(signalingHandler)
+			signalingLogger.Printf("Demo web client enabled at /demo/")
+		}
+		signalingHandler = withICEConfig(signalingHandler)
+		if enableProbe {
+			signalingHandler = withProbe(signalingHandler)
+		}
+	}
+}
+
 // startWebRTC_SignallingServer starts the HTTP/HTTPS server for WebSocket signaling
 // This server handles the WebSocket connections that clients use for signaling
 //
@@ -1550,7 +2713,7 @@ func initializeTLSTURNServer(relayGen *turn.RelayAddressGeneratorStatic, authHan
 //
 // WEBSOCKET ENDPOINT:
 // ===================
-// The /signal endpoint handles all WebRTC signaling:
+// The signaling endpoint (/signal by default, see -signaling-path) handles all WebRTC signaling:
 // - Accepts WebSocket upgrade requests
 // - Manages user sessions and connections
 // - Routes signaling messages between peers
@@ -1564,16 +2727,15 @@ func initializeTLSTURNServer(relayGen *turn.RelayAddressGeneratorStatic, authHan
 // - Port binding issues
 // - Graceful fallback to HTTP when needed
 func startWebRTC_SignallingServer() {
-	// SSL certificate files for HTTPS
+	// SSL certificates for HTTPS, loaded at startup (see TLS CERTIFICATES)
 	// These files must be in PEM format
 	// fullchain.pem contains the certificate chain (including intermediate certificates)
 	// privkey.pem contains the private key (must be kept secure)
-	certFile := "certs/fullchain.pem"
-	keyFile := "certs/privkey.pem"
+	// -tls-cert-pair adds certificates for more server names
 
 	// Check if certificates exist to decide between HTTP and HTTPS
 	// This allows the server to run in both development and production environments
-	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+	if tlsCertificates == nil {
 		// No SSL certificates found - start HTTP server
 		// This is suitable for development and testing
 		// Note: WebRTC may not work in browsers without HTTPS
@@ -1586,8 +2748,19 @@ func startWebRTC_SignallingServer() {
 		// Note: Modern browsers require HTTPS for WebRTC, so HTTP is mainly for development
 		// HTTP can be used for testing with non-browser clients (mobile apps, etc.)
 		signalingLogger.Printf("WebRTC signaling server starting on %s:%d (HTTP)", publicIP, signalingPort)
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", signalingPort), nil); err != nil {
-			signalingLogger.Fatal("Server error:", err)
+		// Bound before serving, so main can report readiness (see SYSTEMD NOTIFICATIONS)
+		listener, err := listenSignaling(fmt.Sprintf(":%d", signalingPort))
+		if err != nil {
+			signalingLog.Error.Fatal("Server error:", err)
+		}
+		signalingHTTPPort = signalingBoundPort(listener)
+		registerListener("Signaling", "HTTP", fmt.Sprintf(":%d", signalingPort), 1)
+		setComponentHealth(componentSignaling, componentUp, "plain HTTP, no TLS certificate")
+		server := &http.Server{Handler: signalingHandler}
+		signalingServer.Store(server)
+		close(signalingListening)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			signalingLog.Error.Fatal("Server error:", err)
 		}
 	} else {
 		// SSL certificates found - start HTTPS server
@@ -1600,8 +2773,10 @@ func startWebRTC_SignallingServer() {
 		// Configure TLS settings for HTTPS
 		// MinVersion ensures we use secure TLS versions
 		// TLS 1.2 is the minimum recommended version for security
+		// The certificate is picked by the name the client asks for (SNI)
 		tlsConfig := &tls.Config{
-			MinVersion: tls.VersionTLS12, // Minimum TLS version (secure)
+			GetCertificate: tlsCertificates.getCertificate, // Our SSL certificates by server name
+			MinVersion:     tls.VersionTLS12,               // Minimum TLS version (secure)
 		}
 
 		// Create HTTPS server with TLS configuration and custom error logging
@@ -1609,6 +2784,7 @@ func startWebRTC_SignallingServer() {
 		// Custom error logger helps with debugging TLS issues
 		server := &http.Server{
 			Addr:      fmt.Sprintf(":%d", signalingPort),
+			Handler:   signalingHandler,
 			TLSConfig: tlsConfig,
 			//ErrorLog:  signalingLogger,
 		}
@@ -1616,31 +2792,734 @@ func startWebRTC_SignallingServer() {
 		// Start HTTPS server with SSL certificates
 		// This provides secure WebSocket connections (WSS)
 		// Required for WebRTC to work in modern browsers
-		if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
-			signalingLogger.Fatal("HTTPS Server error:", err)
+		listener, err := listenSignaling(server.Addr)
+		if err != nil {
+			signalingLog.Error.Fatal("HTTPS Server error:", err)
+		}
+		signalingHTTPSPort = signalingBoundPort(listener)
+		registerListener("Signaling", "HTTPS", fmt.Sprintf(":%d", signalingPort), 1)
+
+		// Redirect http:// requests to the HTTPS server, on the port bound
+		if httpRedirectEnabled {
+			startHTTPRedirect()
+		}
+		setComponentHealth(componentSignaling, componentUp, "")
+		signalingServer.Store(server)
+		close(signalingListening)
+		if err := server.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			signalingLog.Error.Fatal("HTTPS Server error:", err)
+		}
+	}
+}
+
+// closeSignaling closes the signaling listener, then tells the signaling
+// clients the server is going away and waits for their connections to end
+func closeSignaling() {
+	if server := signalingServer.Swap(nil); server != nil {
+		server.Close()
+		unregisterListeners("Signaling")
+	}
+	signalingTenants.Shutdown()
+}
+
+// signalingBoundPort returns the port the signaling listener is bound to,
+// which the system picked if the port was 0, and records it in signalingPort
+func signalingBoundPort(listener net.Listener) int {
+	if signalingPort == 0 {
+		signalingPort = listener.Addr().(*net.TCPAddr).Port
+		signalingLogger.Printf("Signaling port 0: listening on %d", signalingPort)
+	}
+	return signalingPort
+}
+
+// listenSignaling binds the signaling server's port, retried with
+// -startup-retries
+func listenSignaling(addr string) (listener net.Listener, err error) {
+	err = retryStartup(signalingLog.Warn, "Signaling listener", func() (err error) {
+		listener, err = net.Listen("tcp", addr)
+		return err
+	})
+	return listener, err
+}
+
+// startHTTPRedirect starts a plain HTTP listener on port 80 that answers
+// every request with a 301 to the same URL on the HTTPS server. If the port
+// is already taken (another web server, or no permission to bind it) the
+// redirect is skipped with a log line; the HTTPS server still starts.
+func startHTTPRedirect() {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", httpRedirectPort))
+	if err != nil {
+		signalingLogger.Printf("Not redirecting HTTP to HTTPS: port %d unavailable: %v", httpRedirectPort, err)
+		return
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Swap the port in the Host header for the HTTPS port
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			host = strings.Trim(host, "[]")
+			if signalingHTTPSPort != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(signalingHTTPSPort))
+			} else if strings.Contains(host, ":") {
+				host = "[" + host + "]" // IPv6 literal
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	httpRedirectMu.Lock()
+	httpRedirectServer = server
+	httpRedirectMu.Unlock()
+
+	signalingLogger.Printf("Redirecting HTTP on :%d to HTTPS on :%d", httpRedirectPort, signalingHTTPSPort)
+	registerListener("HTTP redirect", "HTTP", listener.Addr().String(), 1)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			signalingLogger.Printf("HTTP redirect listener error: %v", err)
 		}
+	}()
+}
+
+// withDemo serves the built-in demo web client under /demo/ next to the
+// signaling routes. The page is told this server's STUN/TURN URLs; TURN
+// credentials are entered by the tester so the page doesn't publish them.
+func withDemo(signaling http.Handler) http.Handler {
+	// Only the services this node runs, see iceServerURLs
+	var iceServers []demo.ICEServer
+	stunURLs, turnURLs := iceServerURLs()
+	if len(stunURLs) > 0 {
+		iceServers = append(iceServers, demo.ICEServer{URLs: stunURLs})
 	}
+	if len(turnURLs) > 0 {
+		iceServers = append(iceServers, demo.ICEServer{URLs: turnURLs})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", signaling)
+	mux.Handle("/demo/", http.StripPrefix("/demo", demo.Handler(demo.Config{
+		SignalingPath:             signalingPath,
+		ICEServers:                iceServers,
+		DefaultAllocationLifetime: int(defaultAllocationLifetime / time.Second),
+		MaxAllocationLifetime:     int(maxAllocationLifetime / time.Second),
+	})))
+	return mux
 }
 
 // ============================================================================
-// MONITORING AND STATISTICS
+// ICE SERVER URLS
 // ============================================================================
 
-// startMonitoring starts a goroutine to monitor server statistics
-// This function provides real-time insights into server performance and health
+// Frontends need this server's URLs in their RTCPeerConnection config, and
+// copying them by hand got the transports wrong. The startup banner lists
+// the URLs of the listeners that came up, and they are written to
+// -ice-servers-file (ice-servers.json by default) in the RTCIceServer shape:
 //
-// WHY MONITORING IS IMPORTANT:
-// ============================
-// WebRTC servers need monitoring to:
-// - Track server performance and resource usage
-// - Identify connection patterns and bottlenecks
-// - Monitor authentication success/failure rates
-// - Detect potential issues before they become problems
-// - Provide insights for capacity planning
+//	[
+//	  {"urls": ["stun:203.0.113.1:3478"]},
+//	  {"urls": ["turn:203.0.113.1:3478?transport=udp", "turn:203.0.113.1:3478?transport=tcp",
+//	            "turns:203.0.113.1:5349"],
+//	   "username": "alice", "credential": "<password of alice from -turn-users>"}
+//	]
 //
-// MONITORING FREQUENCY:
-// ====================
-// Statistics are logged every 30 seconds by default
+// The username is the first of -turn-users; the credential is a placeholder,
+// so no password ends up in a file. The demo client gets the same URLs.
+
+// iceServer is an RTCIceServer, as written to -ice-servers-file
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+
+	// The allocation lifetime policy of TURN entries in /ice-config, in
+	// seconds; browsers ignore the extra members
+	DefaultAllocationLifetime int `json:"defaultAllocationLifetime,omitempty"`
+	MaxAllocationLifetime     int `json:"maxAllocationLifetime,omitempty"`
+}
+
+// iceServerURLs returns the STUN and TURN URLs of the listeners that are
+// up, extra ports included: none without -enable-stunturn, and no TURN URLs
+// with -mode=stun
+func iceServerURLs() (stunURLs, turnURLs []string) {
+	if !stunturnEnabled || len(udpBoundPorts) == 0 {
+		return nil, nil
+	}
+	stunURLs = []string{fmt.Sprintf("stun:%s:%d", publicIP, udpBoundPorts[0])}
+	if serverMode == modeSTUN {
+		return stunURLs, nil
+	}
+	for _, port := range udpBoundPorts {
+		turnURLs = append(turnURLs, fmt.Sprintf("turn:%s:%d?transport=udp", publicIP, port))
+	}
+	for _, port := range tcpBoundPorts {
+		turnURLs = append(turnURLs, fmt.Sprintf("turn:%s:%d?transport=tcp", publicIP, port))
+	}
+	if stunturnCertsFound {
+		turnURLs = append(turnURLs, fmt.Sprintf("turns:%s:%d", publicIP, stunturnTLSPort))
+	}
+	if dtlsListening {
+		turnURLs = append(turnURLs, fmt.Sprintf("turns:%s:%d?transport=udp", publicIP, stunturnTLSPort))
+	}
+	return stunURLs, turnURLs
+}
+
+// writeICEServersFile writes the ICE server URLs to path, with the first
+// user of -turn-users and a placeholder credential
+func writeICEServersFile(path, users string) error {
+	stunURLs, turnURLs := iceServerURLs()
+	servers := []iceServer{}
+	if len(stunURLs) > 0 {
+		servers = append(servers, iceServer{URLs: stunURLs})
+	}
+	if len(turnURLs) > 0 {
+		server := iceServer{URLs: turnURLs, Username: "username", Credential: "<password>"}
+		if kv := regexp.MustCompile(`(\w+)=(\w+)`).FindStringSubmatch(users); kv != nil {
+			server.Username = kv[1]
+			server.Credential = fmt.Sprintf("<password of %s from -turn-users>", kv[1])
+		}
+		servers = append(servers, server)
+	}
+	// Without HTML escaping, so the placeholder reads as <password ...>
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(servers); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data.Bytes(), 0644)
+}
+
+// ============================================================================
+// PEER SERVERS
+// ============================================================================
+
+// For high availability several of these servers run side by side, and
+// clients should get all of them in their ICE config, so a frontend that
+// only knows one server still gets the redundant set. -peer-servers lists
+// the base URLs of the siblings' -metrics-addr, e.g.
+//
+//	-peer-servers=http://10.0.0.2:9100,http://10.0.0.3:9100
+//
+// Every -peer-poll-interval each sibling's /healthz?format=json is fetched,
+// all at once, each within half the interval (at most 5s). The document
+// carries the sibling's component statuses and its own ICE server URLs.
+// A sibling is healthy if its UDP STUN/TURN listener is up, degraded if
+// that listener is degraded (e.g. at its allocation cap), and dropped if it
+// is anything else or the request fails, so a sibling that goes down leaves
+// the ICE config at the next poll.
+//
+// GET /ice-config on the signaling server returns RTCIceServer entries for
+// this server first, then the healthy siblings and last the degraded ones,
+// each in -peer-servers order:
+//
+//	[
+//	  {"urls": ["stun:203.0.113.1:3478"]},
+//	  {"urls": ["turn:203.0.113.1:3478?transport=udp", ...]},
+//	  {"urls": ["stun:203.0.113.2:3478"]},
+//	  {"urls": ["turn:203.0.113.2:3478?transport=udp", ...]}
+//	]
+//
+// Like the demo client it carries no credentials; the frontend adds its
+// TURN username and credential to the turn entries. Requests are answered
+// from the result of the last poll and never wait for one.
+
+// DefaultPeerPollInterval is how often the sibling servers are polled
+const DefaultPeerPollInterval = 10 * time.Second
+
+// maxPeerPollTimeout bounds one poll of a sibling
+const maxPeerPollTimeout = 5 * time.Second
+
+// peerServer is the last known state of a sibling server
+type peerServer struct {
+	baseURL    string
+	status     string      // componentUp, componentDegraded, or "" if dropped
+	reason     string      // Why it was dropped
+	iceServers []iceServer // Its own ICE servers, as its /healthz says
+}
+
+var (
+	peerServerList []string                     // -peer-servers base URLs
+	peerServers    atomic.Pointer[[]peerServer] // Result of the last poll, in -peer-servers order
+)
+
+// parsePeerServers checks the -peer-servers list
+func parsePeerServers(list string) ([]string, error) {
+	var peers []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimRight(strings.TrimSpace(entry), "/")
+		if entry == "" {
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q: want an http:// or https:// base URL", entry)
+		}
+		peers = append(peers, entry)
+	}
+	return peers, nil
+}
+
+// startPeerPolling polls the sibling servers every interval, the first
+// time right away
+func startPeerPolling(interval time.Duration) {
+	if len(peerServerList) == 0 {
+		return
+	}
+	timeout := min(interval/2, maxPeerPollTimeout)
+	client := &http.Client{Timeout: timeout}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			pollPeerServers(client)
+			<-ticker.C
+		}
+	}()
+}
+
+// pollPeerServers polls every sibling at once and publishes the results,
+// logging the siblings whose state changed
+func pollPeerServers(client *http.Client) {
+	results := make([]peerServer, len(peerServerList))
+	var wg sync.WaitGroup
+	for i, baseURL := range peerServerList {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = pollPeerServer(client, baseURL)
+		}()
+	}
+	wg.Wait()
+
+	var previous []peerServer
+	if last := peerServers.Load(); last != nil {
+		previous = *last
+	}
+	for i, peer := range results {
+		if i < len(previous) && previous[i].status == peer.status {
+			continue
+		}
+		if peer.status == "" {
+			stunTurnLogger.Printf("Peer server %s dropped from the ICE config: %s", peer.baseURL, peer.reason)
+		} else {
+			stunTurnLogger.Printf("Peer server %s is %s", peer.baseURL, peer.status)
+		}
+	}
+	peerServers.Store(&results)
+}
+
+// pollPeerServer fetches a sibling's /healthz document
+func pollPeerServer(client *http.Client, baseURL string) peerServer {
+	peer := peerServer{baseURL: baseURL}
+	resp, err := client.Get(baseURL + "/healthz?format=json")
+	if err != nil {
+		peer.reason = err.Error()
+		return peer
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		peer.reason = "/healthz answered " + resp.Status
+		return peer
+	}
+	var report healthzReport
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&report); err != nil {
+		peer.reason = fmt.Sprintf("bad /healthz document: %v", err)
+		return peer
+	}
+	udpStatus := "missing"
+	for _, c := range report.Components {
+		if c.Name == componentUDP {
+			udpStatus = c.Status
+		}
+	}
+	switch {
+	case udpStatus != componentUp && udpStatus != componentDegraded:
+		peer.reason = "its " + componentUDP + " is " + udpStatus
+	case len(report.ICEServers) == 0:
+		peer.reason = "no ICE servers"
+	default:
+		peer.status = udpStatus
+		peer.iceServers = report.ICEServers
+	}
+	return peer
+}
+
+// localICEServers returns this server's ICE servers, without credentials
+func localICEServers() []iceServer {
+	var servers []iceServer
+	stunURLs, turnURLs := iceServerURLs()
+	if len(stunURLs) > 0 {
+		servers = append(servers, iceServer{URLs: stunURLs})
+	}
+	if len(turnURLs) > 0 {
+		servers = append(servers, iceServer{
+			URLs:                      turnURLs,
+			DefaultAllocationLifetime: int(defaultAllocationLifetime / time.Second),
+			MaxAllocationLifetime:     int(grantedAllocationLifetime() / time.Second),
+		})
+	}
+	return servers
+}
+
+// handleICEConfig serves GET /ice-config: this server's ICE servers, then
+// those of the healthy and the degraded siblings, each TURN entry with its
+// server's allocation lifetime policy
+func handleICEConfig(w http.ResponseWriter, r *http.Request) {
+	servers := append([]iceServer{}, localICEServers()...)
+	if peers := peerServers.Load(); peers != nil {
+		for _, status := range []string{componentUp, componentDegraded} {
+			for _, peer := range *peers {
+				if peer.status == status {
+					servers = append(servers, peer.iceServers...)
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // Public URLs, fetched by frontends on any origin
+	json.NewEncoder(w).Encode(servers)
+}
+
+// withICEConfig serves GET /ice-config next to the signaling routes
+func withICEConfig(signaling http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", signaling)
+	mux.HandleFunc("GET /ice-config", handleICEConfig)
+	return mux
+}
+
+// withProbe serves GET /probe and POST /probe/turn next to the signaling
+// routes, see webrtc/probe.go
+func withProbe(signaling http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", signaling)
+	mux.HandleFunc("GET /probe", signalingService.HandleProbe)
+	mux.HandleFunc("POST /probe/turn", signalingService.HandleTURNProbe)
+	return mux
+}
+
+// ============================================================================
+// RELAY REACHABILITY
+// ============================================================================
+
+// A home server behind carrier-grade NAT (CGNAT), or behind a router that
+// doesn't forward the relay ports, gets -public-ip (or auto-detects) an
+// address nothing outside can reach. Allocations still succeed, since
+// they are made over the listening port the client already talks to, but
+// no media reaches the relay address, and the calls fail without a hint.
+//
+// Once every listener is up, and every -relay-check-interval after that,
+// the server checks its relay address from outside:
+//
+//  1. An advertised address in the shared address space 100.64.0.0/10 is
+//     a CGNAT address and unreachable by definition. A private or loopback
+//     address is meant for a LAN, so it isn't checked.
+//  2. Otherwise a relay socket is allocated the way the TURN server
+//     allocates them, and a vantage point outside is asked to send a
+//     random nonce to it over UDP:
+//
+//     POST <vantage> {"address": "203.0.113.1:51234", "nonce": "..."}
+//
+//     The vantage is -relay-check-url, or else the /probe/relay endpoint
+//     of every -peer-servers sibling in turn (this server serves one too,
+//     see handleRelayProbe), asked with the admin token they share. The relay is reachable if the nonce arrives
+//     within relayCheckWait from any of them, and unreachable if vantages
+//     answered but it never arrived. If no vantage answers the result is
+//     unknown and nothing changes.
+//
+// An unreachable relay is logged with the likely causes, and the TURN
+// components are degraded (see COMPONENT HEALTH) until a check succeeds.
+// -skip-relay-reachability-check turns all of this off.
+
+// DefaultRelayCheckInterval is how often the relay address is checked
+const DefaultRelayCheckInterval = time.Hour
+
+// Relay reachability check limits
+const (
+	relayCheckWait       = 5 * time.Second // How long a nonce may take to arrive
+	relayCheckTimeout    = 5 * time.Second // Bounds one request to a vantage
+	relayProbesPerMinute = 30              // Nonces handleRelayProbe sends per minute, for everyone
+)
+
+var (
+	relayCheckURL  string // -relay-check-url, "" for the siblings' /probe/relay
+	relayCheckSkip bool   // -skip-relay-reachability-check
+
+	// Why the relay address is unreachable, "" if it is or isn't known
+	relayProblem   string
+	relayProblemMu sync.Mutex
+
+	// Nonces handleRelayProbe sent in the current minute
+	relayProbesWindow time.Time
+	relayProbesSent   int
+	relayProbesMu     sync.Mutex
+)
+
+// sharedAddressSpace is the CGNAT range, RFC 6598
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// relayProbeRequest is the POST body of a vantage point
+type relayProbeRequest struct {
+	Address string `json:"address"` // ip:port the nonce goes to
+	Nonce   string `json:"nonce"`
+}
+
+// startRelayReachabilityChecks checks the relay address right away and
+// then every interval (0 checks at startup only)
+func startRelayReachabilityChecks(interval time.Duration) {
+	if !stunturnEnabled || serverMode == modeSTUN {
+		return
+	}
+	if relayCheckSkip {
+		stunTurnLogger.Printf("Relay reachability check skipped (-skip-relay-reachability-check)")
+		return
+	}
+	go func() {
+		for {
+			checkRelayReachability()
+			if interval <= 0 {
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// checkRelayReachability checks the relay address, see above, and records
+// the result
+func checkRelayReachability() {
+	addr, err := netip.ParseAddr(publicIP)
+	if err != nil {
+		return
+	}
+	addr = addr.Unmap()
+	switch {
+	case sharedAddressSpace.Contains(addr):
+		setRelayProblem(fmt.Sprintf("relay address %s is in 100.64.0.0/10, the address range of carrier-grade NAT", addr), addr.String())
+		return
+	case addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast():
+		stunTurnLogger.Printf("Relay address %s is private, for clients on the local network only; reachability not checked", addr)
+		return
+	}
+
+	var vantages []string
+	if relayCheckURL != "" {
+		vantages = []string{relayCheckURL}
+	} else {
+		for _, baseURL := range peerServerList {
+			vantages = append(vantages, baseURL+"/probe/relay")
+		}
+	}
+	if len(vantages) == 0 {
+		stunTurnLogger.Printf("Relay reachability of %s not checked: set -relay-check-url or -peer-servers for a vantage point outside", addr)
+		return
+	}
+
+	network := "udp4"
+	if addr.Is6() {
+		network = "udp6"
+	}
+	generator := &turn.RelayAddressGeneratorStatic{RelayAddress: net.IP(addr.AsSlice()), Address: "0.0.0.0"}
+	if network == "udp6" {
+		generator.Address = "::"
+	}
+	if err := generator.Validate(); err != nil {
+		stunTurnLogger.Printf("Relay reachability not checked: %v", err)
+		return
+	}
+	conn, relayAddr, err := generator.AllocatePacketConn(network, 0)
+	if err != nil {
+		stunTurnLog.Warn.Printf("Relay reachability not checked: could not allocate a relay socket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	nonceBytes := make([]byte, 16)
+	rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+	client := &http.Client{Timeout: relayCheckTimeout}
+	answered := 0
+	var failures []string
+	for _, vantage := range vantages {
+		if err := requestRelayProbe(client, vantage, relayAddr.String(), nonce); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", vantage, err))
+			continue
+		}
+		answered++
+		if awaitNonce(conn, nonce) {
+			setRelayProblem("", relayAddr.String())
+			stunTurnLogger.Printf("Relay address %s is reachable from outside (checked by %s)", relayAddr, vantage)
+			return
+		}
+	}
+	if answered == 0 {
+		stunTurnLogger.Printf("Relay reachability of %s unknown, no vantage point answered: %s", relayAddr, strings.Join(failures, "; "))
+		return
+	}
+	stunTurnLogger.Printf("Relay address %s: nothing %d vantage points sent arrived within %s", relayAddr, answered, relayCheckWait)
+	setRelayProblem(fmt.Sprintf("relay address %s is unreachable from outside", addr), relayAddr.String())
+}
+
+// requestRelayProbe asks a vantage point to send the nonce to address,
+// with this server's admin token, which the vantage's /probe/relay requires
+func requestRelayProbe(client *http.Client, vantage, address, nonce string) error {
+	body, _ := json.Marshal(relayProbeRequest{Address: address, Nonce: nonce})
+	req, err := http.NewRequest(http.MethodPost, vantage, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// awaitNonce reports whether the nonce arrives on the relay socket within
+// relayCheckWait
+func awaitNonce(conn net.PacketConn, nonce string) bool {
+	conn.SetReadDeadline(time.Now().Add(relayCheckWait))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+		if string(buf[:n]) == nonce {
+			return true
+		}
+	}
+}
+
+// setRelayProblem records the result of a check, logging the likely causes
+// when the relay address becomes unreachable
+func setRelayProblem(problem, relayAddr string) {
+	relayProblemMu.Lock()
+	previous := relayProblem
+	relayProblem = problem
+	relayProblemMu.Unlock()
+	switch {
+	case problem != "" && previous == "":
+		for _, line := range []string{
+			"WARNING: ==================================================================",
+			"WARNING: TURN " + problem,
+			"WARNING: Allocations will succeed, but no media will flow through them.",
+			"WARNING: Likely causes:",
+			"WARNING:  - The server is behind carrier-grade NAT (CGNAT): the ISP shares one",
+			"WARNING:    public address between customers and forwards nothing inbound.",
+			"WARNING:    Ask the ISP for a public IPv4 address, or run the server elsewhere.",
+			"WARNING:  - The router doesn't forward the relay ports (UDP, 49152-65535",
+			"WARNING:    by default) to this machine, or a firewall drops them.",
+			"WARNING:  - -public-ip isn't this server's public address.",
+			"WARNING: -skip-relay-reachability-check turns this check off.",
+			"WARNING: ==================================================================",
+		} {
+			stunTurnLog.Warn.Print(line)
+		}
+	case problem == "" && previous != "":
+		stunTurnLogger.Printf("Relay address %s is reachable again", relayAddr)
+	}
+	if problem != previous {
+		// Recheck now so the status change is logged and alerted on
+		componentHealthTable()
+	}
+}
+
+// relayReachabilityProblem returns why the relay address is unreachable,
+// or "" if it is or isn't known
+func relayReachabilityProblem() string {
+	relayProblemMu.Lock()
+	defer relayProblemMu.Unlock()
+	return relayProblem
+}
+
+// handleRelayProbe serves POST /probe/relay on -metrics-addr: it sends a
+// sibling's nonce to its relay address over UDP, so the sibling can check
+// that address from outside (see above). Only a short nonce is sent, once,
+// to public addresses, and at most relayProbesPerMinute times a minute, so
+// it can't be used to flood anyone. It requires the admin token, which
+// siblings share and send with their requests (see requestRelayProbe).
+func handleRelayProbe(w http.ResponseWriter, r *http.Request) {
+	var request relayProbeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&request); err != nil {
+		http.Error(w, `want {"address": "ip:port", "nonce": ...}`, http.StatusBadRequest)
+		return
+	}
+	target, err := netip.ParseAddrPort(request.Address)
+	if err != nil || target.Port() == 0 {
+		http.Error(w, "address must be ip:port", http.StatusBadRequest)
+		return
+	}
+	if ip := target.Addr().Unmap(); !ip.IsGlobalUnicast() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) {
+		http.Error(w, "address must be public", http.StatusBadRequest)
+		return
+	}
+	if request.Nonce == "" || len(request.Nonce) > 64 {
+		http.Error(w, "nonce must be 1-64 bytes", http.StatusBadRequest)
+		return
+	}
+
+	relayProbesMu.Lock()
+	now := time.Now()
+	if now.Sub(relayProbesWindow) >= time.Minute {
+		relayProbesWindow, relayProbesSent = now, 0
+	}
+	allowed := relayProbesSent < relayProbesPerMinute
+	if allowed {
+		relayProbesSent++
+	}
+	relayProbesMu.Unlock()
+	if !allowed {
+		http.Error(w, "too many relay probes", http.StatusTooManyRequests)
+		return
+	}
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(target))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(request.Nonce)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	stunTurnLogger.Printf("Relay probe for %s sent to %s", r.RemoteAddr, target)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ============================================================================
+// MONITORING AND STATISTICS
+// ============================================================================
+
+// startMonitoring starts a goroutine to monitor server statistics
+// This function provides real-time insights into server performance and health
+//
+// WHY MONITORING IS IMPORTANT:
+// ============================
+// WebRTC servers need monitoring to:
+// - Track server performance and resource usage
+// - Identify connection patterns and bottlenecks
+// - Monitor authentication success/failure rates
+// - Detect potential issues before they become problems
+// - Provide insights for capacity planning
+//
+// MONITORING FREQUENCY:
+// ====================
+// Statistics are logged every 30 seconds by default
 // This provides a good balance between detail and performance
 // More frequent monitoring can be enabled for debugging
 //
@@ -1697,7 +3576,7 @@ func startMonitoring() {
 // - Compliance and audit requirements
 func logServerStats() {
 	stunTurnLogger.Printf("=== SERVER STATISTICS ===")
-	stunTurnLogger.Printf("Time: %s", time.Now().Format("2006-01-02 15:04:05"))
+	stunTurnLogger.Printf("Time: %s", formatLogTime(time.Now()))
 	stunTurnLogger.Printf("Active STUN/TURN servers: %d", countActiveSTUNTURNServers())
 	stunTurnLogger.Printf("========================")
 }
@@ -1732,44 +3611,349 @@ func logServerStats() {
 // - Assists with troubleshooting connection issues
 func countActiveSTUNTURNServers() int {
 	count := 0
-	servers := []*turn.Server{stunturnServer, stunturnTCPServer, stunturnTLSServer}
+	servers := []*turn.Server{stunturnServer, stunturnTCPServer, stunturnTLSServer, stunturnDTLSServer}
 	for _, server := range servers {
 		if server != nil {
 			count++
 		}
 	}
-	return count
+	// With -mode=stun binding responders stand in for the TURN servers
+	return count + len(stunBindingServers)
+}
+
+// closeSTUNTURNServers closes every STUN/TURN server and binding responder,
+// with their listeners, and forgets them, at shutdown or when the
+// initialization fails halfway
+func closeSTUNTURNServers() {
+	servers := []*turn.Server{stunturnServer, stunturnTCPServer, stunturnTLSServer, stunturnDTLSServer}
+	for _, server := range servers {
+		if server != nil {
+			if err := server.Close(); err != nil {
+				stunTurnLog.Warn.Printf("Failed to close server: %v", err)
+			}
+		}
+	}
+	for _, server := range stunBindingServers {
+		server.Close()
+	}
+	stunturnServer, stunturnTCPServer, stunturnTLSServer, stunturnDTLSServer = nil, nil, nil, nil
+	stunBindingServers = nil
+	udpBoundPorts, tcpBoundPorts = nil, nil
+	dtlsListening = false
+	udpSocketsMu.Lock()
+	udpSockets, udpBatchConns, udpLoggingConns, udpSupervised = nil, nil, nil, nil
+	udpSocketsMu.Unlock()
+	unregisterListeners("STUN", "STUN/TURN")
 }
 
 // ============================================================================
-// STUNTURN SERVER INITIALIZATION
+// EMBEDDED SERVERS
 // ============================================================================
 
-// initializeSTUNTurnServer sets up the STUN/TURN servers with all protocol variants
-// This is the main initialization function that creates all server instances
-//
-// IMPORTANT: TURN SERVERS INHERENTLY SUPPORT STUN FUNCTIONALITY
-// ============================================================
-// Every TURN server is also a STUN server. This is a fundamental aspect of the
-// TURN protocol specification (RFC 5766). When you run a TURN server, it automatically
-// handles both STUN and TURN requests on the same port.
-//
-// HOW IT WORKS:
-// =============
-//
-//  1. Client sends STUN_BINDING_REQUEST → Server responds with STUN_BINDING_RESPONSE
-//     (This is standard STUN functionality for NAT discovery)
-//
-//  2. Client sends TURN_ALLOCATE_REQUEST → Server responds with TURN_ALLOCATE_RESPONSE
-//     (This is TURN functionality for relay allocation)
+// startServers starts the STUN/TURN listeners and the signaling server from
+// a serverConfig instead of the flags, for the integration tests and
+// anything else embedding the servers. The servers are process-wide, like
+// the globals they are configured through, so one set runs at a time:
+// startServers applies the config, and Close stops everything it started
+// and puts the previous configuration back. Ports of 0 are picked by the
+// system.
+
+// serverConfig is the configuration startServers runs the servers with
+type serverConfig struct {
+	Mode         string // -mode: stun, turn or both
+	PublicIP     string // -public-ip, the relayed addresses' IP
+	STUNTURNPort int    // Main STUN/TURN port, UDP and TCP
+	TURNUsers    string // -turn-users, "user=pass,..."
+	Realm        string // -realm
+
+	Signaling     bool   // -enable-signaling, over plain HTTP
+	SignalingPath string // -signaling-path, /signal if empty
+}
+
+// runningServers is a set of servers started by startServers
+type runningServers struct {
+	restore   func() // Puts the configuration before startServers back
+	closeOnce sync.Once
+}
+
+// embeddedRunning is set while a set of servers started by startServers runs
+var embeddedRunning atomic.Bool
+
+// startServers starts the servers of config, see EMBEDDED SERVERS
+func startServers(config serverConfig) (*runningServers, error) {
+	if !embeddedRunning.CompareAndSwap(false, true) {
+		return nil, errors.New("servers already started")
+	}
+	savedMode, savedIP, savedPort, savedSTUNTURN := serverMode, publicIP, stunturnPort, stunturnEnabled
+	savedSignaling, savedPath, savedHTTPPort, savedPorts := signalingEnabled, signalingPath, signalingHTTPPort, signalingPort
+	savedCertificates, savedListening := tlsCertificates, signalingListening
+	usersMapMu.RLock()
+	savedUsers := usersMap
+	usersMapMu.RUnlock()
+	servers := &runningServers{restore: func() {
+		serverMode, publicIP, stunturnPort, stunturnEnabled = savedMode, savedIP, savedPort, savedSTUNTURN
+		signalingEnabled, signalingPath, signalingHTTPPort, signalingPort = savedSignaling, savedPath, savedHTTPPort, savedPorts
+		tlsCertificates, signalingListening = savedCertificates, savedListening
+		usersMapMu.Lock()
+		usersMap = savedUsers
+		usersMapMu.Unlock()
+		embeddedRunning.Store(false)
+	}}
+
+	serverMode, publicIP, stunturnPort, stunturnEnabled = config.Mode, config.PublicIP, config.STUNTURNPort, true
+	if err := initializeSTUNTurnServer(config.PublicIP, config.TURNUsers, config.Realm, nil, 1, true, false, false); err != nil {
+		servers.restore()
+		return nil, err
+	}
+
+	signalingEnabled, signalingPath, signalingHTTPPort, signalingPort = config.Signaling, config.SignalingPath, 0, 0
+	if signalingPath == "" {
+		signalingPath = "/signal"
+	}
+	tlsCertificates, signalingListening = nil, make(chan struct{})
+	initializeSignaling(nil, false, false)
+	if config.Signaling {
+		go startWebRTC_SignallingServer()
+		<-signalingListening
+	}
+	return servers, nil
+}
+
+// STUNTURNAddr is the address of the STUN/TURN listeners, UDP and TCP
+func (s *runningServers) STUNTURNAddr() string {
+	return fmt.Sprintf("127.0.0.1:%d", stunturnPort)
+}
+
+// SignalingURL is the WebSocket URL of the signaling server
+func (s *runningServers) SignalingURL() string {
+	return fmt.Sprintf("ws://127.0.0.1:%d%s", signalingPort, signalingPath)
+}
+
+// Close stops the servers, waits for the signaling connections to end and
+// puts the previous configuration back. Later calls do nothing.
+func (s *runningServers) Close() {
+	s.closeOnce.Do(func() {
+		closeSignaling()
+		closeSTUNTURNServers()
+		s.restore()
+	})
+}
+
+// ============================================================================
+// PORT FALLBACK
+// ============================================================================
+
+// A main STUN/TURN port taken by another process (often a second instance,
+// or coturn) used to stop the startup with a bare "address already in use".
+// bindError names the transport and port and what to do about it, and with
+// -port-fallback=N choosePorts moves to the first of the next N ports that
+// is free before anything is bound:
+// - the STUN/TURN port must be free over UDP, and TCP with -enable-tcp,
+//   so turn: URLs for both transports keep sharing it
+// - the TLS port must be free over TCP with -enable-tls, and UDP with
+//   -enable-dtls, if there are certificates
 //
-// 3. Same server, same port handles both protocols seamlessly
+// The extra ports and the other main port are never picked. The port used
+// is logged, and shown in the banner and the demo client's ICE servers.
 //
-// WHY WE DON'T NEED SEPARATE STUN SERVERS:
-// ========================================
-// - TURN servers are supersets of STUN servers
-// - Running separate STUN servers is redundant and wasteful
-// - Single STUN/TURN server provides both services efficiently
+// A port of 0 picks any free port, the same way, so the integration tests
+// (and several instances on one host) can run without choosing ports.
+
+// bindError describes a failure to listen on a port, with a hint on what
+// to do when the port is taken
+func bindError(transport string, port int, err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("%s port %d is already in use by another process (%w); stop it (`ss -lntup | grep :%d` shows which), choose another port, or set -port-fallback to try the next ones", transport, port, err, port)
+	}
+	return fmt.Errorf("%s port %d: %w", transport, port, err)
+}
+
+// choosePorts picks free STUN/TURN and TLS ports for the ones set to 0, and
+// moves the others to the next free ones, as far as -port-fallback allows
+func choosePorts(enableTCP, enableTLS, enableDTLS bool) error {
+	withTLS := tlsCertificates != nil && (enableTLS || enableDTLS)
+	if stunturnPort == 0 {
+		port, err := anyFreePort(true, enableTCP)
+		if err != nil {
+			return err
+		}
+		stunTurnLogger.Printf("STUN/TURN port 0: listening on %d", port)
+		stunturnPort = port
+	}
+	if withTLS && stunturnTLSPort == 0 {
+		port, err := anyFreePort(enableDTLS, enableTLS)
+		if err != nil {
+			return err
+		}
+		stunTurnLogger.Printf("STUN/TURN TLS port 0: listening on %d", port)
+		stunturnTLSPort = port
+	}
+	if portFallback == 0 {
+		return nil
+	}
+	port, err := freePort(stunturnPort, stunturnTLSPort, true, enableTCP)
+	if err != nil {
+		return err
+	}
+	if port != stunturnPort {
+		stunTurnLog.Warn.Printf("WARNING: STUN/TURN port %d is in use, listening on %d instead (-port-fallback)", stunturnPort, port)
+		stunturnPort = port
+	}
+	if !withTLS {
+		return nil
+	}
+	port, err = freePort(stunturnTLSPort, stunturnPort, enableDTLS, enableTLS)
+	if err != nil {
+		return err
+	}
+	if port != stunturnTLSPort {
+		stunTurnLog.Warn.Printf("WARNING: STUN/TURN TLS port %d is in use, listening on %d instead (-port-fallback)", stunturnTLSPort, port)
+		stunturnTLSPort = port
+	}
+	return nil
+}
+
+// freePort returns the first port from base to base+portFallback that is
+// free on the given transports, skipping the other main port and the extra
+// ports
+func freePort(base, other int, udp, tcp bool) (int, error) {
+	var firstErr error
+	for port := base; port <= base+portFallback && port <= 65535; port++ {
+		if port != base && (port == other || slices.Contains(extraUDPPorts, port) || slices.Contains(extraTCPPorts, port)) {
+			continue
+		}
+		err := probePort(port, udp, tcp)
+		if err == nil {
+			return port, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return 0, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return 0, fmt.Errorf("no free port in %d-%d (-port-fallback=%d): %w", base, base+portFallback, portFallback, firstErr)
+}
+
+// anyFreePort returns a port the system picked that is free on the given
+// transports. A port picked over one transport may be taken over the other,
+// so it tries a few.
+func anyFreePort(udp, tcp bool) (int, error) {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		var port int
+		if udp {
+			var conn net.PacketConn
+			if conn, err = net.ListenPacket("udp", "0.0.0.0:0"); err != nil {
+				return 0, bindError("UDP", 0, err)
+			}
+			port = conn.LocalAddr().(*net.UDPAddr).Port
+			conn.Close()
+		} else {
+			var listener net.Listener
+			if listener, err = net.Listen("tcp", "0.0.0.0:0"); err != nil {
+				return 0, bindError("TCP", 0, err)
+			}
+			port = listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+		}
+		if err = probePort(port, udp, tcp); err == nil {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no port free on every transport: %w", err)
+}
+
+// probePort checks that a port can be bound on the given transports, and
+// releases it right away
+func probePort(port int, udp, tcp bool) error {
+	address := "0.0.0.0:" + strconv.Itoa(port)
+	if udp {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return bindError("UDP", port, err)
+		}
+		conn.Close()
+	}
+	if tcp {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return bindError("TCP", port, err)
+		}
+		listener.Close()
+	}
+	return nil
+}
+
+// ============================================================================
+// STARTUP RETRIES
+// ============================================================================
+
+// In Kubernetes a pod may start before its IP or NetworkPolicy is in place,
+// so detecting the public IP or binding a listener fails, the process exits
+// and the pod goes into a crash loop. With -startup-retries=N those steps
+// are tried N more times, with exponential backoff: -startup-backoff before
+// the first retry, doubled for each further one up to maxStartupBackoff,
+// each delay jittered by +/-50% so pods starting together don't retry in
+// lockstep. Every failed attempt is logged; the server only gives up once
+// the retries are used up.
+//
+// Until every listener is up /readyz answers 503 "starting", so no traffic
+// is routed to a pod still retrying. 0, the default, fails at once as before.
+
+// maxStartupBackoff caps the delay between startup retries
+const maxStartupBackoff = time.Minute
+
+// startupComplete is set once every listener is up, see handleReadyz
+var startupComplete atomic.Bool
+
+// retryStartup runs a startup step until it succeeds or -startup-retries
+// retries have failed, logging the failures to logger, and returns its last
+// error
+func retryStartup(logger *log.Logger, step string, attempt func() error) error {
+	delay := startupBackoff
+	for try := 1; ; try++ {
+		err := attempt()
+		if err == nil || try > startupRetries {
+			return err
+		}
+		wait := delay/2 + mrand.N(delay) // delay +/-50%
+		logger.Printf("WARNING: %s failed (attempt %d of %d), retrying in %s: %v", step, try, startupRetries+1, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		delay = min(delay*2, maxStartupBackoff)
+	}
+}
+
+// ============================================================================
+// STUNTURN SERVER INITIALIZATION
+// ============================================================================
+
+// initializeSTUNTurnServer sets up the STUN/TURN servers with all protocol variants
+// This is the main initialization function that creates all server instances
+//
+// IMPORTANT: TURN SERVERS INHERENTLY SUPPORT STUN FUNCTIONALITY
+// ============================================================
+// Every TURN server is also a STUN server. This is a fundamental aspect of the
+// TURN protocol specification (RFC 5766). When you run a TURN server, it automatically
+// handles both STUN and TURN requests on the same port.
+//
+// HOW IT WORKS:
+// =============
+//
+//  1. Client sends STUN_BINDING_REQUEST → Server responds with STUN_BINDING_RESPONSE
+//     (This is standard STUN functionality for NAT discovery)
+//
+//  2. Client sends TURN_ALLOCATE_REQUEST → Server responds with TURN_ALLOCATE_RESPONSE
+//     (This is TURN functionality for relay allocation)
+//
+// 3. Same server, same port handles both protocols seamlessly
+//
+// WHY WE DON'T NEED SEPARATE STUN SERVERS:
+// ========================================
+// - TURN servers are supersets of STUN servers
+// - Running separate STUN servers is redundant and wasteful
+// - Single STUN/TURN server provides both services efficiently
 // - Clients can use the same server for both STUN discovery and TURN relay
 //
 // CLIENT CONFIGURATION:
@@ -1817,26 +4001,55 @@ func countActiveSTUNTURNServers() int {
 // - Each thread gets its own listener
 // - Improves performance under high load
 // - Prevents connection bottlenecks
-func initializeSTUNTurnServer(publicIP, users, realm string, threadNum int, enableTCP, enableTLS bool) error {
+func initializeSTUNTurnServer(publicIP, users, realm string, realmUsers map[string]string, threadNum int, enableTCP, enableTLS, enableDTLS bool) (err error) {
+	// A failure leaves nothing behind: the listeners bound so far are closed
+	defer func() {
+		if err != nil {
+			closeSTUNTURNServers()
+		} else {
+			recordSTUNTURNHealth(enableTCP, enableTLS, enableDTLS)
+		}
+	}()
+	// Move to the next free ports with -port-fallback
+	if err := choosePorts(enableTCP, enableTLS, enableDTLS); err != nil {
+		return err
+	}
+
+	// With -mode=stun none of the TURN machinery is loaded: no users, no
+	// relay generator and no auth handler. The listeners answer binding
+	// requests only, see STUN-ONLY MODE
+	if serverMode == modeSTUN {
+		if err := initializeUDPSTUNTurnServer(nil, nil, realm, threadNum); err != nil {
+			return fmt.Errorf("failed to initialize UDP STUN server: %w", err)
+		}
+		if enableTCP {
+			if err := initializeTCPSTUNTurnServer(nil, nil, realm, threadNum); err != nil {
+				return fmt.Errorf("failed to initialize TCP STUN server: %w", err)
+			}
+		}
+		if enableTLS {
+			if err := initializeTLSSTUNTurnServer(nil, nil, realm, threadNum); err != nil {
+				return fmt.Errorf("failed to initialize TLS STUN server: %w", err)
+			}
+		}
+		if enableDTLS {
+			if err := initializeDTLSSTUNTurnServer(nil, nil, realm); err != nil {
+				return fmt.Errorf("failed to initialize DTLS STUN server: %w", err)
+			}
+		}
+		return nil
+	}
+
 	// ========================================================================
 	// USER AUTHENTICATION SETUP
 	// ========================================================================
-	// Parse TURN user credentials from the command line argument
-	// Format: "user1=pass1,user2=pass2"
-	// This creates a map of username -> cryptographic auth key
-	usersMap = make(map[string][]byte)
-
-	// Use regex to parse username=password pairs
-	// This regex finds all patterns like "username=password"
-	// The regex (\w+)=(\w+) captures:
-	// - Group 1: username (word characters)
-	// - Group 2: password (word characters)
-	for _, kv := range regexp.MustCompile(`(\w+)=(\w+)`).FindAllStringSubmatch(users, -1) {
-		// Generate authentication key using TURN protocol specification
-		// This creates a cryptographic key from username, realm, and password
-		// The key is used to validate TURN requests from clients
-		usersMap[kv[1]] = turn.GenerateAuthKey(kv[1], realm, kv[2])
-		stunTurnLogger.Printf("Added TURN user: %s", kv[1])
+	// Parse TURN user credentials from the command line arguments
+	// Format: "user1=pass1,user2=pass2" for the default realm, and the same
+	// list for every realm in -turn-realms (see parseTURNRealms)
+	// This creates a map of realm -> username -> cryptographic auth key
+	usersMap = map[string]map[string][]byte{realm: turnUserKeys(users, realm)}
+	for name, list := range realmUsers {
+		usersMap[name] = turnUserKeys(list, name)
 	}
 
 	// ========================================================================
@@ -1845,10 +4058,11 @@ func initializeSTUNTurnServer(publicIP, users, realm string, threadNum int, enab
 	// This tells the TURN server what IP address to use for relay allocation
 	// When a client requests a relay, the server will allocate an address on this IP
 	// The publicIP must be reachable from the internet for relay to work
-	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
+	// Relay sockets are wrapped to account their traffic per user (see RELAY USAGE ACCOUNTING)
+	relayAddressGenerator := &usageRelayGenerator{&turn.RelayAddressGeneratorStatic{
 		RelayAddress: net.ParseIP(publicIP), // Public IP for relay allocation
 		Address:      "0.0.0.0",             // Listen on all interfaces
-	}
+	}}
 
 	// ========================================================================
 	// AUTHENTICATION HANDLER
@@ -1889,6 +4103,14 @@ func initializeSTUNTurnServer(publicIP, users, realm string, threadNum int, enab
 		}
 	}
 
+	// 7. DTLS STUN/TURN server (if enabled) - secure relay service over UDP
+	// For clients that can do DTLS but neither TCP nor TLS
+	if enableDTLS {
+		if err := initializeDTLSSTUNTurnServer(relayAddressGenerator, authHandler, realm); err != nil {
+			return fmt.Errorf("failed to initialize DTLS STUN/TURN server: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -1936,15 +4158,16 @@ func initializeSTUNTurnServer(publicIP, users, realm string, threadNum int, enab
 // SO_REUSEADDR: Allows multiple listeners to bind to the same port
 // SO_BROADCAST: Enables broadcast capabilities for UDP
 // These options are essential for proper UDP server operation
-func initializeUDPSTUNTurnServer(relayGen *turn.RelayAddressGeneratorStatic, authHandler func(string, string, net.Addr) ([]byte, bool), realm string, threadNum int) error {
-	// Create UDP address for the server
-	// "0.0.0.0" means listen on all network interfaces
-	// Port 3478 is the standard STUNTURN UDP port (IANA assigned)
-	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+strconv.Itoa(stunturnPort))
-	if err != nil {
-		return fmt.Errorf("failed to parse server address: %w", err)
-	}
-
+// SO_RCVBUF/SO_SNDBUF: Set from -udp-rcvbuf/-udp-sndbuf when given, see
+// setUDPBufferSizes
+//
+// EXTRA PORTS:
+// ============
+// The ports of -extra-udp-ports get the same listeners as the main port,
+// threadNum each, and are served by the same STUN/TURN server. An extra
+// port that can't be bound is skipped with a warning; the main port must
+// bind.
+func initializeUDPSTUNTurnServer(relayGen turn.RelayAddressGenerator, authHandler func(string, string, net.Addr) ([]byte, bool), realm string, threadNum int) error {
 	// Create listener configuration with proper socket options for multithreading
 	// SO_REUSEADDR allows multiple listeners to bind to the same port
 	// SO_BROADCAST enables broadcast capabilities for UDP
@@ -1962,6 +4185,11 @@ func initializeUDPSTUNTurnServer(relayGen *turn.RelayAddressGeneratorStatic, aut
 				// Set SO_BROADCAST for UDP broadcast capabilities
 				// This allows the server to handle broadcast packets
 				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+				if operr != nil {
+					return
+				}
+				// Enlarge the socket buffers so relay bursts aren't dropped
+				operr = setUDPBufferSizes(fd)
 			}); err != nil {
 				return err
 			}
@@ -1969,209 +4197,1029 @@ func initializeUDPSTUNTurnServer(relayGen *turn.RelayAddressGeneratorStatic, aut
 		},
 	}
 
-	// Create multiple UDP listeners for better performance
-	// Each thread gets its own listener to handle concurrent connections
-	// This prevents connection bottlenecks and improves throughput
-	packetConnConfigs := make([]turn.PacketConnConfig, threadNum)
+	// Listen on the main port, then on every extra port
+	var packetConnConfigs []turn.PacketConnConfig
 	stunTurnLogger.Printf("")
-	for i := 0; i < threadNum; i++ {
-		// Create UDP listener with proper socket options
-		// Each listener runs on the same port but in a separate thread
-		conn, err := listenerConfig.ListenPacket(context.Background(), addr.Network(), addr.String())
+	for _, port := range append([]int{stunturnPort}, extraUDPPorts...) {
+		configs, err := listenUDPPort(listenerConfig, port, relayGen, threadNum)
 		if err != nil {
-			return fmt.Errorf("failed to create UDP STUNTURN listener %d: %w", i, err)
+			if port == stunturnPort {
+				return bindError("UDP", port, err)
+			}
+			stunTurnLog.Warn.Printf("WARNING: Skipping extra UDP port %d: %v", port, err)
+			continue
 		}
+		packetConnConfigs = append(packetConnConfigs, configs...)
+		udpBoundPorts = append(udpBoundPorts, port)
+	}
 
-		// Wrap the connection with custom logging
-		logger := NewSTUNTurnLogger(stunTurnLogger)
-		customConn := NewLoggingPacketConn(conn, logger, fmt.Sprintf("UDP-%d", i))
-
-		// Configure the packet connection with relay capabilities
-		// Each listener is configured with the same relay address generator
-		// This ensures consistent relay allocation across all threads
-		packetConnConfigs[i] = turn.PacketConnConfig{
-			PacketConn:            customConn, // Custom UDP connection with logging
-			RelayAddressGenerator: relayGen,   // How to allocate relay addresses
+	// Without a relay generator (-mode=stun) only binding requests are answered
+	if relayGen == nil {
+		stunBindingServers = append(stunBindingServers, newSTUNBindingServer(packetConnConfigs, nil))
+		for _, port := range udpBoundPorts {
+			registerListener("STUN", "UDP", "0.0.0.0:"+strconv.Itoa(port), threadNum)
 		}
-		stunTurnLogger.Printf("UDP STUNTURN server %d listening on %s", i, conn.LocalAddr().String())
+		return nil
 	}
 
 	// Create STUN/TURN server with authentication and relay capabilities
 	// The server combines all UDP listeners into a single STUN/TURN server instance
 	// This provides unified authentication and relay management
 	// NOTE: This server automatically handles both STUN and TURN requests
+	var err error
 	stunturnServer, err = turn.NewServer(turn.ServerConfig{
-		Realm:             realm,             // Authentication realm
-		AuthHandler:       authHandler,       // Authentication function
-		PacketConnConfigs: packetConnConfigs, // UDP listeners
+		Realm:             realm,              // Authentication realm
+		AuthHandler:       authHandler,        // Authentication function
+		PacketConnConfigs: packetConnConfigs,  // UDP listeners
+		EventHandler:      allocationEvents(), // Allocation created/deleted callbacks
 	})
 	if err != nil {
+		for _, config := range packetConnConfigs {
+			config.PacketConn.Close()
+		}
 		return fmt.Errorf("failed to create UDP STUN/TURN server: %w", err)
 	}
+	for _, port := range udpBoundPorts {
+		registerListener("STUN/TURN", "UDP", "0.0.0.0:"+strconv.Itoa(port), threadNum)
+	}
 	return nil
 }
 
-// ============================================================================
-// TCP STUNTURN SERVER IMPLEMENTATION
-// ============================================================================
-
-// initializeTCPSTUNTURNServer sets up TCP STUN/TURN server
-// This server handles both STUN discovery and TURN relay services over TCP
-//
-// WHY TCP FOR STUN/TURN?
-// =====================
-// TCP STUN/TURN is used as a fallback when UDP is blocked:
-// - Corporate firewalls often block UDP traffic
-// - Some NATs don't handle UDP well
-// - TCP is more reliable in restrictive network environments
-// - Required for enterprise networks with strict security policies
-//
-// DUAL FUNCTIONALITY:
-// ==================
-// This single server handles both STUN and TURN requests over TCP:
-// - STUN_BINDING_REQUEST → STUN_BINDING_RESPONSE (NAT discovery)
-// - TURN_ALLOCATE_REQUEST → TURN_ALLOCATE_RESPONSE (Relay allocation)
-// - Same port, same server, seamless operation
-//
-// TCP vs UDP PERFORMANCE:
-// =======================
-// TCP STUN/TURN is slower than UDP STUN/TURN because:
-// - TCP has connection establishment overhead (3-way handshake)
-// - TCP has congestion control and flow control
-// - TCP retransmits lost packets (good for reliability, bad for latency)
-// - TCP has higher latency due to buffering
-//
-// WHEN TO USE TCP STUN/TURN:
-// =========================
-// Use TCP STUN/TURN when:
-// - UDP is blocked by firewall/NAT
-// - Network has strict security policies
-// - Reliability is more important than latency
-// - Working in corporate/enterprise environments
-//
-// RELAY MECHANISM (TCP):
-// ======================
-// TCP relay works similarly to UDP relay:
-// 1. Client A establishes TCP connection to STUN/TURN server
-// 2. STUN/TURN server allocates relay address for Client A
-// 3. Client B establishes TCP connection to STUN/TURN server
-// 4. STUN/TURN server allocates relay address for Client B
-// 5. STUN/TURN server forwards data between the two TCP connections
-//
-// THREADING MODEL:
-// ================
-// Similar to UDP, multiple threads handle concurrent connections
-// Each thread gets its own TCP listener for better performance
-func initializeTCPSTUNTurnServer(relayGen *turn.RelayAddressGeneratorStatic, authHandler func(string, string, net.Addr) ([]byte, bool), realm string, threadNum int) error {
-	// Create TCP address for the server
-	// Same port as UDP (3478) but different protocol
+// listenUDPPort opens threadNum UDP listeners on a port, wrapped for
+// batching and logging. Listeners of the main port are named UDP-<thread>,
+// those of an extra port UDP-<port>-<thread>. If one can't be bound, the
+// others are closed and the error is returned.
+func listenUDPPort(listenerConfig *net.ListenConfig, port int, relayGen turn.RelayAddressGenerator, threadNum int) ([]turn.PacketConnConfig, error) {
+	// Create UDP address for the server
 	// "0.0.0.0" means listen on all network interfaces
-	addr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:"+strconv.Itoa(stunturnPort))
+	// Port 3478 is the standard STUNTURN UDP port (IANA assigned)
+	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+strconv.Itoa(port))
 	if err != nil {
-		return fmt.Errorf("failed to parse server address: %w", err)
+		return nil, fmt.Errorf("failed to parse server address: %w", err)
 	}
 
-	// Create listener configuration with proper socket options for multithreading
-	// SO_REUSEADDR allows multiple listeners to bind to the same port
-	// This is essential for multi-threaded TCP servers
-	listenerConfig := &net.ListenConfig{
-		Control: func(network, address string, conn syscall.RawConn) error {
-			var operr error
-			if err := conn.Control(func(fd uintptr) {
-				// Set SO_REUSEADDR to allow multiple listeners on same port
-				// This enables multiple threads to share the same port
-				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-			}); err != nil {
-				return err
+	// Bind every thread's listener before wrapping any, so a port that
+	// fails leaves nothing behind
+	conns := make([]net.PacketConn, 0, threadNum)
+	for i := 0; i < threadNum; i++ {
+		// Create UDP listener with proper socket options
+		// Each listener runs on the same port but in a separate thread
+		conn, err := listenerConfig.ListenPacket(context.Background(), addr.Network(), addr.String())
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
 			}
-			return operr
-		},
+			return nil, fmt.Errorf("failed to create UDP STUNTURN listener %d: %w", i, err)
+		}
+		conns = append(conns, conn)
 	}
 
-	// Create multiple TCP listeners for better performance
+	// Create multiple UDP listeners for better performance
 	// Each thread gets its own listener to handle concurrent connections
 	// This prevents connection bottlenecks and improves throughput
-	listenerConfigs := make([]turn.ListenerConfig, threadNum)
-	stunTurnLogger.Printf("")
-	for i := 0; i < threadNum; i++ {
-		// Create TCP listener with proper socket options
-		// Each listener runs on the same port but in a separate thread
-		listener, err := listenerConfig.Listen(context.Background(), addr.Network(), addr.String())
-		if err != nil {
-			return fmt.Errorf("failed to create TCP STUNTURN listener %d: %w", i, err)
+	packetConnConfigs := make([]turn.PacketConnConfig, threadNum)
+	for i, conn := range conns {
+		connID := fmt.Sprintf("UDP-%d", i)
+		if port != stunturnPort {
+			connID = fmt.Sprintf("UDP-%d-%d", port, i)
 		}
+		conn = prepareUDPSocket(conn, connID)
 
-		// Wrap the listener with custom logging
-		logger := NewSTUNTurnLogger(stunTurnLogger)
-		customListener := NewLoggingListener(listener, logger, fmt.Sprintf("TCP-%d", i))
+		// Watch the socket and replace it if it fails, see UDP LISTENER
+		// SUPERVISION
+		conn = newSupervisedPacketConn(conn, connID, func() (net.PacketConn, error) {
+			conn, err := listenerConfig.ListenPacket(context.Background(), addr.Network(), addr.String())
+			if err != nil {
+				return nil, err
+			}
+			forgetUDPSocket(connID)
+			return prepareUDPSocket(conn, connID), nil
+		})
 
-		// Configure the TCP listener with relay capabilities
+		// Wrap the connection with custom logging
+		logger := NewSTUNTurnLogger(stunTurnLog)
+		customConn := NewLoggingPacketConn(conn, logger, connID, "UDP")
+		udpSocketsMu.Lock()
+		udpLoggingConns = append(udpLoggingConns, customConn)
+		udpSocketsMu.Unlock()
+
+		// Configure the packet connection with relay capabilities
 		// Each listener is configured with the same relay address generator
 		// This ensures consistent relay allocation across all threads
-		listenerConfigs[i] = turn.ListenerConfig{
-			Listener:              customListener, // Custom TCP listener with logging
-			RelayAddressGenerator: relayGen,       // How to allocate relay addresses
+		packetConnConfigs[i] = turn.PacketConnConfig{
+			PacketConn:            customConn, // Custom UDP connection with logging
+			RelayAddressGenerator: relayGen,   // How to allocate relay addresses
 		}
-		stunTurnLogger.Printf("TCP STUNTURN server %d listening on %s", i, listener.Addr().String())
+		stunTurnLogger.Printf("UDP STUNTURN server %s listening on %s", connID, conn.LocalAddr().String())
 	}
+	return packetConnConfigs, nil
+}
 
-	// Create STUNTURN server with TCP listeners
-	// The server combines all TCP listeners into a single STUNTURN server instance
-	// This provides unified authentication and relay management
-	// NOTE: This server automatically handles both STUN and TURN requests
-	stunturnTCPServer, err = turn.NewServer(turn.ServerConfig{
-		Realm:           realm,           // Authentication realm
-		AuthHandler:     authHandler,     // Authentication function
-		ListenerConfigs: listenerConfigs, // TCP listeners
-	})
+// prepareUDPSocket checks which buffer sizes the kernel granted a freshly
+// bound UDP listener and remembers it for the drop statistics, then wraps
+// it for batched I/O
+func prepareUDPSocket(conn net.PacketConn, connID string) net.PacketConn {
+	if err := checkUDPBufferSizes(conn, connID); err != nil {
+		stunTurnLog.Warn.Printf("Could not read UDP socket buffer sizes of %s: %v", connID, err)
+	}
+
+	// Move packets in batches on Linux to save syscalls under relay load
+	conn = newBatchPacketConn(conn)
+	if batchConn, ok := conn.(*batchPacketConn); ok {
+		udpSocketsMu.Lock()
+		udpBatchConns = append(udpBatchConns, udpBatchConn{connID: connID, conn: batchConn})
+		udpSocketsMu.Unlock()
+	}
+	return conn
+}
+
+// forgetUDPSocket drops a replaced listener from the drop and batching
+// statistics
+func forgetUDPSocket(connID string) {
+	udpSocketsMu.Lock()
+	defer udpSocketsMu.Unlock()
+	udpSockets = slices.DeleteFunc(udpSockets, func(socket udpSocket) bool { return socket.connID == connID })
+	udpBatchConns = slices.DeleteFunc(udpBatchConns, func(batch udpBatchConn) bool { return batch.connID == connID })
+}
+
+// ============================================================================
+// UDP SOCKET BUFFERS
+// ============================================================================
+
+// udpSocket is a UDP STUN/TURN listener whose drops the connection
+// statistics report
+type udpSocket struct {
+	connID string
+	inode  uint64 // Socket inode, the key of its row in /proc/net/udp (Linux)
+}
+
+// udpBatchConn is a UDP STUN/TURN listener using batched I/O, whose
+// batching counters the connection statistics report
+type udpBatchConn struct {
+	connID string
+	conn   *batchPacketConn
+}
+
+var (
+	udpSockets      []udpSocket
+	udpBatchConns   []udpBatchConn
+	udpLoggingConns []*LoggingPacketConn    // For the packet counters in the connection statistics
+	udpSupervised   []*supervisedPacketConn // For the supervisor, see superviseUDPListeners
+	udpSocketsMu    sync.Mutex
+)
+
+// setUDPBufferSizes applies -udp-rcvbuf and -udp-sndbuf to a UDP socket
+// before it is bound
+func setUDPBufferSizes(fd uintptr) error {
+	if udpRcvBuf > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, udpRcvBuf); err != nil {
+			return fmt.Errorf("setting SO_RCVBUF: %w", err)
+		}
+	}
+	if udpSndBuf > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, udpSndBuf); err != nil {
+			return fmt.Errorf("setting SO_SNDBUF: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkUDPBufferSizes logs the buffer sizes a UDP listener requested and
+// got, warns when the kernel clamped them, and registers the socket for the
+// drop statistics
+//
+// KERNEL LIMITS:
+// ==============
+// Linux silently caps SO_RCVBUF/SO_SNDBUF at net.core.rmem_max and
+// net.core.wmem_max, so a successful setsockopt doesn't mean the size was
+// granted. Linux also reports twice the usable size (the rest is kernel
+// bookkeeping), which is halved here before comparing.
+func checkUDPBufferSizes(conn net.PacketConn, connID string) error {
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("not a socket")
+	}
+	rawConn, err := syscallConn.SyscallConn()
 	if err != nil {
-		return fmt.Errorf("failed to create TCP STUNTURN server: %w", err)
+		return err
+	}
+
+	var rcvBuf, sndBuf int
+	var inode uint64
+	var operr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if rcvBuf, operr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); operr != nil {
+			return
+		}
+		if sndBuf, operr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF); operr != nil {
+			return
+		}
+		var stat syscall.Stat_t
+		if syscall.Fstat(int(fd), &stat) == nil {
+			inode = uint64(stat.Ino)
+		}
+	}); err != nil {
+		return err
+	}
+	if operr != nil {
+		return operr
+	}
+
+	udpSocketsMu.Lock()
+	udpSockets = append(udpSockets, udpSocket{connID: connID, inode: inode})
+	udpSocketsMu.Unlock()
+
+	if runtime.GOOS == "linux" {
+		rcvBuf /= 2
+		sndBuf /= 2
 	}
+	logUDPBufferSize(connID, "SO_RCVBUF", udpRcvBuf, rcvBuf, "net.core.rmem_max")
+	logUDPBufferSize(connID, "SO_SNDBUF", udpSndBuf, sndBuf, "net.core.wmem_max")
 	return nil
 }
 
+// logUDPBufferSize logs one requested vs actual buffer size
+func logUDPBufferSize(connID, option string, requested, actual int, sysctl string) {
+	if requested <= 0 {
+		stunTurnLogger.Printf("[%s] %s: %d bytes (kernel default)", connID, option, actual)
+		return
+	}
+	stunTurnLogger.Printf("[%s] %s: requested %d bytes, got %d bytes", connID, option, requested, actual)
+	if actual < requested {
+		if runtime.GOOS == "linux" {
+			stunTurnLog.Warn.Printf("WARNING: [%s] the kernel clamped %s to %d bytes; raise it with: sysctl -w %s=%d",
+				connID, option, actual, sysctl, requested)
+		} else {
+			stunTurnLog.Warn.Printf("WARNING: [%s] the kernel clamped %s to %d bytes", connID, option, actual)
+		}
+	}
+}
+
+// logUDPDrops logs how many packets each UDP listener dropped because its
+// receive buffer was full. The counters come from the "drops" column of
+// /proc/net/udp and /proc/net/udp6, so they are only available on Linux.
+func logUDPDrops() {
+	udpSocketsMu.Lock()
+	sockets := append([]udpSocket(nil), udpSockets...)
+	udpSocketsMu.Unlock()
+	if len(sockets) == 0 {
+		return
+	}
+
+	drops, err := readUDPDrops()
+	if err != nil {
+		stunTurnLogger.Printf("UDP drop statistics unavailable: %v", err)
+		return
+	}
+	counts := make([]string, 0, len(sockets))
+	for _, socket := range sockets {
+		if n, ok := drops[socket.inode]; ok {
+			counts = append(counts, fmt.Sprintf("%s=%d", socket.connID, n))
+		}
+	}
+	if len(counts) > 0 {
+		stunTurnLogger.Printf("UDP receive buffer drops: %s", strings.Join(counts, ", "))
+	}
+}
+
+// readUDPDrops returns the drop counter of every UDP socket by inode
+func readUDPDrops() (map[uint64]uint64, error) {
+	drops := make(map[uint64]uint64)
+	found := false
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		found = true
+		// Columns: sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ref pointer drops
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 13 {
+				continue
+			}
+			inode, err1 := strconv.ParseUint(fields[9], 10, 64)
+			n, err2 := strconv.ParseUint(fields[12], 10, 64)
+			if err1 == nil && err2 == nil {
+				drops[inode] = n
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("/proc/net/udp not available on %s", runtime.GOOS)
+	}
+	return drops, nil
+}
+
 // ============================================================================
-// TLS STUNTURN SERVER IMPLEMENTATION
+// BATCHED UDP I/O (LINUX)
 // ============================================================================
 
-// initializeTLSSTUNTurnServer sets up TLS STUN/TURN server
-// This server handles both STUN discovery and TURN relay services over encrypted TLS
+// udpBatchSize is how many packets one recvmmsg/sendmmsg call moves at most
+const udpBatchSize = 32
+
+// udpBatchSlotSize is the buffer size of one batched packet. The TURN server
+// reads with a 1600 byte buffer (its inbound MTU) and relays payloads of at
+// most 1600 bytes plus a TURN header, so 2048 covers every packet; larger
+// writes bypass the batch.
+const udpBatchSlotSize = 2048
+
+// batchPacketConn moves UDP packets with recvmmsg/sendmmsg so a busy relay
+// listener pays one syscall per batch instead of one per packet
 //
-// WHY TLS FOR STUN/TURN?
+// HOW IT WORKS:
+// =============
+//   - Reads: ReadFrom hands out the packets of the last ReadBatch one at a
+//     time and only calls ReadBatch again once they are used up. Under load
+//     the kernel queue holds many packets, so each syscall returns a batch.
+//   - Writes: WriteTo copies the packet into a free slot and queues it; a
+//     writer goroutine sends whatever is queued with one WriteBatch. An idle
+//     listener sends each packet right away, a busy one sends in batches.
+//   - Buffers and messages are allocated once, so batching adds no
+//     per-packet allocations (x/net still allocates each source address).
+//
+// Like any UDP send, a queued write that fails is lost; failures are
+// counted and shown in the connection statistics. It still satisfies
+// net.PacketConn, so LoggingPacketConn and the TURN server use it unchanged.
+type batchPacketConn struct {
+	net.PacketConn // The *net.UDPConn, for deadlines, LocalAddr and Close
+	batch          interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+
+	readMu   sync.Mutex
+	readMsgs []ipv4.Message // Packets of the last ReadBatch
+	readN    int            // Number of packets the last ReadBatch returned
+	readPos  int            // Next packet to hand out
+
+	free      chan *udpBatchPacket // Write slots available to WriteTo
+	queue     chan *udpBatchPacket // Packets waiting for the writer
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Counters for the connection statistics
+	packetsIn   atomic.Uint64
+	batchesIn   atomic.Uint64
+	packetsOut  atomic.Uint64
+	batchesOut  atomic.Uint64
+	writeErrors atomic.Uint64
+}
+
+// udpBatchPacket is one write slot
+type udpBatchPacket struct {
+	buf     [udpBatchSlotSize]byte
+	buffers [][]byte // buf[:n], in the form ipv4.Message wants
+	addr    net.Addr
+}
+
+// newBatchPacketConn wraps a UDP listener for batched I/O. It returns conn
+// unchanged where batching isn't available: outside Linux, x/net falls back
+// to one packet per call, which would only add overhead.
+func newBatchPacketConn(conn net.PacketConn) net.PacketConn {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok || runtime.GOOS != "linux" || !udpBatch {
+		return conn
+	}
+
+	c := &batchPacketConn{
+		PacketConn: conn,
+		readMsgs:   make([]ipv4.Message, udpBatchSize),
+		free:       make(chan *udpBatchPacket, 2*udpBatchSize),
+		queue:      make(chan *udpBatchPacket, 2*udpBatchSize),
+		done:       make(chan struct{}),
+	}
+	// Dual-stack listeners are IPv6 sockets; both packages send and receive
+	// the same messages, they differ only in socket options
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		c.batch = ipv6.NewPacketConn(udpConn)
+	} else {
+		c.batch = ipv4.NewPacketConn(udpConn)
+	}
+	for i := range c.readMsgs {
+		c.readMsgs[i].Buffers = [][]byte{make([]byte, udpBatchSlotSize)}
+	}
+	for i := 0; i < cap(c.free); i++ {
+		c.free <- &udpBatchPacket{buffers: make([][]byte, 1)}
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *batchPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.readPos >= c.readN {
+		n, err := c.batch.ReadBatch(c.readMsgs, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.readN, c.readPos = n, 0
+		c.batchesIn.Add(1)
+		c.packetsIn.Add(uint64(n))
+	}
+	msg := &c.readMsgs[c.readPos]
+	c.readPos++
+	// Like ReadFrom, a packet longer than p is truncated
+	n := copy(p, msg.Buffers[0][:msg.N])
+	return n, msg.Addr, nil
+}
+
+func (c *batchPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > udpBatchSlotSize {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	var pkt *udpBatchPacket
+	select {
+	case pkt = <-c.free:
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+	n := copy(pkt.buf[:], p)
+	pkt.buffers[0] = pkt.buf[:n]
+	pkt.addr = addr
+	c.queue <- pkt // Never blocks: there are as many queue places as slots
+	return n, nil
+}
+
+// writeLoop sends queued packets, as many per WriteBatch as are waiting
+func (c *batchPacketConn) writeLoop() {
+	msgs := make([]ipv4.Message, udpBatchSize)
+	pkts := make([]*udpBatchPacket, 0, udpBatchSize)
+	for {
+		select {
+		case pkt := <-c.queue:
+			pkts = append(pkts[:0], pkt)
+		case <-c.done:
+			return
+		}
+	collect:
+		for len(pkts) < udpBatchSize {
+			select {
+			case pkt := <-c.queue:
+				pkts = append(pkts, pkt)
+			default:
+				break collect
+			}
+		}
+
+		for i, pkt := range pkts {
+			msgs[i].Buffers = pkt.buffers
+			msgs[i].Addr = pkt.addr
+		}
+		for sent := 0; sent < len(pkts); {
+			n, err := c.batch.WriteBatch(msgs[sent:len(pkts)], 0)
+			c.batchesOut.Add(1)
+			c.packetsOut.Add(uint64(n))
+			sent += n
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// The packet at sent failed; drop it and send the rest
+				c.writeErrors.Add(1)
+				sent++
+			}
+		}
+		for i, pkt := range pkts {
+			pkt.addr = nil
+			msgs[i].Addr = nil
+			c.free <- pkt
+		}
+	}
+}
+
+func (c *batchPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.PacketConn.Close()
+}
+
+// logStats writes the batching counters to the STUN/TURN log
+func (c *batchPacketConn) logStats(connID string) {
+	perBatch := func(packets, batches uint64) float64 {
+		if batches == 0 {
+			return 0
+		}
+		return float64(packets) / float64(batches)
+	}
+	packetsIn, batchesIn := c.packetsIn.Load(), c.batchesIn.Load()
+	packetsOut, batchesOut := c.packetsOut.Load(), c.batchesOut.Load()
+	stunTurnLogger.Printf("[%s] Batched UDP I/O: %d packets in %d recvmmsg calls (%.1f per call), %d packets in %d sendmmsg calls (%.1f per call), %d send errors",
+		connID, packetsIn, batchesIn, perBatch(packetsIn, batchesIn),
+		packetsOut, batchesOut, perBatch(packetsOut, batchesOut), c.writeErrors.Load())
+}
+
+// ============================================================================
+// UDP LISTENER SUPERVISION
+// ============================================================================
+
+// The TURN server reads each UDP listener in a loop that ends on the first
+// read error. A persistent error, such as the interface going away, used to
+// end it for good: the server silently lost one -threads share of its
+// capacity, and the clients hashed to that socket got no answers.
+//
+// Every UDP listener is now wrapped in a supervisedPacketConn, which reads
+// with a deadline of udpLivenessInterval and counts a heartbeat for every
+// packet and every deadline that passes, so an idle listener beats too. A
+// read error other than a deadline isn't handed to the TURN server: the
+// read waits for the socket to be replaced instead, so the server's read
+// loop (and its allocations, which write through the same wrapper) never
+// notice. Every udpLivenessCheck the connection monitoring goroutine (see
+// startConnectionMonitoring) runs superviseUDPListeners, which for each
+// listener:
+//
+//  1. Reopens a failed socket on the same port, with the same options, and
+//     swaps it in; the waiting read carries on with the new socket.
+//  2. Reports a listener whose heartbeats stopped without an error: its
+//     reader is stuck, which only recreating the TURN server would fix.
+//
+// While a listener is failed or stuck, the stunturn-udp component is
+// degraded with the listener named, and failures and recoveries are logged.
+// A socket that can't be reopened is retried on the next check.
+
+// UDP listener supervision intervals
+const (
+	udpLivenessInterval = 5 * time.Second  // Read deadline, so idle listeners beat
+	udpLivenessCheck    = 15 * time.Second // How often heartbeats are checked
+)
+
+// supervisedPacketConn is a UDP listener whose socket can be replaced while
+// the TURN server reads it, see above
+type supervisedPacketConn struct {
+	connID string
+	reopen func() (net.PacketConn, error) // Binds a new socket for the listener
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	failure  error         // Read error the current socket failed with, nil if it works
+	replaced chan struct{} // Closed when the socket is replaced or the listener closed
+	closed   bool
+
+	beats        atomic.Uint64 // Reads that returned, deadlines included
+	readDeadline time.Time     // Only touched by the reading goroutine
+
+	// Supervisor state, only touched by superviseUDPListeners
+	lastBeats uint64
+	problem   string // Why the listener isn't working, "" if it is
+}
+
+// newSupervisedPacketConn wraps a UDP listener for the supervisor
+func newSupervisedPacketConn(conn net.PacketConn, connID string, reopen func() (net.PacketConn, error)) *supervisedPacketConn {
+	c := &supervisedPacketConn{
+		connID:   connID,
+		reopen:   reopen,
+		conn:     conn,
+		replaced: make(chan struct{}),
+	}
+	udpSocketsMu.Lock()
+	udpSupervised = append(udpSupervised, c)
+	udpSocketsMu.Unlock()
+	return c
+}
+
+// current returns the socket to use and the channel closed when it is
+// replaced, or net.ErrClosed once the listener is closed
+func (c *supervisedPacketConn) current() (net.PacketConn, chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, net.ErrClosed
+	}
+	return c.conn, c.replaced, nil
+}
+
+func (c *supervisedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn, replaced, err := c.current()
+		if err != nil {
+			return 0, nil, err
+		}
+		// Renewing the deadline updates a timer, so it is only done once
+		// half of it has passed, not for every packet
+		if now := time.Now(); c.readDeadline.Sub(now) < udpLivenessInterval/2 {
+			c.readDeadline = now.Add(udpLivenessInterval)
+			conn.SetReadDeadline(c.readDeadline)
+		}
+		n, addr, err := conn.ReadFrom(p)
+		c.beats.Add(1)
+		if err == nil {
+			return n, addr, nil
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			c.readDeadline = time.Time{}
+			continue
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, nil, err
+		}
+		if c.conn == conn && c.failure == nil {
+			c.failure = err
+			stunTurnLog.Warn.Printf("UDP listener %s failed: %v; waiting for the supervisor to reopen it", c.connID, err)
+		}
+		c.mu.Unlock()
+		<-replaced
+		c.readDeadline = time.Time{}
+	}
+}
+
+func (c *supervisedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn, _, err := c.current()
+	if err != nil {
+		return 0, err
+	}
+	return conn.WriteTo(p, addr)
+}
+
+func (c *supervisedPacketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	close(c.replaced)
+	return c.conn.Close()
+}
+
+func (c *supervisedPacketConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.LocalAddr()
+}
+
+// SetDeadline only sets the write deadline: read deadlines belong to the
+// liveness heartbeat
+func (c *supervisedPacketConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline is ignored, see SetDeadline
+func (c *supervisedPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *supervisedPacketConn) SetWriteDeadline(t time.Time) error {
+	conn, _, err := c.current()
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+// replace swaps in a new socket for a failed one and wakes the read
+// waiting for it. It reports false, closing conn, if the listener was
+// closed meanwhile.
+func (c *supervisedPacketConn) replace(conn net.PacketConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return false
+	}
+	c.conn.Close()
+	c.conn, c.failure = conn, nil
+	close(c.replaced)
+	c.replaced = make(chan struct{})
+	return true
+}
+
+// supervise checks the listener's heartbeats and reopens its socket if it
+// failed, and returns why the listener isn't working, or "" if it is
+func (c *supervisedPacketConn) supervise() string {
+	c.mu.Lock()
+	failure, closed := c.failure, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ""
+	}
+	beats := c.beats.Load()
+	stalled := beats == c.lastBeats
+	c.lastBeats = beats
+
+	if failure != nil {
+		conn, err := c.reopen()
+		if err != nil {
+			return fmt.Sprintf("%s failed (%v) and couldn't be reopened: %v", c.connID, failure, err)
+		}
+		if c.replace(conn) {
+			stunTurnLogger.Printf("UDP listener %s reopened on %s after: %v", c.connID, conn.LocalAddr(), failure)
+		}
+		return ""
+	}
+	if stalled {
+		return fmt.Sprintf("%s stopped reading", c.connID)
+	}
+	return ""
+}
+
+// superviseUDPListeners checks every UDP listener, see above, and degrades
+// the stunturn-udp component while any of them isn't working
+func superviseUDPListeners() {
+	udpSocketsMu.Lock()
+	listeners := append([]*supervisedPacketConn(nil), udpSupervised...)
+	udpSocketsMu.Unlock()
+
+	var problems []string
+	for _, c := range listeners {
+		problem := c.supervise()
+		if problem != c.problem {
+			if problem != "" {
+				stunTurnLog.Warn.Printf("WARNING: UDP listener %s", problem)
+			} else if c.problem != "" {
+				stunTurnLogger.Printf("UDP listener %s is working again", c.connID)
+			}
+			c.problem = problem
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	udpListenerProblemsMu.Lock()
+	changed := !slices.Equal(problems, udpListenerProblems)
+	udpListenerProblems = problems
+	udpListenerProblemsMu.Unlock()
+	if changed {
+		// Recheck now so the status change is logged and alerted on
+		componentHealthTable()
+	}
+}
+
+var (
+	// Problems found by the last superviseUDPListeners, which degrade the
+	// stunturn-udp component
+	udpListenerProblems   []string
+	udpListenerProblemsMu sync.Mutex
+)
+
+// udpListenerProblem describes the UDP listeners that aren't working, or
+// returns "" if they all are
+func udpListenerProblem() string {
+	udpListenerProblemsMu.Lock()
+	defer udpListenerProblemsMu.Unlock()
+	if len(udpListenerProblems) == 0 {
+		return ""
+	}
+	return "UDP listener " + strings.Join(udpListenerProblems, "; ")
+}
+
+// ============================================================================
+// TCP STUNTURN SERVER IMPLEMENTATION
+// ============================================================================
+
+// initializeTCPSTUNTURNServer sets up TCP STUN/TURN server
+// This server handles both STUN discovery and TURN relay services over TCP
+//
+// WHY TCP FOR STUN/TURN?
 // =====================
-// TLS STUN/TURN provides encrypted relay connections:
-// - All relay traffic is encrypted end-to-end
-// - Required for secure enterprise environments
-// - Needed for WebRTC in browsers (HTTPS requirement)
-// - Protects against man-in-the-middle attacks
-// - Complies with security policies and regulations
+// TCP STUN/TURN is used as a fallback when UDP is blocked:
+// - Corporate firewalls often block UDP traffic
+// - Some NATs don't handle UDP well
+// - TCP is more reliable in restrictive network environments
+// - Required for enterprise networks with strict security policies
 //
 // DUAL FUNCTIONALITY:
 // ==================
-// This single server handles both STUN and TURN requests over TLS:
+// This single server handles both STUN and TURN requests over TCP:
 // - STUN_BINDING_REQUEST → STUN_BINDING_RESPONSE (NAT discovery)
 // - TURN_ALLOCATE_REQUEST → TURN_ALLOCATE_RESPONSE (Relay allocation)
-// - Same port, same server, seamless operation with encryption
+// - Same port, same server, seamless operation
 //
-// SECURITY BENEFITS:
-// ==================
-// TLS encryption provides:
-// - Confidentiality: Relay data cannot be intercepted
-// - Integrity: Data cannot be modified in transit
-// - Authentication: Server identity is verified
-// - Forward secrecy: Past communications remain secure
+// TCP vs UDP PERFORMANCE:
+// =======================
+// TCP STUN/TURN is slower than UDP STUN/TURN because:
+// - TCP has connection establishment overhead (3-way handshake)
+// - TCP has congestion control and flow control
+// - TCP retransmits lost packets (good for reliability, bad for latency)
+// - TCP has higher latency due to buffering
 //
-// CERTIFICATE REQUIREMENTS:
+// WHEN TO USE TCP STUN/TURN:
 // =========================
-// TLS STUN/TURN requires SSL/TLS certificates:
-// - Certificate must be valid and trusted
-// - Domain name must match server hostname
-// - Certificate must be in PEM format
-// - Private key must be secure and accessible
-//
-// WHEN TO USE TLS STUN/TURN:
-// ==========================
-// Use TLS STUN/TURN when:
+// Use TCP STUN/TURN when:
+// - UDP is blocked by firewall/NAT
+// - Network has strict security policies
+// - Reliability is more important than latency
+// - Working in corporate/enterprise environments
+//
+// RELAY MECHANISM (TCP):
+// ======================
+// TCP relay works similarly to UDP relay:
+// 1. Client A establishes TCP connection to STUN/TURN server
+// 2. STUN/TURN server allocates relay address for Client A
+// 3. Client B establishes TCP connection to STUN/TURN server
+// 4. STUN/TURN server allocates relay address for Client B
+// 5. STUN/TURN server forwards data between the two TCP connections
+//
+// THREADING MODEL:
+// ================
+// Similar to UDP, multiple threads handle concurrent connections
+// Each thread gets its own TCP listener for better performance
+//
+// EXTRA PORTS:
+// ============
+// As for UDP, the ports of -extra-tcp-ports get threadNum listeners each,
+// served by the same STUN/TURN server, and are skipped with a warning if
+// they can't be bound.
+func initializeTCPSTUNTurnServer(relayGen turn.RelayAddressGenerator, authHandler func(string, string, net.Addr) ([]byte, bool), realm string, threadNum int) error {
+	// Create listener configuration with proper socket options for multithreading
+	// SO_REUSEADDR allows multiple listeners to bind to the same port
+	// This is essential for multi-threaded TCP servers
+	listenerConfig := &net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var operr error
+			if err := conn.Control(func(fd uintptr) {
+				// Set SO_REUSEADDR to allow multiple listeners on same port
+				// This enables multiple threads to share the same port
+				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			}); err != nil {
+				return err
+			}
+			return operr
+		},
+	}
+
+	// Listen on the main port, then on every extra port
+	var listenerConfigs []turn.ListenerConfig
+	stunTurnLogger.Printf("")
+	for _, port := range append([]int{stunturnPort}, extraTCPPorts...) {
+		configs, err := listenTCPPort(listenerConfig, port, relayGen, threadNum)
+		if err != nil {
+			if port == stunturnPort {
+				return bindError("TCP", port, err)
+			}
+			stunTurnLog.Warn.Printf("WARNING: Skipping extra TCP port %d: %v", port, err)
+			continue
+		}
+		listenerConfigs = append(listenerConfigs, configs...)
+		tcpBoundPorts = append(tcpBoundPorts, port)
+	}
+
+	// Without a relay generator (-mode=stun) only binding requests are answered
+	if relayGen == nil {
+		stunBindingServers = append(stunBindingServers, newSTUNBindingServer(nil, listenerConfigs))
+		for _, port := range tcpBoundPorts {
+			registerListener("STUN", "TCP", "0.0.0.0:"+strconv.Itoa(port), threadNum)
+		}
+		return nil
+	}
+
+	// Create STUNTURN server with TCP listeners
+	// The server combines all TCP listeners into a single STUNTURN server instance
+	// This provides unified authentication and relay management
+	// NOTE: This server automatically handles both STUN and TURN requests
+	var err error
+	stunturnTCPServer, err = turn.NewServer(turn.ServerConfig{
+		Realm:           realm,              // Authentication realm
+		AuthHandler:     authHandler,        // Authentication function
+		ListenerConfigs: listenerConfigs,    // TCP listeners
+		EventHandler:    allocationEvents(), // Allocation created/deleted callbacks
+	})
+	if err != nil {
+		for _, config := range listenerConfigs {
+			config.Listener.Close()
+		}
+		return fmt.Errorf("failed to create TCP STUNTURN server: %w", err)
+	}
+	for _, port := range tcpBoundPorts {
+		registerListener("STUN/TURN", "TCP", "0.0.0.0:"+strconv.Itoa(port), threadNum)
+	}
+	return nil
+}
+
+// listenTCPPort opens threadNum TCP listeners on a port, wrapped for the
+// PROXY protocol and logging. Listeners of the main port are named
+// TCP-<thread>, those of an extra port TCP-<port>-<thread>. If one can't be
+// bound, the others are closed and the error is returned.
+func listenTCPPort(listenerConfig *net.ListenConfig, port int, relayGen turn.RelayAddressGenerator, threadNum int) ([]turn.ListenerConfig, error) {
+	// Create TCP address for the server
+	// Same port as UDP (3478) but different protocol
+	// "0.0.0.0" means listen on all network interfaces
+	addr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:"+strconv.Itoa(port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server address: %w", err)
+	}
+
+	// Bind every thread's listener before wrapping any, so a port that
+	// fails leaves nothing behind
+	listeners := make([]net.Listener, 0, threadNum)
+	for i := 0; i < threadNum; i++ {
+		// Create TCP listener with proper socket options
+		// Each listener runs on the same port but in a separate thread
+		listener, err := listenerConfig.Listen(context.Background(), addr.Network(), addr.String())
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to create TCP STUNTURN listener %d: %w", i, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	// Create multiple TCP listeners for better performance
+	// Each thread gets its own listener to handle concurrent connections
+	// This prevents connection bottlenecks and improves throughput
+	listenerConfigs := make([]turn.ListenerConfig, threadNum)
+	for i, listener := range listeners {
+		connID := fmt.Sprintf("TCP-%d", i)
+		if port != stunturnPort {
+			connID = fmt.Sprintf("TCP-%d-%d", port, i)
+		}
+
+		// Read the client address from PROXY protocol headers if enabled
+		listener = wrapProxyProtocol(listener)
+
+		// Wrap the listener with custom logging
+		logger := NewSTUNTurnLogger(stunTurnLog)
+		customListener := NewLoggingListener(listener, logger, connID, "TCP")
+
+		// Configure the TCP listener with relay capabilities
+		// Each listener is configured with the same relay address generator
+		// This ensures consistent relay allocation across all threads
+		listenerConfigs[i] = turn.ListenerConfig{
+			Listener:              customListener, // Custom TCP listener with logging
+			RelayAddressGenerator: relayGen,       // How to allocate relay addresses
+		}
+		stunTurnLogger.Printf("TCP STUNTURN server %s listening on %s", connID, listener.Addr().String())
+	}
+	return listenerConfigs, nil
+}
+
+// parsePortList parses a comma-separated list of ports, such as
+// -extra-udp-ports; an empty string is no ports
+func parsePortList(list string) ([]int, error) {
+	var ports []int
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		port, err := strconv.Atoi(field)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// portList formats ports for the startup banner, e.g. ":3478, :53"
+func portList(ports []int) string {
+	formatted := make([]string, len(ports))
+	for i, port := range ports {
+		formatted[i] = ":" + strconv.Itoa(port)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// ============================================================================
+// TLS STUNTURN SERVER IMPLEMENTATION
+// ============================================================================
+
+// initializeTLSSTUNTurnServer sets up TLS STUN/TURN server
+// This server handles both STUN discovery and TURN relay services over encrypted TLS
+//
+// WHY TLS FOR STUN/TURN?
+// =====================
+// TLS STUN/TURN provides encrypted relay connections:
+// - All relay traffic is encrypted end-to-end
+// - Required for secure enterprise environments
+// - Needed for WebRTC in browsers (HTTPS requirement)
+// - Protects against man-in-the-middle attacks
+// - Complies with security policies and regulations
+//
+// DUAL FUNCTIONALITY:
+// ==================
+// This single server handles both STUN and TURN requests over TLS:
+// - STUN_BINDING_REQUEST → STUN_BINDING_RESPONSE (NAT discovery)
+// - TURN_ALLOCATE_REQUEST → TURN_ALLOCATE_RESPONSE (Relay allocation)
+// - Same port, same server, seamless operation with encryption
+//
+// SECURITY BENEFITS:
+// ==================
+// TLS encryption provides:
+// - Confidentiality: Relay data cannot be intercepted
+// - Integrity: Data cannot be modified in transit
+// - Authentication: Server identity is verified
+// - Forward secrecy: Past communications remain secure
+//
+// CERTIFICATE REQUIREMENTS:
+// =========================
+// TLS STUN/TURN requires SSL/TLS certificates:
+// - Certificate must be valid and trusted
+// - Domain name must match server hostname
+// - Certificate must be in PEM format
+// - Private key must be secure and accessible
+//
+// WHEN TO USE TLS STUN/TURN:
+// ==========================
+// Use TLS STUN/TURN when:
 // - Security is a primary concern
 // - Working in enterprise environments
 // - WebRTC is used in browsers (HTTPS requirement)
@@ -2194,377 +5242,6094 @@ func initializeTCPSTUNTurnServer(relayGen *turn.RelayAddressGeneratorStatic, aut
 // 3. Client B establishes TLS connection to STUN/TURN server
 // 4. STUN/TURN server allocates relay address for Client B
 // 5. STUN/TURN server forwards encrypted data between connections
-func initializeTLSSTUNTurnServer(relayGen *turn.RelayAddressGeneratorStatic, authHandler func(string, string, net.Addr) ([]byte, bool), realm string, threadNum int) error {
+func initializeTLSSTUNTurnServer(relayGen turn.RelayAddressGenerator, authHandler func(string, string, net.Addr) ([]byte, bool), realm string, threadNum int) error {
 	// Check if SSL certificates exist (same as TLS STUN)
-	// Certificates must be in the certs/ directory
-	// fullchain.pem contains the certificate chain
-	// privkey.pem contains the private key
-	certFile := "certs/fullchain.pem"
-	keyFile := "certs/privkey.pem"
+	// Certificates are loaded at startup from the certs/ directory
+	// (fullchain.pem and privkey.pem) and -tls-cert-pair, see TLS CERTIFICATES
 	var err error
 
 	// If certificates don't exist, skip TLS server
 	// This allows the server to run without TLS if certificates are not available
-	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+	if tlsCertificates == nil {
 		stunTurnLogger.Printf("SSL certificates not found. Skipping TLS STUNTURN server.")
 		stunturnCertsFound = false
 		return nil
 	}
 	stunturnCertsFound = true
 
-	// Load TLS certificate and private key
-	// The certificate must be valid and trusted by clients
-	// The private key must be secure and accessible to the server
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return fmt.Errorf("failed to load TLS certificate: %w", err)
-	}
+	// Configure TLS settings
+	// MinVersion ensures we use secure TLS versions
+	// TLS 1.2 is the minimum recommended version for security
+	// The certificate is picked by the name the client asks for (SNI)
+	tlsConfig := &tls.Config{
+		GetCertificate: tlsCertificates.getCertificate, // Our SSL certificates by server name
+		MinVersion:     tls.VersionTLS12,               // Minimum TLS version (secure)
+	}
+
+	// Create TCP address for the server
+	// Port 5349 is the standard STUNTURNS (STUNTURN over TLS) port
+	// Different from standard STUNTURN port (3478) to distinguish protocols
+	addr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:"+strconv.Itoa(stunturnTLSPort))
+	if err != nil {
+		return fmt.Errorf("failed to parse server address: %w", err)
+	}
+
+	// Create listener configuration with proper socket options for multithreading
+	// SO_REUSEADDR allows multiple listeners to bind to the same port
+	// This is essential for multi-threaded TLS servers
+	listenerConfig := &net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var operr error
+			if err := conn.Control(func(fd uintptr) {
+				// Set SO_REUSEADDR to allow multiple listeners on same port
+				// This enables multiple threads to share the same port
+				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			}); err != nil {
+				return err
+			}
+			return operr
+		},
+	}
+
+	// Create multiple TLS listeners for better performance
+	// Each thread gets its own listener to handle concurrent connections
+	// This prevents connection bottlenecks and improves throughput
+	listenerConfigs := make([]turn.ListenerConfig, threadNum)
+	stunTurnLogger.Printf("")
+	for i := 0; i < threadNum; i++ {
+		// Create TCP listener with proper socket options first
+		// TLS is built on top of TCP, so we start with a TCP listener
+		tcpListener, err := listenerConfig.Listen(context.Background(), addr.Network(), addr.String())
+		if err != nil {
+			for _, config := range listenerConfigs[:i] {
+				config.Listener.Close()
+			}
+			return bindError("TLS", stunturnTLSPort, fmt.Errorf("failed to create TCP listener for TLS STUNTURN %d: %w", i, err))
+		}
+
+		// Read the client address from PROXY protocol headers if enabled
+		// The header comes before the TLS handshake, so it is parsed first
+		tcpListener = wrapProxyProtocol(tcpListener)
+
+		// Wrap TCP listener with TLS
+		// This adds encryption to the TCP connection
+		// All data transmitted through this listener will be encrypted
+		tlsListener := tls.NewListener(tcpListener, tlsConfig)
+
+		// Log connections and their teardown, and close connections that
+		// never speak STUN, go idle or live too long
+		limitedListener := NewLoggingListener(tlsListener, NewSTUNTurnLogger(stunTurnLog), fmt.Sprintf("TLS-%d", i), "TLS")
+
+		// Configure the TLS listener with relay capabilities
+		// Each listener is configured with the same relay address generator
+		// This ensures consistent relay allocation across all threads
+		listenerConfigs[i] = turn.ListenerConfig{
+			Listener:              limitedListener, // TLS connection
+			RelayAddressGenerator: relayGen,        // How to allocate relay addresses
+		}
+		stunTurnLogger.Printf("TLS STUNTURN server %d listening on %s", i, tlsListener.Addr().String())
+	}
+
+	// Without a relay generator (-mode=stun) only binding requests are answered
+	if relayGen == nil {
+		stunBindingServers = append(stunBindingServers, newSTUNBindingServer(nil, listenerConfigs))
+		registerListener("STUN", "TLS", addr.String(), threadNum)
+		return nil
+	}
+
+	// Create STUNTURN server with TLS listeners
+	// The server combines all TLS listeners into a single STUNTURN server instance
+	// This provides unified authentication and relay management
+	// NOTE: This server automatically handles both STUN and TURN requests
+	stunturnTLSServer, err = turn.NewServer(turn.ServerConfig{
+		Realm:           realm,              // Authentication realm
+		AuthHandler:     authHandler,        // Authentication function
+		ListenerConfigs: listenerConfigs,    // TLS listeners
+		EventHandler:    allocationEvents(), // Allocation created/deleted callbacks
+	})
+	if err != nil {
+		for _, config := range listenerConfigs {
+			config.Listener.Close()
+		}
+		return fmt.Errorf("failed to create TLS STUNTURN server: %w", err)
+	}
+	registerListener("STUN/TURN", "TLS", addr.String(), threadNum)
+	return nil
+}
+
+// ============================================================================
+// DTLS STUNTURN SERVER IMPLEMENTATION
+// ============================================================================
+
+// initializeDTLSSTUNTurnServer sets up the STUN/TURN server over DTLS
+// (RFC 7350) on the TLS port over UDP, for embedded clients that can do
+// DTLS but neither TCP nor TLS: turns:host:5349?transport=udp
+//
+// HOW IT WORKS:
+// =============
+// A DTLS listener accepts a connection per client. The turn.Server wants a
+// PacketConn, as for plain UDP, so dtlsPacketConn turns the connections
+// back into datagrams from and to their client addresses: STUN messages
+// and ChannelData keep their UDP framing. It is wrapped in the same
+// logging PacketConn as the UDP listeners.
+//
+// The certificates are those of the TLS listener, picked by SNI (see TLS
+// CERTIFICATES); without any the DTLS server is skipped. Handshake
+// failures and the negotiated cipher suite of every connection are logged.
+// A connection without traffic for dtlsIdleTimeout is closed, since a
+// client that vanished never says so over UDP.
+func initializeDTLSSTUNTurnServer(relayGen turn.RelayAddressGenerator, authHandler func(string, string, net.Addr) ([]byte, bool), realm string) error {
+	if tlsCertificates == nil {
+		stunTurnLogger.Printf("SSL certificates not found. Skipping DTLS STUNTURN server.")
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+strconv.Itoa(stunturnTLSPort))
+	if err != nil {
+		return fmt.Errorf("failed to parse server address: %w", err)
+	}
+	listener, err := dtls.Listen("udp", addr, &dtls.Config{
+		GetCertificate: func(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return tlsCertificates.getCertificate(&tls.ClientHelloInfo{ServerName: hello.ServerName})
+		},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	})
+	if err != nil {
+		return bindError("DTLS", stunturnTLSPort, fmt.Errorf("failed to create DTLS STUNTURN listener: %w", err))
+	}
+
+	// Wrap the connection with custom logging, like the UDP listeners
+	logger := NewSTUNTurnLogger(stunTurnLog)
+	customConn := NewLoggingPacketConn(newDTLSPacketConn(listener), logger, "DTLS-0", "DTLS")
+	packetConnConfigs := []turn.PacketConnConfig{{
+		PacketConn:            customConn, // DTLS connections as datagrams, with logging
+		RelayAddressGenerator: relayGen,   // How to allocate relay addresses
+	}}
+	stunTurnLogger.Printf("DTLS STUNTURN server listening on %s/udp", listener.Addr().String())
+	dtlsListening = true
+
+	// Without a relay generator (-mode=stun) only binding requests are answered
+	if relayGen == nil {
+		stunBindingServers = append(stunBindingServers, newSTUNBindingServer(packetConnConfigs, nil))
+		registerListener("STUN", "DTLS", addr.String(), 1)
+		return nil
+	}
+
+	stunturnDTLSServer, err = turn.NewServer(turn.ServerConfig{
+		Realm:             realm,              // Authentication realm
+		AuthHandler:       authHandler,        // Authentication function
+		PacketConnConfigs: packetConnConfigs,  // DTLS listener
+		EventHandler:      allocationEvents(), // Allocation created/deleted callbacks
+	})
+	if err != nil {
+		customConn.Close()
+		return fmt.Errorf("failed to create DTLS STUNTURN server: %w", err)
+	}
+	registerListener("STUN/TURN", "DTLS", addr.String(), 1)
+	return nil
+}
+
+// dtlsHandshakeTimeout bounds a DTLS handshake, and dtlsIdleTimeout how
+// long a DTLS connection may go without a packet from its client
+const (
+	dtlsHandshakeTimeout = 10 * time.Second
+	dtlsIdleTimeout      = 10 * time.Minute
+)
+
+// dtlsConns holds the open DTLS connections by client address, so
+// authentications can be attributed to DTLS (see authSource)
+var dtlsConns sync.Map
+
+// dtlsPacket is a datagram read from a DTLS connection
+type dtlsPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// dtlsPacketConn is a PacketConn over the connections of a DTLS listener:
+// ReadFrom returns the datagrams of every connection with its client's
+// address, and WriteTo sends to the connection of that address
+type dtlsPacketConn struct {
+	listener  net.Listener
+	packets   chan dtlsPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newDTLSPacketConn(listener net.Listener) *dtlsPacketConn {
+	c := &dtlsPacketConn{
+		listener: listener,
+		packets:  make(chan dtlsPacket, 64),
+		closed:   make(chan struct{}),
+	}
+	go c.acceptLoop()
+	return c
+}
+
+// acceptLoop accepts DTLS connections until the listener is closed
+func (c *dtlsPacketConn) acceptLoop() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				stunTurnLogger.Printf("DTLS listener stopped: %v", err)
+				setComponentHealth(componentDTLS, componentFailed, fmt.Sprintf("listener stopped: %v", err))
+			}
+			return
+		}
+		go c.serve(conn.(*dtls.Conn))
+	}
+}
+
+// serve completes a connection's handshake, then queues its datagrams for
+// ReadFrom until it closes or goes idle
+func (c *dtlsPacketConn) serve(conn *dtls.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr()
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		stunTurnLog.Warn.Printf("DTLS handshake with %s failed: %v%s", remote, err, geoTag(remote))
+		return
+	}
+	state, _ := conn.ConnectionState()
+	stunTurnLogger.Printf("DTLS connection from %s established: cipher suite %s%s",
+		remote, dtls.CipherSuiteName(state.CipherSuiteID), geoTag(remote))
+
+	key := remote.String()
+	dtlsConns.Store(key, conn)
+	defer dtlsConns.CompareAndDelete(key, conn)
+
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(dtlsIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			stunTurnLogger.Printf("DTLS connection from %s closed: %v", remote, err)
+			return
+		}
+		select {
+		case c.packets <- dtlsPacket{data: append([]byte(nil), buf[:n]...), addr: remote}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *dtlsPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet.data), packet.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *dtlsPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn, ok := dtlsConns.Load(addr.String())
+	if !ok {
+		return 0, fmt.Errorf("no DTLS connection from %s", addr)
+	}
+	return conn.(*dtls.Conn).Write(p)
+}
+
+// Close stops the listener and closes every connection
+func (c *dtlsPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		dtlsConns.Range(func(key, conn any) bool {
+			conn.(*dtls.Conn).Close()
+			return true
+		})
+	})
+	return c.listener.Close()
+}
+
+func (c *dtlsPacketConn) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+// Deadlines are kept per connection, see serve
+func (c *dtlsPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dtlsPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dtlsPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// ============================================================================
+// TLS CERTIFICATES
+// ============================================================================
+
+// The TURNS listeners and the signaling HTTPS server pick their certificate
+// by the server name the client sends (SNI), so one box can serve several
+// domains, e.g. turn.customer-a.com and turn.customer-b.com:
+//
+//	-tls-cert-pair turn.customer-a.com=certs/a.pem:certs/a-key.pem
+//	-tls-cert-pair turn.customer-b.com=certs/b.pem:certs/b-key.pem
+//
+// A name may be a wildcard for one label, like *.example.com; an exact
+// name wins over a wildcard. Clients sending no name or one without a
+// certificate get the default certificate rather than a failed handshake:
+// the pair named by -tls-default-cert, or else certs/fullchain.pem and
+// certs/privkey.pem if they exist, or else the first -tls-cert-pair.
+
+// defaultCertFile and defaultKeyFile are the certificate pair served when
+// no -tls-cert-pair matches, if they exist
+const (
+	defaultCertFile = "certs/fullchain.pem"
+	defaultKeyFile  = "certs/privkey.pem"
+)
+
+// certPairList collects repeated -tls-cert-pair flags
+type certPairList []string
+
+func (l *certPairList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *certPairList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// certificateSet holds the TLS certificates by server name
+type certificateSet struct {
+	byName   map[string]*tls.Certificate // Lowercase names, wildcards as "*.example.com"
+	fallback *tls.Certificate
+}
+
+// loadCertificates loads every name=cert.pem:key.pem pair and the certs/
+// pair, if it exists. It returns nil, and no error, if there are none.
+func loadCertificates(pairs []string, defaultName string) (*certificateSet, error) {
+	set := &certificateSet{byName: make(map[string]*tls.Certificate)}
+	var first *tls.Certificate
+	for _, pair := range pairs {
+		name, files, ok := strings.Cut(pair, "=")
+		certFile, keyFile, ok2 := strings.Cut(files, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || !ok2 || name == "" || certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("%q: want name=cert.pem:key.pem", pair)
+		}
+		if _, taken := set.byName[name]; taken {
+			return nil, fmt.Errorf("%q: %s listed twice", pair, name)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		set.byName[name] = &cert
+		if first == nil {
+			first = &cert
+		}
+	}
+
+	if _, err := os.Stat(defaultCertFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(defaultCertFile, defaultKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		set.fallback = &cert
+	} else {
+		set.fallback = first
+	}
+	if defaultName != "" {
+		cert, ok := set.byName[strings.ToLower(defaultName)]
+		if !ok {
+			return nil, fmt.Errorf("-tls-default-cert %q is not a -tls-cert-pair name", defaultName)
+		}
+		set.fallback = cert
+	}
+	if set.fallback == nil {
+		return nil, nil
+	}
+	names := make([]string, 0, len(set.byName))
+	for name := range set.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stunTurnLogger.Printf("TLS certificate for %s loaded", name)
+	}
+	return set, nil
+}
+
+// getCertificate returns the certificate for the server name a client
+// asks for, a wildcard's for its parent domain, or the default one
+func (s *certificateSet) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return s.fallback, nil
+}
+
+// ============================================================================
+// STUN-ONLY MODE
+// ============================================================================
+
+// With -mode=stun the STUN/TURN listeners are served by a binding responder
+// instead of a TURN server, for lightweight regional nodes that only help
+// clients discover their public address. The listeners, their logging
+// wrappers, drop list, geo policy and TCP/TLS connection limits are the
+// same as in the other modes.
+//
+// A binding request is answered with a binding success response carrying
+// the client's address in XOR-MAPPED-ADDRESS, and a FINGERPRINT. Other
+// requests, such as a TURN Allocate, are answered with 400 (Bad Request) so
+// TURN clients fail fast; indications are ignored. Nothing is
+// authenticated and no state is kept per client.
+
+// Server modes, see -mode
+const (
+	modeSTUN = "stun" // Binding requests only
+	modeTURN = "turn" // Full TURN server, which answers binding requests too
+	modeBoth = "both" // Same as turn
+)
+
+// maxSTUNStreamBuffer bounds the unparsed bytes kept per TCP/TLS connection
+// in STUN-only mode; a STUN message is far smaller
+const maxSTUNStreamBuffer = 64 * 1024
+
+// stunBindingServer answers STUN binding requests on a set of listeners
+type stunBindingServer struct {
+	packetConns []net.PacketConn
+	listeners   []net.Listener
+}
+
+// newSTUNBindingServer starts answering binding requests on the packet
+// connections and listeners of a protocol's configs
+func newSTUNBindingServer(packetConnConfigs []turn.PacketConnConfig, listenerConfigs []turn.ListenerConfig) *stunBindingServer {
+	s := &stunBindingServer{}
+	for _, config := range packetConnConfigs {
+		s.packetConns = append(s.packetConns, config.PacketConn)
+		go s.servePacketConn(config.PacketConn)
+	}
+	for _, config := range listenerConfigs {
+		s.listeners = append(s.listeners, config.Listener)
+		go s.serveListener(config.Listener)
+	}
+	return s
+}
+
+// Close stops answering and closes the listeners
+func (s *stunBindingServer) Close() {
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+// servePacketConn answers the requests read from a UDP listener until it
+// is closed
+func (s *stunBindingServer) servePacketConn(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			stunTurnLogger.Printf("STUN read error: %v", err)
+			continue
+		}
+		if response := stunBindingResponse(buf[:n], addr); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// serveListener accepts TCP/TLS connections until the listener is closed
+func (s *stunBindingServer) serveListener(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			stunTurnLogger.Printf("STUN accept error: %v", err)
+			continue
+		}
+		go serveSTUNStream(conn)
+	}
+}
+
+// serveSTUNStream answers the requests framed on a TCP/TLS connection until
+// it closes or sends something that isn't STUN
+func serveSTUNStream(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 0, 1500)
+	chunk := make([]byte, 1500)
+	for {
+		n, err := conn.Read(chunk)
+		if err != nil {
+			return
+		}
+		buf = append(buf, chunk[:n]...)
+		for len(buf) >= stunHeaderSize {
+			if buf[0]&0xC0 != 0 {
+				return // Not STUN; ChannelData has no use without TURN
+			}
+			size := stunHeaderSize + int(binary.BigEndian.Uint16(buf[2:4]))
+			if len(buf) < size {
+				break
+			}
+			if response := stunBindingResponse(buf[:size], conn.RemoteAddr()); response != nil {
+				if _, err := conn.Write(response); err != nil {
+					return
+				}
+			}
+			buf = buf[size:]
+		}
+		if len(buf) > maxSTUNStreamBuffer {
+			return
+		}
+		buf = append(buf[:0:0], buf...)
+	}
+}
+
+// stunHeaderSize is the size of a STUN message header
+const stunHeaderSize = 20
+
+// stunBindingResponse returns the response to a STUN request from addr, or
+// nil if data isn't a request
+func stunBindingResponse(data []byte, addr net.Addr) []byte {
+	if !stun.IsMessage(data) {
+		return nil
+	}
+	req := &stun.Message{Raw: append([]byte(nil), data...)}
+	if err := req.Decode(); err != nil || req.Type.Class != stun.ClassRequest {
+		return nil
+	}
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	default:
+		return nil
+	}
+	var res *stun.Message
+	var err error
+	if req.Type.Method == stun.MethodBinding {
+		res, err = stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: ip, Port: port}, stun.Fingerprint)
+	} else {
+		res, err = stun.Build(stun.NewTransactionIDSetter(req.TransactionID),
+			stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+			&stun.ErrorCodeAttribute{Code: stun.CodeBadRequest, Reason: []byte("STUN only")}, stun.Fingerprint)
+	}
+	if err != nil {
+		return nil
+	}
+	return res.Raw
+}
+
+// ============================================================================
+// CUSTOM LOGGING HANDLERS
+// ============================================================================
+
+// CustomPacketConn wraps a net.PacketConn to add logging for all STUN/TURN packets
+type CustomPacketConn struct {
+	net.PacketConn
+	connID string
+}
+
+func (c *CustomPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err == nil && n > 0 {
+		// Log all incoming packets (both STUN and TURN)
+		stunTurnLogger.Printf("[%s] Received %d bytes from %s", c.connID, n, addr.String())
+
+		// Try to identify STUN/TURN message type
+		if n >= 20 { // Minimum STUN message size
+			messageType := getSTUNTURNMessageType(p[:n])
+			if messageType != "" {
+				stunTurnLogger.Printf("[%s] %s request from %s", c.connID, messageType, addr.String())
+			}
+		}
+	}
+	return n, addr, err
+}
+
+func (c *CustomPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	if err == nil && n > 0 {
+		stunTurnLogger.Printf("[%s] Sent %d bytes to %s", c.connID, n, addr.String())
+
+		// Try to identify STUN/TURN message type
+		if n >= 20 { // Minimum STUN message size
+			messageType := getSTUNTURNMessageType(p[:n])
+			if messageType != "" {
+				stunTurnLogger.Printf("[%s] %s response to %s", c.connID, messageType, addr.String())
+			}
+		}
+	}
+	return n, err
+}
+
+// CustomListener wraps a net.Listener to add logging for TCP connections
+type CustomListener struct {
+	net.Listener
+	connID string
+}
+
+func (c *CustomListener) Accept() (net.Conn, error) {
+	conn, err := c.Listener.Accept()
+	if err == nil {
+		stunTurnLogger.Printf("[%s] New TCP connection from %s", c.connID, conn.RemoteAddr().String())
+
+		// Wrap the connection to log data
+		conn = &CustomConn{
+			Conn:   conn,
+			connID: c.connID,
+		}
+	}
+	return conn, err
+}
+
+// CustomConn wraps a net.Conn to add logging for TCP data
+type CustomConn struct {
+	net.Conn
+	connID string
+}
+
+func (c *CustomConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if err == nil && n > 0 {
+		stunTurnLogger.Printf("[%s] Received %d bytes from %s", c.connID, n, c.RemoteAddr().String())
+
+		// Try to identify STUN/TURN message type
+		if n >= 20 { // Minimum STUN message size
+			messageType := getSTUNTURNMessageType(b[:n])
+			if messageType != "" {
+				stunTurnLogger.Printf("[%s] %s request from %s", c.connID, messageType, c.RemoteAddr().String())
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *CustomConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if err == nil && n > 0 {
+		stunTurnLogger.Printf("[%s] Sent %d bytes to %s", c.connID, n, c.RemoteAddr().String())
+
+		// Try to identify STUN/TURN message type
+		if n >= 20 { // Minimum STUN message size
+			messageType := getSTUNTURNMessageType(b[:n])
+			if messageType != "" {
+				stunTurnLogger.Printf("[%s] %s response to %s", c.connID, messageType, c.RemoteAddr().String())
+			}
+		}
+	}
+	return n, err
+}
+
+// getSTUNTURNMessageType attempts to identify STUN/TURN message types, see
+// parseSTUNTURNMessage
+func getSTUNTURNMessageType(data []byte) string {
+	return parseSTUNTURNMessage(data)
+}
+
+// ============================================================================
+// ENHANCED AUTHENTICATION HANDLER
+// ============================================================================
+
+// turnUserKeys parses "user1=pass1,user2=pass2" into the users' auth keys
+// in a realm
+func turnUserKeys(users, realm string) map[string][]byte {
+	keys := make(map[string][]byte)
+
+	// Use regex to parse username=password pairs
+	// This regex finds all patterns like "username=password"
+	// The regex (\w+)=(\w+) captures:
+	// - Group 1: username (word characters)
+	// - Group 2: password (word characters)
+	for _, kv := range regexp.MustCompile(`(\w+)=(\w+)`).FindAllStringSubmatch(users, -1) {
+		// Generate authentication key using TURN protocol specification
+		// This creates a cryptographic key from username, realm, and password
+		// The key is used to validate TURN requests from clients, so it
+		// only matches requests presenting the same realm
+		keys[kv[1]] = turn.GenerateAuthKey(kv[1], realm, kv[2])
+		// Keep the password out of every log line, whatever -log-redact says
+		webrtc.AddSecret(kv[2])
+		stunTurnLogger.Printf("Added TURN user: %s (realm: %s)", webrtc.RedactName(kv[1]), realm)
+	}
+	return keys
+}
+
+// parseTURNRealms parses -turn-realms, "realm:user=pass,user=pass;realm:...",
+// into each realm's user list. The default realm gets its users from
+// -turn-users and can't be listed again.
+func parseTURNRealms(spec, defaultRealm string) (map[string]string, error) {
+	realms := make(map[string]string)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, users, found := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		switch {
+		case !found || name == "":
+			return nil, fmt.Errorf("%q: expected realm:user=pass,...", entry)
+		case name == defaultRealm:
+			return nil, fmt.Errorf("realm %q is the default realm, list its users in -turn-users", name)
+		case realms[name] != "":
+			return nil, fmt.Errorf("realm %q listed twice", name)
+		case !strings.Contains(users, "="):
+			return nil, fmt.Errorf("realm %q has no users", name)
+		}
+		realms[name] = users
+	}
+	return realms, nil
+}
+
+// createEnhancedAuthHandler creates an authentication handler with comprehensive logging.
+// A request is checked against the users of the realm it presents; requests
+// presenting a realm the server doesn't know are refused.
+func createEnhancedAuthHandler(usersMap map[string]map[string][]byte) func(string, string, net.Addr) ([]byte, bool) {
+	logger := NewSTUNTurnLogger(stunTurnLog)
+
+	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		geo := geoTag(srcAddr)
+		stunTurnLogger.Printf("Authentication attempt for user: %s from %s%s (realm: %s)", webrtc.RedactName(username), srcAddr.String(), geo, realm)
+
+		// Banned users and sources are refused whatever their credentials
+		if sourceIP, _ := authSource(srcAddr); checkBan(username, sourceIP, "turn_auth") {
+			stunTurnLogger.Printf("Refusing authentication for user %s from %s%s: banned", webrtc.RedactName(username), srcAddr.String(), geo)
+			publishAuthFailed(username, realm, srcAddr, events.AuthBanned)
+			return nil, false
+		}
+
+		usersMapMu.RLock()
+		realmUsers, knownRealm := usersMap[realm]
+		key, ok := realmUsers[username]
+		usersMapMu.RUnlock()
+		if !knownRealm {
+			stunTurnLogger.Printf("Refusing authentication for user %s from %s%s: unknown realm %q", webrtc.RedactName(username), srcAddr.String(), geo, realm)
+		}
+		if ok {
+			logger.LogAuthentication(srcAddr, username, true)
+			auditLog.authentication(username, realm, srcAddr, true)
+			return key, true
+		}
+
+		logger.LogAuthentication(srcAddr, username, false)
+		auditLog.authentication(username, realm, srcAddr, false)
+		recentAuthFailures.add(username, realm, srcAddr)
+		unknownTraffic.recordAuthFailure(srcAddr)
+		if knownRealm {
+			publishAuthFailed(username, realm, srcAddr, events.AuthUnknownUser)
+		} else {
+			publishAuthFailed(username, realm, srcAddr, events.AuthUnknownRealm)
+		}
+		return nil, false
+	}
+}
+
+// publishAuthFailed counts a refused TURN authentication for the alert
+// rules and publishes it on the event bus
+func publishAuthFailed(username, realm string, srcAddr net.Addr, reason string) {
+	authFailuresTotal.Add(1)
+	eventBus.Publish(events.AuthFailed{
+		Time:       time.Now(),
+		Username:   username,
+		Realm:      realm,
+		ClientAddr: srcAddr.String(),
+		Reason:     reason,
+	})
+}
+
+// probeTURNCredentials checks TURN credentials for POST /probe/turn the way
+// the auth handler above and the TURN library's integrity check would,
+// without logging them as an attempt, counting a failure or recording a ban
+// hit. An unknown user and a wrong credential give the same reason.
+func probeTURNCredentials(username, credential, realm, clientIP string) (bool, string) {
+	if realm == "" {
+		realm = turnRealm
+	}
+	ip, _ := netip.ParseAddr(clientIP)
+	if bans.match(username, ip) != nil {
+		return false, "banned"
+	}
+	usersMapMu.RLock()
+	realmUsers, knownRealm := usersMap[realm]
+	key, ok := realmUsers[username]
+	usersMapMu.RUnlock()
+	switch {
+	case !knownRealm:
+		return false, "unknown realm"
+	case !ok || subtle.ConstantTimeCompare(key, turn.GenerateAuthKey(username, realm, credential)) != 1:
+		return false, "wrong username or credential"
+	}
+	return true, ""
+}
+
+// ============================================================================
+// AUDIT LOG
+// ============================================================================
+
+// The audit log is a third log, next to the STUN/TURN and signaling logs,
+// recording who authenticated to TURN and which admin actions were taken.
+//
+// FORMAT:
+// =======
+// One JSON object per line with an RFC3339 timestamp, e.g.
+//
+//	{"time":"2025-01-02T15:04:05.123Z","event":"turn_auth","result":"success","username":"alice","realm":"example.com","sourceIP":"203.0.113.5","transport":"UDP"}
+//	{"time":"2025-01-02T15:05:00Z","event":"admin","action":"droplist_clear","remoteAddr":"127.0.0.1:53412"}
+//
+// Each entry is written with a single write to a file opened with
+// O_APPEND, so concurrent entries never interleave. The file is never
+// removed or truncated by the server; rotating it is left to the operator.
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time       string            `json:"time"`
+	Event      string            `json:"event"`            // "turn_auth" or "admin"
+	Result     string            `json:"result,omitempty"` // "success" or "failure" for turn_auth
+	Username   string            `json:"username,omitempty"`
+	Realm      string            `json:"realm,omitempty"`
+	SourceIP   string            `json:"sourceIP,omitempty"`
+	Transport  string            `json:"transport,omitempty"`  // UDP, TCP or TLS
+	Action     string            `json:"action,omitempty"`     // What an admin request did
+	RemoteAddr string            `json:"remoteAddr,omitempty"` // Where the admin request came from
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// auditLogger appends entries to the audit log file
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// auditLog is the audit log, nil if -audit-log isn't set. Its methods
+// do nothing on nil, so callers don't need to check.
+var auditLog *auditLogger
+
+// streamConns maps the remote address of each open TCP/TLS connection to
+// its *LoggingConn, so authentications can be attributed to TCP or TLS and
+// a revoked user's connections closed
+var streamConns sync.Map
+
+// openAuditLog opens (or creates) the audit log for appending
+func openAuditLog(path string) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{file: file}, nil
+}
+
+// write timestamps an entry and appends it as one line
+func (a *auditLogger) write(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		stunTurnLog.Warn.Printf("Error encoding audit entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(line); err != nil {
+		stunTurnLog.Warn.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// authentication records a TURN authentication attempt
+func (a *auditLogger) authentication(username, realm string, srcAddr net.Addr, success bool) {
+	if a == nil {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	sourceIP, transport := authSource(srcAddr)
+	a.write(auditEntry{
+		Event:     "turn_auth",
+		Result:    result,
+		Username:  username,
+		Realm:     realm,
+		SourceIP:  sourceIP,
+		Transport: transport,
+	})
+}
+
+// authSource returns the source IP and transport (UDP, TCP or TLS) of a
+// TURN authentication
+func authSource(srcAddr net.Addr) (sourceIP, transport string) {
+	transport = "UDP"
+	if _, ok := dtlsConns.Load(srcAddr.String()); ok {
+		transport = "DTLS"
+	} else if _, ok := srcAddr.(*net.UDPAddr); !ok {
+		transport = "TCP"
+		if conn, ok := streamConns.Load(srcAddr.String()); ok {
+			transport = conn.(*LoggingConn).protocol
+		}
+	}
+	sourceIP = srcAddr.String()
+	if ip, ok := addrIP(srcAddr); ok {
+		sourceIP = ip.String()
+	}
+	return sourceIP, transport
+}
+
+// admin records an action taken through an admin endpoint
+func (a *auditLogger) admin(action, remoteAddr string, details map[string]string) {
+	a.write(auditEntry{
+		Event:      "admin",
+		Action:     action,
+		RemoteAddr: remoteAddr,
+		Details:    details,
+	})
+}
+
+// auditAdminAction reports the signaling package's admin actions (see
+// webrtc.ConfigureAudit) to the audit log
+func auditAdminAction(action, remoteAddr string, details map[string]string) {
+	auditLog.admin(action, remoteAddr, details)
+}
+
+// verifyAuditLog checks that every line of an audit log is a complete JSON
+// entry with an RFC3339 timestamp and an event, and returns the number of
+// entries. The error names the first bad line, e.g. one cut short by a
+// crash or a full disk.
+func verifyAuditLog(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if data[len(data)-1] != '\n' {
+		return 0, fmt.Errorf("last line is incomplete (no trailing newline)")
+	}
+	entries := 0
+	for i, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var entry auditEntry
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entry); err != nil {
+			return entries, fmt.Errorf("line %d: invalid entry: %v", i+1, err)
+		}
+		if decoder.More() {
+			return entries, fmt.Errorf("line %d: trailing data after entry", i+1)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entry.Time); err != nil {
+			return entries, fmt.Errorf("line %d: invalid time %q", i+1, entry.Time)
+		}
+		if entry.Event == "" {
+			return entries, fmt.Errorf("line %d: missing event", i+1)
+		}
+		entries++
+	}
+	return entries, nil
+}
+
+// ============================================================================
+// CONNECTION MONITORING
+// ============================================================================
+
+// startConnectionMonitoring starts a goroutine to monitor active connections
+func startConnectionMonitoring() {
+	go func() {
+		ticker := time.NewTicker(60 * time.Second) // Log every minute
+		defer ticker.Stop()
+		// Pings the systemd watchdog, if there is one (see SYSTEMD NOTIFICATIONS)
+		var watchdog <-chan time.Time
+		if interval := watchdogInterval(); interval > 0 {
+			watchdogTicker := time.NewTicker(interval)
+			defer watchdogTicker.Stop()
+			watchdog = watchdogTicker.C
+		}
+		// Checks the UDP listeners (see UDP LISTENER SUPERVISION)
+		listenerChecks := time.NewTicker(udpLivenessCheck)
+		defer listenerChecks.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				logConnectionStats()
+			case <-watchdog:
+				pingWatchdog()
+			case <-listenerChecks.C:
+				superviseUDPListeners()
+			}
+		}
+	}()
+}
+
+// logConnectionStats logs current connection statistics
+func logConnectionStats() {
+	stunTurnLogger.Printf("=== CONNECTION STATISTICS ===")
+	stunTurnLogger.Printf("Time: %s", formatLogTime(time.Now()))
+	stunTurnLogger.Printf("Active STUN/TURN servers: %d", countActiveSTUNTURNServers())
+	stunTurnLogger.Printf("Server status: RUNNING")
+	logComponentHealth()
+	tcpConnStats.log("TCP")
+	tlsConnStats.log("TLS")
+	if top := tcpConnsPerIP.top(10); len(top) > 0 {
+		stunTurnLogger.Printf("Top source IPs by TCP/TLS connections: %s", strings.Join(top, ", "))
+	}
+	udpSocketsMu.Lock()
+	loggingConns := append([]*LoggingPacketConn(nil), udpLoggingConns...)
+	batchConns := append([]udpBatchConn(nil), udpBatchConns...)
+	udpSocketsMu.Unlock()
+	for _, loggingConn := range loggingConns {
+		loggingConn.logStats()
+	}
+	logSignalingStats()
+	logCallOutcomes()
+	logCountryBreakdown()
+	// Clients that only discover their address vs those that relay
+	clients := clientClasses.today()
+	stunTurnLogger.Printf("Clients today: %d STUN-only, %d TURN (%.1f%% STUN-only), %d untracked requests",
+		clients.STUNOnly, clients.TURN, clients.STUNOnlyRatio*100, clients.Untracked)
+	// Which transports this hour's clients came over
+	if transports := clientTransports.thisHour(); len(transports.Clients) > 0 {
+		stunTurnLogger.Printf("Client transports this hour: %s, %d untracked requests", transports.shares(), transports.Untracked)
+	} else {
+		stunTurnLogger.Printf("Client transports this hour: no clients yet")
+	}
+	sourceGeoPolicy.logStats()
+	logInboundClassCounts()
+	logRemoteLogDrops()
+	if dropped := sourceDropList.list(); len(dropped) > 0 || droppedPackets.Load() > 0 {
+		stunTurnLogger.Printf("Drop list: %d sources, %d packets dropped", len(dropped), droppedPackets.Load())
+	}
+	logUDPDrops()
+	responseLatency.logStats()
+	for _, batchConn := range batchConns {
+		batchConn.conn.logStats(batchConn.connID)
+	}
+	stunTurnLogger.Printf("=============================")
+}
+
+// ============================================================================
+// STUN/TURN RESPONSE LATENCY
+// ============================================================================
+
+// Response latency is measured from the moment a listener wrapper reads a
+// binding or allocate request to the moment it writes the response with the
+// same transaction ID. A slow server (GC pauses, CPU starvation) shows up
+// here before clients start timing out.
+//
+// BOUNDS:
+// =======
+//   - Requests without a response within transactionTTL are dropped from the
+//     tracking map and counted as orphaned
+//   - At most maxPendingTransactions requests are tracked; beyond that new
+//     requests aren't measured until older ones complete or expire
+const (
+	transactionTTL         = 5 * time.Second
+	maxPendingTransactions = 10000
+)
+
+// STUN/TURN methods whose responses are timed
+const (
+	stunMethodBinding  = 0x0001
+	turnMethodAllocate = 0x0003
+)
+
+// latencyKey identifies one histogram: a timed method on one transport
+type latencyKey struct {
+	method    uint16 // stunMethodBinding or turnMethodAllocate
+	transport string // "UDP", "TCP" or "TLS"
+}
+
+func (k latencyKey) methodName() string {
+	if k.method == turnMethodAllocate {
+		return "allocate"
+	}
+	return "binding"
+}
+
+// pendingTransaction is a request waiting for its response
+type pendingTransaction struct {
+	key  latencyKey
+	seen time.Time
+}
+
+// latencyTracker correlates requests with responses by transaction ID
+type latencyTracker struct {
+	mu         sync.Mutex
+	pending    map[[12]byte]pendingTransaction
+	histograms map[latencyKey]*latencyHistogram
+	orphaned   map[latencyKey]uint64 // Requests that never got a response
+	untracked  uint64                // Requests skipped because the map was full
+}
+
+var responseLatency = &latencyTracker{
+	pending:    make(map[[12]byte]pendingTransaction),
+	histograms: make(map[latencyKey]*latencyHistogram),
+	orphaned:   make(map[latencyKey]uint64),
+}
+
+// stunMethod returns the method of a STUN message type, dropping the class bits
+func stunMethod(messageType uint16) uint16 {
+	return messageType &^ 0x0110
+}
+
+// observe records a control message read from (incoming) or written to a
+// client on the given transport
+func (t *latencyTracker) observe(data []byte, transport string, incoming bool) {
+	if len(data) < 20 {
+		return // Not a whole STUN header; the callers classify first, but don't rely on it
+	}
+	messageType := binary.BigEndian.Uint16(data[0:2])
+	method := stunMethod(messageType)
+	if method != stunMethodBinding && method != turnMethodAllocate {
+		return
+	}
+	var id [12]byte
+	copy(id[:], data[8:20])
+	isRequest := messageType&0x0110 == 0
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if incoming && isRequest {
+		if _, ok := t.pending[id]; !ok && len(t.pending) >= maxPendingTransactions {
+			t.untracked++
+			return
+		}
+		// A retransmission restarts the clock, as the client sees it
+		t.pending[id] = pendingTransaction{key: latencyKey{method: method, transport: transport}, seen: now}
+		return
+	}
+	if incoming || isRequest {
+		return
+	}
+	pending, ok := t.pending[id]
+	if !ok {
+		return
+	}
+	delete(t.pending, id)
+	histogram := t.histograms[pending.key]
+	if histogram == nil {
+		histogram = &latencyHistogram{}
+		t.histograms[pending.key] = histogram
+	}
+	histogram.record(now.Sub(pending.seen))
+}
+
+// expire drops requests older than transactionTTL and counts them as orphaned
+func (t *latencyTracker) expire() {
+	cutoff := time.Now().Add(-transactionTTL)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, pending := range t.pending {
+		if pending.seen.Before(cutoff) {
+			delete(t.pending, id)
+			t.orphaned[pending.key]++
+		}
+	}
+}
+
+// startLatencyTracking periodically expires unanswered requests
+func startLatencyTracking() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			responseLatency.expire()
+		}
+	}()
+}
+
+// latencySnapshot is the state of one histogram at one point in time
+type latencySnapshot struct {
+	key           latencyKey
+	count         uint64
+	orphaned      uint64
+	p50, p95, p99 time.Duration
+}
+
+// snapshot returns the current percentiles of every histogram, sorted by
+// method and transport
+func (t *latencyTracker) snapshot() ([]latencySnapshot, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make(map[latencyKey]bool)
+	for key := range t.histograms {
+		keys[key] = true
+	}
+	for key := range t.orphaned {
+		keys[key] = true
+	}
+	snapshots := make([]latencySnapshot, 0, len(keys))
+	for key := range keys {
+		s := latencySnapshot{key: key, orphaned: t.orphaned[key]}
+		if histogram := t.histograms[key]; histogram != nil {
+			s.count = histogram.count
+			s.p50 = histogram.quantile(0.50)
+			s.p95 = histogram.quantile(0.95)
+			s.p99 = histogram.quantile(0.99)
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].key.method != snapshots[j].key.method {
+			return snapshots[i].key.method < snapshots[j].key.method
+		}
+		return snapshots[i].key.transport < snapshots[j].key.transport
+	})
+	return snapshots, t.untracked
+}
+
+// logStats writes the latency percentiles to the STUN/TURN log
+func (t *latencyTracker) logStats() {
+	snapshots, untracked := t.snapshot()
+	for _, s := range snapshots {
+		stunTurnLogger.Printf("%s response latency (%s): p50 %s, p95 %s, p99 %s (%d responses, %d orphaned)",
+			s.key.methodName(), s.key.transport, s.p50, s.p95, s.p99, s.count, s.orphaned)
+	}
+	if untracked > 0 {
+		stunTurnLogger.Printf("%d requests not timed because %d transactions were pending", untracked, maxPendingTransactions)
+	}
+}
+
+// latencyHistogram is an HDR-style histogram of durations in microseconds:
+// each power of two is split into latencySubBuckets linear buckets, so every
+// value is recorded with a relative error below 1/latencySubBuckets while
+// covering 1µs to over an hour in a fixed array. It is guarded by the
+// tracker's mutex.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	count  uint64
+}
+
+const (
+	latencySubBucketBits = 3
+	latencySubBuckets    = 1 << latencySubBucketBits
+	latencyBuckets       = 33 * latencySubBuckets
+)
+
+// latencyBucket returns the bucket of a value in microseconds
+func latencyBucket(us uint64) int {
+	if us < latencySubBuckets {
+		return int(us)
+	}
+	exponent := bits.Len64(us) - 1 - latencySubBucketBits
+	index := (exponent+1)*latencySubBuckets + int(us>>exponent) - latencySubBuckets
+	return min(index, latencyBuckets-1)
+}
+
+// latencyBucketUpper returns the largest value in microseconds of a bucket
+func latencyBucketUpper(index int) uint64 {
+	if index < latencySubBuckets {
+		return uint64(index)
+	}
+	exponent := index/latencySubBuckets - 1
+	sub := uint64(index%latencySubBuckets + latencySubBuckets)
+	return (sub+1)<<exponent - 1
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.counts[latencyBucket(uint64(max(d.Microseconds(), 0)))]++
+	h.count++
+}
+
+// quantile returns the upper bound of the bucket holding quantile q
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for index, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			return time.Duration(latencyBucketUpper(index)) * time.Microsecond
+		}
+	}
+	return time.Duration(latencyBucketUpper(latencyBuckets-1)) * time.Microsecond
+}
+
+// ============================================================================
+// NON-STUN TRAFFIC
+// ============================================================================
+
+// The STUN/TURN ports get scanned constantly. Packets that aren't STUN,
+// ChannelData or DTLS are counted per source so operators can see who sends
+// them, without a log line for every packet of a scan.
+//
+// SUPPRESSION AND WARNINGS:
+// =========================
+//   - Only the first unknownTrafficLoggedPackets unknown packets from a
+//     source are logged per window; the rest are just counted
+//   - At the end of each unknownTrafficWindow, every source that sent at
+//     least unknownTrafficWarnThreshold unknown packets gets one warning,
+//     e.g. "source 1.2.3.4 sent 5,000 non-STUN packets in 1m0s"
+//   - The per-source map is cleared every window and holds at most
+//     maxUnknownTrafficSources sources, so a spoofed flood can't grow it
+//
+// Only UDP is classified per packet: a TCP read can start in the middle of
+// a message, and silent TCP connections are closed by TimeoutConn anyway.
+const (
+	unknownTrafficWindow        = time.Minute
+	unknownTrafficLoggedPackets = 3
+	unknownTrafficWarnThreshold = 100
+	maxUnknownTrafficSources    = 10000
+)
+
+// inboundClassCounts counts inbound UDP packets by class
+var inboundClassCounts [stunClassCount]atomic.Uint64
+
+// unknownTrafficTracker counts unknown packets and failed authentications
+// per source IP in the current window
+type unknownTrafficTracker struct {
+	mu       sync.Mutex
+	sources  map[netip.Addr]sourceOffenses
+	overflow uint64 // Unknown packets from sources that didn't fit in the map
+}
+
+// sourceOffenses is what one source did wrong in the current window
+type sourceOffenses struct {
+	unknown      uint64 // Non-STUN packets
+	authFailures uint64 // Requests for unknown TURN users
+	dropped      bool   // Whether the source was put on the drop list
+}
+
+var unknownTraffic = &unknownTrafficTracker{sources: make(map[netip.Addr]sourceOffenses)}
+
+// record counts an unknown packet from addr and reports whether it should
+// still be logged
+func (t *unknownTrafficTracker) record(addr net.Addr) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	offenses, ok := t.sources[ip]
+	if !ok && len(t.sources) >= maxUnknownTrafficSources {
+		t.overflow++
+		return false
+	}
+	offenses.unknown++
+	t.sources[ip] = t.checkDropThreshold(ip, offenses)
+	return offenses.unknown <= unknownTrafficLoggedPackets
+}
+
+// recordAuthFailure counts a failed authentication from addr
+func (t *unknownTrafficTracker) recordAuthFailure(addr net.Addr) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	offenses, ok := t.sources[ip]
+	if !ok && len(t.sources) >= maxUnknownTrafficSources {
+		return
+	}
+	offenses.authFailures++
+	t.sources[ip] = t.checkDropThreshold(ip, offenses)
+}
+
+// checkDropThreshold puts a source on the drop list once its offenses in
+// this window reach -drop-threshold. Must be called with t.mu held.
+func (t *unknownTrafficTracker) checkDropThreshold(ip netip.Addr, offenses sourceOffenses) sourceOffenses {
+	if dropThreshold <= 0 || offenses.dropped || offenses.unknown+offenses.authFailures < uint64(dropThreshold) {
+		return offenses
+	}
+	offenses.dropped = true
+	sourceDropList.add(ip, time.Now().Add(dropCooldown))
+	stunTurnLog.Warn.Printf("WARNING: dropping all packets from %s%s for %s (%s non-STUN packets, %s failed authentications within %s)",
+		ip, geoIP.lookup(ip).tag(), dropCooldown, formatCount(offenses.unknown), formatCount(offenses.authFailures), unknownTrafficWindow)
+	return offenses
+}
+
+// rotate ends the current window, warning about the sources that sent the
+// most unknown packets in it, and expires old drop list entries
+func (t *unknownTrafficTracker) rotate() {
+	t.mu.Lock()
+	sources, overflow := t.sources, t.overflow
+	t.sources = make(map[netip.Addr]sourceOffenses)
+	t.overflow = 0
+	t.mu.Unlock()
+
+	for ip, offenses := range sources {
+		if offenses.unknown >= unknownTrafficWarnThreshold {
+			stunTurnLog.Warn.Printf("WARNING: source %s%s sent %s non-STUN packets in %s", ip, geoIP.lookup(ip).tag(), formatCount(offenses.unknown), unknownTrafficWindow)
+		}
+	}
+	if overflow > 0 {
+		stunTurnLog.Warn.Printf("WARNING: %s non-STUN packets from more than %d sources in %s (spoofed flood?)",
+			formatCount(overflow), maxUnknownTrafficSources, unknownTrafficWindow)
+	}
+	sourceDropList.expire()
+}
+
+// addrIP returns the IP of a UDP or TCP address without allocating
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.AddrPort().Addr().Unmap(), true
+	case *net.TCPAddr:
+		return addr.AddrPort().Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// startUnknownTrafficMonitoring rotates the unknown traffic window
+func startUnknownTrafficMonitoring() {
+	go func() {
+		ticker := time.NewTicker(unknownTrafficWindow)
+		defer ticker.Stop()
+		for range ticker.C {
+			unknownTraffic.rotate()
+		}
+	}()
+}
+
+// logInboundClassCounts writes the inbound packet classification to the STUN/TURN log
+func logInboundClassCounts() {
+	stunTurnLogger.Printf("UDP inbound packets: STUN/TURN=%d, ChannelData=%d, DTLS=%d, unknown=%d",
+		inboundClassCounts[stunClassControl].Load()+inboundClassCounts[stunClassIndication].Load(),
+		inboundClassCounts[stunClassChannelData].Load(),
+		inboundClassCounts[stunClassDTLS].Load(),
+		inboundClassCounts[stunClassUnknown].Load())
+}
+
+// formatCount formats a count with thousands separators, e.g. 5,000
+func formatCount(n uint64) string {
+	digits := strconv.FormatUint(n, 10)
+	var b strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	return b.String()
+}
+
+// ============================================================================
+// DROP LIST
+// ============================================================================
+
+// Sources that flood the listeners with garbage or failed authentications
+// (see -drop-threshold) are put on a drop list for -drop-cooldown.
+// LoggingPacketConn discards their UDP packets before the TURN server parses
+// them, and LoggingListener closes their TCP/TLS connections on accept.
+//
+// HOT PATH:
+// =========
+// Every UDP packet is checked, so the lookup takes no lock: the list is an
+// immutable map behind an atomic pointer, replaced as a whole on the rare
+// changes. With an empty list the check is one atomic load.
+//
+// The list can be viewed and cleared at /admin/droplist on -metrics-addr.
+
+// sourceDropList holds the dropped sources
+var sourceDropList = &dropList{}
+
+// droppedPackets counts UDP packets discarded because of the drop list
+var droppedPackets atomic.Uint64
+
+// dropList is a copy-on-write set of source IPs with expiry times
+type dropList struct {
+	entries atomic.Pointer[map[netip.Addr]time.Time] // Source IP → expiry, never modified in place
+	mu      sync.Mutex                               // Serialises writers
+}
+
+// contains reports whether packets from addr are to be dropped
+func (d *dropList) contains(addr net.Addr) bool {
+	entries := d.entries.Load()
+	if entries == nil || len(*entries) == 0 {
+		return false
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false
+	}
+	expiry, ok := (*entries)[ip]
+	return ok && time.Now().Before(expiry)
+}
+
+// update replaces the list with a modified copy
+func (d *dropList) update(modify func(entries map[netip.Addr]time.Time)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := make(map[netip.Addr]time.Time)
+	if old := d.entries.Load(); old != nil {
+		for ip, expiry := range *old {
+			entries[ip] = expiry
+		}
+	}
+	modify(entries)
+	d.entries.Store(&entries)
+}
+
+// add drops packets from ip until expiry
+func (d *dropList) add(ip netip.Addr, expiry time.Time) {
+	d.update(func(entries map[netip.Addr]time.Time) {
+		entries[ip] = expiry
+	})
+}
+
+// remove takes ip off the list, reporting whether it was on it
+func (d *dropList) remove(ip netip.Addr) bool {
+	removed := false
+	d.update(func(entries map[netip.Addr]time.Time) {
+		_, removed = entries[ip]
+		delete(entries, ip)
+	})
+	return removed
+}
+
+// clear empties the list
+func (d *dropList) clear() {
+	d.update(func(entries map[netip.Addr]time.Time) {
+		clear(entries)
+	})
+}
+
+// expire removes the entries whose cooldown is over
+func (d *dropList) expire() {
+	now := time.Now()
+	d.update(func(entries map[netip.Addr]time.Time) {
+		for ip, expiry := range entries {
+			if !now.Before(expiry) {
+				stunTurnLogger.Printf("No longer dropping packets from %s", ip)
+				delete(entries, ip)
+			}
+		}
+	})
+}
+
+// dropListEntry is one source on the drop list, as shown by the admin endpoint
+type dropListEntry struct {
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires"`
+}
+
+// list returns the current entries sorted by IP
+func (d *dropList) list() []dropListEntry {
+	list := []dropListEntry{}
+	if entries := d.entries.Load(); entries != nil {
+		for ip, expiry := range *entries {
+			list = append(list, dropListEntry{IP: ip.String(), Expires: expiry})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// handleDropList serves /admin/droplist: GET lists the dropped sources,
+// DELETE clears the list, or removes one source with ?ip=
+func handleDropList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sourceDropList.list())
+	case http.MethodDelete:
+		if param := r.URL.Query().Get("ip"); param != "" {
+			ip, err := netip.ParseAddr(param)
+			if err != nil {
+				http.Error(w, "invalid ip", http.StatusBadRequest)
+				return
+			}
+			if !sourceDropList.remove(ip.Unmap()) {
+				http.Error(w, "not on the drop list", http.StatusNotFound)
+				return
+			}
+			stunTurnLogger.Printf("Removed %s from the drop list (admin request from %s)", ip, r.RemoteAddr)
+			auditLog.admin("droplist_remove", r.RemoteAddr, map[string]string{"ip": ip.String()})
+		} else {
+			sourceDropList.clear()
+			stunTurnLogger.Printf("Cleared the drop list (admin request from %s)", r.RemoteAddr)
+			auditLog.admin("droplist_clear", r.RemoteAddr, nil)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// logSignalingStats writes the signaling message and byte counters to the
+// STUN/TURN log next to the connection statistics
+func logSignalingStats() {
+	// Signaling bytes before and after WebSocket compression and framing
+	payloadBytes, wireBytes := webrtc.SignalingByteStats()
+	if payloadBytes > 0 {
+		stunTurnLogger.Printf("Signaling bytes sent: %d payload, %d on the wire (%.1f%%)",
+			payloadBytes, wireBytes, float64(wireBytes)*100/float64(payloadBytes))
+	}
+	stats := webrtc.Stats()
+	counts := make([]string, 0, len(stats.Messages))
+	for _, messageType := range webrtc.MessageTypes() {
+		if stats.Messages[messageType] == 0 {
+			continue
+		}
+		if stats.RateWindow > 0 {
+			counts = append(counts, fmt.Sprintf("%s=%d (%.2f/s)", messageType, stats.Messages[messageType], stats.Rates[messageType]))
+		} else {
+			counts = append(counts, fmt.Sprintf("%s=%d", messageType, stats.Messages[messageType]))
+		}
+	}
+	if len(counts) == 0 && stats.UnknownTypes == 0 && stats.ParseErrors == 0 && stats.InvalidData == 0 && stats.BadRequests == 0 {
+		return
+	}
+	stunTurnLogger.Printf("Signaling messages: %s", strings.Join(counts, ", "))
+	stunTurnLogger.Printf("Signaling unknown types: %d (%.2f/s), parse errors: %d, invalid data: %d, bad requests: %d", stats.UnknownTypes, stats.UnknownRate, stats.ParseErrors, stats.InvalidData, stats.BadRequests)
+}
+
+// ============================================================================
+// BAN LIST
+// ============================================================================
+
+// Bans keep usernames and client IPs (single addresses or CIDRs) out of
+// both TURN and signaling, for good or until an expiry. Unlike the drop
+// list they are set by an admin and, with -ban-file, survive restarts.
+//
+// WHERE BANS ARE CHECKED:
+// =======================
+// - TURN authentication (createEnhancedAuthHandler): username and source IP
+// - Signaling WebSocket upgrades and new SSE sessions: client IP
+// - Signaling joins on any transport: username and client IP
+// Every hit is recorded in the audit log with the rule that matched.
+//
+// LOOKUPS:
+// ========
+// Like the drop list, the rules are immutable and replaced as a whole on
+// the rare changes, so checks take no lock. IP rules are kept in a binary
+// radix tree per address family: a lookup walks at most 32 (IPv4) or 128
+// (IPv6) nodes whatever the number of rules. Usernames are a map.
+//
+// PERSISTENCE:
+// ============
+// The ban file is a JSON array of banEntry, rewritten (via a temporary
+// file and rename) on every change and loaded at startup. Expired bans are
+// ignored by the checks and dropped at the next write. Without -ban-file
+// bans are kept in memory only.
+//
+// Bans are managed at /admin/bans on -metrics-addr.
+
+// banEntry is one ban rule
+type banEntry struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`  // "ip" (an address or a CIDR) or "username"
+	Value   string    `json:"value"` // Address, CIDR or username
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"` // Zero for a permanent ban
+}
+
+// expired reports whether the ban is over
+func (e *banEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// rule describes the ban for the audit log, e.g. "ip:10.0.0.0/8"
+func (e *banEntry) rule() string {
+	return e.Type + ":" + e.Value
+}
+
+// logRule is rule for log lines, with a banned username passed through
+// webrtc.RedactName
+func (e *banEntry) logRule() string {
+	if e.Type == "username" {
+		return e.Type + ":" + webrtc.RedactName(e.Value)
+	}
+	return e.rule()
+}
+
+// banNode is a node of the binary radix tree of IP rules. The path from the
+// root spells the prefix bits; entry is set on nodes that end a rule.
+type banNode struct {
+	children [2]*banNode
+	entry    *banEntry
+}
+
+// addrBits returns the bytes of an address in the tree of its family
+func addrBits(ip netip.Addr) []byte {
+	if ip.Is4() {
+		b := ip.As4()
+		return b[:]
+	}
+	b := ip.As16()
+	return b[:]
+}
+
+// insert adds a rule for prefix
+func (n *banNode) insert(prefix netip.Prefix, entry *banEntry) {
+	bits := addrBits(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bits[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &banNode{}
+		}
+		n = n.children[bit]
+	}
+	n.entry = entry
+}
+
+// lookup returns the broadest rule in force that covers ip, or nil
+func (n *banNode) lookup(ip netip.Addr, now time.Time) *banEntry {
+	bits := addrBits(ip)
+	for i := 0; n != nil; i++ {
+		if n.entry != nil && !n.entry.expired(now) {
+			return n.entry
+		}
+		if i == len(bits)*8 {
+			break
+		}
+		n = n.children[bits[i/8]>>(7-i%8)&1]
+	}
+	return nil
+}
+
+// banRules is an immutable snapshot of the ban list
+type banRules struct {
+	entries []*banEntry          // All rules, in the order they were added
+	users   map[string]*banEntry // Username rules
+	ipv4    *banNode             // IPv4 rules
+	ipv6    *banNode             // IPv6 rules
+}
+
+// newBanRules builds the lookup structures for a list of rules
+func newBanRules(entries []*banEntry) *banRules {
+	rules := &banRules{
+		entries: entries,
+		users:   make(map[string]*banEntry),
+		ipv4:    &banNode{},
+		ipv6:    &banNode{},
+	}
+	for _, entry := range entries {
+		switch entry.Type {
+		case "username":
+			rules.users[entry.Value] = entry
+		case "ip":
+			prefix, err := parseBanPrefix(entry.Value)
+			if err != nil {
+				continue // Validated on the way in
+			}
+			if prefix.Addr().Is4() {
+				rules.ipv4.insert(prefix, entry)
+			} else {
+				rules.ipv6.insert(prefix, entry)
+			}
+		}
+	}
+	return rules
+}
+
+// parseBanPrefix parses the value of an ip rule: an address or a CIDR
+func parseBanPrefix(value string) (netip.Prefix, error) {
+	if ip, err := netip.ParseAddr(value); err == nil {
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// banList is the ban list and its file
+type banList struct {
+	rules atomic.Pointer[banRules] // Current rules, never modified in place
+	mu    sync.Mutex               // Serialises writers and file writes
+	path  string                   // Ban file, "" keeps bans in memory only
+}
+
+// bans is the ban list checked by TURN and signaling
+var bans = &banList{}
+
+// match returns the ban in force for a username or an IP, or nil. An empty
+// username or an invalid IP isn't checked.
+func (b *banList) match(username string, ip netip.Addr) *banEntry {
+	rules := b.rules.Load()
+	if rules == nil || len(rules.entries) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if entry, ok := rules.users[username]; ok && username != "" && !entry.expired(now) {
+		return entry
+	}
+	if !ip.IsValid() {
+		return nil
+	}
+	ip = ip.Unmap()
+	if ip.Is4() {
+		return rules.ipv4.lookup(ip, now)
+	}
+	return rules.ipv6.lookup(ip, now)
+}
+
+// load reads the ban file, if it exists, and makes it the ban list
+func (b *banList) load(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.path = path
+	var entries []*banEntry
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("invalid ban file %s: %w", path, err)
+		}
+	}
+	now := time.Now()
+	kept := entries[:0]
+	for _, entry := range entries {
+		if err := validateBan(entry); err != nil {
+			return fmt.Errorf("invalid ban %s in %s: %w", entry.ID, path, err)
+		}
+		if !entry.expired(now) {
+			kept = append(kept, entry)
+		}
+	}
+	b.rules.Store(newBanRules(kept))
+	return nil
+}
+
+// validateBan checks a rule and normalises its value
+func validateBan(entry *banEntry) error {
+	switch entry.Type {
+	case "username":
+		if entry.Value == "" {
+			return errors.New("empty username")
+		}
+	case "ip":
+		prefix, err := parseBanPrefix(entry.Value)
+		if err != nil {
+			return fmt.Errorf("invalid address or CIDR %q", entry.Value)
+		}
+		if prefix.IsSingleIP() {
+			entry.Value = prefix.Addr().String()
+		} else {
+			entry.Value = prefix.String()
+		}
+	default:
+		return fmt.Errorf("unknown type %q, want ip or username", entry.Type)
+	}
+	return nil
+}
+
+// update replaces the rules with a modified copy, dropping expired rules,
+// and writes the ban file. The rules only change if the file was written.
+func (b *banList) update(modify func(entries []*banEntry) []*banEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	entries := []*banEntry{}
+	if rules := b.rules.Load(); rules != nil {
+		for _, entry := range rules.entries {
+			if !entry.expired(now) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	entries = modify(entries)
+	if b.path != "" {
+		if err := writeBanFile(b.path, entries); err != nil {
+			return err
+		}
+	}
+	b.rules.Store(newBanRules(entries))
+	return nil
+}
+
+// writeBanFile replaces the ban file atomically, so a crash mid-write
+// leaves the previous list
+func writeBanFile(path string, entries []*banEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after the rename
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// add bans a username or IP and returns the stored rule
+func (b *banList) add(entry banEntry) (banEntry, error) {
+	if err := validateBan(&entry); err != nil {
+		return banEntry{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return banEntry{}, err
+	}
+	entry.ID = hex.EncodeToString(id)
+	entry.Created = time.Now().UTC()
+	err := b.update(func(entries []*banEntry) []*banEntry {
+		return append(entries, &entry)
+	})
+	return entry, err
+}
+
+// remove lifts a ban by ID and returns it
+func (b *banList) remove(id string) (banEntry, bool, error) {
+	var removed *banEntry
+	err := b.update(func(entries []*banEntry) []*banEntry {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entry.ID == id {
+				removed = entry
+			} else {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	})
+	if removed == nil {
+		return banEntry{}, false, err
+	}
+	return *removed, true, err
+}
+
+// list returns the bans in force, oldest first
+func (b *banList) list() []banEntry {
+	list := []banEntry{}
+	if rules := b.rules.Load(); rules != nil {
+		now := time.Now()
+		for _, entry := range rules.entries {
+			if !entry.expired(now) {
+				list = append(list, *entry)
+			}
+		}
+	}
+	return list
+}
+
+// checkBan reports whether a username or source IP is banned, and records
+// a hit in the audit log. check names where the check was made.
+func checkBan(username, sourceIP, check string) bool {
+	ip, _ := netip.ParseAddr(sourceIP)
+	entry := bans.match(username, ip)
+	if entry == nil {
+		return false
+	}
+	auditLog.write(auditEntry{
+		Event:    "ban_hit",
+		Result:   "refused",
+		Username: username,
+		SourceIP: sourceIP,
+		Details:  map[string]string{"check": check, "rule": entry.rule(), "id": entry.ID},
+	})
+	return true
+}
+
+// banRequest is the body of POST /admin/bans
+type banRequest struct {
+	Type     string    `json:"type"`  // "ip" or "username"
+	Value    string    `json:"value"` // Address, CIDR or username
+	Reason   string    `json:"reason"`
+	Duration string    `json:"duration"` // How long the ban lasts, e.g. "24h"; omit for permanent
+	Expires  time.Time `json:"expires"`  // Alternatively, when the ban ends
+}
+
+// handleBans serves /admin/bans: GET lists the bans in force, POST adds one
+func handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bans.list())
+	case http.MethodPost:
+		var req banRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		entry := banEntry{Type: req.Type, Value: req.Value, Reason: req.Reason, Expires: req.Expires}
+		if req.Duration != "" {
+			duration, err := time.ParseDuration(req.Duration)
+			if err != nil || duration <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			entry.Expires = time.Now().Add(duration).UTC()
+		}
+		if !entry.Expires.IsZero() && !entry.Expires.After(time.Now()) {
+			http.Error(w, "ban expires in the past", http.StatusBadRequest)
+			return
+		}
+		if err := validateBan(&entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entry, err := bans.add(entry)
+		if err != nil {
+			stunTurnLog.Warn.Printf("Error saving ban: %v", err)
+			http.Error(w, "failed to save the ban list", http.StatusInternalServerError)
+			return
+		}
+		stunTurnLogger.Printf("Banned %s (admin request from %s)", entry.logRule(), r.RemoteAddr)
+		auditLog.admin("ban_add", r.RemoteAddr, map[string]string{
+			"id":      entry.ID,
+			"rule":    entry.rule(),
+			"reason":  entry.Reason,
+			"expires": formatBanExpiry(entry.Expires),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRemoveBan serves DELETE /admin/bans/{id}
+func handleRemoveBan(w http.ResponseWriter, r *http.Request) {
+	entry, ok, err := bans.remove(r.PathValue("id"))
+	if err != nil {
+		stunTurnLog.Warn.Printf("Error writing ban file: %v", err)
+		http.Error(w, "failed to save the ban list", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "no such ban", http.StatusNotFound)
+		return
+	}
+	stunTurnLogger.Printf("Lifted ban %s (admin request from %s)", entry.logRule(), r.RemoteAddr)
+	auditLog.admin("ban_remove", r.RemoteAddr, map[string]string{"id": entry.ID, "rule": entry.rule()})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// formatBanExpiry formats a ban's expiry for the audit log
+func formatBanExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return "never"
+	}
+	return expires.Format(time.RFC3339)
+}
+
+// ============================================================================
+// GEOIP ENRICHMENT
+// ============================================================================
+//
+// With -geoip-db the connection and authentication log lines carry the
+// source's country and autonomous system, e.g.
+//
+//	AUTH FAILED for user 'bob' from 203.0.113.9:50123 [DE AS3320 Deutsche Telekom AG]
+//
+// which saves a whois lookup per address when investigating abuse.
+// /admin/stats.json gets a per-country breakdown of the connections, and
+// /admin/sessions the same fields for each signaling session.
+//
+// DATABASES:
+// ==========
+// MaxMind ships GeoLite2 country and ASN data as separate databases, so the
+// flag takes a comma-separated list (GeoLite2-Country or GeoLite2-City, and
+// GeoLite2-ASN); a lookup merges the fields found in each. The files are
+// read with github.com/oschwald/maxminddb-golang. A database that is missing
+// or can't be parsed is logged and skipped, and with none left the server
+// runs without enrichment.
+//
+// CACHING:
+// ========
+// Results are cached per IP, misses included, so a busy source costs one
+// map lookup per log line. The cache is cleared when it reaches
+// maxGeoCacheEntries, which bounds it when someone scans from many addresses.
+
+// maxGeoCacheEntries is how many IPs the GeoIP cache holds before it is cleared
+const maxGeoCacheEntries = 65536
+
+// geoLocation is what the GeoIP databases know about an IP
+type geoLocation struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	ASN     uint32 `json:"asn,omitempty"`
+	ASOrg   string `json:"asOrg,omitempty"` // Organization the AS is registered to
+}
+
+// tag formats the location for a log line, " [DE AS3320 Deutsche Telekom AG]",
+// or returns "" when nothing is known
+func (g geoLocation) tag() string {
+	var parts []string
+	if g.Country != "" {
+		parts = append(parts, g.Country)
+	}
+	if g.ASN != 0 {
+		parts = append(parts, fmt.Sprintf("AS%d", g.ASN))
+	}
+	if g.ASOrg != "" {
+		parts = append(parts, g.ASOrg)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(parts, " ") + "]"
+}
+
+// geoRecord holds the fields of a database record the server uses.
+// Country databases have country.iso_code (registered_country for anycast
+// and satellite ranges), ASN databases the autonomous_system_* fields.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN   uint32 `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoDatabase is an open GeoIP database
+type geoDatabase struct {
+	path   string
+	reader *maxminddb.Reader
+}
+
+// geoIPResolver looks IPs up in the GeoIP databases and caches the results
+type geoIPResolver struct {
+	databases []geoDatabase
+
+	mu    sync.RWMutex
+	cache map[netip.Addr]geoLocation
+}
+
+// geoIP resolves source locations, nil without -geoip-db
+var geoIP *geoIPResolver
+
+// openGeoIP opens the comma-separated databases. Databases that can't be
+// opened are logged and skipped; it returns nil if none could be.
+func openGeoIP(paths string) *geoIPResolver {
+	resolver := &geoIPResolver{cache: make(map[netip.Addr]geoLocation)}
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			stunTurnLog.Warn.Printf("WARNING: GeoIP database %s not used: %v", path, err)
+			continue
+		}
+		stunTurnLogger.Printf("GeoIP database %s loaded (%s, %d nodes)", path, reader.Metadata.DatabaseType, reader.Metadata.NodeCount)
+		resolver.databases = append(resolver.databases, geoDatabase{path: path, reader: reader})
+	}
+	if len(resolver.databases) == 0 {
+		stunTurnLog.Warn.Printf("WARNING: no usable GeoIP database, log lines and stats won't be enriched")
+		return nil
+	}
+	return resolver
+}
+
+// lookup returns what the databases know about ip, from the cache if it
+// was looked up before. A nil resolver knows nothing.
+func (g *geoIPResolver) lookup(ip netip.Addr) geoLocation {
+	if g == nil || !ip.IsValid() {
+		return geoLocation{}
+	}
+	ip = ip.Unmap()
+	g.mu.RLock()
+	location, cached := g.cache[ip]
+	g.mu.RUnlock()
+	if cached {
+		return location
+	}
+
+	for _, db := range g.databases {
+		var record geoRecord
+		if err := db.reader.Lookup(net.IP(ip.AsSlice()), &record); err != nil {
+			stunTurnLog.Warn.Printf("WARNING: GeoIP lookup of %s in %s failed: %v", ip, db.path, err)
+			continue
+		}
+		location.merge(record)
+	}
+
+	g.mu.Lock()
+	if len(g.cache) >= maxGeoCacheEntries {
+		clear(g.cache)
+	}
+	g.cache[ip] = location
+	g.mu.Unlock()
+	return location
+}
+
+// merge fills the fields still empty from a database record
+func (g *geoLocation) merge(record geoRecord) {
+	if g.Country == "" {
+		g.Country = record.Country.ISOCode
+	}
+	if g.Country == "" {
+		g.Country = record.RegisteredCountry.ISOCode
+	}
+	if g.ASN == 0 {
+		g.ASN = record.ASN
+	}
+	if g.ASOrg == "" {
+		g.ASOrg = record.ASOrg
+	}
+}
+
+// geoTag returns the log line annotation for a source address, "" without
+// -geoip-db
+func geoTag(addr net.Addr) string {
+	if geoIP == nil || addr == nil {
+		return ""
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		ip, _ = parseAddrIP(addr.String())
+	}
+	return geoIP.lookup(ip).tag()
+}
+
+// parseAddrIP parses "ip:port" or a bare IP
+func parseAddrIP(address string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(address); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(address); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// lookupAddress looks up "ip:port" or a bare IP
+func (g *geoIPResolver) lookupAddress(address string) geoLocation {
+	ip, ok := parseAddrIP(address)
+	if g == nil || !ok {
+		return geoLocation{}
+	}
+	return g.lookup(ip)
+}
+
+// countryConnections is one country's share of the current connections
+type countryConnections struct {
+	Country           string `json:"country"`           // "unknown" if the databases don't say
+	Allocations       int    `json:"allocations"`       // Open TURN relay allocations
+	StreamConnections int    `json:"streamConnections"` // TCP/TLS STUN/TURN connections
+	Sessions          int    `json:"sessions"`          // Signaling sessions
+}
+
+func (c countryConnections) total() int {
+	return c.Allocations + c.StreamConnections + c.Sessions
+}
+
+// countryBreakdown counts the current connections per country of their
+// source, busiest country first. It returns nil without -geoip-db.
+func countryBreakdown(allocations []allocationInfo, sessions []webrtc.SessionInfo) []countryConnections {
+	if geoIP == nil {
+		return nil
+	}
+	byCountry := make(map[string]*countryConnections)
+	countryOf := func(address string) *countryConnections {
+		country := geoIP.lookupAddress(address).Country
+		if country == "" {
+			country = "unknown"
+		}
+		counts, ok := byCountry[country]
+		if !ok {
+			counts = &countryConnections{Country: country}
+			byCountry[country] = counts
+		}
+		return counts
+	}
+
+	for _, allocation := range allocations {
+		if allocation.ClientAddress != "" {
+			countryOf(allocation.ClientAddress).Allocations++
+		}
+	}
+	streamConns.Range(func(key, _ any) bool {
+		countryOf(key.(string)).StreamConnections++
+		return true
+	})
+	for _, session := range sessions {
+		if session.RemoteIP != "" {
+			countryOf(session.RemoteIP).Sessions++
+		}
+	}
+
+	breakdown := make([]countryConnections, 0, len(byCountry))
+	for _, counts := range byCountry {
+		breakdown = append(breakdown, *counts)
+	}
+	sort.Slice(breakdown, func(i, j int) bool {
+		if breakdown[i].total() != breakdown[j].total() {
+			return breakdown[i].total() > breakdown[j].total()
+		}
+		return breakdown[i].Country < breakdown[j].Country
+	})
+	return breakdown
+}
+
+// logCountryBreakdown writes the connections per country to the STUN/TURN log
+func logCountryBreakdown() {
+	breakdown := countryBreakdown(relayUsage.allocations(), signalingTenants.Snapshot())
+	if len(breakdown) == 0 {
+		return
+	}
+	counts := make([]string, 0, len(breakdown))
+	for _, country := range breakdown {
+		counts = append(counts, fmt.Sprintf("%s %d", country.Country, country.total()))
+	}
+	stunTurnLogger.Printf("Connections by country: %s", strings.Join(counts, ", "))
+}
+
+// ============================================================================
+// GEO POLICY
+// ============================================================================
+//
+// -allow-countries, -deny-countries and -deny-asns refuse service to
+// sources by the country and AS the GeoIP databases give them. The policy is
+// enforced where a source first reaches the server:
+//
+//   - UDP: packets are dropped before the TURN server parses them
+//   - TCP/TLS: connections are closed as soon as they are accepted
+//   - Signaling: the WebSocket upgrade (and a new SSE session) gets a 403
+//
+// RULES:
+// ======
+// A source is refused if its AS is in -deny-asns or its country is in
+// -deny-countries. With -allow-countries set, it is also refused unless its
+// country is on that list, which includes sources the databases have no
+// country for. Loopback and private (RFC 1918, IPv6 unique local) sources
+// are never refused, so health checks and internal clients keep working.
+//
+// LOGGING:
+// ========
+// A refused source usually keeps trying, so every refusal is counted (see
+// stunturn_geo_denied_total on /metrics) but only the first
+// geoPolicyLogLines per minute and enforcement point are logged.
+
+// geoPolicyLogLines is how many refusals are logged per minute and point
+const geoPolicyLogLines = 10
+
+// Enforcement points of the geo policy
+const (
+	geoPointUDP = iota
+	geoPointStream
+	geoPointSignaling
+	geoPointCount
+)
+
+// geoPointNames label the enforcement points in logs and metrics
+var geoPointNames = [geoPointCount]string{"udp", "tcp_tls", "signaling"}
+
+// geoPolicy is the country and AS policy built from the flags
+type geoPolicy struct {
+	allowCountries map[string]bool // Empty allows every country
+	denyCountries  map[string]bool
+	denyASNs       map[uint32]bool
+
+	denied [geoPointCount]atomic.Uint64 // Refusals per enforcement point
+
+	logMu      sync.Mutex
+	logWindow  time.Time          // Start of the current log minute
+	logged     [geoPointCount]int // Refusals logged in the window
+	suppressed [geoPointCount]int // Refusals not logged in the window
+}
+
+// sourceGeoPolicy is the policy in force, nil if none of the flags is set
+var sourceGeoPolicy *geoPolicy
+
+// parseGeoPolicy builds the policy from the flag values; it returns nil if
+// all of them are empty
+func parseGeoPolicy(allowCountries, denyCountries, denyASNs string) (*geoPolicy, error) {
+	policy := &geoPolicy{
+		allowCountries: make(map[string]bool),
+		denyCountries:  make(map[string]bool),
+		denyASNs:       make(map[uint32]bool),
+	}
+	for _, flagValue := range []struct {
+		list      string
+		countries map[string]bool
+	}{{allowCountries, policy.allowCountries}, {denyCountries, policy.denyCountries}} {
+		for _, code := range strings.Split(flagValue.list, ",") {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if code == "" {
+				continue
+			}
+			if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+				return nil, fmt.Errorf("invalid country code %q, expected a two-letter ISO 3166-1 code", code)
+			}
+			flagValue.countries[code] = true
+		}
+	}
+	for _, asn := range strings.Split(denyASNs, ",") {
+		asn = strings.TrimSpace(asn)
+		if asn == "" {
+			continue
+		}
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+		if err != nil || number == 0 {
+			return nil, fmt.Errorf("invalid AS number %q", asn)
+		}
+		policy.denyASNs[uint32(number)] = true
+	}
+	if len(policy.allowCountries) == 0 && len(policy.denyCountries) == 0 && len(policy.denyASNs) == 0 {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// refusal returns why ip is refused, or "" if it is allowed
+func (p *geoPolicy) refusal(ip netip.Addr) string {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() {
+		return ""
+	}
+	location := geoIP.lookup(ip)
+	switch {
+	case location.ASN != 0 && p.denyASNs[location.ASN]:
+		return fmt.Sprintf("AS%d denied", location.ASN)
+	case location.Country != "" && p.denyCountries[location.Country]:
+		return fmt.Sprintf("country %s denied", location.Country)
+	case len(p.allowCountries) > 0 && location.Country == "":
+		return "country unknown"
+	case len(p.allowCountries) > 0 && !p.allowCountries[location.Country]:
+		return fmt.Sprintf("country %s not allowed", location.Country)
+	}
+	return ""
+}
+
+// denies reports whether ip is refused at point, counting and (rate
+// limited) logging the refusal. source is what the log line shows.
+func (p *geoPolicy) denies(ip netip.Addr, point int, source string) bool {
+	if p == nil || !ip.IsValid() {
+		return false
+	}
+	reason := p.refusal(ip)
+	if reason == "" {
+		return false
+	}
+	p.denied[point].Add(1)
+
+	p.logMu.Lock()
+	now := time.Now()
+	if now.Sub(p.logWindow) >= time.Minute {
+		p.flushSuppressed()
+		p.logWindow = now
+	}
+	logRefusal := p.logged[point] < geoPolicyLogLines
+	if logRefusal {
+		p.logged[point]++
+	} else {
+		p.suppressed[point]++
+	}
+	p.logMu.Unlock()
+
+	if logRefusal {
+		stunTurnLogger.Printf("Geo policy: refused %s %s%s (%s)", geoPointNames[point], source, geoIP.lookup(ip).tag(), reason)
+	}
+	return true
+}
+
+// flushSuppressed logs how many refusals weren't logged in the window that
+// ends and resets the window's counts. Must be called with p.logMu held.
+func (p *geoPolicy) flushSuppressed() {
+	for point := range geoPointCount {
+		if p.suppressed[point] > 0 {
+			stunTurnLogger.Printf("Geo policy: %d more %s refusals not logged in the last minute", p.suppressed[point], geoPointNames[point])
+		}
+		p.logged[point] = 0
+		p.suppressed[point] = 0
+	}
+}
+
+// deniesAddr is denies for a UDP or TCP address
+func (p *geoPolicy) deniesAddr(addr net.Addr, point int) bool {
+	if p == nil {
+		return false
+	}
+	ip, ok := addrIP(addr)
+	return ok && p.denies(ip, point, addr.String())
+}
+
+// allowsSignaling is the webrtc source policy: it reports whether a
+// signaling client IP passes the geo policy
+func allowsSignaling(clientIP, check string) bool {
+	ip, err := netip.ParseAddr(clientIP)
+	return err != nil || !sourceGeoPolicy.denies(ip, geoPointSignaling, clientIP+" ("+check+")")
+}
+
+// logStats writes the refusals since startup to the STUN/TURN log
+func (p *geoPolicy) logStats() {
+	if p == nil {
+		return
+	}
+	p.logMu.Lock()
+	if time.Since(p.logWindow) >= time.Minute {
+		p.flushSuppressed()
+		p.logWindow = time.Now()
+	}
+	p.logMu.Unlock()
+	stunTurnLogger.Printf("Geo policy: refused %d UDP packets, %d TCP/TLS connections, %d signaling connections",
+		p.denied[geoPointUDP].Load(), p.denied[geoPointStream].Load(), p.denied[geoPointSignaling].Load())
+}
+
+// ============================================================================
+// ALLOCATION LIFETIME
+// ============================================================================
+
+// Clients choose how long their allocations live with the LIFETIME attribute
+// of Allocate and Refresh requests, and the TURN server grants anything
+// under an hour (10 minutes without the attribute). It has no setting for
+// either, so -max-allocation-lifetime and -default-allocation-lifetime are
+// enforced by rewriting the requests before the server parses them:
+// - A LIFETIME above the maximum is lowered to it, and the clamp is logged
+// - A request without LIFETIME gets the default (itself capped at the maximum)
+// - A LIFETIME of 0, which deletes the allocation, is left alone
+//
+// LIFETIME is covered by the request's MESSAGE-INTEGRITY, so a rewritten
+// request is signed again with the user's key. Requests whose integrity
+// doesn't check out are passed on untouched for the server to refuse, so
+// the rewrite never makes a forged request valid. The server computes the
+// granted lifetime from the rewritten request and signs its response
+// itself, so clients see the lifetime they actually got.
+//
+// Over TCP and TLS only reads holding exactly one message are rewritten;
+// clients send one request at a time and wait for the response, so that is
+// every read in practice.
+
+const (
+	defaultTURNLifetime = 10 * time.Minute // What the TURN server grants without LIFETIME
+	maxTURNLifetime     = time.Hour        // Requests at or above it get defaultTURNLifetime
+)
+
+var (
+	maxAllocationLifetime     time.Duration // 0 leaves the TURN server's limit
+	defaultAllocationLifetime = defaultTURNLifetime
+)
+
+// configureAllocationLifetime sets the allocation lifetime policy, set once
+// at startup from -max-allocation-lifetime and -default-allocation-lifetime
+func configureAllocationLifetime(maximum, fallback time.Duration) error {
+	switch {
+	case maximum < 0 || maximum >= maxTURNLifetime:
+		return fmt.Errorf("-max-allocation-lifetime %s must be between 0 and 1h", maximum)
+	case maximum > 0 && maximum < time.Second:
+		return fmt.Errorf("-max-allocation-lifetime %s is shorter than a second", maximum)
+	case fallback < time.Second || fallback >= maxTURNLifetime:
+		return fmt.Errorf("-default-allocation-lifetime %s must be between 1s and 1h", fallback)
+	}
+	maxAllocationLifetime = maximum
+	defaultAllocationLifetime = fallback
+	if maximum > 0 && fallback > maximum {
+		defaultAllocationLifetime = maximum
+	}
+	return nil
+}
+
+// allocationLifetimePolicy describes the policy for the startup banner
+func allocationLifetimePolicy() string {
+	if maxAllocationLifetime == 0 {
+		return fmt.Sprintf("default %s, max under %s", defaultAllocationLifetime, maxTURNLifetime)
+	}
+	return fmt.Sprintf("default %s, max %s", defaultAllocationLifetime, maxAllocationLifetime)
+}
+
+// grantedAllocationLifetime returns the longest lifetime an allocation is
+// granted: the maximum, or just under the TURN server's 1h limit
+func grantedAllocationLifetime() time.Duration {
+	if maxAllocationLifetime == 0 {
+		return maxTURNLifetime - time.Second
+	}
+	return maxAllocationLifetime
+}
+
+// enforceAllocationLifetime returns the Allocate or Refresh request in data
+// rewritten to the lifetime policy, or nil if it is left as it is
+func enforceAllocationLifetime(data []byte, addr net.Addr) []byte {
+	if len(data) < 20 || 20+int(binary.BigEndian.Uint16(data[2:4])) != len(data) {
+		return nil
+	}
+	messageType := binary.BigEndian.Uint16(data[0:2])
+	if messageType != 0x0003 && messageType != 0x0004 { // Allocate, Refresh request
+		return nil
+	}
+	msg := &stun.Message{Raw: append([]byte(nil), data...)}
+	if err := msg.Decode(); err != nil {
+		return nil
+	}
+	var username stun.Username
+	var realm stun.Realm
+	if username.GetFrom(msg) != nil || realm.GetFrom(msg) != nil {
+		return nil // The unauthenticated first attempt, answered with 401
+	}
+	usersMapMu.RLock()
+	key, ok := usersMap[realm.String()][username.String()]
+	usersMapMu.RUnlock()
+	if !ok || stun.MessageIntegrity(key).Check(msg) != nil {
+		return nil
+	}
+
+	granted := defaultAllocationLifetime
+	if value, err := msg.Get(stun.AttrLifetime); err == nil && len(value) == 4 {
+		requested := time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+		if requested == 0 || maxAllocationLifetime == 0 || requested <= maxAllocationLifetime {
+			return nil
+		}
+		granted = maxAllocationLifetime
+		stunTurnLogger.Printf("Clamped allocation lifetime for user %s from %s%s: requested %s, granted %s", webrtc.RedactName(username.String()), addr.String(), geoTag(addr), requested, granted)
+	} else if granted == defaultTURNLifetime {
+		return nil
+	}
+
+	rewritten := &stun.Message{Type: msg.Type, TransactionID: msg.TransactionID}
+	rewritten.WriteHeader()
+	for _, attr := range msg.Attributes {
+		switch attr.Type {
+		case stun.AttrLifetime, stun.AttrMessageIntegrity, stun.AttrFingerprint:
+			continue
+		}
+		rewritten.Add(attr.Type, attr.Value)
+	}
+	lifetime := make([]byte, 4)
+	binary.BigEndian.PutUint32(lifetime, uint32(granted/time.Second))
+	rewritten.Add(stun.AttrLifetime, lifetime)
+	if err := stun.MessageIntegrity(key).AddTo(rewritten); err != nil {
+		return nil
+	}
+	if msg.Contains(stun.AttrFingerprint) {
+		if err := stun.Fingerprint.AddTo(rewritten); err != nil {
+			return nil
+		}
+	}
+	return rewritten.Raw
+}
+
+// ============================================================================
+// TCP RELAYING (RFC 6062)
+// ============================================================================
+
+// RFC 6062 lets a client relay TCP to its peers: it allocates with
+// REQUESTED-TRANSPORT TCP, asks for a peer connection with Connect, is told
+// of incoming ones with ConnectionAttempt, and binds each to a new
+// connection of its own with ConnectionBind.
+//
+// The TURN library only implements the client side of it. Its server
+// drops Connect and ConnectionBind without an answer, so clients waited
+// for a timeout, and handed out a UDP relay to an Allocate asking for TCP.
+// Both are answered here, before the TURN server sees them:
+// - Connect and ConnectionBind requests get 403 (Forbidden)
+// - Allocate requests for TCP get 442 (Unsupported Transport Protocol),
+//   which tells RFC 6062 clients the server doesn't relay TCP
+//
+// Each refusal is logged with the peer address or connection ID the
+// client asked for.
+
+// tcpRelayUnsupported is the reason phrase of the refusals
+const tcpRelayUnsupported = "TCP relaying (RFC 6062) is not supported"
+
+// refuseTCPRelay returns the error response to a TCP relay request in
+// data, or nil if data is anything else
+func refuseTCPRelay(data []byte, addr net.Addr) []byte {
+	if len(data) < 20 || 20+int(binary.BigEndian.Uint16(data[2:4])) != len(data) {
+		return nil
+	}
+	messageType := binary.BigEndian.Uint16(data[0:2])
+	if messageType != 0x0003 && messageType != 0x000A && messageType != 0x000B { // Allocate, Connect, ConnectionBind request
+		return nil
+	}
+	msg := &stun.Message{Raw: append([]byte(nil), data...)}
+	if err := msg.Decode(); err != nil {
+		return nil
+	}
+	user := ""
+	var username stun.Username
+	if username.GetFrom(msg) == nil {
+		user = fmt.Sprintf(" (user %s)", webrtc.RedactName(username.String()))
+	}
+
+	code := stun.CodeForbidden
+	switch msg.Type.Method {
+	case stun.MethodAllocate:
+		if transport, err := msg.Get(stun.AttrRequestedTransport); err != nil || len(transport) == 0 || transport[0] != 6 { // TCP
+			return nil
+		}
+		code = stun.CodeUnsupportedTransProto
+		stunTurnLogger.Printf("Refused TCP allocation from %s%s%s: %s", addr.String(), geoTag(addr), user, tcpRelayUnsupported)
+	case stun.MethodConnect:
+		var peer stun.XORMappedAddress
+		peerAddr := "unknown"
+		if peer.GetFromAs(msg, stun.AttrXORPeerAddress) == nil {
+			peerAddr = peer.String()
+		}
+		stunTurnLogger.Printf("Refused TURN Connect from %s%s%s to peer %s: %s", addr.String(), geoTag(addr), user, peerAddr, tcpRelayUnsupported)
+	case stun.MethodConnectionBind:
+		connectionID := "unknown"
+		if value, err := msg.Get(stun.AttrConnectionID); err == nil && len(value) == 4 {
+			connectionID = strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10)
+		}
+		stunTurnLogger.Printf("Refused TURN ConnectionBind from %s%s%s for connection ID %s: %s", addr.String(), geoTag(addr), user, connectionID, tcpRelayUnsupported)
+	}
+
+	res, err := stun.Build(stun.NewTransactionIDSetter(msg.TransactionID),
+		stun.NewType(msg.Type.Method, stun.ClassErrorResponse),
+		&stun.ErrorCodeAttribute{Code: code, Reason: []byte(tcpRelayUnsupported)}, stun.Fingerprint)
+	if err != nil {
+		return nil
+	}
+	return res.Raw
+}
+
+// ============================================================================
+// RELAY USAGE ACCOUNTING
+// ============================================================================
+
+// Relay usage is accounted per TURN user for the daily usage report: how
+// many allocations they created, how many bytes their relays carried, their
+// peak number of concurrent allocations and how many client IPs they used.
+//
+// ATTRIBUTING ALLOCATIONS TO USERS:
+// =================================
+// The relay address generator doesn't learn who an allocation is for, but
+// the TURN servers report every allocation they create and delete (see
+// allocationEvents). The created event carries the client's 5-tuple, the
+// username and the relay address, whose port identifies the relay socket
+// the generator handed out. The deleted event carries the 5-tuple only, so
+// open allocations are also kept by 5-tuple. The server deletes an
+// allocation once, whether it is refreshed with a lifetime of 0, expires or
+// loses its relay socket, so each allocation is released exactly once.
+//
+// ROLLOVER:
+// =========
+// Bytes and allocations are cumulative counters that are never reset; a
+// report takes the difference to the values at the previous report. An
+// increment racing the rollover is therefore counted in one period or the
+// next, never lost. Peak allocations and client IPs are kept per period
+// under the user's lock and reset by the report.
+
+// userUsage is the accounting of one TURN user
+type userUsage struct {
+	username string
+	bytes    atomic.Uint64 // Bytes relayed, both directions, since startup
+
+	mu             sync.Mutex
+	allocations    uint64              // Allocations created since startup
+	active         int                 // Allocations currently open
+	peak           int                 // Most concurrent allocations this period
+	clientIPs      map[string]struct{} // Client IPs seen this period
+	reportedBytes  uint64              // bytes at the previous report
+	reportedAllocs uint64              // allocations at the previous report
+}
+
+// usageRow is one user's line in a usage report
+type usageRow struct {
+	PeriodStart     time.Time `json:"periodStart"`
+	PeriodEnd       time.Time `json:"periodEnd"`
+	Username        string    `json:"username"`
+	Allocations     uint64    `json:"allocations"`
+	BytesRelayed    uint64    `json:"bytesRelayed"`
+	PeakAllocations int       `json:"peakAllocations"`
+	ClientIPs       int       `json:"distinctClientIPs"`
+}
+
+// usageRegistry holds the accounting of every user
+type usageRegistry struct {
+	mu          sync.Mutex
+	users       map[string]*userUsage
+	periodStart time.Time
+
+	relaysMu sync.Mutex
+	relays   map[int]*usagePacketConn    // Open relay sockets by port
+	tuples   map[string]*usagePacketConn // Relays of open allocations by 5-tuple, see allocationKey
+
+	created atomic.Uint64 // Allocations created since startup
+	deleted atomic.Uint64 // Allocations deleted since startup
+	refused atomic.Uint64 // Allocations refused at -max-total-allocations since startup
+
+	// Refusals since the last saturation warning, and when it was logged;
+	// guarded by relaysMu
+	refusedSinceWarning   int
+	lastSaturationWarning time.Time
+}
+
+// relayUsage is the per-user relay accounting
+var relayUsage = &usageRegistry{
+	users:       make(map[string]*userUsage),
+	periodStart: time.Now(),
+	relays:      make(map[int]*usagePacketConn),
+	tuples:      make(map[string]*usagePacketConn),
+}
+
+// user returns the accounting of a user, creating it on first use
+func (r *usageRegistry) user(username string) *userUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[username]
+	if !ok {
+		u = &userUsage{username: username, clientIPs: make(map[string]struct{})}
+		r.users[username] = u
+	}
+	return u
+}
+
+// allocationKey identifies an allocation by its 5-tuple
+func allocationKey(srcAddr, dstAddr net.Addr, protocol string) string {
+	return protocol + " " + srcAddr.String() + " " + dstAddr.String()
+}
+
+// allocationEvents returns the callbacks the TURN servers report their
+// allocations to: the relay is attributed to its user when the allocation
+// is created, and released when it is deleted. Both are published on the
+// event bus.
+func allocationEvents() turn.EventHandler {
+	logger := NewSTUNTurnLogger(stunTurnLog)
+	return turn.EventHandler{
+		OnAllocationCreated: func(srcAddr, dstAddr net.Addr, protocol, username, realm string, relayAddr net.Addr, requestedPort int) {
+			relayUsage.created.Add(1)
+			clientClasses.observe(srcAddr, true)
+			logger.LogRelayAllocation(srcAddr, relayAddr, username)
+			eventBus.Publish(events.AllocationCreated{
+				Time:       time.Now(),
+				Username:   username,
+				Realm:      realm,
+				ClientAddr: srcAddr.String(),
+				RelayAddr:  relayAddr.String(),
+				Transport:  protocol,
+			})
+			port := 0
+			if udpAddr, ok := relayAddr.(*net.UDPAddr); ok {
+				port = udpAddr.Port
+			}
+			key := allocationKey(srcAddr, dstAddr, protocol)
+			relayUsage.relaysMu.Lock()
+			relay := relayUsage.relays[port]
+			if relay != nil {
+				relayUsage.tuples[key] = relay
+			}
+			relayUsage.relaysMu.Unlock()
+			if relay != nil {
+				relay.assign(relayUsage.user(username), srcAddr)
+			}
+		},
+		OnAllocationDeleted: func(srcAddr, dstAddr net.Addr, protocol, username, realm string) {
+			relayUsage.deleted.Add(1)
+			eventBus.Publish(events.AllocationDeleted{
+				Time:       time.Now(),
+				Username:   username,
+				Realm:      realm,
+				ClientAddr: srcAddr.String(),
+				Transport:  protocol,
+			})
+			key := allocationKey(srcAddr, dstAddr, protocol)
+			relayUsage.relaysMu.Lock()
+			relay := relayUsage.tuples[key]
+			delete(relayUsage.tuples, key)
+			relayUsage.relaysMu.Unlock()
+			if relay == nil {
+				logger.LogRelayRelease(srcAddr, nil, username, 0)
+				return
+			}
+			relay.release()
+			logger.LogRelayRelease(srcAddr, relay.relayAddr, username, time.Since(relay.created))
+		},
+	}
+}
+
+// report ends the current period and returns a row per user with any
+// activity in it, sorted by username
+func (r *usageRegistry) report() []usageRow {
+	r.mu.Lock()
+	start := r.periodStart
+	end := time.Now()
+	r.periodStart = end
+	users := make([]*userUsage, 0, len(r.users))
+	for _, u := range r.users {
+		users = append(users, u)
+	}
+	r.mu.Unlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].username < users[j].username })
+
+	var rows []usageRow
+	for _, u := range users {
+		u.mu.Lock()
+		bytesNow := u.bytes.Load()
+		row := usageRow{
+			PeriodStart:     start,
+			PeriodEnd:       end,
+			Username:        u.username,
+			Allocations:     u.allocations - u.reportedAllocs,
+			BytesRelayed:    bytesNow - u.reportedBytes,
+			PeakAllocations: u.peak,
+			ClientIPs:       len(u.clientIPs),
+		}
+		u.reportedAllocs = u.allocations
+		u.reportedBytes = bytesNow
+		u.peak = u.active
+		u.clientIPs = make(map[string]struct{})
+		u.mu.Unlock()
+		if row.Allocations > 0 || row.BytesRelayed > 0 || row.PeakAllocations > 0 {
+			rows = append(rows, row)
+		}
+	}
+
+	// Allocations that outlive the period count their client IPs in the next one too
+	r.relaysMu.Lock()
+	open := make([]*usagePacketConn, 0, len(r.relays))
+	for _, relay := range r.relays {
+		open = append(open, relay)
+	}
+	r.relaysMu.Unlock()
+	for _, relay := range open {
+		if u := relay.user.Load(); u != nil {
+			u.mu.Lock()
+			if relay.clientIP != "" { // Empty while assign is still running
+				u.clientIPs[relay.clientIP] = struct{}{}
+			}
+			u.mu.Unlock()
+		}
+	}
+	return rows
+}
+
+// ============================================================================
+// ALLOCATION ADMISSION CONTROL
+// ============================================================================
+
+// With -max-total-allocations, at most that many relay sockets are open at
+// once, across all users. The check and the registration of a new socket
+// happen under relaysMu, so concurrent Allocate requests can't overshoot the
+// ceiling. A refused allocation makes the TURN server answer 508
+// (Insufficient Capacity); bindings and refreshes of existing allocations
+// are served as usual. While saturated, one warning a minute says how many
+// allocations were refused, and /readyz answers 503 "degraded" so load
+// balancers send new clients elsewhere.
+
+// maxTotalAllocations is the ceiling on open allocations, 0 for none; set
+// once at startup from -max-total-allocations
+var maxTotalAllocations int
+
+// saturationWarningInterval is how often a saturated server logs its warning
+const saturationWarningInterval = time.Minute
+
+var errAllocationCapacity = errors.New("allocation capacity reached")
+
+// saturated reports whether the server is at its allocation ceiling
+func (r *usageRegistry) saturated() bool {
+	if maxTotalAllocations <= 0 {
+		return false
+	}
+	r.relaysMu.Lock()
+	defer r.relaysMu.Unlock()
+	return len(r.relays) >= maxTotalAllocations
+}
+
+// refuseLocked counts an allocation refused at the ceiling and logs the
+// saturation warning if it is due. The caller must hold relaysMu.
+func (r *usageRegistry) refuseLocked() {
+	r.refused.Add(1)
+	r.refusedSinceWarning++
+	if now := time.Now(); now.Sub(r.lastSaturationWarning) >= saturationWarningInterval {
+		stunTurnLog.Warn.Printf("WARNING: %d allocations open, the -max-total-allocations limit; refused %d new allocations since the last warning", len(r.relays), r.refusedSinceWarning)
+		r.lastSaturationWarning = now
+		r.refusedSinceWarning = 0
+	}
+}
+
+// usageRelayGenerator hands out relay sockets that count their bytes for
+// the user their allocation belongs to, up to -max-total-allocations
+type usageRelayGenerator struct {
+	turn.RelayAddressGenerator
+}
+
+func (g *usageRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	// Held while the socket is opened so the ceiling can't be overshot
+	relayUsage.relaysMu.Lock()
+	defer relayUsage.relaysMu.Unlock()
+	if maxTotalAllocations > 0 && len(relayUsage.relays) >= maxTotalAllocations {
+		relayUsage.refuseLocked()
+		return nil, nil, errAllocationCapacity
+	}
+	conn, relayAddr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return conn, relayAddr, err
+	}
+	port := 0
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		port = udpAddr.Port
+	}
+	relay := &usagePacketConn{PacketConn: conn, port: port, relayAddr: relayAddr, created: time.Now()}
+	relayUsage.relays[port] = relay
+	return relay, relayAddr, nil
+}
+
+// usagePacketConn is a relay socket that counts the bytes it carries
+type usagePacketConn struct {
+	net.PacketConn
+	port      int
+	relayAddr net.Addr                  // Relayed transport address given to the client
+	created   time.Time                 // When the allocation was created
+	bytes     atomic.Uint64             // Bytes relayed by this allocation, both directions
+	user      atomic.Pointer[userUsage] // Set once the allocation is created, see allocationEvents
+
+	// Client the allocation belongs to, set with user under the user's lock
+	clientIP   string
+	clientAddr string
+	transport  string
+
+	closeOnce   sync.Once
+	releaseOnce sync.Once
+}
+
+// assign attributes the relay to a user's new allocation from srcAddr
+func (c *usagePacketConn) assign(u *userUsage, srcAddr net.Addr) {
+	if !c.user.CompareAndSwap(nil, u) {
+		return
+	}
+	clientIP, transport := authSource(srcAddr)
+	u.mu.Lock()
+	c.clientIP = clientIP
+	c.clientAddr = srcAddr.String()
+	c.transport = transport
+	u.allocations++
+	u.active++
+	if u.active > u.peak {
+		u.peak = u.active
+	}
+	u.clientIPs[clientIP] = struct{}{}
+	u.mu.Unlock()
+}
+
+// release ends the relay's allocation in its user's accounting
+func (c *usagePacketConn) release() {
+	c.releaseOnce.Do(func() {
+		if u := c.user.Load(); u != nil {
+			u.mu.Lock()
+			u.active--
+			u.mu.Unlock()
+		}
+	})
+}
+
+func (c *usagePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if n > 0 {
+		c.bytes.Add(uint64(n))
+		if u := c.user.Load(); u != nil {
+			u.bytes.Add(uint64(n))
+		}
+	}
+	return n, addr, err
+}
+
+func (c *usagePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if n > 0 {
+		c.bytes.Add(uint64(n))
+		if u := c.user.Load(); u != nil {
+			u.bytes.Add(uint64(n))
+		}
+	}
+	return n, err
+}
+
+// Close closes the relay when its allocation ends. The allocation is
+// released in the accounting by its deleted event, which follows.
+func (c *usagePacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		relayUsage.relaysMu.Lock()
+		if relayUsage.relays[c.port] == c {
+			delete(relayUsage.relays, c.port)
+		}
+		relayUsage.relaysMu.Unlock()
+	})
+	return c.PacketConn.Close()
+}
+
+// ============================================================================
+// CLIENT CLASSIFICATION
+// ============================================================================
+
+// Every client IP that sends a binding request or creates an allocation is
+// classified for the day: "turn" once it has created an allocation, and
+// "stun-only" if all it did that day was binding requests, e.g. browsers
+// that only use the server to discover their public address. The day
+// starts at -usage-report-time (00:00 by default, server local time).
+//
+// The IPs of the day are kept in a set of at most maxClassifiedClients,
+// emptied when the day ends, so memory stays bounded however many clients
+// come by. Binding requests and allocations from new IPs once the set is
+// full aren't classified and are counted as untracked instead.
+
+// maxClassifiedClients bounds the client IPs classified per day
+const maxClassifiedClients = 100000
+
+// maxClientDays bounds the finished days kept until a usage report writes
+// them out
+const maxClientDays = 7
+
+// clientDay is a day's count of classified clients, a line in the usage
+// reports
+type clientDay struct {
+	PeriodStart   time.Time `json:"periodStart"`
+	PeriodEnd     time.Time `json:"periodEnd"`
+	STUNOnly      int       `json:"stunOnlyClients"`
+	TURN          int       `json:"turnClients"`
+	Untracked     uint64    `json:"untrackedRequests"`
+	STUNOnlyRatio float64   `json:"stunOnlyRatio"` // STUN-only share of the classified clients
+}
+
+// clientClassifier classifies the client IPs of the current day
+type clientClassifier struct {
+	mu        sync.Mutex
+	start     time.Time
+	end       time.Time           // When the day ends and the set is emptied
+	clients   map[netip.Addr]bool // true once the IP has allocated
+	stunOnly  int
+	turn      int
+	untracked uint64
+	finished  []clientDay // Days ended since the last usage report
+}
+
+// clientClasses is the classification of today's clients
+var clientClasses = newClientClassifier(time.Now())
+
+// clientDayAt is the time of day the classification day starts, set once
+// at startup by startUsageReports
+var clientDayAt time.Duration
+
+// reportDayStart returns when the day that contains now started, days
+// starting at clientDayAt
+func reportDayStart(now time.Time) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	start := midnight.Add(clientDayAt)
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+func newClientClassifier(now time.Time) *clientClassifier {
+	c := &clientClassifier{clients: make(map[netip.Addr]bool)}
+	c.startDayLocked(now)
+	return c
+}
+
+// startDayLocked empties the set for the day that contains now. The caller
+// must hold mu.
+func (c *clientClassifier) startDayLocked(now time.Time) {
+	c.start = reportDayStart(now)
+	c.end = c.start.AddDate(0, 0, 1)
+	c.clients = make(map[netip.Addr]bool)
+	c.stunOnly, c.turn, c.untracked = 0, 0, 0
+}
+
+// rolloverLocked ends the day if it is over, keeping its counts for the
+// next usage report. The caller must hold mu.
+func (c *clientClassifier) rolloverLocked(now time.Time) {
+	if now.Before(c.end) {
+		return
+	}
+	day := c.countsLocked()
+	day.PeriodEnd = c.end
+	if len(c.finished) == maxClientDays {
+		c.finished = c.finished[1:]
+	}
+	c.finished = append(c.finished, day)
+	c.startDayLocked(now)
+}
+
+// countsLocked returns the counts of the day so far. The caller must hold mu.
+func (c *clientClassifier) countsLocked() clientDay {
+	day := clientDay{PeriodStart: c.start, STUNOnly: c.stunOnly, TURN: c.turn, Untracked: c.untracked}
+	if total := c.stunOnly + c.turn; total > 0 {
+		day.STUNOnlyRatio = float64(c.stunOnly) / float64(total)
+	}
+	return day
+}
+
+// observe classifies the client IP of addr after a binding request, or
+// after an allocation if allocated is set
+func (c *clientClassifier) observe(addr net.Addr, allocated bool) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	wasTURN, seen := c.clients[ip]
+	switch {
+	case !seen && len(c.clients) >= maxClassifiedClients:
+		c.untracked++
+	case !seen:
+		c.clients[ip] = allocated
+		if allocated {
+			c.turn++
+		} else {
+			c.stunOnly++
+		}
+	case allocated && !wasTURN:
+		c.clients[ip] = true
+		c.stunOnly--
+		c.turn++
+	}
+}
+
+// observeBinding classifies the sender of a STUN message if it is a
+// binding request
+func (c *clientClassifier) observeBinding(data []byte, addr net.Addr) {
+	if len(data) >= 2 && binary.BigEndian.Uint16(data) == 0x0001 {
+		c.observe(addr, false)
+	}
+}
+
+// today returns the counts of the current day
+func (c *clientClassifier) today() clientDay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	return c.countsLocked()
+}
+
+// takeFinished returns the days that ended since it was last called
+func (c *clientClassifier) takeFinished() []clientDay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	days := c.finished
+	c.finished = nil
+	return days
+}
+
+// ============================================================================
+// CLIENT TRANSPORTS
+// ============================================================================
+
+// Every client IP that sends a STUN/TURN request is counted once an hour
+// for each transport it used: "UDP", "TCP", "TLS" or "DTLS" on the main
+// ports, and the protocol with the port, e.g. "UDP:53", on the ports of
+// -extra-udp-ports and -extra-tcp-ports. The shares show which listeners
+// the clients actually need, to tune which ports to open.
+//
+// As for the client classification, the pairs of IP and transport of the
+// hour are kept in a set of at most maxTransportClients, emptied when the
+// hour ends; requests of new pairs once it is full are counted as
+// untracked. Finished hours are kept until a usage report writes them out.
+
+// maxTransportClients bounds the pairs of client IP and transport counted
+// per hour
+const maxTransportClients = 100000
+
+// maxTransportHours bounds the finished hours kept until a usage report
+// writes them out
+const maxTransportHours = 7 * 24
+
+// transportClient is a client IP seen on a transport
+type transportClient struct {
+	ip        netip.Addr
+	transport string
+}
+
+// transportHour is an hour's count of clients per transport, a line in
+// the usage reports
+type transportHour struct {
+	PeriodStart time.Time      `json:"periodStart"`
+	PeriodEnd   time.Time      `json:"periodEnd"`
+	Clients     map[string]int `json:"clients"` // Distinct client IPs by transport
+	Untracked   uint64         `json:"untrackedRequests"`
+}
+
+// transports returns the hour's transports, most clients first
+func (h transportHour) transports() []string {
+	names := make([]string, 0, len(h.Clients))
+	for name := range h.Clients {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if h.Clients[names[i]] != h.Clients[names[j]] {
+			return h.Clients[names[i]] > h.Clients[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// share returns a transport's share of the hour's clients, a client on
+// two transports counting for both
+func (h transportHour) share(transport string) float64 {
+	total := 0
+	for _, n := range h.Clients {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(h.Clients[transport]) / float64(total)
+}
+
+// shares formats the transports' shares for the server statistics, e.g.
+// "UDP: 84.0%, TCP: 12.0%, TLS: 4.0%"
+func (h transportHour) shares() string {
+	parts := []string{}
+	for _, name := range h.transports() {
+		parts = append(parts, fmt.Sprintf("%s: %.1f%%", name, h.share(name)*100))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// transportCounter counts the clients of the current hour per transport
+type transportCounter struct {
+	mu        sync.Mutex
+	start     time.Time
+	clients   map[transportClient]struct{}
+	counts    map[string]int
+	untracked uint64
+	finished  []transportHour // Hours ended since the last usage report
+}
+
+// clientTransports counts the transports of this hour's clients
+var clientTransports = newTransportCounter(time.Now())
+
+func newTransportCounter(now time.Time) *transportCounter {
+	c := &transportCounter{}
+	c.startHourLocked(now)
+	return c
+}
+
+// startHourLocked empties the set for the hour that contains now, in
+// server local time. The caller must hold mu.
+func (c *transportCounter) startHourLocked(now time.Time) {
+	c.start = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	c.clients = make(map[transportClient]struct{})
+	c.counts = make(map[string]int)
+	c.untracked = 0
+}
+
+// rolloverLocked ends the hour if it is over, keeping its counts for the
+// next usage report unless nobody came. The caller must hold mu.
+func (c *transportCounter) rolloverLocked(now time.Time) {
+	if now.Before(c.start.Add(time.Hour)) {
+		return
+	}
+	if hour := c.countsLocked(); len(hour.Clients) > 0 || hour.Untracked > 0 {
+		if len(c.finished) == maxTransportHours {
+			c.finished = c.finished[1:]
+		}
+		c.finished = append(c.finished, hour)
+	}
+	c.startHourLocked(now)
+}
+
+// countsLocked returns the counts of the hour so far. The caller must hold
+// mu.
+func (c *transportCounter) countsLocked() transportHour {
+	hour := transportHour{
+		PeriodStart: c.start,
+		PeriodEnd:   c.start.Add(time.Hour),
+		Clients:     make(map[string]int, len(c.counts)),
+		Untracked:   c.untracked,
+	}
+	for name, n := range c.counts {
+		hour.Clients[name] = n
+	}
+	return hour
+}
+
+// observe counts the client IP of addr for a transport
+func (c *transportCounter) observe(addr net.Addr, transport string) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return
+	}
+	key := transportClient{ip: ip, transport: transport}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	if _, seen := c.clients[key]; seen {
+		return
+	}
+	if len(c.clients) >= maxTransportClients {
+		c.untracked++
+		return
+	}
+	c.clients[key] = struct{}{}
+	c.counts[transport]++
+}
+
+// thisHour returns the counts of the current hour
+func (c *transportCounter) thisHour() transportHour {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	return c.countsLocked()
+}
+
+// takeFinished returns the hours that ended since it was last called
+func (c *transportCounter) takeFinished() []transportHour {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	hours := c.finished
+	c.finished = nil
+	return hours
+}
+
+// transportLabel names the transport of a STUN/TURN listener: its protocol
+// on the main port of that protocol, or else the protocol and the port
+func transportLabel(protocol string, addr net.Addr) string {
+	port := 0
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		port = addr.Port
+	case *net.TCPAddr:
+		port = addr.Port
+	}
+	mainPort := stunturnPort
+	if protocol == "TLS" || protocol == "DTLS" {
+		mainPort = stunturnTLSPort
+	}
+	if port == 0 || port == mainPort {
+		return protocol
+	}
+	return protocol + ":" + strconv.Itoa(port)
+}
+
+// ============================================================================
+// CALL OUTCOMES
+// ============================================================================
+
+// Every call that ends is counted for the day by its outcome (see
+// webrtc/calloutcomes.go): completed, cancelled, declined, timeout,
+// peer-disconnected or transferred, with how many of the day's calls were
+// answered and how many likely used the TURN relay. The success ratio is
+// the completed share of the calls, not counting transferred ones, whose
+// new call is counted on its own. As for the client classification, the
+// day starts at -usage-report-time.
+//
+// The counts of today are on the metrics endpoint and in the periodic
+// stats, next to totals since the start; the counts of every day that
+// ended go into the daily report.
+
+// callOutcomeNames are the outcomes counted, in report order
+var callOutcomeNames = []string{webrtc.CallCompleted, webrtc.CallCancelled, webrtc.CallDeclined, webrtc.CallTimeout, webrtc.CallPeerDisconnected, webrtc.CallTransferred}
+
+// callDay is a day's count of ended calls, a line in the daily report
+type callDay struct {
+	PeriodStart  time.Time      `json:"periodStart"`
+	PeriodEnd    time.Time      `json:"periodEnd"`
+	Calls        int            `json:"calls"`
+	Answered     int            `json:"answered"`
+	Relayed      int            `json:"relayed"`  // A relay candidate was forwarded
+	Outcomes     map[string]int `json:"outcomes"` // Calls by outcome
+	SuccessRatio float64        `json:"successRatio"`
+}
+
+// callOutcomeKey is a metrics series of ended calls
+type callOutcomeKey struct {
+	outcome string
+	relayed bool
+}
+
+// callOutcomeCounter counts the ended calls of the current day
+type callOutcomeCounter struct {
+	mu       sync.Mutex
+	start    time.Time
+	end      time.Time
+	day      callDay
+	totals   map[callOutcomeKey]uint64 // Since the start, for the metrics
+	finished []callDay                 // Days ended since the last usage report
+}
+
+// callOutcomes counts today's ended calls, see webrtc.ConfigureCallOutcomes
+var callOutcomes = newCallOutcomeCounter(time.Now())
+
+func newCallOutcomeCounter(now time.Time) *callOutcomeCounter {
+	c := &callOutcomeCounter{totals: make(map[callOutcomeKey]uint64)}
+	c.startDayLocked(now)
+	return c
+}
+
+// startDayLocked starts counting the day that contains now. The caller
+// must hold mu.
+func (c *callOutcomeCounter) startDayLocked(now time.Time) {
+	c.start = reportDayStart(now)
+	c.end = c.start.AddDate(0, 0, 1)
+	c.day = callDay{PeriodStart: c.start, Outcomes: make(map[string]int)}
+}
+
+// rolloverLocked ends the day if it is over, keeping its counts for the
+// next usage report. The caller must hold mu.
+func (c *callOutcomeCounter) rolloverLocked(now time.Time) {
+	if now.Before(c.end) {
+		return
+	}
+	day := c.countsLocked()
+	day.PeriodEnd = c.end
+	if len(c.finished) == maxClientDays {
+		c.finished = c.finished[1:]
+	}
+	c.finished = append(c.finished, day)
+	c.startDayLocked(now)
+}
+
+// countsLocked returns the counts of the day so far. The caller must hold mu.
+func (c *callOutcomeCounter) countsLocked() callDay {
+	day := c.day
+	day.Outcomes = make(map[string]int, len(c.day.Outcomes))
+	for outcome, count := range c.day.Outcomes {
+		day.Outcomes[outcome] = count
+	}
+	if counted := day.Calls - day.Outcomes[webrtc.CallTransferred]; counted > 0 {
+		day.SuccessRatio = float64(day.Outcomes[webrtc.CallCompleted]) / float64(counted)
+	}
+	return day
+}
+
+// observe counts an ended call, see webrtc.CallOutcomeFunc
+func (c *callOutcomeCounter) observe(outcome string, answered, relayed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	c.day.Calls++
+	c.day.Outcomes[outcome]++
+	if answered {
+		c.day.Answered++
+	}
+	if relayed {
+		c.day.Relayed++
+	}
+	c.totals[callOutcomeKey{outcome, relayed}]++
+}
+
+// today returns the counts of the current day
+func (c *callOutcomeCounter) today() callDay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	return c.countsLocked()
+}
+
+// total returns the calls that ended with an outcome since the start,
+// relayed or not
+func (c *callOutcomeCounter) total(outcome string, relayed bool) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totals[callOutcomeKey{outcome, relayed}]
+}
+
+// takeFinished returns the days that ended since it was last called
+func (c *callOutcomeCounter) takeFinished() []callDay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolloverLocked(time.Now())
+	days := c.finished
+	c.finished = nil
+	return days
+}
+
+// logCallOutcomes logs today's call outcomes with the periodic stats
+func logCallOutcomes() {
+	day := callOutcomes.today()
+	if day.Calls == 0 {
+		return
+	}
+	counts := make([]string, 0, len(callOutcomeNames))
+	for _, outcome := range callOutcomeNames {
+		counts = append(counts, fmt.Sprintf("%s=%d", outcome, day.Outcomes[outcome]))
+	}
+	stunTurnLogger.Printf("Calls today: %d (%d answered, %d relayed, %.1f%% successful): %s",
+		day.Calls, day.Answered, day.Relayed, day.SuccessRatio*100, strings.Join(counts, ", "))
+}
+
+// ============================================================================
+// RELAY USAGE REPORTS
+// ============================================================================
+
+// With -usage-report-dir set, a report of the relay usage accounting is
+// appended every day at -usage-report-time (server local time) to
+// usage-YYYY-MM-DD.csv and/or .json in that directory, named after the day
+// the period started. Each report covers the time since the previous one,
+// so reports triggered on demand (POST /admin/usage-report) and the daily
+// ones add up without overlapping.
+//
+// CSV columns: period_start, period_end, username, allocations,
+// bytes_relayed, peak_allocations, distinct_client_ips.
+// The JSON file has one usageRow object per line.
+//
+// The client classification of every day that ended since the previous
+// report is appended to clients-YYYY-MM-DD.csv and/or .json, named after
+// the day, with the columns period_start, period_end, stun_only_clients,
+// turn_clients, untracked_requests, stun_only_ratio.
+//
+// The call outcomes of every day that ended since the previous report are
+// appended to calls-YYYY-MM-DD.csv and/or .json, named after the day, with
+// the columns period_start, period_end, calls, answered, relayed, one
+// column per outcome (see CALL OUTCOMES) and success_ratio. The JSON file
+// has one callDay object per line.
+//
+// The client transports of every hour that ended since the previous report
+// are appended to transports-YYYY-MM-DD.csv and/or .json, named after the
+// day of the hour, with one row per transport and the columns
+// period_start, period_end, transport, clients, share. The JSON file has
+// one transportHour object per line.
+
+var (
+	usageReportDir     string   // Directory for the reports, "" disables them
+	usageReportFormats []string // "csv" and/or "json"
+	usageReportMu      sync.Mutex
+)
+
+// usageCSVHeader is the first line of every CSV report
+var usageCSVHeader = []string{"period_start", "period_end", "username", "allocations", "bytes_relayed", "peak_allocations", "distinct_client_ips"}
+
+// clientsCSVHeader is the first line of every CSV client classification
+// report
+var clientsCSVHeader = []string{"period_start", "period_end", "stun_only_clients", "turn_clients", "untracked_requests", "stun_only_ratio"}
+
+// callsCSVHeader is the first line of every CSV call outcomes report
+var callsCSVHeader = []string{"period_start", "period_end", "calls", "answered", "relayed", "completed", "cancelled", "declined", "timeout", "peer_disconnected", "transferred", "success_ratio"}
+
+// transportsCSVHeader is the first line of every CSV client transports
+// report
+var transportsCSVHeader = []string{"period_start", "period_end", "transport", "clients", "share"}
+
+// startUsageReports writes a report every day at reportTime ("HH:MM")
+func startUsageReports(reportTime string) error {
+	at, err := time.Parse("15:04", reportTime)
+	if err != nil {
+		return fmt.Errorf("invalid report time %q, want HH:MM", reportTime)
+	}
+	// Client classification and call outcome days end with the daily report
+	clientDayAt = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	clientClasses.mu.Lock()
+	clientClasses.startDayLocked(time.Now())
+	clientClasses.mu.Unlock()
+	callOutcomes.mu.Lock()
+	callOutcomes.startDayLocked(time.Now())
+	callOutcomes.mu.Unlock()
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(time.Until(next))
+			if _, err := writeUsageReport(); err != nil {
+				stunTurnLog.Warn.Printf("Error writing usage report: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// writeUsageReport ends the current accounting period and appends its rows
+// to the report files
+func writeUsageReport() ([]usageRow, error) {
+	usageReportMu.Lock()
+	defer usageReportMu.Unlock()
+
+	rows := relayUsage.report()
+	if usageReportDir == "" {
+		return rows, nil
+	}
+	if err := writeClientsReport(clientClasses.takeFinished()); err != nil {
+		return rows, err
+	}
+	if err := writeCallsReport(callOutcomes.takeFinished()); err != nil {
+		return rows, err
+	}
+	if err := writeTransportsReport(clientTransports.takeFinished()); err != nil {
+		return rows, err
+	}
+	if len(rows) == 0 {
+		return rows, nil
+	}
+	day := rows[0].PeriodStart.Format("2006-01-02")
+	for _, format := range usageReportFormats {
+		path := filepath.Join(usageReportDir, "usage-"+day+"."+format)
+		var err error
+		if format == "csv" {
+			err = appendUsageCSV(path, rows)
+		} else {
+			err = appendUsageJSON(path, rows)
+		}
+		if err != nil {
+			return rows, err
+		}
+		stunTurnLogger.Printf("Usage report for %d users appended to %s", len(rows), path)
+	}
+	return rows, nil
+}
+
+// appendUsageCSV appends rows to a CSV report, with a header if it's new
+func appendUsageCSV(path string, rows []usageRow) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	if info.Size() == 0 {
+		w.Write(usageCSVHeader)
+	}
+	for _, row := range rows {
+		w.Write([]string{
+			row.PeriodStart.Format(time.RFC3339),
+			row.PeriodEnd.Format(time.RFC3339),
+			row.Username,
+			strconv.FormatUint(row.Allocations, 10),
+			strconv.FormatUint(row.BytesRelayed, 10),
+			strconv.Itoa(row.PeakAllocations),
+			strconv.Itoa(row.ClientIPs),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// appendUsageJSON appends rows to a JSON report, one object per line
+func appendUsageJSON(path string, rows []usageRow) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeClientsReport appends the client classification of finished days to
+// their report files
+func writeClientsReport(days []clientDay) error {
+	for _, day := range days {
+		for _, format := range usageReportFormats {
+			path := filepath.Join(usageReportDir, "clients-"+day.PeriodStart.Format("2006-01-02")+"."+format)
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			if format == "csv" {
+				info, statErr := file.Stat()
+				w := csv.NewWriter(file)
+				if statErr == nil && info.Size() == 0 {
+					w.Write(clientsCSVHeader)
+				}
+				w.Write([]string{
+					day.PeriodStart.Format(time.RFC3339),
+					day.PeriodEnd.Format(time.RFC3339),
+					strconv.Itoa(day.STUNOnly),
+					strconv.Itoa(day.TURN),
+					strconv.FormatUint(day.Untracked, 10),
+					strconv.FormatFloat(day.STUNOnlyRatio, 'f', 4, 64),
+				})
+				w.Flush()
+				err = w.Error()
+			} else {
+				err = json.NewEncoder(file).Encode(day)
+			}
+			file.Close()
+			if err != nil {
+				return err
+			}
+			stunTurnLogger.Printf("Client classification for %s appended to %s", day.PeriodStart.Format("2006-01-02"), path)
+		}
+	}
+	return nil
+}
+
+// writeCallsReport appends the call outcomes of finished days to their
+// report files
+func writeCallsReport(days []callDay) error {
+	for _, day := range days {
+		for _, format := range usageReportFormats {
+			path := filepath.Join(usageReportDir, "calls-"+day.PeriodStart.Format("2006-01-02")+"."+format)
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			if format == "csv" {
+				info, statErr := file.Stat()
+				w := csv.NewWriter(file)
+				if statErr == nil && info.Size() == 0 {
+					w.Write(callsCSVHeader)
+				}
+				record := []string{
+					day.PeriodStart.Format(time.RFC3339),
+					day.PeriodEnd.Format(time.RFC3339),
+					strconv.Itoa(day.Calls),
+					strconv.Itoa(day.Answered),
+					strconv.Itoa(day.Relayed),
+				}
+				for _, outcome := range callOutcomeNames {
+					record = append(record, strconv.Itoa(day.Outcomes[outcome]))
+				}
+				w.Write(append(record, strconv.FormatFloat(day.SuccessRatio, 'f', 4, 64)))
+				w.Flush()
+				err = w.Error()
+			} else {
+				err = json.NewEncoder(file).Encode(day)
+			}
+			file.Close()
+			if err != nil {
+				return err
+			}
+			stunTurnLogger.Printf("Call outcomes for %s appended to %s", day.PeriodStart.Format("2006-01-02"), path)
+		}
+	}
+	return nil
+}
+
+// writeTransportsReport appends the client transports of finished hours
+// to the transports reports of their days
+func writeTransportsReport(hours []transportHour) error {
+	for _, hour := range hours {
+		for _, format := range usageReportFormats {
+			path := filepath.Join(usageReportDir, "transports-"+hour.PeriodStart.Format("2006-01-02")+"."+format)
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			if format == "csv" {
+				info, statErr := file.Stat()
+				w := csv.NewWriter(file)
+				if statErr == nil && info.Size() == 0 {
+					w.Write(transportsCSVHeader)
+				}
+				for _, transport := range hour.transports() {
+					w.Write([]string{
+						hour.PeriodStart.Format(time.RFC3339),
+						hour.PeriodEnd.Format(time.RFC3339),
+						transport,
+						strconv.Itoa(hour.Clients[transport]),
+						strconv.FormatFloat(hour.share(transport), 'f', 4, 64),
+					})
+				}
+				w.Flush()
+				err = w.Error()
+			} else {
+				err = json.NewEncoder(file).Encode(hour)
+			}
+			file.Close()
+			if err != nil {
+				return err
+			}
+			stunTurnLogger.Printf("Client transports for %s appended to %s", hour.PeriodStart.Format("2006-01-02 15:04"), path)
+		}
+	}
+	return nil
+}
+
+// handleUsageReport serves POST /admin/usage-report, writing a report of
+// the usage since the previous one right away and returning its rows
+func handleUsageReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rows, err := writeUsageReport()
+	auditLog.admin("usage_report", r.RemoteAddr, map[string]string{"users": strconv.Itoa(len(rows))})
+	if err != nil {
+		stunTurnLog.Warn.Printf("Error writing usage report: %v", err)
+		http.Error(w, "failed to write report", http.StatusInternalServerError)
+		return
+	}
+	if rows == nil {
+		rows = []usageRow{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+// ============================================================================
+// ADMIN AUTHENTICATION
+// ============================================================================
+
+// adminToken is the token the /admin/ endpoints require, set once at
+// startup from -admin-token or, without it, by generateAdminToken
+var adminToken string
+
+// generateAdminToken makes up a random admin token for a server started
+// without -admin-token
+func generateAdminToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// requireAdmin wraps an admin handler so it only runs for requests that
+// carry the admin token, either as "Authorization: Bearer <token>" or as
+// ?token= for clients that can't set headers (browser WebSockets). Failed
+// attempts are answered with 401 and recorded in the audit log.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = bearer
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			auditLog.admin("auth_failure", r.RemoteAddr, map[string]string{"path": r.URL.Path})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ============================================================================
+// LOG LIVE TAIL
+// ============================================================================
+//
+// GET /admin/logs/stream?source=stunturn|signaling upgrades to a WebSocket
+// and sends every new line of that log stream as one text message, so the
+// logs can be followed from any machine instead of in terminal windows on
+// the server.
+//
+// HOW IT WORKS:
+// =============
+// Each logger writes through a logBroadcaster (see setupLogging) that hands
+// every line to the subscribed streams. With nobody subscribed it returns
+// right away, so the tee costs the logging path nothing.
+//
+// FILTERING:
+// ==========
+// ?filter=<regexp> only sends matching lines, e.g. filter=alice|ERROR.
+// Lines are matched in the stream's goroutine, not in the logger.
+//
+// SLOW CONSUMERS:
+// ===============
+// Logging never waits for a stream. A stream buffers logTailBuffer lines;
+// lines that don't fit are dropped, and the stream sends
+// "[gap: N lines dropped]" where they would have been.
+
+// logTailBuffer is how many lines a live tail stream buffers
+const logTailBuffer = 256
+
+// logTailPingInterval is how often an idle live tail stream is pinged, so
+// dead clients are noticed while the log is quiet
+const logTailPingInterval = 30 * time.Second
+
+// The live tail sources; without -separate-logs both carry the combined log
+var (
+	stunturnLogTail  = &logBroadcaster{}
+	signalingLogTail = &logBroadcaster{}
+)
+
+// logBroadcaster is an io.Writer that copies each log line to its
+// subscribers without ever blocking
+type logBroadcaster struct {
+	count       atomic.Int32 // Number of subscribers, checked before taking mu
+	mu          sync.Mutex
+	subscribers map[*logSubscriber]struct{}
+}
+
+// logTailLine is one buffered line and the number of lines dropped just
+// before it
+type logTailLine struct {
+	text string
+	gap  uint64
+}
+
+// logSubscriber is one live tail stream's buffer
+type logSubscriber struct {
+	lines   chan logTailLine
+	dropped uint64 // Lines dropped since the last buffered one, guarded by the broadcaster's mu
+}
+
+// Write copies one log line to every subscriber that has room for it
+func (b *logBroadcaster) Write(p []byte) (int, error) {
+	if b.count.Load() == 0 {
+		return len(p), nil
+	}
+	line := logTailLine{text: strings.TrimSuffix(string(p), "\n")}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		line.gap = sub.dropped
+		select {
+		case sub.lines <- line:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe adds a live tail stream
+func (b *logBroadcaster) subscribe() *logSubscriber {
+	sub := &logSubscriber{lines: make(chan logTailLine, logTailBuffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[*logSubscriber]struct{})
+	}
+	b.subscribers[sub] = struct{}{}
+	b.count.Add(1)
+	return sub
+}
+
+// unsubscribe removes a live tail stream
+func (b *logBroadcaster) unsubscribe(sub *logSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, sub)
+	b.count.Add(-1)
+}
+
+// logTailUpgrader upgrades live tail requests; the default origin check
+// allows tools that send no Origin and pages served by this endpoint
+var logTailUpgrader = websocket.Upgrader{}
+
+// handleLogStream serves GET /admin/logs/stream
+func handleLogStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	source := query.Get("source")
+	var tail *logBroadcaster
+	switch source {
+	case "stunturn":
+		tail = stunturnLogTail
+	case "signaling":
+		tail = signalingLogTail
+	default:
+		http.Error(w, "source must be stunturn or signaling", http.StatusBadRequest)
+		return
+	}
+	var filter *regexp.Regexp
+	if pattern := query.Get("filter"); pattern != "" {
+		var err error
+		if filter, err = regexp.Compile(pattern); err != nil {
+			http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := logTailUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // The upgrader has already answered
+	}
+	defer conn.Close()
+	auditLog.admin("logs_stream", r.RemoteAddr, map[string]string{"source": source, "filter": query.Get("filter")})
+	stunTurnLogger.Printf("Live log tail of %s opened by %s", source, r.RemoteAddr)
+
+	sub := tail.subscribe()
+	defer tail.unsubscribe(sub)
+
+	// The client never sends anything; reading is how a close is noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(logTailPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case line := <-sub.lines:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if line.gap > 0 {
+				if err := conn.WriteMessage(websocket.TextMessage, fmt.Appendf(nil, "[gap: %d lines dropped]", line.gap)); err != nil {
+					return
+				}
+			}
+			if filter != nil && !filter.MatchString(line.text) {
+				continue
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line.text)); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// ============================================================================
+// LOG DEBUG BUFFER
+// ============================================================================
+//
+// GET /admin/logs/debug?source=stunturn|signaling answers with the lines of
+// that log stream kept in memory, oldest first, as plain text. The buffer
+// takes every level (see LOG LEVELS), so it holds the packet traces that
+// the files leave out at the default level, for the last
+// -log-debug-buffer lines, e.g. the last few minutes of a busy relay.
+//
+// ?since=<t> only returns the lines logged at or after t, an RFC 3339 time
+// or a duration like 5m, and ?filter=<regexp> only the matching lines, as
+// on the live tail. Without -separate-logs both sources return the
+// combined log.
+//
+// Logging into the buffer is a copy of the line under a mutex; the oldest
+// line is overwritten once the buffer is full.
+
+// DefaultLogDebugBuffer is how many lines of each stream the debug buffer
+// keeps by default
+const DefaultLogDebugBuffer = 50000
+
+var (
+	logDebugBufferLines int // Lines per debug buffer, set once at startup from -log-debug-buffer
+
+	// The debug buffers of the streams, nil with -log-debug-buffer=0
+	stunturnDebugBuffer  *logRing
+	signalingDebugBuffer *logRing
+)
+
+// logRingLine is one line of a debug buffer and when it was logged
+type logRingLine struct {
+	at   time.Time
+	text string
+}
+
+// logRing is an io.Writer that keeps the last lines written to it
+type logRing struct {
+	mu    sync.Mutex
+	lines []logRingLine
+	next  int  // Where the next line goes
+	full  bool // Whether lines have wrapped around
+}
+
+// newLogRing creates a debug buffer of size lines, or returns nil if size
+// is 0
+func newLogRing(size int) *logRing {
+	if size <= 0 {
+		return nil
+	}
+	return &logRing{lines: make([]logRingLine, size)}
+}
+
+// withDebugBuffer adds a stream's debug buffer, if it has one, to its sinks
+func withDebugBuffer(sinks []logSink, buffer *logRing) []logSink {
+	if buffer == nil {
+		return sinks
+	}
+	return append(sinks, logSink{buffer, levelDebug})
+}
+
+// Write keeps one log line, overwriting the oldest once the buffer is full
+func (b *logRing) Write(p []byte) (int, error) {
+	text := strings.TrimSuffix(string(p), "\n")
+	b.mu.Lock()
+	// Stamped under the lock, so the lines stay in time order for since
+	b.lines[b.next] = logRingLine{at: time.Now(), text: text}
+	b.next++
+	if b.next == len(b.lines) {
+		b.next = 0
+		b.full = true
+	}
+	b.mu.Unlock()
+	return len(p), nil
+}
+
+// since returns the lines logged at or after t, oldest first
+func (b *logRing) since(t time.Time) []logRingLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []logRingLine
+	if b.full {
+		lines = append(lines, b.lines[b.next:]...)
+	}
+	lines = append(lines, b.lines[:b.next]...)
+	first, _ := slices.BinarySearchFunc(lines, t, func(line logRingLine, t time.Time) int {
+		return line.at.Compare(t)
+	})
+	return lines[first:]
+}
+
+// handleLogDebug serves GET /admin/logs/debug
+func handleLogDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	source := query.Get("source")
+	var buffer *logRing
+	switch source {
+	case "stunturn":
+		buffer = stunturnDebugBuffer
+	case "signaling":
+		buffer = signalingDebugBuffer
+	default:
+		http.Error(w, "source must be stunturn or signaling", http.StatusBadRequest)
+		return
+	}
+	if buffer == nil {
+		http.Error(w, "the debug buffer is disabled (-log-debug-buffer=0)", http.StatusNotFound)
+		return
+	}
+	var since time.Time
+	if param := query.Get("since"); param != "" {
+		if t, err := time.Parse(time.RFC3339, param); err == nil {
+			since = t
+		} else if d, err := time.ParseDuration(param); err == nil && d >= 0 {
+			since = time.Now().Add(-d)
+		} else {
+			http.Error(w, "since must be an RFC 3339 time or a duration", http.StatusBadRequest)
+			return
+		}
+	}
+	var filter *regexp.Regexp
+	if pattern := query.Get("filter"); pattern != "" {
+		var err error
+		if filter, err = regexp.Compile(pattern); err != nil {
+			http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	auditLog.admin("logs_debug", r.RemoteAddr, map[string]string{"source": source, "since": query.Get("since"), "filter": query.Get("filter")})
+	lines := buffer.since(since)
+	stunTurnLogger.Printf("Debug buffer of %s dumped by %s (%d lines)", source, r.RemoteAddr, len(lines))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	out := bufio.NewWriter(w)
+	for _, line := range lines {
+		if filter != nil && !filter.MatchString(line.text) {
+			continue
+		}
+		out.WriteString(line.text)
+		out.WriteByte('\n')
+	}
+	out.Flush()
+}
+
+// ============================================================================
+// STATUS DASHBOARD
+// ============================================================================
+//
+// GET /admin/stats.json answers "is it healthy and who's connected" in one
+// request: uptime, the listeners, open relay allocations, the users relaying
+// the most bytes, the signaling sessions and the latest failed TURN
+// authentications. GET /admin/dashboard is a page that shows the same JSON
+// and reloads it every 5 seconds (see dashboard.html).
+
+// dashboardTopUsers is how many users the dashboard ranks by bytes relayed
+const dashboardTopUsers = 10
+
+// maxRecentAuthFailures is how many failed authentications the dashboard
+// keeps
+const maxRecentAuthFailures = 50
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// listenerInfo is one listening socket, or group of sockets sharing a port
+type listenerInfo struct {
+	Service  string `json:"service"`  // STUN/TURN, Signaling, ...
+	Protocol string `json:"protocol"` // UDP, TCP, TLS, HTTP, HTTPS or gRPC
+	Address  string `json:"address"`
+	Threads  int    `json:"threads"` // Listeners sharing the port
+}
+
+var (
+	listeners   []listenerInfo // Listeners in the order they started
+	listenersMu sync.Mutex
+)
+
+// registerListener records a listener for the dashboard once it is bound
+func registerListener(service, protocol, address string, threads int) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = append(listeners, listenerInfo{Service: service, Protocol: protocol, Address: address, Threads: threads})
+}
+
+// unregisterListeners forgets the listeners of the given services, once
+// they are closed
+func unregisterListeners(services ...string) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = slices.DeleteFunc(listeners, func(l listenerInfo) bool {
+		return slices.Contains(services, l.Service)
+	})
+}
+
+// authFailure is one failed TURN authentication
+type authFailure struct {
+	Time      time.Time `json:"time"`
+	Username  string    `json:"username"`
+	Realm     string    `json:"realm"`
+	SourceIP  string    `json:"sourceIP"`
+	Transport string    `json:"transport"`
+}
+
+// authFailureRing keeps the latest failed authentications
+type authFailureRing struct {
+	mu      sync.Mutex
+	entries [maxRecentAuthFailures]authFailure
+	next    int // Index the next failure is written to
+	count   int // Entries in use, up to maxRecentAuthFailures
+}
+
+// recentAuthFailures holds the failed authentications shown on the dashboard
+var recentAuthFailures = &authFailureRing{}
+
+// add records a failed authentication, replacing the oldest one when full
+func (r *authFailureRing) add(username, realm string, srcAddr net.Addr) {
+	sourceIP, transport := authSource(srcAddr)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = authFailure{Time: time.Now(), Username: username, Realm: realm, SourceIP: sourceIP, Transport: transport}
+	r.next = (r.next + 1) % maxRecentAuthFailures
+	r.count = min(r.count+1, maxRecentAuthFailures)
+}
+
+// snapshot returns the recorded failures, newest first
+func (r *authFailureRing) snapshot() []authFailure {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failures := make([]authFailure, 0, r.count)
+	for i := 1; i <= r.count; i++ {
+		failures = append(failures, r.entries[(r.next-i+maxRecentAuthFailures)%maxRecentAuthFailures])
+	}
+	return failures
+}
+
+// userBandwidth is one user's relay traffic on the dashboard
+type userBandwidth struct {
+	Username          string `json:"username"`
+	BytesRelayed      uint64 `json:"bytesRelayed"` // Both directions, since startup
+	ActiveAllocations int    `json:"activeAllocations"`
+}
+
+// topUsers returns the n users that relayed the most bytes since startup
+func (r *usageRegistry) topUsers(n int) []userBandwidth {
+	r.mu.Lock()
+	users := make([]*userUsage, 0, len(r.users))
+	for _, u := range r.users {
+		users = append(users, u)
+	}
+	r.mu.Unlock()
+
+	top := make([]userBandwidth, 0, len(users))
+	for _, u := range users {
+		u.mu.Lock()
+		active := u.active
+		u.mu.Unlock()
+		top = append(top, userBandwidth{Username: u.username, BytesRelayed: u.bytes.Load(), ActiveAllocations: active})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].BytesRelayed != top[j].BytesRelayed {
+			return top[i].BytesRelayed > top[j].BytesRelayed
+		}
+		return top[i].Username < top[j].Username
+	})
+	return top[:min(n, len(top))]
+}
+
+// allocationCount returns the number of open relay allocations
+func (r *usageRegistry) allocationCount() int {
+	r.relaysMu.Lock()
+	defer r.relaysMu.Unlock()
+	return len(r.tuples)
+}
+
+// dashboardStats is the /admin/stats.json document
+type dashboardStats struct {
+	Time          time.Time            `json:"time"`
+	StartTime     time.Time            `json:"startTime"`
+	UptimeSeconds float64              `json:"uptimeSeconds"`
+	Listeners     []listenerInfo       `json:"listeners"`
+	Services      serviceStatus        `json:"services"`
+	Allocations   int                  `json:"allocations"` // Open TURN relay allocations
+	TopUsers      []userBandwidth      `json:"topUsers"`
+	Sessions      []sessionView        `json:"sessions"` // Signaling sessions
+	InCall        int                  `json:"inCall"`   // Sessions in a call
+	AuthFailures  []authFailure        `json:"authFailures"`
+	Countries     []countryConnections `json:"countries,omitzero"` // Connections per country, with -geoip-db
+	Components    []componentHealth    `json:"components"`
+}
+
+// collectDashboardStats gathers the dashboard's data
+func collectDashboardStats() dashboardStats {
+	now := time.Now()
+	listenersMu.Lock()
+	listenerList := append([]listenerInfo{}, listeners...)
+	listenersMu.Unlock()
+
+	sessions := signalingTenants.Snapshot()
+	stats := dashboardStats{
+		Time:          now,
+		StartTime:     serverStartTime,
+		UptimeSeconds: now.Sub(serverStartTime).Seconds(),
+		Listeners:     listenerList,
+		Services:      runningServices(),
+		Allocations:   relayUsage.allocationCount(),
+		TopUsers:      relayUsage.topUsers(dashboardTopUsers),
+		Sessions:      sessionViews(sessions),
+		AuthFailures:  recentAuthFailures.snapshot(),
+		Components:    componentHealthTable(),
+	}
+	for _, session := range sessions {
+		if session.InCall {
+			stats.InCall++
+		}
+	}
+	if geoIP != nil {
+		stats.Countries = countryBreakdown(relayUsage.allocations(), sessions)
+	}
+	return stats
+}
+
+// handleStatsJSON serves GET /admin/stats.json
+func handleStatsJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(collectDashboardStats())
+}
+
+// handleDashboard serves GET /admin/dashboard
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardHTML)
+}
+
+// ============================================================================
+// SESSION AND ALLOCATION ENDPOINTS
+// ============================================================================
+//
+// GET /admin/sessions and GET /admin/allocations answer "is alice connected,
+// is she in a call and does she hold a relay?" from the signaling sessions
+// (webrtc.Sessions) and the open relay allocations (relayUsage.relays).
+// Both take ?user= to show one user only. Sessions of every signaling tenant
+// are listed unless ?tenant= picks one (tenant= is the default tenant).
+//
+// KICKING AND REVOKING:
+// =====================
+// DELETE /admin/sessions/{username} kicks a signaling user (see
+// webrtc/kick.go); they can't rejoin for -kick-cooldown, or ?cooldown=.
+// A user of another tenant than the default one is named with ?tenant=.
+// DELETE /admin/allocations/{username} removes a TURN user's credentials
+// until the server restarts: their relay sockets and TCP/TLS connections
+// are closed, and refreshes and new allocations fail authentication.
+// Both actions are recorded in the audit log.
+
+// kickCooldown is how long a kicked user can't rejoin, from -kick-cooldown
+var kickCooldown = webrtc.DefaultKickCooldown
+
+// allocationInfo is one open TURN relay allocation
+type allocationInfo struct {
+	Username      string    `json:"username"`      // Empty until the allocation response is seen
+	ClientAddress string    `json:"clientAddress"` // Client address and port
+	RelayAddress  string    `json:"relayAddress"`
+	Transport     string    `json:"transport"` // Client transport: UDP, TCP or TLS
+	Created       time.Time `json:"created"`
+	AgeSeconds    float64   `json:"ageSeconds"`
+	BytesRelayed  uint64    `json:"bytesRelayed"` // Both directions
+}
+
+// sessionView is a signaling session as the admin endpoints show it, with
+// its client's country and AS when -geoip-db is set
+type sessionView struct {
+	webrtc.SessionInfo
+	geoLocation
+}
+
+// sessionViews adds the GeoIP fields to a sessions snapshot
+func sessionViews(sessions []webrtc.SessionInfo) []sessionView {
+	views := make([]sessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, sessionView{SessionInfo: session, geoLocation: geoIP.lookupAddress(session.RemoteIP)})
+	}
+	return views
+}
+
+// allocations returns the open relay allocations, sorted by user and age
+func (r *usageRegistry) allocations() []allocationInfo {
+	r.relaysMu.Lock()
+	open := make([]*usagePacketConn, 0, len(r.relays))
+	for _, relay := range r.relays {
+		open = append(open, relay)
+	}
+	r.relaysMu.Unlock()
+
+	now := time.Now()
+	allocations := make([]allocationInfo, 0, len(open))
+	for _, relay := range open {
+		info := allocationInfo{
+			RelayAddress: relay.relayAddr.String(),
+			Created:      relay.created,
+			AgeSeconds:   now.Sub(relay.created).Seconds(),
+			BytesRelayed: relay.bytes.Load(),
+		}
+		if u := relay.user.Load(); u != nil {
+			u.mu.Lock()
+			info.Username = u.username
+			info.ClientAddress = relay.clientAddr
+			info.Transport = relay.transport
+			u.mu.Unlock()
+		}
+		allocations = append(allocations, info)
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		if allocations[i].Username != allocations[j].Username {
+			return allocations[i].Username < allocations[j].Username
+		}
+		return allocations[i].Created.Before(allocations[j].Created)
+	})
+	return allocations
+}
+
+// handleSessions serves GET /admin/sessions[?user=&tenant=]
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessions := signalingTenants.Snapshot()
+	if tenant, filtered := r.URL.Query()["tenant"]; filtered {
+		service := signalingTenants.Service(tenant[0])
+		if service == nil {
+			http.Error(w, "unknown tenant", http.StatusNotFound)
+			return
+		}
+		sessions = service.Registry().Snapshot()
+	}
+	if user := r.URL.Query().Get("user"); user != "" {
+		matching := []webrtc.SessionInfo{}
+		for _, session := range sessions {
+			if session.Username == user {
+				matching = append(matching, session)
+			}
+		}
+		sessions = matching
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sessionViews(sessions))
+}
+
+// revokeTURNUser removes a TURN user's credentials, in every realm, and
+// closes their relay sockets and the TCP/TLS connections that hold them. It
+// returns whether the user had credentials and how many relays and
+// connections were closed.
+func revokeTURNUser(username string) (known bool, relays, conns int) {
+	usersMapMu.Lock()
+	for _, realmUsers := range usersMap {
+		if _, ok := realmUsers[username]; ok {
+			known = true
+			delete(realmUsers, username)
+		}
+	}
+	usersMapMu.Unlock()
+
+	relayUsage.relaysMu.Lock()
+	var owned []*usagePacketConn
+	for _, relay := range relayUsage.relays {
+		if u := relay.user.Load(); u != nil && u.username == username {
+			owned = append(owned, relay)
+		}
+	}
+	relayUsage.relaysMu.Unlock()
+
+	for _, relay := range owned {
+		u := relay.user.Load()
+		u.mu.Lock()
+		clientAddr := relay.clientAddr
+		u.mu.Unlock()
+		relay.Close()
+		relays++
+		if conn, ok := streamConns.Load(clientAddr); ok {
+			conn.(*LoggingConn).setCloseReason("TURN user revoked")
+			conn.(*LoggingConn).Close()
+			conns++
+		}
+	}
+	return known, relays, conns
+}
+
+// handleKickSession serves DELETE /admin/sessions/{username}[?reason=&cooldown=&tenant=]
+func handleKickSession(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	query := r.URL.Query()
+	tenant := query.Get("tenant")
+	service := signalingTenants.Service(tenant)
+	if service == nil {
+		http.Error(w, "unknown tenant", http.StatusNotFound)
+		return
+	}
+	reason := query.Get("reason")
+	if reason == "" {
+		reason = "disconnected by an administrator"
+	}
+	cooldown := kickCooldown
+	if value := query.Get("cooldown"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid cooldown", http.StatusBadRequest)
+			return
+		}
+		cooldown = parsed
+	}
+
+	kicked := service.Kick(username, reason, cooldown)
+	result := "kicked"
+	if !kicked {
+		result = "not connected"
+	}
+	auditLog.admin("session_kick", r.RemoteAddr, map[string]string{
+		"username": username,
+		"tenant":   tenant,
+		"reason":   reason,
+		"cooldown": cooldown.String(),
+		"result":   result,
+	})
+	if !kicked {
+		http.Error(w, "user not connected", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRevokeAllocations serves DELETE /admin/allocations/{username}
+func handleRevokeAllocations(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	known, relays, conns := revokeTURNUser(username)
+	stunTurnLogger.Printf("TURN user %s revoked by %s: %d relays and %d connections closed", webrtc.RedactName(username), r.RemoteAddr, relays, conns)
+	auditLog.admin("turn_revoke", r.RemoteAddr, map[string]string{
+		"username":    username,
+		"known":       strconv.FormatBool(known),
+		"relays":      strconv.Itoa(relays),
+		"connections": strconv.Itoa(conns),
+	})
+	if !known && relays == 0 {
+		http.Error(w, "unknown TURN user", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"relaysClosed": relays, "connectionsClosed": conns})
+}
+
+// handleAllocations serves GET /admin/allocations[?user=]
+func handleAllocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	allocations := relayUsage.allocations()
+	if user := r.URL.Query().Get("user"); user != "" {
+		matching := []allocationInfo{}
+		for _, allocation := range allocations {
+			if allocation.Username == user {
+				matching = append(matching, allocation)
+			}
+		}
+		allocations = matching
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(allocations)
+}
+
+// ============================================================================
+// SYSTEMD NOTIFICATIONS
+// ============================================================================
+
+// Under systemd with Type=notify the server reports its state on the socket
+// in $NOTIFY_SOCKET (the sd_notify protocol, written directly, no cgo):
+// - READY=1 once the STUN/TURN servers and the signaling listener are up,
+//   so units ordered after this one don't start against closed ports
+// - STOPPING=1 when the shutdown begins
+// - WATCHDOG=1 with WatchdogSec= set, every half of it, from the connection
+//   monitoring goroutine, and only while the self-checks pass (see
+//   selfCheck), so a wedged server is restarted
+//
+// Without $NOTIFY_SOCKET, outside systemd or with Type=simple, nothing is
+// sent. A minimal unit:
+//
+//	[Service]
+//	Type=notify
+//	WatchdogSec=30
+//	ExecStart=/opt/go-server/go-server -public-ip=203.0.113.1
+//	Restart=on-failure
+
+// selfCheckTimeout bounds each self-check, well below the watchdog interval
+// of any sensible WatchdogSec
+const selfCheckTimeout = 2 * time.Second
+
+// systemdReady is set once READY=1 was sent; the watchdog isn't pinged
+// before, as systemd only starts watching then
+var systemdReady atomic.Bool
+
+// notifySystemd sends a state, such as "READY=1", to systemd. Failures are
+// logged, not fatal: the server runs the same without systemd.
+func notifySystemd(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		stunTurnLog.Warn.Printf("Failed to notify systemd (%s): %v", state, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		stunTurnLog.Warn.Printf("Failed to notify systemd (%s): %v", state, err)
+		return
+	}
+	if state == "READY=1" {
+		systemdReady.Store(true)
+		stunTurnLogger.Printf("Notified systemd: READY=1")
+	}
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog, half of
+// $WATCHDOG_USEC, or 0 if this process has no watchdog
+func watchdogInterval() time.Duration {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// $WATCHDOG_PID, when set, names the process the watchdog is meant for
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// pingWatchdog sends WATCHDOG=1 if the self-checks pass; otherwise it logs
+// why and leaves systemd to restart the server once the watchdog times out
+func pingWatchdog() {
+	if !systemdReady.Load() {
+		return
+	}
+	if err := selfCheck(); err != nil {
+		stunTurnLog.Warn.Printf("WARNING: Self-check failed, not pinging the systemd watchdog: %v", err)
+		return
+	}
+	notifySystemd("WATCHDOG=1")
+}
+
+// selfCheck checks that the server still serves: the UDP STUN/TURN server
+// answers a binding request on its main port, and the signaling port
+// accepts connections. The binding request shows up in the STUN/TURN log
+// like any other, from 127.0.0.1.
+func selfCheck() error {
+	if stunturnEnabled && len(udpBoundPorts) > 0 {
+		if err := checkSTUNBinding(udpBoundPorts[0]); err != nil {
+			return fmt.Errorf("STUN on UDP port %d: %v", udpBoundPorts[0], err)
+		}
+	}
+	if signalingEnabled {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(signalingPort)), selfCheckTimeout)
+		if err != nil {
+			return fmt.Errorf("signaling port %d: %v", signalingPort, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// checkSTUNBinding sends a binding request to a local UDP port and waits
+// for the matching success response
+func checkSTUNBinding(port int) error {
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(selfCheckTimeout))
+	if _, err := conn.Write(req.Raw); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		res := &stun.Message{Raw: buf[:n]}
+		if res.Decode() != nil || res.TransactionID != req.TransactionID {
+			continue
+		}
+		if res.Type != stun.BindingSuccess {
+			return fmt.Errorf("got %s", res.Type)
+		}
+		return nil
+	}
+}
+
+// ============================================================================
+// BUILD INFORMATION
+// ============================================================================
+
+// The version, commit and build date of the binary, set at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without -ldflags the version is "dev", the commit is taken from the VCS
+// information Go stamps into builds of a git checkout, and anything still
+// missing is "unknown". -version prints them, and the startup banners of
+// both logs, /healthz and the signaling join responses carry them.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo returns the build information of the binary
+func buildInfo() webrtc.ServerInfo {
+	info := webrtc.ServerInfo{Version: version, Commit: commit, BuildDate: buildDate}
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Commit == "" {
+		modified := false
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = setting.Value
+				if len(info.Commit) > 12 {
+					info.Commit = info.Commit[:12]
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if info.Commit != "" && modified {
+			info.Commit += "-dirty"
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// versionString formats the build information for -version and the
+// startup banners, e.g. "1.4.0 (commit 3f9c2e1, built 2026-10-17T09:30:00Z, go1.25.0)"
+func versionString() string {
+	info := buildInfo()
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", info.Version, info.Commit, info.BuildDate, runtime.Version())
+}
+
+// credentialValues matches the users and passwords in -turn-users and
+// -turn-realms
+var credentialValues = regexp.MustCompile(`([^,;:=]*)=[^,;]*`)
+
+// logEffectiveConfig logs every flag with the value it took and where it
+// came from (flag, env or default), so "what flags was it started with" has
+// an answer in the log. Secrets are redacted, see redactFlagValue.
+func logEffectiveConfig() {
+	stunTurnLogger.Printf("Effective configuration:")
+	flag.VisitAll(func(f *flag.Flag) {
+		source := flagSources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		stunTurnLogger.Printf("  -%s=%s (%s)", f.Name, redactFlagValue(f.Name, f.Value.String()), source)
+	})
+	for _, name := range unknownEnvVars {
+		stunTurnLog.Warn.Printf("WARNING: Ignoring environment variable %s: no flag -%s, check for typos", name, envFlagName(name))
+	}
+}
+
+// redactFlagValue hides the secrets in a flag's value: the admin token, the
+// TURN passwords, the path of the alert webhook (Slack and PagerDuty put
+// their keys there) and the password of any URL, such as a remote log
+// destination
+func redactFlagValue(name, value string) string {
+	switch name {
+	case "admin-token":
+		if value != "" {
+			return "<redacted>"
+		}
+		return value
+	case "turn-users", "turn-realms":
+		// Passwords always go, usernames at -log-redact=pii
+		return credentialValues.ReplaceAllStringFunc(value, func(pair string) string {
+			user, _, _ := strings.Cut(pair, "=")
+			return webrtc.RedactName(user) + "=<redacted>"
+		})
+	case "alert-webhook":
+		if u, err := url.Parse(value); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host + "/<redacted>"
+		}
+		return value
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// ============================================================================
+// ENVIRONMENT VARIABLES
+// ============================================================================
+
+// Every flag can also be set with an environment variable, WEBRTC_ and the
+// flag's name in upper case with dashes as underscores: WEBRTC_PUBLIC_IP
+// for -public-ip, WEBRTC_TURN_USERS for -turn-users. Containers are usually
+// configured through their environment, and secrets such as the TURN
+// passwords don't show up in the process list there.
+//
+// A flag given on the command line wins over its variable, and the variable
+// over the default. The value is parsed by the flag itself, exactly as if it
+// had been given as -name=value: booleans take true/false/1/0, lists are
+// comma-separated. A repeatable flag (-tls-cert-pair) takes one value per
+// line. WEBRTC_* variables that match no flag are logged as warnings, since
+// a typo would otherwise leave a setting at its default without a word.
+const envFlagPrefix = "WEBRTC_"
+
+// repeatableFlags are the flags that may be given more than once; their
+// variables hold one value per line
+var repeatableFlags = map[string]bool{"tls-cert-pair": true}
+
+var (
+	// flagSources records where each flag's value came from, "flag" or
+	// "env WEBRTC_...", set once at startup by applyEnvFlags; flags missing
+	// from it kept their default
+	flagSources = make(map[string]string)
+	// unknownEnvVars are the WEBRTC_* variables that match no flag, logged
+	// once the loggers are set up
+	unknownEnvVars []string
+)
+
+// envVarName returns the environment variable of a flag, e.g.
+// WEBRTC_PUBLIC_IP for public-ip
+func envVarName(flagName string) string {
+	return envFlagPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// envFlagName returns the flag an environment variable would set, e.g.
+// public-ip for WEBRTC_PUBLIC_IP
+func envFlagName(envName string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(envName, envFlagPrefix), "_", "-"))
+}
+
+// applyEnvFlags sets every flag that wasn't given on the command line from
+// its environment variable, if that is set, and records the source of each
+// value. It must run right after flag.Parse.
+func applyEnvFlags() error {
+	flag.Visit(func(f *flag.Flag) {
+		flagSources[f.Name] = "flag"
+	})
+	var err error
+	known := make(map[string]bool)
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envVarName(f.Name)
+		known[name] = true
+		value, set := os.LookupEnv(name)
+		if err != nil || !set || flagSources[f.Name] == "flag" {
+			return
+		}
+		values := []string{value}
+		if repeatableFlags[f.Name] {
+			values = strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == '\r' })
+		}
+		for _, v := range values {
+			if setErr := flag.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s=%q: %v", name, redactFlagValue(f.Name, v), setErr)
+				return
+			}
+		}
+		flagSources[f.Name] = "env " + name
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, envFlagPrefix) && !known[name] {
+			unknownEnvVars = append(unknownEnvVars, name)
+		}
+	}
+	sort.Strings(unknownEnvVars)
+	return nil
+}
+
+// ============================================================================
+// TRACING
+// ============================================================================
+
+// With -otel-endpoint set, the server exports OpenTelemetry traces over
+// OTLP/gRPC to a collector (Jaeger, Tempo, the OpenTelemetry Collector):
+// - a span per signaling message, and a "call setup" trace per call linking
+//   its offer, answer and first candidates (see webrtc/tracing.go)
+// - a span "TURN Allocate" per Allocate transaction, from the request
+//   arriving to the response being sent, measured where the packets are
+//   logged (see STUNTurnLogger.LogMessage). The usual first attempt,
+//   answered 401 to ask for credentials, is a span of its own with
+//   turn.error_code 401 and no error status.
+//
+// Without it no tracer is set up and every tracing hook returns after one
+// nil check, so tracing costs nothing measurable when it is off.
+
+var (
+	// turnTracer records the TURN Allocate spans, set once at startup by
+	// setupTracing; nil while tracing is off
+	turnTracer trace.Tracer
+
+	// allocateSpans are the spans of the Allocate requests not answered yet
+	allocateSpans   = make(map[allocateKey]*allocateSpan)
+	allocateSpansMu sync.Mutex
+)
+
+// allocateKey identifies an Allocate transaction: the transaction ID is only
+// unique per client
+type allocateKey struct {
+	transactionID [stun.TransactionIDSize]byte
+	client        string
+}
+
+// allocateSpan is the span of an Allocate request waiting for its response
+type allocateSpan struct {
+	span    trace.Span
+	started time.Time
+}
 
-	// Configure TLS settings
-	// MinVersion ensures we use secure TLS versions
-	// TLS 1.2 is the minimum recommended version for security
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert}, // Our SSL certificate
-		MinVersion:   tls.VersionTLS12,        // Minimum TLS version (secure)
+// setupTracing sets up the export of traces to an OTLP/gRPC endpoint,
+// host:port for a plaintext connection or an http:// or https:// URL, and
+// turns tracing on. Shut the returned provider down on exit to flush the
+// spans still buffered.
+func setupTracing(endpoint string) (*sdktrace.TracerProvider, error) {
+	var opts []otlptracegrpc.Option
+	if strings.Contains(endpoint, "://") {
+		opts = append(opts, otlptracegrpc.WithEndpointURL(endpoint))
+	} else {
+		opts = append(opts, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
 	}
-
-	// Create TCP address for the server
-	// Port 5349 is the standard STUNTURNS (STUNTURN over TLS) port
-	// Different from standard STUNTURN port (3478) to distinguish protocols
-	addr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:"+strconv.Itoa(stunturnTLSPort))
+	// The connection is made lazily, so a collector that is down doesn't
+	// stop the server from starting; the spans are dropped until it is up
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
 	if err != nil {
-		return fmt.Errorf("failed to parse server address: %w", err)
+		return nil, fmt.Errorf("failed to create OTLP exporter for %s: %w", endpoint, err)
 	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "go-server"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	webrtc.ConfigureTracing(provider)
+	turnTracer = provider.Tracer("go-server/turn")
+	return provider, nil
+}
 
-	// Create listener configuration with proper socket options for multithreading
-	// SO_REUSEADDR allows multiple listeners to bind to the same port
-	// This is essential for multi-threaded TLS servers
-	listenerConfig := &net.ListenConfig{
-		Control: func(network, address string, conn syscall.RawConn) error {
-			var operr error
-			if err := conn.Control(func(fd uintptr) {
-				// Set SO_REUSEADDR to allow multiple listeners on same port
-				// This enables multiple threads to share the same port
-				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-			}); err != nil {
-				return err
-			}
-			return operr
-		},
+// traceAllocate starts the span of an incoming Allocate request and ends it
+// at the outgoing response to it. Retransmissions of a request still
+// waiting are part of its span. Like the response latency, at most
+// maxPendingTransactions requests wait at a time, and the spans of those
+// without a response within transactionTTL are ended as unanswered.
+func traceAllocate(data []byte, addr net.Addr, incoming bool) {
+	if turnTracer == nil || len(data) < 20 {
+		return
 	}
-
-	// Create multiple TLS listeners for better performance
-	// Each thread gets its own listener to handle concurrent connections
-	// This prevents connection bottlenecks and improves throughput
-	listenerConfigs := make([]turn.ListenerConfig, threadNum)
-	stunTurnLogger.Printf("")
-	for i := 0; i < threadNum; i++ {
-		// Create TCP listener with proper socket options first
-		// TLS is built on top of TCP, so we start with a TCP listener
-		tcpListener, err := listenerConfig.Listen(context.Background(), addr.Network(), addr.String())
-		if err != nil {
-			return fmt.Errorf("failed to create TCP listener for TLS STUNTURN %d: %w", i, err)
+	method, class := decodeMessageType(binary.BigEndian.Uint16(data[0:2]) & 0x3FFF)
+	if method != turnMethodAllocate {
+		return
+	}
+	key := allocateKey{client: addr.String()}
+	copy(key.transactionID[:], data[8:20])
+
+	allocateSpansMu.Lock()
+	defer allocateSpansMu.Unlock()
+	switch {
+	case class == messageClassRequest && incoming:
+		if _, waiting := allocateSpans[key]; waiting {
+			return
 		}
-
-		// Wrap TCP listener with TLS
-		// This adds encryption to the TCP connection
-		// All data transmitted through this listener will be encrypted
-		tlsListener := tls.NewListener(tcpListener, tlsConfig)
-
-		// Configure the TLS listener with relay capabilities
-		// Each listener is configured with the same relay address generator
-		// This ensures consistent relay allocation across all threads
-		listenerConfigs[i] = turn.ListenerConfig{
-			Listener:              tlsListener, // TLS connection
-			RelayAddressGenerator: relayGen,    // How to allocate relay addresses
+		sweepAllocateSpans()
+		if len(allocateSpans) >= maxPendingTransactions {
+			return
 		}
-		stunTurnLogger.Printf("TLS STUNTURN server %d listening on %s", i, tlsListener.Addr().String())
+		attrs := []attribute.KeyValue{
+			attribute.String("client.address", addr.String()),
+			attribute.String("network.transport", addr.Network()),
+		}
+		msg := &stun.Message{Raw: append([]byte(nil), data...)}
+		if msg.Decode() == nil {
+			var username stun.Username
+			if username.GetFrom(msg) == nil {
+				attrs = append(attrs, attribute.String("turn.username", webrtc.RedactName(username.String())))
+			}
+		}
+		_, span := turnTracer.Start(context.Background(), "TURN Allocate",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...))
+		allocateSpans[key] = &allocateSpan{span: span, started: time.Now()}
+
+	case (class == messageClassSuccess || class == messageClassError) && !incoming:
+		pending, waiting := allocateSpans[key]
+		if !waiting {
+			return
+		}
+		delete(allocateSpans, key)
+		if class == messageClassError {
+			msg := &stun.Message{Raw: append([]byte(nil), data...)}
+			var errorCode stun.ErrorCodeAttribute
+			if msg.Decode() == nil && errorCode.GetFrom(msg) == nil {
+				pending.span.SetAttributes(attribute.Int("turn.error_code", int(errorCode.Code)))
+				// 401 is the challenge every client gets first, not a failure
+				if errorCode.Code != stun.CodeUnauthorized {
+					pending.span.SetStatus(codes.Error, string(errorCode.Reason))
+				}
+			}
+		}
+		pending.span.End()
 	}
+}
 
-	// Create STUNTURN server with TLS listeners
-	// The server combines all TLS listeners into a single STUNTURN server instance
-	// This provides unified authentication and relay management
-	// NOTE: This server automatically handles both STUN and TURN requests
-	stunturnTLSServer, err = turn.NewServer(turn.ServerConfig{
-		Realm:           realm,           // Authentication realm
-		AuthHandler:     authHandler,     // Authentication function
-		ListenerConfigs: listenerConfigs, // TLS listeners
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create TLS STUNTURN server: %w", err)
+// sweepAllocateSpans ends the spans of the Allocate requests that waited
+// longer than transactionTTL. allocateSpansMu must be held.
+func sweepAllocateSpans() {
+	cutoff := time.Now().Add(-transactionTTL)
+	for key, pending := range allocateSpans {
+		if pending.started.Before(cutoff) {
+			pending.span.SetStatus(codes.Error, "no response")
+			pending.span.End()
+			delete(allocateSpans, key)
+		}
 	}
-	return nil
 }
 
 // ============================================================================
-// CUSTOM LOGGING HANDLERS
+// COMPONENT HEALTH
 // ============================================================================
 
-// CustomPacketConn wraps a net.PacketConn to add logging for all STUN/TURN packets
-type CustomPacketConn struct {
-	net.PacketConn
-	connID string
+// A listener that couldn't start used to be a single log line at startup,
+// like "SSL certificates not found. Skipping TLS STUNTURN server.", easy to
+// miss until clients on restrictive networks failed to connect. Each
+// component now has a status with a reason, shown on /healthz, in the
+// connection statistics and on the dashboard:
+//
+//	up        serving
+//	degraded  serving, but something is wrong, e.g. an expired certificate
+//	disabled  not running, by configuration or for want of a certificate
+//	failed    stopped or couldn't start
+//
+// The statuses are set as the components start. Every minute, and whenever
+// they are read, they are rechecked for runtime problems: an up STUN/TURN
+// listener is degraded while -max-total-allocations is reached, and an up
+// TLS listener while a certificate has expired or expires within
+// certExpiryWarning. Changes after startup are logged.
+
+// Component statuses
+const (
+	componentUp       = "up"
+	componentDegraded = "degraded"
+	componentDisabled = "disabled"
+	componentFailed   = "failed"
+)
+
+// Components, in the order they are listed
+const (
+	componentUDP       = "stunturn-udp"
+	componentTCP       = "stunturn-tcp"
+	componentTLS       = "stunturn-tls"
+	componentDTLS      = "stunturn-dtls"
+	componentSignaling = "signaling"
+	componentAdmin     = "admin"
+)
+
+// certExpiryWarning is how long before a certificate expires its TLS
+// listeners are reported degraded
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// componentHealth is the status of one component
+type componentHealth struct {
+	Name   string    `json:"name"`
+	Status string    `json:"status"`           // componentUp, componentDegraded, ...
+	Reason string    `json:"reason,omitempty"` // Why it isn't up, or a note if it is
+	Since  time.Time `json:"since"`            // When it got its status
 }
 
-func (c *CustomPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = c.PacketConn.ReadFrom(p)
-	if err == nil && n > 0 {
-		// Log all incoming packets (both STUN and TURN)
-		stunTurnLogger.Printf("[%s] Received %d bytes from %s", c.connID, n, addr.String())
+// componentState is a component's status as set when it started, and its
+// status once runtime problems are taken into account
+type componentState struct {
+	componentHealth
+	setStatus string
+	setReason string
+}
 
-		// Try to identify STUN/TURN message type
-		if n >= 20 { // Minimum STUN message size
-			messageType := getSTUNTURNMessageType(p[:n])
-			if messageType != "" {
-				stunTurnLogger.Printf("[%s] %s request from %s", c.connID, messageType, addr.String())
-			}
+var (
+	components = []*componentState{
+		newComponentState(componentUDP),
+		newComponentState(componentTCP),
+		newComponentState(componentTLS),
+		newComponentState(componentDTLS),
+		newComponentState(componentSignaling),
+		newComponentState(componentAdmin),
+	}
+	componentsMu sync.Mutex
+)
+
+// newComponentState returns a component that hasn't started
+func newComponentState(name string) *componentState {
+	return &componentState{
+		componentHealth: componentHealth{Name: name, Status: componentDisabled, Reason: "not started", Since: time.Now()},
+		setStatus:       componentDisabled,
+		setReason:       "not started",
+	}
+}
+
+// setComponentHealth records a component's status as it starts or stops
+func setComponentHealth(name, status, reason string) {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	for _, c := range components {
+		if c.Name == name {
+			c.setStatus, c.setReason = status, reason
+			c.updateLocked(status, reason)
 		}
 	}
-	return n, addr, err
 }
 
-func (c *CustomPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	n, err = c.PacketConn.WriteTo(p, addr)
-	if err == nil && n > 0 {
-		stunTurnLogger.Printf("[%s] Sent %d bytes to %s", c.connID, n, addr.String())
+// updateLocked changes a component's status, logging the change once the
+// server runs. The caller must hold componentsMu.
+func (c *componentState) updateLocked(status, reason string) {
+	if c.Status == status && c.Reason == reason {
+		return
+	}
+	if c.Status != status {
+		c.Since = time.Now()
+	}
+	c.Status, c.Reason = status, reason
+	if !startupComplete.Load() {
+		return
+	}
+	if reason != "" {
+		stunTurnLogger.Printf("Component %s is %s: %s", c.Name, status, reason)
+	} else {
+		stunTurnLogger.Printf("Component %s is %s", c.Name, status)
+	}
+}
 
-		// Try to identify STUN/TURN message type
-		if n >= 20 { // Minimum STUN message size
-			messageType := getSTUNTURNMessageType(p[:n])
-			if messageType != "" {
-				stunTurnLogger.Printf("[%s] %s response to %s", c.connID, messageType, addr.String())
+// componentHealthTable rechecks the components for runtime problems and
+// returns their statuses
+func componentHealthTable() []componentHealth {
+	saturated := relayUsage.saturated()
+	certProblem := tlsCertificates.expiryProblem(time.Now())
+	udpProblem := udpListenerProblem()
+	relayProblem := relayReachabilityProblem()
+
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	table := make([]componentHealth, 0, len(components))
+	for _, c := range components {
+		status, reason := c.setStatus, c.setReason
+		if status == componentUp {
+			usesTLS := c.Name == componentTLS || c.Name == componentDTLS || (c.Name == componentSignaling && signalingCertsFound)
+			isTURN := c.Name == componentUDP || c.Name == componentTCP || c.Name == componentTLS || c.Name == componentDTLS
+			if usesTLS && certProblem != "" {
+				status, reason = componentDegraded, certProblem
+			} else if c.Name == componentUDP && udpProblem != "" {
+				status, reason = componentDegraded, udpProblem
+			} else if isTURN && relayProblem != "" {
+				status, reason = componentDegraded, relayProblem
+			} else if isTURN && saturated {
+				status, reason = componentDegraded, fmt.Sprintf("%d allocations open, the -max-total-allocations limit", maxTotalAllocations)
 			}
 		}
+		c.updateLocked(status, reason)
+		table = append(table, c.componentHealth)
 	}
-	return n, err
+	return table
 }
 
-// CustomListener wraps a net.Listener to add logging for TCP connections
-type CustomListener struct {
-	net.Listener
-	connID string
+// expiryProblem describes the first certificate that has expired or expires
+// within certExpiryWarning, or returns "" if there is none
+func (s *certificateSet) expiryProblem(now time.Time) string {
+	if s == nil {
+		return ""
+	}
+	names := make([]string, 0, len(s.byName))
+	for name := range s.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	certs := make([]*tls.Certificate, 0, len(names)+1)
+	for _, name := range names {
+		certs = append(certs, s.byName[name])
+	}
+	certs = append(certs, s.fallback)
+	for _, cert := range certs {
+		if cert.Leaf == nil {
+			continue
+		}
+		subject := cert.Leaf.Subject.CommonName
+		if len(cert.Leaf.DNSNames) > 0 {
+			subject = cert.Leaf.DNSNames[0]
+		}
+		if notAfter := cert.Leaf.NotAfter; now.After(notAfter) {
+			return fmt.Sprintf("certificate for %s expired on %s", subject, notAfter.Format(time.DateOnly))
+		} else if notAfter.Sub(now) < certExpiryWarning {
+			return fmt.Sprintf("certificate for %s expires on %s", subject, notAfter.Format(time.DateOnly))
+		}
+	}
+	return ""
 }
 
-func (c *CustomListener) Accept() (net.Conn, error) {
-	conn, err := c.Listener.Accept()
-	if err == nil {
-		stunTurnLogger.Printf("[%s] New TCP connection from %s", c.connID, conn.RemoteAddr().String())
+// recordSTUNTURNHealth sets the statuses of the STUN/TURN listeners once
+// they are up
+func recordSTUNTURNHealth(enableTCP, enableTLS, enableDTLS bool) {
+	setPortsHealth(componentUDP, "UDP", extraUDPPorts, udpBoundPorts)
+	if enableTCP {
+		setPortsHealth(componentTCP, "TCP", extraTCPPorts, tcpBoundPorts)
+	} else {
+		setComponentHealth(componentTCP, componentDisabled, "-enable-tcp=false")
+	}
+	noCertificate := "no TLS certificate: add certs/fullchain.pem and certs/privkey.pem, or -tls-cert-pair"
+	switch {
+	case !enableTLS:
+		setComponentHealth(componentTLS, componentDisabled, "-enable-tls=false")
+	case tlsCertificates == nil:
+		setComponentHealth(componentTLS, componentDisabled, noCertificate)
+	default:
+		setComponentHealth(componentTLS, componentUp, "")
+	}
+	switch {
+	case !enableDTLS:
+		setComponentHealth(componentDTLS, componentDisabled, "-enable-dtls=false")
+	case tlsCertificates == nil:
+		setComponentHealth(componentDTLS, componentDisabled, noCertificate)
+	default:
+		setComponentHealth(componentDTLS, componentUp, "")
+	}
+}
 
-		// Wrap the connection to log data
-		conn = &CustomConn{
-			Conn:   conn,
-			connID: c.connID,
+// setPortsHealth reports a listener up, or degraded if some of its extra
+// ports couldn't be bound (the main port must bind)
+func setPortsHealth(name, protocol string, extraPorts, boundPorts []int) {
+	var missing []int
+	for _, port := range extraPorts {
+		if !slices.Contains(boundPorts, port) {
+			missing = append(missing, port)
 		}
 	}
-	return conn, err
+	if len(missing) > 0 {
+		setComponentHealth(name, componentDegraded, fmt.Sprintf("extra %s ports %s couldn't be bound", protocol, portList(missing)))
+	} else {
+		setComponentHealth(name, componentUp, "")
+	}
 }
 
-// CustomConn wraps a net.Conn to add logging for TCP data
-type CustomConn struct {
-	net.Conn
-	connID string
+// logComponentHealth logs the components that aren't up, for the
+// connection statistics
+func logComponentHealth() {
+	var notUp []string
+	for _, c := range componentHealthTable() {
+		if c.Status != componentUp {
+			notUp = append(notUp, fmt.Sprintf("%s %s (%s)", c.Name, c.Status, c.Reason))
+		}
+	}
+	if len(notUp) == 0 {
+		stunTurnLogger.Printf("Components: all up")
+	} else {
+		stunTurnLogger.Printf("Components not up: %s", strings.Join(notUp, ", "))
+	}
 }
 
-func (c *CustomConn) Read(b []byte) (n int, err error) {
-	n, err = c.Conn.Read(b)
-	if err == nil && n > 0 {
-		stunTurnLogger.Printf("[%s] Received %d bytes from %s", c.connID, n, c.RemoteAddr().String())
+// ============================================================================
+// ALERTING
+// ============================================================================
 
-		// Try to identify STUN/TURN message type
-		if n >= 20 { // Minimum STUN message size
-			messageType := getSTUNTURNMessageType(b[:n])
-			if messageType != "" {
-				stunTurnLogger.Printf("[%s] %s request from %s", c.connID, messageType, c.RemoteAddr().String())
+// Operators want to be paged when something needs them, not to find it in
+// the logs afterwards. Every alertInterval the alerting goroutine checks
+// these rules over the server's counters and component statuses:
+//
+//	auth-failure-spike  -alert-auth-failures or more refused TURN
+//	                    authentications in the last minute
+//	allocation-cap      -max-total-allocations is reached
+//	component-failed    a component is failed (see COMPONENT HEALTH), one
+//	                    alert per component
+//	public-ip-changed   the public IP, re-detected every
+//	                    -alert-public-ip-interval, isn't the one relays are
+//	                    given out on; only if it was auto-detected
+//
+// An alert fires once when its condition starts and is resolved once when
+// it clears, never repeated while the condition lasts. Each one is logged
+// and sent as an alert JSON document: POSTed to -alert-webhook (Slack and
+// PagerDuty can take it through their generic webhook integrations) and/or
+// written to the stdin of -alert-command, run without a shell. Deliveries
+// run in the background, each for at most alertDeliveryTimeout; a failed
+// one is logged and not retried.
+
+// alertInterval is how often the alert rules are checked
+const alertInterval = 30 * time.Second
+
+// alertDeliveryTimeout bounds one webhook request or command run
+const alertDeliveryTimeout = 10 * time.Second
+
+// Defaults of the alerting flags
+const (
+	defaultAlertAuthFailures     = 100
+	defaultAlertPublicIPInterval = 10 * time.Minute
+)
+
+var (
+	// Alert settings, set once at startup from the -alert-* flags
+	alertWebhook          string
+	alertCommand          string
+	alertAuthFailures     int           // 0 disables auth-failure-spike
+	alertPublicIPInterval time.Duration // 0 disables public-ip-changed
+
+	publicIPDetected  bool          // Whether publicIP was auto-detected rather than given
+	authFailuresTotal atomic.Uint64 // Refused TURN authentications since startup
+)
+
+// alert is the document an alert is delivered as
+type alert struct {
+	Rule     string    `json:"rule"`     // auth-failure-spike, allocation-cap, component-failed or public-ip-changed
+	Key      string    `json:"key"`      // The rule, and the component for component-failed
+	Status   string    `json:"status"`   // firing or resolved
+	Severity string    `json:"severity"` // warning or critical
+	Summary  string    `json:"summary"`  // What fired, as when it fired
+	Server   string    `json:"server"`   // The server's public IP
+	Since    time.Time `json:"since"`    // When it started firing
+	Time     time.Time `json:"time"`
+}
+
+// alertCondition is a condition an alert rule found
+type alertCondition struct {
+	rule     string
+	severity string
+	summary  string
+}
+
+// counterSample is a counter's value at one time
+type counterSample struct {
+	at    time.Time
+	count uint64
+}
+
+// alertManager keeps what the alert rules need between checks. It is only
+// used by the alerting goroutine.
+type alertManager struct {
+	firing      map[string]alert // Alerts firing, by key
+	authSamples []counterSample  // authFailuresTotal over the last minute
+	detectedIP  string           // Public IP found by the last re-detection
+	lastIPCheck time.Time
+}
+
+// startAlerting starts the alerting goroutine if an alert destination is set
+func startAlerting() {
+	if alertWebhook == "" && alertCommand == "" {
+		return
+	}
+	now := time.Now()
+	manager := &alertManager{
+		firing:      make(map[string]alert),
+		authSamples: []counterSample{{at: now, count: authFailuresTotal.Load()}},
+		lastIPCheck: now,
+	}
+	go func() {
+		ticker := time.NewTicker(alertInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, a := range manager.transitions(manager.conditions(now), now) {
+				deliverAlert(a)
 			}
 		}
+	}()
+}
+
+// conditions runs the alert rules, returning the conditions found by key
+func (m *alertManager) conditions(now time.Time) map[string]alertCondition {
+	found := make(map[string]alertCondition)
+	if alertAuthFailures > 0 {
+		if failures := m.authFailuresLastMinute(authFailuresTotal.Load(), now); failures >= uint64(alertAuthFailures) {
+			found["auth-failure-spike"] = alertCondition{"auth-failure-spike", "warning",
+				fmt.Sprintf("%d refused TURN authentications in the last minute, -alert-auth-failures is %d", failures, alertAuthFailures)}
+		}
 	}
-	return n, err
+	if relayUsage.saturated() {
+		found["allocation-cap"] = alertCondition{"allocation-cap", "critical",
+			fmt.Sprintf("%d allocations open, the -max-total-allocations limit; new allocations are refused", maxTotalAllocations)}
+	}
+	for _, c := range componentHealthTable() {
+		if c.Status == componentFailed {
+			found["component-failed:"+c.Name] = alertCondition{"component-failed", "critical",
+				fmt.Sprintf("Component %s failed: %s", c.Name, c.Reason)}
+		}
+	}
+	if publicIPDetected && alertPublicIPInterval > 0 && now.Sub(m.lastIPCheck) >= alertPublicIPInterval {
+		m.lastIPCheck = now
+		if ip, err := detectPublicIPViaHTTP(); err != nil {
+			stunTurnLog.Warn.Printf("Public IP re-detection failed: %v", err)
+		} else {
+			m.detectedIP = ip
+		}
+	}
+	if m.detectedIP != "" && m.detectedIP != publicIP {
+		found["public-ip-changed"] = alertCondition{"public-ip-changed", "critical",
+			fmt.Sprintf("Public IP changed from %s to %s; relays are given out on the old address until the server restarts", publicIP, m.detectedIP)}
+	}
+	return found
 }
 
-func (c *CustomConn) Write(b []byte) (n int, err error) {
-	n, err = c.Conn.Write(b)
-	if err == nil && n > 0 {
-		stunTurnLogger.Printf("[%s] Sent %d bytes to %s", c.connID, n, c.RemoteAddr().String())
+// authFailuresLastMinute records the refused authentications counter and
+// returns how much it grew over the last minute
+func (m *alertManager) authFailuresLastMinute(count uint64, now time.Time) uint64 {
+	m.authSamples = append(m.authSamples, counterSample{at: now, count: count})
+	// The newest sample at least a minute old is the baseline
+	for len(m.authSamples) > 1 && now.Sub(m.authSamples[1].at) >= time.Minute {
+		m.authSamples = m.authSamples[1:]
+	}
+	return count - m.authSamples[0].count
+}
 
-		// Try to identify STUN/TURN message type
-		if n >= 20 { // Minimum STUN message size
-			messageType := getSTUNTURNMessageType(b[:n])
-			if messageType != "" {
-				stunTurnLogger.Printf("[%s] %s response to %s", c.connID, messageType, c.RemoteAddr().String())
-			}
+// transitions compares the conditions found with the alerts firing and
+// returns the alerts that start firing and those resolved, in key order
+func (m *alertManager) transitions(found map[string]alertCondition, now time.Time) []alert {
+	var changed []alert
+	for key, condition := range found {
+		if _, ok := m.firing[key]; ok {
+			continue
 		}
+		a := alert{
+			Rule:     condition.rule,
+			Key:      key,
+			Status:   "firing",
+			Severity: condition.severity,
+			Summary:  condition.summary,
+			Server:   publicIP,
+			Since:    now,
+			Time:     now,
+		}
+		m.firing[key] = a
+		changed = append(changed, a)
 	}
-	return n, err
+	for key, a := range m.firing {
+		if _, ok := found[key]; ok {
+			continue
+		}
+		delete(m.firing, key)
+		a.Status = "resolved"
+		a.Time = now
+		changed = append(changed, a)
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Key < changed[j].Key })
+	return changed
 }
 
-// getSTUNTURNMessageType attempts to identify STUN/TURN message types
-func getSTUNTURNMessageType(data []byte) string {
-	if len(data) < 20 {
-		return ""
+// deliverAlert logs an alert and sends it to -alert-webhook and
+// -alert-command in the background
+func deliverAlert(a alert) {
+	stunTurnLogger.Printf("ALERT %s %s: %s", a.Key, a.Status, a.Summary)
+	body, err := json.Marshal(a)
+	if err != nil {
+		stunTurnLog.Warn.Printf("Failed to encode alert %s: %v", a.Key, err)
+		return
 	}
-
-	// Check STUN magic cookie (0x2112A442)
-	if len(data) >= 4 && data[0] == 0x21 && data[1] == 0x12 && data[2] == 0xA4 && data[3] == 0x42 {
-		// Extract message type (bytes 4-5)
-		if len(data) >= 6 {
-			messageType := uint16(data[4])<<8 | uint16(data[5])
-			switch messageType {
-			case 0x0001:
-				return "STUN_BINDING_REQUEST"
-			case 0x0101:
-				return "STUN_BINDING_RESPONSE"
-			case 0x0111:
-				return "STUN_BINDING_ERROR_RESPONSE"
-			case 0x0003:
-				return "TURN_ALLOCATE_REQUEST"
-			case 0x0103:
-				return "TURN_ALLOCATE_RESPONSE"
-			case 0x0113:
-				return "TURN_ALLOCATE_ERROR_RESPONSE"
-			case 0x0004:
-				return "TURN_REFRESH_REQUEST"
-			case 0x0104:
-				return "TURN_REFRESH_RESPONSE"
-			case 0x0114:
-				return "TURN_REFRESH_ERROR_RESPONSE"
-			case 0x0006:
-				return "TURN_SEND_REQUEST"
-			case 0x0106:
-				return "TURN_SEND_RESPONSE"
-			case 0x0116:
-				return "TURN_SEND_ERROR_RESPONSE"
-			case 0x0007:
-				return "TURN_DATA_REQUEST"
-			case 0x0107:
-				return "TURN_DATA_RESPONSE"
-			case 0x0117:
-				return "TURN_DATA_ERROR_RESPONSE"
-			case 0x0008:
-				return "TURN_CREATE_PERMISSION_REQUEST"
-			case 0x0108:
-				return "TURN_CREATE_PERMISSION_RESPONSE"
-			case 0x0118:
-				return "TURN_CREATE_PERMISSION_ERROR_RESPONSE"
-			case 0x0009:
-				return "TURN_CHANNEL_BIND_REQUEST"
-			case 0x0109:
-				return "TURN_CHANNEL_BIND_RESPONSE"
-			case 0x0119:
-				return "TURN_CHANNEL_BIND_ERROR_RESPONSE"
-			default:
-				return fmt.Sprintf("UNKNOWN_STUNTURN_0x%04X", messageType)
+	if alertWebhook != "" {
+		go func() {
+			if err := postAlert(body); err != nil {
+				stunTurnLog.Warn.Printf("Failed to deliver alert %s to -alert-webhook: %v", a.Key, err)
 			}
-		}
+		}()
+	}
+	if alertCommand != "" {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), alertDeliveryTimeout)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, alertCommand)
+			cmd.Stdin = bytes.NewReader(body)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				stunTurnLog.Warn.Printf("-alert-command failed for alert %s: %v: %s", a.Key, err, strings.TrimSpace(string(output)))
+			}
+		}()
 	}
+}
 
-	return ""
+// postAlert POSTs an alert document to -alert-webhook
+func postAlert(body []byte) error {
+	client := &http.Client{Timeout: alertDeliveryTimeout}
+	resp, err := client.Post(alertWebhook, "application/json", bytes.NewReader(body))
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err // Without the URL, which holds the webhook's key
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
 }
 
 // ============================================================================
-// ENHANCED AUTHENTICATION HANDLER
+// METRICS ENDPOINT
 // ============================================================================
 
-// createEnhancedAuthHandler creates an authentication handler with comprehensive logging
-func createEnhancedAuthHandler(usersMap map[string][]byte) func(string, string, net.Addr) ([]byte, bool) {
-	logger := NewSTUNTurnLogger(stunTurnLogger)
-
-	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
-		stunTurnLogger.Printf("Authentication attempt for user: %s from %s (realm: %s)", username, srcAddr.String(), realm)
+// serveMetrics serves the server's counters in the Prometheus text format
+// at /metrics on addr, the drop list admin endpoint at /admin/droplist, the
+// signaling capture admin endpoints at /admin/capture (see webrtc/capture.go),
+// the live log tail at /admin/logs/stream, the debug buffer at
+// /admin/logs/debug, the status dashboard at
+// /admin/dashboard and the session and allocation lists at /admin/sessions
+// and /admin/allocations, where single users can also be kicked or revoked,
+// and the ban list at /admin/bans
+//
+// Like the gRPC API it is served without TLS, so bind it to an internal
+// interface (e.g. -metrics-addr=127.0.0.1:9100). The /admin/ endpoints and
+// /probe/relay require the admin token (see requireAdmin).
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("POST /probe/relay", requireAdmin(handleRelayProbe))
+	mux.HandleFunc("/admin/droplist", requireAdmin(handleDropList))
+	mux.HandleFunc("/admin/usage-report", requireAdmin(handleUsageReport))
+	mux.HandleFunc("/admin/logs/stream", requireAdmin(handleLogStream))
+	mux.HandleFunc("/admin/logs/debug", requireAdmin(handleLogDebug))
+	mux.HandleFunc("/admin/stats.json", requireAdmin(handleStatsJSON))
+	mux.HandleFunc("/admin/dashboard", requireAdmin(handleDashboard))
+	mux.HandleFunc("/admin/sessions", requireAdmin(handleSessions))
+	mux.HandleFunc("/admin/allocations", requireAdmin(handleAllocations))
+	mux.HandleFunc("DELETE /admin/sessions/{username}", requireAdmin(handleKickSession))
+	mux.HandleFunc("DELETE /admin/allocations/{username}", requireAdmin(handleRevokeAllocations))
+	mux.HandleFunc("/admin/bans", requireAdmin(handleBans))
+	mux.HandleFunc("DELETE /admin/bans/{id}", requireAdmin(handleRemoveBan))
+	handleCapture := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		webrtc.HandleCapture(w, r, signalingLogger)
+	})
+	mux.HandleFunc("/admin/capture", handleCapture)
+	mux.HandleFunc("/admin/capture/", handleCapture)
+	mux.HandleFunc("GET /admin/calls", requireAdmin(webrtc.HandleCalls))
+	mux.HandleFunc("GET /admin/calls/{callId}/events", requireAdmin(webrtc.HandleCallEvents))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		setComponentHealth(componentAdmin, componentFailed, err.Error())
+		return err
+	}
+	stunTurnLogger.Printf("Metrics endpoint listening on http://%s/metrics", addr)
+	registerListener("Metrics/admin", "HTTP", addr, 1)
+	setComponentHealth(componentAdmin, componentUp, "")
+	return http.Serve(listener, mux)
+}
 
-		if key, ok := usersMap[username]; ok {
-			logger.LogAuthentication(srcAddr, username, true)
-			return key, true
+// handleHealthz serves GET /healthz, 200 "ok" while the process runs,
+// followed by its build (see BUILD INFORMATION) and the status of each
+// component (see COMPONENT HEALTH):
+//
+//	ok
+//	version: 1.4.0
+//	commit: 3f9c2e1
+//	built: 2026-10-17T09:30:00Z
+//	stunturn-udp: up
+//	stunturn-tls: disabled (no TLS certificate: ...)
+//
+// With ?format=json, or a request that accepts application/json, the same
+// is a healthzReport document, with this server's ICE servers for the
+// siblings polling it (see PEER SERVERS).
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	info := buildInfo()
+	table := componentHealthTable()
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(healthzReport{
+			Status:     "ok",
+			Version:    info.Version,
+			Commit:     info.Commit,
+			Built:      info.BuildDate,
+			Components: table,
+			ICEServers: localICEServers(),
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "ok\nversion: %s\ncommit: %s\nbuilt: %s\n", info.Version, info.Commit, info.BuildDate)
+	for _, c := range table {
+		if c.Reason != "" {
+			fmt.Fprintf(w, "%s: %s (%s)\n", c.Name, c.Status, c.Reason)
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", c.Name, c.Status)
 		}
+	}
+}
 
-		logger.LogAuthentication(srcAddr, username, false)
-		return nil, false
+// healthzReport is the /healthz JSON document
+type healthzReport struct {
+	Status     string            `json:"status"` // Always "ok": the process runs
+	Version    string            `json:"version"`
+	Commit     string            `json:"commit"`
+	Built      string            `json:"built"`
+	Components []componentHealth `json:"components"`
+	ICEServers []iceServer       `json:"iceServers,omitempty"` // Without credentials, for -peer-servers polling
+}
+
+// handleReadyz serves GET /readyz for load balancers: 200 "ok", or 503
+// "starting" until every listener is up (see STARTUP RETRIES) and
+// "degraded" while -max-total-allocations is reached, followed by the
+// services this node runs (see runningServices):
+//
+//	ok
+//	stunturn: both
+//	signaling: enabled
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !startupComplete.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "starting")
+	} else if relayUsage.saturated() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "degraded")
+	} else {
+		fmt.Fprintln(w, "ok")
 	}
+	services := runningServices()
+	fmt.Fprintf(w, "stunturn: %s\nsignaling: %s\n", services.STUNTURN, services.Signaling)
 }
 
-// ============================================================================
-// CONNECTION MONITORING
-// ============================================================================
+// serviceStatus says which services a node runs
+type serviceStatus struct {
+	STUNTURN  string `json:"stunturn"`  // The -mode (stun, turn or both), or "disabled"
+	Signaling string `json:"signaling"` // "enabled" or "disabled"
+}
 
-// startConnectionMonitoring starts a goroutine to monitor active connections
-func startConnectionMonitoring() {
-	go func() {
-		ticker := time.NewTicker(60 * time.Second) // Log every minute
-		defer ticker.Stop()
+// runningServices returns the services this node runs, as set by -mode,
+// -enable-stunturn and -enable-signaling
+func runningServices() serviceStatus {
+	services := serviceStatus{STUNTURN: serverMode, Signaling: "enabled"}
+	if !stunturnEnabled {
+		services.STUNTURN = "disabled"
+	}
+	if !signalingEnabled {
+		services.Signaling = "disabled"
+	}
+	return services
+}
 
-		for {
-			select {
-			case <-ticker.C:
-				logConnectionStats()
-			}
+// writeMetrics writes every metric in the Prometheus text format
+func writeMetrics(w io.Writer) {
+	snapshots, untracked := responseLatency.snapshot()
+	fmt.Fprintln(w, "# HELP stunturn_response_latency_seconds Time from a STUN/TURN request to its response.")
+	fmt.Fprintln(w, "# TYPE stunturn_response_latency_seconds summary")
+	for _, s := range snapshots {
+		labels := fmt.Sprintf(`method=%q,transport=%q`, s.key.methodName(), s.key.transport)
+		fmt.Fprintf(w, "stunturn_response_latency_seconds{%s,quantile=\"0.5\"} %g\n", labels, s.p50.Seconds())
+		fmt.Fprintf(w, "stunturn_response_latency_seconds{%s,quantile=\"0.95\"} %g\n", labels, s.p95.Seconds())
+		fmt.Fprintf(w, "stunturn_response_latency_seconds{%s,quantile=\"0.99\"} %g\n", labels, s.p99.Seconds())
+		fmt.Fprintf(w, "stunturn_response_latency_seconds_count{%s} %d\n", labels, s.count)
+	}
+	fmt.Fprintln(w, "# HELP stunturn_orphaned_transactions_total STUN/TURN requests without a response within 5s.")
+	fmt.Fprintln(w, "# TYPE stunturn_orphaned_transactions_total counter")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "stunturn_orphaned_transactions_total{method=%q,transport=%q} %d\n", s.key.methodName(), s.key.transport, s.orphaned)
+	}
+	fmt.Fprintln(w, "# HELP stunturn_untracked_transactions_total STUN/TURN requests not timed because too many were pending.")
+	fmt.Fprintln(w, "# TYPE stunturn_untracked_transactions_total counter")
+	fmt.Fprintf(w, "stunturn_untracked_transactions_total %d\n", untracked)
+
+	fmt.Fprintln(w, "# HELP stunturn_inbound_packets_total UDP packets received by the STUN/TURN listeners, by class.")
+	fmt.Fprintln(w, "# TYPE stunturn_inbound_packets_total counter")
+	for _, class := range []struct {
+		name    string
+		classes []stunClass
+	}{
+		{"stunturn", []stunClass{stunClassControl, stunClassIndication}},
+		{"channeldata", []stunClass{stunClassChannelData}},
+		{"dtls", []stunClass{stunClassDTLS}},
+		{"unknown", []stunClass{stunClassUnknown}},
+	} {
+		var count uint64
+		for _, c := range class.classes {
+			count += inboundClassCounts[c].Load()
 		}
-	}()
-}
+		fmt.Fprintf(w, "stunturn_inbound_packets_total{class=%q} %d\n", class.name, count)
+	}
 
-// logConnectionStats logs current connection statistics
-func logConnectionStats() {
-	stunTurnLogger.Printf("=== CONNECTION STATISTICS ===")
-	stunTurnLogger.Printf("Time: %s", time.Now().Format("2006-01-02 15:04:05"))
-	stunTurnLogger.Printf("Active STUN/TURN servers: %d", countActiveSTUNTURNServers())
-	stunTurnLogger.Printf("Server status: RUNNING")
-	stunTurnLogger.Printf("=============================")
+	signalingStats := webrtc.Stats()
+	fmt.Fprintln(w, "# HELP signaling_messages_total Signaling messages received, by type.")
+	fmt.Fprintln(w, "# TYPE signaling_messages_total counter")
+	for _, messageType := range webrtc.MessageTypes() {
+		fmt.Fprintf(w, "signaling_messages_total{type=%q} %d\n", messageType, signalingStats.Messages[messageType])
+	}
+	fmt.Fprintf(w, "signaling_messages_total{type=\"unknown\"} %d\n", signalingStats.UnknownTypes)
+	fmt.Fprintln(w, "# HELP signaling_message_rate Signaling messages per second over the last complete minute, by type.")
+	fmt.Fprintln(w, "# TYPE signaling_message_rate gauge")
+	for _, messageType := range webrtc.MessageTypes() {
+		fmt.Fprintf(w, "signaling_message_rate{type=%q} %g\n", messageType, signalingStats.Rates[messageType])
+	}
+	fmt.Fprintf(w, "signaling_message_rate{type=\"unknown\"} %g\n", signalingStats.UnknownRate)
+	fmt.Fprintln(w, "# HELP signaling_parse_errors_total Signaling messages that couldn't be decoded.")
+	fmt.Fprintln(w, "# TYPE signaling_parse_errors_total counter")
+	fmt.Fprintf(w, "signaling_parse_errors_total %d\n", signalingStats.ParseErrors)
+	fmt.Fprintln(w, "# HELP signaling_invalid_payloads_total Offers, answers and candidates dropped for invalid data.")
+	fmt.Fprintln(w, "# TYPE signaling_invalid_payloads_total counter")
+	fmt.Fprintf(w, "signaling_invalid_payloads_total %d\n", signalingStats.InvalidData)
+	fmt.Fprintln(w, "# HELP signaling_bad_requests_total Signaling messages dropped for data too deeply nested, too big or of the wrong shape.")
+	fmt.Fprintln(w, "# TYPE signaling_bad_requests_total counter")
+	fmt.Fprintf(w, "signaling_bad_requests_total %d\n", signalingStats.BadRequests)
+	fmt.Fprintln(w, "# HELP signaling_unclassified_candidates_total Candidates -filter-host-candidates couldn't parse and forwarded.")
+	fmt.Fprintln(w, "# TYPE signaling_unclassified_candidates_total counter")
+	fmt.Fprintf(w, "signaling_unclassified_candidates_total %d\n", signalingStats.Unclassified)
+	payloadBytes, wireBytes := webrtc.SignalingByteStats()
+	fmt.Fprintln(w, "# HELP signaling_payload_bytes_total Signaling message bytes written, before compression and framing.")
+	fmt.Fprintln(w, "# TYPE signaling_payload_bytes_total counter")
+	fmt.Fprintf(w, "signaling_payload_bytes_total %d\n", payloadBytes)
+	fmt.Fprintln(w, "# HELP signaling_wire_bytes_total Signaling bytes that went out on the WebSocket connections, after compression and framing.")
+	fmt.Fprintln(w, "# TYPE signaling_wire_bytes_total counter")
+	fmt.Fprintf(w, "signaling_wire_bytes_total %d\n", wireBytes)
+	broadcasts := webrtc.Broadcasts()
+	fmt.Fprintln(w, "# HELP signaling_broadcasts_total User list changes and snapshots fanned out to the clients.")
+	fmt.Fprintln(w, "# TYPE signaling_broadcasts_total counter")
+	fmt.Fprintf(w, "signaling_broadcasts_total %d\n", broadcasts.Broadcasts)
+	fmt.Fprintln(w, "# HELP signaling_broadcast_skipped_total Clients skipped by a user list fan-out because their outbound queue was full.")
+	fmt.Fprintln(w, "# TYPE signaling_broadcast_skipped_total counter")
+	fmt.Fprintf(w, "signaling_broadcast_skipped_total %d\n", broadcasts.Skipped)
+	fmt.Fprintln(w, "# HELP signaling_broadcast_seconds How long the last user list fan-out took.")
+	fmt.Fprintln(w, "# TYPE signaling_broadcast_seconds gauge")
+	fmt.Fprintf(w, "signaling_broadcast_seconds %g\n", broadcasts.Last.Seconds())
+	fmt.Fprintln(w, "# HELP signaling_broadcast_max_seconds Longest user list fan-out since startup.")
+	fmt.Fprintln(w, "# TYPE signaling_broadcast_max_seconds gauge")
+	fmt.Fprintf(w, "signaling_broadcast_max_seconds %g\n", broadcasts.Max.Seconds())
+	fmt.Fprintln(w, "# HELP signaling_calls_total Calls that ended, by outcome and whether a relay candidate was forwarded.")
+	fmt.Fprintln(w, "# TYPE signaling_calls_total counter")
+	for _, outcome := range callOutcomeNames {
+		for _, relayed := range []bool{false, true} {
+			fmt.Fprintf(w, "signaling_calls_total{outcome=%q,relayed=\"%t\"} %d\n", outcome, relayed, callOutcomes.total(outcome, relayed))
+		}
+	}
+	calls := callOutcomes.today()
+	fmt.Fprintln(w, "# HELP signaling_calls_today Calls that ended today, by outcome.")
+	fmt.Fprintln(w, "# TYPE signaling_calls_today gauge")
+	for _, outcome := range callOutcomeNames {
+		fmt.Fprintf(w, "signaling_calls_today{outcome=%q} %d\n", outcome, calls.Outcomes[outcome])
+	}
+	fmt.Fprintln(w, "# HELP signaling_calls_answered_today Calls that ended today after being answered.")
+	fmt.Fprintln(w, "# TYPE signaling_calls_answered_today gauge")
+	fmt.Fprintf(w, "signaling_calls_answered_today %d\n", calls.Answered)
+	fmt.Fprintln(w, "# HELP signaling_calls_relayed_today Calls that ended today for which a relay candidate was forwarded.")
+	fmt.Fprintln(w, "# TYPE signaling_calls_relayed_today gauge")
+	fmt.Fprintf(w, "signaling_calls_relayed_today %d\n", calls.Relayed)
+	fmt.Fprintln(w, "# HELP signaling_call_success_ratio_today Completed share of today's calls, not counting transferred ones.")
+	fmt.Fprintln(w, "# TYPE signaling_call_success_ratio_today gauge")
+	fmt.Fprintf(w, "signaling_call_success_ratio_today %g\n", calls.SuccessRatio)
+
+	remoteLogWritersMu.Lock()
+	logWriters := append([]*remoteLogWriter(nil), remoteLogWriters...)
+	remoteLogWritersMu.Unlock()
+	fmt.Fprintln(w, "# HELP log_dropped_lines_total Log lines a remote log destination couldn't take.")
+	fmt.Fprintln(w, "# TYPE log_dropped_lines_total counter")
+	for _, lw := range logWriters {
+		fmt.Fprintf(w, "log_dropped_lines_total{destination=%q} %d\n", lw.name, lw.dropped.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP stunturn_allocations Open TURN relay allocations.")
+	fmt.Fprintln(w, "# TYPE stunturn_allocations gauge")
+	fmt.Fprintf(w, "stunturn_allocations %d\n", relayUsage.allocationCount())
+	fmt.Fprintln(w, "# HELP stunturn_allocations_created_total TURN relay allocations created.")
+	fmt.Fprintln(w, "# TYPE stunturn_allocations_created_total counter")
+	fmt.Fprintf(w, "stunturn_allocations_created_total %d\n", relayUsage.created.Load())
+	fmt.Fprintln(w, "# HELP stunturn_allocations_deleted_total TURN relay allocations deleted: refreshed with lifetime 0, expired or closed.")
+	fmt.Fprintln(w, "# TYPE stunturn_allocations_deleted_total counter")
+	fmt.Fprintf(w, "stunturn_allocations_deleted_total %d\n", relayUsage.deleted.Load())
+	fmt.Fprintln(w, "# HELP stunturn_allocations_refused_total TURN allocations refused at -max-total-allocations.")
+	fmt.Fprintln(w, "# TYPE stunturn_allocations_refused_total counter")
+	fmt.Fprintf(w, "stunturn_allocations_refused_total %d\n", relayUsage.refused.Load())
+
+	clients := clientClasses.today()
+	fmt.Fprintln(w, "# HELP stunturn_clients_today Distinct client IPs today: stun-only if they only sent binding requests, turn once they allocated.")
+	fmt.Fprintln(w, "# TYPE stunturn_clients_today gauge")
+	fmt.Fprintf(w, "stunturn_clients_today{class=\"stun-only\"} %d\n", clients.STUNOnly)
+	fmt.Fprintf(w, "stunturn_clients_today{class=\"turn\"} %d\n", clients.TURN)
+	fmt.Fprintln(w, "# HELP stunturn_clients_stun_only_ratio Share of today's classified client IPs that are STUN-only.")
+	fmt.Fprintln(w, "# TYPE stunturn_clients_stun_only_ratio gauge")
+	fmt.Fprintf(w, "stunturn_clients_stun_only_ratio %g\n", clients.STUNOnlyRatio)
+	fmt.Fprintln(w, "# HELP stunturn_clients_untracked_today Binding requests and allocations today from IPs not classified because the day's set was full.")
+	fmt.Fprintln(w, "# TYPE stunturn_clients_untracked_today gauge")
+	fmt.Fprintf(w, "stunturn_clients_untracked_today %d\n", clients.Untracked)
+
+	transports := clientTransports.thisHour()
+	fmt.Fprintln(w, "# HELP stunturn_transport_clients_this_hour Distinct client IPs this hour by the transport they used, e.g. UDP or TCP:80 for an extra port.")
+	fmt.Fprintln(w, "# TYPE stunturn_transport_clients_this_hour gauge")
+	for _, transport := range transports.transports() {
+		fmt.Fprintf(w, "stunturn_transport_clients_this_hour{transport=%q} %d\n", transport, transports.Clients[transport])
+	}
+	fmt.Fprintln(w, "# HELP stunturn_transport_clients_untracked_this_hour STUN/TURN requests this hour from IPs not counted because the hour's set was full.")
+	fmt.Fprintln(w, "# TYPE stunturn_transport_clients_untracked_this_hour gauge")
+	fmt.Fprintf(w, "stunturn_transport_clients_untracked_this_hour %d\n", transports.Untracked)
+
+	fmt.Fprintln(w, "# HELP stunturn_droplist_sources Sources whose packets are currently dropped.")
+	fmt.Fprintln(w, "# TYPE stunturn_droplist_sources gauge")
+	fmt.Fprintf(w, "stunturn_droplist_sources %d\n", len(sourceDropList.list()))
+	fmt.Fprintln(w, "# HELP stunturn_dropped_packets_total UDP packets discarded because their source is on the drop list.")
+	fmt.Fprintln(w, "# TYPE stunturn_dropped_packets_total counter")
+	fmt.Fprintf(w, "stunturn_dropped_packets_total %d\n", droppedPackets.Load())
+	if sourceGeoPolicy != nil {
+		fmt.Fprintln(w, "# HELP stunturn_geo_denied_total Packets and connections refused by the country/AS policy.")
+		fmt.Fprintln(w, "# TYPE stunturn_geo_denied_total counter")
+		for point, name := range geoPointNames {
+			fmt.Fprintf(w, "stunturn_geo_denied_total{point=%q} %d\n", name, sourceGeoPolicy.denied[point].Load())
+		}
+	}
 }
 
 // ============================================================================
 // ENHANCED STUN/TURN LOGGING
 // ============================================================================
 
-// STUNTurnLogger provides comprehensive logging for STUN/TURN server activity
+// STUNTurnLogger provides comprehensive logging for STUN/TURN server activity.
+// Each method logs at its own level (see LOG LEVELS): message, packet and
+// data traces at debug, connections, authentications and allocations at
+// info, failed authentications and refused connections at warn.
 type STUNTurnLogger struct {
-	logger *log.Logger
+	logger *leveledLogger
 }
 
 // NewSTUNTurnLogger creates a new STUN/TURN logger
-func NewSTUNTurnLogger(logger *log.Logger) *STUNTurnLogger {
+func NewSTUNTurnLogger(logger *leveledLogger) *STUNTurnLogger {
 	return &STUNTurnLogger{logger: logger}
 }
 
 // LogSTUNRequest logs STUN binding requests
 func (l *STUNTurnLogger) LogSTUNRequest(srcAddr net.Addr, messageType string) {
-	l.logger.Printf("STUN %s from %s", messageType, srcAddr.String())
+	l.logger.Debug.Printf("STUN %s from %s%s", messageType, srcAddr.String(), geoTag(srcAddr))
 }
 
 // LogSTUNResponse logs STUN binding responses
 func (l *STUNTurnLogger) LogSTUNResponse(dstAddr net.Addr, messageType string) {
-	l.logger.Printf("STUN %s to %s", messageType, dstAddr.String())
+	l.logger.Debug.Printf("STUN %s to %s", messageType, dstAddr.String())
 }
 
 // LogTURNRequest logs TURN requests (allocate, refresh, send, etc.)
 func (l *STUNTurnLogger) LogTURNRequest(srcAddr net.Addr, messageType string, username string) {
-	l.logger.Printf("TURN %s from %s (user: %s)", messageType, srcAddr.String(), username)
+	l.logger.Debug.Printf("TURN %s from %s%s (user: %s)", messageType, srcAddr.String(), geoTag(srcAddr), turnUser(username))
 }
 
 // LogTURNResponse logs TURN responses
 func (l *STUNTurnLogger) LogTURNResponse(dstAddr net.Addr, messageType string, username string) {
-	l.logger.Printf("TURN %s to %s (user: %s)", messageType, dstAddr.String(), username)
+	l.logger.Debug.Printf("TURN %s to %s (user: %s)", messageType, dstAddr.String(), turnUser(username))
+}
+
+// turnUser is the username logged with a TURN message, "unknown" when it
+// isn't known (yet), so the placeholder isn't redacted like a name
+func turnUser(username string) string {
+	if username == "" {
+		return "unknown"
+	}
+	return webrtc.RedactName(username)
 }
 
 // LogAuthentication logs authentication attempts
 func (l *STUNTurnLogger) LogAuthentication(srcAddr net.Addr, username string, success bool) {
 	if success {
-		l.logger.Printf("AUTH SUCCESS for user '%s' from %s", username, srcAddr.String())
+		l.logger.Info.Printf("AUTH SUCCESS for user '%s' from %s%s", webrtc.RedactName(username), srcAddr.String(), geoTag(srcAddr))
 	} else {
-		l.logger.Printf("AUTH FAILED for user '%s' from %s", username, srcAddr.String())
+		l.logger.Warn.Printf("AUTH FAILED for user '%s' from %s%s", webrtc.RedactName(username), srcAddr.String(), geoTag(srcAddr))
+	}
+}
+
+// LogMessage logs a STUN/TURN message read from (incoming) or written to
+// addr by one of the listener wrappers
+func (l *STUNTurnLogger) LogMessage(data []byte, addr net.Addr, incoming bool) {
+	traceAllocate(data, addr, incoming)
+	messageType := parseSTUNTURNMessage(data)
+	switch {
+	case isSTUNMessage(messageType) && incoming:
+		l.LogSTUNRequest(addr, messageType)
+	case isSTUNMessage(messageType):
+		l.LogSTUNResponse(addr, messageType)
+	case isTURNMessage(messageType) && incoming:
+		// For TURN messages, we'll log the request but username comes later in auth
+		l.LogTURNRequest(addr, messageType, "")
+	case isTURNMessage(messageType):
+		l.LogTURNResponse(addr, messageType, "")
 	}
 }
 
 // LogConnection logs new connections
 func (l *STUNTurnLogger) LogConnection(srcAddr net.Addr, protocol string) {
-	l.logger.Printf("New %s connection from %s", protocol, srcAddr.String())
+	l.logger.Info.Printf("New %s connection from %s%s", protocol, srcAddr.String(), geoTag(srcAddr))
 }
 
 // LogRelayAllocation logs relay allocation events
 func (l *STUNTurnLogger) LogRelayAllocation(srcAddr net.Addr, relayAddr net.Addr, username string) {
-	l.logger.Printf("Relay allocated for user '%s' from %s -> %s", username, srcAddr.String(), relayAddr.String())
+	l.logger.Info.Printf("Relay allocated for user '%s' from %s -> %s", webrtc.RedactName(username), srcAddr.String(), relayAddr.String())
+}
+
+// LogRelayRelease logs the end of a relay allocation and how long it lived.
+// relayAddr is nil for an allocation whose relay wasn't tracked.
+func (l *STUNTurnLogger) LogRelayRelease(srcAddr net.Addr, relayAddr net.Addr, username string, lifetime time.Duration) {
+	if relayAddr == nil {
+		l.logger.Info.Printf("Relay released for user '%s' from %s", webrtc.RedactName(username), srcAddr.String())
+		return
+	}
+	l.logger.Info.Printf("Relay released for user '%s' from %s -> %s after %s", webrtc.RedactName(username), srcAddr.String(), relayAddr.String(), lifetime.Round(time.Second))
 }
 
 // LogDataTransfer logs data transfer events
 func (l *STUNTurnLogger) LogDataTransfer(srcAddr net.Addr, dstAddr net.Addr, bytes int, protocol string) {
-	l.logger.Printf("%s data transfer: %s -> %s (%d bytes)", protocol, srcAddr.String(), dstAddr.String(), bytes)
+	l.logger.Debug.Printf("%s data transfer: %s -> %s (%d bytes)", protocol, srcAddr.String(), dstAddr.String(), bytes)
 }
 
 // ============================================================================
@@ -2572,37 +11337,83 @@ func (l *STUNTurnLogger) LogDataTransfer(srcAddr net.Addr, dstAddr net.Addr, byt
 // ============================================================================
 
 // LoggingPacketConn wraps a net.PacketConn to add comprehensive STUN/TURN logging
+//
+// PER-PACKET COST:
+// ================
+// Every relayed packet passes through here, so the common path must not
+// allocate: the counters are atomics, packets are classified by their
+// first bytes (ChannelData is recognised from one byte), and addresses are
+// only turned into strings when a line is actually logged. With
+// -log-packets=false a relayed packet costs a few atomic adds.
 type LoggingPacketConn struct {
 	net.PacketConn
-	logger *STUNTurnLogger
-	connID string
+	logger    *STUNTurnLogger
+	connID    string
+	transport string // Transport of the listener for the client counts, see transportLabel
+
+	// Counters for the connection statistics
+	packetsIn  atomic.Uint64
+	bytesIn    atomic.Uint64
+	packetsOut atomic.Uint64
+	bytesOut   atomic.Uint64
 }
 
-func NewLoggingPacketConn(conn net.PacketConn, logger *STUNTurnLogger, connID string) *LoggingPacketConn {
+func NewLoggingPacketConn(conn net.PacketConn, logger *STUNTurnLogger, connID, protocol string) *LoggingPacketConn {
 	return &LoggingPacketConn{
 		PacketConn: conn,
 		logger:     logger,
 		connID:     connID,
+		transport:  transportLabel(protocol, conn.LocalAddr()),
 	}
 }
 
 func (l *LoggingPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = l.PacketConn.ReadFrom(p)
+	for {
+		n, addr, err = l.PacketConn.ReadFrom(p)
+		if err != nil {
+			break
+		}
+		// Discard packets from flooding sources before the TURN server parses them
+		if sourceDropList.contains(addr) {
+			droppedPackets.Add(1)
+			continue
+		}
+		// And from sources the geo policy refuses
+		if sourceGeoPolicy.deniesAddr(addr, geoPointUDP) {
+			continue
+		}
+		// TCP relay requests are answered here, see refuseTCPRelay
+		if !l.answerTCPRelay(p[:n], addr) {
+			break
+		}
+	}
 	if err == nil && n > 0 {
-		// Log the raw packet first
-		l.logger.logger.Printf("[%s] Received %d bytes from %s", l.connID, n, addr.String())
+		l.packetsIn.Add(1)
+		l.bytesIn.Add(uint64(n))
+		class := classifySTUNTURN(p[:n])
+		inboundClassCounts[class].Add(1)
+
+		// Log the raw packet first; a source sending garbage is only
+		// logged for its first few packets, see unknownTrafficTracker
+		if class == stunClassUnknown {
+			if unknownTraffic.record(addr) && logPackets {
+				l.logger.logger.Debug.Printf("[%s] Received %d bytes of non-STUN data from %s%s", l.connID, n, addr.String(), geoTag(addr))
+			}
+		} else if logPackets {
+			l.logger.logger.Debug.Printf("[%s] Received %d bytes from %s", l.connID, n, addr.String())
+		}
 
-		// Try to identify and log STUN/TURN message type
-		if n >= 20 { // Minimum STUN message size
-			messageType := parseSTUNTURNMessage(p[:n])
-			if messageType != "" {
-				if isSTUNMessage(messageType) {
-					l.logger.LogSTUNRequest(addr, messageType)
-				} else if isTURNMessage(messageType) {
-					// For TURN messages, we'll log the request but username comes later in auth
-					l.logger.LogTURNRequest(addr, messageType, "unknown")
-				}
+		// Identify and log STUN/TURN messages; relayed data only with -log-packets
+		if class == stunClassControl {
+			if rewritten := enforceAllocationLifetime(p[:n], addr); rewritten != nil && len(rewritten) <= len(p) {
+				n = copy(p, rewritten)
 			}
+			responseLatency.observe(p[:n], "UDP", true)
+			clientClasses.observeBinding(p[:n], addr)
+			clientTransports.observe(addr, l.transport)
+		}
+		if class == stunClassControl || (class == stunClassIndication && logPackets) {
+			l.logger.LogMessage(p[:n], addr, true)
 		}
 	}
 	return n, addr, err
@@ -2611,105 +11422,583 @@ func (l *LoggingPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 func (l *LoggingPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	n, err = l.PacketConn.WriteTo(p, addr)
 	if err == nil && n > 0 {
+		l.packetsOut.Add(1)
+		l.bytesOut.Add(uint64(n))
+
 		// Log the raw packet first
-		l.logger.logger.Printf("[%s] Sent %d bytes to %s", l.connID, n, addr.String())
+		if logPackets {
+			l.logger.logger.Debug.Printf("[%s] Sent %d bytes to %s", l.connID, n, addr.String())
+		}
 
-		// Try to identify and log STUN/TURN message type
-		if n >= 20 { // Minimum STUN message size
-			messageType := parseSTUNTURNMessage(p[:n])
-			if messageType != "" {
-				if isSTUNMessage(messageType) {
-					l.logger.LogSTUNResponse(addr, messageType)
-				} else if isTURNMessage(messageType) {
-					l.logger.LogTURNResponse(addr, messageType, "unknown")
-				}
-			}
+		// Identify and log STUN/TURN messages; relayed data only with -log-packets
+		class := classifySTUNTURN(p[:n])
+		if class == stunClassControl {
+			responseLatency.observe(p[:n], "UDP", false)
+		}
+		if class == stunClassControl || (class == stunClassIndication && logPackets) {
+			l.logger.LogMessage(p[:n], addr, false)
 		}
 	}
 	return n, err
 }
 
+// answerTCPRelay answers a TCP relay request read from addr in place of
+// the TURN server (see refuseTCPRelay), and reports whether it did
+func (l *LoggingPacketConn) answerTCPRelay(data []byte, addr net.Addr) bool {
+	response := refuseTCPRelay(data, addr)
+	if response == nil {
+		return false
+	}
+	l.packetsIn.Add(1)
+	l.bytesIn.Add(uint64(len(data)))
+	l.logger.LogMessage(data, addr, true)
+	l.WriteTo(response, addr)
+	return true
+}
+
+// logStats writes the packet counters to the STUN/TURN log
+func (l *LoggingPacketConn) logStats() {
+	stunTurnLogger.Printf("[%s] UDP packets: %d in (%d bytes), %d out (%d bytes)",
+		l.connID, l.packetsIn.Load(), l.bytesIn.Load(), l.packetsOut.Load(), l.bytesOut.Load())
+}
+
+// wrapProxyProtocol makes a STUN/TURN listener understand PROXY protocol v1
+// and v2 headers when -proxy-protocol is set, so RemoteAddr is the real
+// client address. Allowlisted load balancers may send a header; a header
+// from any other source fails the connection, since it could be spoofed.
+func wrapProxyProtocol(listener net.Listener) net.Listener {
+	if proxyProtocolPolicy == nil {
+		return listener
+	}
+	return &proxyproto.Listener{
+		Listener:          listener,
+		ConnPolicy:        proxyProtocolPolicy,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
 // LoggingListener wraps a net.Listener to add connection logging
 type LoggingListener struct {
 	net.Listener
-	logger *STUNTurnLogger
-	connID string
+	logger    *STUNTurnLogger
+	connID    string
+	protocol  string // "TCP" or "TLS", used in logs and connection statistics
+	transport string // Transport for the client counts, see transportLabel
 }
 
-func NewLoggingListener(listener net.Listener, logger *STUNTurnLogger, connID string) *LoggingListener {
+func NewLoggingListener(listener net.Listener, logger *STUNTurnLogger, connID, protocol string) *LoggingListener {
 	return &LoggingListener{
-		Listener: listener,
-		logger:   logger,
-		connID:   connID,
+		Listener:  listener,
+		logger:    logger,
+		connID:    connID,
+		protocol:  protocol,
+		transport: transportLabel(protocol, listener.Addr()),
 	}
 }
 
 func (l *LoggingListener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
-	if err == nil {
-		l.logger.LogConnection(conn.RemoteAddr(), "TCP")
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		if proxyProtocolPolicy == nil && (sourceDropList.contains(conn.RemoteAddr()) ||
+			sourceGeoPolicy.deniesAddr(conn.RemoteAddr(), geoPointStream)) {
+			// Returning an error would stop the TURN server's accept loop
+			conn.Close()
+			continue
+		}
 
-		// Wrap the connection to log data transfer
-		conn = &LoggingConn{
-			Conn:   conn,
-			logger: l.logger,
-			connID: l.connID,
+		// Wrap the connection to log data transfer and its teardown
+		loggingConn := &LoggingConn{
+			Conn:      conn,
+			logger:    l.logger,
+			connID:    l.connID,
+			protocol:  l.protocol,
+			transport: l.transport,
+			accepted:  time.Now(),
+		}
+		connStatsFor(l.protocol).opened()
+
+		if proxyProtocolPolicy != nil {
+			// RemoteAddr waits for the PROXY header, which mustn't hold up
+			// Accept, so the per-IP limit closes the connection afterwards
+			go func() {
+				if sourceDropList.contains(conn.RemoteAddr()) {
+					loggingConn.setCloseReason("source on drop list")
+					loggingConn.Close()
+					return
+				}
+				if sourceGeoPolicy.deniesAddr(conn.RemoteAddr(), geoPointStream) {
+					loggingConn.setCloseReason("refused by geo policy")
+					loggingConn.Close()
+					return
+				}
+				if loggingConn.admit() {
+					l.logger.LogConnection(conn.RemoteAddr(), l.protocol)
+				}
+			}()
+		} else if loggingConn.admit() {
+			l.logger.LogConnection(conn.RemoteAddr(), l.protocol)
+		} else {
+			// Returning an error would stop the TURN server's accept loop
+			continue
 		}
+
+		// Close connections that never speak STUN, go idle or live too long
+		return NewTimeoutConn(loggingConn), nil
 	}
-	return conn, err
 }
 
-// LoggingConn wraps a net.Conn to add data transfer logging
+// LoggingConn wraps a net.Conn to add data transfer logging. When the
+// connection closes it logs one summary line with its duration, byte totals,
+// STUN/TURN message count and why it closed.
 type LoggingConn struct {
 	net.Conn
-	logger *STUNTurnLogger
-	connID string
+	logger    *STUNTurnLogger
+	connID    string
+	protocol  string
+	transport string
+	accepted  time.Time
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	messages atomic.Uint64 // STUN/TURN control messages read
+
+	closeOnce   sync.Once
+	mu          sync.Mutex
+	closeReason string // Why the connection ended, first cause wins
+	sourceIP    string // Source IP counted against the per-IP limit, if any
+	closed      bool   // Whether Close has run, so a late admit releases its count
 }
 
 func (l *LoggingConn) Read(b []byte) (n int, err error) {
-	n, err = l.Conn.Read(b)
+	for {
+		n, err = l.Conn.Read(b)
+		// TCP relay requests are answered here, see refuseTCPRelay
+		if err != nil || n == 0 || !l.answerTCPRelay(b[:n]) {
+			break
+		}
+	}
+	if n > 0 {
+		l.bytesIn.Add(uint64(n))
+	}
+	if err != nil {
+		// Only the first cause counts: after a timeout or server close the
+		// pending read fails too, and that mustn't overwrite the real reason
+		if errors.Is(err, io.EOF) {
+			l.setCloseReason("client EOF")
+		} else {
+			l.setCloseReason(fmt.Sprintf("error: %v", err))
+		}
+	}
 	if err == nil && n > 0 {
-		l.logger.logger.Printf("[%s] Received %d bytes from %s", l.connID, n, l.RemoteAddr().String())
-
-		// Try to identify STUN/TURN message type
-		if n >= 20 {
-			messageType := parseSTUNTURNMessage(b[:n])
-			if messageType != "" {
-				if isSTUNMessage(messageType) {
-					l.logger.LogSTUNRequest(l.RemoteAddr(), messageType)
-				} else if isTURNMessage(messageType) {
-					l.logger.LogTURNRequest(l.RemoteAddr(), messageType, "unknown")
-				}
+		if logPackets {
+			l.logger.logger.Debug.Printf("[%s] Received %d bytes from %s", l.connID, n, l.RemoteAddr().String())
+		}
+		if class := classifySTUNTURN(b[:n]); class == stunClassControl {
+			l.messages.Add(1)
+			if rewritten := enforceAllocationLifetime(b[:n], l.RemoteAddr()); rewritten != nil && len(rewritten) <= len(b) {
+				n = copy(b, rewritten)
 			}
+			responseLatency.observe(b[:n], l.protocol, true)
+			clientClasses.observeBinding(b[:n], l.RemoteAddr())
+			clientTransports.observe(l.RemoteAddr(), l.transport)
+			l.logger.LogMessage(b[:n], l.RemoteAddr(), true)
+		} else if class == stunClassIndication && logPackets {
+			l.logger.LogMessage(b[:n], l.RemoteAddr(), true)
 		}
 	}
 	return n, err
 }
 
+// answerTCPRelay answers a TCP relay request read from the connection in
+// place of the TURN server (see refuseTCPRelay), and reports whether it did
+func (l *LoggingConn) answerTCPRelay(data []byte) bool {
+	response := refuseTCPRelay(data, l.RemoteAddr())
+	if response == nil {
+		return false
+	}
+	l.bytesIn.Add(uint64(len(data)))
+	l.messages.Add(1)
+	l.logger.LogMessage(data, l.RemoteAddr(), true)
+	l.Write(response)
+	return true
+}
+
 func (l *LoggingConn) Write(b []byte) (n int, err error) {
 	n, err = l.Conn.Write(b)
+	if n > 0 {
+		l.bytesOut.Add(uint64(n))
+	}
+	if err != nil {
+		l.setCloseReason(fmt.Sprintf("error: %v", err))
+	}
 	if err == nil && n > 0 {
-		l.logger.logger.Printf("[%s] Sent %d bytes to %s", l.connID, n, l.RemoteAddr().String())
+		if logPackets {
+			l.logger.logger.Debug.Printf("[%s] Sent %d bytes to %s", l.connID, n, l.RemoteAddr().String())
+		}
+		class := classifySTUNTURN(b[:n])
+		if class == stunClassControl {
+			responseLatency.observe(b[:n], l.protocol, false)
+		}
+		if class == stunClassControl || (class == stunClassIndication && logPackets) {
+			l.logger.LogMessage(b[:n], l.RemoteAddr(), false)
+		}
+	}
+	return n, err
+}
 
-		// Try to identify STUN/TURN message type
-		if n >= 20 {
-			messageType := parseSTUNTURNMessage(b[:n])
-			if messageType != "" {
-				if isSTUNMessage(messageType) {
-					l.logger.LogSTUNResponse(l.RemoteAddr(), messageType)
-				} else if isTURNMessage(messageType) {
-					l.logger.LogTURNResponse(l.RemoteAddr(), messageType, "unknown")
-				}
-			}
+// Close closes the connection and logs its summary, once
+func (l *LoggingConn) Close() error {
+	l.setCloseReason("server close")
+	err := l.Conn.Close()
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		reason := l.closeReason
+		sourceIP := l.sourceIP
+		l.sourceIP = ""
+		l.closed = true
+		l.mu.Unlock()
+		if sourceIP != "" {
+			tcpConnsPerIP.release(sourceIP)
+			streamConns.Delete(l.RemoteAddr().String())
+		}
+		duration := time.Since(l.accepted)
+		l.logger.logger.Info.Printf("[%s] %s connection from %s%s closed: %s (duration %s, %d bytes in, %d bytes out, %d STUN/TURN messages)",
+			l.connID, l.protocol, l.RemoteAddr().String(), geoTag(l.RemoteAddr()), reason, duration.Round(time.Millisecond),
+			l.bytesIn.Load(), l.bytesOut.Load(), l.messages.Load())
+		connStatsFor(l.protocol).closed(reason, duration, l.bytesIn.Load(), l.bytesOut.Load(), l.messages.Load())
+	})
+	return err
+}
+
+// admit counts the connection against its source IP's limit. Over the limit
+// it logs the offending IP, closes the connection and returns false.
+func (l *LoggingConn) admit() bool {
+	ip := l.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !tcpConnsPerIP.acquire(ip) {
+		l.logger.logger.Warn.Printf("[%s] %s connection limit exceeded for %s (%d connections), closing connection",
+			l.connID, l.protocol, ip, maxTCPConnsPerIP)
+		l.setCloseReason("connection limit exceeded")
+		l.Close()
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		// Closed while waiting for the PROXY header; Close had nothing to release
+		tcpConnsPerIP.release(ip)
+	} else {
+		l.sourceIP = ip
+		streamConns.Store(l.RemoteAddr().String(), l)
+	}
+	return true
+}
+
+// setCloseReason records why the connection ended unless a reason is known
+func (l *LoggingConn) setCloseReason(reason string) {
+	l.mu.Lock()
+	if l.closeReason == "" {
+		l.closeReason = reason
+	}
+	l.mu.Unlock()
+}
+
+// ============================================================================
+// TCP/TLS CONNECTION STATISTICS
+// ============================================================================
+
+// connStats aggregates the connection summaries of one protocol for the
+// periodic connection statistics
+type connStats struct {
+	active   atomic.Int64
+	total    atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	messages atomic.Uint64
+
+	mu       sync.Mutex
+	duration time.Duration     // Total duration of closed connections
+	reasons  map[string]uint64 // Closed connections by reason category
+}
+
+var (
+	tcpConnStats = &connStats{reasons: make(map[string]uint64)}
+	tlsConnStats = &connStats{reasons: make(map[string]uint64)}
+)
+
+// connStatsFor returns the statistics of a listener protocol
+func connStatsFor(protocol string) *connStats {
+	if protocol == "TLS" {
+		return tlsConnStats
+	}
+	return tcpConnStats
+}
+
+func (s *connStats) opened() {
+	s.active.Add(1)
+	s.total.Add(1)
+}
+
+func (s *connStats) closed(reason string, duration time.Duration, bytesIn, bytesOut, messages uint64) {
+	s.active.Add(-1)
+	s.bytesIn.Add(bytesIn)
+	s.bytesOut.Add(bytesOut)
+	s.messages.Add(messages)
+
+	// Group by the kind of reason; error and timeout details vary per connection
+	category, _, _ := strings.Cut(reason, ":")
+	category, _, _ = strings.Cut(category, " (")
+	s.mu.Lock()
+	s.duration += duration
+	s.reasons[category]++
+	s.mu.Unlock()
+}
+
+// log writes the statistics of one protocol to the STUN/TURN log
+func (s *connStats) log(protocol string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closed := s.total.Load() - uint64(s.active.Load())
+	average := time.Duration(0)
+	if closed > 0 {
+		average = s.duration / time.Duration(closed)
+	}
+	stunTurnLogger.Printf("%s connections: %d active, %d total, %d bytes in, %d bytes out, %d STUN/TURN messages, average duration %s",
+		protocol, s.active.Load(), s.total.Load(), s.bytesIn.Load(), s.bytesOut.Load(), s.messages.Load(), average.Round(time.Second))
+	if len(s.reasons) > 0 {
+		reasons := make([]string, 0, len(s.reasons))
+		for reason, count := range s.reasons {
+			reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+		}
+		sort.Strings(reasons)
+		stunTurnLogger.Printf("%s connections closed by: %s", protocol, strings.Join(reasons, ", "))
+	}
+}
+
+// ipConnCounter counts live TCP/TLS STUN/TURN connections per source IP,
+// across both protocols, and enforces -max-tcp-conns-per-ip
+type ipConnCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// tcpConnsPerIP holds the live connection counts of the TCP/TLS listeners
+var tcpConnsPerIP = &ipConnCounter{counts: make(map[string]int)}
+
+// acquire counts a new connection from ip, unless ip is at the limit
+func (c *ipConnCounter) acquire(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if maxTCPConnsPerIP > 0 && c.counts[ip] >= maxTCPConnsPerIP {
+		return false
+	}
+	c.counts[ip]++
+	return true
+}
+
+// release uncounts a closed connection from ip
+func (c *ipConnCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[ip] <= 1 {
+		delete(c.counts, ip)
+		return
+	}
+	c.counts[ip]--
+}
+
+// top returns up to n source IPs with the most live connections, as
+// "ip=count" with the busiest first
+func (c *ipConnCounter) top(n int) []string {
+	c.mu.Lock()
+	ips := make([]string, 0, len(c.counts))
+	counts := make(map[string]int, len(c.counts))
+	for ip, count := range c.counts {
+		ips = append(ips, ip)
+		counts[ip] = count
+	}
+	c.mu.Unlock()
+
+	sort.Slice(ips, func(i, j int) bool {
+		if counts[ips[i]] != counts[ips[j]] {
+			return counts[ips[i]] > counts[ips[j]]
+		}
+		return ips[i] < ips[j]
+	})
+	if len(ips) > n {
+		ips = ips[:n]
+	}
+	for i, ip := range ips {
+		ips[i] = fmt.Sprintf("%s=%d", ip, counts[ip])
+	}
+	return ips
+}
+
+// ============================================================================
+// TCP/TLS CONNECTION LIMITS
+// ============================================================================
+
+// TimeoutConn closes a TCP/TLS STUN/TURN connection that holds a file
+// descriptor without doing anything useful
+//
+// LIMITS:
+// =======
+// - Handshake timeout: no valid STUN message within the timeout → close
+// - Idle timeout: no data read or written within the timeout → close
+// - Max lifetime: optional absolute limit on how long a connection stays open
+//
+// A single timer per connection checks the limits, so reads and writes only
+// record the time; the connection's own read/write deadlines are untouched.
+// The closure is logged by the LoggingConn summary with a "timeout" reason.
+type TimeoutConn struct {
+	*LoggingConn
+
+	lastActivity atomic.Int64 // Unix nanoseconds of the last read or write
+
+	mu         sync.Mutex
+	sawSTUN    bool   // Whether a valid STUN message header has been read
+	stunPrefix []byte // First bytes read, until a STUN header can be checked
+	timer      *time.Timer
+}
+
+// NewTimeoutConn wraps an accepted connection and starts enforcing the
+// -turn-tcp-* limits
+func NewTimeoutConn(conn *LoggingConn) *TimeoutConn {
+	c := &TimeoutConn{LoggingConn: conn}
+	c.lastActivity.Store(conn.accepted.UnixNano())
+	c.mu.Lock()
+	c.timer = time.AfterFunc(c.nextCheck(time.Now()), c.check)
+	c.mu.Unlock()
+	return c
+}
+
+func (c *TimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.LoggingConn.Read(b)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+		c.mu.Lock()
+		if !c.sawSTUN && len(c.stunPrefix) < 8 {
+			c.stunPrefix = append(c.stunPrefix, b[:min(n, 8-len(c.stunPrefix))]...)
+			c.sawSTUN = isSTUNHeader(c.stunPrefix)
 		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *TimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.LoggingConn.Write(b)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
 	}
 	return n, err
 }
 
+func (c *TimeoutConn) Close() error {
+	c.mu.Lock()
+	c.timer.Stop()
+	c.mu.Unlock()
+	return c.LoggingConn.Close()
+}
+
+// nextCheck returns how long until the earliest limit could be reached.
+// Must be called with c.mu held.
+func (c *TimeoutConn) nextCheck(now time.Time) time.Duration {
+	next := time.Duration(math.MaxInt64)
+	if !c.sawSTUN && turnTCPHandshakeTimeout > 0 {
+		next = min(next, c.accepted.Add(turnTCPHandshakeTimeout).Sub(now))
+	}
+	if turnTCPIdleTimeout > 0 {
+		last := time.Unix(0, c.lastActivity.Load())
+		next = min(next, last.Add(turnTCPIdleTimeout).Sub(now))
+	}
+	if turnTCPMaxLifetime > 0 {
+		next = min(next, c.accepted.Add(turnTCPMaxLifetime).Sub(now))
+	}
+	return max(next, 0)
+}
+
+// check closes the connection if a limit was reached, otherwise it waits
+// for the next one
+func (c *TimeoutConn) check() {
+	now := time.Now()
+	c.mu.Lock()
+	reason := ""
+	switch {
+	case !c.sawSTUN && turnTCPHandshakeTimeout > 0 && now.Sub(c.accepted) >= turnTCPHandshakeTimeout:
+		reason = fmt.Sprintf("no STUN message within %s", turnTCPHandshakeTimeout)
+	case turnTCPMaxLifetime > 0 && now.Sub(c.accepted) >= turnTCPMaxLifetime:
+		reason = fmt.Sprintf("reached max lifetime of %s", turnTCPMaxLifetime)
+	case turnTCPIdleTimeout > 0 && now.Sub(time.Unix(0, c.lastActivity.Load())) >= turnTCPIdleTimeout:
+		reason = fmt.Sprintf("idle for %s", turnTCPIdleTimeout)
+	}
+	if reason == "" {
+		c.timer.Reset(c.nextCheck(now))
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	// The summary is logged when the connection closes
+	c.setCloseReason("timeout (" + reason + ")")
+	c.LoggingConn.Close()
+}
+
+// isSTUNHeader reports whether b starts with a STUN message header: the two
+// top bits are zero and bytes 4-8 hold the magic cookie (RFC 5389)
+func isSTUNHeader(b []byte) bool {
+	return len(b) >= 8 && b[0]&0xC0 == 0 && binary.BigEndian.Uint32(b[4:8]) == 0x2112A442
+}
+
 // ============================================================================
 // STUN/TURN MESSAGE PARSING
 // ============================================================================
 
+// stunClass is the kind of packet a STUN/TURN listener sees
+type stunClass int
+
+const (
+	stunClassUnknown     stunClass = iota // Not STUN/TURN, ChannelData or DTLS (scans, garbage)
+	stunClassDTLS                         // DTLS record, e.g. a client using the port for media by mistake
+	stunClassChannelData                  // TURN ChannelData: relayed data on a bound channel
+	stunClassIndication                   // STUN indication, e.g. TURN Send/Data carrying relayed data
+	stunClassControl                      // STUN request, success or error response
+	stunClassCount                        // Number of classes, for counter arrays
+)
+
+// classifySTUNTURN tells the kind of a packet from its first bytes, without
+// allocating, so the wrappers can skip the relayed data cheaply
+//
+// FRAMING:
+// ========
+//   - ChannelData starts with a channel number 0x4000-0x4FFF (RFC 8656),
+//     followed by a length that must fit in the packet
+//   - DTLS records start with a content type of 20-63 (RFC 7983)
+//   - STUN messages start with bits 00 and carry the magic cookie at bytes
+//     4-7. The class is two bits spread over the type (0x0110 mask):
+//     00 request, 01 indication, 10 success response, 11 error response.
+func classifySTUNTURN(data []byte) stunClass {
+	if len(data) >= 4 && data[0] >= 0x40 && data[0] <= 0x4F && int(binary.BigEndian.Uint16(data[2:4])) <= len(data)-4 {
+		return stunClassChannelData
+	}
+	if len(data) >= 13 && data[0] >= 20 && data[0] <= 63 {
+		return stunClassDTLS
+	}
+	if len(data) < 20 || !isSTUNHeader(data) {
+		return stunClassUnknown
+	}
+	if binary.BigEndian.Uint16(data[0:2])&0x0110 == 0x0010 {
+		return stunClassIndication
+	}
+	return stunClassControl
+}
+
 // parseSTUNTURNMessage attempts to parse STUN/TURN message types from raw data
 func parseSTUNTURNMessage(data []byte) string {
 	if len(data) < 20 {
@@ -2726,57 +12015,77 @@ func parseSTUNTURNMessage(data []byte) string {
 	return ""
 }
 
-// getMessageTypeName returns the human-readable name for STUN/TURN message types
+// Message classes, the two class bits of a STUN message type (RFC 5389
+// section 6)
+const (
+	messageClassRequest    = 0
+	messageClassIndication = 1
+	messageClassSuccess    = 2
+	messageClassError      = 3
+)
+
+// messageMethod names a STUN/TURN method and the classes it exists in
+type messageMethod struct {
+	name        string // e.g. "TURN_ALLOCATE"
+	requests    bool   // Sent as requests, answered with success or error responses
+	indications bool   // Sent as indications
+}
+
+// messageMethods are the methods of STUN (RFC 5389), TURN (RFC 5766) and TURN
+// TCP relaying (RFC 6062) by number. Send and Data, and ConnectionAttempt,
+// are indications only; Binding may be either.
+var messageMethods = map[uint16]messageMethod{
+	0x001: {"STUN_BINDING", true, true},
+	0x003: {"TURN_ALLOCATE", true, false},
+	0x004: {"TURN_REFRESH", true, false},
+	0x006: {"TURN_SEND", false, true},
+	0x007: {"TURN_DATA", false, true},
+	0x008: {"TURN_CREATE_PERMISSION", true, false},
+	0x009: {"TURN_CHANNEL_BIND", true, false},
+	0x00A: {"TURN_CONNECT", true, false},
+	0x00B: {"TURN_CONNECTION_BIND", true, false},
+	0x00C: {"TURN_CONNECTION_ATTEMPT", false, true},
+}
+
+// decodeMessageType splits a 14-bit STUN message type into its method and
+// class. The class bits C1 and C0 sit at bits 8 and 4, between the method
+// bits M11-M7, M6-M4 and M3-M0 (RFC 5389 section 6).
+func decodeMessageType(messageType uint16) (method uint16, class uint16) {
+	method = messageType&0x000F | (messageType&0x00E0)>>1 | (messageType&0x3E00)>>2
+	class = (messageType&0x0010)>>4 | (messageType&0x0100)>>7
+	return method, class
+}
+
+// getMessageTypeName returns the human-readable name for STUN/TURN message
+// types: the method followed by the class, e.g. TURN_ALLOCATE_REQUEST,
+// TURN_ALLOCATE_RESPONSE (success), TURN_ALLOCATE_ERROR_RESPONSE or
+// TURN_DATA_INDICATION. A known method in a class it doesn't exist in, such
+// as a Send request, is named TURN_INVALID_SEND_REQUEST, and unknown
+// methods UNKNOWN_STUNTURN_0x<type>.
 func getMessageTypeName(messageType uint16) string {
-	switch messageType {
-	// STUN Methods
-	case 0x0001:
-		return "STUN_BINDING_REQUEST"
-	case 0x0101:
-		return "STUN_BINDING_RESPONSE"
-	case 0x0111:
-		return "STUN_BINDING_ERROR_RESPONSE"
-
-	// TURN Methods
-	case 0x0003:
-		return "TURN_ALLOCATE_REQUEST"
-	case 0x0103:
-		return "TURN_ALLOCATE_RESPONSE"
-	case 0x0113:
-		return "TURN_ALLOCATE_ERROR_RESPONSE"
-	case 0x0004:
-		return "TURN_REFRESH_REQUEST"
-	case 0x0104:
-		return "TURN_REFRESH_RESPONSE"
-	case 0x0114:
-		return "TURN_REFRESH_ERROR_RESPONSE"
-	case 0x0006:
-		return "TURN_SEND_REQUEST"
-	case 0x0106:
-		return "TURN_SEND_RESPONSE"
-	case 0x0116:
-		return "TURN_SEND_ERROR_RESPONSE"
-	case 0x0007:
-		return "TURN_DATA_REQUEST"
-	case 0x0107:
-		return "TURN_DATA_RESPONSE"
-	case 0x0117:
-		return "TURN_DATA_ERROR_RESPONSE"
-	case 0x0008:
-		return "TURN_CREATE_PERMISSION_REQUEST"
-	case 0x0108:
-		return "TURN_CREATE_PERMISSION_RESPONSE"
-	case 0x0118:
-		return "TURN_CREATE_PERMISSION_ERROR_RESPONSE"
-	case 0x0009:
-		return "TURN_CHANNEL_BIND_REQUEST"
-	case 0x0109:
-		return "TURN_CHANNEL_BIND_RESPONSE"
-	case 0x0119:
-		return "TURN_CHANNEL_BIND_ERROR_RESPONSE"
-	default:
+	method, class := decodeMessageType(messageType)
+	m, known := messageMethods[method]
+	if !known {
 		return fmt.Sprintf("UNKNOWN_STUNTURN_0x%04X", messageType)
 	}
+	suffix := ""
+	valid := m.requests
+	switch class {
+	case messageClassRequest:
+		suffix = "REQUEST"
+	case messageClassIndication:
+		suffix, valid = "INDICATION", m.indications
+	case messageClassSuccess:
+		suffix = "RESPONSE"
+	case messageClassError:
+		suffix = "ERROR_RESPONSE"
+	}
+	if !valid {
+		// Keep the STUN_/TURN_ prefix, so the message is still logged as such
+		protocol, name, _ := strings.Cut(m.name, "_")
+		return protocol + "_INVALID_" + name + "_" + suffix
+	}
+	return m.name + "_" + suffix
 }
 
 // isSTUNMessage checks if a message type is a STUN message
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestMain gives the tests the loggers main would have set up
+func TestMain(m *testing.M) {
+	discard := log.New(io.Discard, "", 0)
+	stunTurnLog = &leveledLogger{Debug: discard, Info: discard, Warn: discard, Error: discard}
+	stunTurnLogger = stunTurnLog.Info
+	signalingLog = stunTurnLog
+	signalingLogger = stunTurnLogger
+	os.Exit(m.Run())
+}
+
+// syncBuffer collects log lines written from several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the STUN/TURN log lines of every level to a buffer
+// until the test ends
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	saved, savedInfo := stunTurnLog, stunTurnLogger
+	t.Cleanup(func() { stunTurnLog, stunTurnLogger = saved, savedInfo })
+	out := &syncBuffer{}
+	logger := log.New(out, "", 0)
+	stunTurnLog = &leveledLogger{Debug: logger, Info: logger, Warn: logger, Error: logger}
+	stunTurnLogger = logger
+	return out
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pion/stun/v3"
+)
+
+// readCapture returns the packet of a FuzzParseSTUNTURN seed corpus file
+func readCapture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "fuzz", "FuzzParseSTUNTURN", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	quoted, ok := strings.CutPrefix(value, "[]byte(")
+	if !ok {
+		t.Fatalf("%s: not a []byte corpus entry", name)
+	}
+	packet, err := strconv.Unquote(strings.TrimSuffix(quoted, ")"))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return []byte(packet)
+}
+
+// The captured requests, responses and indications are named by method and
+// class, and what isn't STUN isn't named at all
+func TestMessageTypeCaptures(t *testing.T) {
+	for capture, want := range map[string]string{
+		"binding_request":          "STUN_BINDING_REQUEST",
+		"binding_success":          "STUN_BINDING_RESPONSE",
+		"binding_indication":       "STUN_BINDING_INDICATION",
+		"allocate_unauthenticated": "TURN_ALLOCATE_REQUEST",
+		"allocate_unauthorized":    "TURN_ALLOCATE_ERROR_RESPONSE",
+		"allocate_authenticated":   "TURN_ALLOCATE_REQUEST",
+		"refresh":                  "TURN_REFRESH_REQUEST",
+		"create_permission":        "TURN_CREATE_PERMISSION_REQUEST",
+		"channel_bind":             "TURN_CHANNEL_BIND_REQUEST",
+		"send_indication":          "TURN_SEND_INDICATION",
+		"data_indication":          "TURN_DATA_INDICATION",
+		"connect":                  "TURN_CONNECT_REQUEST",
+		"connection_bind":          "TURN_CONNECTION_BIND_REQUEST",
+		"channel_data":             "",
+		"dtls_client_hello":        "",
+		"http_get":                 "",
+		"truncated_header":         "",
+	} {
+		if got := parseSTUNTURNMessage(readCapture(t, capture)); got != want {
+			t.Errorf("%s: parsed as %q, want %q", capture, got, want)
+		}
+	}
+}
+
+// Headers of the messages the corpus has no capture of: responses and
+// RFC 6062 messages, methods in a class they don't exist in, and unknown
+// methods
+func TestMessageTypeHeaders(t *testing.T) {
+	const rest = "00002112a442" + "5a1f039c44217e10b208d36f" // Length, magic cookie, transaction ID
+	for messageType, want := range map[string]string{
+		"0111": "STUN_BINDING_ERROR_RESPONSE",
+		"0103": "TURN_ALLOCATE_RESPONSE",
+		"0104": "TURN_REFRESH_RESPONSE",
+		"0114": "TURN_REFRESH_ERROR_RESPONSE",
+		"0108": "TURN_CREATE_PERMISSION_RESPONSE",
+		"0119": "TURN_CHANNEL_BIND_ERROR_RESPONSE",
+		"010a": "TURN_CONNECT_RESPONSE",
+		"011a": "TURN_CONNECT_ERROR_RESPONSE",
+		"010b": "TURN_CONNECTION_BIND_RESPONSE",
+		"001c": "TURN_CONNECTION_ATTEMPT_INDICATION",
+		// Send and Data used to be named as requests and responses
+		"0006": "TURN_INVALID_SEND_REQUEST",
+		"0106": "TURN_INVALID_SEND_RESPONSE",
+		"0007": "TURN_INVALID_DATA_REQUEST",
+		"0117": "TURN_INVALID_DATA_ERROR_RESPONSE",
+		"0013": "TURN_INVALID_ALLOCATE_INDICATION",
+		"000c": "TURN_INVALID_CONNECTION_ATTEMPT_REQUEST",
+		"0002": "UNKNOWN_STUNTURN_0x0002",
+		"3eef": "UNKNOWN_STUNTURN_0x3EEF",
+	} {
+		packet, err := hex.DecodeString(messageType + rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := parseSTUNTURNMessage(packet)
+		if got != want {
+			t.Errorf("0x%s: parsed as %q, want %q", messageType, got, want)
+		}
+		// Invalid classes still count as STUN or TURN traffic
+		if strings.HasPrefix(want, "TURN_") != isTURNMessage(got) || strings.HasPrefix(want, "STUN_") != isSTUNMessage(got) {
+			t.Errorf("0x%s: %q counted as the wrong protocol", messageType, got)
+		}
+	}
+
+	// Without the magic cookie it is an RFC 3489 message or not STUN at all
+	packet, _ := hex.DecodeString("00010000" + "a442211a" + "5a1f039c44217e10b208d36f")
+	if got := parseSTUNTURNMessage(packet); got != "" {
+		t.Errorf("message without the magic cookie parsed as %q", got)
+	}
+}
+
+// Every 14-bit message type is split into the method and class pion/stun
+// reads from it
+func TestDecodeMessageType(t *testing.T) {
+	for value := range uint16(0x4000) {
+		var want stun.MessageType
+		want.ReadValue(value)
+		method, class := decodeMessageType(value)
+		if method != uint16(want.Method) || class != uint16(want.Class) {
+			t.Fatalf("0x%04X: method 0x%03X class %d, want method 0x%03X class %d", value, method, class, want.Method, want.Class)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// usePorts sets the main ports and -port-fallback until the test ends
+func usePorts(t *testing.T, port, tlsPort, fallback int) {
+	t.Helper()
+	savedPort, savedTLS, savedFallback := stunturnPort, stunturnTLSPort, portFallback
+	t.Cleanup(func() { stunturnPort, stunturnTLSPort, portFallback = savedPort, savedTLS, savedFallback })
+	stunturnPort, stunturnTLSPort, portFallback = port, tlsPort, fallback
+}
+
+// freeRun returns the first of n consecutive ports free over UDP and TCP
+func freeRun(t *testing.T, n int) int {
+	t.Helper()
+	for range 20 {
+		base, err := anyFreePort(true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		free := true
+		for port := base + 1; port < base+n && free; port++ {
+			free = probePort(port, true, true) == nil
+		}
+		if free && base+n <= 65535 {
+			return base
+		}
+	}
+	t.Fatalf("no %d consecutive free ports", n)
+	return 0
+}
+
+// takeUDP holds a port over UDP until the test ends
+func takeUDP(t *testing.T, port int) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "0.0.0.0:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+}
+
+func TestBindErrorTakenPort(t *testing.T) {
+	base := freeRun(t, 1)
+	takeUDP(t, base)
+	err := probePort(base, true, false)
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("probing a taken port: %v, want EADDRINUSE", err)
+	}
+	for _, want := range []string{"UDP port " + strconv.Itoa(base) + " is already in use", "-port-fallback"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q doesn't say %q", err, want)
+		}
+	}
+}
+
+// With -port-fallback the STUN/TURN port moves to the next free one,
+// skipping the TLS port, and the move is logged
+func TestChoosePortsFallback(t *testing.T) {
+	logs := captureLogs(t)
+	base := freeRun(t, 4)
+	takeUDP(t, base)
+
+	usePorts(t, base, base+1, 3)
+	if err := choosePorts(true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if stunturnPort != base+2 {
+		t.Fatalf("moved to %d, want %d past the TLS port", stunturnPort, base+2)
+	}
+	want := "STUN/TURN port " + strconv.Itoa(base) + " is in use, listening on " + strconv.Itoa(base+2)
+	if !strings.Contains(logs.String(), want) {
+		t.Fatalf("logged %q, want %q", logs.String(), want)
+	}
+
+	// Without -port-fallback the port is left for the bind to fail on
+	usePorts(t, base, base+1, 0)
+	if err := choosePorts(true, false, false); err != nil || stunturnPort != base {
+		t.Fatalf("without -port-fallback: port %d, %v; want %d, nil", stunturnPort, err, base)
+	}
+}
+
+func TestChoosePortsNoneFree(t *testing.T) {
+	base := freeRun(t, 3)
+	for port := base; port < base+3; port++ {
+		takeUDP(t, port)
+	}
+	usePorts(t, base, 0, 2)
+	err := choosePorts(true, false, false)
+	if err == nil || !strings.Contains(err.Error(), "no free port in") || !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("every port taken: %v", err)
+	}
+}
+
+// A taken port stops the startup with the bind error, and the listeners
+// bound before it are closed
+func TestTakenPortClosesListeners(t *testing.T) {
+	base := freeRun(t, 1)
+	listener, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, err = startServers(serverConfig{Mode: modeBoth, PublicIP: integrationPublicIP, STUNTURNPort: base, TURNUsers: "alice=secret", Realm: "pion.ly"})
+	if err == nil || !strings.Contains(err.Error(), "TCP port "+strconv.Itoa(base)+" is already in use") {
+		t.Fatalf("start on a taken TCP port: %v", err)
+	}
+	if n := countActiveSTUNTURNServers(); n != 0 {
+		t.Fatalf("%d servers left running", n)
+	}
+	// The UDP listener bound before the TCP one failed is gone
+	takeUDP(t, base)
+	startIntegrationServers(t)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// udpComponentStatus returns the stunturn-udp status and reason of a fresh
+// componentHealthTable
+func udpComponentStatus(t *testing.T) (string, string) {
+	t.Helper()
+	for _, c := range componentHealthTable() {
+		if c.Name == componentUDP {
+			return c.Status, c.Reason
+		}
+	}
+	t.Fatalf("no %s component", componentUDP)
+	return "", ""
+}
+
+// A UDP listener whose socket is closed out from under the TURN server
+// degrades stunturn-udp until the supervisor reopens it, and then serves
+// bindings and allocations on the same port again
+func TestSuperviseUDPListenerReopens(t *testing.T) {
+	logs := captureLogs(t)
+	useComponentHealth(t, componentUDP, componentUp, "")
+	server := startIntegrationServers(t).STUNTURNAddr()
+
+	udpSocketsMu.Lock()
+	if len(udpSupervised) != 1 {
+		udpSocketsMu.Unlock()
+		t.Fatalf("%d supervised UDP listeners, want 1", len(udpSupervised))
+	}
+	listener := udpSupervised[0]
+	udpSocketsMu.Unlock()
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+
+	listener.mu.Lock()
+	socket := listener.conn
+	listener.mu.Unlock()
+	socket.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		listener.mu.Lock()
+		failure := listener.failure
+		listener.mu.Unlock()
+		if failure != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the read loop didn't notice the closed socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "UDP listener UDP-0 failed") {
+		t.Fatalf("failure not logged:\n%s", logs)
+	}
+
+	// A socket that can't be reopened degrades the component and is
+	// retried on the next check
+	reopen := listener.reopen
+	listener.reopen = func() (net.PacketConn, error) { return nil, errors.New("interface gone") }
+	superviseUDPListeners()
+	if problem := udpListenerProblem(); !strings.Contains(problem, "UDP-0 failed") || !strings.Contains(problem, "couldn't be reopened: interface gone") {
+		t.Fatalf("problem %q, want the failure and the reopen error", problem)
+	}
+	if status, reason := udpComponentStatus(t); status != componentDegraded || !strings.Contains(reason, "interface gone") {
+		t.Fatalf("%s is %s (%s), want %s", componentUDP, status, reason, componentDegraded)
+	}
+	if !strings.Contains(logs.String(), "WARNING: UDP listener UDP-0 failed") {
+		t.Fatalf("problem not logged:\n%s", logs)
+	}
+
+	listener.reopen = reopen
+	superviseUDPListeners()
+	if problem := udpListenerProblem(); problem != "" {
+		t.Fatalf("problem %q after the reopen", problem)
+	}
+	if status, reason := udpComponentStatus(t); status != componentUp {
+		t.Fatalf("%s is %s (%s), want %s", componentUDP, status, reason, componentUp)
+	}
+	for _, want := range []string{"UDP listener UDP-0 reopened on", "UDP listener UDP-0 is working again"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("%q not logged:\n%s", want, logs)
+		}
+	}
+	if got := listener.LocalAddr().(*net.UDPAddr).Port; got != port {
+		t.Fatalf("reopened on port %d, want %d", got, port)
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	checkBindingAndAllocation(t, server, conn, conn.LocalAddr())
+}
+
+// A listener whose heartbeats stop between two checks without a read error
+// is reported as stuck
+func TestSuperviseUDPListenerStuck(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener := &supervisedPacketConn{connID: "UDP-9", conn: conn, replaced: make(chan struct{})}
+	defer listener.Close()
+
+	listener.beats.Add(1)
+	if problem := listener.supervise(); problem != "" {
+		t.Fatalf("problem %q for a listener that beat", problem)
+	}
+	if problem := listener.supervise(); problem != "UDP-9 stopped reading" {
+		t.Fatalf("problem %q, want UDP-9 stopped reading", problem)
+	}
+	listener.beats.Add(1)
+	if problem := listener.supervise(); problem != "" {
+		t.Fatalf("problem %q once it beat again", problem)
+	}
+
+	listener.Close()
+	if problem := listener.supervise(); problem != "" {
+		t.Fatalf("problem %q for a closed listener", problem)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// errNoSyslog is why syslog: log destinations can't be used, nil where
+// they can
+var errNoSyslog = fmt.Errorf("syslog is not available on %s", runtime.GOOS)
+
+// openSyslog fails: log/syslog doesn't exist on this platform
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return nil, errNoSyslog
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// errNoSyslog is why syslog: log destinations can't be used, nil where
+// they can
+var errNoSyslog error
+
+// openSyslog connects to the local syslog daemon, facility LOCAL0, for a
+// syslog:tag log destination
+func openSyslog(tag string) (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTCPLimits sets the -turn-tcp-* limits for one test
+func setTCPLimits(t *testing.T, handshake, idle, lifetime time.Duration) {
+	t.Helper()
+	savedHandshake, savedIdle, savedLifetime := turnTCPHandshakeTimeout, turnTCPIdleTimeout, turnTCPMaxLifetime
+	t.Cleanup(func() {
+		turnTCPHandshakeTimeout, turnTCPIdleTimeout, turnTCPMaxLifetime = savedHandshake, savedIdle, savedLifetime
+	})
+	turnTCPHandshakeTimeout, turnTCPIdleTimeout, turnTCPMaxLifetime = handshake, idle, lifetime
+}
+
+// newPipeTimeoutConn wraps the server end of a pipe in a TimeoutConn that
+// reads everything the client writes, and returns the client end
+func newPipeTimeoutConn(t *testing.T) net.Conn {
+	t.Helper()
+	server, client := net.Pipe()
+	conn := NewTimeoutConn(&LoggingConn{
+		Conn:     server,
+		logger:   NewSTUNTurnLogger(stunTurnLog),
+		connID:   "test",
+		protocol: "TCP",
+		accepted: time.Now(),
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(io.Discard, conn)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// stunBindingRequest returns a Binding request header with no attributes
+func stunBindingRequest() []byte {
+	msg := make([]byte, 20)
+	binary.BigEndian.PutUint16(msg[0:2], 0x0001)
+	binary.BigEndian.PutUint32(msg[4:8], 0x2112A442)
+	copy(msg[8:], "transaction1")
+	return msg
+}
+
+// waitClosed waits for the connection summary to be logged and returns how
+// long it took
+func waitClosed(t *testing.T, logs *syncBuffer, start time.Time) time.Duration {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if strings.Contains(logs.String(), " closed: ") {
+			return time.Since(start)
+		}
+	}
+	t.Fatal("connection was not closed")
+	return 0
+}
+
+// A connection that never sends a STUN message is closed after the
+// handshake timeout
+func TestTimeoutConnHandshake(t *testing.T) {
+	logs := captureLogs(t)
+	setTCPLimits(t, 50*time.Millisecond, 0, 0)
+	start := time.Now()
+	client := newPipeTimeoutConn(t)
+
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if elapsed := waitClosed(t, logs, start); elapsed < 50*time.Millisecond {
+		t.Fatalf("closed after %s, before the handshake timeout", elapsed)
+	}
+	if !strings.Contains(logs.String(), "closed: timeout (no STUN message within 50ms)") ||
+		!strings.Contains(logs.String(), "16 bytes in, 0 bytes out") {
+		t.Fatalf("summary missing handshake reason or byte counts:\n%s", logs)
+	}
+}
+
+// Once a STUN message is read the handshake timeout no longer applies, and
+// the connection is closed when it goes idle
+func TestTimeoutConnIdle(t *testing.T) {
+	logs := captureLogs(t)
+	setTCPLimits(t, 50*time.Millisecond, 150*time.Millisecond, 0)
+	client := newPipeTimeoutConn(t)
+
+	if _, err := client.Write(stunBindingRequest()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	start := time.Now()
+	if elapsed := waitClosed(t, logs, start); elapsed < 140*time.Millisecond {
+		t.Fatalf("closed after %s, before the idle timeout", elapsed)
+	}
+	if !strings.Contains(logs.String(), "closed: timeout (idle for 150ms)") ||
+		!strings.Contains(logs.String(), "20 bytes in, 0 bytes out, 1 STUN/TURN messages") {
+		t.Fatalf("summary missing idle reason or counters:\n%s", logs)
+	}
+}
+
+// Activity keeps a connection from going idle, but not past its max
+// lifetime
+func TestTimeoutConnMaxLifetime(t *testing.T) {
+	logs := captureLogs(t)
+	setTCPLimits(t, 0, 100*time.Millisecond, 300*time.Millisecond)
+	start := time.Now()
+	client := newPipeTimeoutConn(t)
+
+	go func() {
+		for {
+			if _, err := client.Write([]byte{0}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	if elapsed := waitClosed(t, logs, start); elapsed < 300*time.Millisecond {
+		t.Fatalf("closed after %s, before the max lifetime", elapsed)
+	}
+	if !strings.Contains(logs.String(), "closed: timeout (reached max lifetime of 300ms)") {
+		t.Fatalf("summary missing lifetime reason:\n%s", logs)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/stun/v3"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// useTurnTracer records the TURN Allocate spans in memory until the test
+// ends
+func useTurnTracer(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	saved := turnTracer
+	t.Cleanup(func() {
+		turnTracer = saved
+		allocateSpansMu.Lock()
+		clear(allocateSpans)
+		allocateSpansMu.Unlock()
+	})
+	turnTracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("go-server/turn")
+	return recorder
+}
+
+// stunMessage builds a message of method and class answering or repeating
+// transaction, with the given attributes
+func stunMessage(t *testing.T, method stun.Method, class stun.MessageClass, transaction [stun.TransactionIDSize]byte, setters ...stun.Setter) []byte {
+	t.Helper()
+	msg, err := stun.Build(append([]stun.Setter{stun.NewType(method, class), stun.NewTransactionIDSetter(transaction)}, setters...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Raw
+}
+
+// spanIntAttribute returns a span's integer attribute, -1 without it
+func spanIntAttribute(span sdktrace.ReadOnlySpan, key string) int64 {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value.AsInt64()
+		}
+	}
+	return -1
+}
+
+// An Allocate transaction is one span from the request to its response; the
+// 401 challenge isn't an error, other error responses are, and other
+// methods aren't traced
+func TestTraceAllocate(t *testing.T) {
+	recorder := useTurnTracer(t)
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	cases := []struct {
+		name      string
+		class     stun.MessageClass
+		errorCode stun.ErrorCode
+		status    codes.Code
+	}{
+		{"challenge", stun.ClassErrorResponse, stun.CodeUnauthorized, codes.Unset},
+		{"refused", stun.ClassErrorResponse, stun.CodeAllocQuotaReached, codes.Error},
+		{"allocated", stun.ClassSuccessResponse, 0, codes.Unset},
+	}
+	for i, c := range cases {
+		transaction := stun.NewTransactionID()
+		request := stunMessage(t, stun.MethodAllocate, stun.ClassRequest, transaction, stun.NewUsername("alice"))
+		traceAllocate(request, client, true)
+		// A retransmission is part of the same span
+		traceAllocate(request, client, true)
+		// A response to another client with the same transaction ID isn't its end
+		other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 50000}
+		traceAllocate(stunMessage(t, stun.MethodAllocate, stun.ClassSuccessResponse, transaction), other, false)
+		if ended := len(recorder.Ended()); ended != i {
+			t.Fatalf("%s: %d spans ended before the response, want %d", c.name, ended, i)
+		}
+
+		var setters []stun.Setter
+		if c.errorCode != 0 {
+			setters = append(setters, c.errorCode)
+		}
+		traceAllocate(stunMessage(t, stun.MethodAllocate, c.class, transaction, setters...), client, false)
+		spans := recorder.Ended()
+		if len(spans) != i+1 {
+			t.Fatalf("%s: %d spans ended, want %d", c.name, len(spans), i+1)
+		}
+		span := spans[i]
+		if span.Name() != "TURN Allocate" || span.Status().Code != c.status {
+			t.Fatalf("%s: span %q with status %v, want \"TURN Allocate\" with %v", c.name, span.Name(), span.Status(), c.status)
+		}
+		wantCode := int64(c.errorCode)
+		if c.errorCode == 0 {
+			wantCode = -1
+		}
+		if got := spanIntAttribute(span, "turn.error_code"); got != wantCode {
+			t.Fatalf("%s: turn.error_code %d, want %d", c.name, got, wantCode)
+		}
+	}
+
+	binding := stun.NewTransactionID()
+	traceAllocate(stunMessage(t, stun.MethodBinding, stun.ClassRequest, binding), client, true)
+	traceAllocate(stunMessage(t, stun.MethodBinding, stun.ClassSuccessResponse, binding), client, false)
+	if ended := len(recorder.Ended()); ended != len(cases) {
+		t.Fatalf("%d spans after a Binding transaction, want %d", ended, len(cases))
+	}
+}
+
+// Allocating through the running server traces the challenge and the
+// allocation, measured where the packets are logged
+func TestTraceAllocateIntegration(t *testing.T) {
+	recorder := useTurnTracer(t)
+	server := startIntegrationServers(t).STUNTURNAddr()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	checkBindingAndAllocation(t, server, conn, conn.LocalAddr())
+
+	var allocates []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "TURN Allocate" {
+			allocates = append(allocates, span)
+		}
+	}
+	if len(allocates) != 2 {
+		t.Fatalf("%d Allocate spans, want the challenge and the allocation", len(allocates))
+	}
+	if spanIntAttribute(allocates[0], "turn.error_code") != int64(stun.CodeUnauthorized) || spanIntAttribute(allocates[1], "turn.error_code") != -1 {
+		t.Fatal("want a 401 challenge span then a successful one")
+	}
+	for _, span := range allocates {
+		if span.Status().Code == codes.Error {
+			t.Fatalf("Allocate span with error status %v", span.Status())
+		}
+	}
+}
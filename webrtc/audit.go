@@ -0,0 +1,37 @@
+/*
+WebRTC Signaling Admin Audit Hook
+=================================
+
+This file lets the embedding server record the administrative actions taken
+through the signaling package's admin endpoints (see capture.go) in its
+audit log.
+
+WHY IS THIS NEEDED?
+===================
+Starting a capture records a user's full signaling traffic, so who did it
+and when has to end up in the same tamper-evident record as every other
+admin action. The package doesn't own that log; the server passes in a
+function that writes to it.
+*/
+
+package webrtc
+
+// AuditFunc records one admin action: what was done, the address of the
+// admin request and action-specific details
+type AuditFunc func(action, remoteAddr string, details map[string]string)
+
+// auditAction is the current audit function, set once at startup by
+// ConfigureAudit; nil records nothing
+var auditAction AuditFunc
+
+// ConfigureAudit sets the function admin actions are reported to
+func ConfigureAudit(fn AuditFunc) {
+	auditAction = fn
+}
+
+// audit reports an admin action if an audit function is configured
+func audit(action, remoteAddr string, details map[string]string) {
+	if auditAction != nil {
+		auditAction(action, remoteAddr, details)
+	}
+}
@@ -0,0 +1,40 @@
+/*
+WebRTC Signaling Ban Hook
+=========================
+
+This file lets the embedding server refuse banned clients and usernames
+before they can use the signaling service.
+
+WHY IS THIS NEEDED?
+===================
+The server keeps one ban list for TURN and signaling (see BAN LIST in
+main.go), persisted across restarts. The package doesn't own that list; the
+server passes in a function that consults it and records the hit.
+
+WHERE BANS ARE CHECKED:
+=======================
+- "websocket": the client IP, before the WebSocket upgrade (403)
+- "sse": the client IP, before a new SSE session is opened (403)
+- "join": the username and client IP of every join, on any transport; the
+  join is refused with the error "banned"
+*/
+
+package webrtc
+
+// BanFunc reports whether a client is banned. username is empty for the
+// checks made before a join; check names where the check is made.
+type BanFunc func(username, clientIP, check string) bool
+
+// banCheck is the current ban function, set once at startup by
+// ConfigureBans; nil bans nobody
+var banCheck BanFunc
+
+// ConfigureBans sets the function clients are checked against
+func ConfigureBans(fn BanFunc) {
+	banCheck = fn
+}
+
+// isBanned reports whether a client is banned if a ban function is configured
+func isBanned(username, clientIP, check string) bool {
+	return banCheck != nil && banCheck(username, clientIP, check)
+}
@@ -0,0 +1,421 @@
+/*
+WebRTC Signaling Presence Broadcasts
+====================================
+
+This file implements the fan-out of active user list changes to every
+connected client.
+
+WHY IS THIS NEEDED?
+===================
+Originally every join, leave, call and hangup sent the entire user list to
+every client, synchronously, from the handler that caused the change. With
+2,000 connected users that is 2,000 messages of 2,000 entries per event, and
+a single client with a full TCP window stalled the broadcast for everyone.
+
+HOW IT WORKS:
+=============
+1. Registry.Broadcast compares the current user list with the last one
+   it broadcast and queues a job with the differences to a single worker.
+2. The worker copies the list of recipients under the registry's read lock
+   and releases it, so joins and disconnects never wait for a fan-out.
+3. A pool of broadcastWorkers goroutines hands the job to the recipients'
+   presence queues, each taking a share of them. This never blocks: each
+   session has its own writer goroutine draining its queue. A session whose
+   outbound queue (see outbound.go) is already full is skipped; it gets a
+   fresh snapshot once its writer has caught up.
+4. How long the fan-out took and how many sessions were skipped is kept for
+   the metrics endpoint (see BroadcastStats), and logged when the fan-out
+   took longer than slowBroadcast or skipped sessions.
+5. v1 clients get the full "activeUsers" list, as before. Only the newest
+   list matters, so a backed up v1 queue just keeps the latest one.
+6. v2 clients get deltas instead:
+     {"type":"userAdded","data":{"name":"bob","inCall":false,"status":"available"}}
+     {"type":"userUpdated","data":{"name":"bob","inCall":true,"status":"available"}}
+     {"type":"userRemoved","data":{"name":"bob"}}
+   plus a full "activeUsers" snapshot when they join, periodically for
+   resync, and whenever their queue overflows.
+
+Clients should apply userAdded and userUpdated as upserts and userRemoved as
+an idempotent delete: a snapshot is taken when it is written, so a delta that
+follows it may already be reflected in it.
+*/
+
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Presence broadcast configuration defaults
+const (
+	DefaultPresenceSnapshotInterval = 60 * time.Second      // Full list resync for v2 clients
+	presenceQueueLimit              = 256                   // Deltas queued per session before falling back to a snapshot
+	DefaultBroadcastWorkers         = 8                     // Goroutines fanning a broadcast out to sessions
+	broadcastShareMin               = 64                    // Fewest sessions a fan-out worker is handed at once
+	slowBroadcast                   = 50 * time.Millisecond // Fan-outs taking longer are logged
+)
+
+var (
+	// Presence settings, set once at startup by ConfigurePresence and
+	// ConfigureBroadcastWorkers
+	presenceSnapshotInterval = DefaultPresenceSnapshotInterval
+	broadcastWorkers         = DefaultBroadcastWorkers
+
+	// Fan-out measurements since startup, see BroadcastStats
+	broadcastCount    atomic.Uint64
+	broadcastSkipped  atomic.Uint64
+	broadcastLastNano atomic.Int64
+	broadcastMaxNano  atomic.Int64
+)
+
+// broadcastJob is a single change to the user list, ready to be fanned out
+type broadcastJob struct {
+	full   SignalingMessage   // Full list for v1 clients
+	deltas []SignalingMessage // Changes for v2 clients
+	resync bool               // Send v2 clients a full snapshot instead of deltas
+}
+
+// presenceQueue holds the broadcast messages waiting to be written to one
+// session, drained by that session's writer goroutine.
+type presenceQueue struct {
+	mu       sync.Mutex
+	pending  []SignalingMessage
+	resync   bool // Send a fresh snapshot before anything else
+	deferred bool // Resync skipped while the outbound queue was full
+	wake     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// ConfigurePresence sets how often v2 clients receive a full user list
+// snapshot to resync their delta state. 0 disables periodic snapshots.
+func ConfigurePresence(snapshotInterval time.Duration) {
+	presenceSnapshotInterval = snapshotInterval
+}
+
+// ConfigureBroadcastWorkers sets how many goroutines fan each user list
+// change out to the sessions. Values below 1 mean 1.
+func ConfigureBroadcastWorkers(workers int) {
+	broadcastWorkers = max(workers, 1)
+}
+
+// BroadcastStats describes how user list changes were fanned out
+type BroadcastStats struct {
+	Broadcasts uint64        // Changes fanned out since startup, periodic snapshots included
+	Skipped    uint64        // Sessions skipped since startup because their outbound queue was full
+	Last       time.Duration // How long the last fan-out took
+	Max        time.Duration // Longest fan-out since startup
+}
+
+// Broadcasts returns the fan-out measurements since startup
+func Broadcasts() BroadcastStats {
+	return BroadcastStats{
+		Broadcasts: broadcastCount.Load(),
+		Skipped:    broadcastSkipped.Load(),
+		Last:       time.Duration(broadcastLastNano.Load()),
+		Max:        time.Duration(broadcastMaxNano.Load()),
+	}
+}
+
+// newPresenceQueue creates the presence queue of a new session, starting
+// with a snapshot so the client learns the current list. For v1 sessions the
+// full list broadcast that follows the join replaces it.
+func newPresenceQueue() *presenceQueue {
+	q := &presenceQueue{
+		resync: true,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	q.wake <- struct{}{}
+	return q
+}
+
+// startPresence starts writing the session's presence queue. It is called
+// after the join response so no broadcast can overtake it.
+func (u *UserSession) startPresence(signalingLogger *log.Logger) {
+	u.service.registry.writers.Add(1)
+	go func() {
+		defer u.service.registry.writers.Done()
+		u.presenceWriter(signalingLogger)
+	}()
+}
+
+// stopPresence stops the session's presence writer. Safe to call more than once.
+func (u *UserSession) stopPresence() {
+	if u.presence == nil {
+		return
+	}
+	u.presence.stopOnce.Do(func() {
+		close(u.presence.done)
+	})
+}
+
+// requestResync makes the writer send a fresh snapshot, used when queued
+// broadcasts had to be dropped
+func (q *presenceQueue) requestResync() {
+	q.mu.Lock()
+	q.resync = true
+	q.pending = nil
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deferResync makes the session get a fresh snapshot instead of a job it
+// was skipped for, once its outbound writer has caught up (see resume)
+func (q *presenceQueue) deferResync() {
+	q.mu.Lock()
+	q.resync = true
+	q.deferred = true
+	q.pending = nil
+	q.mu.Unlock()
+}
+
+// resume wakes the presence writer if a resync was deferred while the
+// outbound queue was full; called by the outbound writer once it has
+// written what was queued
+func (q *presenceQueue) resume() {
+	q.mu.Lock()
+	deferred := q.deferred
+	q.deferred = false
+	q.mu.Unlock()
+	if !deferred {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queuePresence adds a broadcast job to the session's queue without blocking
+func (u *UserSession) queuePresence(job broadcastJob) {
+	q := u.presence
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	if q.deferred {
+		// Still waiting for the outbound queue to drain; the snapshot
+		// sent then covers this job too
+		q.mu.Unlock()
+		return
+	}
+	switch {
+	case u.Version < ProtocolV2:
+		// v1 clients only care about the newest full list
+		q.pending = append(q.pending[:0], job.full)
+		q.resync = false
+	case job.resync || q.resync:
+		q.resync = true
+		q.pending = nil
+	default:
+		q.pending = append(q.pending, job.deltas...)
+		if len(q.pending) > presenceQueueLimit {
+			// Too far behind: replace the backlog with a single snapshot
+			q.resync = true
+			q.pending = nil
+		}
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// presenceWriter writes queued broadcast messages to the session until it stops
+func (u *UserSession) presenceWriter(signalingLogger *log.Logger) {
+	q := u.presence
+	// Broadcasts stop with the registry (see context.go)
+	ctx := u.service.registry.ctx
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.wake:
+		}
+
+		q.mu.Lock()
+		pending, resync := q.pending, q.resync
+		q.pending, q.resync = nil, false
+		q.mu.Unlock()
+
+		if resync {
+			registry := u.service.registry
+			registry.mu.RLock()
+			activeUsers := registry.listActiveUsersLocked()
+			registry.mu.RUnlock()
+			pending = append([]SignalingMessage{{
+				Type: "activeUsers",
+				Data: ActiveUsers{Users: activeUsers},
+			}}, pending...)
+		}
+
+		for _, msg := range pending {
+			if u.hidesGuests() {
+				var visible bool
+				if msg, visible = hideGuestsFrom(msg); !visible {
+					continue
+				}
+			}
+			if err := u.sendLowPriority(ctx, msg); err != nil {
+				if err != errSessionDetached && ctx.Err() == nil {
+					signalingLogger.Printf("Error sending %s to %s: %v", msg.Type, RedactName(u.Name), err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// diffActiveUsers turns the difference between the last broadcast list and
+// the current one into delta messages, and records the current list.
+// The caller must hold lastBroadcastMu.
+func (r *Registry) diffActiveUsers(current []ActiveUser) []SignalingMessage {
+	var deltas []SignalingMessage
+	seen := make(map[string]bool, len(current))
+	for _, user := range current {
+		seen[user.Name] = true
+		previous, existed := r.lastBroadcast[user.Name]
+		// Activity alone isn't worth a delta to every client; snapshots
+		// carry it (see heartbeat.go)
+		previous.LastActivity = user.LastActivity
+		switch {
+		case !existed:
+			deltas = append(deltas, SignalingMessage{Type: "userAdded", Data: user})
+		case previous != user:
+			deltas = append(deltas, SignalingMessage{Type: "userUpdated", Data: user})
+		}
+		r.lastBroadcast[user.Name] = user
+	}
+	for name := range r.lastBroadcast {
+		if !seen[name] {
+			deltas = append(deltas, SignalingMessage{Type: "userRemoved", Data: map[string]string{"name": name}})
+			delete(r.lastBroadcast, name)
+		}
+	}
+	return deltas
+}
+
+// fanOutShare is a share of a broadcast's recipients for one fan-out worker
+type fanOutShare struct {
+	job      broadcastJob
+	sessions []*UserSession
+	skipped  *atomic.Uint64
+	done     *sync.WaitGroup
+}
+
+// startBroadcaster starts the single broadcast worker, which fans each job
+// out to every session's queue through a pool of workers and periodically
+// triggers v2 snapshots. The worker stops when the registry's root context
+// is cancelled, and the pool with it (see Registry.Close).
+func (r *Registry) startBroadcaster() {
+	shares := make(chan fanOutShare)
+	r.broadcasters.Add(broadcastWorkers + 1)
+	for range broadcastWorkers {
+		go func() {
+			defer r.broadcasters.Done()
+			fanOutWorker(shares)
+		}()
+	}
+	go func() {
+		defer r.broadcasters.Done()
+		// Only the worker hands out shares, so the pool ends with it
+		defer close(shares)
+		var snapshots <-chan time.Time
+		if presenceSnapshotInterval > 0 {
+			ticker := time.NewTicker(presenceSnapshotInterval)
+			defer ticker.Stop()
+			snapshots = ticker.C
+		}
+		for {
+			var job broadcastJob
+			select {
+			case <-r.ctx.Done():
+				return
+			case job = <-r.broadcastJobs:
+			case <-snapshots:
+				job = broadcastJob{resync: true}
+			}
+			r.fanOut(job, shares)
+		}
+	}()
+}
+
+// fanOut hands a job to the presence queue of every recipient, split
+// between the fan-out workers, and records how long that took
+func (r *Registry) fanOut(job broadcastJob, shares chan<- fanOutShare) {
+	start := time.Now()
+	r.mu.RLock()
+	recipients := make([]*UserSession, 0, len(r.nameToUserSession))
+	for _, session := range r.nameToUserSession {
+		// Periodic snapshots are only for v2 delta clients
+		if job.resync && session.Version < ProtocolV2 {
+			continue
+		}
+		recipients = append(recipients, session)
+	}
+	r.mu.RUnlock()
+
+	total := len(recipients)
+	var skipped atomic.Uint64
+	var done sync.WaitGroup
+	share := max((len(recipients)+broadcastWorkers-1)/broadcastWorkers, broadcastShareMin)
+	for len(recipients) > 0 {
+		n := min(share, len(recipients))
+		done.Add(1)
+		shares <- fanOutShare{job: job, sessions: recipients[:n:n], skipped: &skipped, done: &done}
+		recipients = recipients[n:]
+	}
+	done.Wait()
+
+	elapsed := time.Since(start)
+	broadcastCount.Add(1)
+	broadcastSkipped.Add(skipped.Load())
+	broadcastLastNano.Store(int64(elapsed))
+	for {
+		longest := broadcastMaxNano.Load()
+		if int64(elapsed) <= longest || broadcastMaxNano.CompareAndSwap(longest, int64(elapsed)) {
+			break
+		}
+	}
+	// Every join and disconnect fans out, so only log the ones worth a look
+	if r.logger == nil || (elapsed < slowBroadcast && skipped.Load() == 0) {
+		return
+	}
+	kind := "User list change"
+	if job.resync {
+		kind = "User list snapshot"
+	}
+	note := ""
+	if n := skipped.Load(); n > 0 {
+		note = fmt.Sprintf(", %d skipped with a full outbound queue", n)
+	}
+	r.logger.Printf("%s fanned out to %d sessions in %s%s", kind, total, elapsed.Round(time.Microsecond), note)
+}
+
+// fanOutWorker queues the jobs of the shares it is handed to their
+// sessions, skipping sessions whose outbound queue is full
+func fanOutWorker(shares <-chan fanOutShare) {
+	for share := range shares {
+		for _, session := range share.sessions {
+			if session.outbound != nil && session.outbound.full() {
+				if session.presence != nil {
+					session.presence.deferResync()
+				}
+				share.skipped.Add(1)
+				continue
+			}
+			session.queuePresence(share.job)
+		}
+		share.done.Done()
+	}
+}
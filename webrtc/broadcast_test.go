@@ -0,0 +1,308 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// presenceConn is a client that applies the user list messages written to
+// it the way a v2 client should, and keeps their types in order. Writes
+// block while gate is held.
+type presenceConn struct {
+	stalledConn
+	addr net.Addr
+	gate sync.Mutex
+
+	mu    sync.Mutex
+	types []string
+	users map[string]ActiveUser
+}
+
+func newPresenceConn(port int) *presenceConn {
+	return &presenceConn{
+		stalledConn: stalledConn{closed: make(chan struct{})},
+		addr:        &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port},
+		users:       make(map[string]ActiveUser),
+	}
+}
+
+func (c *presenceConn) WriteMessage(msg SignalingMessage) error {
+	c.gate.Lock()
+	c.gate.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch data := msg.Data.(type) {
+	case ActiveUsers:
+		clear(c.users)
+		for _, user := range data.Users {
+			c.users[user.Name] = user
+		}
+	case ActiveUser:
+		c.users[data.Name] = data
+	case map[string]string:
+		delete(c.users, data["name"])
+	}
+	c.types = append(c.types, msg.Type)
+	return nil
+}
+
+func (c *presenceConn) RemoteAddr() net.Addr { return c.addr }
+
+// written returns the types of the messages written so far
+func (c *presenceConn) written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.types)
+}
+
+// user returns the client's view of a user
+func (c *presenceConn) user(name string) (ActiveUser, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, ok := c.users[name]
+	return user, ok
+}
+
+// names returns the users the client knows of, sorted
+func (c *presenceConn) names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Sorted(maps.Keys(c.users))
+}
+
+// joinPresence adds a session of the given protocol version on a new
+// presenceConn and starts its writers
+func joinPresence(s *Service, name string, version, port int) (*UserSession, *presenceConn) {
+	conn := newPresenceConn(port)
+	session := newTestSession(s, name, conn)
+	session.Version = version
+	s.registry.Add(session)
+	session.startOutbound(s.logger)
+	session.startPresence(s.logger)
+	return session, conn
+}
+
+// expectWritten waits until conn has been written want, in order
+func expectWritten(t *testing.T, conn *presenceConn, want ...string) {
+	t.Helper()
+	eventually(t, fmt.Sprintf("messages %q", want), func() bool {
+		return slices.Equal(conn.written(), want)
+	})
+}
+
+// v2 clients get a snapshot when they join and deltas after it, v1 clients
+// the full list every time, and a change of activity alone sends nothing
+func TestBroadcastDeltas(t *testing.T) {
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	r := s.Registry()
+	t.Cleanup(r.Close)
+
+	_, alice := joinPresence(s, "alice", ProtocolV2, 40001)
+	expectWritten(t, alice, "activeUsers")
+	r.Broadcast()
+	expectWritten(t, alice, "activeUsers", "userAdded")
+
+	carolSession, carol := joinPresence(s, "carol", ProtocolV1, 40002)
+	expectWritten(t, carol, "activeUsers")
+	r.Broadcast()
+	expectWritten(t, alice, "activeUsers", "userAdded", "userAdded")
+	expectWritten(t, carol, "activeUsers", "activeUsers")
+	if names := alice.names(); !slices.Equal(names, []string{"alice", "carol"}) {
+		t.Fatalf("alice knows %q, want alice and carol", names)
+	}
+
+	carolSession.SetInCall(true)
+	r.Broadcast()
+	expectWritten(t, alice, "activeUsers", "userAdded", "userAdded", "userUpdated")
+	expectWritten(t, carol, "activeUsers", "activeUsers", "activeUsers")
+	if user, _ := alice.user("carol"); !user.InCall {
+		t.Fatal("alice doesn't see carol in a call")
+	}
+	if user, _ := carol.user("carol"); !user.InCall || user.LastActivity != "" {
+		t.Fatalf("carol's v1 list has %+v, want her in a call without v2 fields", user)
+	}
+
+	carolSession.mu.Lock()
+	carolSession.LastActivity = carolSession.LastActivity.Add(time.Minute)
+	carolSession.mu.Unlock()
+	r.Broadcast()
+	r.Remove("carol").stopWriters()
+	r.Broadcast()
+	expectWritten(t, alice, "activeUsers", "userAdded", "userAdded", "userUpdated", "userRemoved")
+	if names := alice.names(); !slices.Equal(names, []string{"alice"}) {
+		t.Fatalf("alice knows %q after carol left, want only alice", names)
+	}
+}
+
+// Only v2 clients get the periodic snapshots
+func TestBroadcastSnapshots(t *testing.T) {
+	saved := presenceSnapshotInterval
+	t.Cleanup(func() { ConfigurePresence(saved) })
+	ConfigurePresence(20 * time.Millisecond)
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	r := s.Registry()
+	t.Cleanup(r.Close)
+
+	_, alice := joinPresence(s, "alice", ProtocolV2, 40001)
+	_, carol := joinPresence(s, "carol", ProtocolV1, 40002)
+	expectWritten(t, carol, "activeUsers")
+	r.Broadcast()
+	expectWritten(t, carol, "activeUsers", "activeUsers")
+
+	eventually(t, "alice's snapshots", func() bool {
+		written := alice.written()
+		return len(written) >= 4 && slices.Equal(written[len(written)-2:], []string{"activeUsers", "activeUsers"})
+	})
+	if written := carol.written(); len(written) != 2 {
+		t.Fatalf("carol was written %q, want no snapshots after the broadcast", written)
+	}
+}
+
+// A client that stopped reading doesn't hold up the others. It is skipped
+// while its outbound queue is full, and catches up with a snapshot.
+func TestBroadcastSlowSession(t *testing.T) {
+	savedTimeout, savedSize := writeTimeout, outboundQueueSize
+	t.Cleanup(func() { ConfigureOutbound(savedTimeout, savedSize) })
+	ConfigureOutbound(DefaultWriteTimeout, 4)
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	r := s.Registry()
+	t.Cleanup(r.Close)
+
+	_, alice := joinPresence(s, "alice", ProtocolV2, 40001)
+	bobSession, bob := joinPresence(s, "bob", ProtocolV2, 40002)
+	expectWritten(t, bob, "activeUsers")
+	r.Broadcast()
+	expectWritten(t, bob, "activeUsers", "userAdded", "userAdded")
+	skipped := Broadcasts().Skipped
+
+	// Bob stops reading in the middle of a message and four more fill his
+	// queue, none of which may be dropped
+	bob.gate.Lock()
+	stalled := true
+	t.Cleanup(func() {
+		if stalled {
+			bob.gate.Unlock()
+		}
+	})
+	ctx := context.Background()
+	bobSession.Send(ctx, SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob"})
+	eventually(t, "bob's write in flight", func() bool {
+		bobSession.outbound.mu.Lock()
+		defer bobSession.outbound.mu.Unlock()
+		return len(bobSession.outbound.pending) == 0
+	})
+	for range 4 {
+		bobSession.Send(ctx, SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob"})
+	}
+	want := []string{"alice", "bob"}
+	for i := range 50 {
+		name := fmt.Sprintf("user%02d", i)
+		r.Add(newTestSession(s, name, newPresenceConn(41000+i)))
+		r.Broadcast()
+		want = append(want, name)
+	}
+	eventually(t, "alice sees every user", func() bool { return slices.Equal(alice.names(), want) })
+	if Broadcasts().Skipped == skipped {
+		t.Fatal("no broadcast skipped bob's full queue")
+	}
+
+	stalled = false
+	bob.gate.Unlock()
+	eventually(t, "bob catches up", func() bool { return slices.Equal(bob.names(), want) })
+	if written := bob.written(); !slices.Contains(written[1:], "activeUsers") {
+		t.Fatalf("bob was written %q, want a snapshot after the join", written)
+	}
+}
+
+// benchConn is a client that counts itself in once it has seen the
+// mover's call state of the current benchmark round
+type benchConn struct {
+	stalledConn
+	addr  net.Addr
+	round *benchRound
+	seen  atomic.Int64 // Last round this client saw
+}
+
+// benchRound is a change being fanned out by BenchmarkBroadcast
+type benchRound struct {
+	n        atomic.Int64 // Current round; odd rounds put the mover in a call
+	sessions int64
+	pending  atomic.Int64 // Clients yet to see the round
+	done     chan struct{}
+}
+
+func (c *benchConn) WriteMessage(msg SignalingMessage) error {
+	var users []ActiveUser
+	switch data := msg.Data.(type) {
+	case ActiveUsers:
+		users = data.Users
+	case ActiveUser:
+		users = []ActiveUser{data}
+	}
+	round := c.round.n.Load()
+	for _, user := range users {
+		if user.Name == "mover" && user.InCall == (round%2 == 1) && c.seen.Swap(round) < round {
+			if c.round.pending.Add(-1) == 0 {
+				c.round.done <- struct{}{}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *benchConn) RemoteAddr() net.Addr { return c.addr }
+
+// BenchmarkBroadcast measures the time from a user list change until all of
+// 1,000 connected clients have been written it
+func BenchmarkBroadcast(b *testing.B) {
+	for _, version := range []int{ProtocolV1, ProtocolV2} {
+		b.Run(fmt.Sprintf("v%d", version), func(b *testing.B) {
+			s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+			r := s.Registry()
+			b.Cleanup(r.Close)
+			round := &benchRound{sessions: 1000, done: make(chan struct{}, 1)}
+			var mover *UserSession
+			for i := range round.sessions {
+				conn := &benchConn{
+					stalledConn: stalledConn{closed: make(chan struct{})},
+					addr:        &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000 + int(i)},
+					round:       round,
+				}
+				name := fmt.Sprintf("user%04d", i)
+				if i == 0 {
+					name = "mover"
+				}
+				session := newTestSession(s, name, conn)
+				session.Version = version
+				r.Add(session)
+				session.startOutbound(s.logger)
+				session.startPresence(s.logger)
+				if i == 0 {
+					mover = session
+				}
+			}
+
+			change := func(n int64) {
+				round.pending.Store(round.sessions)
+				round.n.Store(n)
+				mover.SetInCall(n%2 == 1)
+				r.Broadcast()
+				<-round.done
+			}
+			change(1)
+			b.ResetTimer()
+			for i := range b.N {
+				change(int64(i) + 2)
+			}
+		})
+	}
+}
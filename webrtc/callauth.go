@@ -0,0 +1,96 @@
+/*
+WebRTC Signaling Call Authorization
+===================================
+
+This file restricts offer, answer and candidate messages to the two users
+of a call.
+
+WHY IS THIS NEEDED?
+===================
+These messages used to be forwarded to whoever was named as the receiver,
+so any joined user could push an SDP offer or ICE candidates into someone
+else's call. They are now only forwarded when:
+
+- the sender is the user of the connection the message came in on, and
+- sender and receiver are each other's peer in a call (see HandleCall)
+  that the callee has accepted (see HandleAcceptCall), and
+- the message names that call by its ID, if it names one; v2 clients must
+  (see callid.go).
+
+Anything else is dropped, logged, and answered with
+{"type":"error","error":"forbidden","data":{"error":"forbidden","type":"offer"}}.
+
+Deployments whose clients set up calls out of band, without call and
+acceptCall messages, can turn the check off with ConfigureCallAuthorization.
+In-call controls such as callHold are always checked (see callcontrol.go).
+*/
+
+package webrtc
+
+import "context"
+
+// callAuthorization is whether call messages are checked, set once at
+// startup by ConfigureCallAuthorization
+var callAuthorization = true
+
+// ConfigureCallAuthorization sets whether offer, answer and candidate
+// messages are only forwarded between the two users of an accepted call
+func ConfigureCallAuthorization(enforce bool) {
+	callAuthorization = enforce
+}
+
+// callMessageAllowed reports whether a call message may be forwarded to its
+// receiver. Refused messages are logged and answered with an error.
+func (s *Service) callMessageAllowed(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+	if !callAuthorization {
+		return true
+	}
+	return s.inCallWith(ctx, conn, msg)
+}
+
+// inCallWith reports whether the message came from its sender's connection
+// and sender and receiver are in an accepted call together, regardless of
+// ConfigureCallAuthorization, and the message names no other call.
+// Otherwise it logs the message and answers it with an error: forbidden,
+// or why the call ID was refused.
+func (s *Service) inCallWith(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+	s.registry.mu.RLock()
+	allowed := s.registry.inAcceptedCallLocked(conn, msg.Sender, msg.Receiver)
+	s.registry.mu.RUnlock()
+	if allowed {
+		// The message must also be about the current call (see callid.go)
+		return s.callIDAllowed(ctx, conn, msg)
+	}
+
+	s.logger.Printf("Dropping %s from %s to %s: not in an accepted call together%s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), callLabel(msg.CallID))
+	s.sendToConn(ctx, conn, SignalingMessage{
+		Type:     "error",
+		Receiver: msg.Sender,
+		Error:    "forbidden",
+		Data:     map[string]string{"error": "forbidden", "type": msg.Type},
+	}, msg.Version)
+	return false
+}
+
+// inAcceptedCallLocked reports whether conn is sender's connection and
+// sender and receiver are in an accepted call with each other. The caller
+// must hold mu.
+func (r *Registry) inAcceptedCallLocked(conn Conn, sender, receiver string) bool {
+	session, name, owned := r.connSessionLocked(conn)
+	if !owned || name != sender {
+		return false
+	}
+	peer, exists := r.nameToUserSession[receiver]
+	if !exists {
+		return false
+	}
+	// A call still ringing hasn't been accepted
+	call := r.sessionCallLocked(session)
+	if call == nil || !call.accepted || call.peerOf(sender) != receiver {
+		return false
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return peer.CallID == call.id
+}
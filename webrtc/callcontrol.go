@@ -0,0 +1,163 @@
+/*
+WebRTC Signaling In-Call Controls
+=================================
+
+This file relays hold, resume, mute and other control messages between the
+two users of a call.
+
+WHY IS THIS NEEDED?
+===================
+Clients used to signal hold and mute by renegotiating media, which is slow
+and looks like a glitch to the other side. These messages just tell the
+peer what happened, and the server remembers the latest state so a client
+that reconnects mid-call can restore its UI.
+
+MESSAGE FORMAT:
+===============
+	{"type":"callHold","sender":"alice","receiver":"bob"}
+	{"type":"callResume","sender":"alice","receiver":"bob"}
+	{"type":"muteState","sender":"alice","receiver":"bob","data":{"audio":true,"video":false}}
+	{"type":"callControl","sender":"alice","receiver":"bob","data":{"control":"raiseHand","data":{...}}}
+
+callControl is a generic envelope: clients can add their own controls
+without server changes. The control name is 1-32 letters, digits, dashes
+or underscores.
+
+RULES:
+======
+- Sender and receiver must be in an accepted call with each other, on the
+  sender's own connection (see callauth.go). This applies even when
+  -signal-call-auth is off.
+- The data may be at most maxCallControlBytes encoded (see payload.go).
+- Each user's hold flag and latest muteState data are kept until the call
+  ends. A client that resumes its session (see resume.go) gets them for
+  both users as "callState" in the resume response:
+
+	{"type":"resume","data":{"result":true,"callState":{"peer":"bob",
+	 "callId":"9b2f...","held":["alice"],"mute":{"bob":{"audio":true,"video":false}},
+	 "negotiationEpoch":1}}}
+*/
+
+package webrtc
+
+import (
+	"context"
+	"sort"
+)
+
+// maxCallControlBytes is the largest encoded data of an in-call control
+// message; the state is kept per user, so it stays small
+const maxCallControlBytes = 4096
+
+// callControlState is what a user has told their peer during the current
+// call. It is reset whenever the user's peer changes.
+type callControlState struct {
+	held bool
+	mute interface{} // Latest muteState data, nil if none was sent
+	// ICE restarts in the current call, the same for both users; the
+	// negotiation epoch is one more (see icerestart.go)
+	restarts uint64
+}
+
+// CallState is the hold and mute state of both users of a call, sent to a
+// client resuming its session mid-call
+type CallState struct {
+	Peer   string                 `json:"peer"`
+	CallID string                 `json:"callId"`         // See callid.go
+	Held   []string               `json:"held,omitempty"` // Users who have the call on hold
+	Mute   map[string]interface{} `json:"mute,omitempty"` // Latest muteState data by user
+	// Current negotiation epoch of the call, see icerestart.go
+	NegotiationEpoch uint64 `json:"negotiationEpoch"`
+}
+
+// isCallControl reports whether a message type is an in-call control
+func isCallControl(msgType string) bool {
+	switch msgType {
+	case "callHold", "callResume", "muteState", "callControl":
+		return true
+	}
+	return false
+}
+
+// isControlName reports whether a callControl name is a short identifier
+func isControlName(control string) bool {
+	if control == "" || len(control) > 32 {
+		return false
+	}
+	for _, r := range control {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleCallControl relays an in-call control message to the sender's peer
+// and records hold and mute changes
+func (s *Service) HandleCallControl(ctx context.Context, conn Conn, msg SignalingMessage) {
+	if !s.inCallWith(ctx, conn, msg) || !s.payloadAllowed(ctx, conn, msg) {
+		return
+	}
+
+	s.registry.mu.RLock()
+	senderSession, senderExists := s.registry.nameToUserSession[msg.Sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[msg.Receiver]
+	s.registry.mu.RUnlock()
+	if !senderExists || !receiverExists {
+		return
+	}
+
+	senderSession.mu.Lock()
+	switch msg.Type {
+	case "callHold":
+		senderSession.callControls.held = true
+	case "callResume":
+		senderSession.callControls.held = false
+	case "muteState":
+		senderSession.callControls.mute = msg.Data
+	}
+	senderSession.mu.Unlock()
+
+	receiverSession.Send(ctx, SignalingMessage{
+		Type:     msg.Type,
+		Sender:   msg.Sender,
+		Receiver: msg.Receiver,
+		Data:     msg.Data,
+		CallID:   s.callID(msg),
+	})
+}
+
+// callStateLocked collects the hold and mute state of a session's current
+// call, or nil if it isn't in an accepted call. The caller must hold r.mu.
+func (r *Registry) callStateLocked(session *UserSession) *CallState {
+	call := r.sessionCallLocked(session)
+	if call == nil || !call.accepted {
+		return nil
+	}
+	peerName := call.peerOf(session.Name)
+	session.mu.Lock()
+	own := session.callControls
+	session.mu.Unlock()
+	peer, exists := r.nameToUserSession[peerName]
+	if !exists {
+		return nil
+	}
+	peer.mu.Lock()
+	theirs, together := peer.callControls, peer.CallID == call.id
+	peer.mu.Unlock()
+	if !together {
+		return nil
+	}
+
+	state := &CallState{Peer: peerName, CallID: call.id, Mute: make(map[string]interface{}), NegotiationEpoch: own.restarts + 1}
+	for name, controls := range map[string]callControlState{session.Name: own, peerName: theirs} {
+		if controls.held {
+			state.Held = append(state.Held, name)
+		}
+		if controls.mute != nil {
+			state.Mute[name] = controls.mute
+		}
+	}
+	sort.Strings(state.Held)
+	return state
+}
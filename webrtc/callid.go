@@ -0,0 +1,242 @@
+/*
+WebRTC Signaling Call IDs
+=========================
+
+This file gives every call a unique ID and keeps the registry of calls by
+that ID.
+
+WHY IS THIS NEEDED?
+===================
+Calls used to be identified by the two usernames only. When alice called
+bob, cancelled and called again right away, a late acceptCall, candidate or
+hangUp meant for the first call was applied to the second one, and nothing
+in the logs told the two calls apart.
+
+HOW IT WORKS:
+=============
+HandleCall generates a call ID (a random UUID) and registers the call. The
+ID is sent to the callee in the call message and to the caller in the
+acceptCall message:
+
+	{"type":"call","sender":"alice","receiver":"bob","callId":"9b2f...-..."}
+	{"type":"acceptCall","sender":"bob","receiver":"alice","callId":"9b2f...-..."}
+
+Every message the server sends about the call carries it as "callId":
+offers, answers, candidates, iceRestart, in-call controls, hangUp,
+cancelCall, the callFailed of a ring timeout and callTransferred (a
+transfer starts a new call, see transfer.go). A resumed session gets it in
+its callState.
+
+Clients send it back on the messages of the call:
+- v2 clients must put it on offer, answer, candidate and hangUp once the
+  call is accepted; without it they are answered with an error
+  "missingCallId". Only the callee can know it while the call rings.
+- v1 clients never see it and may leave it out, but a v1 message that
+  carries one is checked the same way.
+- A message naming another call than the sender's current one, e.g. a
+  straggler from a call that has ended, is dropped and answered with an
+  error "unknownCallId". acceptCall naming another call is refused with
+  "noPendingCall".
+
+Like the rest of call authorization (see callauth.go), offers, answers and
+candidates aren't checked with -signal-call-auth off.
+
+LOGS AND CAPTURES:
+==================
+Signaling log lines about a call end with "(call <id>)", and POST
+/admin/capture?callId=<id> records the messages of one call, to and from
+both users (see capture.go).
+*/
+
+package webrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// activeCall is a call between two users, from the moment it rings until
+// it ends, registered by its ID
+type activeCall struct {
+	id       string
+	caller   string
+	callee   string
+	accepted bool        // The callee accepted it
+	relayed  bool        // A relay candidate was forwarded for it, see calloutcomes.go
+	started  time.Time   // When it started ringing
+	ring     *time.Timer // Ring timeout while ringing, see missedcalls.go
+}
+
+// peerOf returns the other user of the call, or "" if name isn't in it
+func (c *activeCall) peerOf(name string) string {
+	switch name {
+	case c.caller:
+		return c.callee
+	case c.callee:
+		return c.caller
+	}
+	return ""
+}
+
+// newCallID returns a random version 4 UUID
+func newCallID() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read never fails since Go 1.24
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// callLabel is appended to the log lines about a call
+func callLabel(callID string) string {
+	if callID == "" {
+		return ""
+	}
+	return " (call " + callID + ")"
+}
+
+// newCallLocked registers a call ringing callee. The caller must hold mu
+// and make it both sessions' current call.
+func (r *Registry) newCallLocked(caller, callee string) *activeCall {
+	call := &activeCall{id: newCallID(), caller: caller, callee: callee, started: time.Now()}
+	r.calls[call.id] = call
+	concurrentCalls.Add(1)
+	history.callStarted(call, r.tenant)
+	r.publishCallStarted(call)
+	return call
+}
+
+// endCallLocked forgets a call, stops its ring timeout and records its
+// outcome in the event history (see history.go), on the event bus (see
+// events.go) and to the outcome counts (see calloutcomes.go). The caller
+// must hold mu.
+func (r *Registry) endCallLocked(call *activeCall, outcome string) {
+	if call == nil || r.calls[call.id] != call {
+		return
+	}
+	delete(r.calls, call.id)
+	concurrentCalls.Add(-1)
+	history.callEnded(call, outcome)
+	endCallSetup(call.id, outcome)
+	r.publishCallEnded(call, outcome)
+	reportCallOutcome(call, outcome)
+	if call.ring != nil {
+		call.ring.Stop()
+	}
+}
+
+// leaveCallLocked takes the named user out of a call that ended, unless
+// they have moved on to another one, and returns their session or nil. The
+// caller must hold mu.
+func (r *Registry) leaveCallLocked(name string, call *activeCall) *UserSession {
+	session, exists := r.nameToUserSession[name]
+	if !exists {
+		return nil
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.CallID != call.id {
+		return nil
+	}
+	session.InCall = false
+	session.Peer = ""
+	session.CallID = ""
+	session.callControls = callControlState{}
+	return session
+}
+
+// sessionCallLocked returns a session's current call, or nil if it isn't
+// in one. The caller must hold mu.
+func (r *Registry) sessionCallLocked(session *UserSession) *activeCall {
+	session.mu.Lock()
+	callID := session.CallID
+	session.mu.Unlock()
+	if callID == "" {
+		return nil
+	}
+	return r.calls[callID]
+}
+
+// ringingCallLocked returns the call ringing callee, or nil if there is
+// none. The caller must hold mu.
+func (r *Registry) ringingCallLocked(callee string) *activeCall {
+	session, exists := r.nameToUserSession[callee]
+	if !exists {
+		return nil
+	}
+	call := r.sessionCallLocked(session)
+	if call == nil || call.accepted || call.callee != callee {
+		return nil
+	}
+	return call
+}
+
+// callID returns the ID of the sender's current call, if it is with the
+// receiver; forwarded messages are tagged with it
+func (s *Service) callID(msg SignalingMessage) string {
+	s.registry.mu.RLock()
+	defer s.registry.mu.RUnlock()
+	return s.registry.callIDLocked(msg.Sender, msg.Receiver)
+}
+
+// callIDLocked returns the ID of the call between two users, or "" if they
+// aren't in one together. The caller must hold mu.
+func (r *Registry) callIDLocked(a, b string) string {
+	session, exists := r.nameToUserSession[a]
+	if !exists {
+		return ""
+	}
+	call := r.sessionCallLocked(session)
+	if call == nil || call.peerOf(a) != b {
+		return ""
+	}
+	return call.id
+}
+
+// callIDRequired reports whether v2 clients must name the call on a
+// message type once the call is accepted
+func callIDRequired(msgType string) bool {
+	switch msgType {
+	case "offer", "answer", "candidate", "hangUp":
+		return true
+	}
+	return false
+}
+
+// callIDAllowed checks the callId of a message against the sender's current
+// call: it must match if the message has one, and v2 clients must send it
+// on the messages that require it once the call is accepted. Refused
+// messages are logged and answered with an error.
+func (s *Service) callIDAllowed(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+	s.registry.mu.RLock()
+	current := ""
+	accepted := false
+	if session, exists := s.registry.nameToUserSession[msg.Sender]; exists {
+		if call := s.registry.sessionCallLocked(session); call != nil {
+			current, accepted = call.id, call.accepted
+		}
+	}
+	s.registry.mu.RUnlock()
+
+	reason := ""
+	switch {
+	case msg.CallID != "" && msg.CallID != current:
+		reason = "unknownCallId"
+	case msg.CallID == "" && accepted && msg.Version >= ProtocolV2 && callIDRequired(msg.Type):
+		reason = "missingCallId"
+	default:
+		return true
+	}
+
+	s.logger.Printf("Dropping %s from %s to %s: %s%s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), reason, callLabel(msg.CallID))
+	s.sendToConn(ctx, conn, SignalingMessage{
+		Type:     "error",
+		Receiver: msg.Sender,
+		Error:    reason,
+		Data:     map[string]string{"error": reason, "type": msg.Type},
+	}, msg.Version)
+	return false
+}
@@ -0,0 +1,131 @@
+/*
+WebRTC Signaling Call Limits
+============================
+
+This file bounds how many calls the server carries and how fast a user can
+place or receive them.
+
+WHY IS THIS NEEDED?
+===================
+A script can place thousands of call/cancel cycles a minute, ringing other
+users over and over, and every call ties up state on the server. Guests
+already had a call rate (see guests.go); joined users and the server as a
+whole had none.
+
+HOW IT WORKS:
+=============
+HandleCall checks three limits; a call over any of them isn't placed, the
+caller gets a callFailed message with the reason "rateLimited" and the
+refusal is logged:
+
+- -max-concurrent-calls: calls ringing or in progress on the whole server,
+  across all tenants (0 is unlimited). A per-tenant cap is set with
+  max-calls in -tenants.
+- -call-attempt-rate: call attempts a user may make per minute, counted
+  before anything else is checked, so calls to busy or offline users count
+  too. A call can only be placed from the caller's own connection, so
+  naming someone else as the sender doesn't get around it.
+- -ring-rate: calls a user may be rung with per minute, counted when the
+  call would ring, so one target can't be flooded by many callers.
+
+The per-user limits are token buckets (see limits.go) holding a minute's
+worth of calls, which refill continuously: a user who stops calling can
+call again at the configured rate. They are kept in the Registry by
+username and forgotten once idle for a minute, when they would be full
+again anyway.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Default per-user call rates, in calls per minute
+const (
+	DefaultCallAttemptRate = 30
+	DefaultRingRate        = 30
+)
+
+// callLimiterIdle is how long an idle per-user call limiter is kept; at the
+// rates above it is full again by then
+const callLimiterIdle = time.Minute
+
+var (
+	// Current call limits, set once at startup by ConfigureCallLimits
+	maxConcurrentCalls int
+	callAttemptRate    float64 = DefaultCallAttemptRate
+	ringRate           float64 = DefaultRingRate
+
+	// concurrentCalls counts the calls ringing or in progress in every
+	// registry, see newCallLocked and endCallLocked
+	concurrentCalls atomic.Int64
+)
+
+// ConfigureCallLimits sets the most calls ringing or in progress on the
+// server (0 is unlimited), and how many calls per minute a user may place
+// and be rung with (0 disables each)
+func ConfigureCallLimits(maxCalls int, attemptsPerMinute, ringsPerMinute float64) {
+	maxConcurrentCalls = maxCalls
+	callAttemptRate = attemptsPerMinute
+	ringRate = ringsPerMinute
+}
+
+// allowRateLocked takes a token from a user's bucket in limiters, at
+// perMinute calls per minute with a minute's worth of burst, sweeping the
+// idle buckets first. The caller must hold mu.
+func (r *Registry) allowRateLocked(limiters map[string]*tokenBucket, name string, perMinute float64) bool {
+	if perMinute <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(r.callLimitersSwept) >= callLimiterIdle {
+		for _, buckets := range []map[string]*tokenBucket{r.callAttempts, r.ringsReceived} {
+			for user, bucket := range buckets {
+				if now.Sub(bucket.last) >= callLimiterIdle {
+					delete(buckets, user)
+				}
+			}
+		}
+		r.callLimitersSwept = now
+	}
+	bucket, ok := limiters[name]
+	if !ok {
+		bucket = &tokenBucket{}
+		limiters[name] = bucket
+	}
+	return bucket.allow(perMinute/60, perMinute, now)
+}
+
+// allowCallAttemptLocked counts a call attempt by caller and reports whether
+// it is within -call-attempt-rate. The caller must hold mu.
+func (r *Registry) allowCallAttemptLocked(caller string) bool {
+	return r.allowRateLocked(r.callAttempts, caller, callAttemptRate)
+}
+
+// allowRingLocked counts a ring of callee and reports whether it is within
+// -ring-rate. The caller must hold mu.
+func (r *Registry) allowRingLocked(callee string) bool {
+	return r.allowRateLocked(r.ringsReceived, callee, ringRate)
+}
+
+// serverCallLimitReached reports whether the server carries
+// -max-concurrent-calls calls
+func serverCallLimitReached() bool {
+	return maxConcurrentCalls > 0 && concurrentCalls.Load() >= int64(maxConcurrentCalls)
+}
+
+// refuseRateLimitedCall logs a call refused by one of the limits above and
+// tells the caller
+func (s *Service) refuseRateLimitedCall(ctx context.Context, callerSession *UserSession, callee, why string) {
+	s.logger.Printf("Call from %s to %s refused: %s", RedactName(callerSession.Name), RedactName(callee), why)
+	callerSession.Send(ctx, SignalingMessage{
+		Type:     "callFailed",
+		Sender:   callee,
+		Receiver: callerSession.Name,
+		Data:     map[string]interface{}{"reason": "rateLimited"},
+		Error:    "rateLimited",
+	})
+}
@@ -0,0 +1,141 @@
+package webrtc_test
+
+import (
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+)
+
+// useCallLimits sets the call limits until the test ends
+func useCallLimits(t *testing.T, maxCalls int, attemptsPerMinute, ringsPerMinute float64) {
+	t.Helper()
+	webrtc.ConfigureCallLimits(maxCalls, attemptsPerMinute, ringsPerMinute)
+	t.Cleanup(func() { webrtc.ConfigureCallLimits(0, webrtc.DefaultCallAttemptRate, webrtc.DefaultRingRate) })
+}
+
+// callRecorder counts how a caller's calls turn out
+type callRecorder struct {
+	caller   *client.Client
+	rings    chan string // Callers the callee was rung by
+	failures chan string // Reasons the caller's calls failed
+}
+
+func newCallRecorder(caller, callee *client.Client) *callRecorder {
+	r := &callRecorder{caller: caller, rings: make(chan string, 1), failures: make(chan string, 1)}
+	callee.OnCall(func(from string) { r.rings <- from })
+	caller.OnCallFailed(func(to, reason string) { r.failures <- reason })
+	return r
+}
+
+// attempt places a call and returns whether it rang, cancelling it if it
+// did; a refused call must be refused as rateLimited
+func (r *callRecorder) attempt(t *testing.T, callee *client.Client) bool {
+	t.Helper()
+	if err := r.caller.Call(callee.Name); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	select {
+	case <-r.rings:
+		if err := r.caller.CancelCall(callee.Name); err != nil {
+			t.Fatalf("cancel: %v", err)
+		}
+		return true
+	case reason := <-r.failures:
+		if reason != "rateLimited" {
+			t.Fatalf("call failed with %q, want rateLimited", reason)
+		}
+		return false
+	case <-time.After(5 * time.Second):
+		t.Fatal("call neither rang nor failed")
+	}
+	return false
+}
+
+// A burst of 100 call/cancel cycles from one user rings the callee as many
+// times as -call-attempt-rate allows in a minute; the rest are refused
+func TestCallAttemptRateBurst(t *testing.T) {
+	useCallLimits(t, 0, 10, 0)
+	// 110 messages in a burst are over the per-connection message rate
+	webrtc.ConfigureLimits(webrtc.DefaultMaxMessageBytes, 0, webrtc.DefaultMessageBurst)
+	t.Cleanup(func() {
+		webrtc.ConfigureLimits(webrtc.DefaultMaxMessageBytes, webrtc.DefaultMessageRate, webrtc.DefaultMessageBurst)
+	})
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+	bob := dial(t, url, client.Options{Username: "bob"})
+	cancels := make(chan string, 1)
+	bob.OnCancelCall(func(from string) { cancels <- from })
+	calls := newCallRecorder(alice, bob)
+
+	rang := 0
+	for range 100 {
+		if calls.attempt(t, bob) {
+			rang++
+			// Wait for the cancel, so the next attempt doesn't find bob busy
+			receive(t, cancels, "cancelCall")
+		}
+	}
+	if rang != 10 {
+		t.Fatalf("bob was rung %d times, want 10", rang)
+	}
+}
+
+// -ring-rate bounds how often one user is rung, whoever calls
+func TestRingRateAcrossCallers(t *testing.T) {
+	useCallLimits(t, 0, 0, 5)
+	_, url := newTestServer(t)
+	bob := dial(t, url, client.Options{Username: "bob"})
+	cancels := make(chan string, 1)
+	bob.OnCancelCall(func(from string) { cancels <- from })
+	// bob's rings go to whichever caller is calling
+	rings := make(chan string, 1)
+	bob.OnCall(func(from string) { rings <- from })
+	var callers []*callRecorder
+	for _, name := range []string{"alice", "carol", "dave"} {
+		r := &callRecorder{caller: dial(t, url, client.Options{Username: name}), rings: rings, failures: make(chan string, 1)}
+		r.caller.OnCallFailed(func(to, reason string) { r.failures <- reason })
+		callers = append(callers, r)
+	}
+
+	rang := 0
+	for i := range 30 {
+		if callers[i%len(callers)].attempt(t, bob) {
+			rang++
+			receive(t, cancels, "cancelCall")
+		}
+	}
+	if rang != 5 {
+		t.Fatalf("bob was rung %d times, want 5", rang)
+	}
+}
+
+// -max-concurrent-calls refuses calls while the server carries that many,
+// and frees a slot when one of them ends
+func TestMaxConcurrentCalls(t *testing.T) {
+	useCallLimits(t, 2, 0, 0)
+	_, url := newTestServer(t)
+	var pairs [3][2]*client.Client
+	for i, names := range [][2]string{{"alice", "bob"}, {"carol", "dave"}, {"erin", "frank"}} {
+		pairs[i] = [2]*client.Client{dial(t, url, client.Options{Username: names[0]}), dial(t, url, client.Options{Username: names[1]})}
+	}
+	for _, pair := range pairs[:2] {
+		startCall(t, pair[0], pair[1])
+	}
+
+	third := newCallRecorder(pairs[2][0], pairs[2][1])
+	if third.attempt(t, pairs[2][1]) {
+		t.Fatal("a third call rang with -max-concurrent-calls=2")
+	}
+
+	hangUps := make(chan string, 1)
+	pairs[0][1].OnHangUp(func(from string) { hangUps <- from })
+	if err := pairs[0][0].HangUp(pairs[0][1].Name); err != nil {
+		t.Fatalf("hang up: %v", err)
+	}
+	receive(t, hangUps, "hangUp")
+	if !third.attempt(t, pairs[2][1]) {
+		t.Fatal("the third call was refused after another ended")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+WebRTC Signaling Call Outcomes
+==============================
+
+This file tells the server how every call ended, whether it was answered
+and whether it likely went through the TURN relay, so call success rates
+can be reported.
+
+WHY IS THIS NEEDED?
+===================
+Of the calls placed, how many connected and how many were cancelled,
+declined, rang out or lost a peer is the number that shows whether calling
+works for users. The event history (see history.go) keeps outcomes, but
+only of the last calls and only until a restart.
+
+HOW IT WORKS:
+=============
+Every call in the registry notes whether a relay candidate ("typ relay")
+was forwarded for it, trickled or in an offer or answer; that is when the
+call likely used the TURN relay, since the peers can't know a relay
+address otherwise. When the call ends, endCallLocked hands its outcome
+(one of the Call* outcomes of history.go), whether the callee answered it
+and whether it was relayed to the function set by ConfigureCallOutcomes.
+The standalone server counts them per day for the metrics endpoint and the
+daily report.
+
+A call is a success when it is completed: answered, then hung up by one of
+its users. A call that lost a peer counts as peer-disconnected even if it
+was answered first, and a transferred call is continued by a new call that
+has an outcome of its own.
+*/
+
+package webrtc
+
+// CallOutcomeFunc is told how a call ended: its outcome, one of the Call*
+// outcomes, whether the callee answered and whether a relay candidate was
+// forwarded for it. It is called with the registry's mutex held and must
+// not block.
+type CallOutcomeFunc func(outcome string, answered, relayed bool)
+
+// callOutcome is the function calls are reported to, set once at startup
+// by ConfigureCallOutcomes
+var callOutcome CallOutcomeFunc
+
+// ConfigureCallOutcomes sets the function ended calls are reported to
+func ConfigureCallOutcomes(fn CallOutcomeFunc) {
+	callOutcome = fn
+}
+
+// reportCallOutcome reports an ended call to the outcome function
+func reportCallOutcome(call *activeCall, outcome string) {
+	if callOutcome != nil {
+		callOutcome(outcome, call.accepted, call.relayed)
+	}
+}
+
+// hasRelayCandidate reports whether an offer, answer or trickled candidate
+// carries a relay candidate
+func hasRelayCandidate(msg SignalingMessage) bool {
+	found := false
+	filterCandidates(msg, func(candidate string) (string, bool) {
+		found = found || candidateType(candidate) == "relay"
+		return candidate, true
+	})
+	return found
+}
+
+// noteRelayCandidates marks the call with the given ID as relayed if msg,
+// just forwarded for it, carries a relay candidate
+func (r *Registry) noteRelayCandidates(callID string, msg SignalingMessage) {
+	if callID == "" || !hasRelayCandidate(msg) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if call, exists := r.calls[callID]; exists {
+		call.relayed = true
+	}
+}
@@ -0,0 +1,115 @@
+package webrtc_test
+
+import (
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+
+	"github.com/gorilla/websocket"
+)
+
+// reportedCall is a call outcome as reported to ConfigureCallOutcomes
+type reportedCall struct {
+	outcome           string
+	answered, relayed bool
+}
+
+// useCallOutcomes collects the outcomes of ended calls until the test ends
+func useCallOutcomes(t *testing.T) <-chan reportedCall {
+	t.Helper()
+	outcomes := make(chan reportedCall, 10)
+	webrtc.ConfigureCallOutcomes(func(outcome string, answered, relayed bool) {
+		outcomes <- reportedCall{outcome, answered, relayed}
+	})
+	t.Cleanup(func() { webrtc.ConfigureCallOutcomes(nil) })
+	return outcomes
+}
+
+// ringRaw has alice call bob over raw connections and returns the call ID
+func ringRaw(t *testing.T, alice, bob *websocket.Conn) string {
+	t.Helper()
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"})
+	return expectRaw(t, bob, "call").CallID
+}
+
+// Scripted calls are classified by how they ended, whether they were
+// answered and whether a relay candidate was forwarded for them
+func TestCallOutcomes(t *testing.T) {
+	// Without a grace window to resume in, a lost caller's call ends at once
+	webrtc.ConfigureResume(0)
+	t.Cleanup(func() { webrtc.ConfigureResume(webrtc.DefaultResumeGrace) })
+	relay := map[string]any{"candidate": "candidate:1121413430 1 udp 33562367 198.51.100.7 49152 typ relay raddr 203.0.113.45 rport 61000", "sdpMid": "0", "sdpMLineIndex": 0}
+	host := map[string]any{"candidate": "candidate:1467250027 1 udp 2122260223 192.168.1.20 54321 typ host", "sdpMid": "0", "sdpMLineIndex": 0}
+	cases := []struct {
+		name   string
+		accept bool
+		script func(t *testing.T, alice, bob *websocket.Conn, callID string)
+		want   reportedCall
+	}{
+		{"hung up after a relay candidate in the offer", true, func(t *testing.T, alice, bob *websocket.Conn, callID string) {
+			offer := describe("offer", chromeOffer(t))
+			offer.CallID = callID
+			sendRaw(t, alice, offer)
+			expectRaw(t, bob, "offer")
+			sendRaw(t, bob, webrtc.SignalingMessage{Type: "hangUp", Sender: "bob", Receiver: "alice", CallID: callID})
+		}, reportedCall{webrtc.CallCompleted, true, true}},
+		{"hung up after a trickled relay candidate", true, func(t *testing.T, alice, bob *websocket.Conn, callID string) {
+			sendRaw(t, bob, webrtc.SignalingMessage{Type: "candidate", Sender: "bob", Receiver: "alice", Data: relay, CallID: callID})
+			expectRaw(t, alice, "candidate")
+			sendRaw(t, alice, webrtc.SignalingMessage{Type: "hangUp", Sender: "alice", Receiver: "bob", CallID: callID})
+		}, reportedCall{webrtc.CallCompleted, true, true}},
+		{"hung up after host candidates", true, func(t *testing.T, alice, bob *websocket.Conn, callID string) {
+			sendRaw(t, alice, webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: host, CallID: callID})
+			expectRaw(t, bob, "candidate")
+			sendRaw(t, alice, webrtc.SignalingMessage{Type: "hangUp", Sender: "alice", Receiver: "bob", CallID: callID})
+		}, reportedCall{webrtc.CallCompleted, true, false}},
+		{"cancelled by the caller", false, func(t *testing.T, alice, bob *websocket.Conn, callID string) {
+			sendRaw(t, alice, webrtc.SignalingMessage{Type: "cancelCall", Sender: "alice", Receiver: "bob", CallID: callID})
+		}, reportedCall{webrtc.CallCancelled, false, false}},
+		{"declined by the callee", false, func(t *testing.T, alice, bob *websocket.Conn, callID string) {
+			sendRaw(t, bob, webrtc.SignalingMessage{Type: "cancelCall", Sender: "bob", Receiver: "alice", CallID: callID})
+		}, reportedCall{webrtc.CallDeclined, false, false}},
+		{"caller lost after the answer", true, func(t *testing.T, alice, bob *websocket.Conn, callID string) {
+			sendRaw(t, alice, webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: relay, CallID: callID})
+			expectRaw(t, bob, "candidate")
+			alice.NetConn().Close()
+		}, reportedCall{webrtc.CallPeerDisconnected, true, true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			outcomes := useCallOutcomes(t)
+			_, url := newTestServer(t)
+			alice := joinRaw(t, url, "alice")
+			bob := joinRaw(t, url, "bob")
+			callID := ringRaw(t, alice, bob)
+			if c.accept {
+				sendRaw(t, bob, webrtc.SignalingMessage{Type: "acceptCall", Sender: "bob", Receiver: "alice", CallID: callID})
+				expectRaw(t, alice, "acceptCall")
+			}
+			c.script(t, alice, bob, callID)
+			if got := receive(t, outcomes, "call outcome"); got != c.want {
+				t.Fatalf("call reported as %+v, want %+v", got, c.want)
+			}
+			select {
+			case got := <-outcomes:
+				t.Fatalf("a second outcome %+v", got)
+			default:
+			}
+		})
+	}
+}
+
+// A call nobody answers rings out as timed out
+func TestCallOutcomeTimeout(t *testing.T) {
+	webrtc.ConfigureRingTimeout(50 * time.Millisecond)
+	t.Cleanup(func() { webrtc.ConfigureRingTimeout(webrtc.DefaultRingTimeout) })
+	outcomes := useCallOutcomes(t)
+	_, url := newTestServer(t)
+	alice := joinRaw(t, url, "alice")
+	bob := joinRaw(t, url, "bob")
+	ringRaw(t, alice, bob)
+	if got := receive(t, outcomes, "call outcome"); got != (reportedCall{webrtc.CallTimeout, false, false}) {
+		t.Fatalf("unanswered call reported as %+v, want a timeout", got)
+	}
+}
@@ -0,0 +1,506 @@
+/*
+WebRTC Signaling Message Capture
+================================
+
+This file records every signaling message to and from one user, or of one
+call, with full SDP and candidate payloads, for debugging calls that never
+connect.
+
+WHY IS THIS NEEDED?
+===================
+The signaling log only has one-line summaries ("Received: offer From: alice
+To: bob"). When a call fails, the exact sequence of messages and what was
+in them (codecs, candidates, ICE credentials) is what tells us why.
+
+HOW IT WORKS:
+=============
+1. POST /admin/capture?user=alice&duration=5m starts a capture and returns
+   its id. duration defaults to 5m and may be at most 1h. With
+   callId=<id> instead of (or as well as) user, only the messages of that
+   call are recorded, to and from both of its users (see callid.go).
+2. Every message alice sends or receives is appended to the capture as one
+   JSON line: time, direction ("in" or "out"), user, address and message.
+   A message belongs to a call if it carries the call's ID; one a v1
+   client sends without it belongs to the sender's call with its receiver.
+3. The capture stops by itself when the duration ends or it reaches the
+   size cap (-capture-max-bytes), or with DELETE /admin/capture/<id>.
+4. GET /admin/capture/<id> returns the lines recorded so far (JSONL), and
+   GET /admin/capture lists the captures. Finished captures are kept in
+   memory until maxCaptures newer ones replace them.
+
+OVERHEAD:
+=========
+With no capture running, recording a message is a single atomic load, so
+the capture hooks cost nothing measurable on the message path.
+
+REDACTION:
+==========
+Nothing is redacted by default, since the addresses are often the point.
+With ConfigureCapture(redactIPs=true) (-capture-redact-ips) every IP address
+in the payloads and the connection address is replaced with "REDACTED".
+*/
+
+package webrtc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Capture defaults and limits
+const (
+	DefaultCaptureDuration = 5 * time.Minute
+	DefaultCaptureMaxBytes = 16 << 20 // Size cap of one capture's recording
+
+	maxCaptureDuration = time.Hour
+	maxCaptures        = 16 // Captures kept in memory, running or finished
+)
+
+var (
+	// Current capture configuration, set once at startup by ConfigureCapture
+	captureRedactIPs bool
+	captureMaxBytes  = DefaultCaptureMaxBytes
+
+	// activeCaptureCount is the number of running captures, checked before
+	// anything else so the message path pays nothing while it is zero
+	activeCaptureCount atomic.Int32
+
+	captures   = make(map[string]*capture) // Captures by id
+	capturesMu sync.Mutex
+)
+
+// ConfigureCapture sets whether captures redact IP addresses and how many
+// bytes one capture may record before it stops
+func ConfigureCapture(redactIPs bool, maxBytes int) {
+	captureRedactIPs = redactIPs
+	captureMaxBytes = maxBytes
+}
+
+// capture records the messages of one user, one call, or one user in one
+// call
+type capture struct {
+	id      string
+	user    string // Empty to record every user of the call
+	callID  string // Empty to record every message of the user
+	started time.Time
+	expires time.Time
+	logger  *log.Logger // Logs when the capture starts and stops
+
+	mu         sync.Mutex
+	data       bytes.Buffer // Recorded JSON lines
+	messages   int
+	stopped    time.Time // Zero while running
+	stopReason string
+	timer      *time.Timer
+}
+
+// captureEntry is one recorded message
+type captureEntry struct {
+	Time      string           `json:"time"`
+	Direction string           `json:"direction"` // "in" from the user, "out" to the user
+	User      string           `json:"user"`
+	Addr      string           `json:"addr,omitempty"`
+	Message   SignalingMessage `json:"message"`
+}
+
+// CaptureInfo describes a capture in admin responses
+type CaptureInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user,omitempty"`
+	CallID     string    `json:"callId,omitempty"`
+	Started    time.Time `json:"started"`
+	Expires    time.Time `json:"expires"`
+	Active     bool      `json:"active"`
+	StopReason string    `json:"stopReason,omitempty"`
+	Messages   int       `json:"messages"`
+	Bytes      int       `json:"bytes"`
+}
+
+func (c *capture) info() CaptureInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CaptureInfo{
+		ID:         c.id,
+		User:       c.user,
+		CallID:     c.callID,
+		Started:    c.started,
+		Expires:    c.expires,
+		Active:     c.stopped.IsZero(),
+		StopReason: c.stopReason,
+		Messages:   c.messages,
+		Bytes:      c.data.Len(),
+	}
+}
+
+// target describes what the capture records, for its log lines
+func (c *capture) target() string {
+	switch {
+	case c.callID == "":
+		return RedactName(c.user)
+	case c.user == "":
+		return "call " + c.callID
+	}
+	return RedactName(c.user) + " in call " + c.callID
+}
+
+// matches reports whether the capture records a message to or from user
+// belonging to the call with the given ID, "" if it belongs to none
+func (c *capture) matches(user, callID string) bool {
+	return (c.user == "" || c.user == user) && (c.callID == "" || c.callID == callID)
+}
+
+// auditDetails identifies the capture in audit log entries
+func (c *capture) auditDetails() map[string]string {
+	details := map[string]string{"id": c.id}
+	if c.user != "" {
+		details["user"] = c.user
+	}
+	if c.callID != "" {
+		details["callId"] = c.callID
+	}
+	return details
+}
+
+// startCapture starts recording the messages of user, callID or both for
+// duration
+func startCapture(user, callID string, duration time.Duration, signalingLogger *log.Logger) (*capture, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	c := &capture{
+		id:      hex.EncodeToString(idBytes),
+		user:    user,
+		callID:  callID,
+		started: now,
+		expires: now.Add(duration),
+		logger:  signalingLogger,
+	}
+
+	capturesMu.Lock()
+	evictCapturesLocked()
+	captures[c.id] = c
+	capturesMu.Unlock()
+
+	c.mu.Lock()
+	c.timer = time.AfterFunc(duration, func() {
+		c.stop("duration elapsed")
+	})
+	c.mu.Unlock()
+	activeCaptureCount.Add(1)
+	signalingLogger.Printf("Capture %s started for %s (%s)", c.id, c.target(), duration)
+	return c, nil
+}
+
+// evictCapturesLocked makes room for a new capture by dropping the oldest
+// finished ones. Running captures are never dropped, so there may briefly
+// be more than maxCaptures. The caller must hold capturesMu.
+func evictCapturesLocked() {
+	if len(captures) < maxCaptures {
+		return
+	}
+	finished := make([]*capture, 0, len(captures))
+	for _, c := range captures {
+		c.mu.Lock()
+		if !c.stopped.IsZero() {
+			finished = append(finished, c)
+		}
+		c.mu.Unlock()
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].started.Before(finished[j].started) })
+	for _, c := range finished {
+		if len(captures) < maxCaptures {
+			break
+		}
+		delete(captures, c.id)
+	}
+}
+
+// stop ends the capture, keeping what it recorded. Safe to call more than once.
+func (c *capture) stop(reason string) {
+	c.mu.Lock()
+	if !c.stopped.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	c.stopped = time.Now()
+	c.stopReason = reason
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	messages, size := c.messages, c.data.Len()
+	c.mu.Unlock()
+
+	activeCaptureCount.Add(-1)
+	c.logger.Printf("Capture %s for %s stopped: %s (%d messages, %d bytes)", c.id, c.target(), reason, messages, size)
+}
+
+// record appends a message to the capture, stopping it at the size cap
+func (c *capture) record(line []byte) {
+	c.mu.Lock()
+	if !c.stopped.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	if c.data.Len()+len(line) > captureMaxBytes {
+		c.mu.Unlock()
+		c.stop("size limit reached")
+		return
+	}
+	c.data.Write(line)
+	c.messages++
+	c.mu.Unlock()
+}
+
+// captureMessage records a message to or from user, belonging to the call
+// with the given ID if it isn't empty, in every capture running for that
+// user or call. It returns right away when no capture is running.
+func captureMessage(direction, user, callID string, conn Conn, msg SignalingMessage) {
+	if activeCaptureCount.Load() == 0 || user == "" {
+		return
+	}
+
+	capturesMu.Lock()
+	var matching []*capture
+	for _, c := range captures {
+		if c.matches(user, callID) {
+			matching = append(matching, c)
+		}
+	}
+	capturesMu.Unlock()
+	if len(matching) == 0 {
+		return
+	}
+
+	if captureRedactIPs {
+		msg.Data = redactIPs(msg.Data)
+	}
+	entry := captureEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Direction: direction,
+		User:      user,
+		Message:   msg,
+	}
+	if conn != nil {
+		entry.Addr = conn.RemoteAddr().String()
+		if captureRedactIPs {
+			entry.Addr = redactIPsInString(entry.Addr)
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		matching[0].logger.Printf("Error capturing %s message for %s: %v", msg.Type, RedactName(user), err)
+		return
+	}
+	line = append(line, '\n')
+	for _, c := range matching {
+		c.record(line)
+	}
+}
+
+// captureInbound records a message read from conn. Messages from a joined
+// user are recorded under the session's name, others (such as the join
+// itself) under the name they claim. A message that doesn't name its call
+// belongs to the user's call with its receiver, if they are in one.
+func (s *Service) captureInbound(conn Conn, msg SignalingMessage) {
+	if activeCaptureCount.Load() == 0 {
+		return
+	}
+	callID := msg.CallID
+	s.registry.mu.RLock()
+	user, joined := s.registry.sessionIdToName[conn.RemoteAddr().String()]
+	if joined && callID == "" {
+		callID = s.registry.callIDLocked(user, msg.Receiver)
+	}
+	s.registry.mu.RUnlock()
+	if !joined {
+		user = msg.Sender
+	}
+	captureMessage("in", user, callID, conn, msg)
+}
+
+// redactIPs returns a copy of a message payload with the IP addresses in
+// its strings redacted, including SDP bodies and candidate lines. The
+// payload is copied through JSON, so typed payloads are redacted too and
+// the message being sent is never modified.
+func redactIPs(data interface{}) interface{} {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(encoded, &value); err != nil {
+		return nil
+	}
+	return redactValue(value)
+}
+
+// redactValue redacts the IP addresses in the strings of a decoded JSON value
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactIPsInString(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = redactValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
+
+// redactIPsInString replaces each run of address characters that parses as
+// an IP address, with or without a port (e.g. "1.2.3.4", "[2001:db8::1]:443")
+func redactIPsInString(s string) string {
+	isAddrChar := func(r rune) bool {
+		return r == '.' || r == ':' || r == '[' || r == ']' ||
+			(r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+	}
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		token := s[start:end]
+		if isIPToken(token) {
+			b.WriteString("REDACTED")
+		} else {
+			b.WriteString(token)
+		}
+		start = -1
+	}
+	for i, r := range s {
+		if isAddrChar(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			flush(i)
+		}
+		b.WriteRune(r)
+	}
+	if start >= 0 {
+		flush(len(s))
+	}
+	return b.String()
+}
+
+// isIPToken reports whether token is an IP address, optionally with a port
+func isIPToken(token string) bool {
+	if !strings.ContainsAny(token, ".:") {
+		return false
+	}
+	if host, _, err := net.SplitHostPort(token); err == nil {
+		token = host
+	}
+	return net.ParseIP(strings.Trim(token, "[]")) != nil
+}
+
+// HandleCapture serves the capture admin endpoints:
+//
+//	POST   /admin/capture?user=<name>&duration=<d>  start a capture
+//	POST   /admin/capture?callId=<id>&duration=<d>  start a capture of a call
+//	GET    /admin/capture                           list captures
+//	GET    /admin/capture/<id>                      recorded messages (JSONL)
+//	DELETE /admin/capture/<id>                      stop a capture
+//
+// It expects to be mounted at both /admin/capture and /admin/capture/.
+func HandleCapture(w http.ResponseWriter, r *http.Request, signalingLogger *log.Logger) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/capture"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodPost:
+			handleStartCapture(w, r, signalingLogger)
+		case http.MethodGet:
+			capturesMu.Lock()
+			list := make([]CaptureInfo, 0, len(captures))
+			for _, c := range captures {
+				list = append(list, c.info())
+			}
+			capturesMu.Unlock()
+			sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	capturesMu.Lock()
+	c := captures[id]
+	capturesMu.Unlock()
+	if c == nil {
+		http.Error(w, "unknown capture", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		c.mu.Lock()
+		data := append([]byte(nil), c.data.Bytes()...)
+		active := c.stopped.IsZero()
+		c.mu.Unlock()
+		// The recording holds a user's full signaling traffic, so reads are audited too
+		audit("capture_read", r.RemoteAddr, c.auditDetails())
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if active {
+			w.Header().Set("X-Capture-State", "active")
+		} else {
+			w.Header().Set("X-Capture-State", "stopped")
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		c.stop("stopped by admin request from " + r.RemoteAddr)
+		audit("capture_stop", r.RemoteAddr, c.auditDetails())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleStartCapture serves POST /admin/capture
+func handleStartCapture(w http.ResponseWriter, r *http.Request, signalingLogger *log.Logger) {
+	query := r.URL.Query()
+	user := query.Get("user")
+	callID := query.Get("callId")
+	if user == "" && callID == "" {
+		http.Error(w, "missing user or callId", http.StatusBadRequest)
+		return
+	}
+	duration := DefaultCaptureDuration
+	if param := query.Get("duration"); param != "" {
+		d, err := time.ParseDuration(param)
+		if err != nil || d <= 0 || d > maxCaptureDuration {
+			http.Error(w, "duration must be between 0 and "+maxCaptureDuration.String(), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+
+	c, err := startCapture(user, callID, duration, signalingLogger)
+	if err != nil {
+		signalingLogger.Printf("Error starting capture: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	details := c.auditDetails()
+	details["duration"] = duration.String()
+	audit("capture_start", r.RemoteAddr, details)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c.info())
+}
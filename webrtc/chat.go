@@ -0,0 +1,226 @@
+/*
+WebRTC Signaling Text Chat Relay
+================================
+
+This file implements the "chat" message type, a small text relay that runs
+over the signaling WebSocket instead of a WebRTC data channel.
+
+WHY IS THIS NEEDED?
+===================
+Users want to exchange short messages before the peer connection is up
+("calling you in a sec"), or when it fails entirely because no ICE candidate
+pair works. The signaling channel is already connected, so the server can
+relay the text itself.
+
+MESSAGE FORMAT:
+===============
+	{"type":"chat","sender":"alice","receiver":"bob","data":{"text":"hi"}}
+
+The data is forwarded unchanged, so clients may add their own fields.
+
+LIMITS:
+=======
+- Payload size: the JSON encoded data may be at most maxBytes (default 4 KB)
+- Rate limit: each sender gets a token bucket (default 5 messages per second,
+  bursts of up to twice that)
+Violations are reported back to the sender with a "chatError" message.
+
+DELIVERY:
+=========
+If the receiver isn't connected, the sender gets a "chatError" with reason
+"receiverNotFound". When history is enabled, the last M undelivered messages
+per sender/receiver pair are kept for a short while and delivered as soon as
+the receiver joins, so a peer that shows up a few seconds late still gets them.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Chat relay configuration defaults
+const (
+	DefaultChatMaxBytes   = 4096             // Largest chat payload accepted
+	DefaultChatRate       = 5.0              // Chat messages per second per sender
+	DefaultChatHistory    = 10               // Undelivered messages kept per user pair, 0 disables
+	DefaultChatHistoryTTL = 30 * time.Second // How long undelivered messages are kept
+)
+
+var (
+	// Current chat configuration, set once at startup by ConfigureChat
+	chatMaxBytes   = DefaultChatMaxBytes
+	chatRate       = DefaultChatRate
+	chatHistory    = DefaultChatHistory
+	chatHistoryTTL = DefaultChatHistoryTTL
+)
+
+// pendingChat is a chat message waiting for its receiver to join
+type pendingChat struct {
+	msg     SignalingMessage
+	expires time.Time
+}
+
+// ConfigureChat sets the chat payload limit in bytes, the per-sender rate
+// in messages per second (0 disables rate limiting) and how many undelivered
+// messages are kept per user pair (0 disables history).
+func ConfigureChat(maxBytes int, rate float64, history int) {
+	chatMaxBytes = maxBytes
+	chatRate = rate
+	chatHistory = history
+}
+
+// allowChat reports whether the session may send another chat message
+func (u *UserSession) allowChat() bool {
+	if chatRate <= 0 {
+		return true
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.chatLimiter.allow(chatRate, 2*chatRate, time.Now())
+}
+
+// HandleChat relays a short text message from the sender to the receiver
+//
+// CHAT PROCESS:
+// =============
+// 1. Validate that the sender is the user who owns this connection
+// 2. Enforce the payload size limit and the sender's rate limit
+// 3. Forward the message to the receiver if they are connected
+// 4. Otherwise report the failure and keep the message for a late joiner
+func (s *Service) HandleChat(ctx context.Context, conn Conn, msg SignalingMessage) {
+	sender := msg.Sender
+	receiver := msg.Receiver
+
+	// Only joined users can chat, and only as themselves
+	s.registry.mu.RLock()
+	senderSession, senderName, owned := s.registry.connSessionLocked(conn)
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	s.registry.mu.RUnlock()
+
+	if !owned || senderName != sender {
+		s.logger.Printf("Rejected chat from unknown sender %s", RedactName(sender))
+		s.sendChatError(ctx, conn, msg, "senderNotJoined", false)
+		return
+	}
+
+	payload, err := json.Marshal(msg.Data)
+	if err != nil || len(payload) > chatMaxBytes {
+		s.logger.Printf("Rejected chat from %s to %s: payload of %d bytes exceeds %d", RedactName(sender), RedactName(receiver), len(payload), chatMaxBytes)
+		s.sendChatError(ctx, conn, msg, "payloadTooLarge", false)
+		return
+	}
+
+	if !senderSession.allowChat() {
+		s.logger.Printf("Rejected chat from %s to %s: rate limit exceeded", RedactName(sender), RedactName(receiver))
+		s.sendChatError(ctx, conn, msg, "rateLimited", false)
+		return
+	}
+
+	chat := SignalingMessage{
+		Type:     "chat",
+		Sender:   sender,
+		Receiver: receiver,
+		Data:     msg.Data,
+	}
+
+	if !receiverExists {
+		queued := s.registry.queuePendingChat(chat)
+		s.logger.Printf("Receiver %s not found for chat from %s (queued: %t)", RedactName(receiver), RedactName(sender), queued)
+		s.sendChatError(ctx, conn, msg, "receiverNotFound", queued)
+		return
+	}
+
+	// A detached session buffers the message for replay on resume,
+	// so only real write failures count as undelivered
+	if err := receiverSession.Send(ctx, chat); err != nil && err != errSessionDetached {
+		s.logger.Printf("Error sending chat from %s to %s: %v", RedactName(sender), RedactName(receiver), err)
+		s.sendChatError(ctx, conn, msg, "deliveryFailed", false)
+		return
+	}
+
+	s.logger.Printf("Chat forwarded from %s to %s (%d bytes)", RedactName(sender), RedactName(receiver), len(payload))
+}
+
+// sendChatError tells the sender that their chat message was not delivered.
+// The reason is repeated in the data so v1 clients, which never see the
+// error field, can still show it.
+func (s *Service) sendChatError(ctx context.Context, conn Conn, msg SignalingMessage, reason string, queued bool) {
+	s.sendToConn(ctx, conn, SignalingMessage{
+		Type:     "chatError",
+		Sender:   msg.Receiver,
+		Receiver: msg.Sender,
+		Data:     map[string]interface{}{"error": reason, "queued": queued},
+		Error:    reason,
+	}, msg.Version)
+}
+
+// queuePendingChat keeps an undelivered chat message for its receiver,
+// dropping the oldest message of the pair when the history is full.
+// It returns false if history is disabled.
+func (r *Registry) queuePendingChat(msg SignalingMessage) bool {
+	if chatHistory <= 0 {
+		return false
+	}
+	r.pendingChatsMu.Lock()
+	defer r.pendingChatsMu.Unlock()
+
+	// Expired messages are swept here so the map can't grow without bound
+	now := time.Now()
+	for receiver, bySender := range r.pendingChats {
+		for sender, chats := range bySender {
+			for len(chats) > 0 && now.After(chats[0].expires) {
+				chats = chats[1:]
+			}
+			if len(chats) == 0 {
+				delete(bySender, sender)
+			} else {
+				bySender[sender] = chats
+			}
+		}
+		if len(bySender) == 0 {
+			delete(r.pendingChats, receiver)
+		}
+	}
+
+	bySender := r.pendingChats[msg.Receiver]
+	if bySender == nil {
+		bySender = make(map[string][]pendingChat)
+		r.pendingChats[msg.Receiver] = bySender
+	}
+	chats := append(bySender[msg.Sender], pendingChat{msg: msg, expires: now.Add(chatHistoryTTL)})
+	if len(chats) > chatHistory {
+		chats = chats[len(chats)-chatHistory:]
+	}
+	bySender[msg.Sender] = chats
+	return true
+}
+
+// deliverPendingChats sends the chat messages that arrived for a user
+// before they joined, oldest first per sender.
+func (s *Service) deliverPendingChats(ctx context.Context, session *UserSession) {
+	s.registry.pendingChatsMu.Lock()
+	bySender := s.registry.pendingChats[session.Name]
+	delete(s.registry.pendingChats, session.Name)
+	s.registry.pendingChatsMu.Unlock()
+
+	now := time.Now()
+	for sender, chats := range bySender {
+		delivered := 0
+		for _, chat := range chats {
+			if now.After(chat.expires) {
+				continue
+			}
+			if err := session.Send(ctx, chat.msg); err != nil {
+				s.logger.Printf("Error delivering queued chat from %s to %s: %v", RedactName(sender), RedactName(session.Name), err)
+				break
+			}
+			delivered++
+		}
+		if delivered > 0 {
+			s.logger.Printf("Delivered %d queued chat messages from %s to %s", delivered, RedactName(sender), RedactName(session.Name))
+		}
+	}
+}
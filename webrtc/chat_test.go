@@ -0,0 +1,124 @@
+package webrtc
+
+import (
+	"context"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordConn is a client that keeps every message written to it
+type recordConn struct {
+	*listConn
+
+	mu       sync.Mutex
+	messages []SignalingMessage
+}
+
+func newRecordConn(port int) *recordConn {
+	return &recordConn{listConn: newListConn(port)}
+}
+
+func (c *recordConn) WriteMessage(msg SignalingMessage) error {
+	c.mu.Lock()
+	c.messages = append(c.messages, msg)
+	c.mu.Unlock()
+	return c.listConn.WriteMessage(msg)
+}
+
+// received returns the messages of the given type written so far
+func (c *recordConn) received(msgType string) []SignalingMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var matching []SignalingMessage
+	for _, msg := range c.messages {
+		if msg.Type == msgType {
+			matching = append(matching, msg)
+		}
+	}
+	return matching
+}
+
+// expect waits for a message of the given type to be written
+func (c *recordConn) expect(t *testing.T, msgType string) SignalingMessage {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if matching := c.received(msgType); len(matching) > 0 {
+			return matching[0]
+		}
+	}
+	t.Fatalf("no %s written", msgType)
+	return SignalingMessage{}
+}
+
+// joinRecorded joins name on a new recording connection
+func joinRecorded(t *testing.T, s *Service, name string, port int) *recordConn {
+	t.Helper()
+	conn := newRecordConn(port)
+	s.HandleJoin(context.Background(), conn, SignalingMessage{Type: "join", Sender: name})
+	if join := conn.expect(t, "join"); join.Data.(JoinResult).Result != true {
+		t.Fatalf("join as %s refused: %+v", name, join)
+	}
+	return conn
+}
+
+// A chat is only forwarded from the connection of the user it claims to be
+// from
+func TestChatSenderMustOwnConnection(t *testing.T) {
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	t.Cleanup(s.Shutdown)
+	alice := joinRecorded(t, s, "alice", 50001)
+	bob := joinRecorded(t, s, "bob", 50002)
+	mallory := joinRecorded(t, s, "mallory", 50003)
+	ctx := context.Background()
+
+	s.HandleChat(ctx, mallory, SignalingMessage{Type: "chat", Sender: "alice", Receiver: "bob", Data: map[string]any{"text": "spoofed"}})
+	// v1 clients get the reason in the data
+	if reply := mallory.expect(t, "chatError"); reply.Data.(map[string]any)["error"] != "senderNotJoined" {
+		t.Fatalf("spoofed chat answered with %+v, want senderNotJoined", reply)
+	}
+
+	s.HandleChat(ctx, alice, SignalingMessage{Type: "chat", Sender: "alice", Receiver: "bob", Data: map[string]any{"text": "hi"}})
+	chat := bob.expect(t, "chat")
+	if text := chat.Data.(map[string]any)["text"]; chat.Sender != "alice" || text != "hi" {
+		t.Fatalf("bob got %+v, want alice's hi", chat)
+	}
+	if chats := bob.received("chat"); len(chats) != 1 {
+		t.Fatalf("bob got %d chats, want only alice's", len(chats))
+	}
+}
+
+// Chats are checked against the sender's connection while a resume or a
+// replacing join swaps it, under the session's lock (run with -race)
+func TestChatWhileConnectionSwapped(t *testing.T) {
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	t.Cleanup(s.Shutdown)
+	alice := joinRecorded(t, s, "alice", 50001)
+	joinRecorded(t, s, "bob", 50002)
+	session, _ := s.Registry().Get("alice")
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			session.mu.Lock()
+			session.Conn = alice
+			session.mu.Unlock()
+			runtime.Gosched()
+		}
+	}()
+	for range 20 {
+		s.HandleChat(context.Background(), alice, SignalingMessage{Type: "chat", Sender: "alice", Receiver: "bob", Data: map[string]any{"text": "hi"}})
+		runtime.Gosched()
+	}
+	close(stop)
+	<-stopped
+}
@@ -0,0 +1,921 @@
+/*
+WebRTC Signaling Client
+=======================
+
+This package implements a small Go client for the WebSocket signaling
+protocol served by the webrtc package on /signal.
+
+WHY A GO CLIENT?
+================
+Test bots, IoT devices and server-side tools need to talk to the signaling
+server without a browser. Instead of hand-rolling gorilla/websocket plus the
+SignalingMessage shape, they can use this package, which speaks exactly the
+same message types the server uses.
+
+USAGE:
+======
+
+	c, err := client.Dial("ws://localhost:8080/signal", "alice")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	c.OnCall(func(from string) {
+		c.AcceptCall(from)
+	})
+	c.OnOffer(func(from string, offer json.RawMessage) {
+		// hand the offer to your WebRTC stack, then:
+		c.SendAnswer(from, answer)
+	})
+
+	c.Call("bob")
+
+CALLBACKS:
+==========
+Callbacks are invoked from the client's read goroutine, one at a time and in
+the order the messages arrive. A callback may call any Send method, but it
+should not block for long or later messages will queue up behind it.
+
+CLOSE CODES:
+============
+When the connection ends, Done is closed and CloseCode tells why: 1000
+after a leave, 1001 when the server shut down (reconnect later), 1002 for a
+protocol error, 1008 for a kick or rate limit, 1009 for an oversized
+message, 4001 for reading too slowly, 4002 for not answering pings and 4003
+when a newer join under the same name replaced the session.
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-server/webrtc"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ErrJoinRejected is returned by Dial when the server refuses the join,
+// usually because the username already has an active session.
+var ErrJoinRejected = errors.New("signaling: join rejected by server")
+
+// envelope mirrors webrtc.SignalingMessage but keeps Data raw so that each
+// callback can decode it into the type it expects.
+type envelope struct {
+	Type     string          `json:"type"`
+	Sender   string          `json:"sender"`
+	Receiver string          `json:"receiver"`
+	Data     json.RawMessage `json:"data"`
+	Error    string          `json:"error,omitempty"`
+	Seq      uint64          `json:"seq,omitempty"`
+	// Negotiation epoch of an offer, answer or candidate (v2 only)
+	NegotiationEpoch uint64 `json:"negotiationEpoch,omitempty"`
+	CallID           string `json:"callId,omitempty"` // Call the message belongs to (v2 only)
+}
+
+// chatData is the payload of a chat message.
+type chatData struct {
+	Text string `json:"text"`
+}
+
+// metadataData is the data of a join or setMetadata message carrying metadata.
+type metadataData struct {
+	Metadata *webrtc.UserMetadata `json:"metadata"`
+}
+
+// iceRestartData is the payload of an iceRestart message.
+type iceRestartData struct {
+	NegotiationEpoch uint64 `json:"negotiationEpoch"`
+}
+
+// transferResultData is the payload of a transferResult message.
+type transferResultData struct {
+	Result bool   `json:"result"`
+	Target string `json:"target"`
+	Reason string `json:"reason"`
+}
+
+// callControlData is the payload of a callControl message.
+type callControlData struct {
+	Control string      `json:"control"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// chatErrorData is the payload of a chatError reply.
+type chatErrorData struct {
+	Error  string `json:"error"`
+	Queued bool   `json:"queued"`
+}
+
+// Client is a connection to the signaling server for a single user.
+type Client struct {
+	// Name is the username this client joined with.
+	Name string
+	// Version is the signaling protocol version negotiated with the server.
+	Version int
+	// CallState is the call this client took over when its join replaced
+	// the user's session on another connection (see -join-policy), nil if
+	// it didn't. The peer was sent a peerReplaced and expects this client
+	// to renegotiate media.
+	CallState *webrtc.CallState
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	hooksMu       sync.RWMutex
+	onCall        func(from string)
+	onCancelCall  func(from string)
+	onAcceptCall  func(from string)
+	onCallFailed  func(to string, reason string)
+	onOffer       func(from string, offer json.RawMessage)
+	onAnswer      func(from string, answer json.RawMessage)
+	onCandidate   func(from string, candidate json.RawMessage)
+	onHangUp      func(from string)
+	onActiveUsers func(users []webrtc.ActiveUser)
+	onUsersPage   func(page webrtc.ActiveUsersPage)
+	onChat        func(from string, text string)
+	onChatError   func(to string, reason string)
+	onKicked      func(reason string)
+	onCallControl func(from string, control string, data json.RawMessage)
+	onTransfer    func(target string, ok bool, reason string)
+	onTransferred func(by string, peer string)
+	onIceRestart  func(from string, epoch uint64)
+	onMissedCalls func(calls []webrtc.MissedCall)
+	onReplaced    func()
+	onPeerReplace func(from string)
+	onUndelivered func(to string, msgType string)
+
+	// Negotiation epoch of the current call, learned from iceRestart
+	// messages; 0 until the first restart
+	epoch atomic.Uint64
+	// ID of the current call (a string), learned from call, acceptCall and
+	// callTransferred messages; empty outside a call and with protocol v1
+	callID atomic.Value
+
+	// Current user list, rebuilt from snapshots and deltas. Only touched
+	// by the read goroutine.
+	users map[string]webrtc.ActiveUser
+
+	done chan struct{}
+	err  error
+}
+
+// Dial connects to the signaling endpoint at url (e.g. "ws://host:8080/signal")
+// and joins as username using protocol v1. It returns once the server has
+// accepted the join.
+func Dial(url, username string) (*Client, error) {
+	return DialVersion(url, username, webrtc.ProtocolV1)
+}
+
+// DialVersion is like Dial but negotiates the given signaling protocol version.
+func DialVersion(url, username string, version int) (*Client, error) {
+	return DialOptions(url, Options{Username: username, Version: version})
+}
+
+// Options configures a connection made with DialOptions.
+type Options struct {
+	// Username to join as. An empty name joins as a guest with a name the
+	// server generates, if it allows guests; Client.Name then holds it.
+	Username string
+	// Version is the signaling protocol version to negotiate. 0 means v1.
+	Version int
+	// Compression offers permessage-deflate to the server, which uses it
+	// if it was started with -ws-compression.
+	Compression bool
+	// MessagePack encodes messages as MessagePack binary frames instead of JSON.
+	MessagePack bool
+	// Metadata is sent with the join and shown to v2 clients in the user
+	// list. nil sends none.
+	Metadata *webrtc.UserMetadata
+	// OnMissedCalls receives the calls this user missed, oldest first.
+	// The server sends them right after the join, before DialOptions
+	// returns, so the callback is set here rather than with a method.
+	OnMissedCalls func(calls []webrtc.MissedCall)
+}
+
+// DialOptions is like Dial but takes all connection settings in opts.
+func DialOptions(url string, opts Options) (*Client, error) {
+	username, version := opts.Username, opts.Version
+	if version == 0 {
+		version = webrtc.ProtocolV1
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = opts.Compression
+	if opts.MessagePack {
+		dialer.Subprotocols = []string{webrtc.SubprotocolMsgpack}
+	}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial signaling server: %w", err)
+	}
+
+	c := &Client{
+		Name:          username,
+		Version:       version,
+		conn:          conn,
+		users:         make(map[string]webrtc.ActiveUser),
+		done:          make(chan struct{}),
+		onMissedCalls: opts.OnMissedCalls,
+	}
+
+	join := webrtc.SignalingMessage{Type: "join", Sender: username}
+	if version != webrtc.ProtocolV1 {
+		join.Version = version
+	}
+	if opts.Metadata != nil {
+		join.Data = metadataData{Metadata: opts.Metadata}
+	}
+	if err := c.send(join); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send join: %w", err)
+	}
+
+	// The join response is always the first message the server sends back
+	// to a new connection, so read it synchronously before starting the loop.
+	var env envelope
+	if err := c.read(&env); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read join response: %w", err)
+	}
+	if env.Type == "error" {
+		conn.Close()
+		return nil, fmt.Errorf("signaling: server refused connection: %s", env.Error)
+	}
+	if env.Type != "join" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected %q message while waiting for join response", env.Type)
+	}
+	var result webrtc.JoinResult
+	if err := json.Unmarshal(env.Data, &result); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to decode join response: %w", err)
+	}
+	if !result.Result {
+		conn.Close()
+		if env.Error != "" {
+			return nil, fmt.Errorf("%w: %s", ErrJoinRejected, env.Error)
+		}
+		return nil, ErrJoinRejected
+	}
+	if result.Username != "" {
+		c.Name = result.Username
+	}
+	if result.CallState != nil {
+		c.CallState = result.CallState
+		c.callID.Store(result.CallState.CallID)
+		c.epoch.Store(result.CallState.NegotiationEpoch)
+	}
+
+	go c.readLoop()
+	return c, nil
+}
+
+// OnCall registers the callback for incoming calls.
+func (c *Client) OnCall(fn func(from string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onCall = fn
+}
+
+// OnCancelCall registers the callback for calls cancelled by the caller.
+func (c *Client) OnCancelCall(fn func(from string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onCancelCall = fn
+}
+
+// OnAcceptCall registers the callback for when a callee accepts our call.
+func (c *Client) OnAcceptCall(fn func(from string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onAcceptCall = fn
+}
+
+// OnCallFailed registers the callback for calls the server refused to place,
+// with the reason reported by the server (e.g. "doNotDisturb").
+func (c *Client) OnCallFailed(fn func(to string, reason string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onCallFailed = fn
+}
+
+// OnDeliveryFailed registers the callback for messages the server couldn't
+// deliver to the peer, with the type of the message (e.g. "call" or
+// "hangUp"). A call that couldn't be delivered has ended.
+func (c *Client) OnDeliveryFailed(fn func(to string, msgType string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onUndelivered = fn
+}
+
+// OnCallControl registers the callback for in-call controls from the peer.
+// control is "callHold", "callResume" or "muteState" (with the mute state as
+// data), or the name of a control sent with SendCallControl.
+func (c *Client) OnCallControl(fn func(from string, control string, data json.RawMessage)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onCallControl = fn
+}
+
+// OnTransferResult registers the callback for the outcome of a TransferCall,
+// with the reason the server reported if it failed (e.g. "declined").
+func (c *Client) OnTransferResult(fn func(target string, ok bool, reason string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onTransfer = fn
+}
+
+// OnCallTransferred registers the callback for when a call this user is in
+// was transferred by the user by, making peer the new peer. The remaining
+// party of the original call should send the new offer.
+func (c *Client) OnCallTransferred(fn func(by string, peer string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onTransferred = fn
+}
+
+// OnIceRestart registers the callback for when the peer restarts ICE,
+// e.g. after changing networks. Offers, answers and candidates from before
+// the restart are discarded from then on.
+func (c *Client) OnIceRestart(fn func(from string, epoch uint64)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onIceRestart = fn
+}
+
+// OnOffer registers the callback for incoming SDP offers.
+func (c *Client) OnOffer(fn func(from string, offer json.RawMessage)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onOffer = fn
+}
+
+// OnAnswer registers the callback for incoming SDP answers.
+func (c *Client) OnAnswer(fn func(from string, answer json.RawMessage)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onAnswer = fn
+}
+
+// OnCandidate registers the callback for incoming ICE candidates.
+func (c *Client) OnCandidate(fn func(from string, candidate json.RawMessage)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onCandidate = fn
+}
+
+// OnHangUp registers the callback for when the peer ends the call.
+func (c *Client) OnHangUp(fn func(from string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onHangUp = fn
+}
+
+// OnActiveUsers registers the callback for active user list updates.
+// v2 servers only send changes; the client applies them and always passes
+// the complete list, sorted by name.
+func (c *Client) OnActiveUsers(fn func(users []webrtc.ActiveUser)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onActiveUsers = fn
+}
+
+// OnChat registers the callback for incoming chat messages.
+func (c *Client) OnChat(fn func(from string, text string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onChat = fn
+}
+
+// OnChatError registers the callback for chat messages the server could not
+// deliver, with the reason reported by the server (e.g. "receiverNotFound").
+func (c *Client) OnChatError(fn func(to string, reason string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onChatError = fn
+}
+
+// OnKicked registers the callback for when an admin disconnects this user,
+// with the reason given by the admin. The connection closes right after.
+func (c *Client) OnKicked(fn func(reason string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onKicked = fn
+}
+
+// OnSessionReplaced registers the callback for when a newer join under
+// this client's name, e.g. from another device, replaced its session. The
+// connection closes right after, with code 4003; reconnecting would replace
+// the other device in turn.
+func (c *Client) OnSessionReplaced(fn func()) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onReplaced = fn
+}
+
+// OnPeerReplaced registers the callback for when the peer's session was
+// replaced by a join from another device that carried the call over. The
+// call goes on, but media has to be renegotiated with the new device.
+func (c *Client) OnPeerReplaced(fn func(from string)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onPeerReplace = fn
+}
+
+// OnActiveUsersPage registers the callback for pages requested with
+// RequestActiveUsersPage.
+func (c *Client) OnActiveUsersPage(fn func(page webrtc.ActiveUsersPage)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onUsersPage = fn
+}
+
+// RequestActiveUsers asks the server for the current user list. The answer
+// is delivered to the OnActiveUsers callback.
+func (c *Client) RequestActiveUsers() error {
+	return c.send(webrtc.SignalingMessage{Type: "activeUsers", Sender: c.Name})
+}
+
+// RequestActiveUsersPage asks the server for one page of the user list,
+// sorted by name and filtered by name prefix. A limit of 0 uses the server's
+// maximum page size. The answer is delivered to the OnActiveUsersPage callback.
+func (c *Client) RequestActiveUsersPage(offset, limit int, prefix string) error {
+	return c.send(webrtc.SignalingMessage{
+		Type:   "activeUsers",
+		Sender: c.Name,
+		Data:   map[string]interface{}{"offset": offset, "limit": limit, "prefix": prefix},
+	})
+}
+
+// Call starts a call to the named user.
+func (c *Client) Call(to string) error {
+	c.epoch.Store(0)
+	c.callID.Store("")
+	return c.send(webrtc.SignalingMessage{Type: "call", Sender: c.Name, Receiver: to})
+}
+
+// CancelCall cancels an outgoing call that has not been accepted yet.
+func (c *Client) CancelCall(to string) error {
+	err := c.send(webrtc.SignalingMessage{Type: "cancelCall", Sender: c.Name, Receiver: to, CallID: c.CallID()})
+	c.callID.Store("")
+	return err
+}
+
+// AcceptCall accepts an incoming call from the named user.
+func (c *Client) AcceptCall(from string) error {
+	c.epoch.Store(0)
+	return c.send(webrtc.SignalingMessage{Type: "acceptCall", Sender: c.Name, Receiver: from, CallID: c.CallID()})
+}
+
+// SendOffer sends an SDP offer to the peer. The offer is marshaled as JSON
+// and forwarded unchanged by the server. It must marshal to a session
+// description, {"type":"offer","sdp":"v=0..."}, as pion's
+// webrtc.SessionDescription does; the server drops anything else.
+func (c *Client) SendOffer(to string, offer interface{}) error {
+	return c.send(webrtc.SignalingMessage{Type: "offer", Sender: c.Name, Receiver: to, Data: offer, NegotiationEpoch: c.epoch.Load(), CallID: c.CallID()})
+}
+
+// SendAnswer sends an SDP answer to the peer.
+func (c *Client) SendAnswer(to string, answer interface{}) error {
+	return c.send(webrtc.SignalingMessage{Type: "answer", Sender: c.Name, Receiver: to, Data: answer, NegotiationEpoch: c.epoch.Load(), CallID: c.CallID()})
+}
+
+// SendCandidate sends an ICE candidate to the peer. It must marshal to an
+// ICE candidate, {"candidate":"candidate:...","sdpMid":"0"}, as pion's
+// webrtc.ICECandidateInit does.
+func (c *Client) SendCandidate(to string, candidate interface{}) error {
+	return c.send(webrtc.SignalingMessage{Type: "candidate", Sender: c.Name, Receiver: to, Data: candidate, NegotiationEpoch: c.epoch.Load(), CallID: c.CallID()})
+}
+
+// ClearMissedCalls acknowledges the missed calls delivered on join, so they
+// aren't delivered again. A zero until clears them all; otherwise only those
+// at or before until, the time of the newest one shown.
+func (c *Client) ClearMissedCalls(until time.Time) error {
+	msg := webrtc.SignalingMessage{Type: "clearMissedCalls", Sender: c.Name}
+	if !until.IsZero() {
+		msg.Data = map[string]string{"until": until.UTC().Format(time.RFC3339)}
+	}
+	return c.send(msg)
+}
+
+// RestartIce tells the peer that this user is restarting ICE, e.g. after a
+// network change, and starts a new negotiation epoch for the call. Send the
+// new offer once the server confirms; offers, answers and candidates from
+// before the restart are then discarded.
+func (c *Client) RestartIce(to string) error {
+	return c.send(webrtc.SignalingMessage{Type: "iceRestart", Sender: c.Name, Receiver: to, CallID: c.CallID()})
+}
+
+// HoldCall tells the peer of an accepted call that this user put it on hold.
+func (c *Client) HoldCall(to string) error {
+	return c.send(webrtc.SignalingMessage{Type: "callHold", Sender: c.Name, Receiver: to, CallID: c.CallID()})
+}
+
+// ResumeCall tells the peer that this user took the call off hold.
+func (c *Client) ResumeCall(to string) error {
+	return c.send(webrtc.SignalingMessage{Type: "callResume", Sender: c.Name, Receiver: to, CallID: c.CallID()})
+}
+
+// SendMuteState tells the peer which tracks this user muted. state must
+// marshal to a JSON object, e.g. map[string]bool{"audio": true}.
+func (c *Client) SendMuteState(to string, state interface{}) error {
+	return c.send(webrtc.SignalingMessage{Type: "muteState", Sender: c.Name, Receiver: to, Data: state, CallID: c.CallID()})
+}
+
+// SendCallControl sends the peer a control of the client's own, named with
+// letters, digits, dashes or underscores. The server relays it unchanged.
+func (c *Client) SendCallControl(to, control string, data interface{}) error {
+	return c.send(webrtc.SignalingMessage{Type: "callControl", Sender: c.Name, Receiver: to, Data: callControlData{Control: control, Data: data}, CallID: c.CallID()})
+}
+
+// TransferCall hands this user's side of the current call over to target.
+// The outcome is delivered to the OnTransferResult callback.
+func (c *Client) TransferCall(target string) error {
+	return c.send(webrtc.SignalingMessage{Type: "transferCall", Sender: c.Name, Receiver: target})
+}
+
+// SetStatus changes this user's presence status: "available", "away", "dnd"
+// or "invisible".
+func (c *Client) SetStatus(status string) error {
+	return c.send(webrtc.SignalingMessage{Type: "setStatus", Sender: c.Name, Data: map[string]string{"status": status}})
+}
+
+// SetMetadata replaces this user's display name, avatar URL and
+// capabilities. nil clears them.
+func (c *Client) SetMetadata(metadata *webrtc.UserMetadata) error {
+	return c.send(webrtc.SignalingMessage{Type: "setMetadata", Sender: c.Name, Data: metadataData{Metadata: metadata}})
+}
+
+// SendChat sends a short text message to the named user through the server.
+func (c *Client) SendChat(to, text string) error {
+	return c.send(webrtc.SignalingMessage{Type: "chat", Sender: c.Name, Receiver: to, Data: chatData{Text: text}})
+}
+
+// HangUp ends the current call with the peer.
+func (c *Client) HangUp(to string) error {
+	err := c.send(webrtc.SignalingMessage{Type: "hangUp", Sender: c.Name, Receiver: to, CallID: c.CallID()})
+	c.callID.Store("")
+	return err
+}
+
+// CallID returns the ID the server gave the current call, which every
+// message about the call carries. It is empty outside a call, while an
+// outgoing call rings, and with protocol v1.
+func (c *Client) CallID() string {
+	callID, _ := c.callID.Load().(string)
+	return callID
+}
+
+// Close sends a leave message and closes the connection.
+func (c *Client) Close() error {
+	c.send(webrtc.SignalingMessage{Type: "leave", Sender: c.Name})
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Done is closed when the connection to the server has ended.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that ended the connection, if any.
+// It is only valid after Done has been closed.
+func (c *Client) Err() error {
+	<-c.done
+	return c.err
+}
+
+// CloseCode returns the WebSocket close code and reason the server ended
+// the connection with, e.g. 1001 when it shut down, 1008 when the user was
+// kicked or 4001 when the client read too slowly. It returns 1006
+// (websocket.CloseAbnormalClosure) if the connection ended without a close
+// frame, including when the client closed it itself. It blocks until Done
+// has been closed.
+func (c *Client) CloseCode() (int, string) {
+	var closeErr *websocket.CloseError
+	if errors.As(c.Err(), &closeErr) {
+		return closeErr.Code, closeErr.Text
+	}
+	return websocket.CloseAbnormalClosure, ""
+}
+
+// send writes a message to the server. Writes are serialized because
+// gorilla/websocket allows only one concurrent writer.
+func (c *Client) send(msg webrtc.SignalingMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.conn.Subprotocol() != webrtc.SubprotocolMsgpack {
+		return c.conn.WriteJSON(msg)
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(msg); err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+}
+
+// read reads the next message from the server. MessagePack data is
+// converted to JSON so callbacks see the same json.RawMessage either way.
+func (c *Client) read(env *envelope) error {
+	if c.conn.Subprotocol() != webrtc.SubprotocolMsgpack {
+		return c.conn.ReadJSON(env)
+	}
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return err
+	}
+	var msg webrtc.SignalingMessage
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&msg); err != nil {
+		return err
+	}
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return err
+	}
+	*env = envelope{
+		Type:             msg.Type,
+		Sender:           msg.Sender,
+		Receiver:         msg.Receiver,
+		Data:             data,
+		Error:            msg.Error,
+		Seq:              msg.Seq,
+		NegotiationEpoch: msg.NegotiationEpoch,
+		CallID:           msg.CallID,
+	}
+	return nil
+}
+
+// readLoop reads messages until the connection closes and dispatches each
+// one to the matching callback.
+func (c *Client) readLoop() {
+	defer close(c.done)
+	for {
+		var env envelope
+		if err := c.read(&env); err != nil {
+			c.err = err
+			return
+		}
+		c.dispatch(env)
+	}
+}
+
+// dispatch routes a single message to its registered callback.
+func (c *Client) dispatch(env envelope) {
+	// Copy the hooks so callbacks can register other hooks without deadlocking
+	c.hooksMu.RLock()
+	onCall, onCancelCall, onAcceptCall := c.onCall, c.onCancelCall, c.onAcceptCall
+	onOffer, onAnswer, onCandidate := c.onOffer, c.onAnswer, c.onCandidate
+	onHangUp, onActiveUsers := c.onHangUp, c.onActiveUsers
+	onChat, onChatError, onCallFailed := c.onChat, c.onChatError, c.onCallFailed
+	onUsersPage, onKicked, onCallControl := c.onUsersPage, c.onKicked, c.onCallControl
+	onTransfer, onTransferred, onIceRestart := c.onTransfer, c.onTransferred, c.onIceRestart
+	onMissedCalls, onReplaced, onPeerReplace := c.onMissedCalls, c.onReplaced, c.onPeerReplace
+	onUndelivered := c.onUndelivered
+	c.hooksMu.RUnlock()
+
+	switch env.Type {
+	case "call":
+		c.callID.Store(env.CallID)
+		if onCall != nil {
+			onCall(env.Sender)
+		}
+	case "cancelCall":
+		c.endCall(env)
+		if onCancelCall != nil {
+			onCancelCall(env.Sender)
+		}
+	case "acceptCall":
+		c.callID.Store(env.CallID)
+		if onAcceptCall != nil {
+			onAcceptCall(env.Sender)
+		}
+	case "callFailed":
+		c.endCall(env)
+		if onCallFailed != nil {
+			var failed struct {
+				Reason string `json:"reason"`
+			}
+			if err := json.Unmarshal(env.Data, &failed); err == nil {
+				onCallFailed(env.Sender, failed.Reason)
+			}
+		}
+	case "deliveryFailed":
+		var failed struct {
+			Type     string `json:"type"`
+			Receiver string `json:"receiver"`
+		}
+		if err := json.Unmarshal(env.Data, &failed); err != nil {
+			return
+		}
+		if failed.Type == "call" || failed.Type == "acceptCall" {
+			c.endCall(env)
+		}
+		if onUndelivered != nil {
+			onUndelivered(failed.Receiver, failed.Type)
+		}
+	case "offer":
+		if c.stale(env) {
+			return
+		}
+		if onOffer != nil {
+			onOffer(env.Sender, env.Data)
+		}
+	case "answer":
+		if c.stale(env) {
+			return
+		}
+		if onAnswer != nil {
+			onAnswer(env.Sender, env.Data)
+		}
+	case "candidate":
+		if c.stale(env) {
+			return
+		}
+		if onCandidate != nil {
+			onCandidate(env.Sender, env.Data)
+		}
+	case "hangUp":
+		c.endCall(env)
+		if onHangUp != nil {
+			onHangUp(env.Sender)
+		}
+	case "chat":
+		if onChat != nil {
+			var chat chatData
+			if err := json.Unmarshal(env.Data, &chat); err == nil {
+				onChat(env.Sender, chat.Text)
+			}
+		}
+	case "chatError":
+		if onChatError != nil {
+			var chatErr chatErrorData
+			if err := json.Unmarshal(env.Data, &chatErr); err == nil {
+				onChatError(env.Sender, chatErr.Error)
+			}
+		}
+	case "callHold", "callResume", "muteState":
+		if onCallControl != nil {
+			onCallControl(env.Sender, env.Type, env.Data)
+		}
+	case "callControl":
+		if onCallControl != nil {
+			var control struct {
+				Control string          `json:"control"`
+				Data    json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(env.Data, &control); err == nil {
+				onCallControl(env.Sender, control.Control, control.Data)
+			}
+		}
+	case "iceRestart":
+		var restart iceRestartData
+		if err := json.Unmarshal(env.Data, &restart); err != nil || restart.NegotiationEpoch == 0 {
+			return
+		}
+		c.epoch.Store(restart.NegotiationEpoch)
+		// The server's confirmation of our own restart has no sender
+		if env.Sender != "" && onIceRestart != nil {
+			onIceRestart(env.Sender, restart.NegotiationEpoch)
+		}
+	case "missedCalls":
+		if onMissedCalls != nil {
+			var missed webrtc.MissedCalls
+			if err := json.Unmarshal(env.Data, &missed); err == nil {
+				onMissedCalls(missed.Calls)
+			}
+		}
+	case "transferResult":
+		var result transferResultData
+		if err := json.Unmarshal(env.Data, &result); err != nil {
+			return
+		}
+		// This user left the call once it was handed over
+		if result.Result {
+			c.callID.Store("")
+		}
+		if onTransfer != nil {
+			onTransfer(result.Target, result.Result, result.Reason)
+		}
+	case "callTransferred":
+		// The call with the new peer is a new call, starting at the
+		// first epoch
+		c.epoch.Store(0)
+		c.callID.Store(env.CallID)
+		if onTransferred != nil {
+			var transferred struct {
+				Peer string `json:"peer"`
+			}
+			if err := json.Unmarshal(env.Data, &transferred); err == nil {
+				onTransferred(env.Sender, transferred.Peer)
+			}
+		}
+	case "kicked":
+		if onKicked != nil {
+			var kicked webrtc.KickInfo
+			if err := json.Unmarshal(env.Data, &kicked); err == nil {
+				onKicked(kicked.Reason)
+			}
+		}
+	case "sessionReplaced":
+		if onReplaced != nil {
+			onReplaced()
+		}
+	case "peerReplaced":
+		if onPeerReplace != nil {
+			onPeerReplace(env.Sender)
+		}
+	case "activeUsers", "userAdded", "userUpdated", "userRemoved":
+		// Pages carry a total and are answers to RequestActiveUsersPage,
+		// not updates to the full list
+		var page webrtc.ActiveUsersPage
+		if env.Type == "activeUsers" && isPage(env.Data) {
+			if onUsersPage != nil && json.Unmarshal(env.Data, &page) == nil {
+				onUsersPage(page)
+			}
+			return
+		}
+		if c.applyUserList(env) && onActiveUsers != nil {
+			onActiveUsers(c.userList())
+		}
+	}
+}
+
+// applyUserList updates the client's user list from a full snapshot or a
+// single delta. It returns false if the message couldn't be decoded.
+func (c *Client) applyUserList(env envelope) bool {
+	switch env.Type {
+	case "activeUsers":
+		var users webrtc.ActiveUsers
+		if err := json.Unmarshal(env.Data, &users); err != nil {
+			return false
+		}
+		c.users = make(map[string]webrtc.ActiveUser, len(users.Users))
+		for _, user := range users.Users {
+			c.users[user.Name] = user
+		}
+	case "userAdded", "userUpdated":
+		var user webrtc.ActiveUser
+		if err := json.Unmarshal(env.Data, &user); err != nil {
+			return false
+		}
+		c.users[user.Name] = user
+	case "userRemoved":
+		var user webrtc.ActiveUser
+		if err := json.Unmarshal(env.Data, &user); err != nil {
+			return false
+		}
+		delete(c.users, user.Name)
+	}
+	return true
+}
+
+// stale reports whether an offer, answer or candidate belongs to a
+// negotiation epoch from before the last ICE restart, or to another call
+func (c *Client) stale(env envelope) bool {
+	if callID := c.CallID(); env.CallID != "" && callID != "" && env.CallID != callID {
+		return true
+	}
+	return env.NegotiationEpoch != 0 && env.NegotiationEpoch < c.epoch.Load()
+}
+
+// endCall forgets the current call when a message ends it. One naming an
+// earlier call leaves the current one alone.
+func (c *Client) endCall(env envelope) {
+	if env.CallID == "" || env.CallID == c.CallID() {
+		c.callID.Store("")
+	}
+}
+
+// isPage reports whether activeUsers data is a page rather than the full list.
+func isPage(data json.RawMessage) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	_, hasTotal := fields["total"]
+	return hasTotal
+}
+
+// userList returns the current user list sorted by name.
+func (c *Client) userList() []webrtc.ActiveUser {
+	users := make([]webrtc.ActiveUser, 0, len(c.users))
+	for _, user := range c.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
@@ -0,0 +1,144 @@
+/*
+WebRTC Signaling Message Encodings
+==================================
+
+This file implements the wire encodings a signaling connection can use:
+JSON (the default) and MessagePack.
+
+WHY MESSAGEPACK?
+================
+Encoding SDPs and floods of ICE candidates as JSON is measurable overhead
+on constrained devices. MessagePack is a binary format with the same data
+model, so the same SignalingMessage can be sent in fewer bytes and with
+cheaper parsing.
+
+NEGOTIATION:
+============
+The encoding is chosen with the WebSocket subprotocol:
+- "signal-json": JSON text frames (also used when no subprotocol is requested)
+- "signal-msgpack": MessagePack binary frames
+
+The choice is per connection, so JSON and MessagePack clients can call each
+other through the same server. MessagePack messages use the same field names
+as the JSON ones ("type", "sender", "receiver", "data", ...).
+*/
+
+package webrtc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WebSocket subprotocols selecting the message encoding
+const (
+	SubprotocolJSON    = "signal-json"
+	SubprotocolMsgpack = "signal-msgpack"
+)
+
+// isMsgpack reports whether the connection negotiated MessagePack
+func isMsgpack(conn *websocket.Conn) bool {
+	return conn.Subprotocol() == SubprotocolMsgpack
+}
+
+// encodeMessage encodes a message in the connection's encoding and returns
+// the WebSocket frame type to send it in.
+func encodeMessage(conn *websocket.Conn, msg SignalingMessage) (int, []byte, error) {
+	if !isMsgpack(conn) {
+		data, err := json.Marshal(msg)
+		return websocket.TextMessage, data, err
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(msg); err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, buf.Bytes(), nil
+}
+
+// readMessage reads the next message from the connection in its encoding
+func readMessage(conn *websocket.Conn, msg *SignalingMessage) error {
+	_, frame, err := conn.NextReader()
+	if err != nil {
+		return err
+	}
+	// Tell connection failures (e.g. the read limit) apart from malformed messages
+	r := &frameReader{r: frame}
+	if !isMsgpack(conn) {
+		if err := json.NewDecoder(r).Decode(msg); err != nil {
+			return r.decodeError(err)
+		}
+		return nil
+	}
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	dec.UseLooseInterfaceDecoding(true)
+	if err := dec.Decode(msg); err != nil {
+		return r.decodeError(err)
+	}
+	// Handlers inspect Data the way encoding/json decodes it
+	msg.Data = normalizeMsgpackValue(msg.Data)
+	return nil
+}
+
+// frameReader remembers whether reading a message frame failed, so a
+// decoder error can be blamed on the connection or on the message
+type frameReader struct {
+	r   io.Reader
+	err error // Read error other than the end of the frame
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err != nil && err != io.EOF {
+		f.err = err
+	}
+	return n, err
+}
+
+// decodeError returns the read error if there was one, otherwise the
+// decoder error marked as a malformed message
+func (f *frameReader) decodeError(err error) error {
+	if f.err != nil {
+		return f.err
+	}
+	return &parseError{err}
+}
+
+// normalizeMsgpackValue converts decoded MessagePack values to the types
+// encoding/json would have produced: numbers become float64 and maps get
+// string keys.
+func normalizeMsgpackValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeMsgpackValue(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if name, ok := key.(string); ok {
+				converted[name] = normalizeMsgpackValue(item)
+			}
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeMsgpackValue(item)
+		}
+		return v
+	}
+	return value
+}
@@ -0,0 +1,99 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoCodecServer decodes every message it gets in the connection's
+// encoding and sends it back encoded the same way
+func echoCodecServer(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		echoUpgrader := websocket.Upgrader{Subprotocols: []string{SubprotocolJSON, SubprotocolMsgpack}}
+		conn, err := echoUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg SignalingMessage
+			if err := readMessage(conn, &msg); err != nil {
+				return
+			}
+			frameType, data, err := encodeMessage(conn, msg)
+			if err != nil || conn.WriteMessage(frameType, data) != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// Messages with nested data, such as offers with long SDPs, come through
+// both encodings exactly as encoding/json decodes them
+func TestCodecRoundTrip(t *testing.T) {
+	url := echoCodecServer(t)
+	sdp := "v=0\r\n" + strings.Repeat("a=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n", 1000)
+	sent := SignalingMessage{
+		Type:     "offer",
+		Sender:   "alice",
+		Receiver: "bob",
+		Data: map[string]interface{}{
+			"type": "offer",
+			"sdp":  sdp,
+			"nested": map[string]interface{}{
+				"list":  []interface{}{1, 2.5, "three", map[string]interface{}{"four": true}},
+				"empty": map[string]interface{}{},
+			},
+		},
+		NegotiationEpoch: 3,
+	}
+	// What a JSON client's message looks like to the handlers
+	var want SignalingMessage
+	encoded, _ := json.Marshal(sent)
+	json.Unmarshal(encoded, &want)
+
+	for _, subprotocol := range []string{SubprotocolJSON, SubprotocolMsgpack} {
+		t.Run(subprotocol, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+			conn, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			if conn.Subprotocol() != subprotocol {
+				t.Fatalf("negotiated %q, want %q", conn.Subprotocol(), subprotocol)
+			}
+
+			frameType, data, err := encodeMessage(conn, sent)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			wantFrame := websocket.TextMessage
+			if subprotocol == SubprotocolMsgpack {
+				wantFrame = websocket.BinaryMessage
+			}
+			if frameType != wantFrame {
+				t.Fatalf("frame type %d, want %d", frameType, wantFrame)
+			}
+			if err := conn.WriteMessage(frameType, data); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			var got SignalingMessage
+			if err := readMessage(conn, &got); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("round trip changed the message:\ngot  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+WebRTC Signaling Package-Level API
+==================================
+
+This file keeps the package-level functions the signaling service had
+before its state moved into a Registry owned by a Service.
+
+WHY IS THIS NEEDED?
+===================
+Embedders that called webrtc.HandleWebSocket, webrtc.Routes and friends
+with a logger keep working unchanged. Every function here runs on one
+default Registry, so they all see the same users as each other, but not the
+users of a Service created with NewService. Handlers called directly run
+under the default registry's root context (see context.go).
+*/
+
+package webrtc
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultRegistry holds the users of the package-level functions
+var defaultRegistry = NewRegistry()
+
+// defaultService returns a Service on the default registry logging to
+// signalingLogger
+func defaultService(signalingLogger *log.Logger) *Service {
+	return NewService(defaultRegistry, signalingLogger)
+}
+
+// HandleWebSocket upgrades and serves a signaling connection on the default
+// registry (see Service.HandleWebSocket)
+func HandleWebSocket(w http.ResponseWriter, r *http.Request, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleWebSocket(w, r)
+}
+
+// HandleSSEEvents serves the event stream of an SSE session on the default
+// registry (see Service.HandleSSEEvents)
+func HandleSSEEvents(w http.ResponseWriter, r *http.Request, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleSSEEvents(w, r)
+}
+
+// HandleSSESend accepts a message from an SSE client on the default
+// registry (see Service.HandleSSESend)
+func HandleSSESend(w http.ResponseWriter, r *http.Request, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleSSESend(w, r)
+}
+
+// Routes returns the signaling endpoints under path on the default registry
+// (see Service.Routes)
+func Routes(path string, signalingLogger *log.Logger) http.Handler {
+	return defaultService(signalingLogger).Routes(path)
+}
+
+// ServeGRPC serves gRPC signaling on addr on the default registry (see
+// Service.ServeGRPC)
+func ServeGRPC(addr string, signalingLogger *log.Logger) error {
+	return defaultService(signalingLogger).ServeGRPC(addr)
+}
+
+// HandleJoin handles a join request on the default registry
+func HandleJoin(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleJoin(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleActiveUsers handles a user list request on the default registry
+func HandleActiveUsers(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleActiveUsers(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleCall handles a call request on the default registry
+func HandleCall(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleCall(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleCancelCall handles a call cancellation on the default registry
+func HandleCancelCall(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleCancelCall(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleAcceptCall handles a call acceptance on the default registry
+func HandleAcceptCall(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleAcceptCall(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleOffer forwards an SDP offer on the default registry
+func HandleOffer(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleOffer(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleAnswer forwards an SDP answer on the default registry
+func HandleAnswer(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleAnswer(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleIceCandidate forwards an ICE candidate on the default registry
+func HandleIceCandidate(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleIceCandidate(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleHangUp handles a hang up on the default registry
+func HandleHangUp(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleHangUp(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleDisconnect removes a departed connection's user from the default
+// registry
+func HandleDisconnect(conn Conn, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleDisconnect(defaultRegistry.ctx, conn)
+}
+
+// HandleConnectionLost detaches a lost connection's user on the default
+// registry, keeping the session for resume
+func HandleConnectionLost(conn Conn, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleConnectionLost(defaultRegistry.ctx, conn)
+}
+
+// HandleResume resumes a detached session on the default registry
+func HandleResume(conn Conn, token string, version int, signalingLogger *log.Logger) (int, bool) {
+	return defaultService(signalingLogger).HandleResume(defaultRegistry.ctx, conn, token, version)
+}
+
+// HandleChat relays a chat message on the default registry
+func HandleChat(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleChat(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleSetStatus changes a user's presence status on the default registry
+func HandleSetStatus(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleSetStatus(defaultRegistry.ctx, conn, msg)
+}
+
+// HandleAck handles an acknowledgement on the default registry
+func HandleAck(conn Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+	defaultService(signalingLogger).HandleAck(defaultRegistry.ctx, conn, msg)
+}
+
+// BroadcastActiveUsers sends the user list of the default registry to its
+// users. The logger is unused and kept for compatibility.
+func BroadcastActiveUsers(signalingLogger *log.Logger) {
+	defaultRegistry.Broadcast()
+}
+
+// Sessions returns a snapshot of the default registry's sessions
+func Sessions() []SessionInfo {
+	return defaultRegistry.Snapshot()
+}
+
+// Kick disconnects a user of the default registry (see Service.Kick)
+func Kick(username, reason string, cooldown time.Duration, signalingLogger *log.Logger) bool {
+	return defaultService(signalingLogger).Kick(username, reason, cooldown)
+}
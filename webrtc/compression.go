@@ -0,0 +1,104 @@
+/*
+WebRTC Signaling Compression
+============================
+
+This file implements optional permessage-deflate compression (RFC 7692) for
+the signaling WebSocket, plus byte counters to measure what it saves.
+
+WHY IS THIS NEEDED?
+===================
+activeUsers lists and SDP offers are large and highly compressible text,
+and mobile clients on metered connections pay for every byte.
+
+HOW IT WORKS:
+=============
+1. With compression enabled (-ws-compression), the upgrader offers
+   permessage-deflate; browsers and the Go client accept it automatically.
+2. Each outgoing message is compressed only if its payload is at least
+   the threshold, so tiny candidate messages don't waste CPU.
+3. Every payload byte the server writes is counted, as is every byte that
+   actually goes out on the socket (after compression and framing), so the
+   stats output shows the real saving.
+*/
+
+package webrtc
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultCompressionThreshold is the smallest payload worth compressing
+const DefaultCompressionThreshold = 512
+
+var (
+	// Current compression configuration, set once at startup by ConfigureCompression
+	compressionThreshold = DefaultCompressionThreshold
+
+	// Signaling byte counters since startup
+	payloadBytesWritten atomic.Uint64 // Message payloads before compression
+	wireBytesWritten    atomic.Uint64 // Bytes written to sockets, after compression and framing
+)
+
+// ConfigureCompression enables or disables permessage-deflate negotiation and
+// sets the smallest payload, in bytes, that gets compressed.
+func ConfigureCompression(enabled bool, threshold int) {
+	upgrader.EnableCompression = enabled
+	compressionThreshold = threshold
+}
+
+// SignalingByteStats returns the number of payload bytes written to signaling
+// clients and the number of bytes that actually went out on the wire.
+func SignalingByteStats() (payload uint64, wire uint64) {
+	return payloadBytesWritten.Load(), wireBytesWritten.Load()
+}
+
+// writeMessage encodes a message in the connection's encoding (see codec.go)
+// and writes it, compressing it if compression was negotiated and the
+// payload is large enough.
+func writeMessage(conn *websocket.Conn, msg SignalingMessage) error {
+	frameType, data, err := encodeMessage(conn, msg)
+	if err != nil {
+		return err
+	}
+	conn.EnableWriteCompression(len(data) >= compressionThreshold)
+	if err := conn.WriteMessage(frameType, data); err != nil {
+		return err
+	}
+	payloadBytesWritten.Add(uint64(len(data)))
+	return nil
+}
+
+// countingResponseWriter wraps the upgrade response so the hijacked
+// connection counts the bytes written to it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+// Hijack hands the upgrader a connection that counts written bytes
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return countingConn{Conn: conn}, rw, nil
+}
+
+// countingConn counts the bytes written to a network connection
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	wireBytesWritten.Add(uint64(n))
+	return n, err
+}
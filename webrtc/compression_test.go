@@ -0,0 +1,62 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+)
+
+// enableCompression turns compression on once and leaves it on: like the
+// server, the package reads the setting without a lock, and the sessions of
+// earlier tests may still be writing. Clients that don't offer compression
+// never get it.
+var enableCompression sync.Once
+
+// A large offer between two Go clients that negotiated permessage-deflate
+// arrives intact and takes fewer bytes on the wire than its payload
+func TestCompressedOfferBetweenGoClients(t *testing.T) {
+	enableCompression.Do(func() { webrtc.ConfigureCompression(true, webrtc.DefaultCompressionThreshold) })
+	_, url := newTestServer(t)
+
+	alice := dial(t, url, client.Options{Username: "alice", Compression: true})
+	bob := dial(t, url, client.Options{Username: "bob", Compression: true})
+	startCall(t, alice, bob)
+
+	offers := make(chan json.RawMessage, 1)
+	bob.OnOffer(func(from string, offer json.RawMessage) { offers <- offer })
+	sdp := testOffer["sdp"] + strings.Repeat("a=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n", 200)
+
+	payloadBefore, wireBefore := webrtc.SignalingByteStats()
+	if err := alice.SendOffer("bob", map[string]string{"type": "offer", "sdp": sdp}); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+	var got struct{ SDP string }
+	if err := json.Unmarshal(receive(t, offers, "offer"), &got); err != nil {
+		t.Fatalf("decode offer: %v", err)
+	}
+	if got.SDP != sdp {
+		t.Fatalf("bob got an SDP of %d bytes, want the %d sent", len(got.SDP), len(sdp))
+	}
+
+	// The server counts a message after its write returns, which can be
+	// just after bob reads it
+	var payload, wire uint64
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		payloadAfter, wireAfter := webrtc.SignalingByteStats()
+		payload, wire = payloadAfter-payloadBefore, wireAfter-wireBefore
+		if payload >= uint64(len(sdp)) {
+			break
+		}
+	}
+	if payload < uint64(len(sdp)) {
+		t.Fatalf("payload bytes grew by %d, want at least the %d byte SDP", payload, len(sdp))
+	}
+	if wire >= payload {
+		t.Fatalf("%d bytes on the wire for %d payload bytes, want compression to save some", wire, payload)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+WebRTC Signaling Contexts
+=========================
+
+This file gives every signaling connection a context.Context that its
+handlers, and the messages they send, run under.
+
+WHY IS THIS NEEDED?
+===================
+Handlers had no way to notice that the server was shutting down or that
+their connection had been kicked, so they kept forwarding and queueing
+messages for connections about to be closed. Nor could a log line or a
+middleware (see dispatch.go) tell which session, call or tenant the work
+it was doing belonged to without looking them up again.
+
+HOW IT WORKS:
+=============
+Every Registry has a root context, cancelled when its Service shuts down
+(see Service.Shutdown). serveConn derives a connection's context from the
+one of its transport, e.g. the HTTP request of a WebSocket, and cancels it
+when the connection ends, when it is kicked (see kick.go) or when the root
+context is cancelled. Each message is handled under the connection's
+context with the message's call ID added.
+
+UserSession.Send and sendToConn queue nothing once their context is done
+and return its error, so a handler still running during shutdown or after
+a kick stops reaching clients. Cleanup that has to reach the peers of a
+lost connection, and work started by timers or admin requests, runs under
+the root context instead.
+
+The values carried are read with SessionIDFromContext (the connection's
+remote address, as sessions are looked up by), CallIDFromContext and
+TenantFromContext.
+*/
+
+package webrtc
+
+import (
+	"context"
+)
+
+// contextKey is the type of the keys of the values a signaling context
+// carries
+type contextKey int
+
+const (
+	sessionIDKey contextKey = iota
+	callIDKey
+	tenantKey
+)
+
+// connContext derives the context a connection's messages are handled
+// under from parent, carrying its session ID and tenant. It is also
+// cancelled with the registry's root context; call cancel once the
+// connection has ended.
+func (r *Registry) connContext(parent context.Context, conn Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(r.ctx, cancel)
+	ctx = context.WithValue(ctx, sessionIDKey, conn.RemoteAddr().String())
+	ctx = context.WithValue(ctx, tenantKey, r.tenant)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// withCallID returns a context carrying a message's call ID, if it has one
+func withCallID(ctx context.Context, callID string) context.Context {
+	if callID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, callIDKey, callID)
+}
+
+// SessionIDFromContext returns the session ID of the connection a message
+// is handled for, or "" outside of a connection
+func SessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey).(string)
+	return id
+}
+
+// CallIDFromContext returns the call ID of the message being handled, or ""
+// if it names no call
+func CallIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(callIDKey).(string)
+	return id
+}
+
+// TenantFromContext returns the tenant of the connection a message is
+// handled for (see tenants.go), "" for the default tenant
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
@@ -0,0 +1,111 @@
+/*
+WebRTC Signaling Delivery Failures
+==================================
+
+This file tells the sender of a call message when the server couldn't
+deliver it to the other user.
+
+WHY IS THIS NEEDED?
+===================
+UserSession.Send only queues a message (see outbound.go), and several
+handlers ignored even the error it returned. When the receiver's socket was
+already dead, the caller of HandleCall kept ringing a user who would never
+hear it, both stayed marked as in a call, and a hangUp or cancelCall was
+believed delivered.
+
+HOW IT WORKS:
+=============
+The call, cancelCall, acceptCall, offer, answer, candidate and hangUp
+handlers forward through Service.forward. Delivery fails when Send can't
+queue the message (the receiver's queue is full) or the writer can't write
+it once queued (the connection is closed or the write fails). A v2 session
+that keeps unacknowledged messages for replay (see reliability.go) gets
+them when it resumes, so only a slow consumer, which is cut off without a
+resume window, fails there. A message refused because the sender's own
+connection is going away isn't a delivery failure.
+
+When delivery fails, once per message:
+1. The handler's undo function runs, e.g. HandleCall ends the call it
+   started ringing and frees both users.
+2. The failure is logged.
+3. The sender gets
+	{"type":"deliveryFailed","sender":"bob","receiver":"alice","callId":"...",
+	 "data":{"type":"call","receiver":"bob"},"error":"deliveryFailed"}
+4. The receiver's connection is closed and its disconnect cleanup runs
+   right away, without waiting for the read loop to notice.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// forward sends msg to receiver on behalf of sender, and reports whether it
+// was queued. If it can't be delivered, now or once the writer gets to it,
+// undo (which may be nil) runs and the failure is reported, see above.
+func (s *Service) forward(ctx context.Context, sender, receiver *UserSession, msg SignalingMessage, undo func()) bool {
+	var once sync.Once
+	failed := func(err error) {
+		if deliveryFailed(receiver, err) {
+			once.Do(func() { s.reportDeliveryFailure(sender, receiver, msg, err, undo) })
+		}
+	}
+	err := receiver.send(ctx, msg, false, failed)
+	if err != nil {
+		failed(err)
+	}
+	return err == nil
+}
+
+// deliveryFailed reports whether a message that couldn't be queued or
+// written for a session is lost
+func deliveryFailed(session *UserSession, err error) bool {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// The sender's connection is going away, not the receiver's
+		return false
+	case errors.Is(err, errSlowConsumer):
+		return true
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return !session.reliable()
+}
+
+// reportDeliveryFailure undoes what a handler did for a message that wasn't
+// delivered, tells its sender and cleans up the receiver
+func (s *Service) reportDeliveryFailure(sender, receiver *UserSession, msg SignalingMessage, err error, undo func()) {
+	if undo != nil {
+		undo()
+	}
+	s.logger.Printf("Could not deliver %s from %s to %s: %v%s", msg.Type, RedactName(msg.Sender), RedactName(receiver.Name), err, callLabel(msg.CallID))
+	if sender != nil {
+		sender.Send(s.registry.ctx, SignalingMessage{
+			Type:     "deliveryFailed",
+			Sender:   receiver.Name,
+			Receiver: sender.Name,
+			Data:     map[string]string{"type": msg.Type, "receiver": receiver.Name},
+			Error:    "deliveryFailed",
+			CallID:   msg.CallID,
+		})
+	}
+
+	// A slow consumer is already being cut off, see closeSlowConsumer
+	if errors.Is(err, errSlowConsumer) {
+		return
+	}
+	receiver.mu.Lock()
+	conn := receiver.Conn
+	receiver.mu.Unlock()
+	if conn == nil {
+		s.expireDetachedSession(receiver)
+		return
+	}
+	s.closeConn(conn, websocket.CloseGoingAway, "delivery failed")
+	s.HandleDisconnect(s.registry.ctx, conn)
+}
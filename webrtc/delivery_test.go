@@ -0,0 +1,111 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// deadConn is a recording client whose connection can die: once dead,
+// every write fails
+type deadConn struct {
+	*recordConn
+	dead atomic.Bool
+}
+
+func (c *deadConn) WriteMessage(msg SignalingMessage) error {
+	if c.dead.Load() {
+		return errors.New("connection closed")
+	}
+	return c.recordConn.WriteMessage(msg)
+}
+
+// eventually waits for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: timed out", what)
+		}
+	}
+}
+
+// A message to a receiver whose connection closed just before it was
+// forwarded is reported to its sender once, what the handler did is undone
+// and the receiver is cleaned up at once
+func TestDeliveryFailure(t *testing.T) {
+	ctx := context.Background()
+	ring := func(t *testing.T, s *Service, alice *recordConn, bob *deadConn) {
+		s.HandleCall(ctx, alice, SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"})
+		bob.expect(t, "call")
+	}
+	answer := func(t *testing.T, s *Service, alice *recordConn, bob *deadConn) {
+		ring(t, s, alice, bob)
+		s.HandleAcceptCall(ctx, bob, SignalingMessage{Type: "acceptCall", Sender: "bob", Receiver: "alice"})
+		alice.expect(t, "acceptCall")
+	}
+	cases := []struct {
+		name  string
+		setup func(t *testing.T, s *Service, alice *recordConn, bob *deadConn) // Before bob's connection dies
+		msg   SignalingMessage                                                 // From alice
+	}{
+		{"call", nil, SignalingMessage{Type: "call"}},
+		{"cancelCall", ring, SignalingMessage{Type: "cancelCall"}},
+		{"offer", answer, SignalingMessage{Type: "offer", Data: map[string]interface{}{"type": "offer", "sdp": "v=0\r\n"}}},
+		{"hangUp", answer, SignalingMessage{Type: "hangUp"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logs := &lockedBuffer{}
+			s := NewService(NewRegistry(), log.New(logs, "", 0))
+			t.Cleanup(s.Shutdown)
+			alice := joinRecorded(t, s, "alice", 50001)
+			bob := &deadConn{recordConn: newRecordConn(50002)}
+			s.HandleJoin(ctx, bob, SignalingMessage{Type: "join", Sender: "bob"})
+			bob.expect(t, "join")
+			if c.setup != nil {
+				c.setup(t, s, alice, bob)
+			}
+
+			bob.dead.Store(true)
+			msg := c.msg
+			msg.Sender, msg.Receiver = "alice", "bob"
+			handlers := map[string]func(context.Context, Conn, SignalingMessage){
+				"call": s.HandleCall, "cancelCall": s.HandleCancelCall, "offer": s.HandleOffer, "hangUp": s.HandleHangUp,
+			}
+			handlers[msg.Type](ctx, alice, msg)
+
+			failure := alice.expect(t, "deliveryFailed")
+			data, _ := failure.Data.(map[string]string)
+			if failure.Sender != "bob" || data["type"] != c.msg.Type || data["receiver"] != "bob" {
+				t.Fatalf("alice got %+v, want a deliveryFailed for her %s to bob", failure, c.msg.Type)
+			}
+			eventually(t, "bob's cleanup", func() bool {
+				_, joined := s.Registry().Get("bob")
+				return !joined
+			})
+			eventually(t, "alice freed", func() bool {
+				session, _ := s.Registry().Get("alice")
+				session.mu.Lock()
+				defer session.mu.Unlock()
+				return !session.InCall && session.Peer == ""
+			})
+			s.registry.mu.Lock()
+			calls := len(s.registry.calls)
+			s.registry.mu.Unlock()
+			if calls != 0 {
+				t.Fatalf("%d calls left", calls)
+			}
+			if logged := strings.Count(logs.String(), "Could not deliver "+c.msg.Type+" from alice to bob"); logged != 1 {
+				t.Fatalf("failure logged %d times:\n%s", logged, logs)
+			}
+			if failures := alice.received("deliveryFailed"); len(failures) != 1 {
+				t.Fatalf("alice told %d times", len(failures))
+			}
+		})
+	}
+}
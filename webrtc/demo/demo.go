@@ -0,0 +1,71 @@
+/*
+WebRTC Demo Web Client
+======================
+
+This package serves a minimal single-page web client, embedded in the
+binary, for manually testing a deployment end to end.
+
+WHY IS THIS NEEDED?
+===================
+Checking that a fresh deployment works used to mean wiring up an external
+frontend. With the demo enabled, two browser tabs can join, see each other
+in the live user list and start a video call through the server's own
+signaling and STUN/TURN services. That exercises the full stack and gives
+bug reports a common reference client.
+
+HOW IT WORKS:
+=============
+1. index.html is embedded with go:embed and served under the mount path.
+2. config.json, next to it, tells the page the signaling path and the
+   server's STUN/TURN URLs, taken from the server configuration.
+3. TURN credentials are never injected into the page; the tester enters
+   them, so enabling the demo doesn't publish them.
+
+The demo speaks signaling protocol v1 over WebSocket.
+*/
+
+package demo
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+)
+
+//go:embed index.html
+var files embed.FS
+
+// ICEServer is one entry of RTCConfiguration.iceServers
+type ICEServer struct {
+	URLs []string `json:"urls"`
+}
+
+// Config is what the demo page needs to know about the server
+type Config struct {
+	SignalingPath string      `json:"signalingPath"` // Path of the WebSocket signaling endpoint
+	ICEServers    []ICEServer `json:"iceServers"`    // STUN/TURN servers offered to the browser
+
+	// TURN allocation lifetime policy in seconds; MaxAllocationLifetime is
+	// 0 when only the TURN server's own limit of an hour applies
+	DefaultAllocationLifetime int `json:"defaultAllocationLifetime"`
+	MaxAllocationLifetime     int `json:"maxAllocationLifetime"`
+}
+
+// Handler returns a handler serving the demo page and its config. Mount it
+// on a path ending in "/", e.g. mux.Handle("/demo/", http.StripPrefix("/demo", demo.Handler(cfg))).
+func Handler(cfg Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(cfg)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFileFS(w, r, files, "index.html")
+	})
+	return mux
+}
@@ -0,0 +1,76 @@
+package webrtc_test
+
+import (
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+
+	"github.com/gorilla/websocket"
+)
+
+// expectRaw reads from a raw WebSocket until a message of the given type
+func expectRaw(t *testing.T, ws *websocket.Conn, msgType string) webrtc.SignalingMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg webrtc.SignalingMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// When one side of a call drops its connection without leaving, the other
+// side is hung up on and shown as available again
+func TestPeerReleasedWhenCallerDrops(t *testing.T) {
+	_, url := newTestServer(t)
+	bob := dial(t, url, client.Options{Username: "bob"})
+	lists := make(chan []webrtc.ActiveUser, 16)
+	bob.OnActiveUsers(func(users []webrtc.ActiveUser) { lists <- users })
+	calls := make(chan string, 1)
+	bob.OnCall(func(from string) { calls <- from })
+	hangUps := make(chan string, 1)
+	bob.OnHangUp(func(from string) { hangUps <- from })
+
+	// alice is a raw WebSocket so her connection can be cut without a leave
+	alice, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial as alice: %v", err)
+	}
+	defer alice.Close()
+	if err := alice.WriteJSON(webrtc.SignalingMessage{Type: "join", Sender: "alice"}); err != nil {
+		t.Fatalf("send join: %v", err)
+	}
+	expectRaw(t, alice, "join")
+	if err := alice.WriteJSON(webrtc.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"}); err != nil {
+		t.Fatalf("send call: %v", err)
+	}
+	receive(t, calls, "call")
+	if err := bob.AcceptCall("alice"); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	expectRaw(t, alice, "acceptCall")
+
+	alice.NetConn().Close()
+
+	if from := receive(t, hangUps, "hangUp"); from != "alice" {
+		t.Fatalf("bob got a hangUp from %q, want alice", from)
+	}
+	for {
+		users := receive(t, lists, "a user list without alice")
+		if len(users) == 1 && users[0].Name == "bob" {
+			if users[0].InCall {
+				t.Fatal("bob is still shown in a call after alice dropped")
+			}
+			break
+		}
+	}
+
+	carol := dial(t, url, client.Options{Username: "carol"})
+	startCall(t, carol, bob)
+}
@@ -0,0 +1,237 @@
+/*
+WebRTC Signaling Message Dispatch
+=================================
+
+This file routes every message a client sends to the handler of its type,
+through a chain of middlewares that see every message.
+
+WHY IS THIS NEEDED?
+===================
+Statistics, captures, the event history and logging all look at every
+message, and each of them used to be another line in front of one large
+switch in serveConn. Every new cross-cutting feature (an auth check, a rate
+limit, another metric) meant editing that switch.
+
+HOW IT WORKS:
+=============
+A Service keeps a registry of handlers by message type and a chain of
+middlewares. serveConn reads a message, applies the connection-level checks
+that need the connection's own state (the rate limit, the protocol version
+of a join, see handler.go) and hands the message to the chain:
+
+	traceMessages -> countMessages -> captureMessages -> recordMessages -> logMessages -> validateMessages -> handler
+
+The built-in middlewares run first, in this order, so a middleware added
+with Use sees a message after it was traced (see tracing.go), counted,
+captured, recorded, logged and validated (see validate.go), and can still
+drop it by not calling next.
+A message whose type has no handler goes to the default handler, which
+logs it and tells v2 clients "unknownMessageType".
+
+A handler returns false when nothing more is to be read from the
+connection; leave does, after closing it.
+
+Handlers, middlewares and the default handler are set up before the
+service serves connections, like the rest of its configuration. Tenants
+(see tenants.go) each get their own Service with the built-in setup.
+*/
+
+package webrtc
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+)
+
+// HandlerFunc handles one message read from a connection, under the
+// connection's context (see context.go). It returns false when nothing more
+// is to be read from the connection.
+type HandlerFunc func(ctx context.Context, conn Conn, msg SignalingMessage) bool
+
+// Middleware wraps the handling of every message, e.g. to count, log or
+// drop it. It calls next to pass the message on.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// dispatcher is a service's registry of handlers and its middleware chain
+type dispatcher struct {
+	handlers       map[string]HandlerFunc
+	middlewares    []Middleware // Outermost first
+	defaultHandler HandlerFunc  // For types without a handler
+	chain          HandlerFunc  // The middlewares around route, rebuilt on every change
+}
+
+// loggedWithCall are the message types logged with their call ID (see
+// callLabel); they are sent in the course of a call
+var loggedWithCall = map[string]bool{
+	"cancelCall": true, "acceptCall": true, "offer": true, "answer": true,
+	"candidate": true, "iceRestart": true, "hangUp": true, "callHold": true,
+	"callResume": true, "muteState": true, "callControl": true,
+}
+
+// unloggedTypes are the message types not logged as they are received.
+// Clients ack frequently and the lines add no value.
+var unloggedTypes = map[string]bool{"ack": true}
+
+// newDispatcher sets up the built-in handlers and middlewares of a service
+func (s *Service) newDispatcher() *dispatcher {
+	d := &dispatcher{
+		handlers: map[string]HandlerFunc{
+			// User joins the signaling server
+			// Registers user and adds to active users list
+			"join": continueAfter(s.HandleJoin),
+			// Get list of currently active users
+			"activeUsers": continueAfter(s.HandleActiveUsers),
+			// Initiate a call to another user
+			"call": continueAfter(s.HandleCall),
+			// Cancel an outgoing call
+			"cancelCall": continueAfter(s.HandleCancelCall),
+			// Accept an incoming call
+			"acceptCall": continueAfter(s.HandleAcceptCall),
+			// Forward SDP offers, answers and ICE candidates to the peer
+			"offer":     continueAfter(s.HandleOffer),
+			"answer":    continueAfter(s.HandleAnswer),
+			"candidate": continueAfter(s.HandleIceCandidate),
+			// Tell the peer ICE is restarting, e.g. after a network change
+			"iceRestart": continueAfter(s.HandleIceRestart),
+			// End an active call and notify both users
+			"hangUp": continueAfter(s.HandleHangUp),
+			// Change presence status, or display name, avatar URL and capabilities
+			"setStatus":   continueAfter(s.HandleSetStatus),
+			"setMetadata": continueAfter(s.HandleSetMetadata),
+			// Tell the peer about hold, mute or a client-defined control
+			"callHold":    continueAfter(s.HandleCallControl),
+			"callResume":  continueAfter(s.HandleCallControl),
+			"muteState":   continueAfter(s.HandleCallControl),
+			"callControl": continueAfter(s.HandleCallControl),
+			// Hand the sender's side of their call over to the receiver
+			"transferCall": continueAfter(s.HandleTransferCall),
+			// Relay a short text message to another user
+			"chat": continueAfter(s.HandleChat),
+			// Acknowledge the missed calls delivered on join
+			"clearMissedCalls": continueAfter(s.HandleClearMissedCalls),
+			// Acknowledge messages up to msg.Seq (protocol v2 reliability)
+			"ack": continueAfter(s.HandleAck),
+			// User leaves the signaling server
+			// Nothing more is read; the client is told it was a normal close
+			"leave": func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+				s.HandleDisconnect(ctx, conn)
+				s.closeConn(conn, websocket.CloseNormalClosure, "leave")
+				return false
+			},
+		},
+		defaultHandler: s.handleUnknown,
+	}
+	d.middlewares = []Middleware{s.traceMessages, countMessages, s.captureMessages, s.recordMessages, s.logMessages(d), s.validateMessages}
+	d.build()
+	return d
+}
+
+// continueAfter adapts a Handle* method to a HandlerFunc that keeps reading
+func continueAfter(handle func(context.Context, Conn, SignalingMessage)) HandlerFunc {
+	return func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+		handle(ctx, conn, msg)
+		return true
+	}
+}
+
+// build wraps route in the middlewares, the first one outermost
+func (d *dispatcher) build() {
+	chain := d.route
+	for i := len(d.middlewares) - 1; i >= 0; i-- {
+		chain = d.middlewares[i](chain)
+	}
+	d.chain = chain
+}
+
+// route calls the handler of a message's type, or the default handler
+func (d *dispatcher) route(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+	if handler, ok := d.handlers[msg.Type]; ok {
+		return handler(ctx, conn, msg)
+	}
+	return d.defaultHandler(ctx, conn, msg)
+}
+
+// Handle registers the handler of a message type, replacing the built-in
+// one if there is one. It must be called before the service serves
+// connections.
+func (s *Service) Handle(msgType string, handler HandlerFunc) {
+	s.dispatch.handlers[msgType] = handler
+	s.dispatch.build()
+}
+
+// Use adds a middleware that every message passes through, after the
+// built-in ones and those added before it. It must be called before the
+// service serves connections.
+func (s *Service) Use(middleware Middleware) {
+	s.dispatch.middlewares = append(s.dispatch.middlewares, middleware)
+	s.dispatch.build()
+}
+
+// SetDefaultHandler sets the handler of messages whose type has no handler,
+// in place of the built-in one that answers v2 clients
+// "unknownMessageType". It must be called before the service serves
+// connections.
+func (s *Service) SetDefaultHandler(handler HandlerFunc) {
+	s.dispatch.defaultHandler = handler
+}
+
+// countMessages counts every message by type for the statistics (see
+// stats.go)
+func countMessages(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+		countMessage(msg.Type)
+		return next(ctx, conn, msg)
+	}
+}
+
+// captureMessages records a message if its user is being captured (see
+// capture.go)
+func (s *Service) captureMessages(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+		s.captureInbound(conn, msg)
+		return next(ctx, conn, msg)
+	}
+}
+
+// recordMessages keeps a message in the event history if it belongs to a
+// call (see history.go)
+func (s *Service) recordMessages(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+		s.recordInbound(conn, msg)
+		return next(ctx, conn, msg)
+	}
+}
+
+// logMessages logs every message of a type with a handler as it is
+// received; the default handler logs the others
+func (s *Service) logMessages(d *dispatcher) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+			if _, known := d.handlers[msg.Type]; known && !unloggedTypes[msg.Type] {
+				label := ""
+				if loggedWithCall[msg.Type] {
+					label = callLabel(msg.CallID)
+				}
+				s.logger.Printf("Received: %s From: %s To: %s%s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), label)
+			}
+			return next(ctx, conn, msg)
+		}
+	}
+}
+
+// handleUnknown is the built-in default handler: it logs the message but
+// keeps the connection, and tells v2 clients about it; v1 clients never
+// expected a reply
+func (s *Service) handleUnknown(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+	s.logger.Printf("Unknown message type: %s From: %s To: %s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver))
+	if msg.Version >= ProtocolV2 {
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "error",
+			Receiver: msg.Sender,
+			Error:    "unknownMessageType",
+			Data:     map[string]string{"type": msg.Type},
+		}, msg.Version)
+	}
+	return true
+}
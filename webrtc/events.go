@@ -0,0 +1,98 @@
+/*
+WebRTC Signaling Events
+=======================
+
+This file publishes the signaling service's users joining and leaving and
+its calls starting and ending on the server's event bus (see the events
+package).
+
+WHY IS THIS NEEDED?
+===================
+Programs embedding the service want to know when a user comes online or a
+call ends, e.g. to update a directory or bill the call, without scraping
+the signaling log.
+
+HOW IT WORKS:
+=============
+Every service publishes to one package-level bus, so the events of all
+tenants (see tenants.go) arrive together, told apart by their Tenant field.
+The standalone server shares its own bus with ConfigureEvents, so its TURN
+events go to the same subscribers; an embedding program can simply call
+Service.Subscribe. Publishing never blocks (see events.Bus.Publish), so it
+is safe while the registry's mutex is held.
+*/
+
+package webrtc
+
+import (
+	"time"
+
+	"go-server/events"
+)
+
+// eventBus is the bus signaling events are published on, replaced once at
+// startup by ConfigureEvents
+var eventBus = events.NewBus()
+
+// ConfigureEvents sets the bus signaling events are published on
+func ConfigureEvents(bus *events.Bus) {
+	eventBus = bus
+}
+
+// Subscribe delivers the signaling events filter accepts, of every service
+// sharing the bus, to ch until the subscription's Unsubscribe is called.
+// Events that don't fit in ch are dropped and counted, see events.Bus.
+func (s *Service) Subscribe(filter events.Filter, ch chan<- events.Event) *events.Subscription {
+	return eventBus.Subscribe(filter, ch)
+}
+
+// publishUserJoined publishes the join of a session
+func (r *Registry) publishUserJoined(session *UserSession, sessionID string) {
+	eventBus.Publish(events.UserJoined{
+		Time:      time.Now(),
+		Tenant:    r.tenant,
+		Username:  session.Name,
+		SessionID: sessionID,
+		ClientIP:  session.ClientIP,
+		Protocol:  session.Version,
+		Guest:     session.Guest,
+	})
+}
+
+// publishUserLeft publishes the end of a user's session, reason being one
+// of the events.Left* reasons
+func (r *Registry) publishUserLeft(username, reason string) {
+	eventBus.Publish(events.UserLeft{
+		Time:     time.Now(),
+		Tenant:   r.tenant,
+		Username: username,
+		Reason:   reason,
+	})
+}
+
+// publishCallStarted publishes a call that started ringing
+func (r *Registry) publishCallStarted(call *activeCall) {
+	eventBus.Publish(events.CallStarted{
+		Time:   call.started,
+		Tenant: r.tenant,
+		CallID: call.id,
+		Caller: call.caller,
+		Callee: call.callee,
+	})
+}
+
+// publishCallEnded publishes how a call ended
+func (r *Registry) publishCallEnded(call *activeCall, outcome string) {
+	now := time.Now()
+	eventBus.Publish(events.CallEnded{
+		Time:     now,
+		Tenant:   r.tenant,
+		CallID:   call.id,
+		Caller:   call.caller,
+		Callee:   call.callee,
+		Outcome:  outcome,
+		Answered: call.accepted,
+		Relayed:  call.relayed,
+		Duration: now.Sub(call.started),
+	})
+}
@@ -0,0 +1,54 @@
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"runtime"
+	"testing"
+)
+
+// maxFuzzMessages bounds the messages of one input, so the rate limit
+// doesn't cut every long input short
+const maxFuzzMessages = 16
+
+// FuzzSignalingMessage decodes each line of the input as a JSON message,
+// the way a WebSocket frame is decoded, and sends the messages that decode
+// from alice, who joined with bob, to the handlers. No message may panic
+// the server. The seed corpus in testdata/fuzz/FuzzSignalingMessage holds
+// whole calls on both protocol versions and messages with missing fields,
+// fields of the wrong type and malformed JSON. Each input gets a service of
+// its own, and no goroutine of it may outlive its shutdown, so a long
+// fuzzing run doesn't pile them up.
+func FuzzSignalingMessage(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		before := runtime.NumGoroutine()
+		script := []SignalingMessage{{Type: "join", Sender: "alice"}}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			var msg SignalingMessage
+			if json.Unmarshal(line, &msg) == nil && len(script) <= maxFuzzMessages {
+				script = append(script, msg)
+			}
+		}
+
+		s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+		bob := newListConn(50002)
+		s.HandleJoin(context.Background(), bob, SignalingMessage{Type: "join", Sender: "bob"})
+		bobDone := make(chan struct{})
+		go func() {
+			defer close(bobDone)
+			s.serveConn(context.Background(), bob, ProtocolV1, "")
+		}()
+
+		// Closed up front, so alice's reads end once the script runs out
+		alice := &scriptConn{listConn: newListConn(50001), script: script}
+		alice.listConn.Close()
+		s.serveConn(context.Background(), alice, ProtocolV1, "")
+
+		s.Shutdown()
+		<-bobDone
+		waitGoroutines(t, before)
+	})
+}
@@ -0,0 +1,287 @@
+/*
+WebRTC Signaling over gRPC
+==========================
+
+This file implements the optional gRPC signaling API (see
+signalpb/signaling.proto), served next to the WebSocket endpoint.
+
+WHY IS THIS NEEDED?
+===================
+Server-side media bots are usually gRPC-native, and bridging them through a
+WebSocket client library is awkward. The Signal RPC gives them the same
+signaling protocol as a bidirectional stream.
+
+HOW IT WORKS:
+=============
+1. Each Signal stream is wrapped in a grpcConn, which implements Conn.
+2. The stream is served by the same serveConn loop as WebSocket connections,
+   so it joins the same session registry and goes through the same handlers,
+   rate limits and outbound queue.
+3. A gRPC user can therefore call a WebSocket user and vice versa; offers,
+   answers and candidates are converted between the two encodings on the way.
+
+METADATA:
+=========
+- "signal-version": protocol version, like ?v= on the WebSocket URL
+- "signal-resume": resume token, like ?resume= on the WebSocket URL
+
+LIMITATIONS:
+============
+gRPC streams have no write deadlines; a stalled bot is still caught by the
+outbound queue limit, and HTTP/2 flow control keeps it from using memory.
+The server listens without TLS, so it is meant for internal networks.
+*/
+
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-server/webrtc/signalpb"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ServeGRPC serves the gRPC signaling API on addr until the listener fails.
+// Its clients share the service's users with WebSocket and SSE clients.
+func (s *Service) ServeGRPC(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(int(maxMessageBytes)))
+	signalpb.RegisterSignalingServer(server, &grpcSignalingServer{service: s, logger: s.logger})
+	s.logger.Printf("gRPC signaling server listening on %s", addr)
+	return server.Serve(listener)
+}
+
+// grpcSignalingServer implements the Signaling service
+type grpcSignalingServer struct {
+	signalpb.UnimplementedSignalingServer
+	service *Service
+	logger  *log.Logger
+}
+
+// Signal serves one signaling session over a bidirectional stream
+func (s *grpcSignalingServer) Signal(stream signalpb.Signaling_SignalServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	version, err := parseVersionParam(firstMetadata(md, "signal-version"))
+	if err != nil {
+		s.logger.Printf("Rejecting gRPC stream: %v", err)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	conn := newGRPCConn(stream)
+	s.service.serveConn(stream.Context(), conn, version, firstMetadata(md, "signal-resume"))
+	return conn.closeStatus()
+}
+
+// firstMetadata returns the first value of a metadata key, or ""
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcConn is a signaling connection over a gRPC stream
+type grpcConn struct {
+	stream   signalpb.Signaling_SignalServer
+	addr     net.Addr
+	clientIP string
+
+	// Recv can't be interrupted, so it runs in its own goroutine and the
+	// connection can be closed by closing done
+	incoming chan recvResult
+	done     chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error // Status returned to the client when the server closes
+	writeMu   sync.Mutex
+}
+
+// recvResult is one message or error received from the stream
+type recvResult struct {
+	msg *signalpb.SignalingMessage
+	err error
+}
+
+// grpcAddr identifies a gRPC stream in logs and session lookups. Every
+// stream needs its own address because the streams multiplexed on one
+// client connection share their peer's.
+type grpcAddr string
+
+func (a grpcAddr) Network() string { return "grpc" }
+func (a grpcAddr) String() string  { return string(a) }
+
+// grpcStreams numbers the Signal streams for their addresses
+var grpcStreams atomic.Uint64
+
+// newGRPCConn wraps a Signal stream and starts receiving from it
+func newGRPCConn(stream signalpb.Signaling_SignalServer) *grpcConn {
+	c := &grpcConn{
+		stream:   stream,
+		incoming: make(chan recvResult),
+		done:     make(chan struct{}),
+	}
+	peerAddr := (&net.TCPAddr{}).String()
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		peerAddr = p.Addr.String()
+	}
+	c.addr = grpcAddr(peerAddr + "/grpc/" + strconv.FormatUint(grpcStreams.Add(1), 10))
+	// gRPC proxies such as Envoy forward the client address in metadata
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	c.clientIP = clientIP(peerAddr, md.Get("x-forwarded-for"), firstMetadata(md, "x-real-ip"))
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			select {
+			case c.incoming <- recvResult{msg: msg, err: err}:
+			case <-c.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *grpcConn) ReadMessage(msg *SignalingMessage) error {
+	select {
+	case <-c.done:
+		return errConnClosed
+	case result := <-c.incoming:
+		if result.err != nil {
+			return result.err
+		}
+		*msg = fromProtoMessage(result.msg)
+		return nil
+	}
+}
+
+func (c *grpcConn) WriteMessage(msg SignalingMessage) error {
+	pb, err := toProtoMessage(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.done:
+		return errConnClosed
+	default:
+	}
+	return c.stream.Send(pb)
+}
+
+func (c *grpcConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *grpcConn) CloseWithCode(code int, reason string) {
+	grpcCode := codes.Aborted
+	switch code {
+	case websocket.CloseNormalClosure:
+		c.close(nil)
+		return
+	case websocket.CloseGoingAway:
+		grpcCode = codes.Unavailable
+	case websocket.CloseProtocolError:
+		grpcCode = codes.InvalidArgument
+	case websocket.ClosePolicyViolation, websocket.CloseMessageTooBig, CloseSlowConsumer:
+		grpcCode = codes.ResourceExhausted
+	}
+	c.close(status.Error(grpcCode, reason))
+}
+
+func (c *grpcConn) Close() error {
+	c.close(nil)
+	return nil
+}
+
+func (c *grpcConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.closeErr = err
+		close(c.done)
+	})
+}
+
+// closeStatus is the error the Signal RPC returns once serveConn is done
+func (c *grpcConn) closeStatus() error {
+	c.close(nil)
+	return c.closeErr
+}
+
+func (c *grpcConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *grpcConn) ClientIP() string {
+	return c.clientIP
+}
+
+// fromProtoMessage converts a gRPC message into a SignalingMessage. Data
+// becomes the same generic value encoding/json would have produced.
+func fromProtoMessage(pb *signalpb.SignalingMessage) SignalingMessage {
+	msg := SignalingMessage{
+		Type:             pb.GetType(),
+		Sender:           pb.GetSender(),
+		Receiver:         pb.GetReceiver(),
+		Version:          int(pb.GetVersion()),
+		Error:            pb.GetError(),
+		Seq:              pb.GetSeq(),
+		Room:             pb.GetRoom(),
+		NegotiationEpoch: pb.GetNegotiationEpoch(),
+		CallID:           pb.GetCallId(),
+	}
+	if pb.GetData() != nil {
+		msg.Data = pb.GetData().AsInterface()
+	}
+	return msg
+}
+
+// toProtoMessage converts a SignalingMessage into a gRPC message. Data may be
+// any JSON-encodable value, so it goes through JSON to reach a generic form.
+func toProtoMessage(msg SignalingMessage) (*signalpb.SignalingMessage, error) {
+	pb := &signalpb.SignalingMessage{
+		Type:             msg.Type,
+		Sender:           msg.Sender,
+		Receiver:         msg.Receiver,
+		Version:          int32(msg.Version),
+		Error:            msg.Error,
+		Seq:              msg.Seq,
+		Room:             msg.Room,
+		NegotiationEpoch: msg.NegotiationEpoch,
+		CallId:           msg.CallID,
+	}
+	if msg.Data == nil {
+		return pb, nil
+	}
+	encoded, err := json.Marshal(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(encoded, &generic); err != nil {
+		return nil, err
+	}
+	pb.Data, err = structpb.NewValue(generic)
+	if err != nil {
+		return nil, err
+	}
+	return pb, nil
+}
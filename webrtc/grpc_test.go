@@ -0,0 +1,108 @@
+package webrtc
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"go-server/webrtc/signalpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCTestClient serves s over an in-memory gRPC listener and returns a
+// client connection to it
+func newGRPCTestClient(t *testing.T, s *Service) signalpb.SignalingClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	// Stop returns once the handlers have, so the next test may change the
+	// package configuration
+	server := grpc.NewServer(grpc.WaitForHandlers(true))
+	signalpb.RegisterSignalingServer(server, &grpcSignalingServer{service: s, logger: s.logger})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return signalpb.NewSignalingClient(conn)
+}
+
+// grpcJoin opens a Signal stream and joins it as name
+func grpcJoin(t *testing.T, client signalpb.SignalingClient, name string) signalpb.Signaling_SignalClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := client.Signal(ctx)
+	if err != nil {
+		t.Fatalf("open stream for %s: %v", name, err)
+	}
+	if err := stream.Send(&signalpb.SignalingMessage{Type: "join", Sender: name}); err != nil {
+		t.Fatalf("send join for %s: %v", name, err)
+	}
+	grpcExpect(t, stream, "join")
+	return stream
+}
+
+// grpcExpect reads from a stream until a message of the given type arrives
+func grpcExpect(t *testing.T, stream signalpb.Signaling_SignalClient, msgType string) *signalpb.SignalingMessage {
+	t.Helper()
+	received := make(chan *signalpb.SignalingMessage, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				close(received)
+				return
+			}
+			if msg.Type == msgType {
+				received <- msg
+				return
+			}
+		}
+	}()
+	select {
+	case msg, ok := <-received:
+		if !ok {
+			t.Fatalf("stream ended waiting for %s", msgType)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", msgType)
+	}
+	return nil
+}
+
+// Streams multiplexed on one client connection share their peer address,
+// but each must keep its own session
+func TestGRPCStreamsOnOneConnectionKeepTheirSessions(t *testing.T) {
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	client := newGRPCTestClient(t, s)
+
+	alice := grpcJoin(t, client, "alice")
+	bob := grpcJoin(t, client, "bob")
+
+	if err := alice.Send(&signalpb.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"}); err != nil {
+		t.Fatalf("send call: %v", err)
+	}
+	call := grpcExpect(t, bob, "call")
+	if call.Sender != "alice" {
+		t.Fatalf("bob got call %+v, want one from alice", call)
+	}
+
+	sessions := s.Registry().Snapshot()
+	if len(sessions) != 2 || sessions[0].SessionID == sessions[1].SessionID {
+		t.Fatalf("sessions %+v, want alice and bob with distinct session IDs", sessions)
+	}
+}
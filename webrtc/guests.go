@@ -0,0 +1,137 @@
+/*
+WebRTC Signaling Guests
+=======================
+
+This file lets clients join without choosing a name, for quick demos.
+
+WHY IS THIS NEEDED?
+===================
+Every join needed a username, so a demo page had to ask for one before
+anything could happen, and two visitors picking "test" collided.
+
+HOW IT WORKS:
+=============
+When guests are allowed (-allow-guests), a join with an empty sender gets a
+generated name such as "guest-7f3a". The name comes back in the join
+response, and the client uses it as the sender of everything it sends:
+
+	{"type":"join","sender":""}
+	{"type":"join","receiver":"guest-7f3a","data":{"result":true,"username":"guest-7f3a"}}
+
+The "guest-" prefix is reserved while guests are allowed: explicit joins
+using it fail with the error "reservedName", so a generated name can never
+belong to a registered user. Names are generated under the registry lock and
+grow longer if the short ones run out, so two guests never get the same one.
+
+RESTRICTIONS:
+=============
+- Guests are marked with "guest":true in v2 user lists and on the admin
+  sessions endpoint.
+- With -guests-hidden, guests are left out of the user lists of users who
+  aren't guests themselves. They can still call and be called by name.
+- Guests may place at most -guest-call-rate calls per minute; further calls
+  fail with a callFailed message with the reason "rateLimited".
+*/
+
+package webrtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// GuestPrefix starts every generated guest name
+const GuestPrefix = "guest-"
+
+// DefaultGuestCallRate is how many calls per minute a guest may place by default
+const DefaultGuestCallRate = 6
+
+// guestNameBytes is how many random bytes a guest name starts out with
+const guestNameBytes = 2
+
+var (
+	// Current guest configuration, set once at startup by ConfigureGuests
+	allowGuests   bool
+	guestsHidden  bool
+	guestCallRate float64 = DefaultGuestCallRate
+)
+
+// ConfigureGuests sets whether clients may join without a name, whether
+// guests are hidden from other users' lists, and how many calls per minute
+// a guest may place (0 disables the limit).
+func ConfigureGuests(allow, hidden bool, callsPerMinute float64) {
+	allowGuests = allow
+	guestsHidden = hidden
+	guestCallRate = callsPerMinute
+}
+
+// isGuestName reports whether a name uses the reserved guest prefix, in any case
+func isGuestName(name string) bool {
+	return len(name) >= len(GuestPrefix) && strings.EqualFold(name[:len(GuestPrefix)], GuestPrefix)
+}
+
+// newGuestNameLocked generates a guest name no session holds. A few
+// collisions make it try longer names. The caller must hold r.mu.
+func (r *Registry) newGuestNameLocked() string {
+	for size := guestNameBytes; ; size++ {
+		for attempt := 0; attempt < 8; attempt++ {
+			random := make([]byte, size)
+			rand.Read(random)
+			name := GuestPrefix + hex.EncodeToString(random)
+			if _, taken := r.nameToUserSession[name]; !taken {
+				return name
+			}
+		}
+	}
+}
+
+// allowGuestCall reports whether a guest session may place another call
+func (u *UserSession) allowGuestCall() bool {
+	if guestCallRate <= 0 {
+		return true
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.callLimiter.allow(guestCallRate/60, guestCallRate, time.Now())
+}
+
+// hidesGuests reports whether guests are left out of this session's user lists
+func (u *UserSession) hidesGuests() bool {
+	return allowGuests && guestsHidden && !u.Guest
+}
+
+// joinedName is the username returned in a join response: only guests need
+// to be told theirs
+func joinedName(name string, guest bool) string {
+	if guest {
+		return name
+	}
+	return ""
+}
+
+// withoutGuests copies a user list without its guests
+func withoutGuests(users []ActiveUser) []ActiveUser {
+	visible := make([]ActiveUser, 0, len(users))
+	for _, user := range users {
+		if !user.Guest {
+			visible = append(visible, user)
+		}
+	}
+	return visible
+}
+
+// hideGuestsFrom removes guests from a presence message for a session that
+// doesn't see them. It reports false if nothing is left to send.
+func hideGuestsFrom(msg SignalingMessage) (SignalingMessage, bool) {
+	switch data := msg.Data.(type) {
+	case ActiveUsers:
+		msg.Data = ActiveUsers{Users: withoutGuests(data.Users)}
+	case ActiveUser:
+		return msg, !data.Guest
+	case map[string]string:
+		return msg, !isGuestName(data["name"])
+	}
+	return msg, true
+}
@@ -26,31 +26,45 @@ This handler supports the following message types:
 - offer: Send SDP offer to peer
 - answer: Send SDP answer to peer
 - candidate: Send ICE candidate to peer
+- iceRestart: Announce an ICE restart to the peer
 - hangUp: End an active call
+- setStatus: Set presence status (available, away, dnd, invisible)
+- setMetadata: Set display name, avatar URL and capabilities
+- callHold, callResume, muteState, callControl: In-call controls for the peer
+- transferCall: Transfer one's side of a call to another user
+- chat: Send a short text message to another user
+- clearMissedCalls: Acknowledge the missed calls delivered on join
+- ack: Acknowledge received messages (protocol v2)
 - leave: User leaves the signaling server
 
 CONNECTION LIFECYCLE:
 =====================
 1. Client connects via WebSocket upgrade
-2. Client sends 'join' message to register
+2. Client sends 'join' message to register (or resumes with ?resume=<token>)
 3. Client can send/receive signaling messages
 4. Client sends 'leave' message or connection closes
-5. Server cleans up user session
+5. Server cleans up user session (after a resume grace window for v2 clients)
 
 ERROR HANDLING:
 ==============
 - WebSocket upgrade failures
-- JSON parsing errors
+- JSON parsing errors (close code 1002)
 - Connection read/write errors
 - Unknown message types
-- Graceful disconnection handling
+- Unsupported protocol versions (close code 1002)
+- Oversized messages (close code 1009) and message floods (close code 1008)
+- Graceful disconnection handling: leave (close code 1000) and server
+  shutdown (close code 1001); see closeConn for all close codes
 */
 
 package webrtc
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -60,6 +74,8 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024, // Buffer size for reading messages
 	WriteBufferSize: 1024, // Buffer size for writing messages
+	// Message encodings a client can pick (see codec.go); JSON if none is requested
+	Subprotocols: []string{SubprotocolJSON, SubprotocolMsgpack},
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for development
 		// In production, you should implement proper origin checking
@@ -81,7 +97,8 @@ var upgrader = websocket.Upgrader{
 // ================
 // Each message type is routed to a specific handler function
 // This modular design makes the code maintainable and extensible
-// New message types can be easily added by extending the switch statement
+// New message types and middlewares are registered with Service.Handle and
+// Service.Use (see dispatch.go)
 //
 // ERROR HANDLING:
 // ===============
@@ -95,12 +112,59 @@ var upgrader = websocket.Upgrader{
 // All messages and errors are logged for debugging and monitoring
 // This helps with troubleshooting connection issues
 // Logs include message content and connection details
-func HandleWebSocket(w http.ResponseWriter, r *http.Request, signalingLogger *log.Logger) {
+func (s *Service) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Banned clients are turned away before the upgrade (see bans.go)
+	if clientIP := requestClientIP(r); isBanned("", clientIP, "websocket") {
+		s.logger.Printf("Refusing WebSocket connection from banned client %s", clientIP)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// So are clients from regions or networks the server doesn't serve (see sourcepolicy.go)
+	if !sourceAllowed(requestClientIP(r), "websocket") {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	// This performs the WebSocket handshake and establishes the connection
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// The response writer is wrapped so bytes sent on the connection are counted
+	wsConnection, err := upgrader.Upgrade(countingResponseWriter{w}, r, nil)
 	if err != nil {
-		signalingLogger.Println("Upgrade error:", err)
+		s.logger.Println("Upgrade error:", err)
+		return
+	}
+	// Limit how large client messages can be (see limits.go)
+	wsConnection.SetReadLimit(maxMessageBytes)
+	conn := newWSConn(wsConnection, requestClientIP(r))
+
+	// Negotiate the protocol version from the upgrade URL (?v=2)
+	// The join message may still override it with its own version field
+	version, err := parseVersionParam(r.URL.Query().Get("v"))
+	if err != nil {
+		s.logger.Printf("Rejecting connection from %s: %v", describeConn(conn), err)
+		s.rejectVersion(r.Context(), conn, err.Error())
+		conn.Close()
+		return
+	}
+
+	// A client reconnecting with ?resume=<token> takes over its existing session
+	// The connection's context ends with the request's (see context.go)
+	s.serveConn(r.Context(), conn, version, r.URL.Query().Get("resume"))
+}
+
+// serveConn runs a signaling connection on any transport until it closes:
+// it resumes the session if a resume token is given, then reads messages,
+// enforces the rate limit and passes each message to the middleware chain
+// and its handler (see dispatch.go). The messages are handled under a
+// context derived from parent, cancelled when the connection ends (see
+// context.go).
+func (s *Service) serveConn(parent context.Context, conn Conn, version int, resumeToken string) {
+	ctx, cancel := s.registry.connContext(parent, conn)
+	defer cancel()
+
+	// Connections arriving during shutdown are turned away (see Shutdown)
+	if !s.registry.track(conn, cancel) {
+		s.closeConn(conn, websocket.CloseGoingAway, closeReasonShutdown)
 		return
 	}
 
@@ -108,82 +172,115 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request, signalingLogger *lo
 	// This prevents resource leaks and ensures proper cleanup
 	defer func() {
 		// Handle disconnection
-		HandleDisconnect(conn, signalingLogger)
+		// Resumable sessions are held for a grace window instead of removed
+		// The peers are told under the root context, which outlives the
+		// connection's
+		s.HandleConnectionLost(s.registry.ctx, conn)
 		conn.Close()
+		s.registry.untrack(conn)
 	}()
 
+	// Ping the client and reap its session if it goes quiet (see heartbeat.go)
+	stopHeartbeat := s.startHeartbeat(conn)
+	defer stopHeartbeat()
+	s.startReaper()
+
+	// A client reconnecting with a resume token takes over its existing session
+	// If the token is rejected the client can still join normally
+	if resumeToken != "" {
+		if resumedVersion, ok := s.HandleResume(ctx, conn, resumeToken, version); ok {
+			version = resumedVersion
+		}
+	}
+
+	// Limit how frequent client messages can be (see limits.go)
+	var limiter inboundLimiter
+
 	// Main message handling loop
 	// This loop continuously reads messages from the WebSocket connection
 	// Each message is parsed and routed to the appropriate handler
 	for {
 		var msg SignalingMessage
-		if err := conn.ReadJSON(&msg); err != nil {
-			signalingLogger.Println("Read error:", err)
+		if err := conn.ReadMessage(&msg); err != nil {
+			countReadError(err)
+			s.logger.Println("Read error:", err)
+			s.closeAfterReadError(conn, err)
 			break
 		}
+		// Anything the client sends shows it is still there
+		s.registry.touch(conn)
+
+		// Enforce the per-connection rate limit before doing any work
+		verdict := limiter.check(time.Now())
+		if verdict == rateExceeded {
+			s.closePolicyViolation(ctx, conn, "message rate limit exceeded")
+			break
+		}
+		if verdict == rateWarned {
+			s.logger.Printf("Rate limit exceeded by %s, dropping message and warning client", describeConn(conn))
+			s.sendToConn(ctx, conn, SignalingMessage{
+				Type:  "error",
+				Error: "rateLimited",
+				Data:  map[string]string{"error": "rateLimited"},
+			}, version)
+			continue
+		}
 
 		// Add debug logging for all messages
 		// This helps with debugging and understanding message flow
-		//signalingLogger.Printf("Received message: %+v", msg)
-
-		// Route message to appropriate handler based on message type
-		// Each message type has its own handler function for modularity
-		switch msg.Type {
-		case "join":
-			signalingLogger.Printf("Received: join From: %s To: %s", msg.Sender, msg.Receiver)
-			// User joins the signaling server
-			// Registers user and adds to active users list
-			HandleJoin(conn, msg, signalingLogger)
-		case "activeUsers":
-			signalingLogger.Printf("Received: activeUsers From: %s To: %s", msg.Sender, msg.Receiver)
-			// Get list of currently active users
-			// Sends current user list to requesting client
-			HandleActiveUsers(conn, msg, signalingLogger)
-		case "call":
-			signalingLogger.Printf("Received: call From: %s To: %s", msg.Sender, msg.Receiver)
-			// Initiate a call to another user
-			// Sends call request to target user
-			HandleCall(conn, msg, signalingLogger)
-		case "cancelCall":
-			signalingLogger.Printf("Received: cancelCall From: %s To: %s", msg.Sender, msg.Receiver)
-			// Cancel an outgoing call
-			// Notifies target user that call was cancelled
-			HandleCancelCall(conn, msg, signalingLogger)
-		case "acceptCall":
-			signalingLogger.Printf("Received: acceptCall From: %s To: %s", msg.Sender, msg.Receiver)
-			// Accept an incoming call
-			// Establishes call connection between users
-			HandleAcceptCall(conn, msg, signalingLogger)
-		case "offer":
-			signalingLogger.Printf("Received: offer From: %s To: %s", msg.Sender, msg.Receiver)
-			// Send SDP offer to peer
-			// Initiates WebRTC connection establishment
-			HandleOffer(conn, msg, signalingLogger)
-		case "answer":
-			signalingLogger.Printf("Received: answer From: %s To: %s", msg.Sender, msg.Receiver)
-			// Send SDP answer to peer
-			// Completes WebRTC connection establishment
-			HandleAnswer(conn, msg, signalingLogger)
-		case "candidate":
-			signalingLogger.Printf("Received: candidate From: %s To: %s", msg.Sender, msg.Receiver)
-			// Send ICE candidate to peer
-			// Helps establish optimal peer-to-peer connection
-			HandleIceCandidate(conn, msg, signalingLogger)
-		case "hangUp":
-			signalingLogger.Printf("Received: hangUp From: %s To: %s", msg.Sender, msg.Receiver)
-			// End an active call
-			// Terminates WebRTC connection and notifies both users
-			HandleHangUp(conn, msg, signalingLogger)
-		case "leave":
-			signalingLogger.Printf("Received: leave From: %s To: %s", msg.Sender, msg.Receiver)
-			// User leaves the signaling server
-			// Cleans up user session and removes from active users
-			HandleDisconnect(conn, signalingLogger)
-			conn.Close()
-		default:
-			// Unknown message type
-			// Log for debugging but don't break the connection
-			signalingLogger.Printf("Unknown message type: %s From: %s To: %s", msg.Type, msg.Sender, msg.Receiver)
+		//s.logger.Printf("Received message: %+v", msg)
+
+		// A join may carry its own protocol version, which wins over the URL
+		if msg.Type == "join" && msg.Version != 0 {
+			if !isSupportedVersion(msg.Version) {
+				reason := fmt.Sprintf("unsupported protocol version %d", msg.Version)
+				s.logger.Printf("Rejecting join from %s: %s", RedactName(msg.Sender), reason)
+				s.rejectVersion(ctx, conn, reason)
+				break
+			}
+			version = msg.Version
 		}
+		// Stamp every message with the connection's negotiated version
+		// so handlers can render their replies appropriately
+		msg.Version = version
+
+		// Count, capture, record and log the message and route it to the
+		// handler of its type (see dispatch.go)
+		if !s.dispatch.chain(withCallID(ctx, msg.CallID), conn, msg) {
+			return
+		}
+	}
+}
+
+// closeConn closes a connection with a WebSocket close code and reason and
+// logs both, so clients and operators can tell a kick from a shutdown or a
+// protocol error. SSE and gRPC connections translate the code (see sse.go
+// and grpc.go).
+//
+// CLOSE CODES:
+// ============
+// - 1000 normal closure: the client sent leave, or resumed elsewhere
+// - 1001 going away: the server is shutting down
+// - 1002 protocol error: malformed message or unsupported protocol version
+// - 1008 policy violation: rate limit exceeded, or kicked by an admin
+// - 1009 message too big: larger than -signal-max-message-bytes
+// - 4001 slow consumer: the client stopped reading (see outbound.go)
+// - 4002 stale session: the client stopped answering pings (see heartbeat.go)
+// - 4003 replaced: a newer join took over the session (see rejoin.go)
+func (s *Service) closeConn(conn Conn, code int, reason string) {
+	s.logger.Printf("Closing connection from %s with code %d (%s)", describeConn(conn), code, reason)
+	conn.CloseWithCode(code, reason)
+}
+
+// closeAfterReadError closes a connection whose read failed because of what
+// the client sent. A connection that simply went away isn't sent anything.
+func (s *Service) closeAfterReadError(conn Conn, err error) {
+	var parseErr *parseError
+	switch {
+	case errors.As(err, &parseErr):
+		s.closeConn(conn, websocket.CloseProtocolError, "invalid message")
+	case errors.Is(err, websocket.ErrReadLimit):
+		// gorilla/websocket has sent the close frame already
+		s.closeConn(conn, websocket.CloseMessageTooBig, "message too big")
 	}
 }
@@ -0,0 +1,175 @@
+/*
+WebRTC Signaling Heartbeats
+===========================
+
+This file tracks when each signaling user was last heard from, pings
+WebSocket clients to keep that current, and reaps sessions that went quiet.
+
+WHY IS THIS NEEDED?
+===================
+A phone that loses its network without closing the socket left its session
+behind until the TCP connection timed out, often many minutes later. In the
+meantime it showed up as online and could be called. Clients also want to
+show "last seen 2 minutes ago", and support wants to know how stale a
+session is.
+
+HOW IT WORKS:
+=============
+1. Every session records ConnectedAt when the user joins (a resumed session
+   keeps it) and LastActivity, updated on every message read and every pong.
+2. WebSocket connections are pinged every heartbeat interval. Browsers and
+   gorilla/websocket answer pings by themselves, so an idle but healthy
+   client stays active without sending anything.
+3. A reaper closes WebSocket connections whose session has been inactive
+   for the stale timeout with close code 4002. The session is then
+   detached like any lost connection (see resume.go).
+
+SSE and gRPC connections aren't pinged or reaped: SSE sessions have their
+own idle timeout (see sse.go) and gRPC has transport keepalives. Their
+LastActivity still follows the messages they send.
+
+Both timestamps are shown in the user list to v2 clients (RFC 3339) and on
+the admin sessions endpoint. A change in LastActivity alone doesn't cause a
+userUpdated delta, so v2 clients see it refreshed with each full snapshot.
+*/
+
+package webrtc
+
+import "time"
+
+// Heartbeat configuration defaults
+const (
+	DefaultHeartbeatInterval   = 30 * time.Second // Between pings to WebSocket clients
+	DefaultStaleSessionTimeout = 90 * time.Second // Inactivity before a session is reaped
+
+	// CloseStaleSession is the close code sent to clients that stopped
+	// answering heartbeats
+	CloseStaleSession = 4002
+)
+
+var (
+	// Current heartbeat configuration, set once at startup by ConfigureHeartbeat
+	heartbeatInterval   = DefaultHeartbeatInterval
+	staleSessionTimeout = DefaultStaleSessionTimeout
+)
+
+// ConfigureHeartbeat sets how often WebSocket clients are pinged and how
+// long a session may be inactive before it is reaped. 0 disables either.
+func ConfigureHeartbeat(interval, staleTimeout time.Duration) {
+	heartbeatInterval = interval
+	staleSessionTimeout = staleTimeout
+}
+
+// heartbeatConn is implemented by transports that can ping their clients
+type heartbeatConn interface {
+	// ping sends a heartbeat ping to the client
+	ping() error
+	// setPongHandler calls onPong whenever the client answers a ping
+	setPongHandler(onPong func())
+}
+
+// startHeartbeat pings conn until the returned function is called, if its
+// transport supports it, and counts pongs as activity
+func (s *Service) startHeartbeat(conn Conn) (stop func()) {
+	hb, ok := conn.(heartbeatConn)
+	if !ok || heartbeatInterval <= 0 {
+		return func() {}
+	}
+	hb.setPongHandler(func() {
+		s.registry.touch(conn)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := hb.ping(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// touch records activity on the session that owns conn, if any
+func (r *Registry) touch(conn Conn) {
+	r.mu.RLock()
+	session, _, owned := r.connSessionLocked(conn)
+	r.mu.RUnlock()
+	if !owned {
+		return
+	}
+	session.mu.Lock()
+	session.LastActivity = time.Now()
+	session.mu.Unlock()
+}
+
+// startReaper starts the stale session reaper of the service's registry,
+// once per registry
+func (s *Service) startReaper() {
+	if staleSessionTimeout <= 0 {
+		return
+	}
+	s.registry.reaperOnce.Do(func() {
+		s.registry.reaper.Add(1)
+		go func() {
+			defer s.registry.reaper.Done()
+			s.reapStaleSessions()
+		}()
+	})
+}
+
+// reapStaleSessions periodically closes the connections of WebSocket
+// sessions that have been inactive for the stale timeout, until the
+// registry is closed
+func (s *Service) reapStaleSessions() {
+	// A stale session is reaped at most a third of the timeout late
+	ticker := time.NewTicker(staleSessionTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.registry.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		type staleConn struct {
+			name string
+			conn Conn
+			idle time.Duration
+		}
+		var stale []staleConn
+		now := time.Now()
+		s.registry.mu.RLock()
+		for name, session := range s.registry.nameToUserSession {
+			session.mu.Lock()
+			conn, lastActivity := session.Conn, session.LastActivity
+			session.mu.Unlock()
+			if _, ok := conn.(heartbeatConn); !ok {
+				continue // Detached, or a transport without heartbeats
+			}
+			if idle := now.Sub(lastActivity); idle > staleSessionTimeout {
+				stale = append(stale, staleConn{name, conn, idle})
+			}
+		}
+		s.registry.mu.RUnlock()
+
+		for _, c := range stale {
+			s.logger.Printf("Reaping stale session of %s, inactive for %s", RedactName(c.name), c.idle.Round(time.Second))
+			s.closeConn(c.conn, CloseStaleSession, "stale session")
+		}
+	}
+}
+
+// formatActivityTime renders a presence timestamp for the user list
+func formatActivityTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,88 @@
+package webrtc_test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+)
+
+// testOffer is a session description the server's payload checks accept
+var testOffer = map[string]string{"type": "offer", "sdp": "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"}
+
+// newTestServer serves a fresh service at /signal and returns it with the
+// WebSocket URL to dial
+func newTestServer(t *testing.T) (*webrtc.Service, string) {
+	t.Helper()
+	s := webrtc.NewService(webrtc.NewRegistry(), log.New(io.Discard, "", 0))
+	// The server doesn't wait for hijacked WebSocket connections, so count
+	// the handlers itself: the test isn't over until they have returned,
+	// and the next one may change the package configuration
+	var handlers sync.WaitGroup
+	routes := s.Routes("/signal")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		routes.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		s.Shutdown()
+		server.Close()
+		handlers.Wait()
+	})
+	return s, "ws" + strings.TrimPrefix(server.URL, "http") + "/signal"
+}
+
+// dial joins the server at url with opts and closes the client when the
+// test ends
+func dial(t *testing.T, url string, opts client.Options) *client.Client {
+	t.Helper()
+	c, err := client.DialOptions(url, opts)
+	if err != nil {
+		t.Fatalf("dial as %q: %v", opts.Username, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// receive waits for a value on ch
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	var zero T
+	return zero
+}
+
+// startCall has caller call callee and callee accept, and returns once the
+// caller has seen the accept
+func startCall(t *testing.T, caller, callee *client.Client) {
+	t.Helper()
+	calls := make(chan string, 1)
+	callee.OnCall(func(from string) { calls <- from })
+	accepts := make(chan string, 1)
+	caller.OnAcceptCall(func(from string) { accepts <- from })
+	if err := caller.Call(callee.Name); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if from := receive(t, calls, "call"); from != caller.Name {
+		t.Fatalf("%s got a call from %q, want %q", callee.Name, from, caller.Name)
+	}
+	if err := callee.AcceptCall(caller.Name); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if from := receive(t, accepts, "acceptCall"); from != callee.Name {
+		t.Fatalf("%s got an accept from %q, want %q", caller.Name, from, callee.Name)
+	}
+}
@@ -0,0 +1,347 @@
+/*
+WebRTC Signaling Event History
+==============================
+
+This file keeps the most recent signaling events of calls in memory, and the
+outcome of recent calls, for debugging a call after it happened.
+
+WHY IS THIS NEEDED?
+===================
+Captures (see capture.go) only record what happens after they are started,
+and the signaling log only has what it was configured to log. When a user
+reports that a call failed an hour ago, "show me everything that happened in
+call X" has to work without anyone having turned anything on beforehand.
+
+HOW IT WORKS:
+=============
+Every message that belongs to a call (see callid.go), whether it comes from
+a client ("in") or is written to one ("out"), is recorded as an event:
+time, direction, type, sender, receiver, call ID and the size of its
+encoded data. The data itself is never kept, so an event holds no reference
+to SDP bodies or candidates, and names longer than maxHistoryField bytes
+are cut short.
+
+Each call is also recorded when it starts ringing, when it is answered and
+when it ends, with its outcome:
+- completed: hung up after it was answered
+- cancelled: ended by the caller (or a transfer abandoned) before it was answered
+- declined: hung up by the callee while it was ringing
+- timeout: nobody answered within the ring timeout (see missedcalls.go),
+  or a transfer's target within the transfer timeout
+- peer-disconnected: one of the users left or lost their connection
+- transferred: handed over to another user (see transfer.go)
+
+Events and calls are each kept in a ring of the last N (default 10000,
+-call-history-size), so recording one evicts the oldest in O(1) once the
+ring is full. 0 disables the history.
+
+ADMIN ENDPOINTS:
+================
+GET /admin/calls?since=<t> lists the recorded calls that started at or after
+t, oldest first, where t is an RFC 3339 time or a duration before now such
+as 15m. Without since every recorded call is listed, and with
+tenant=<name> only the calls of that tenant (see tenants.go; tenant= is the
+default tenant). A call still ringing or in progress has no outcome yet:
+
+	[{"callId":"9b2f...","caller":"alice","callee":"bob",
+	  "started":"2026-10-17T09:30:00Z","answered":"2026-10-17T09:30:04Z",
+	  "ended":"2026-10-17T09:41:12Z","outcome":"completed"}]
+
+GET /admin/calls/<callId>/events returns the call and its recorded events,
+oldest first:
+
+	{"call":{...},"events":[{"time":"2026-10-17T09:30:00Z","direction":"out",
+	 "type":"call","sender":"alice","receiver":"bob","callId":"9b2f...","size":0}, ...]}
+
+The oldest events of a long call may have been evicted already, and a call
+whose record was evicted still has its remaining events listed.
+*/
+
+package webrtc
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHistorySize is the default number of events, and of calls, kept
+// in the event history
+const DefaultHistorySize = 10000
+
+// maxHistoryField is the longest name, type or call ID kept in an event.
+// Clients can put anything in a message, and the history must stay small.
+const maxHistoryField = 64
+
+// Call outcomes in the event history
+const (
+	CallCompleted        = "completed"
+	CallCancelled        = "cancelled"
+	CallDeclined         = "declined"
+	CallTimeout          = "timeout"
+	CallPeerDisconnected = "peer-disconnected"
+	CallTransferred      = "transferred"
+)
+
+// history is the current event history, replaced once at startup by
+// ConfigureHistory
+var history = newEventHistory(DefaultHistorySize)
+
+// ConfigureHistory sets how many events, and how many calls, the event
+// history keeps; 0 disables it
+func ConfigureHistory(size int) {
+	history = newEventHistory(size)
+}
+
+// HistoryEvent is a signaling message of a call, as kept in the history
+type HistoryEvent struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // "in" from a client, "out" to one
+	Type      string    `json:"type"`
+	Sender    string    `json:"sender,omitempty"`
+	Receiver  string    `json:"receiver,omitempty"`
+	CallID    string    `json:"callId"`
+	Size      int       `json:"size"` // Bytes of the message's data, JSON encoded
+}
+
+// CallRecord is a call in the history and how it ended
+type CallRecord struct {
+	Tenant   string    `json:"tenant,omitempty"` // See tenants.go, empty for the default tenant
+	CallID   string    `json:"callId"`
+	Caller   string    `json:"caller"`
+	Callee   string    `json:"callee"`
+	Started  time.Time `json:"started"`
+	Answered time.Time `json:"answered,omitzero"`
+	Ended    time.Time `json:"ended,omitzero"`
+	Outcome  string    `json:"outcome,omitempty"` // Empty while the call goes on
+}
+
+// eventHistory keeps the last size events and calls in two rings
+type eventHistory struct {
+	size int
+
+	mu         sync.Mutex
+	events     []HistoryEvent // Grows to size, then wraps around
+	nextEvent  int            // Slot the next event overwrites once full
+	calls      map[string]*CallRecord
+	callOrder  []string // IDs of the calls in calls, in the order they started
+	nextCallID int      // Slot the next call overwrites once full
+}
+
+func newEventHistory(size int) *eventHistory {
+	size = max(size, 0)
+	return &eventHistory{
+		size:      size,
+		events:    make([]HistoryEvent, 0, size),
+		calls:     make(map[string]*CallRecord, size),
+		callOrder: make([]string, 0, size),
+	}
+}
+
+// enabled reports whether the history keeps anything
+func (h *eventHistory) enabled() bool {
+	return h.size > 0
+}
+
+// addEvent appends an event, overwriting the oldest once the ring is full
+func (h *eventHistory) addEvent(event HistoryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.events) < h.size {
+		h.events = append(h.events, event)
+		return
+	}
+	h.events[h.nextEvent] = event
+	h.nextEvent = (h.nextEvent + 1) % h.size
+}
+
+// callEvents returns the events of a call, oldest first
+func (h *eventHistory) callEvents(callID string) []HistoryEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := []HistoryEvent{}
+	for i := range h.events {
+		// Once the ring is full, the oldest event is in the next slot
+		event := h.events[(h.nextEvent+i)%len(h.events)]
+		if event.CallID == callID {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// callStarted records a call of a tenant that started ringing, forgetting
+// the oldest call once the ring is full
+func (h *eventHistory) callStarted(call *activeCall, tenant string) {
+	if !h.enabled() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.callOrder) < h.size {
+		h.callOrder = append(h.callOrder, call.id)
+	} else {
+		delete(h.calls, h.callOrder[h.nextCallID])
+		h.callOrder[h.nextCallID] = call.id
+		h.nextCallID = (h.nextCallID + 1) % h.size
+	}
+	h.calls[call.id] = &CallRecord{
+		Tenant:  tenant,
+		CallID:  call.id,
+		Caller:  call.caller,
+		Callee:  call.callee,
+		Started: time.Now(),
+	}
+}
+
+// callAnswered records that a call was accepted
+func (h *eventHistory) callAnswered(call *activeCall) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if record := h.calls[call.id]; record != nil && record.Answered.IsZero() {
+		record.Answered = time.Now()
+	}
+}
+
+// callEnded records how a call ended
+func (h *eventHistory) callEnded(call *activeCall, outcome string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if record := h.calls[call.id]; record != nil && record.Outcome == "" {
+		record.Ended = time.Now()
+		record.Outcome = outcome
+	}
+}
+
+// call returns a copy of a call's record, or nil if it isn't kept
+func (h *eventHistory) call(callID string) *CallRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	record := h.calls[callID]
+	if record == nil {
+		return nil
+	}
+	copied := *record
+	return &copied
+}
+
+// callsSince returns copies of the calls that started at or after since,
+// oldest first, only those of one tenant unless all is set
+func (h *eventHistory) callsSince(since time.Time, tenant string, all bool) []CallRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	calls := []CallRecord{}
+	for i := range h.callOrder {
+		record := h.calls[h.callOrder[(h.nextCallID+i)%len(h.callOrder)]]
+		if record != nil && !record.Started.Before(since) && (all || record.Tenant == tenant) {
+			calls = append(calls, *record)
+		}
+	}
+	return calls
+}
+
+// hangUpOutcome is the outcome of a call that one of its users ended with a
+// hangUp or cancelCall
+func hangUpOutcome(call *activeCall, by string) string {
+	switch {
+	case call == nil || call.accepted:
+		return CallCompleted
+	case by == call.callee:
+		return CallDeclined
+	}
+	return CallCancelled
+}
+
+// historyField cuts a string from a message down to maxHistoryField bytes,
+// copying it so the event doesn't keep the original alive
+func historyField(s string) string {
+	if len(s) <= maxHistoryField {
+		return s
+	}
+	return strings.Clone(s[:maxHistoryField])
+}
+
+// recordEvent adds a message of the call with the given ID to the history.
+// Messages that don't belong to a call aren't recorded.
+func recordEvent(direction, callID string, msg SignalingMessage) {
+	h := history
+	if !h.enabled() || callID == "" {
+		return
+	}
+	size := 0
+	if msg.Data != nil {
+		if encoded, err := json.Marshal(msg.Data); err == nil {
+			size = len(encoded)
+		}
+	}
+	h.addEvent(HistoryEvent{
+		Time:      time.Now(),
+		Direction: direction,
+		Type:      historyField(msg.Type),
+		Sender:    historyField(msg.Sender),
+		Receiver:  historyField(msg.Receiver),
+		CallID:    historyField(callID),
+		Size:      size,
+	})
+}
+
+// recordInbound adds a message read from conn to the history if it belongs
+// to a call: the one it names, or else the call of the connection's user
+// with its receiver
+func (s *Service) recordInbound(conn Conn, msg SignalingMessage) {
+	if !history.enabled() {
+		return
+	}
+	callID := msg.CallID
+	if callID == "" {
+		s.registry.mu.RLock()
+		if user, joined := s.registry.sessionIdToName[conn.RemoteAddr().String()]; joined {
+			callID = s.registry.callIDLocked(user, msg.Receiver)
+		}
+		s.registry.mu.RUnlock()
+	}
+	recordEvent("in", callID, msg)
+}
+
+// HandleCalls serves GET /admin/calls?since=<t>&tenant=<name>, the calls in
+// the event history that started at or after t, of one tenant if one is
+// given (see tenants.go)
+func HandleCalls(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if param := r.URL.Query().Get("since"); param != "" {
+		if t, err := time.Parse(time.RFC3339, param); err == nil {
+			since = t
+		} else if d, err := time.ParseDuration(param); err == nil && d >= 0 {
+			since = time.Now().Add(-d)
+		} else {
+			http.Error(w, "since must be an RFC 3339 time or a duration", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	tenant, filtered := r.URL.Query()["tenant"]
+	if filtered {
+		json.NewEncoder(w).Encode(history.callsSince(since, tenant[0], false))
+		return
+	}
+	json.NewEncoder(w).Encode(history.callsSince(since, "", true))
+}
+
+// HandleCallEvents serves GET /admin/calls/{callId}/events, a call's record
+// and its events in the event history
+func HandleCallEvents(w http.ResponseWriter, r *http.Request) {
+	callID := r.PathValue("callId")
+	record := history.call(callID)
+	events := history.callEvents(callID)
+	if record == nil && len(events) == 0 {
+		http.Error(w, "unknown call", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Call   *CallRecord    `json:"call"`
+		Events []HistoryEvent `json:"events"`
+	}{record, events})
+}
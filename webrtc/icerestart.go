@@ -0,0 +1,160 @@
+/*
+WebRTC Signaling ICE Restart
+============================
+
+This file coordinates ICE restarts between the two users of a call.
+
+WHY IS THIS NEEDED?
+===================
+When a phone switches from Wi-Fi to mobile data mid-call, its candidates
+stop working and it has to restart ICE. Clients had no agreed way to say so,
+and candidates gathered on the old network kept arriving after the restart:
+some still queued on the server, others already on their way from the peer.
+Applied to the new negotiation, they make it slower or fail.
+
+MESSAGE FORMAT:
+===============
+Either user of an accepted call (see callauth.go) announces the restart:
+
+	{"type":"iceRestart","sender":"alice","receiver":"bob"}
+
+The server bumps the call's negotiation epoch, which starts at 1, and:
+
+1. Drops the candidates between the two users that are still waiting on the
+   server: queued for writing, or kept for replay after a reconnect (see
+   reliability.go). They belong to the old network.
+2. Relays the restart to the peer with the new epoch:
+     {"type":"iceRestart","sender":"alice","receiver":"bob","data":{"negotiationEpoch":2}}
+3. Confirms it to the sender:
+     {"type":"iceRestart","receiver":"alice","data":{"result":true,"negotiationEpoch":2}}
+
+EPOCH TAGS:
+===========
+Offers, answers and candidates forwarded to v2 clients carry the epoch they
+belong to as "negotiationEpoch". A client may name it when sending; messages
+without one belong to the current epoch, and messages naming an epoch the
+call hasn't reached are dropped. A receiver discards any message tagged with
+an older epoch than the last iceRestart it saw: that is a straggler from
+before the restart. The epoch starts over at 1 for every call, and the
+current one is part of the callState a resumed session gets.
+*/
+
+package webrtc
+
+import "context"
+
+// HandleIceRestart starts a new negotiation epoch for the sender's call
+// and tells both users
+func (s *Service) HandleIceRestart(ctx context.Context, conn Conn, msg SignalingMessage) {
+	if !s.inCallWith(ctx, conn, msg) {
+		return
+	}
+	sender := msg.Sender
+	receiver := msg.Receiver
+
+	// The registry lock keeps restarts from both users from interleaving
+	s.registry.mu.Lock()
+	senderSession, senderExists := s.registry.nameToUserSession[sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	if !senderExists || !receiverExists {
+		s.registry.mu.Unlock()
+		return
+	}
+	senderSession.mu.Lock()
+	restarts := senderSession.callControls.restarts + 1
+	senderSession.callControls.restarts = restarts
+	senderSession.mu.Unlock()
+	receiverSession.mu.Lock()
+	receiverSession.callControls.restarts = restarts
+	receiverSession.mu.Unlock()
+
+	callID := s.registry.callIDLocked(sender, receiver)
+	s.registry.mu.Unlock()
+
+	epoch := restarts + 1
+	dropped := receiverSession.dropCandidatesFrom(sender) + senderSession.dropCandidatesFrom(receiver)
+	s.logger.Printf("User %s restarted ICE with %s, negotiation epoch %d, %d stale candidates dropped%s", RedactName(sender), RedactName(receiver), epoch, dropped, callLabel(callID))
+
+	receiverSession.Send(ctx, SignalingMessage{
+		Type:     "iceRestart",
+		Sender:   sender,
+		Receiver: receiver,
+		Data:     map[string]uint64{"negotiationEpoch": epoch},
+		CallID:   callID,
+	})
+	senderSession.Send(ctx, SignalingMessage{
+		Type:     "iceRestart",
+		Receiver: sender,
+		Data:     map[string]interface{}{"result": true, "negotiationEpoch": epoch},
+		CallID:   callID,
+	})
+}
+
+// negotiationEpoch returns the epoch to tag a forwarded offer, answer or
+// candidate with: the one the sender named, or the call's current one. It
+// is 0 if sender and receiver aren't in a call together, which is only
+// possible with call authorization off. It reports false, after logging, if
+// the message names an epoch the call hasn't reached.
+func (s *Service) negotiationEpoch(msg SignalingMessage) (uint64, bool) {
+	s.registry.mu.RLock()
+	session, exists := s.registry.nameToUserSession[msg.Sender]
+	s.registry.mu.RUnlock()
+	if !exists {
+		return 0, true
+	}
+	session.mu.Lock()
+	inCall := session.Peer == msg.Receiver
+	current := session.callControls.restarts + 1
+	session.mu.Unlock()
+	if !inCall {
+		return 0, true
+	}
+
+	switch {
+	case msg.NegotiationEpoch == 0:
+		return current, true
+	case msg.NegotiationEpoch > current:
+		s.logger.Printf("Dropping %s from %s to %s: negotiation epoch %d, call is at %d%s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), msg.NegotiationEpoch, current, callLabel(msg.CallID))
+		return 0, false
+	}
+	return msg.NegotiationEpoch, true
+}
+
+// dropCandidatesFrom removes the candidates from peer that are waiting to be
+// written to this session or kept for replay, and returns how many it found
+func (u *UserSession) dropCandidatesFrom(peer string) int {
+	stale := func(msg SignalingMessage) bool {
+		return msg.Type == "candidate" && msg.Sender == peer
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	replayable := 0
+	kept := u.outbox[:0]
+	for _, msg := range u.outbox {
+		if stale(msg) {
+			replayable++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	u.outbox = kept
+
+	queued := 0
+	if u.outbound != nil {
+		q := u.outbound
+		q.mu.Lock()
+		pending := q.pending[:0]
+		for _, m := range q.pending {
+			if stale(m.msg) {
+				queued++
+				continue
+			}
+			pending = append(pending, m)
+		}
+		q.pending = pending
+		q.mu.Unlock()
+	}
+	// A queued message is usually in the outbox too, don't count it twice
+	return max(replayable, queued)
+}
@@ -0,0 +1,83 @@
+package webrtc_test
+
+import (
+	"fmt"
+	"testing"
+
+	"go-server/webrtc"
+
+	"github.com/gorilla/websocket"
+)
+
+// joinRaw joins as name on a raw v2 WebSocket, to see the epoch tags the
+// Go client acts on
+func joinRaw(t *testing.T, url, name string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial as %s: %v", name, err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	sendRaw(t, ws, webrtc.SignalingMessage{Type: "join", Sender: name, Version: webrtc.ProtocolV2})
+	expectRaw(t, ws, "join")
+	return ws
+}
+
+// sendRaw writes a message to a raw WebSocket
+func sendRaw(t *testing.T, ws *websocket.Conn, msg webrtc.SignalingMessage) {
+	t.Helper()
+	if err := ws.WriteJSON(msg); err != nil {
+		t.Fatalf("send %s: %v", msg.Type, err)
+	}
+}
+
+// candidateOn returns a host candidate on the given port
+func candidateOn(port int) map[string]any {
+	return map[string]any{"candidate": fmt.Sprintf("candidate:1 1 udp 2130706431 192.0.2.1 %d typ host", port), "sdpMid": "0", "sdpMLineIndex": 0}
+}
+
+// expectCandidate reads the next candidate and checks its port and epoch
+func expectCandidate(t *testing.T, ws *websocket.Conn, port int, epoch uint64) {
+	t.Helper()
+	candidate := expectRaw(t, ws, "candidate")
+	data, _ := candidate.Data.(map[string]any)
+	if data["candidate"] != candidateOn(port)["candidate"] || candidate.NegotiationEpoch != epoch {
+		t.Fatalf("got candidate %v in epoch %d, want port %d in epoch %d", candidate.Data, candidate.NegotiationEpoch, port, epoch)
+	}
+}
+
+// Candidates are tagged with the epoch they were gathered in: a straggler
+// from epoch 1 arriving after the restart to epoch 2 keeps its tag so the
+// receiver can discard it, and an epoch the call hasn't reached is dropped
+func TestIceRestartEpochTags(t *testing.T) {
+	_, url := newTestServer(t)
+	alice := joinRaw(t, url, "alice")
+	bob := joinRaw(t, url, "bob")
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"})
+	// v2 clients name the call in everything they send about it
+	callID := expectRaw(t, bob, "call").CallID
+	sendRaw(t, bob, webrtc.SignalingMessage{Type: "acceptCall", Sender: "bob", Receiver: "alice", CallID: callID})
+	expectRaw(t, alice, "acceptCall")
+
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: candidateOn(50001), CallID: callID})
+	expectCandidate(t, bob, 50001, 1)
+
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "iceRestart", Sender: "alice", Receiver: "bob", CallID: callID})
+	if restart := expectRaw(t, bob, "iceRestart"); restart.Sender != "alice" || restart.Data.(map[string]any)["negotiationEpoch"] != 2.0 {
+		t.Fatalf("bob got %+v, want a restart to epoch 2 from alice", restart)
+	}
+	if result := expectRaw(t, alice, "iceRestart"); result.Data.(map[string]any)["negotiationEpoch"] != 2.0 {
+		t.Fatalf("alice got %+v, want a confirmed restart to epoch 2", result)
+	}
+
+	// bob's candidate gathered before he saw the restart
+	sendRaw(t, bob, webrtc.SignalingMessage{Type: "candidate", Sender: "bob", Receiver: "alice", Data: candidateOn(50002), NegotiationEpoch: 1, CallID: callID})
+	expectCandidate(t, alice, 50002, 1)
+	sendRaw(t, bob, webrtc.SignalingMessage{Type: "candidate", Sender: "bob", Receiver: "alice", Data: candidateOn(50003), NegotiationEpoch: 2, CallID: callID})
+	expectCandidate(t, alice, 50003, 2)
+
+	// Untagged candidates belong to the current epoch, future ones are dropped
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: candidateOn(50004), NegotiationEpoch: 3, CallID: callID})
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: candidateOn(50005), CallID: callID})
+	expectCandidate(t, bob, 50005, 2)
+}
@@ -0,0 +1,376 @@
+/*
+WebRTC Signaling Message Interceptors
+=====================================
+
+This file lets server-side policy rewrite or veto the offers, answers and
+ICE candidates the server forwards, and provides two such policies.
+
+WHY IS THIS NEEDED?
+===================
+Some deployments must enforce what a call may use: all media through the
+TURN relay (so client addresses never reach the peer, or only the relay is
+reachable through the firewall), or no codec the peers' hardware can't
+decode. Clients can't be trusted to do that, and doing it in the handlers
+meant forking them.
+
+HOW IT WORKS:
+=============
+Interceptors are configured once at startup with ConfigureInterceptors.
+HandleOffer, HandleAnswer and HandleIceCandidate pass the message, after
+its data was validated (see payload.go), through every interceptor in turn
+and forward what the last one returns. An interceptor that returns an error
+vetoes the message: it isn't forwarded, and the sender gets
+
+	{"type":"error","error":"messageRejected","data":{"error":"messageRejected","type":"offer","reason":"..."}}
+
+with the error as reason. ErrSuppressMessage vetoes a message quietly,
+without telling the sender.
+
+BUILT-IN INTERCEPTORS:
+======================
+- ForceRelay (-force-relay): removes every candidate but relay ones from
+  offers and answers, and quietly drops trickled candidates that aren't
+  relay candidates, so peers only ever try the TURN relay
+- HideLocalCandidates (-filter-host-candidates): keeps peers from learning
+  each other's LAN addresses. Host candidates (including mDNS .local ones),
+  peer reflexive candidates and server reflexive candidates with a private,
+  loopback, link-local or shared (100.64.0.0/10) address are removed from
+  offers and answers, and dropped quietly when trickled; public srflx and
+  relay candidates are forwarded, with their related address (raddr,
+  the client's local address) zeroed. A candidate whose type or address
+  can't be parsed is forwarded untouched, failing open, and counted (see
+  stats.go).
+- CodecFilter (-filter-codecs): removes the named codecs (e.g. H264, or
+  red and ulpfec) from every media section of offers and answers, along
+  with their retransmission (RTX) payload types. A media section left
+  without any codec vetoes the description.
+
+An interceptor must not modify the message's data in place; the same data
+may still be captured or recorded. The built-ins return a copy.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// MessageInterceptor rewrites or vetoes an offer, answer or candidate
+// before it is forwarded, see above
+type MessageInterceptor interface {
+	Intercept(ctx context.Context, msg SignalingMessage) (SignalingMessage, error)
+}
+
+// ErrSuppressMessage is returned by an interceptor to drop a message
+// without telling its sender
+var ErrSuppressMessage = errors.New("message suppressed")
+
+// interceptors are the current interceptors, in order, set once at startup
+// by ConfigureInterceptors
+var interceptors []MessageInterceptor
+
+// ConfigureInterceptors sets the interceptors offers, answers and candidates
+// pass through before they are forwarded, in the order given
+func ConfigureInterceptors(list ...MessageInterceptor) {
+	interceptors = list
+}
+
+// intercept passes a message through the interceptors. A vetoed message is
+// logged, answered with an error unless suppressed, and reported as not ok.
+func (s *Service) intercept(ctx context.Context, conn Conn, msg SignalingMessage) (SignalingMessage, bool) {
+	for _, interceptor := range interceptors {
+		intercepted, err := interceptor.Intercept(ctx, msg)
+		if errors.Is(err, ErrSuppressMessage) {
+			return msg, false
+		}
+		if err != nil {
+			s.logger.Printf("Rejecting %s from %s to %s%s: %v", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), callLabel(msg.CallID), err)
+			s.sendToConn(ctx, conn, SignalingMessage{
+				Type:     "error",
+				Receiver: msg.Sender,
+				Error:    "messageRejected",
+				Data:     map[string]string{"error": "messageRejected", "type": msg.Type, "reason": err.Error()},
+			}, msg.Version)
+			return msg, false
+		}
+		msg = intercepted
+	}
+	return msg, true
+}
+
+// sdpLines splits an SDP into its lines and returns the line ending it
+// uses, "\r\n" as RFC 8866 requires or "\n"
+func sdpLines(sdp string) ([]string, string) {
+	eol := "\r\n"
+	if !strings.Contains(sdp, eol) {
+		eol = "\n"
+	}
+	return strings.Split(strings.TrimSuffix(sdp, eol), eol), eol
+}
+
+// withField returns a copy of a message's data with one field replaced,
+// such as the SDP of a description
+func withField(data map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
+
+// candidateType returns the type of an ICE candidate line, e.g. "host" or
+// "relay", or "" if it has none
+func candidateType(candidate string) string {
+	fields := strings.Fields(candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "typ" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// filterCandidates passes every candidate of a description, or a trickled
+// candidate, through keep, which returns the candidate to forward or false
+// to remove it; a removed trickled candidate is suppressed. The empty
+// candidate that marks the end of candidates is always kept.
+func filterCandidates(msg SignalingMessage, keep func(candidate string) (string, bool)) (SignalingMessage, error) {
+	data, _ := msg.Data.(map[string]interface{})
+	switch msg.Type {
+	case "candidate":
+		candidate, _ := data["candidate"].(string)
+		if candidate == "" {
+			return msg, nil
+		}
+		kept, ok := keep(candidate)
+		if !ok {
+			return msg, ErrSuppressMessage
+		}
+		if kept != candidate {
+			msg.Data = withField(data, "candidate", kept)
+		}
+	case "offer", "answer":
+		sdp, _ := data["sdp"].(string)
+		lines, eol := sdpLines(sdp)
+		out := make([]string, 0, len(lines))
+		changed := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, "a=candidate:") {
+				kept, ok := keep(line)
+				changed = changed || !ok || kept != line
+				if !ok {
+					continue
+				}
+				line = kept
+			}
+			out = append(out, line)
+		}
+		if changed {
+			msg.Data = withField(data, "sdp", strings.Join(out, eol)+eol)
+		}
+	}
+	return msg, nil
+}
+
+// ForceRelay is the built-in interceptor that keeps only relay candidates,
+// see above
+type ForceRelay struct{}
+
+// Intercept removes non-relay candidates from a description, or suppresses
+// a trickled non-relay candidate
+func (ForceRelay) Intercept(ctx context.Context, msg SignalingMessage) (SignalingMessage, error) {
+	return filterCandidates(msg, func(candidate string) (string, bool) {
+		return candidate, candidateType(candidate) == "relay"
+	})
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), as local to
+// a carrier's network as RFC 1918 addresses are to a LAN
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// HideLocalCandidates is the built-in interceptor that keeps only public
+// srflx and relay candidates, see above
+type HideLocalCandidates struct{}
+
+// Intercept removes host, prflx and private srflx candidates from a
+// description, or suppresses such a trickled candidate
+func (HideLocalCandidates) Intercept(ctx context.Context, msg SignalingMessage) (SignalingMessage, error) {
+	return filterCandidates(msg, keepPublicCandidate)
+}
+
+// keepPublicCandidate decides whether HideLocalCandidates forwards a
+// candidate. The related address (raddr, rport) of a forwarded srflx or
+// relay candidate is the client's local address, so it is replaced with
+// 0.0.0.0 and port 0, as browsers do in their own privacy modes.
+// Candidates that can't be parsed are forwarded untouched, and counted.
+func keepPublicCandidate(candidate string) (string, bool) {
+	// candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ...
+	fields := strings.Fields(candidate)
+	typ := candidateType(candidate)
+	if len(fields) < 8 || typ == "" {
+		malformedCandidateCount.Add(1)
+		return candidate, true
+	}
+	switch typ {
+	case "relay":
+		return hideRelatedAddress(fields), true
+	case "host", "prflx":
+		return "", false
+	case "srflx":
+		addr, err := netip.ParseAddr(fields[4])
+		if err != nil {
+			malformedCandidateCount.Add(1)
+			return candidate, true
+		}
+		addr = addr.Unmap()
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddressSpace.Contains(addr) {
+			return "", false
+		}
+		return hideRelatedAddress(fields), true
+	}
+	// A type from a later RFC; forwarded like any candidate that can't be told apart
+	malformedCandidateCount.Add(1)
+	return candidate, true
+}
+
+// hideRelatedAddress returns a candidate, split into fields, with its raddr
+// and rport zeroed
+func hideRelatedAddress(fields []string) string {
+	hidden := append([]string(nil), fields...)
+	for i := 0; i+1 < len(hidden); i++ {
+		switch hidden[i] {
+		case "raddr":
+			hidden[i+1] = "0.0.0.0"
+		case "rport":
+			hidden[i+1] = "0"
+		}
+	}
+	return strings.Join(hidden, " ")
+}
+
+// CodecFilter is the built-in interceptor that removes codecs from
+// descriptions, see above
+type CodecFilter struct {
+	codecs map[string]bool // Lowercase encoding names
+}
+
+// NewCodecFilter returns a codec filter removing the named codecs, matched
+// case-insensitively against the encoding names of a=rtpmap lines
+func NewCodecFilter(names []string) *CodecFilter {
+	f := &CodecFilter{codecs: make(map[string]bool)}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			f.codecs[strings.ToLower(name)] = true
+		}
+	}
+	return f
+}
+
+// Intercept removes the filtered codecs from the media sections of an offer
+// or answer; candidates pass unchanged
+func (f *CodecFilter) Intercept(ctx context.Context, msg SignalingMessage) (SignalingMessage, error) {
+	if msg.Type != "offer" && msg.Type != "answer" {
+		return msg, nil
+	}
+	data, _ := msg.Data.(map[string]interface{})
+	sdp, _ := data["sdp"].(string)
+	lines, eol := sdpLines(sdp)
+
+	// Split the SDP into the session section and one section per m= line
+	var sections [][]string
+	start := 0
+	for i, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			sections = append(sections, lines[start:i])
+			start = i
+		}
+	}
+	sections = append(sections, lines[start:])
+
+	changed := false
+	out := append([]string(nil), sections[0]...)
+	for _, section := range sections[1:] {
+		filtered, removed, err := f.filterSection(section)
+		if err != nil {
+			return msg, err
+		}
+		changed = changed || removed
+		out = append(out, filtered...)
+	}
+	if changed {
+		msg.Data = withField(data, "sdp", strings.Join(out, eol)+eol)
+	}
+	return msg, nil
+}
+
+// filterSection removes the filtered codecs from one media section, whose
+// first line is its m= line. It fails if no codec would be left.
+func (f *CodecFilter) filterSection(section []string) ([]string, bool, error) {
+	// m=<media> <port> <proto> <fmt> ...
+	mline := strings.Fields(section[0])
+	if len(mline) < 4 || !strings.Contains(mline[2], "RTP") {
+		return section, false, nil // Not RTP media, e.g. a data channel
+	}
+
+	// Payload types of the filtered codecs, then of the RTX streams
+	// repairing them (a=fmtp:<rtx pt> apt=<pt>)
+	dropped := make(map[string]bool)
+	for _, line := range section {
+		if rest, ok := strings.CutPrefix(line, "a=rtpmap:"); ok {
+			pt, encoding, _ := strings.Cut(rest, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			if f.codecs[strings.ToLower(name)] {
+				dropped[pt] = true
+			}
+		}
+	}
+	if len(dropped) == 0 {
+		return section, false, nil
+	}
+	for _, line := range section {
+		if rest, ok := strings.CutPrefix(line, "a=fmtp:"); ok {
+			pt, params, _ := strings.Cut(rest, " ")
+			for _, param := range strings.Split(params, ";") {
+				if apt, ok := strings.CutPrefix(strings.TrimSpace(param), "apt="); ok && dropped[apt] {
+					dropped[pt] = true
+				}
+			}
+		}
+	}
+
+	formats := append([]string(nil), mline[:3]...)
+	for _, pt := range mline[3:] {
+		if !dropped[pt] {
+			formats = append(formats, pt)
+		}
+	}
+	if len(formats) == 3 {
+		return nil, false, fmt.Errorf("no codec left in the %s section after filtering", mline[0][len("m="):])
+	}
+
+	filtered := []string{strings.Join(formats, " ")}
+	for _, line := range section[1:] {
+		if pt, ok := payloadTypeOf(line); ok && dropped[pt] {
+			continue
+		}
+		filtered = append(filtered, line)
+	}
+	return filtered, true, nil
+}
+
+// payloadTypeOf returns the payload type an a=rtpmap, a=fmtp or a=rtcp-fb
+// line is about
+func payloadTypeOf(line string) (string, bool) {
+	for _, prefix := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			pt, _, _ := strings.Cut(rest, " ")
+			return pt, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,321 @@
+package webrtc_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+)
+
+// chromeOffer returns the offer Chrome makes for an audio, video and data
+// channel call, with host, mDNS, TCP, srflx (one behind carrier-grade NAT)
+// and relay candidates
+func chromeOffer(t *testing.T) string {
+	t.Helper()
+	sdp, err := os.ReadFile("testdata/chrome-offer.sdp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(sdp)
+}
+
+// describe wraps an SDP in a message the way clients send it
+func describe(msgType, sdp string) webrtc.SignalingMessage {
+	return webrtc.SignalingMessage{Type: msgType, Sender: "alice", Receiver: "bob", Data: map[string]interface{}{"type": msgType, "sdp": sdp}}
+}
+
+// sdpOf returns the SDP of an intercepted description
+func sdpOf(t *testing.T, msg webrtc.SignalingMessage) string {
+	t.Helper()
+	data, _ := msg.Data.(map[string]interface{})
+	sdp, ok := data["sdp"].(string)
+	if !ok {
+		t.Fatalf("no SDP in %+v", msg.Data)
+	}
+	return sdp
+}
+
+// linesWith returns the lines of an SDP starting with prefix
+func linesWith(sdp, prefix string) []string {
+	var matching []string
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, prefix) {
+			matching = append(matching, line)
+		}
+	}
+	return matching
+}
+
+// ForceRelay leaves only the relay candidate of an offer and changes
+// nothing else, without touching the data it was given
+func TestForceRelayDescription(t *testing.T) {
+	sdp := chromeOffer(t)
+	for _, msgType := range []string{"offer", "answer"} {
+		msg := describe(msgType, sdp)
+		intercepted, err := webrtc.ForceRelay{}.Intercept(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("%s: %v", msgType, err)
+		}
+		got := sdpOf(t, intercepted)
+		candidates := linesWith(got, "a=candidate:")
+		if len(candidates) != 1 || !strings.Contains(candidates[0], " typ relay ") {
+			t.Fatalf("%s: candidates %q, want only the relay one", msgType, candidates)
+		}
+		var withoutCandidates []string
+		for _, line := range strings.Split(sdp, "\r\n") {
+			if !strings.HasPrefix(line, "a=candidate:") || strings.Contains(line, " typ relay ") {
+				withoutCandidates = append(withoutCandidates, line)
+			}
+		}
+		if want := strings.Join(withoutCandidates, "\r\n"); got != want {
+			t.Fatalf("%s: rewritten to\n%s\nwant\n%s", msgType, got, want)
+		}
+		if sdpOf(t, msg) != sdp {
+			t.Fatalf("%s: the original message was modified", msgType)
+		}
+	}
+}
+
+// Trickled candidates that aren't relay candidates are dropped quietly
+func TestForceRelayTrickle(t *testing.T) {
+	cases := []struct {
+		name      string
+		candidate string
+		forwarded bool
+	}{
+		{"host", "candidate:1467250027 1 udp 2122260223 192.168.1.20 54321 typ host generation 0", false},
+		{"mDNS host", "candidate:2999745851 1 udp 2122194687 3d8e2b0f-2c1a-4e0e-9d0e-1d2f3a4b5c6d.local 54322 typ host generation 0", false},
+		{"TCP host", "candidate:1610713179 1 tcp 1518280447 192.168.1.20 9 typ host tcptype active generation 0", false},
+		{"srflx", "candidate:842163049 1 udp 1686052607 203.0.113.45 61000 typ srflx raddr 192.168.1.20 rport 54321 generation 0", false},
+		{"relay", "candidate:1121413430 1 udp 33562367 198.51.100.7 49152 typ relay raddr 203.0.113.45 rport 61000 generation 0", true},
+		{"end of candidates", "", true},
+	}
+	for _, c := range cases {
+		msg := webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: map[string]interface{}{"candidate": c.candidate, "sdpMid": "0", "sdpMLineIndex": 0.0}}
+		intercepted, err := webrtc.ForceRelay{}.Intercept(context.Background(), msg)
+		if c.forwarded {
+			if err != nil || intercepted.Data.(map[string]interface{})["candidate"] != c.candidate {
+				t.Fatalf("%s: got %+v, %v; want it forwarded unchanged", c.name, intercepted.Data, err)
+			}
+		} else if !errors.Is(err, webrtc.ErrSuppressMessage) {
+			t.Fatalf("%s: got %v, want ErrSuppressMessage", c.name, err)
+		}
+	}
+}
+
+func TestCodecFilter(t *testing.T) {
+	sdp := chromeOffer(t)
+	const (
+		audio = "m=audio 9 UDP/TLS/RTP/SAVPF 111 63 9 0 8 13 110 126"
+		video = "m=video 9 UDP/TLS/RTP/SAVPF 96 97 98 99 100 101 102 103 45 46"
+	)
+	cases := []struct {
+		name         string
+		codecs       []string
+		mlines       []string
+		removedTypes []string // Payload types whose lines must be gone
+	}{
+		// H264 takes its RTX payload types 101 and 103 with it
+		{"H264", []string{"H264"}, []string{audio, "m=video 9 UDP/TLS/RTP/SAVPF 96 97 98 99 45 46"}, []string{"100", "101", "102", "103"}},
+		{"case and spaces", []string{" h264", "vp9 "}, []string{audio, "m=video 9 UDP/TLS/RTP/SAVPF 96 97 45 46"}, []string{"98", "99", "100", "101", "102", "103"}},
+		{"audio only", []string{"red", "G722", "PCMU"}, []string{"m=audio 9 UDP/TLS/RTP/SAVPF 111 8 13 110 126", video}, []string{"63", "9", "0"}},
+		{"absent codec", []string{"H265"}, []string{audio, video}, nil},
+	}
+	for _, c := range cases {
+		intercepted, err := webrtc.NewCodecFilter(c.codecs).Intercept(context.Background(), describe("offer", sdp))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got := sdpOf(t, intercepted)
+		if mlines := linesWith(got, "m="); len(mlines) != 3 || mlines[0] != c.mlines[0] || mlines[1] != c.mlines[1] || mlines[2] != "m=application 9 UDP/DTLS/SCTP webrtc-datachannel" {
+			t.Fatalf("%s: media lines %q, want %q and the data channel", c.name, mlines, c.mlines)
+		}
+		for _, pt := range c.removedTypes {
+			for _, prefix := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+				if left := linesWith(got, prefix+pt+" "); len(left) > 0 {
+					t.Fatalf("%s: %q left", c.name, left)
+				}
+			}
+		}
+		if len(c.removedTypes) == 0 && got != sdp {
+			t.Fatalf("%s: SDP rewritten without a codec to remove", c.name)
+		}
+		// Everything but the codecs' lines is kept
+		for _, prefix := range []string{"a=candidate:", "a=ssrc:", "a=extmap:", "a=mid:", "a=sctp-port:"} {
+			if len(linesWith(got, prefix)) != len(linesWith(sdp, prefix)) {
+				t.Fatalf("%s: %s lines removed", c.name, prefix)
+			}
+		}
+	}
+}
+
+// A media section left without a codec vetoes the description, and an SDP
+// with bare LF line endings keeps them
+func TestCodecFilterEdges(t *testing.T) {
+	sdp := chromeOffer(t)
+	filter := webrtc.NewCodecFilter([]string{"opus", "red", "G722", "PCMU", "PCMA", "CN", "telephone-event"})
+	_, err := filter.Intercept(context.Background(), describe("answer", sdp))
+	if err == nil || !strings.Contains(err.Error(), "no codec left in the audio section") {
+		t.Fatalf("filtering every audio codec: %v", err)
+	}
+
+	lf := strings.ReplaceAll(sdp, "\r\n", "\n")
+	intercepted, err := webrtc.NewCodecFilter([]string{"VP8"}).Intercept(context.Background(), describe("offer", lf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := sdpOf(t, intercepted)
+	if strings.Contains(got, "\r") || !strings.HasSuffix(got, "\n") || strings.Contains(got, "VP8") {
+		t.Fatalf("LF SDP filtered to %q", got)
+	}
+
+	candidate := webrtc.SignalingMessage{Type: "candidate", Data: map[string]interface{}{"candidate": "candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host"}}
+	if intercepted, err := filter.Intercept(context.Background(), candidate); err != nil || intercepted.Data.(map[string]interface{})["candidate"] != candidate.Data.(map[string]interface{})["candidate"] {
+		t.Fatalf("candidate through the codec filter: %+v, %v", intercepted.Data, err)
+	}
+}
+
+// useInterceptors sets the interceptors until the test ends
+func useInterceptors(t *testing.T, list ...webrtc.MessageInterceptor) {
+	t.Helper()
+	webrtc.ConfigureInterceptors(list...)
+	t.Cleanup(func() { webrtc.ConfigureInterceptors() })
+}
+
+// vetoOffers rejects every offer
+type vetoOffers struct{}
+
+func (vetoOffers) Intercept(ctx context.Context, msg webrtc.SignalingMessage) (webrtc.SignalingMessage, error) {
+	if msg.Type == "offer" {
+		return msg, errors.New("offers are closed")
+	}
+	return msg, nil
+}
+
+// Through a running service: a vetoed offer is answered with
+// messageRejected and not forwarded, a suppressed candidate is dropped
+// without a word, and rewritten descriptions reach the peer
+func TestInterceptorsForwarding(t *testing.T) {
+	useInterceptors(t, webrtc.ForceRelay{}, webrtc.NewCodecFilter([]string{"H264"}), vetoOffers{})
+	_, url := newTestServer(t)
+	alice := joinRaw(t, url, "alice")
+	bob := joinRaw(t, url, "bob")
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"})
+	callID := expectRaw(t, bob, "call").CallID
+	sendRaw(t, bob, webrtc.SignalingMessage{Type: "acceptCall", Sender: "bob", Receiver: "alice", CallID: callID})
+	expectRaw(t, alice, "acceptCall")
+
+	offer := describe("offer", chromeOffer(t))
+	offer.CallID = callID
+	sendRaw(t, alice, offer)
+	rejection := expectRaw(t, alice, "error")
+	data, _ := rejection.Data.(map[string]any)
+	if rejection.Error != "messageRejected" || data["type"] != "offer" || data["reason"] != "offers are closed" {
+		t.Fatalf("vetoed offer answered with %+v", rejection)
+	}
+
+	host := map[string]any{"candidate": "candidate:1467250027 1 udp 2122260223 192.168.1.20 54321 typ host generation 0", "sdpMid": "0", "sdpMLineIndex": 0}
+	relay := map[string]any{"candidate": "candidate:1121413430 1 udp 33562367 198.51.100.7 49152 typ relay raddr 203.0.113.45 rport 61000 generation 0", "sdpMid": "0", "sdpMLineIndex": 0}
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: host, CallID: callID})
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: relay, CallID: callID})
+	answer := describe("answer", chromeOffer(t))
+	answer.Sender, answer.Receiver, answer.CallID = "bob", "alice", callID
+	sendRaw(t, bob, answer)
+
+	// bob gets neither the offer nor the host candidate, only the relay one
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg webrtc.SignalingMessage
+		if err := bob.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for the relay candidate: %v", err)
+		}
+		if msg.Type == "offer" {
+			t.Fatal("bob got the vetoed offer")
+		}
+		if msg.Type == "candidate" {
+			if got := msg.Data.(map[string]any)["candidate"]; got != relay["candidate"] {
+				t.Fatalf("bob got candidate %q, want only the relay one", got)
+			}
+			break
+		}
+	}
+	sdp := sdpOf(t, expectRaw(t, alice, "answer"))
+	if strings.Contains(sdp, "H264") || len(linesWith(sdp, "a=candidate:")) != 1 {
+		t.Fatalf("alice got an answer with H264 or non-relay candidates:\n%s", sdp)
+	}
+}
+
+// HideLocalCandidates forwards public srflx and relay candidates with their
+// related address zeroed, drops the rest, and forwards what it can't
+// classify untouched, counting it
+func TestHideLocalCandidatesTrickle(t *testing.T) {
+	cases := []struct {
+		name         string
+		candidate    string
+		forwarded    string // "" when dropped
+		unclassified bool
+	}{
+		{"host", "candidate:1467250027 1 udp 2122260223 192.168.1.20 54321 typ host generation 0", "", false},
+		{"mDNS host", "candidate:2999745851 1 udp 2122194687 3d8e2b0f-2c1a-4e0e-9d0e-1d2f3a4b5c6d.local 54322 typ host generation 0", "", false},
+		{"public IPv6 host", "candidate:3 1 udp 2122262783 2001:db8::20 54323 typ host generation 0", "", false},
+		{"prflx", "candidate:4 1 udp 1853824767 203.0.113.46 61001 typ prflx raddr 0.0.0.0 rport 0 generation 0", "", false},
+		{"private srflx", "candidate:5 1 udp 1686052607 10.1.2.3 61000 typ srflx raddr 192.168.1.20 rport 54321 generation 0", "", false},
+		{"CGNAT srflx", "candidate:3402581839 1 udp 1685987071 100.72.14.9 61002 typ srflx raddr 192.168.1.20 rport 54321 generation 0", "", false},
+		{"loopback srflx", "candidate:6 1 udp 1686052607 127.0.0.1 61000 typ srflx raddr 127.0.0.1 rport 54321 generation 0", "", false},
+		{"link-local srflx", "candidate:7 1 udp 1686052607 fe80::1 61000 typ srflx raddr fe80::2 rport 54321 generation 0", "", false},
+		{"ULA srflx", "candidate:8 1 udp 1686052607 fd12:3456::1 61000 typ srflx raddr fd12:3456::2 rport 54321 generation 0", "", false},
+		{"public srflx", "candidate:842163049 1 udp 1686052607 203.0.113.45 61000 typ srflx raddr 192.168.1.20 rport 54321 generation 0",
+			"candidate:842163049 1 udp 1686052607 203.0.113.45 61000 typ srflx raddr 0.0.0.0 rport 0 generation 0", false},
+		{"IPv4-mapped public srflx", "candidate:9 1 udp 1686052607 ::ffff:203.0.113.45 61000 typ srflx raddr 192.168.1.20 rport 54321",
+			"candidate:9 1 udp 1686052607 ::ffff:203.0.113.45 61000 typ srflx raddr 0.0.0.0 rport 0", false},
+		{"relay", "candidate:1121413430 1 udp 33562367 198.51.100.7 49152 typ relay raddr 203.0.113.45 rport 61000 generation 0",
+			"candidate:1121413430 1 udp 33562367 198.51.100.7 49152 typ relay raddr 0.0.0.0 rport 0 generation 0", false},
+		{"without type", "candidate:1 1 udp 2122260223 192.168.1.20 54321", "candidate:1 1 udp 2122260223 192.168.1.20 54321", true},
+		{"srflx without address", "candidate:10 1 udp 1686052607 not-an-ip 61000 typ srflx", "candidate:10 1 udp 1686052607 not-an-ip 61000 typ srflx", true},
+		{"unknown type", "candidate:11 1 udp 1686052607 192.168.1.20 61000 typ future", "candidate:11 1 udp 1686052607 192.168.1.20 61000 typ future", true},
+		{"end of candidates", "", "", false},
+	}
+	for _, c := range cases {
+		before := webrtc.Stats().Unclassified
+		msg := webrtc.SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob", Data: map[string]interface{}{"candidate": c.candidate, "sdpMid": "0"}}
+		intercepted, err := webrtc.HideLocalCandidates{}.Intercept(context.Background(), msg)
+		switch {
+		case c.forwarded == "" && c.candidate != "":
+			if !errors.Is(err, webrtc.ErrSuppressMessage) {
+				t.Fatalf("%s: got %+v, %v; want it dropped", c.name, intercepted.Data, err)
+			}
+		case err != nil:
+			t.Fatalf("%s: %v", c.name, err)
+		default:
+			if got := intercepted.Data.(map[string]interface{})["candidate"]; got != c.forwarded {
+				t.Fatalf("%s: forwarded %q, want %q", c.name, got, c.forwarded)
+			}
+		}
+		if counted := webrtc.Stats().Unclassified - before; (counted != 0) != c.unclassified {
+			t.Fatalf("%s: counted %d unclassified candidates", c.name, counted)
+		}
+		if msg.Data.(map[string]interface{})["candidate"] != c.candidate {
+			t.Fatalf("%s: the original message was modified", c.name)
+		}
+	}
+}
+
+// In a description only the public srflx and relay candidates are left
+func TestHideLocalCandidatesDescription(t *testing.T) {
+	intercepted, err := webrtc.HideLocalCandidates{}.Intercept(context.Background(), describe("offer", chromeOffer(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := linesWith(sdpOf(t, intercepted), "a=candidate:")
+	want := []string{
+		"a=candidate:842163049 1 udp 1686052607 203.0.113.45 61000 typ srflx raddr 0.0.0.0 rport 0 generation 0 network-id 1 network-cost 10",
+		"a=candidate:1121413430 1 udp 33562367 198.51.100.7 49152 typ relay raddr 0.0.0.0 rport 0 generation 0 network-id 1 network-cost 10",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("candidates left:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,55 @@
+package webrtc_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+
+	"github.com/gorilla/websocket"
+)
+
+// Kicking a user in a call hangs up their peer, who can take calls again,
+// and keeps the kicked user out for the cooldown
+func TestKickReleasesPeer(t *testing.T) {
+	s, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+	bob := dial(t, url, client.Options{Username: "bob"})
+	startCall(t, alice, bob)
+
+	kicks := make(chan string, 1)
+	alice.OnKicked(func(reason string) { kicks <- reason })
+	hangUps := make(chan string, 1)
+	bob.OnHangUp(func(from string) { hangUps <- from })
+
+	if !s.Kick("alice", "spam", time.Minute) {
+		t.Fatal("kick found no session for alice")
+	}
+	if reason := receive(t, kicks, "kicked"); reason != "spam" {
+		t.Fatalf("alice was kicked for %q, want spam", reason)
+	}
+	if from := receive(t, hangUps, "hangUp"); from != "alice" {
+		t.Fatalf("bob got a hangUp from %q, want alice", from)
+	}
+	receive(t, alice.Done(), "alice's connection to close")
+	if code, _ := alice.CloseCode(); code != websocket.ClosePolicyViolation {
+		t.Fatalf("alice's connection closed with %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+
+	for _, session := range s.Registry().Snapshot() {
+		if session.Username == "bob" && (session.InCall || session.Peer != "" || session.CallID != "") {
+			t.Fatalf("bob is still in a call after alice was kicked: %+v", session)
+		}
+	}
+	carol := dial(t, url, client.Options{Username: "carol"})
+	startCall(t, carol, bob)
+
+	// Only v2 clients are told why a join was refused
+	_, err := client.DialOptions(url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	if !errors.Is(err, client.ErrJoinRejected) || !strings.Contains(err.Error(), "kicked") {
+		t.Fatalf("alice rejoined during the cooldown, error %v", err)
+	}
+}
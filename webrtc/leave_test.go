@@ -0,0 +1,89 @@
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer collects the log lines of handlers on several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// scriptConn is a client that sends the scripted messages, then waits to
+// be closed. onClose runs when the server closes it, before the server's
+// own cleanup for the connection.
+type scriptConn struct {
+	*listConn
+	script  []SignalingMessage
+	onClose func()
+}
+
+func (c *scriptConn) ReadMessage(msg *SignalingMessage) error {
+	if len(c.script) == 0 {
+		return c.listConn.ReadMessage(msg)
+	}
+	*msg, c.script = c.script[0], c.script[1:]
+	return nil
+}
+
+func (c *scriptConn) CloseWithCode(code int, reason string) {
+	if onClose := c.onClose; onClose != nil {
+		c.onClose = nil
+		onClose()
+	}
+	c.listConn.CloseWithCode(code, reason)
+}
+
+// A user who leaves and rejoins before the old socket's cleanup runs keeps
+// the new session, and the leave is only handled once
+func TestLeaveThenRejoinBeforeOldSocketCloses(t *testing.T) {
+	logs := &lockedBuffer{}
+	s := NewService(NewRegistry(), log.New(logs, "", 0))
+	old := &scriptConn{
+		listConn: newListConn(50001),
+		script: []SignalingMessage{
+			{Type: "join", Sender: "alice"},
+			{Type: "leave", Sender: "alice"},
+		},
+	}
+	rejoined := newListConn(50002)
+	old.onClose = func() {
+		s.HandleJoin(context.Background(), rejoined, SignalingMessage{Type: "join", Sender: "alice"})
+	}
+
+	// Returns after the leave, once the old connection's cleanup has run
+	s.serveConn(context.Background(), old, ProtocolV1, "")
+
+	session, joined := s.Registry().Get("alice")
+	if !joined {
+		t.Fatal("alice's new session was removed by the old socket's cleanup")
+	}
+	t.Cleanup(session.stopWriters)
+	if session.Conn != rejoined {
+		t.Fatalf("alice is joined on %s, want the new connection", session.Conn.RemoteAddr())
+	}
+	if n := strings.Count(logs.String(), "User alice disconnected"); n != 1 {
+		t.Fatalf("logged %d disconnects for alice, want 1:\n%s", n, logs)
+	}
+	if sessions := s.Registry().Snapshot(); len(sessions) != 1 || sessions[0].SessionID != rejoined.RemoteAddr().String() {
+		t.Fatalf("sessions %+v, want only alice on the new connection", sessions)
+	}
+}
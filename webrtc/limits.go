@@ -0,0 +1,122 @@
+/*
+WebRTC Signaling Inbound Limits
+===============================
+
+This file implements the size and rate limits applied to every message a
+client sends over the signaling WebSocket.
+
+WHY IS THIS NEEDED?
+===================
+Without limits, a malicious or buggy client can send arbitrarily large JSON
+messages, or arbitrarily many small ones, and keep a CPU core busy decoding
+them and formatting log lines for them.
+
+LIMITS:
+=======
+- Message size: conn.SetReadLimit with maxMessageBytes (default 272 KB,
+  room for the largest offer payload, see payload.go, plus the message
+  fields). Larger frames fail the read and gorilla/websocket closes the
+  connection with code 1009 (message too big).
+- Message rate: a token bucket per connection (default 50 messages per
+  second, bursts of 100). ICE gathering can produce dozens of candidates in
+  a second, which fits comfortably under these defaults.
+
+VIOLATIONS:
+===========
+The first message over the rate limit is dropped and the client gets a
+warning ({"type":"error","error":"rateLimited"}). Another violation within
+rateWarningWindow closes the connection with code 1008 (policy violation)
+and cleans up the session immediately, without a resume grace window.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Inbound limit defaults
+const (
+	DefaultMaxMessageBytes = DefaultMaxPayloadBytes + 16*1024 // Largest message a client may send
+	DefaultMessageRate     = 50.0                             // Messages per second per connection
+	DefaultMessageBurst    = 100                              // Messages a connection may send at once
+	rateWarningWindow      = 5 * time.Second
+)
+
+var (
+	// Current limits, set once at startup by ConfigureLimits
+	maxMessageBytes int64 = DefaultMaxMessageBytes
+	messageRate           = DefaultMessageRate
+	messageBurst          = DefaultMessageBurst
+)
+
+// ConfigureLimits sets the largest message a client may send in bytes and
+// the per-connection message rate and burst. A rate of 0 disables rate limiting.
+func ConfigureLimits(maxBytes int64, rate float64, burst int) {
+	maxMessageBytes = maxBytes
+	messageRate = rate
+	messageBurst = burst
+}
+
+// tokenBucket is a simple token bucket rate limiter.
+// It is not safe for concurrent use; callers serialize access themselves.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow refills the bucket for the time elapsed since the last call and
+// takes one token if available.
+func (b *tokenBucket) allow(rate float64, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// inboundLimiter enforces the message rate of a single connection.
+// It is only used by the connection's read loop.
+type inboundLimiter struct {
+	bucket   tokenBucket
+	warnedAt time.Time
+}
+
+// Rate limit verdicts for a single inbound message
+const (
+	rateAllowed  = iota // Process the message
+	rateWarned          // Drop the message and warn the client
+	rateExceeded        // Close the connection
+)
+
+// check decides what to do with the next inbound message
+func (l *inboundLimiter) check(now time.Time) int {
+	if messageRate <= 0 || l.bucket.allow(messageRate, float64(messageBurst), now) {
+		return rateAllowed
+	}
+	if !l.warnedAt.IsZero() && now.Sub(l.warnedAt) < rateWarningWindow {
+		return rateExceeded
+	}
+	l.warnedAt = now
+	return rateWarned
+}
+
+// closePolicyViolation closes a connection that kept exceeding its limits
+// and removes its session right away.
+func (s *Service) closePolicyViolation(ctx context.Context, conn Conn, reason string) {
+	s.closeConn(conn, websocket.ClosePolicyViolation, reason)
+	// Abusive clients don't get a resume grace window
+	s.HandleDisconnect(ctx, conn)
+}
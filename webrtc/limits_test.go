@@ -0,0 +1,63 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+
+	"github.com/gorilla/websocket"
+)
+
+// A burst of candidates like ICE gathering produces fits under the default
+// rate limit: every one is forwarded and the sender stays connected
+func TestCandidateBurstNotRateLimited(t *testing.T) {
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+	bob := dial(t, url, client.Options{Username: "bob"})
+	startCall(t, alice, bob)
+
+	const burst = 80
+	candidates := make(chan json.RawMessage, burst)
+	bob.OnCandidate(func(from string, candidate json.RawMessage) { candidates <- candidate })
+	start := time.Now()
+	for i := range burst {
+		candidate := map[string]any{"candidate": fmt.Sprintf("candidate:%d 1 udp 2130706431 192.0.2.1 %d typ host", i, 50000+i), "sdpMid": "0"}
+		if err := alice.SendCandidate("bob", candidate); err != nil {
+			t.Fatalf("send candidate %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("sending %d candidates took %s, want them within a second", burst, elapsed)
+	}
+	for i := range burst {
+		receive(t, candidates, fmt.Sprintf("candidate %d", i))
+	}
+	select {
+	case <-alice.Done():
+		code, reason := alice.CloseCode()
+		t.Fatalf("alice was disconnected with %d (%s)", code, reason)
+	default:
+	}
+}
+
+// A message over the size limit closes the connection with 1009
+func TestOversizedMessageClosesConnection(t *testing.T) {
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+	sdp := "v=0\r\n" + strings.Repeat("a", webrtc.DefaultMaxMessageBytes)
+	// The write may fail once the server has closed the connection
+	alice.SendOffer("bob", map[string]string{"type": "offer", "sdp": sdp})
+	select {
+	case <-alice.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open after an oversized message")
+	}
+	if code, _ := alice.CloseCode(); code != websocket.CloseMessageTooBig {
+		t.Fatalf("closed with %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+WebRTC Signaling User Metadata
+==============================
+
+This file lets users describe themselves beyond their username: a display
+name, an avatar URL and the media they can handle.
+
+WHY IS THIS NEEDED?
+===================
+A username alone makes for a poor user list, and a caller couldn't tell
+whether the other side can do video or share a screen before calling.
+
+MESSAGE FORMAT:
+===============
+The metadata is sent with the join, and can be replaced later:
+
+	{"type":"join","sender":"alice","data":{"metadata":{"displayName":"Alice",
+	 "avatarUrl":"https://example.com/alice.png","capabilities":["audio","video"]}}}
+	{"type":"setMetadata","sender":"alice","data":{"metadata":{"displayName":"Alice B."}}}
+
+setMetadata replaces the whole metadata; an empty or missing metadata object
+clears it. v2 clients see it in the user list and get a userUpdated delta
+when it changes; v1 clients never see it.
+
+LIMITS:
+=======
+Everything in the metadata ends up in every client's user list, so it is
+kept small:
+- displayName: at most 64 characters, no control characters
+- avatarUrl: at most 512 bytes, an absolute http or https URL
+- capabilities: at most 8, each 1-32 lowercase letters, digits or dashes
+
+A join with invalid metadata fails with the error "invalidMetadata".
+Metadata lives on the session, so it is gone once the user leaves.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Metadata limits
+const (
+	MaxDisplayNameLength = 64  // Characters
+	MaxAvatarURLBytes    = 512 // Bytes
+	MaxCapabilities      = 8   // Entries
+	MaxCapabilityLength  = 32  // Bytes per entry
+)
+
+// UserMetadata describes a user in the user list. A session's metadata is
+// replaced as a whole, never modified, so it can be shared between lists.
+type UserMetadata struct {
+	DisplayName  string   `json:"displayName,omitempty"`
+	AvatarURL    string   `json:"avatarUrl,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"` // e.g. "audio", "video", "screen"
+}
+
+// metadataFromData reads the metadata object of a join or setMetadata
+// message. It returns nil if there is none, and the reason if it is invalid.
+func metadataFromData(data interface{}) (*UserMetadata, string) {
+	fields, ok := data.(map[string]interface{})
+	if !ok || fields["metadata"] == nil {
+		return nil, ""
+	}
+	raw, ok := fields["metadata"].(map[string]interface{})
+	if !ok {
+		return nil, "metadata must be an object"
+	}
+
+	var metadata UserMetadata
+	if value, present := raw["displayName"]; present {
+		name, ok := value.(string)
+		name = strings.TrimSpace(name)
+		if !ok || utf8.RuneCountInString(name) > MaxDisplayNameLength || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return nil, "invalid displayName"
+		}
+		metadata.DisplayName = name
+	}
+	if value, present := raw["avatarUrl"]; present {
+		avatar, ok := value.(string)
+		if !ok || len(avatar) > MaxAvatarURLBytes || (avatar != "" && !isAvatarURL(avatar)) {
+			return nil, "invalid avatarUrl"
+		}
+		metadata.AvatarURL = avatar
+	}
+	if value, present := raw["capabilities"]; present {
+		list, ok := value.([]interface{})
+		if !ok || len(list) > MaxCapabilities {
+			return nil, "invalid capabilities"
+		}
+		for _, entry := range list {
+			capability, ok := entry.(string)
+			if !ok || !isCapability(capability) {
+				return nil, "invalid capabilities"
+			}
+			metadata.Capabilities = append(metadata.Capabilities, capability)
+		}
+	}
+
+	if metadata.DisplayName == "" && metadata.AvatarURL == "" && len(metadata.Capabilities) == 0 {
+		return nil, ""
+	}
+	return &metadata, ""
+}
+
+// isAvatarURL reports whether avatar is an absolute http or https URL, so
+// clients can't be handed javascript: or data: URLs to render
+func isAvatarURL(avatar string) bool {
+	parsed, err := url.Parse(avatar)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	return parsed.Scheme == "https" || parsed.Scheme == "http"
+}
+
+// isCapability reports whether a capability is a short lowercase token
+func isCapability(capability string) bool {
+	if capability == "" || len(capability) > MaxCapabilityLength {
+		return false
+	}
+	for _, r := range capability {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleSetMetadata replaces the metadata of the user owning the connection
+// and broadcasts the change
+func (s *Service) HandleSetMetadata(ctx context.Context, conn Conn, msg SignalingMessage) {
+	sender := msg.Sender
+
+	s.registry.mu.RLock()
+	session, _, owned := s.registry.connSessionLocked(conn)
+	s.registry.mu.RUnlock()
+
+	// Users can only change their own metadata
+	if !owned || session.Name != sender {
+		s.logger.Printf("Rejected metadata change from unknown sender %s", RedactName(sender))
+		return
+	}
+
+	metadata, reason := metadataFromData(msg.Data)
+	if reason != "" {
+		s.logger.Printf("Rejected metadata from %s: %s", RedactName(sender), reason)
+		session.Send(ctx, SignalingMessage{
+			Type:     "setMetadata",
+			Receiver: sender,
+			Data:     map[string]interface{}{"result": false, "error": "invalidMetadata", "reason": reason},
+			Error:    "invalidMetadata",
+		})
+		return
+	}
+
+	session.mu.Lock()
+	session.Metadata = metadata
+	session.mu.Unlock()
+	s.logger.Printf("User %s updated their metadata", RedactName(sender))
+
+	session.Send(ctx, SignalingMessage{
+		Type:     "setMetadata",
+		Receiver: sender,
+		Data:     map[string]interface{}{"result": true},
+	})
+	s.registry.Broadcast()
+}
@@ -0,0 +1,310 @@
+/*
+WebRTC Signaling Missed Calls
+=============================
+
+This file keeps a short history of the calls each user missed, and gives
+ringing calls a timeout.
+
+WHY IS THIS NEEDED?
+===================
+If alice called bob while bob's app was relaunching, the call was silently
+dropped and bob never learned about it. Calls to a user who never answered
+also rang forever.
+
+HOW IT WORKS:
+=============
+A missed call is recorded for the callee, with the caller, the time and a
+reason, when:
+- offline: the callee wasn't joined when the call was placed (the caller
+  gets a callFailed with the same reason), or their session ended while
+  the call was ringing
+- timeout: nobody answered within the ring timeout; the caller gets a
+  callFailed with the reason "timeout" and the callee a cancelCall
+- rejectedElsewhere: the callee joined again from another connection, e.g.
+  a relaunched app, while the call was ringing on the old one
+
+Every successful join is answered with the user's missed calls, oldest
+first, if there are any:
+
+	{"type":"missedCalls","receiver":"bob","data":{"calls":[
+	 {"caller":"alice","time":"2026-10-17T09:30:00Z","reason":"offline"}]}}
+
+They stay until the client acknowledges them. Without data every missed
+call is cleared; with "until", only those at or before that time, so calls
+missed after the list was shown aren't lost:
+
+	{"type":"clearMissedCalls","sender":"bob","data":{"until":"2026-10-17T09:30:00Z"}}
+	{"type":"clearMissedCalls","receiver":"bob","data":{"result":true,"cleared":1}}
+
+LIMITS:
+=======
+Anyone can call any name, so the history is bounded on every axis: entries
+expire after a TTL (default 24h), each user keeps their newest N (default
+20), and the whole registry at most M (default 10000), dropping the oldest
+entry overall when full. Guests aren't given a history, since their names
+are never reused. Calls can only be placed from the caller's own
+connection (see HandleCall).
+*/
+
+package webrtc
+
+import (
+	"context"
+	"time"
+)
+
+// Missed call and ring timeout defaults
+const (
+	DefaultMissedCallTTL      = 24 * time.Hour   // How long a missed call is kept
+	DefaultMissedCallsPerUser = 20               // Missed calls kept per user, 0 disables
+	DefaultMissedCallsMax     = 10000            // Missed calls kept across all users
+	DefaultRingTimeout        = 60 * time.Second // How long a call rings unanswered
+)
+
+var (
+	// Current missed call configuration, set once at startup by
+	// ConfigureMissedCalls and ConfigureRingTimeout
+	missedCallTTL      = DefaultMissedCallTTL
+	missedCallsPerUser = DefaultMissedCallsPerUser
+	missedCallsMax     = DefaultMissedCallsMax
+	ringTimeout        = DefaultRingTimeout
+)
+
+// ConfigureMissedCalls sets how long missed calls are kept, how many are
+// kept per user (0 disables the history) and how many across all users
+func ConfigureMissedCalls(ttl time.Duration, perUser, total int) {
+	missedCallTTL = ttl
+	missedCallsPerUser = perUser
+	missedCallsMax = total
+}
+
+// ConfigureRingTimeout sets how long a call rings before it is given up as
+// missed; 0 lets calls ring until they are cancelled
+func ConfigureRingTimeout(timeout time.Duration) {
+	ringTimeout = timeout
+}
+
+// MissedCall is one entry of a missedCalls message
+type MissedCall struct {
+	Caller string `json:"caller"`
+	Time   string `json:"time"`   // RFC 3339
+	Reason string `json:"reason"` // offline, timeout or rejectedElsewhere
+}
+
+// MissedCalls is the data of a missedCalls message
+type MissedCalls struct {
+	Calls []MissedCall `json:"calls"`
+}
+
+// missedCall is a missed call kept for its callee
+type missedCall struct {
+	caller string
+	at     time.Time
+	reason string
+}
+
+// recordMissedCall adds a missed call to the callee's history
+func (r *Registry) recordMissedCall(callee, caller, reason string) {
+	if missedCallsPerUser <= 0 || (allowGuests && isGuestName(callee)) {
+		return
+	}
+	r.missedCallsMu.Lock()
+	defer r.missedCallsMu.Unlock()
+
+	now := time.Now()
+	r.missedCalls[callee] = append(r.missedCalls[callee], missedCall{caller: caller, at: now, reason: reason})
+	r.missedCallCount++
+	r.forgetMissedCallsLocked(callee, len(r.missedCalls[callee])-missedCallsPerUser)
+
+	if r.missedCallCount > missedCallsMax {
+		r.sweepMissedCallsLocked(now)
+	}
+	for r.missedCallCount > missedCallsMax {
+		r.dropOldestMissedCallLocked()
+	}
+}
+
+// sweepMissedCallsLocked drops every expired missed call. The caller must
+// hold r.missedCallsMu.
+func (r *Registry) sweepMissedCallsLocked(now time.Time) {
+	for callee := range r.missedCalls {
+		r.expireMissedCallsLocked(callee, now)
+	}
+}
+
+// expireMissedCallsLocked drops a user's expired missed calls, which are
+// the oldest ones. The caller must hold r.missedCallsMu.
+func (r *Registry) expireMissedCallsLocked(callee string, now time.Time) {
+	calls := r.missedCalls[callee]
+	expired := 0
+	for expired < len(calls) && now.Sub(calls[expired].at) > missedCallTTL {
+		expired++
+	}
+	r.forgetMissedCallsLocked(callee, expired)
+}
+
+// forgetMissedCallsLocked drops a user's n oldest missed calls. The caller
+// must hold r.missedCallsMu.
+func (r *Registry) forgetMissedCallsLocked(callee string, n int) {
+	calls := r.missedCalls[callee]
+	if n <= 0 {
+		return
+	}
+	r.missedCallCount -= n
+	if n >= len(calls) {
+		delete(r.missedCalls, callee)
+	} else {
+		r.missedCalls[callee] = calls[n:]
+	}
+}
+
+// dropOldestMissedCallLocked drops the oldest missed call of any user. The
+// caller must hold r.missedCallsMu.
+func (r *Registry) dropOldestMissedCallLocked() {
+	oldest := ""
+	for callee, calls := range r.missedCalls {
+		if oldest == "" || calls[0].at.Before(r.missedCalls[oldest][0].at) {
+			oldest = callee
+		}
+	}
+	if oldest == "" {
+		// Not expected: the count is out of step with the history
+		r.missedCallCount = 0
+		return
+	}
+	r.forgetMissedCallsLocked(oldest, 1)
+}
+
+// missRingingCallLocked records a missed call for a session that goes away
+// while a call to it is still ringing. The caller must hold r.mu.
+func (r *Registry) missRingingCallLocked(session *UserSession, reason string) {
+	call := r.ringingCallLocked(session.Name)
+	// A transfer ringing its target isn't a call to them (see transfer.go)
+	if _, transfer := r.transfers[session.Name]; call == nil || transfer {
+		return
+	}
+	r.recordMissedCall(session.Name, call.caller, reason)
+}
+
+// deliverMissedCalls sends a user who just joined their missed calls, if
+// they have any
+func (s *Service) deliverMissedCalls(ctx context.Context, session *UserSession) {
+	s.registry.missedCallsMu.Lock()
+	s.registry.expireMissedCallsLocked(session.Name, time.Now())
+	calls := make([]MissedCall, 0, len(s.registry.missedCalls[session.Name]))
+	for _, call := range s.registry.missedCalls[session.Name] {
+		calls = append(calls, MissedCall{Caller: call.caller, Time: formatActivityTime(call.at), Reason: call.reason})
+	}
+	s.registry.missedCallsMu.Unlock()
+	if len(calls) == 0 {
+		return
+	}
+
+	s.logger.Printf("Delivering %d missed calls to %s", len(calls), RedactName(session.Name))
+	session.Send(ctx, SignalingMessage{
+		Type:     "missedCalls",
+		Receiver: session.Name,
+		Data:     MissedCalls{Calls: calls},
+	})
+}
+
+// HandleClearMissedCalls forgets the missed calls of the user owning the
+// connection, up to the given time if there is one
+func (s *Service) HandleClearMissedCalls(ctx context.Context, conn Conn, msg SignalingMessage) {
+	sender := msg.Sender
+
+	s.registry.mu.RLock()
+	session, connUser, owned := s.registry.connSessionLocked(conn)
+	s.registry.mu.RUnlock()
+	if !owned || connUser != sender {
+		s.logger.Printf("Rejected clearMissedCalls from unknown sender %s", RedactName(sender))
+		return
+	}
+
+	var until time.Time
+	if data, ok := msg.Data.(map[string]interface{}); ok && data["until"] != nil {
+		value, _ := data["until"].(string)
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			session.Send(ctx, SignalingMessage{
+				Type:     "clearMissedCalls",
+				Receiver: sender,
+				Data:     map[string]interface{}{"result": false, "error": "invalidTime"},
+				Error:    "invalidTime",
+			})
+			return
+		}
+		until = parsed
+	}
+
+	s.registry.missedCallsMu.Lock()
+	calls := s.registry.missedCalls[sender]
+	cleared := len(calls)
+	if !until.IsZero() {
+		// The history is oldest first; times are compared at the second
+		// precision they were sent with
+		cleared = 0
+		for cleared < len(calls) && !calls[cleared].at.Truncate(time.Second).After(until) {
+			cleared++
+		}
+	}
+	s.registry.forgetMissedCallsLocked(sender, cleared)
+	s.registry.missedCallsMu.Unlock()
+	s.logger.Printf("User %s cleared %d missed calls", RedactName(sender), cleared)
+
+	session.Send(ctx, SignalingMessage{
+		Type:     "clearMissedCalls",
+		Receiver: sender,
+		Data:     map[string]interface{}{"result": true, "cleared": cleared},
+	})
+}
+
+// startRingLocked gives a call that just started ringing its timeout. The
+// caller must hold r.mu.
+func (s *Service) startRingLocked(call *activeCall) {
+	if ringTimeout <= 0 {
+		return
+	}
+	call.ring = time.AfterFunc(ringTimeout, func() {
+		s.ringTimedOut(call)
+	})
+}
+
+// ringTimedOut gives up on a call nobody answered: both users leave it, the
+// caller is told why, and the callee gets a missed call
+func (s *Service) ringTimedOut(call *activeCall) {
+	s.registry.mu.Lock()
+	// The call may have been answered or ended
+	if s.registry.calls[call.id] != call || call.accepted {
+		s.registry.mu.Unlock()
+		return
+	}
+	s.registry.endCallLocked(call, CallTimeout)
+	callerSession := s.registry.leaveCallLocked(call.caller, call)
+	calleeSession := s.registry.leaveCallLocked(call.callee, call)
+	s.registry.recordMissedCall(call.callee, call.caller, "timeout")
+	s.registry.mu.Unlock()
+	s.logger.Printf("Call from %s to %s timed out after %s%s", RedactName(call.caller), RedactName(call.callee), ringTimeout, callLabel(call.id))
+	// No connection's handler is running; the root context stops at shutdown
+	ctx := s.registry.ctx
+
+	if callerSession != nil {
+		callerSession.Send(ctx, SignalingMessage{
+			Type:     "callFailed",
+			Sender:   call.callee,
+			Receiver: call.caller,
+			Data:     map[string]interface{}{"reason": "timeout"},
+			Error:    "timeout",
+			CallID:   call.id,
+		})
+	}
+	if calleeSession != nil {
+		calleeSession.Send(ctx, SignalingMessage{
+			Type:     "cancelCall",
+			Sender:   call.caller,
+			Receiver: call.callee,
+			CallID:   call.id,
+		})
+	}
+	s.registry.Broadcast()
+}
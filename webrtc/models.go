@@ -1,28 +1,56 @@
 package webrtc
 
 import (
+	"context"
+	"errors"
+	"log"
 	"sync"
-
-	"github.com/gorilla/websocket"
+	"time"
 )
 
 // SignalingMessage represents a signaling message with type, sender, receiver, and data.
+// Version, Error, Seq, Room, NegotiationEpoch and CallID are only rendered
+// for protocol v2 clients.
 type SignalingMessage struct {
 	Type     string      `json:"type"`
 	Sender   string      `json:"sender"`
 	Receiver string      `json:"receiver"`
 	Data     interface{} `json:"data"`
+	Version  int         `json:"version,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Seq      uint64      `json:"seq,omitempty"`
+	Room     string      `json:"room,omitempty"`
+	// Negotiation epoch of an offer, answer or candidate, see icerestart.go
+	NegotiationEpoch uint64 `json:"negotiationEpoch,omitempty"`
+	// Call the message belongs to, see callid.go
+	CallID string `json:"callId,omitempty"`
 }
 
 // JoinResult represents the result of a join attempt
 type JoinResult struct {
-	Result bool `json:"result"`
+	Result       bool   `json:"result"`
+	SessionToken string `json:"sessionToken,omitempty"` // Token for replaying unacked messages after a reconnect
+	Username     string `json:"username,omitempty"`     // Name generated for a guest, see guests.go
+	// Hold and mute state of the current call, in resume responses and in
+	// join responses that took over a call (see rejoin.go)
+	CallState *CallState `json:"callState,omitempty"`
+	// Build of the server, in successful join and resume responses (see
+	// serverinfo.go)
+	ServerInfo *ServerInfo `json:"serverInfo,omitempty"`
 }
 
 // ActiveUser represents an active user in the system
 type ActiveUser struct {
 	Name   string `json:"name"`
 	InCall bool   `json:"inCall"`
+	Status string `json:"status"` // Presence status: available, away or dnd
+	// When the user joined and was last heard from, RFC 3339; v2 clients
+	// only (see heartbeat.go)
+	ConnectedAt  string `json:"connectedAt,omitempty"`
+	LastActivity string `json:"lastActivity,omitempty"`
+	// Display name, avatar and capabilities; v2 clients only (see metadata.go)
+	Metadata *UserMetadata `json:"metadata,omitempty"`
+	Guest    bool          `json:"guest,omitempty"` // Joined without a name, v2 clients only (see guests.go)
 }
 
 // ActiveUsers represents the list of active users
@@ -30,19 +58,87 @@ type ActiveUsers struct {
 	Users []ActiveUser `json:"users"`
 }
 
+// ActiveUsersPage represents one page of the active users list, sorted by
+// name, sent when the request asks for paging or filtering
+type ActiveUsersPage struct {
+	Users  []ActiveUser `json:"users"`
+	Total  int          `json:"total"`  // Users matching the prefix across all pages
+	Offset int          `json:"offset"` // Index of the first user in this page
+	Limit  int          `json:"limit"`  // Page size actually used
+}
+
 // UserSession represents a user's WebSocket session and call state.
 type UserSession struct {
-	Name   string
-	Conn   *websocket.Conn
-	InCall bool
-	mu     sync.Mutex
+	Name    string
+	Conn    Conn
+	InCall  bool
+	Peer    string // User on the other end of the current call, if any
+	CallID  string // ID of the current call, see callid.go
+	Status  string // Presence status, see presence.go
+	Version int    // Negotiated signaling protocol version
+	Token   string // Signed token used to resume the session or replay unacked messages
+	// Client IP of the current connection, behind any trusted proxies
+	ClientIP     string
+	ConnectedAt  time.Time     // When the user joined; a resumed session keeps it
+	LastActivity time.Time     // When a message or pong was last read, see heartbeat.go
+	Metadata     *UserMetadata // Set on join or by setMetadata, see metadata.go
+	Guest        bool          // Joined without a name, see guests.go
+	seq          uint64
+	outbox       []SignalingMessage // Sent messages not yet acknowledged by the client
+	dropped      int                // Messages dropped because the outbox was full
+	logger       *log.Logger
+	service      *Service // Service the user joined, for cleanup from the writers
+
+	chatLimiter tokenBucket // Rate limit for chat messages sent by this user
+	callLimiter tokenBucket // Rate limit for calls placed by a guest
+
+	// Hold and mute state sent during the current call, see callcontrol.go
+	callControls callControlState
+	presence     *presenceQueue // Pending active user broadcasts, see broadcast.go
+	outbound     *outboundQueue // Messages waiting to be written, see outbound.go
+
+	// Pending disconnect cleanup while the session is detached (Conn == nil)
+	graceTimer *time.Timer
+	mu         sync.Mutex
 }
 
-// Send sends a JSON message to the user's WebSocket connection.
-func (u *UserSession) Send(msg SignalingMessage) error {
+// errSessionDetached is returned when sending to a session whose connection
+// was lost and that is waiting for its client to resume.
+var errSessionDetached = errors.New("session is detached, waiting for resume")
+
+// Send queues a JSON message for the user's WebSocket connection,
+// rendered for the session's protocol version. It never blocks on the
+// network; see outbound.go. Once ctx is done nothing is queued and its
+// error is returned (see context.go).
+func (u *UserSession) Send(ctx context.Context, msg SignalingMessage) error {
+	return u.send(ctx, msg, false, nil)
+}
+
+// sendLowPriority is like Send, but the message may be dropped if the
+// client falls behind. Used for user list broadcasts.
+func (u *UserSession) sendLowPriority(ctx context.Context, msg SignalingMessage) error {
+	return u.send(ctx, msg, true, nil)
+}
+
+// send queues a message; failed, if set, is called from the writer if the
+// message can't be written once queued (see delivery.go)
+func (u *UserSession) send(ctx context.Context, msg SignalingMessage, lowPriority bool, failed func(error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	return u.Conn.WriteJSON(msg)
+	u.seq++
+	rendered := renderMessage(msg, u.Version, u.seq)
+	// Keep the message until the client acknowledges it, even if the
+	// write fails, so it can be replayed when the client reconnects
+	if u.reliable() {
+		u.bufferLocked(rendered)
+	}
+	if u.Conn == nil {
+		return errSessionDetached
+	}
+	return u.enqueueLocked(rendered, msg.CallID, lowPriority, failed)
 }
 
 // SetInCall sets the user's call state.
@@ -51,3 +147,14 @@ func (u *UserSession) SetInCall(inCall bool) {
 	defer u.mu.Unlock()
 	u.InCall = inCall
 }
+
+// SetPeer sets the user on the other end of the current call and the
+// call's ID. An empty name means the user is not in a call with anyone.
+// Hold and mute state belong to the previous call and are reset.
+func (u *UserSession) SetPeer(peer, callID string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Peer = peer
+	u.CallID = callID
+	u.callControls = callControlState{}
+}
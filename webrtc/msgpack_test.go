@@ -0,0 +1,38 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go-server/webrtc/client"
+)
+
+// A MessagePack client and a JSON client negotiate a call through the same
+// server, each in its own encoding
+func TestMsgpackAndJSONClientsInterop(t *testing.T) {
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice", MessagePack: true})
+	bob := dial(t, url, client.Options{Username: "bob"})
+	startCall(t, alice, bob)
+
+	offer := map[string]string{"type": "offer", "sdp": testOffer["sdp"] + strings.Repeat("a=ssrc:1 cname:x\r\n", 2000)}
+	offers := make(chan json.RawMessage, 1)
+	bob.OnOffer(func(from string, offer json.RawMessage) { offers <- offer })
+	if err := alice.SendOffer("bob", offer); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+	if got := receive(t, offers, "offer"); !equalJSON(t, got, offer) {
+		t.Fatalf("bob got a different offer of %d bytes", len(got))
+	}
+
+	answer := map[string]string{"type": "answer", "sdp": offer["sdp"]}
+	answers := make(chan json.RawMessage, 1)
+	alice.OnAnswer(func(from string, answer json.RawMessage) { answers <- answer })
+	if err := bob.SendAnswer("alice", answer); err != nil {
+		t.Fatalf("send answer: %v", err)
+	}
+	if got := receive(t, answers, "answer"); !equalJSON(t, got, answer) {
+		t.Fatalf("alice got a different answer of %d bytes", len(got))
+	}
+}
@@ -0,0 +1,254 @@
+/*
+WebRTC Signaling Outbound Queues
+================================
+
+This file implements the per-session outbound queue that every message to a
+joined user goes through.
+
+WHY IS THIS NEEDED?
+===================
+WriteJSON blocks until the message is in the kernel's send buffer. If a
+client stops reading (phone asleep, congested link) its buffer fills up and
+every goroutine writing to it stalls, including the handler of whichever
+unrelated user happened to trigger a broadcast.
+
+HOW IT WORKS:
+=============
+1. UserSession.Send renders the message and appends it to the session's
+   bounded queue. It never touches the network, so it never blocks.
+2. A writer goroutine per session drains the queue, with a write deadline
+   on every write.
+3. When the queue is full, low priority messages (user list broadcasts) are
+   dropped first; v2 clients then get a fresh snapshot once they catch up.
+4. If the queue is still full of signaling messages (offers, candidates...),
+   or a single write takes longer than the write timeout, the client is a
+   slow consumer: it is disconnected with close code 4001 and its session is
+   cleaned up, so the rest of the server never waits for it.
+*/
+
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Outbound queue configuration defaults
+const (
+	DefaultWriteTimeout      = 10 * time.Second // Longest a single write may block
+	DefaultOutboundQueueSize = 256              // Messages queued per session
+
+	// CloseSlowConsumer is the close code sent to clients that fell too far behind
+	CloseSlowConsumer = 4001
+)
+
+var (
+	// Current outbound configuration, set once at startup by ConfigureOutbound
+	writeTimeout      = DefaultWriteTimeout
+	outboundQueueSize = DefaultOutboundQueueSize
+)
+
+// errSlowConsumer is returned when a session's outbound queue is full of
+// messages that can't be dropped.
+var errSlowConsumer = errors.New("outbound queue full, client is not reading")
+
+// outboundMessage is a rendered message waiting to be written
+type outboundMessage struct {
+	msg         SignalingMessage
+	callID      string      // Call the message belongs to, for captures; v1 rendering drops it
+	lowPriority bool        // May be dropped when the queue is full
+	failed      func(error) // Called if the message can't be written, see delivery.go
+}
+
+// outboundQueue holds the messages waiting to be written to one session,
+// drained by that session's writer goroutine.
+type outboundQueue struct {
+	mu       sync.Mutex
+	pending  []outboundMessage
+	wake     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// ConfigureOutbound sets the write timeout and the number of messages that
+// may be queued for a session before it is treated as a slow consumer.
+func ConfigureOutbound(timeout time.Duration, queueSize int) {
+	writeTimeout = timeout
+	outboundQueueSize = queueSize
+}
+
+// newOutboundQueue creates an empty outbound queue
+func newOutboundQueue() *outboundQueue {
+	return &outboundQueue{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// push queues a message, dropping low priority messages if the queue is full.
+// It reports whether low priority messages were dropped, and returns
+// errSlowConsumer if there was no room even after that.
+func (q *outboundQueue) push(m outboundMessage) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dropped := false
+	if len(q.pending) >= outboundQueueSize {
+		kept := q.pending[:0]
+		for _, queued := range q.pending {
+			if !queued.lowPriority {
+				kept = append(kept, queued)
+			}
+		}
+		dropped = len(kept) < len(q.pending)
+		q.pending = kept
+	}
+	if len(q.pending) >= outboundQueueSize {
+		if m.lowPriority {
+			return true, nil
+		}
+		return dropped, errSlowConsumer
+	}
+
+	q.pending = append(q.pending, m)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+// full reports whether the queue has no room left
+func (q *outboundQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) >= outboundQueueSize
+}
+
+// take removes and returns everything queued
+func (q *outboundQueue) take() []outboundMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := q.pending
+	q.pending = nil
+	return pending
+}
+
+// enqueueLocked queues a rendered message for the writer, with the ID of
+// the call it belongs to, if any, and the function to call if it can't be
+// written. The caller must hold u.mu, which keeps queue order identical to
+// seq order.
+func (u *UserSession) enqueueLocked(msg SignalingMessage, callID string, lowPriority bool, failed func(error)) error {
+	dropped, err := u.outbound.push(outboundMessage{msg: msg, callID: callID, lowPriority: lowPriority, failed: failed})
+	if dropped && u.presence != nil {
+		// The client missed user list updates; resync it once it catches up
+		u.presence.requestResync()
+	}
+	if err == errSlowConsumer {
+		go closeSlowConsumer(u, u.Conn, "outbound queue full")
+	}
+	return err
+}
+
+// startOutbound starts the session's writer goroutine
+func (u *UserSession) startOutbound(signalingLogger *log.Logger) {
+	u.service.registry.writers.Add(1)
+	go func() {
+		defer u.service.registry.writers.Done()
+		u.outboundWriter(signalingLogger)
+	}()
+}
+
+// outboundWriter writes queued messages to the session's current connection
+// until the session stops. It is the only goroutine that writes messages to
+// a joined user's connection.
+func (u *UserSession) outboundWriter(signalingLogger *log.Logger) {
+	q := u.outbound
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.wake:
+		}
+
+		batch := q.take()
+		for i, m := range batch {
+			u.mu.Lock()
+			conn := u.Conn
+			u.mu.Unlock()
+			// Detached sessions drop the queue; v2 clients get the
+			// unacknowledged messages replayed when they resume
+			if conn == nil {
+				failMessages(batch[i:], errSessionDetached)
+				break
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := conn.WriteMessage(m.msg)
+			if err == nil {
+				captureMessage("out", u.Name, m.callID, conn, m.msg)
+				recordEvent("out", m.callID, m.msg)
+				continue
+			}
+			var netErr interface{ Timeout() bool }
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				closeSlowConsumer(u, conn, "write timed out")
+				failMessages(batch[i:], errSlowConsumer)
+				return
+			}
+			// Forwarded messages log their failure themselves
+			if m.failed == nil {
+				signalingLogger.Printf("Error sending %s to %s: %v", m.msg.Type, RedactName(u.Name), err)
+			}
+			failMessages(batch[i:], err)
+			break
+		}
+		if u.presence != nil {
+			// Broadcasts skipped while the queue was full can go out now
+			u.presence.resume()
+		}
+	}
+}
+
+// failMessages tells the senders of messages that won't be written, see
+// delivery.go
+func failMessages(messages []outboundMessage, err error) {
+	for _, m := range messages {
+		if m.failed != nil {
+			m.failed(err)
+		}
+	}
+}
+
+// clearOutbound drops everything queued, used when the connection is lost
+func (u *UserSession) clearOutbound() {
+	if u.outbound != nil {
+		u.outbound.take()
+	}
+}
+
+// stopWriters stops the session's outbound and presence writers; they exit
+// once done with the write they are in (see Registry.Close). Safe to call
+// more than once.
+func (u *UserSession) stopWriters() {
+	if u.outbound != nil {
+		u.outbound.stopOnce.Do(func() {
+			close(u.outbound.done)
+		})
+	}
+	u.stopPresence()
+}
+
+// closeSlowConsumer disconnects a client that stopped reading its messages
+// and cleans up its session right away.
+func closeSlowConsumer(u *UserSession, conn Conn, reason string) {
+	if conn == nil {
+		return
+	}
+	u.logger.Printf("Disconnecting slow consumer %s (%s) with code %d: %s", RedactName(u.Name), describeConn(conn), CloseSlowConsumer, reason)
+	conn.CloseWithCode(CloseSlowConsumer, "slow consumer")
+	// Slow consumers don't get a resume grace window
+	u.service.HandleDisconnect(u.service.registry.ctx, conn)
+}
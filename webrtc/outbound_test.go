@@ -0,0 +1,104 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stalledConn is a client that stops reading once stalled: writes block
+// until the connection is closed
+type stalledConn struct {
+	stalled   atomic.Bool
+	closeOnce sync.Once
+	closed    chan struct{}
+	code      atomic.Int32
+}
+
+func newStalledConn() *stalledConn {
+	return &stalledConn{closed: make(chan struct{})}
+}
+
+func (c *stalledConn) ReadMessage(msg *SignalingMessage) error {
+	<-c.closed
+	return io.EOF
+}
+
+func (c *stalledConn) WriteMessage(msg SignalingMessage) error {
+	if c.stalled.Load() {
+		<-c.closed
+		return errors.New("connection closed")
+	}
+	return nil
+}
+
+func (c *stalledConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *stalledConn) CloseWithCode(code int, reason string) {
+	c.code.CompareAndSwap(0, int32(code))
+	c.Close()
+}
+
+func (c *stalledConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *stalledConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+}
+
+func (c *stalledConn) ClientIP() string { return "192.0.2.1" }
+
+// A client that stopped reading never blocks the senders, and is
+// disconnected as a slow consumer once its queue is full
+func TestStalledReaderDisconnected(t *testing.T) {
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	conn := newStalledConn()
+	s.HandleJoin(context.Background(), conn, SignalingMessage{Type: "join", Sender: "bob"})
+	s.registry.mu.RLock()
+	bob := s.registry.nameToUserSession["bob"]
+	s.registry.mu.RUnlock()
+	if bob == nil {
+		t.Fatal("bob didn't join")
+	}
+	conn.stalled.Store(true)
+
+	start := time.Now()
+	var err error
+	for i := 0; i <= outboundQueueSize+1 && err == nil; i++ {
+		err = bob.Send(context.Background(), SignalingMessage{Type: "candidate", Sender: "alice", Receiver: "bob"})
+	}
+	if err != errSlowConsumer {
+		t.Fatalf("sending past a full queue returned %v, want errSlowConsumer", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("queueing for a stalled reader took %s, want no blocking", elapsed)
+	}
+
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled reader still connected")
+	}
+	if code := conn.code.Load(); code != CloseSlowConsumer {
+		t.Fatalf("closed with %d, want %d", code, CloseSlowConsumer)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.registry.mu.RLock()
+		_, joined := s.registry.nameToUserSession["bob"]
+		s.registry.mu.RUnlock()
+		if !joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow consumer's session not cleaned up")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+WebRTC Signaling Payload Validation
+===================================
+
+This file checks the data of offer, answer and candidate messages, and of
+in-call controls (see callcontrol.go), before they are forwarded to the
+peer.
+
+WHY IS THIS NEEDED?
+===================
+The server used to forward whatever a client put in the data field, so a
+client could push an arbitrarily large or malformed "SDP" to its peer and
+leave it to the peer's browser to choke on it. The data now has to look like
+what RTCPeerConnection produces:
+
+- offer/answer: an RTCSessionDescription,
+  {"type":"offer","sdp":"v=0\r\n..."}. The type has to match the message
+  ("pranswer" is accepted for answers) and the SDP has to start with its
+  version line.
+- candidate: an RTCIceCandidate, {"candidate":"candidate:...","sdpMid":"0"}.
+  The candidate has to parse as an ICE candidate line (RFC 8839), or be
+  empty to mark the end of candidates.
+- muteState: an object.
+- callControl: an object whose "control" is a short name.
+
+LIMITS:
+=======
+The encoded data may be at most maxPayloadBytes (default 256 KB), or
+maxCallControlBytes (4 KB) for in-call controls. Every
+message is also bounded by maxMessageBytes (see limits.go), which applies
+first and by default leaves room for the largest payload. Browser SDPs for
+a dozen video tracks with simulcast run to 40-70 KB, more than the 64 KB
+message limit used to allow.
+
+REJECTIONS:
+===========
+Rejected messages are dropped, logged, counted (see stats.go) and answered
+with {"type":"error","error":"invalidPayload","data":{"error":"invalidPayload",
+"type":"offer","reason":"..."}}, where reason is payloadTooLarge, invalidSdp,
+invalidCandidate or invalidCallControl.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxPayloadBytes is the default limit on the encoded data of an
+// offer, answer or candidate message
+const DefaultMaxPayloadBytes = 256 * 1024
+
+// maxPayloadBytes is the current payload limit, set once at startup by
+// ConfigurePayloads; 0 disables it
+var maxPayloadBytes = DefaultMaxPayloadBytes
+
+// ConfigurePayloads sets the largest offer, answer or candidate data
+// forwarded in bytes; 0 disables the limit
+func ConfigurePayloads(maxBytes int) {
+	maxPayloadBytes = maxBytes
+}
+
+// payloadAllowed reports whether the data of a call message or in-call
+// control is valid.
+// Invalid messages are logged, counted and answered with an error.
+func (s *Service) payloadAllowed(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+	reason := validatePayload(msg)
+	if reason == "" {
+		return true
+	}
+
+	invalidPayloadCount.Add(1)
+	s.logger.Printf("Dropping %s from %s to %s: %s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), reason)
+	s.sendToConn(ctx, conn, SignalingMessage{
+		Type:     "error",
+		Receiver: msg.Sender,
+		Error:    "invalidPayload",
+		Data:     map[string]string{"error": "invalidPayload", "type": msg.Type, "reason": reason},
+	}, msg.Version)
+	return false
+}
+
+// validatePayload returns why the data of an offer, answer, candidate or
+// in-call control message is invalid, or "" if it is valid
+func validatePayload(msg SignalingMessage) string {
+	limit := maxPayloadBytes
+	if isCallControl(msg.Type) {
+		limit = maxCallControlBytes
+	}
+	if limit > 0 {
+		encoded, err := json.Marshal(msg.Data)
+		if err != nil || len(encoded) > limit {
+			return "payloadTooLarge"
+		}
+	}
+
+	data, _ := msg.Data.(map[string]interface{})
+	switch msg.Type {
+	case "offer", "answer":
+		descriptionType, _ := data["type"].(string)
+		sdp, _ := data["sdp"].(string)
+		typeMatches := descriptionType == msg.Type || (msg.Type == "answer" && descriptionType == "pranswer")
+		if !typeMatches || !strings.HasPrefix(sdp, "v=0") {
+			return "invalidSdp"
+		}
+	case "candidate":
+		candidate, ok := data["candidate"].(string)
+		if !ok || (candidate != "" && !isCandidateLine(candidate)) {
+			return "invalidCandidate"
+		}
+	case "muteState":
+		if data == nil {
+			return "invalidCallControl"
+		}
+	case "callControl":
+		control, _ := data["control"].(string)
+		if !isControlName(control) {
+			return "invalidCallControl"
+		}
+	}
+	return ""
+}
+
+// isCandidateLine reports whether a string is an ICE candidate attribute
+// as browsers produce it (RFC 8839, section 5.1):
+//
+//	candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> [...]
+//
+// The address isn't checked further, since it may be an mDNS name.
+func isCandidateLine(candidate string) bool {
+	candidate = strings.TrimPrefix(candidate, "a=")
+	fields, ok := strings.CutPrefix(candidate, "candidate:")
+	if !ok {
+		return false
+	}
+	parts := strings.Fields(fields)
+	if len(parts) < 8 || len(parts[0]) > 32 || parts[6] != "typ" {
+		return false
+	}
+	if component, err := strconv.Atoi(parts[1]); err != nil || component < 1 || component > 256 {
+		return false
+	}
+	switch strings.ToLower(parts[2]) {
+	case "udp", "tcp":
+	default:
+		return false
+	}
+	if _, err := strconv.ParseUint(parts[3], 10, 32); err != nil {
+		return false
+	}
+	if _, err := strconv.ParseUint(parts[5], 10, 16); err != nil {
+		return false
+	}
+	switch parts[7] {
+	case "host", "srflx", "prflx", "relay":
+		return true
+	}
+	return false
+}
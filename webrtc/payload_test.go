@@ -0,0 +1,222 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go-server/webrtc"
+
+	"github.com/gorilla/websocket"
+)
+
+// multiVideoOffer returns the Chrome offer with its video section repeated
+// for videos camera tracks sent with three simulcast layers each, as a
+// browser offers them to an SFU
+func multiVideoOffer(t *testing.T, videos int) string {
+	t.Helper()
+	lines := strings.Split(chromeOffer(t), "\r\n")
+	start, end := -1, -1
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "m=video"):
+			start = i
+		case strings.HasPrefix(line, "m=application"):
+			end = i
+		}
+	}
+	if start < 0 || end < start {
+		t.Fatal("no video section in the Chrome offer")
+	}
+
+	var sdp []string
+	mids := []string{"0"}
+	for _, line := range lines[:start] {
+		if strings.HasPrefix(line, "a=group:BUNDLE") {
+			continue
+		}
+		sdp = append(sdp, line)
+	}
+	for v := range videos {
+		mid := fmt.Sprintf("v%d", v)
+		mids = append(mids, mid)
+		replacer := strings.NewReplacer(
+			"a=mid:1", "a=mid:"+mid,
+			"c3d4e5f6a7b8", fmt.Sprintf("c3d4e5f6%04d", v),
+			"1931548420", strconv.Itoa(1931548420+2*v),
+			"3356120385", strconv.Itoa(3356120385+2*v),
+		)
+		for _, line := range lines[start:end] {
+			if strings.HasPrefix(line, "a=ssrc-group:") {
+				sdp = append(sdp, "a=rid:q send", "a=rid:h send", "a=rid:f send", "a=simulcast:send q;h;f")
+			}
+			sdp = append(sdp, replacer.Replace(line))
+		}
+	}
+	sdp = append(sdp, lines[end:]...)
+	// The BUNDLE group follows the timing line, listing every section
+	for i, line := range sdp {
+		if strings.HasPrefix(line, "t=") {
+			group := "a=group:BUNDLE " + strings.Join(append(mids, "2"), " ")
+			sdp = append(sdp[:i+1], append([]string{group}, sdp[i+1:]...)...)
+			break
+		}
+	}
+	return strings.Join(sdp, "\r\n")
+}
+
+// oversizedSDP is over the 256 KB payload limit but within the message
+// limit once encoded
+var oversizedSDP = "v=0\r\na=" + strings.Repeat("x", 260*1024)
+
+// payloadCall has alice call bob over raw connections and returns them
+// once the call is accepted, with its ID
+func payloadCall(t *testing.T, url string) (alice, bob *websocket.Conn, callID string) {
+	t.Helper()
+	alice = joinRaw(t, url, "alice")
+	bob = joinRaw(t, url, "bob")
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"})
+	callID = expectRaw(t, bob, "call").CallID
+	sendRaw(t, bob, webrtc.SignalingMessage{Type: "acceptCall", Sender: "bob", Receiver: "alice", CallID: callID})
+	expectRaw(t, alice, "acceptCall")
+	return alice, bob, callID
+}
+
+// An offer and answer for a gallery of thirty simulcast cameras, larger
+// than the old 64 KB message limit, are forwarded unchanged
+func TestPayloadMultiVideoOffer(t *testing.T) {
+	_, url := newTestServer(t)
+	alice, bob, callID := payloadCall(t, url)
+	sdp := multiVideoOffer(t, 30)
+	offer := describe("offer", sdp)
+	offer.CallID = callID
+	if encoded, _ := json.Marshal(offer); len(encoded) <= 64*1024 {
+		t.Fatalf("offer is %d bytes, want more than the old 64 KB limit", len(encoded))
+	}
+	sendRaw(t, alice, offer)
+	if got := sdpOf(t, expectNextOf(t, bob, "offer", "error")); got != sdp {
+		t.Fatalf("bob got a %d byte offer, want the %d bytes alice sent", len(got), len(sdp))
+	}
+	answer := describe("answer", sdp)
+	answer.Sender, answer.Receiver, answer.CallID = "bob", "alice", callID
+	sendRaw(t, bob, answer)
+	if got := sdpOf(t, expectNextOf(t, alice, "answer", "error")); got != sdp {
+		t.Fatalf("alice got a %d byte answer, want the %d bytes bob sent", len(got), len(sdp))
+	}
+}
+
+// What browsers send passes: pranswers, every candidate of the Chrome
+// offer, mDNS and end-of-candidates
+func TestPayloadAccepts(t *testing.T) {
+	_, url := newTestServer(t)
+	alice, bob, callID := payloadCall(t, url)
+	before := webrtc.Stats().InvalidData
+
+	messages := []webrtc.SignalingMessage{describe("offer", chromeOffer(t))}
+	pranswer := describe("answer", chromeOffer(t))
+	pranswer.Data = map[string]any{"type": "pranswer", "sdp": chromeOffer(t)}
+	messages = append(messages, pranswer)
+	candidates := []string{
+		"candidate:842163049 1 udp 1677729535 3f9a0c1e-7d2b-4c55-9a1e-5b8f0d2c6e41.local 54321 typ host generation 0 ufrag Qx7z network-cost 999",
+		"candidate:1 1 UDP 2130706431 192.0.2.1 5000 typ host",
+		"",
+	}
+	for _, line := range linesWith(chromeOffer(t), "a=candidate:") {
+		candidates = append(candidates, strings.TrimPrefix(line, "a="))
+	}
+	for _, candidate := range candidates {
+		messages = append(messages, webrtc.SignalingMessage{Type: "candidate", Data: map[string]any{"candidate": candidate, "sdpMid": "0", "sdpMLineIndex": 0}})
+	}
+
+	for _, msg := range messages {
+		msg.Sender, msg.Receiver, msg.CallID = "alice", "bob", callID
+		sendRaw(t, alice, msg)
+		expectNextOf(t, bob, msg.Type, "offer", "answer", "candidate")
+	}
+	if counted := webrtc.Stats().InvalidData - before; counted != 0 {
+		t.Fatalf("%d valid payloads rejected", counted)
+	}
+}
+
+// Offers, answers and candidates that don't look like what a browser sends,
+// or are too large, are answered with an error and never reach the peer
+func TestPayloadRejects(t *testing.T) {
+	_, url := newTestServer(t)
+	alice, bob, callID := payloadCall(t, url)
+	before := webrtc.Stats().InvalidData
+
+	candidate := func(line string) any { return map[string]any{"candidate": line, "sdpMid": "0", "sdpMLineIndex": 0} }
+	tests := []struct {
+		name    string
+		msgType string
+		data    any
+		reason  string
+	}{
+		{"offer without an SDP", "offer", map[string]any{"type": "offer"}, "invalidSdp"},
+		{"offer typed answer", "offer", map[string]any{"type": "answer", "sdp": testOffer["sdp"]}, "invalidSdp"},
+		{"answer typed offer", "answer", map[string]any{"type": "offer", "sdp": testOffer["sdp"]}, "invalidSdp"},
+		{"SDP without a version line", "offer", map[string]any{"type": "offer", "sdp": "o=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\n"}, "invalidSdp"},
+		{"SDP that isn't SDP", "answer", map[string]any{"type": "answer", "sdp": "<html>"}, "invalidSdp"},
+		{"oversized offer", "offer", map[string]any{"type": "offer", "sdp": oversizedSDP}, "payloadTooLarge"},
+		{"candidate without a line", "candidate", map[string]any{"sdpMid": "0"}, "invalidCandidate"},
+		{"candidate without a prefix", "candidate", candidate("1 1 udp 2130706431 192.0.2.1 5000 typ host"), "invalidCandidate"},
+		{"candidate missing its type", "candidate", candidate("candidate:1 1 udp 2130706431 192.0.2.1 5000"), "invalidCandidate"},
+		{"candidate of an unknown type", "candidate", candidate("candidate:1 1 udp 2130706431 192.0.2.1 5000 typ nat"), "invalidCandidate"},
+		{"candidate over SCTP", "candidate", candidate("candidate:1 1 sctp 2130706431 192.0.2.1 5000 typ host"), "invalidCandidate"},
+		{"candidate port out of range", "candidate", candidate("candidate:1 1 udp 2130706431 192.0.2.1 70000 typ host"), "invalidCandidate"},
+		{"candidate component 0", "candidate", candidate("candidate:1 0 udp 2130706431 192.0.2.1 5000 typ host"), "invalidCandidate"},
+		{"candidate priority not a number", "candidate", candidate("candidate:1 1 udp high 192.0.2.1 5000 typ host"), "invalidCandidate"},
+		{"candidate foundation too long", "candidate", candidate("candidate:" + strings.Repeat("f", 33) + " 1 udp 2130706431 192.0.2.1 5000 typ host"), "invalidCandidate"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sendRaw(t, alice, webrtc.SignalingMessage{Type: tc.msgType, Sender: "alice", Receiver: "bob", CallID: callID, Data: tc.data})
+			reply := expectRaw(t, alice, "error")
+			data, _ := reply.Data.(map[string]any)
+			if reply.Error != "invalidPayload" || data["type"] != tc.msgType || data["reason"] != tc.reason {
+				t.Fatalf("error %q %+v, want invalidPayload for %s with reason %s", reply.Error, reply.Data, tc.msgType, tc.reason)
+			}
+		})
+	}
+
+	if counted := webrtc.Stats().InvalidData - before; counted != uint64(len(tests)) {
+		t.Fatalf("%d rejections counted, want %d", counted, len(tests))
+	}
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "chat", Sender: "alice", Receiver: "bob", Data: map[string]any{"text": "still there?"}})
+	expectNextOf(t, bob, "chat", "offer", "answer", "candidate")
+}
+
+// The payload limit can be lowered, or turned off leaving only the message
+// limit
+func TestPayloadLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxBytes int
+		sdp      string
+		reason   string
+	}{
+		{"lowered", 2048, chromeOffer(t), "payloadTooLarge"},
+		{"off", 0, oversizedSDP, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			webrtc.ConfigurePayloads(tc.maxBytes)
+			t.Cleanup(func() { webrtc.ConfigurePayloads(webrtc.DefaultMaxPayloadBytes) })
+			_, url := newTestServer(t)
+			alice, bob, callID := payloadCall(t, url)
+
+			offer := describe("offer", tc.sdp)
+			offer.CallID = callID
+			sendRaw(t, alice, offer)
+			if tc.reason == "" {
+				expectNextOf(t, bob, "offer", "error")
+				return
+			}
+			reply := expectRaw(t, alice, "error")
+			if data, _ := reply.Data.(map[string]any); data["reason"] != tc.reason {
+				t.Fatalf("error %+v, want reason %s", reply.Data, tc.reason)
+			}
+		})
+	}
+}
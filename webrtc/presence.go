@@ -0,0 +1,196 @@
+/*
+WebRTC Signaling Presence Status
+================================
+
+This file implements user presence statuses on top of the InCall flag.
+
+WHY IS THIS NEEDED?
+===================
+InCall only says whether a user is busy right now. Users also want to appear
+"away", refuse calls entirely ("dnd"), or not show up in the user list at all
+("invisible") while still being able to call others.
+
+STATUSES:
+=========
+- available: The default. Listed and callable.
+- away: Listed with the away status, still callable.
+- dnd: Listed, but calls to the user fail with the reason "doNotDisturb".
+- invisible: Not listed in active users at all, but can still place calls.
+
+MESSAGE FORMAT:
+===============
+	{"type":"setStatus","sender":"alice","data":{"status":"dnd"}}
+
+The status is stored on the session and resets to available on every join.
+
+This file also builds the active users list itself, including paging for
+activeUsers requests.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Presence statuses a user can set
+const (
+	StatusAvailable = "available"
+	StatusAway      = "away"
+	StatusDND       = "dnd"
+	StatusInvisible = "invisible"
+)
+
+// isValidStatus reports whether status is one of the allowed presence statuses
+func isValidStatus(status string) bool {
+	switch status {
+	case StatusAvailable, StatusAway, StatusDND, StatusInvisible:
+		return true
+	}
+	return false
+}
+
+// SetStatus sets the user's presence status.
+func (u *UserSession) SetStatus(status string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Status = status
+}
+
+// HandleSetStatus changes the presence status of the user owning the connection
+//
+// STATUS PROCESS:
+// ===============
+// 1. Validate the requested status against the allowlist
+// 2. Store it on the sender's session
+// 3. Confirm the change to the sender
+// 4. Broadcast the updated user list to all clients
+func (s *Service) HandleSetStatus(ctx context.Context, conn Conn, msg SignalingMessage) {
+	sender := msg.Sender
+
+	var status string
+	if data, ok := msg.Data.(map[string]interface{}); ok {
+		status, _ = data["status"].(string)
+	}
+
+	// Users can only change their own status
+	s.registry.mu.RLock()
+	session, name, owned := s.registry.connSessionLocked(conn)
+	s.registry.mu.RUnlock()
+
+	if !owned || name != sender {
+		s.logger.Printf("Rejected status change from unknown sender %s", RedactName(sender))
+		return
+	}
+
+	if !isValidStatus(status) {
+		s.logger.Printf("Rejected invalid status %q from %s", status, RedactName(sender))
+		session.Send(ctx, SignalingMessage{
+			Type:     "setStatus",
+			Receiver: sender,
+			Data:     map[string]interface{}{"result": false, "error": "invalidStatus"},
+			Error:    "invalidStatus",
+		})
+		return
+	}
+
+	session.SetStatus(status)
+	s.logger.Printf("User %s set status to %s", RedactName(sender), status)
+
+	session.Send(ctx, SignalingMessage{
+		Type:     "setStatus",
+		Receiver: sender,
+		Data:     map[string]interface{}{"result": true, "status": status},
+	})
+	s.registry.Broadcast()
+}
+
+// listActiveUsersLocked builds the user list shown to clients, sorted by
+// name and leaving out invisible users. The caller must hold r.mu.
+func (r *Registry) listActiveUsersLocked() []ActiveUser {
+	activeUsers := make([]ActiveUser, 0, len(r.nameToUserSession))
+	for name, session := range r.nameToUserSession {
+		session.mu.Lock()
+		status, inCall := session.Status, session.InCall
+		connectedAt, lastActivity := session.ConnectedAt, session.LastActivity
+		metadata := session.Metadata
+		session.mu.Unlock()
+		if status == StatusInvisible {
+			continue
+		}
+		activeUsers = append(activeUsers, ActiveUser{
+			Name:         name,
+			InCall:       inCall,
+			Status:       status,
+			ConnectedAt:  formatActivityTime(connectedAt),
+			LastActivity: formatActivityTime(lastActivity),
+			Metadata:     metadata,
+			Guest:        session.Guest,
+		})
+	}
+	// A stable order keeps pages from overlapping between requests
+	sort.Slice(activeUsers, func(i, j int) bool {
+		return activeUsers[i].Name < activeUsers[j].Name
+	})
+	return activeUsers
+}
+
+// MaxActiveUsersPage is the largest page HandleActiveUsers sends, and the
+// page size used when a paged request doesn't give a limit
+const MaxActiveUsersPage = 200
+
+// pageRequest is the paging and filtering part of an activeUsers request
+type pageRequest struct {
+	offset int
+	limit  int
+	prefix string
+}
+
+// parsePageRequest reads offset, limit and prefix from the request data.
+// It reports false if none of them are present, meaning the client wants
+// the full list.
+func parsePageRequest(data interface{}) (pageRequest, bool) {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return pageRequest{}, false
+	}
+	offset, hasOffset := fields["offset"].(float64)
+	limit, hasLimit := fields["limit"].(float64)
+	prefix, hasPrefix := fields["prefix"].(string)
+	if !hasOffset && !hasLimit && !hasPrefix {
+		return pageRequest{}, false
+	}
+
+	page := pageRequest{offset: int(offset), limit: int(limit), prefix: prefix}
+	if page.offset < 0 {
+		page.offset = 0
+	}
+	if page.limit <= 0 || page.limit > MaxActiveUsersPage {
+		page.limit = MaxActiveUsersPage
+	}
+	return page, true
+}
+
+// apply filters the sorted user list by prefix and cuts out the requested page
+func (p pageRequest) apply(activeUsers []ActiveUser) ActiveUsersPage {
+	matching := activeUsers
+	if p.prefix != "" {
+		matching = make([]ActiveUser, 0, len(activeUsers))
+		for _, user := range activeUsers {
+			if strings.HasPrefix(user.Name, p.prefix) {
+				matching = append(matching, user)
+			}
+		}
+	}
+
+	start := min(p.offset, len(matching))
+	end := min(start+p.limit, len(matching))
+	return ActiveUsersPage{
+		Users:  matching[start:end],
+		Total:  len(matching),
+		Offset: start,
+		Limit:  p.limit,
+	}
+}
@@ -0,0 +1,76 @@
+package webrtc_test
+
+import (
+	"slices"
+	"testing"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+)
+
+// requestPage asks for one page of the user list and waits for it
+func requestPage(t *testing.T, c *client.Client, pages <-chan webrtc.ActiveUsersPage, offset, limit int, prefix string) webrtc.ActiveUsersPage {
+	t.Helper()
+	if err := c.RequestActiveUsersPage(offset, limit, prefix); err != nil {
+		t.Fatalf("request page: %v", err)
+	}
+	return receive(t, pages, "activeUsers page")
+}
+
+// Pages come sorted by name, so walking them lists every user once
+func TestActiveUsersPagesDontOverlap(t *testing.T) {
+	_, url := newTestServer(t)
+	// Joined out of order; the pages must not depend on it
+	names := []string{"erin", "bob", "alice", "dave", "carol", "al", "frank"}
+	clients := make([]*client.Client, len(names))
+	for i, name := range names {
+		clients[i] = dial(t, url, client.Options{Username: name})
+	}
+	pages := make(chan webrtc.ActiveUsersPage, 1)
+	clients[0].OnActiveUsersPage(func(page webrtc.ActiveUsersPage) { pages <- page })
+
+	var listed []string
+	for offset := 0; offset < len(names); offset += 3 {
+		page := requestPage(t, clients[0], pages, offset, 3, "")
+		if page.Total != len(names) || page.Offset != offset || page.Limit != 3 {
+			t.Fatalf("page at %d: total %d, offset %d, limit %d; want %d, %d, 3", offset, page.Total, page.Offset, page.Limit, len(names), offset)
+		}
+		for _, user := range page.Users {
+			listed = append(listed, user.Name)
+		}
+	}
+	want := slices.Sorted(slices.Values(names))
+	if !slices.Equal(listed, want) {
+		t.Fatalf("pages listed %v, want %v", listed, want)
+	}
+
+	page := requestPage(t, clients[0], pages, 0, 0, "al")
+	if page.Total != 2 || len(page.Users) != 2 || page.Users[0].Name != "al" || page.Users[1].Name != "alice" {
+		t.Fatalf("prefix al gave %+v, want al and alice of 2", page)
+	}
+	if page.Limit != webrtc.MaxActiveUsersPage {
+		t.Fatalf("limit 0 gave pages of %d, want the default %d", page.Limit, webrtc.MaxActiveUsersPage)
+	}
+}
+
+// Without paging fields the whole list is sent, sorted
+func TestActiveUsersFullList(t *testing.T) {
+	_, url := newTestServer(t)
+	bob := dial(t, url, client.Options{Username: "bob"})
+	dial(t, url, client.Options{Username: "alice"})
+	lists := make(chan []webrtc.ActiveUser, 16)
+	bob.OnActiveUsers(func(users []webrtc.ActiveUser) { lists <- users })
+	if err := bob.RequestActiveUsers(); err != nil {
+		t.Fatalf("request users: %v", err)
+	}
+	for {
+		users := receive(t, lists, "activeUsers")
+		if len(users) < 2 {
+			continue // A broadcast from before alice joined
+		}
+		if len(users) != 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+			t.Fatalf("got %+v, want alice and bob", users)
+		}
+		return
+	}
+}
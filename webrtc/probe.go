@@ -0,0 +1,224 @@
+/*
+WebRTC Signaling Connectivity Probe
+===================================
+
+This file serves GET /probe, which tells a client how the server sees its
+request, and POST /probe/turn, which tells it whether a TURN username and
+credential would authenticate.
+
+WHY IS THIS NEEDED?
+===================
+"It works on my network but not the customer's" can only be debugged with
+data from the customer's side: which address the server sees, whether a
+proxy or TLS-intercepting middlebox sits in between, how long a round trip
+takes, and whether the TURN credentials the app hands out are right. A
+support page or the app itself can fetch these and attach the answers to a
+bug report.
+
+HOW IT WORKS:
+=============
+GET /probe answers with a ProbeReport: the direct peer address, the client
+IP as worked out from trusted proxy headers (see proxy.go), HTTP or HTTPS
+with the TLS version and cipher suite, every proxy header present, and the
+server's time next to the client's own timestamp, passed as ?t=, echoed
+back so the client can measure the round trip.
+
+POST /probe/turn takes {"username": ..., "credential": ..., "realm": ...}
+(realm may be left out for the default one) and answers with
+{"authenticated": true} or false and a reason. The server checks the
+credentials the way the TURN auth handler would, through the function set
+by ConfigureProbe, without allocating anything, counting an authentication
+failure or writing the audit log. Unknown users and wrong credentials give
+the same reason, so the probe can't be used to list usernames.
+
+Both are limited per client IP to probeRate requests a minute (429 beyond)
+and every probe is logged to the signaling log, without the credential.
+*/
+
+package webrtc
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultProbeRate is how many probes a client IP may make per minute
+const DefaultProbeRate = 10
+
+// TURNProbeFunc reports whether a TURN username and credential would
+// authenticate in realm ("" for the default realm), and if not, why
+type TURNProbeFunc func(username, credential, realm, clientIP string) (ok bool, reason string)
+
+var (
+	// Probe settings, set once at startup by ConfigureProbe
+	probeEnabled = true
+	probeRate    = float64(DefaultProbeRate)
+	turnProbe    TURNProbeFunc
+
+	// Per client IP probe limiters, forgotten once idle for a minute
+	probeLimiters      = make(map[string]*tokenBucket)
+	probeLimitersSwept time.Time
+	probeLimitersMu    sync.Mutex
+)
+
+// ConfigureProbe enables or disables the probe endpoints, sets how many
+// probes a client IP may make per minute (0 is unlimited) and the function
+// TURN credentials are checked with (nil answers that TURN isn't served)
+func ConfigureProbe(enabled bool, perMinute float64, turnCheck TURNProbeFunc) {
+	probeEnabled = enabled
+	probeRate = perMinute
+	turnProbe = turnCheck
+}
+
+// ProbeReport is the GET /probe document
+type ProbeReport struct {
+	RemoteAddr   string            `json:"remoteAddr"`   // Direct peer, ip:port
+	ClientIP     string            `json:"clientIP"`     // As worked out from trusted proxy headers
+	TrustedProxy bool              `json:"trustedProxy"` // Whether the direct peer is in -trusted-proxies
+	Scheme       string            `json:"scheme"`       // http or https
+	Protocol     string            `json:"protocol"`     // HTTP/1.1, HTTP/2.0, ...
+	TLS          *ProbeTLS         `json:"tls,omitempty"`
+	ProxyHeaders map[string]string `json:"proxyHeaders,omitempty"` // Forwarding headers present, trusted or not
+	UserAgent    string            `json:"userAgent,omitempty"`
+	ServerTime   time.Time         `json:"serverTime"`
+	Echo         string            `json:"echo,omitempty"` // The client's ?t=, unchanged
+}
+
+// ProbeTLS describes the TLS connection a probe came over
+type ProbeTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	ServerName  string `json:"serverName,omitempty"` // SNI
+	ALPN        string `json:"alpn,omitempty"`
+}
+
+// probeProxyHeaders are the headers reported as proxy headers
+var probeProxyHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP", "Via"}
+
+// turnProbeRequest is the POST /probe/turn body
+type turnProbeRequest struct {
+	Username   string `json:"username"`
+	Credential string `json:"credential"`
+	Realm      string `json:"realm"`
+}
+
+// turnProbeResult is the POST /probe/turn answer
+type turnProbeResult struct {
+	Authenticated bool   `json:"authenticated"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// HandleProbe serves GET /probe
+func (s *Service) HandleProbe(w http.ResponseWriter, r *http.Request) {
+	clientIP, ok := s.admitProbe(w, r)
+	if !ok {
+		return
+	}
+	report := ProbeReport{
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   clientIP,
+		Scheme:     "http",
+		Protocol:   r.Proto,
+		UserAgent:  r.UserAgent(),
+		ServerTime: time.Now(),
+		Echo:       r.URL.Query().Get("t"),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			report.TrustedProxy = isTrustedProxy(ip)
+		}
+	}
+	if r.TLS != nil {
+		report.Scheme = "https"
+		report.TLS = &ProbeTLS{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+			ALPN:        r.TLS.NegotiatedProtocol,
+		}
+	}
+	for _, header := range probeProxyHeaders {
+		if value := r.Header.Get(header); value != "" {
+			if report.ProxyHeaders == nil {
+				report.ProxyHeaders = make(map[string]string)
+			}
+			report.ProxyHeaders[header] = value
+		}
+	}
+	s.logger.Printf("Probe from %s (via %s, %s)", clientIP, r.RemoteAddr, report.Scheme)
+	writeProbeJSON(w, http.StatusOK, report)
+}
+
+// HandleTURNProbe serves POST /probe/turn
+func (s *Service) HandleTURNProbe(w http.ResponseWriter, r *http.Request) {
+	clientIP, ok := s.admitProbe(w, r)
+	if !ok {
+		return
+	}
+	var request turnProbeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil || request.Username == "" {
+		http.Error(w, `want {"username": ..., "credential": ..., "realm": ...}`, http.StatusBadRequest)
+		return
+	}
+	result := turnProbeResult{Reason: "TURN is not served here"}
+	if turnProbe != nil {
+		result.Authenticated, result.Reason = turnProbe(request.Username, request.Credential, request.Realm, clientIP)
+	}
+	outcome := "authenticated"
+	if !result.Authenticated {
+		outcome = "refused, " + result.Reason
+	}
+	s.logger.Printf("TURN credential probe for user %s (realm %q) from %s: %s", RedactName(request.Username), request.Realm, clientIP, outcome)
+	writeProbeJSON(w, http.StatusOK, result)
+}
+
+// admitProbe checks that probes are enabled and the client IP is within
+// its probe rate, answering the request if not
+func (s *Service) admitProbe(w http.ResponseWriter, r *http.Request) (clientIP string, ok bool) {
+	if !probeEnabled {
+		http.NotFound(w, r)
+		return "", false
+	}
+	clientIP = requestClientIP(r)
+	if !allowProbe(clientIP, time.Now()) {
+		s.logger.Printf("Probe from %s refused: more than %g probes a minute", clientIP, probeRate)
+		http.Error(w, "too many probes", http.StatusTooManyRequests)
+		return "", false
+	}
+	return clientIP, true
+}
+
+// allowProbe takes a token from a client IP's probe limiter
+func allowProbe(clientIP string, now time.Time) bool {
+	if probeRate <= 0 {
+		return true
+	}
+	probeLimitersMu.Lock()
+	defer probeLimitersMu.Unlock()
+	if now.Sub(probeLimitersSwept) >= time.Minute {
+		for ip, bucket := range probeLimiters {
+			if now.Sub(bucket.last) >= time.Minute {
+				delete(probeLimiters, ip)
+			}
+		}
+		probeLimitersSwept = now
+	}
+	bucket, ok := probeLimiters[clientIP]
+	if !ok {
+		bucket = &tokenBucket{}
+		probeLimiters[clientIP] = bucket
+	}
+	return bucket.allow(probeRate/60, probeRate, now)
+}
+
+// writeProbeJSON writes a probe answer, which must never be cached
+func writeProbeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
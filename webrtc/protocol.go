@@ -0,0 +1,131 @@
+/*
+WebRTC Signaling Protocol Versions
+==================================
+
+This file implements protocol version negotiation and the translation layer
+that renders outgoing messages in the shape each client understands.
+
+WHY VERSIONS?
+=============
+Deployed mobile apps speak today's message format and cannot be updated
+overnight. To evolve the schema (rooms, error reasons, sequence numbers)
+without breaking them, every connection negotiates a protocol version and
+the server renders messages for that version only.
+
+SUPPORTED VERSIONS:
+===================
+- v1: The original format. Messages carry exactly type, sender, receiver
+  and data. This is the default when the client doesn't ask for anything.
+- v2: Adds an "error" reason on failures, a per-session "seq" counter on
+  every message sent by the server, and a "room" field.
+
+NEGOTIATION:
+============
+A client selects a version either:
+1. On the WebSocket upgrade URL: /signal?v=2
+2. With a "version" field in its join message: {"type":"join","version":2,...}
+
+The join field wins if both are present. Unknown versions are refused with
+an error message followed by a close frame with code 1002 (protocol error).
+
+INTEROPERABILITY:
+=================
+Versions are per connection, so a v1 client and a v2 client can call each
+other through the same server: every message is rendered for its receiver.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// Supported signaling protocol versions
+const (
+	ProtocolV1 = 1 // Original message format
+	ProtocolV2 = 2 // Adds error, seq and room fields
+
+	// DefaultProtocolVersion is used when the client doesn't negotiate one
+	DefaultProtocolVersion = ProtocolV1
+)
+
+// isSupportedVersion reports whether the server can speak the given version
+func isSupportedVersion(version int) bool {
+	return version == ProtocolV1 || version == ProtocolV2
+}
+
+// parseVersionParam parses the "v" query parameter of the upgrade request.
+// An empty value selects the default version.
+func parseVersionParam(value string) (int, error) {
+	if value == "" {
+		return DefaultProtocolVersion, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol version %q", value)
+	}
+	if !isSupportedVersion(version) {
+		return 0, fmt.Errorf("unsupported protocol version %d", version)
+	}
+	return version, nil
+}
+
+// renderMessage translates an outgoing message into the shape expected by
+// a client speaking the given protocol version.
+//
+// v1 clients get exactly the original four fields; every v2-only field is
+// cleared so it is omitted from the JSON, including the presence timestamps,
+// metadata and guest marks of user lists. v2 clients get the message as-is with the given sequence
+// number.
+func renderMessage(msg SignalingMessage, version int, seq uint64) SignalingMessage {
+	if version < ProtocolV2 {
+		return SignalingMessage{
+			Type:     msg.Type,
+			Sender:   msg.Sender,
+			Receiver: msg.Receiver,
+			Data:     renderV1Data(msg.Data),
+		}
+	}
+	msg.Seq = seq
+	return msg
+}
+
+// renderV1Data strips the v2-only fields from user lists
+func renderV1Data(data interface{}) interface{} {
+	switch list := data.(type) {
+	case ActiveUsers:
+		return ActiveUsers{Users: withoutV2Fields(list.Users)}
+	case ActiveUsersPage:
+		list.Users = withoutV2Fields(list.Users)
+		return list
+	}
+	return data
+}
+
+// withoutV2Fields copies a user list without presence timestamps, metadata
+// and guest marks
+func withoutV2Fields(users []ActiveUser) []ActiveUser {
+	stripped := make([]ActiveUser, len(users))
+	for i, user := range users {
+		user.ConnectedAt, user.LastActivity = "", ""
+		user.Metadata = nil
+		user.Guest = false
+		stripped[i] = user
+	}
+	return stripped
+}
+
+// rejectVersion tells the client that its protocol version is not supported
+// and closes the connection with a protocol error close frame.
+func (s *Service) rejectVersion(ctx context.Context, conn Conn, reason string) {
+	s.sendToConn(ctx, conn, SignalingMessage{
+		Type:  "error",
+		Error: "unsupportedVersion",
+		Data:  map[string]interface{}{"error": reason, "supported": []int{ProtocolV1, ProtocolV2}},
+	}, ProtocolV2)
+	s.closeConn(conn, websocket.CloseProtocolError, reason)
+}
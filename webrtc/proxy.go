@@ -0,0 +1,153 @@
+/*
+WebRTC Signaling Behind Reverse Proxies
+=======================================
+
+This file works out the real client IP of a signaling connection when the
+server sits behind a reverse proxy or load balancer (nginx, AWS ALB, ...).
+
+WHY IS THIS NEEDED?
+===================
+Behind a proxy every connection comes from the proxy's address, so logs
+can't tell clients apart and abuse can't be traced to anyone. Proxies pass
+the original address in the X-Forwarded-For or X-Real-IP header.
+
+TRUST:
+======
+Anyone can send those headers, so they are only believed when the direct
+peer is a trusted proxy (-trusted-proxies). From untrusted peers they are
+ignored and the peer address is the client IP.
+
+X-FORWARDED-FOR CHAINS:
+=======================
+Each proxy appends the address it received the request from, so a chain
+like "client, proxy1, proxy2" is read from the right: trusted proxies are
+skipped and the first untrusted address is the client. Addresses to the
+left of it were supplied by the client itself and can't be believed.
+If X-Forwarded-For is absent, X-Real-IP is used.
+*/
+
+package webrtc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks whose forwarding headers are believed,
+// set once at startup by ConfigureTrustedProxies
+var trustedProxies []*net.IPNet
+
+// ConfigureTrustedProxies sets the proxies allowed to report client IPs,
+// as a comma-separated list of CIDRs or single IPs (e.g. "10.0.0.0/8,::1").
+// An empty list trusts no one.
+func ConfigureTrustedProxies(list string) error {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestClientIP returns the client IP of an HTTP request
+func requestClientIP(r *http.Request) string {
+	return clientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"), r.Header.Get("X-Real-IP"))
+}
+
+// clientIP works out the client IP from the direct peer address and the
+// forwarding headers, which are only used if the peer is a trusted proxy.
+func clientIP(peerAddr string, forwardedFor []string, realIP string) string {
+	peerHost := peerAddr
+	if host, _, err := net.SplitHostPort(peerAddr); err == nil {
+		peerHost = host
+	}
+	peer := net.ParseIP(peerHost)
+	if peer == nil || !isTrustedProxy(peer) {
+		return peerHost
+	}
+
+	if ip := parseForwardedFor(forwardedFor); ip != nil {
+		return ip.String()
+	}
+	if ip := net.ParseIP(strings.TrimSpace(realIP)); ip != nil {
+		return ip.String()
+	}
+	return peerHost
+}
+
+// parseForwardedFor returns the rightmost untrusted address of an
+// X-Forwarded-For chain, which may be split across several headers. If
+// every hop is trusted the leftmost one is the client. A malformed hop ends
+// the walk, since nothing left of it can be trusted either.
+func parseForwardedFor(headers []string) net.IP {
+	var hops []string
+	for _, header := range headers {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseHop parses one X-Forwarded-For entry, which some proxies write with
+// a port ("1.2.3.4:5678", "[2001:db8::1]:443")
+func parseHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(hop)
+}
+
+// describeConn labels a connection in logs with its client IP and, when
+// they differ, the address it actually connected from
+func describeConn(conn Conn) string {
+	addr := conn.RemoteAddr().String()
+	ip := conn.ClientIP()
+	if host, _, err := net.SplitHostPort(addr); err == nil && host == ip {
+		return addr
+	}
+	return fmt.Sprintf("%s (via %s)", ip, addr)
+}
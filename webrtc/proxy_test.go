@@ -0,0 +1,48 @@
+package webrtc
+
+import "testing"
+
+func TestClientIP(t *testing.T) {
+	if err := ConfigureTrustedProxies("10.0.0.0/8, 192.0.2.1, ::1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ConfigureTrustedProxies("") })
+
+	tests := []struct {
+		name         string
+		peer         string
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{"direct client", "203.0.113.5:1234", nil, "", "203.0.113.5"},
+		{"untrusted peer's headers ignored", "203.0.113.5:1234", []string{"198.51.100.7"}, "198.51.100.8", "203.0.113.5"},
+		{"single hop", "10.0.0.2:80", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"multi-hop, trusted hops skipped", "10.0.0.2:80", []string{"198.51.100.7, 10.1.1.1, 10.2.2.2"}, "", "198.51.100.7"},
+		{"spoofed hop left of the client", "10.0.0.2:80", []string{"1.1.1.1, 198.51.100.7, 10.1.1.1"}, "", "198.51.100.7"},
+		{"chain split across headers", "10.0.0.2:80", []string{"198.51.100.7", "192.0.2.1"}, "", "198.51.100.7"},
+		{"hops with ports", "10.0.0.2:80", []string{"[2001:db8::7]:443, 10.1.1.1:80"}, "", "2001:db8::7"},
+		{"every hop trusted", "10.0.0.2:80", []string{"10.3.3.3, 10.1.1.1"}, "", "10.3.3.3"},
+		{"malformed hop ends the walk", "10.0.0.2:80", []string{"198.51.100.7, garbage, 10.1.1.1"}, "", "10.1.1.1"},
+		{"X-Real-IP without X-Forwarded-For", "10.0.0.2:80", nil, " 198.51.100.9 ", "198.51.100.9"},
+		{"X-Forwarded-For wins over X-Real-IP", "10.0.0.2:80", []string{"198.51.100.7"}, "198.51.100.9", "198.51.100.7"},
+		{"unparseable headers fall back to the peer", "10.0.0.2:80", []string{"garbage"}, "also garbage", "10.0.0.2"},
+		{"trusted IPv6 peer", "[::1]:80", []string{"2001:db8::1"}, "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientIP(tt.peer, tt.forwardedFor, tt.realIP); got != tt.want {
+				t.Fatalf("clientIP(%q, %q, %q) = %q, want %q", tt.peer, tt.forwardedFor, tt.realIP, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureTrustedProxiesRejectsInvalid(t *testing.T) {
+	t.Cleanup(func() { ConfigureTrustedProxies("") })
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1,,bad/8"} {
+		if err := ConfigureTrustedProxies(list); err == nil {
+			t.Errorf("ConfigureTrustedProxies(%q) accepted an invalid list", list)
+		}
+	}
+}
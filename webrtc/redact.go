@@ -0,0 +1,174 @@
+/*
+Log Redaction
+=============
+
+This file keeps credentials, and optionally personal data, out of the
+STUN/TURN and signaling logs.
+
+WHY IS THIS NEEDED?
+===================
+Logs are shipped to remote collectors, attached to tickets and read by
+people who should never see a user's ICE credentials. Usernames are
+personal data in some deployments, and so are the addresses in the
+candidates of an SDP.
+
+LEVELS (-log-redact):
+=====================
+- none: everything is logged as it is
+- credentials (default): the values of ICE ufrag and pwd lines
+  (a=ice-ufrag:, a=ice-pwd:) are replaced with "[redacted]" wherever they
+  appear in a log line, e.g. in an SDP or a message dump.
+- pii: as credentials, and usernames are replaced with a stable short
+  token, "user-" and 8 hex digits of their SHA-256, so the lines of one
+  user can still be followed; the addresses in candidates (a=candidate:,
+  raddr) and SDP connection and origin lines (c=, o=) are replaced too.
+
+HOW IT WORKS:
+=============
+NewRedactingWriter wraps the output of both loggers, so SDP fragments are
+caught whatever logged them; a RedactingWriter can also be given its own
+Level. The TURN passwords are registered with
+AddSecret at startup and replaced with "[redacted]" at every level, none
+included, wherever they appear. Usernames can't be recognised in free text,
+so the log lines that name users pass them through RedactName. The audit
+log is written separately and always keeps the usernames; it is the
+record of who did what.
+*/
+
+package webrtc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// Redaction levels for -log-redact
+const (
+	RedactNone        = "none"
+	RedactCredentials = "credentials"
+	RedactPII         = "pii"
+)
+
+// redactLevel is the current redaction level, set once at startup by
+// ConfigureRedaction
+var redactLevel = RedactCredentials
+
+// ConfigureRedaction sets what is redacted from the logs: RedactNone,
+// RedactCredentials or RedactPII
+func ConfigureRedaction(level string) error {
+	switch level {
+	case RedactNone, RedactCredentials, RedactPII:
+		redactLevel = level
+		return nil
+	}
+	return fmt.Errorf("unknown redaction level %q, expected %q, %q or %q", level, RedactNone, RedactCredentials, RedactPII)
+}
+
+var (
+	// iceCredential matches the value of an ICE ufrag or pwd line, up to
+	// the end of the line, including a JSON-escaped \r\n
+	iceCredential = regexp.MustCompile(`(a=ice-(?:ufrag|pwd):)[^\s"\\]+`)
+	// candidateAddress matches the address of a candidate (RFC 8839:
+	// foundation, component, transport, priority, address) and of its raddr
+	candidateAddress = regexp.MustCompile(`(candidate:\S+ \d+ \S+ \d+ )\S+|(raddr )\S+`)
+	// connectionAddress matches the address of an SDP connection or origin
+	// line
+	connectionAddress = regexp.MustCompile(`((?:c=|o=\S+ \d+ \d+ )IN IP[46] )[^\s"\\]+`)
+)
+
+var (
+	// secrets are the values AddSecret registered, replaced in every log
+	// line whatever the level
+	secrets   [][]byte
+	secretsMu sync.RWMutex
+)
+
+// AddSecret registers a value, such as a TURN password, that must never
+// reach a log line at any level
+func AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMu.Lock()
+	secrets = append(secrets, []byte(secret))
+	secretsMu.Unlock()
+}
+
+// redactSecrets replaces the registered secrets in a piece of log text
+func redactSecrets(text []byte) []byte {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		if bytes.Contains(text, secret) {
+			text = bytes.ReplaceAll(text, secret, []byte("[redacted]"))
+		}
+	}
+	return text
+}
+
+// RedactName returns a username as it may be logged: unchanged, or a
+// stable short token at the pii level
+func RedactName(name string) string {
+	if redactLevel != RedactPII || name == "" {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "user-" + hex.EncodeToString(sum[:4])
+}
+
+// RedactText redacts the registered secrets, the ICE credentials and, at
+// the pii level, the addresses of any SDP in a piece of log text
+func RedactText(text []byte) []byte {
+	return redactText(text, redactLevel)
+}
+
+// redactText is RedactText at a given level
+func redactText(text []byte, level string) []byte {
+	text = redactSecrets(text)
+	if level == RedactNone {
+		return text
+	}
+	if bytes.Contains(text, []byte("a=ice-")) {
+		text = iceCredential.ReplaceAll(text, []byte("${1}[redacted]"))
+	}
+	if level == RedactPII {
+		if bytes.Contains(text, []byte("candidate:")) {
+			text = candidateAddress.ReplaceAll(text, []byte("${1}${2}[redacted]"))
+		}
+		if bytes.Contains(text, []byte("IN IP")) {
+			text = connectionAddress.ReplaceAll(text, []byte("${1}[redacted]"))
+		}
+	}
+	return text
+}
+
+// RedactingWriter redacts every line written to it, see RedactText
+type RedactingWriter struct {
+	Out io.Writer
+	// Level is the redaction level of the lines; empty follows the level
+	// set by ConfigureRedaction
+	Level string
+}
+
+// NewRedactingWriter wraps a log output so every line written to it is
+// redacted at the level set by ConfigureRedaction
+func NewRedactingWriter(out io.Writer) *RedactingWriter {
+	return &RedactingWriter{Out: out}
+}
+
+func (w *RedactingWriter) Write(p []byte) (int, error) {
+	level := w.Level
+	if level == "" {
+		level = redactLevel
+	}
+	if _, err := w.Out.Write(redactText(p, level)); err != nil {
+		return 0, err
+	}
+	// The caller's line was written, however long the redacted one is
+	return len(p), nil
+}
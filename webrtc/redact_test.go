@@ -0,0 +1,91 @@
+package webrtc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Registered secrets are redacted from every line a redacting writer gets.
+// RedactText removes them before it looks at the level, so this holds at
+// none too; the level isn't switched here because the sessions of other
+// tests may still be logging.
+func TestSecretsRedacted(t *testing.T) {
+	AddSecret("hunter2-turn")
+	t.Cleanup(func() {
+		secretsMu.Lock()
+		secrets = nil
+		secretsMu.Unlock()
+	})
+
+	var out bytes.Buffer
+	line := "Auth for alice with hunter2-turn, again hunter2-turn\n"
+	n, err := NewRedactingWriter(&out).Write([]byte(line))
+	if err != nil || n != len(line) {
+		t.Fatalf("wrote %d, %v; want %d, nil", n, err, len(line))
+	}
+	if want := "Auth for alice with [redacted], again [redacted]\n"; out.String() != want {
+		t.Fatalf("logged %q, want %q", out.String(), want)
+	}
+	if got := redactSecrets([]byte("no secret here")); string(got) != "no secret here" {
+		t.Fatalf("redactSecrets changed a line without secrets to %q", got)
+	}
+}
+
+// Each level redacts what it promises from an SDP offer dump, without
+// touching the configured level the loggers of other tests follow
+func TestRedactingWriterLevels(t *testing.T) {
+	offer := `offer from alice: {"type":"offer","sdp":"v=0\r\n` +
+		`o=- 4611731400430051336 2 IN IP4 192.0.2.10\r\n` +
+		`c=IN IP4 192.0.2.10\r\n` +
+		`a=ice-ufrag:F7gI\r\n` +
+		`a=ice-pwd:x9cml/YzichV2+XlhiMu8g\r\n` +
+		`a=candidate:842163049 1 udp 1677729535 198.51.100.7 46154 typ srflx raddr 10.0.0.5 rport 46154\r\n"}` + "\n"
+	credentials := []string{"F7gI", "x9cml/YzichV2+XlhiMu8g"}
+	addresses := []string{"192.0.2.10", "198.51.100.7", "10.0.0.5"}
+
+	tests := []struct {
+		level           string
+		keepCredentials bool
+		keepAddresses   bool
+	}{
+		{RedactNone, true, true},
+		{RedactCredentials, false, true},
+		{RedactPII, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var out bytes.Buffer
+			w := &RedactingWriter{Out: &out, Level: tt.level}
+			if n, err := w.Write([]byte(offer)); err != nil || n != len(offer) {
+				t.Fatalf("wrote %d, %v; want %d, nil", n, err, len(offer))
+			}
+			logged := out.String()
+			for _, value := range credentials {
+				if strings.Contains(logged, value) != tt.keepCredentials {
+					t.Errorf("credential %q kept %t, want %t: %s", value, !tt.keepCredentials, tt.keepCredentials, logged)
+				}
+			}
+			for _, value := range addresses {
+				if strings.Contains(logged, value) != tt.keepAddresses {
+					t.Errorf("address %q kept %t, want %t: %s", value, !tt.keepAddresses, tt.keepAddresses, logged)
+				}
+			}
+			if !tt.keepCredentials && !strings.Contains(logged, `a=ice-ufrag:[redacted]\r\na=ice-pwd:[redacted]\r\n`) {
+				t.Errorf("credential lines not redacted in place: %s", logged)
+			}
+			if !strings.Contains(logged, "typ srflx") || !strings.HasSuffix(logged, "\"}\n") {
+				t.Errorf("redaction cut into the rest of the line: %s", logged)
+			}
+		})
+	}
+}
+
+func TestConfigureRedactionUnknown(t *testing.T) {
+	if err := ConfigureRedaction("all"); err == nil {
+		t.Fatal("unknown redaction level accepted")
+	}
+	if redactLevel != RedactCredentials {
+		t.Fatalf("level changed to %q by a rejected value", redactLevel)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+WebRTC Signaling Session Registry
+=================================
+
+This file implements the Registry, which holds every piece of signaling
+state that is keyed by username: the joined sessions, the connections they
+use, the last user list broadcast, undelivered chat messages, missed calls
+and kick cooldowns. It also records the calls, by call ID: who called whom
+and whether it has been accepted yet. A server hosting several tenants has
+one registry per tenant (see tenants.go).
+
+WHY IS THIS NEEDED?
+===================
+This state used to live in package variables, so every handler in the
+process shared one set of users: two signaling services mounted on the same
+server saw each other's users, and a registry couldn't be created fresh for
+a test. Each Service now works on the Registry it was created with (see
+service.go); the package-level functions use a default one (see compat.go).
+
+Some state is still process-wide on purpose: retained outboxes are keyed by
+unguessable session tokens, SSE sessions by random IDs, and captures are
+started by an admin for a username across all services.
+
+LOCKING:
+========
+Lock order is mu, then a session's mu, then the queue mutexes. The
+exported methods take mu themselves; handlers that need several steps to be
+atomic (join, call, resume, kick) hold mu and use the fields directly.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registry holds the signaling sessions of one Service and the state that
+// goes with their usernames. The zero value is not usable; use NewRegistry.
+type Registry struct {
+	// Maps username to user session for quick lookups
+	nameToUserSession map[string]*UserSession
+	// Maps connection address to username for reverse lookups
+	sessionIdToName map[string]string
+	// Calls from the moment they ring until they end, keyed by call ID
+	// (see callid.go); guarded by mu
+	calls map[string]*activeCall
+	// Transfers ringing their target, keyed by target (see transfer.go);
+	// guarded by mu
+	transfers map[string]*callTransfer
+	// Read-write mutex for thread-safe access to session data
+	mu sync.RWMutex
+
+	// Last user list broadcast, used to compute deltas (see broadcast.go)
+	lastBroadcast   map[string]ActiveUser
+	lastBroadcastMu sync.Mutex
+
+	// Jobs for the broadcast worker, started on first use and stopped by
+	// Close, and its goroutines, the worker and the fan-out pool
+	broadcastJobs   chan broadcastJob
+	broadcasterOnce sync.Once
+	broadcasters    sync.WaitGroup
+	// Signaling log of the first service of the registry, for the
+	// broadcaster's timings; set by NewService
+	logger *log.Logger
+
+	// Started by the first connection and stopped by Close (see heartbeat.go)
+	reaperOnce sync.Once
+	reaper     sync.WaitGroup
+
+	// Outbound and presence writers of the sessions, removed ones
+	// included, until they have exited (see outbound.go)
+	writers sync.WaitGroup
+
+	// Undelivered chat messages keyed by receiver, then by sender (see chat.go)
+	pendingChats   map[string]map[string][]pendingChat
+	pendingChatsMu sync.Mutex
+
+	// Missed calls keyed by callee, oldest first, and how many there are
+	// in total (see missedcalls.go)
+	missedCalls     map[string][]missedCall
+	missedCallCount int
+	missedCallsMu   sync.Mutex
+
+	// Kicked usernames and the end of their cooldown (see kick.go)
+	kickedUntil   map[string]time.Time
+	kickedUntilMu sync.Mutex
+
+	// Connections being served, joined or not, so Shutdown can close them,
+	// with the cancel functions of their contexts (see context.go), and
+	// the serveConn calls still running for them
+	conns        map[Conn]context.CancelFunc
+	shuttingDown bool
+	connsMu      sync.Mutex
+	served       sync.WaitGroup
+
+	// Root context of the registry's connections, cancelled by Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Tenant the registry serves and its limits, fixed at creation (see
+	// tenants.go); the default tenant is "" and unlimited
+	tenant string
+	limits TenantLimits
+
+	// Per-user call rate limiters by username and when the idle ones were
+	// last forgotten, guarded by mu (see calllimits.go)
+	callAttempts      map[string]*tokenBucket
+	ringsReceived     map[string]*tokenBucket
+	callLimitersSwept time.Time
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Registry{
+		nameToUserSession: make(map[string]*UserSession),
+		sessionIdToName:   make(map[string]string),
+		calls:             make(map[string]*activeCall),
+		transfers:         make(map[string]*callTransfer),
+		lastBroadcast:     make(map[string]ActiveUser),
+		broadcastJobs:     make(chan broadcastJob, 64),
+		pendingChats:      make(map[string]map[string][]pendingChat),
+		missedCalls:       make(map[string][]missedCall),
+		kickedUntil:       make(map[string]time.Time),
+		callAttempts:      make(map[string]*tokenBucket),
+		ringsReceived:     make(map[string]*tokenBucket),
+		conns:             make(map[Conn]context.CancelFunc),
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+}
+
+// Close cancels the registry's root context, stops its broadcaster and
+// stale session reaper, and the writers of the sessions still in it and
+// their resume grace timers, and waits for all of their goroutines to
+// exit, the writers of sessions removed earlier included. A writer in the
+// middle of a write is waited for, at most the write timeout. Broadcasts after Close are dropped. It doesn't close the
+// connections; Service.Shutdown does that and then calls Close. Safe to
+// call more than once.
+func (r *Registry) Close() {
+	r.cancel()
+	// Neither may start now if it hasn't yet
+	r.broadcasterOnce.Do(func() {})
+	r.reaperOnce.Do(func() {})
+	r.broadcasters.Wait()
+	r.reaper.Wait()
+
+	r.mu.RLock()
+	sessions := make([]*UserSession, 0, len(r.nameToUserSession))
+	for _, session := range r.nameToUserSession {
+		sessions = append(sessions, session)
+	}
+	r.mu.RUnlock()
+	for _, session := range sessions {
+		session.mu.Lock()
+		if session.graceTimer != nil {
+			session.graceTimer.Stop()
+			session.graceTimer = nil
+		}
+		session.mu.Unlock()
+		session.stopWriters()
+	}
+	r.writers.Wait()
+}
+
+// Add registers a session under its name and, if it has one, its
+// connection, replacing any session of the same name. It doesn't broadcast
+// the change; call Broadcast for that.
+func (r *Registry) Add(session *UserSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(session.Name)
+	r.nameToUserSession[session.Name] = session
+	session.mu.Lock()
+	if session.Conn != nil {
+		r.sessionIdToName[session.Conn.RemoteAddr().String()] = session.Name
+	}
+	session.mu.Unlock()
+}
+
+// Remove unregisters the named user's session and returns it, or nil if
+// there is none. The session's connection is left open.
+func (r *Registry) Remove(name string) *UserSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.removeLocked(name)
+}
+
+// removeLocked unregisters a session and every connection mapped to it.
+// The caller must hold mu.
+func (r *Registry) removeLocked(name string) *UserSession {
+	session, exists := r.nameToUserSession[name]
+	if !exists {
+		return nil
+	}
+	delete(r.nameToUserSession, name)
+	for sessionId, userName := range r.sessionIdToName {
+		if userName == name {
+			delete(r.sessionIdToName, sessionId)
+		}
+	}
+	return session
+}
+
+// Get returns the named user's session
+func (r *Registry) Get(name string) (*UserSession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	session, exists := r.nameToUserSession[name]
+	return session, exists
+}
+
+// byConn returns the session a connection belongs to, if it has joined
+func (r *Registry) byConn(conn Conn) (*UserSession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	session, exists := r.nameToUserSession[r.sessionIdToName[conn.RemoteAddr().String()]]
+	return session, exists
+}
+
+// connSessionLocked returns the session conn is serving and its name, and
+// whether conn is still that session's connection. Every connection has an
+// address of its own (SSE sessions and gRPC streams get a unique one, see
+// sse.go and grpc.go), but once a session has resumed on a new connection
+// the old one must not act for it. The caller must hold mu.
+func (r *Registry) connSessionLocked(conn Conn) (*UserSession, string, bool) {
+	name, exists := r.sessionIdToName[conn.RemoteAddr().String()]
+	if !exists {
+		return nil, "", false
+	}
+	session := r.nameToUserSession[name]
+	if session == nil {
+		return nil, "", false
+	}
+	session.mu.Lock()
+	owned := session.Conn == conn
+	session.mu.Unlock()
+	return session, name, owned
+}
+
+// releasePeerLocked ends the call of a session that is going away: it
+// clears the session's call state and its peer's, unless the peer has moved
+// on to another call already. It returns the released peer, to be sent a
+// hangUp once mu is released, or nil, and the ID of the call that ended. The
+// caller must hold mu.
+func (r *Registry) releasePeerLocked(session *UserSession) (*UserSession, string) {
+	// A transfer can't go on without every user in it
+	r.abortTransfersLocked(session.Name)
+
+	call := r.sessionCallLocked(session)
+	r.endCallLocked(call, CallPeerDisconnected)
+	callID := ""
+	if call != nil {
+		callID = call.id
+	}
+	session.mu.Lock()
+	peerName := ""
+	if session.InCall {
+		peerName = session.Peer
+	}
+	session.InCall = false
+	session.Peer = ""
+	session.CallID = ""
+	session.callControls = callControlState{}
+	session.mu.Unlock()
+
+	peer, exists := r.nameToUserSession[peerName]
+	if !exists {
+		return nil, callID
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.Peer != session.Name || peer.CallID != callID {
+		return nil, callID
+	}
+	peer.InCall = false
+	peer.Peer = ""
+	peer.CallID = ""
+	peer.callControls = callControlState{}
+	return peer, callID
+}
+
+// hangUpLocked ends the call between sender and receiver on a hangUp or
+// cancelCall from conn, and takes both users out of it. It returns the
+// call, or nil if conn isn't the sender's or sender and receiver aren't in
+// a call together: naming two users is not enough to end their calls,
+// which may be with someone else. The caller must hold mu.
+func (r *Registry) hangUpLocked(conn Conn, sender, receiver string) *activeCall {
+	session, name, owned := r.connSessionLocked(conn)
+	if !owned || name != sender {
+		return nil
+	}
+	call := r.sessionCallLocked(session)
+	if call == nil || call.peerOf(sender) != receiver {
+		return nil
+	}
+	r.endCallLocked(call, hangUpOutcome(call, sender))
+	r.leaveCallLocked(sender, call)
+	r.leaveCallLocked(call.peerOf(sender), call)
+	// A transfer of the call can't go on without it
+	r.abortTransfersLocked(sender)
+	r.abortTransfersLocked(receiver)
+	return call
+}
+
+// track adds a connection to the ones being served, with the cancel
+// function of its context. It returns false once the registry is shutting
+// down.
+func (r *Registry) track(conn Conn, cancel context.CancelFunc) bool {
+	r.connsMu.Lock()
+	defer r.connsMu.Unlock()
+	if r.shuttingDown {
+		return false
+	}
+	r.conns[conn] = cancel
+	r.served.Add(1)
+	return true
+}
+
+// cancelConn cancels the context of a connection being served, so the
+// work of its handlers stops reaching clients
+func (r *Registry) cancelConn(conn Conn) {
+	r.connsMu.Lock()
+	cancel := r.conns[conn]
+	r.connsMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// untrack removes a connection that has ended
+func (r *Registry) untrack(conn Conn) {
+	r.connsMu.Lock()
+	defer r.connsMu.Unlock()
+	delete(r.conns, conn)
+	r.served.Done()
+}
+
+// Len returns the number of sessions
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.nameToUserSession)
+}
+
+// Snapshot returns a copy of every session's state, sorted by username
+// (see snapshot.go)
+func (r *Registry) Snapshot() []SessionInfo {
+	r.mu.RLock()
+	sessions := make([]SessionInfo, 0, len(r.nameToUserSession))
+	for _, session := range r.nameToUserSession {
+		info := session.info()
+		info.Tenant = r.tenant
+		sessions = append(sessions, info)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Username < sessions[j].Username
+	})
+	return sessions
+}
@@ -0,0 +1,189 @@
+package webrtc
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listConn is a client that keeps the last user list written to it
+type listConn struct {
+	stalledConn
+	addr net.Addr
+
+	mu    sync.Mutex
+	users []string
+}
+
+func newListConn(port int) *listConn {
+	return &listConn{
+		stalledConn: stalledConn{closed: make(chan struct{})},
+		addr:        &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port},
+	}
+}
+
+func (c *listConn) WriteMessage(msg SignalingMessage) error {
+	if list, ok := msg.Data.(ActiveUsers); ok && msg.Type == "activeUsers" {
+		names := make([]string, 0, len(list.Users))
+		for _, user := range list.Users {
+			names = append(names, user.Name)
+		}
+		sort.Strings(names)
+		c.mu.Lock()
+		c.users = names
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *listConn) lastUsers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.users
+}
+
+func (c *listConn) RemoteAddr() net.Addr { return c.addr }
+
+// newTestSession returns a v1 session on conn, as HandleJoin creates it
+func newTestSession(s *Service, name string, conn Conn) *UserSession {
+	now := time.Now()
+	return &UserSession{
+		Name:         name,
+		Conn:         conn,
+		ClientIP:     conn.ClientIP(),
+		ConnectedAt:  now,
+		LastActivity: now,
+		Version:      ProtocolV1,
+		Status:       StatusAvailable,
+		logger:       s.logger,
+		service:      s,
+		presence:     newPresenceQueue(),
+		outbound:     newOutboundQueue(),
+	}
+}
+
+// Sessions added and removed from many goroutines, some racing for the
+// same name, leave the name and connection maps in step
+func TestRegistryConcurrentAddRemove(t *testing.T) {
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	r := s.Registry()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				own := fmt.Sprintf("user%d-%d", g, i)
+				r.Add(newTestSession(s, own, newListConn(10000+g*1000+i)))
+				r.Add(newTestSession(s, "shared", newListConn(20000+g*1000+i)))
+				if session, ok := r.Get(own); !ok || session.Name != own {
+					t.Errorf("%s missing right after it was added", own)
+					return
+				}
+				r.Snapshot()
+				if i%2 == 1 && r.Remove(own) == nil {
+					t.Errorf("%s missing when removed", own)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every goroutine kept its even-numbered users, plus one shared
+	if want := 8*100 + 1; r.Len() != want {
+		t.Fatalf("registry holds %d sessions, want %d", r.Len(), want)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.sessionIdToName) != len(r.nameToUserSession) {
+		t.Fatalf("%d connections mapped for %d sessions", len(r.sessionIdToName), len(r.nameToUserSession))
+	}
+	for sessionID, name := range r.sessionIdToName {
+		session := r.nameToUserSession[name]
+		if session == nil || session.Conn.RemoteAddr().String() != sessionID {
+			t.Fatalf("connection %s maps to %s, which isn't joined on it", sessionID, name)
+		}
+	}
+}
+
+// Broadcasts racing with adds and removes reach a joined user, and the
+// last one lists exactly the users that remain
+func TestRegistryConcurrentBroadcast(t *testing.T) {
+	s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+	r := s.Registry()
+	observerConn := newListConn(9999)
+	observer := newTestSession(s, "observer", observerConn)
+	r.Add(observer)
+	observer.startOutbound(s.logger)
+	observer.startPresence(s.logger)
+	t.Cleanup(observer.stopWriters)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				name := fmt.Sprintf("user%d-%d", g, i)
+				r.Add(newTestSession(s, name, newListConn(10000+g*1000+i)))
+				r.Broadcast()
+				if i%4 != 0 {
+					r.Remove(name)
+					r.Broadcast()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	r.Broadcast()
+
+	want := []string{"observer"}
+	for g := 0; g < 4; g++ {
+		for i := 0; i < 100; i += 4 {
+			want = append(want, fmt.Sprintf("user%d-%d", g, i))
+		}
+	}
+	sort.Strings(want)
+	for deadline := time.Now().Add(5 * time.Second); !slices.Equal(observerConn.lastUsers(), want); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("observer's last user list has %d users, want %d", len(observerConn.lastUsers()), len(want))
+		}
+	}
+}
+
+// The per-user call limiters refill over time and are forgotten once idle
+// for a minute
+func TestCallLimitersDecay(t *testing.T) {
+	saved := callAttemptRate
+	t.Cleanup(func() { callAttemptRate = saved })
+	callAttemptRate = 2
+	r := NewRegistry()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, want := range []bool{true, true, false} {
+		if got := r.allowCallAttemptLocked("alice"); got != want {
+			t.Fatalf("attempt %d allowed: %v, want %v", i+1, got, want)
+		}
+	}
+	// Two a minute is one every 30 seconds
+	r.callAttempts["alice"].last = r.callAttempts["alice"].last.Add(-30 * time.Second)
+	if !r.allowCallAttemptLocked("alice") || r.allowCallAttemptLocked("alice") {
+		t.Fatal("want one attempt back after 30 seconds")
+	}
+
+	r.callAttempts["alice"].last = time.Now().Add(-callLimiterIdle)
+	r.callLimitersSwept = time.Now().Add(-callLimiterIdle)
+	r.allowCallAttemptLocked("bob")
+	if _, kept := r.callAttempts["alice"]; kept {
+		t.Fatal("alice's idle limiter was kept")
+	}
+}
@@ -0,0 +1,193 @@
+/*
+WebRTC Signaling Duplicate Joins
+================================
+
+This file decides what happens to a join for a username that already has a
+session, or from a connection that already joined.
+
+WHY IS THIS NEEDED?
+===================
+A client that retries its join on a second connection, because the first one
+seemed slow, can have both joins arrive within milliseconds. The join path
+read the existing session's connection without its lock and rejected or
+replaced in separate steps, and a connection could join a second name,
+taking over the reverse mapping of the first one while its session stayed
+registered. Either way a session could end up half registered: in
+nameToUserSession with no sessionIdToName entry, or the other way around,
+and it then never got cleaned up.
+
+HOW IT WORKS:
+=============
+HandleJoin takes the registry lock once and, before changing anything,
+decides one of:
+- reject ("alreadyJoined"): the connection already serves a session, or
+  the name is held by a live connection of another client and the join
+  policy is "reject"
+- replace: the name is held by a live connection of the same client, i.e.
+  the join presents that session's token, or of any client with the join
+  policy "replace". The client IP doesn't count: behind a NAT, CGNAT or an
+  untrusted proxy many users share one, and any of them could take over
+  another's session and call.
+- accept: no session holds the name, or only one whose connection is gone
+  (waiting to be resumed, see resume.go), which is removed
+
+The session, if any, is removed from both maps and the new one added to
+both under the same lock, so concurrent joins for one name leave exactly
+one live session, with a single reverse entry pointing to it.
+
+JOIN POLICY:
+============
+With -join-policy=reject (the default) a user can only take over their own
+session, as a client that retries its join with the sessionToken of its
+first one does. With -join-policy=replace
+the newest connection always wins, e.g. when the user opens the app on a
+second device or the first one is a zombie that hasn't been noticed yet.
+
+REPLACING A SESSION:
+====================
+1. The older connection is sent a sessionReplaced message and closed with
+   code 4003 (CloseReplacedBySession). Clients shouldn't reconnect
+   automatically on it, or two devices would keep replacing each other.
+
+	{"type":"sessionReplaced","receiver":"alice","data":{"reason":"newSession"}}
+
+2. An accepted call carries over to the new session: it stays in the call,
+   with the same call ID and negotiation epoch, and gets the callState in
+   its join response as a resumed session would (see callcontrol.go). A
+   call still ringing is missed instead ("rejectedElsewhere", see
+   missedcalls.go).
+3. The peer of a call that carried over is told, so it can renegotiate
+   media with the new device, e.g. with an iceRestart and a new offer:
+
+	{"type":"peerReplaced","sender":"alice","receiver":"bob","callId":"9b2f..."}
+*/
+
+package webrtc
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+)
+
+// Join policies for a name held by another client's live connection
+const (
+	JoinPolicyReject  = "reject"  // Refuse the join
+	JoinPolicyReplace = "replace" // Replace the older session
+)
+
+// CloseReplacedBySession is the close code sent to a connection whose
+// session was replaced by a newer join of the same user
+const CloseReplacedBySession = 4003
+
+// replacedWriteTimeout bounds how long the sessionReplaced message may take
+// to send
+const replacedWriteTimeout = time.Second
+
+// joinPolicy is the current join policy, set once at startup by
+// ConfigureJoinPolicy
+var joinPolicy = JoinPolicyReject
+
+// ConfigureJoinPolicy sets what a join for a name held by another client's
+// live connection does: JoinPolicyReject or JoinPolicyReplace
+func ConfigureJoinPolicy(policy string) error {
+	switch policy {
+	case JoinPolicyReject, JoinPolicyReplace:
+		joinPolicy = policy
+		return nil
+	}
+	return fmt.Errorf("unknown join policy %q, expected %q or %q", policy, JoinPolicyReject, JoinPolicyReplace)
+}
+
+// ReplacedInfo is the data of a sessionReplaced message
+type ReplacedInfo struct {
+	Reason string `json:"reason"`
+}
+
+// joinDecision is what HandleJoin does with a join, see joinDecisionLocked
+type joinDecision int
+
+const (
+	joinAccept  joinDecision = iota // No live session holds the name
+	joinReplace                     // The live session holding the name is replaced
+	joinReject                      // The join is refused with alreadyJoined
+)
+
+// joinDecisionLocked decides what to do with a join for name from conn,
+// carrying the given session token if any. For joinReplace it also returns
+// the session being replaced. The caller must hold r.mu and keep holding it
+// until the join is applied.
+func (r *Registry) joinDecisionLocked(conn Conn, name, token string) (joinDecision, *UserSession) {
+	// A connection serves one session; a second join on it is a client bug
+	if _, _, owned := r.connSessionLocked(conn); owned {
+		return joinReject, nil
+	}
+
+	existing, exists := r.nameToUserSession[name]
+	if !exists {
+		return joinAccept, nil
+	}
+	existing.mu.Lock()
+	oldConn, sessionToken := existing.Conn, existing.Token
+	existing.mu.Unlock()
+	switch {
+	case oldConn == nil:
+		// Detached, waiting to be resumed: the join supersedes it
+		return joinAccept, nil
+	case joinPolicy == JoinPolicyReplace,
+		token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sessionToken)) == 1:
+		return joinReplace, existing
+	}
+	return joinReject, nil
+}
+
+// callHandover is the accepted call a replaced session hands over to the
+// session replacing it
+type callHandover struct {
+	peer     string
+	callID   string
+	restarts uint64 // ICE restarts so far, see icerestart.go
+}
+
+// handOverCallLocked takes a replaced session out of its accepted call so
+// the new session can carry on with it. It returns nil, leaving the session
+// as it is, if it isn't in an accepted call. The caller must hold r.mu.
+func (r *Registry) handOverCallLocked(session *UserSession) *callHandover {
+	call := r.sessionCallLocked(session)
+	if call == nil || !call.accepted {
+		return nil
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	handover := &callHandover{peer: call.peerOf(session.Name), callID: call.id, restarts: session.callControls.restarts}
+	session.InCall = false
+	session.Peer = ""
+	session.CallID = ""
+	session.callControls = callControlState{}
+	return handover
+}
+
+// takeOver puts a new session in the call handed over by the session it
+// replaced. Hold and mute state belonged to the old device and start over.
+func (h *callHandover) takeOver(session *UserSession) {
+	session.InCall = true
+	session.Peer = h.peer
+	session.CallID = h.callID
+	session.callControls = callControlState{restarts: h.restarts}
+}
+
+// closeReplaced tells a replaced session's connection why it is being
+// closed and closes it
+func (s *Service) closeReplaced(conn Conn, name string, version int) {
+	// Written directly: the outbound queue stops with the session
+	conn.SetWriteDeadline(time.Now().Add(replacedWriteTimeout))
+	replaced := renderMessage(SignalingMessage{
+		Type:     "sessionReplaced",
+		Receiver: name,
+		Data:     ReplacedInfo{Reason: "newSession"},
+	}, version, 0)
+	if err := conn.WriteMessage(replaced); err == nil {
+		captureMessage("out", name, "", conn, replaced)
+	}
+	s.closeConn(conn, CloseReplacedBySession, "replaced by new session")
+}
@@ -0,0 +1,229 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+
+	"github.com/gorilla/websocket"
+)
+
+// rawJoin dials url and sends join, without waiting for the response
+func rawJoin(t *testing.T, url string, join webrtc.SignalingMessage) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial as %s: %v", join.Sender, err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	sendRaw(t, ws, join)
+	return ws
+}
+
+// joinResult reads a join response and returns whether it succeeded, its
+// error and the session token it carries
+func joinResult(t *testing.T, ws *websocket.Conn) (bool, string, string) {
+	t.Helper()
+	response := expectRaw(t, ws, "join")
+	data, _ := response.Data.(map[string]any)
+	ok, _ := data["result"].(bool)
+	token, _ := data["sessionToken"].(string)
+	return ok, response.Error, token
+}
+
+// A second join under a name whose session is still connected is refused
+// even though it comes from the same client IP, as every user behind one
+// NAT does, and the first session carries on
+func TestJoinFromSameIPRefused(t *testing.T) {
+	s, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+	replaced := make(chan struct{}, 1)
+	alice.OnSessionReplaced(func() { replaced <- struct{}{} })
+
+	// Both come from 127.0.0.1
+	_, err := client.DialOptions(url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	if !errors.Is(err, client.ErrJoinRejected) || !strings.Contains(err.Error(), "alreadyJoined") {
+		t.Fatalf("second join from the same IP: %v, want alreadyJoined", err)
+	}
+
+	sessions := s.Registry().Snapshot()
+	if len(sessions) != 1 || sessions[0].Username != "alice" {
+		t.Fatalf("sessions %+v, want alice's first one", sessions)
+	}
+	bob := dial(t, url, client.Options{Username: "bob"})
+	startCall(t, bob, alice)
+	select {
+	case <-replaced:
+		t.Fatal("alice's first session was replaced")
+	default:
+	}
+}
+
+// A join carrying another session token than the live session's is
+// refused; one carrying its token replaces it
+func TestJoinSessionToken(t *testing.T) {
+	s, url := newTestServer(t)
+	first := rawJoin(t, url, webrtc.SignalingMessage{Type: "join", Sender: "alice", Version: webrtc.ProtocolV2})
+	ok, _, token := joinResult(t, first)
+	if !ok || token == "" {
+		t.Fatalf("first join: result %t, token %q", ok, token)
+	}
+
+	wrong := rawJoin(t, url, webrtc.SignalingMessage{Type: "join", Sender: "alice", Version: webrtc.ProtocolV2,
+		Data: map[string]string{"sessionToken": token[:len(token)-1] + "x"}})
+	if ok, reason, _ := joinResult(t, wrong); ok || reason != "alreadyJoined" {
+		t.Fatalf("join with another token: result %t, error %q, want alreadyJoined", ok, reason)
+	}
+
+	retry := rawJoin(t, url, webrtc.SignalingMessage{Type: "join", Sender: "alice", Version: webrtc.ProtocolV2,
+		Data: map[string]string{"sessionToken": token}})
+	if ok, reason, _ := joinResult(t, retry); !ok {
+		t.Fatalf("join with the session's token refused: %q", reason)
+	}
+	expectRaw(t, first, "sessionReplaced")
+	sessions := s.Registry().Snapshot()
+	if len(sessions) != 1 || sessions[0].SessionID != retry.LocalAddr().String() {
+		t.Fatalf("sessions %+v, want alice on %s", sessions, retry.LocalAddr())
+	}
+}
+
+// Of many joins racing for one name, exactly one wins and the others are
+// refused with alreadyJoined, leaving a single session on the winner's
+// connection
+func TestConcurrentJoinsOneWinner(t *testing.T) {
+	s, url := newTestServer(t)
+	const joins = 50
+	conns := make([]*websocket.Conn, joins)
+	for i := range conns {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		conns[i] = ws
+	}
+
+	var wg sync.WaitGroup
+	for _, ws := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws.WriteJSON(webrtc.SignalingMessage{Type: "join", Sender: "alice", Version: webrtc.ProtocolV2})
+		}()
+	}
+	wg.Wait()
+
+	var winners []*websocket.Conn
+	refused := 0
+	for _, ws := range conns {
+		ok, reason, _ := joinResult(t, ws)
+		switch {
+		case ok:
+			winners = append(winners, ws)
+		case reason == "alreadyJoined":
+			refused++
+		default:
+			t.Fatalf("join refused with %q", reason)
+		}
+	}
+	if len(winners) != 1 || refused != joins-1 {
+		t.Fatalf("%d joins won and %d were refused, want 1 and %d", len(winners), refused, joins-1)
+	}
+	sessions := s.Registry().Snapshot()
+	if len(sessions) != 1 || sessions[0].SessionID != winners[0].LocalAddr().String() {
+		t.Fatalf("sessions %+v, want alice on %s", sessions, winners[0].LocalAddr())
+	}
+}
+
+// useJoinPolicy sets the join policy for the test, restoring the default
+// when it ends. Call it before newTestServer so the restore runs after the
+// server's shutdown.
+func useJoinPolicy(t *testing.T, policy string) {
+	t.Helper()
+	if err := webrtc.ConfigureJoinPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { webrtc.ConfigureJoinPolicy(webrtc.JoinPolicyReject) })
+}
+
+func TestConfigureJoinPolicyUnknown(t *testing.T) {
+	if err := webrtc.ConfigureJoinPolicy("evict"); err == nil {
+		t.Fatal("unknown join policy accepted")
+	}
+}
+
+// Under the reject policy the first session keeps the name
+func TestJoinPolicyReject(t *testing.T) {
+	useJoinPolicy(t, webrtc.JoinPolicyReject)
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+
+	_, err := client.DialOptions(url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	if !errors.Is(err, client.ErrJoinRejected) || !strings.Contains(err.Error(), "alreadyJoined") {
+		t.Fatalf("second join: %v, want alreadyJoined", err)
+	}
+	select {
+	case <-alice.Done():
+		t.Fatalf("first session closed: %v", alice.Err())
+	default:
+	}
+}
+
+// Under the replace policy the newer join takes the name, and the older
+// connection is told why and closed with CloseReplacedBySession
+func TestJoinPolicyReplace(t *testing.T) {
+	useJoinPolicy(t, webrtc.JoinPolicyReplace)
+	s, url := newTestServer(t)
+	old := dial(t, url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	replaced := make(chan struct{}, 1)
+	old.OnSessionReplaced(func() { replaced <- struct{}{} })
+
+	current := dial(t, url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	receive(t, replaced, "sessionReplaced")
+	<-old.Done()
+	if code, _ := old.CloseCode(); code != webrtc.CloseReplacedBySession {
+		t.Fatalf("old connection closed with %d, want %d", code, webrtc.CloseReplacedBySession)
+	}
+	if current.CallState != nil {
+		t.Fatalf("join without a call took over %+v", current.CallState)
+	}
+	if sessions := s.Registry().Snapshot(); len(sessions) != 1 || sessions[0].Detached {
+		t.Fatalf("sessions %+v, want alice's new one", sessions)
+	}
+}
+
+// A replacing join takes over the session's call: the peer is told the
+// other end moved, the new device gets the call's state and the call
+// carries on from it
+func TestJoinPolicyReplaceHandsOverCall(t *testing.T) {
+	useJoinPolicy(t, webrtc.JoinPolicyReplace)
+	_, url := newTestServer(t)
+	bob := dial(t, url, client.Options{Username: "bob", Version: webrtc.ProtocolV2})
+	old := dial(t, url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	startCall(t, old, bob)
+	callID := old.CallID()
+	peerReplaced := make(chan string, 1)
+	bob.OnPeerReplaced(func(from string) { peerReplaced <- from })
+	offers := make(chan string, 1)
+	bob.OnOffer(func(from string, _ json.RawMessage) { offers <- from })
+
+	current := dial(t, url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	if from := receive(t, peerReplaced, "peerReplaced"); from != "alice" {
+		t.Fatalf("peerReplaced from %q, want alice", from)
+	}
+	state := current.CallState
+	if state == nil || state.Peer != "bob" || state.CallID != callID {
+		t.Fatalf("new device took over %+v, want the call %s with bob", state, callID)
+	}
+	if err := current.SendOffer("bob", testOffer); err != nil {
+		t.Fatalf("offer: %v", err)
+	}
+	if from := receive(t, offers, "offer"); from != "alice" {
+		t.Fatalf("offer from %q, want alice", from)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+WebRTC Signaling Reliability Layer
+==================================
+
+This file implements an optional acknowledgement and replay layer on top of
+the sequence numbers that protocol v2 sessions already receive.
+
+WHY IS THIS NEEDED?
+===================
+Signaling messages are fire-and-forget. If a WriteJSON fails mid-call (the
+phone switched networks, the socket died), the offer or candidate is simply
+lost and both sides stall waiting for each other.
+
+HOW IT WORKS:
+=============
+1. Every message the server sends to a v2 session carries a "seq" number
+   that increases by one per message.
+2. The server keeps the last N messages that the client hasn't acknowledged
+   in a per-session outbox.
+3. The client acknowledges with {"type":"ack","seq":17}, which releases
+   every message up to and including seq 17 (cumulative ack).
+4. The join response includes a "sessionToken". If the client resumes its
+   session with that token (see resume.go), the outbox is replayed. If the
+   session ends instead, the outbox is kept for a replay window.
+5. When the client joins again with {"data":{"sessionToken":"..."}}, the
+   unacknowledged messages are replayed in order with their original seq.
+
+MEMORY BOUNDS:
+==============
+- Each outbox holds at most bufferSize messages; older ones are dropped and
+  the drop is logged (once per session, with a running count).
+- Retained outboxes expire after the replay window.
+- Setting the buffer size to 0 disables the layer entirely.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Reliability configuration defaults
+const (
+	DefaultAckBufferSize   = 64               // Unacked messages kept per session
+	DefaultAckReplayWindow = 30 * time.Second // How long a dropped session's outbox is kept
+)
+
+var (
+	// Current reliability configuration, set once at startup by ConfigureReliability
+	ackBufferSize   = DefaultAckBufferSize
+	ackReplayWindow = DefaultAckReplayWindow
+
+	// Outboxes of disconnected sessions waiting to be replayed, keyed by session token
+	retainedOutboxes   = make(map[string]*retainedOutbox)
+	retainedOutboxesMu sync.Mutex
+)
+
+// retainedOutbox holds the unacknowledged messages of a disconnected session
+type retainedOutbox struct {
+	name    string
+	seq     uint64
+	outbox  []SignalingMessage
+	expires time.Time
+}
+
+// ConfigureReliability sets the per-session unacked message buffer size and
+// how long the buffer of a disconnected session is kept for replay.
+// A bufferSize of 0 disables acknowledgements and replay.
+func ConfigureReliability(bufferSize int, replayWindow time.Duration) {
+	ackBufferSize = bufferSize
+	ackReplayWindow = replayWindow
+}
+
+// reliable reports whether the session buffers messages for acknowledgement.
+// Only v2 clients see sequence numbers, so only they can acknowledge.
+func (u *UserSession) reliable() bool {
+	return ackBufferSize > 0 && u.Version >= ProtocolV2 && u.Token != ""
+}
+
+// bufferLocked appends a rendered message to the outbox, dropping the
+// oldest message when the buffer is full. The caller must hold u.mu.
+func (u *UserSession) bufferLocked(msg SignalingMessage) {
+	u.outbox = append(u.outbox, msg)
+	if len(u.outbox) <= ackBufferSize {
+		return
+	}
+	u.outbox = u.outbox[len(u.outbox)-ackBufferSize:]
+	u.dropped++
+	if u.dropped == 1 && u.logger != nil {
+		u.logger.Printf("Unacked buffer full for user %s (limit %d), dropping oldest messages", RedactName(u.Name), ackBufferSize)
+	}
+}
+
+// ack releases every buffered message with a seq up to and including seq.
+// It returns the number of messages released.
+func (u *UserSession) ack(seq uint64) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	released := 0
+	for released < len(u.outbox) && u.outbox[released].Seq <= seq {
+		released++
+	}
+	u.outbox = u.outbox[released:]
+	return released
+}
+
+// replay resends the given messages exactly as they were first rendered
+// and buffers them again until the client acknowledges them.
+func (u *UserSession) replay(messages []SignalingMessage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.Conn == nil {
+		return
+	}
+	for _, msg := range messages {
+		u.bufferLocked(msg)
+		if err := u.enqueueLocked(msg, msg.CallID, false, nil); err != nil {
+			return
+		}
+	}
+}
+
+// replayOutbox resends every message up to seq that is still waiting for
+// acknowledgement, used when a client resumes its session on a new connection.
+func (u *UserSession) replayOutbox(upTo uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.Conn == nil {
+		return
+	}
+	for _, msg := range u.outbox {
+		if msg.Seq > upTo {
+			break
+		}
+		if err := u.enqueueLocked(msg, msg.CallID, false, nil); err != nil {
+			return
+		}
+	}
+}
+
+// HandleAck processes a cumulative acknowledgement from a client
+// The client sends {"type":"ack","seq":N} to release messages up to N
+func (s *Service) HandleAck(ctx context.Context, conn Conn, msg SignalingMessage) {
+	s.registry.mu.RLock()
+	session, _, owned := s.registry.connSessionLocked(conn)
+	s.registry.mu.RUnlock()
+	if !owned || !session.reliable() {
+		return
+	}
+	session.ack(msg.Seq)
+}
+
+// retainOutbox keeps the unacked messages of a disconnecting session so they
+// can be replayed if the client comes back within the replay window.
+func retainOutbox(session *UserSession) {
+	if !session.reliable() {
+		return
+	}
+	session.mu.Lock()
+	outbox := session.outbox
+	seq := session.seq
+	session.mu.Unlock()
+	if len(outbox) == 0 {
+		return
+	}
+
+	retainedOutboxesMu.Lock()
+	defer retainedOutboxesMu.Unlock()
+	// Expired outboxes are swept here so the map can't grow without bound
+	now := time.Now()
+	for token, retained := range retainedOutboxes {
+		if now.After(retained.expires) {
+			delete(retainedOutboxes, token)
+		}
+	}
+	retainedOutboxes[session.Token] = &retainedOutbox{
+		name:    session.Name,
+		seq:     seq,
+		outbox:  outbox,
+		expires: now.Add(ackReplayWindow),
+	}
+}
+
+// takeRetainedOutbox removes and returns the retained outbox for the token,
+// if it exists, belongs to the named user and hasn't expired.
+func takeRetainedOutbox(token, name string) *retainedOutbox {
+	if token == "" {
+		return nil
+	}
+	retainedOutboxesMu.Lock()
+	defer retainedOutboxesMu.Unlock()
+	retained, exists := retainedOutboxes[token]
+	if !exists {
+		return nil
+	}
+	delete(retainedOutboxes, token)
+	if retained.name != name || time.Now().After(retained.expires) {
+		return nil
+	}
+	return retained
+}
+
+// sessionTokenFromJoin extracts the sessionToken a reconnecting client
+// sends in its join data, if any.
+func sessionTokenFromJoin(msg SignalingMessage) string {
+	data, ok := msg.Data.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	token, _ := data["sessionToken"].(string)
+	return token
+}
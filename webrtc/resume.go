@@ -0,0 +1,249 @@
+/*
+WebRTC Signaling Session Resume
+===============================
+
+This file implements resume tokens that let a client reattach to its
+existing session after the WebSocket drops.
+
+WHY IS THIS NEEDED?
+===================
+Mobile clients switching from Wi-Fi to LTE lose their WebSocket. Without
+resume, the reconnect either gets rejected by HandleJoin ("already has an
+active session") or starts a brand new session, losing the in-progress call
+state, and every other client sees the user leave and come back.
+
+HOW IT WORKS:
+=============
+1. Protocol v2 clients receive a signed token in their join response
+   ("sessionToken" in the join data).
+2. When the connection is lost, the session is detached instead of deleted:
+   the user stays in the active users list and keeps its InCall state.
+3. If the client reconnects to /signal?resume=<token> within the grace
+   window, the new connection replaces the old one on the same UserSession,
+   unacknowledged messages are replayed, and the call peer is told with a
+   "peerReconnected" message. No disconnect is ever broadcast.
+4. If the grace window passes first, the normal disconnect cleanup runs.
+
+TOKEN FORMAT:
+=============
+base64url(username + "\n" + random nonce) + "." + base64url(HMAC-SHA256)
+The HMAC key is generated at startup, so tokens can't be forged and don't
+survive a server restart. The token must also match the one stored on the
+session, so a token from an older session of the same user is useless.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"go-server/events"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultResumeGrace is how long a dropped session waits for its client to resume
+const DefaultResumeGrace = 30 * time.Second
+
+var (
+	// Grace window for resuming a dropped session, 0 disables resume
+	resumeGrace = DefaultResumeGrace
+
+	// Key used to sign resume tokens, generated once per process
+	resumeKey = func() []byte {
+		key := make([]byte, 32)
+		rand.Read(key)
+		return key
+	}()
+)
+
+// ConfigureResume sets how long a dropped session is held for its client to
+// resume it. A grace of 0 disables resume and cleans up immediately.
+func ConfigureResume(grace time.Duration) {
+	resumeGrace = grace
+}
+
+// newResumeToken creates a signed token identifying a new session of the named user
+func newResumeToken(name string) string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return ""
+	}
+	payload := []byte(name + "\n" + hex.EncodeToString(nonce))
+	mac := hmac.New(sha256.New, resumeKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyResumeToken checks the token signature and returns the username it was issued to
+func verifyResumeToken(token string) (string, bool) {
+	payloadPart, sigPart, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, resumeKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	name, _, found := strings.Cut(string(payload), "\n")
+	return name, found
+}
+
+// HandleResume reattaches a new connection to the session identified by token
+// On success it returns the resumed session's protocol version and true.
+// It returns false if the token is invalid or the session no longer exists,
+// in which case the client is told and may join normally instead.
+//
+// RESUME PROCESS:
+// ===============
+// 1. Verify the token signature and find the session it belongs to
+// 2. Swap the connection on the existing UserSession (closing the old one)
+// 3. Cancel the pending disconnect cleanup
+// 4. Confirm the resume and replay unacknowledged messages
+// 5. Tell the call peer, if any, that the user is back
+func (s *Service) HandleResume(ctx context.Context, conn Conn, token string, version int) (int, bool) {
+	name, valid := verifyResumeToken(token)
+
+	s.registry.mu.Lock()
+	session, exists := s.registry.nameToUserSession[name]
+	if !valid || !exists || subtle.ConstantTimeCompare([]byte(session.Token), []byte(token)) != 1 {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Rejected resume from %s: invalid or expired token", describeConn(conn))
+		conn.WriteMessage(renderMessage(SignalingMessage{
+			Type:  "resume",
+			Data:  JoinResult{Result: false},
+			Error: "invalidResumeToken",
+		}, version, 0))
+		return 0, false
+	}
+
+	session.mu.Lock()
+	oldConn := session.Conn
+	session.Conn = conn
+	session.ClientIP = conn.ClientIP()
+	session.LastActivity = time.Now()
+	if session.graceTimer != nil {
+		session.graceTimer.Stop()
+		session.graceTimer = nil
+	}
+	peer := session.Peer
+	// Only messages sent before the resume are replayed, not the
+	// resume confirmation that is about to be sent
+	lastSeq := session.seq
+	session.mu.Unlock()
+
+	if oldConn != nil {
+		delete(s.registry.sessionIdToName, oldConn.RemoteAddr().String())
+	}
+	s.registry.sessionIdToName[conn.RemoteAddr().String()] = name
+	s.registry.mu.Unlock()
+
+	// The old connection may still look alive if the drop hasn't been detected yet
+	if oldConn != nil {
+		s.closeConn(oldConn, websocket.CloseNormalClosure, "resumed on another connection")
+	}
+	s.logger.Printf("User %s resumed session from %s", RedactName(name), describeConn(conn))
+
+	// A client resuming mid-call gets the hold and mute state back (see callcontrol.go)
+	s.registry.mu.RLock()
+	callState := s.registry.callStateLocked(session)
+	s.registry.mu.RUnlock()
+	session.Send(ctx, SignalingMessage{
+		Type:     "resume",
+		Receiver: name,
+		Data:     JoinResult{Result: true, SessionToken: token, CallState: callState, ServerInfo: serverInfo},
+	})
+	session.replayOutbox(lastSeq)
+
+	if peer != "" {
+		s.registry.mu.RLock()
+		peerSession, peerExists := s.registry.nameToUserSession[peer]
+		s.registry.mu.RUnlock()
+		if peerExists {
+			peerSession.Send(ctx, SignalingMessage{
+				Type:     "peerReconnected",
+				Sender:   name,
+				Receiver: peer,
+			})
+		}
+	}
+	return session.Version, true
+}
+
+// HandleConnectionLost handles a WebSocket that closed without a leave message
+// Sessions holding a resume token are detached and kept for the grace window
+// so the client can resume; all other sessions, and every session once the
+// service is shutting down, are cleaned up immediately.
+func (s *Service) HandleConnectionLost(ctx context.Context, conn Conn) {
+	s.registry.mu.Lock()
+	session, userName, exists := s.registry.connSessionLocked(conn)
+	if !exists {
+		s.registry.mu.Unlock()
+		return
+	}
+	// A closed registry has nothing left to resume into (see Shutdown)
+	if session.Token == "" || resumeGrace <= 0 || s.registry.ctx.Err() != nil {
+		s.registry.mu.Unlock()
+		s.HandleDisconnect(ctx, conn)
+		return
+	}
+
+	// Detach the session: keep the user listed and in their call, but with
+	// no connection until they resume or the grace window expires
+	delete(s.registry.sessionIdToName, conn.RemoteAddr().String())
+	session.mu.Lock()
+	session.Conn = nil
+	session.clearOutbound()
+	session.graceTimer = time.AfterFunc(resumeGrace, func() {
+		s.expireDetachedSession(session)
+	})
+	session.mu.Unlock()
+	s.registry.mu.Unlock()
+
+	s.logger.Printf("User %s connection lost, holding session for %s", RedactName(userName), resumeGrace)
+}
+
+// expireDetachedSession runs the normal disconnect cleanup for a session
+// whose client didn't resume within the grace window.
+func (s *Service) expireDetachedSession(session *UserSession) {
+	s.registry.mu.Lock()
+	session.mu.Lock()
+	detached := session.Conn == nil
+	session.graceTimer = nil
+	session.mu.Unlock()
+	// The session may have been resumed, or replaced by a fresh join
+	if !detached || s.registry.nameToUserSession[session.Name] != session {
+		s.registry.mu.Unlock()
+		return
+	}
+	delete(s.registry.nameToUserSession, session.Name)
+	s.registry.missRingingCallLocked(session, "offline")
+	// The peer stayed in the call through the grace window; free them now
+	peer, callID := s.registry.releasePeerLocked(session)
+	s.registry.mu.Unlock()
+
+	session.stopWriters()
+	retainOutbox(session)
+	s.logger.Printf("User %s disconnected (resume grace expired)", RedactName(session.Name))
+	s.registry.publishUserLeft(session.Name, events.LeftResumeExpired)
+	s.hangUpPeer(s.registry.ctx, session.Name, peer, callID)
+	s.registry.Broadcast()
+}
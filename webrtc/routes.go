@@ -0,0 +1,51 @@
+/*
+WebRTC Signaling HTTP Routes
+============================
+
+This file builds the HTTP handler that serves every signaling endpoint, so
+the server can be mounted at any path and composed with other handlers.
+
+WHY IS THIS NEEDED?
+===================
+Embedding the server behind an API gateway often means /signal is already
+taken or has to live under a prefix like /webrtc/ws. Returning a handler
+instead of registering on http.DefaultServeMux lets embedders pick the path,
+wrap it in their own middleware (auth, logging, CORS) and mount it on their
+own mux without leaking routes to unrelated code.
+
+ENDPOINTS (relative to the signaling path):
+===========================================
+- <path>         WebSocket signaling
+- <path>/events  SSE event stream (fallback, see sse.go)
+- <path>/send    HTTP POST messages (fallback, see sse.go)
+*/
+
+package webrtc
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DefaultSignalingPath is where the signaling endpoints are mounted by default
+const DefaultSignalingPath = "/signal"
+
+// Routes returns a handler serving the service's signaling endpoints under
+// path, e.g. "/signal" or "/webrtc/ws". Requests to any other path get a
+// 404, so the handler can be mounted on a mux at "/" or at the path itself.
+func (s *Service) Routes(path string) http.Handler {
+	// Accept "signal", "/signal" and "/signal/" alike
+	base := strings.TrimRight("/"+strings.TrimLeft(path, "/"), "/")
+	wsPath := base
+	if wsPath == "" {
+		wsPath = "/" // Mounted at the root, WebSocket catches everything else
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(wsPath, s.HandleWebSocket)
+	// Fallback for networks that block WebSockets: SSE for server-to-client
+	// messages, HTTP POST for client-to-server messages
+	mux.HandleFunc(base+"/events", s.HandleSSEEvents)
+	mux.HandleFunc(base+"/send", s.HandleSSESend)
+	return mux
+}
@@ -0,0 +1,42 @@
+/*
+WebRTC Signaling Server Info
+============================
+
+This file tells clients which build of the server they are talking to.
+
+WHY IS THIS NEEDED?
+===================
+Client bug reports never said which server build they ran against, so
+triaging them started with a guess. Clients that log their join response
+now carry the server version in every report without anyone asking.
+
+HOW IT WORKS:
+=============
+The server's build information, set once at startup by ConfigureServerInfo
+(see -version in main.go), is sent as "serverInfo" in every successful join
+and resume response, to v1 and v2 clients alike:
+
+	{"type":"join","receiver":"alice","data":{"result":true,
+	 "serverInfo":{"version":"1.4.0","commit":"3f9c2e1","buildDate":"2026-10-17T09:30:00Z"}}}
+
+Nothing is sent before ConfigureServerInfo is called.
+*/
+
+package webrtc
+
+// ServerInfo identifies the build of the server
+type ServerInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// serverInfo is the build information sent in join responses, set once at
+// startup by ConfigureServerInfo
+var serverInfo *ServerInfo
+
+// ConfigureServerInfo sets the build information sent to clients in their
+// join and resume responses
+func ConfigureServerInfo(info ServerInfo) {
+	serverInfo = &info
+}
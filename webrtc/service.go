@@ -25,8 +25,9 @@ The service maintains user sessions and manages:
 
 THREAD SAFETY:
 ==============
-All session operations are protected by read-write mutexes to ensure
-thread safety in concurrent environments.
+All session operations are protected by the read-write mutex of the
+service's Registry (see registry.go) to ensure thread safety in concurrent
+environments.
 
 MESSAGE TYPES HANDLED:
 ======================
@@ -38,7 +39,15 @@ MESSAGE TYPES HANDLED:
 - offer: Forward SDP offer between peers
 - answer: Forward SDP answer between peers
 - candidate: Forward ICE candidates between peers
+- iceRestart: Coordinate an ICE restart between peers (see icerestart.go)
 - hangUp: End an active call
+- setStatus: Change presence status (see presence.go)
+- setMetadata: Change display name, avatar and capabilities (see metadata.go)
+- callHold, callResume, muteState, callControl: In-call controls (see callcontrol.go)
+- transferCall: Hand one's side of a call over to another user (see transfer.go)
+- chat: Relay a short text message between users (see chat.go)
+- clearMissedCalls: Forget the user's missed calls (see missedcalls.go)
+- ack: Acknowledge messages up to a sequence number (protocol v2)
 - leave: User disconnection and cleanup
 
 WEBRTC COORDINATION:
@@ -55,22 +64,77 @@ This service coordinates the WebRTC connection establishment process:
 package webrtc
 
 import (
+	"context"
 	"log"
 	"sync"
+	"time"
+
+	"go-server/events"
 
 	"github.com/gorilla/websocket"
 )
 
-// Global session management variables
-// These maintain the state of all connected users and their sessions
-var (
-	// Maps username to user session for quick lookups
-	nameToUserSession = make(map[string]*UserSession)
-	// Maps connection address to username for reverse lookups
-	sessionIdToName = make(map[string]string)
-	// Read-write mutex for thread-safe access to session data
-	mu sync.RWMutex
-)
+// Service is one signaling service: it routes the messages of its
+// connections between the users of its Registry. Every Handle* function is
+// a method on it; the package-level ones use a default Service (see
+// compat.go).
+type Service struct {
+	registry *Registry   // Users of this service, see registry.go
+	logger   *log.Logger // Signaling logger
+	dispatch *dispatcher // Message handlers and middlewares, see dispatch.go
+}
+
+// NewService creates a service serving the users of registry, logging to
+// signalingLogger
+func NewService(registry *Registry, signalingLogger *log.Logger) *Service {
+	s := &Service{registry: registry, logger: signalingLogger}
+	if registry.logger == nil {
+		registry.logger = signalingLogger
+	}
+	s.dispatch = s.newDispatcher()
+	return s
+}
+
+// Registry returns the registry the service's users are kept in
+func (s *Service) Registry() *Registry {
+	return s.registry
+}
+
+// closeReasonShutdown is the close reason sent with code 1001 on shutdown
+const closeReasonShutdown = "server shutting down"
+
+// Shutdown closes every connection of the service's registry with close
+// code 1001, so clients know to reconnect later rather than treat it as an
+// error, cancels the contexts their handlers run under and turns away
+// connections that arrive afterwards. It returns once
+// the close frames have been written, the connections' handlers and
+// cleanup have run, and the registry is closed (see Registry.Close), so no
+// goroutine of the service is left.
+func (s *Service) Shutdown() {
+	s.registry.connsMu.Lock()
+	s.registry.shuttingDown = true
+	conns := make([]Conn, 0, len(s.registry.conns))
+	for conn := range s.registry.conns {
+		conns = append(conns, conn)
+	}
+	s.registry.connsMu.Unlock()
+	// Handlers still running stop sending (see context.go)
+	s.registry.cancel()
+
+	s.logger.Printf("Closing %d signaling connections with code %d (%s)", len(conns), websocket.CloseGoingAway, closeReasonShutdown)
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.CloseWithCode(websocket.CloseGoingAway, closeReasonShutdown)
+		}()
+	}
+	wg.Wait()
+	// Sessions of closed connections are cleaned up by serveConn
+	s.registry.served.Wait()
+	s.registry.Close()
+}
 
 // HandleJoin handles a join request from a user
 // This function manages user registration and session creation
@@ -96,68 +160,243 @@ var (
 // - Rejects join if username already has active session
 // - Cleans up invalid sessions automatically
 // - Provides clear feedback to client about join status
-func HandleJoin(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleJoin(ctx context.Context, conn Conn, msg SignalingMessage) {
 	name := msg.Sender
-	signalingLogger.Printf("Handling join request from user: %s", name)
+	version := msg.Version
+	if version == 0 {
+		version = DefaultProtocolVersion
+	}
+	s.logger.Printf("Handling join request from user: %s (protocol v%d)", RedactName(name), version)
+
+	// Banned usernames and client IPs can't join (see bans.go)
+	if isBanned(name, conn.ClientIP(), "join") {
+		s.logger.Printf("Rejecting join from %s (%s): banned", RedactName(name), describeConn(conn))
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "join",
+			Receiver: name,
+			Data:     JoinResult{Result: false},
+			Version:  version,
+			Error:    "banned",
+		}, version)
+		return
+	}
 
-	mu.Lock()
+	// A kicked user can't rejoin until the cooldown ends (see kick.go)
+	if remaining := s.registry.kickCooldownRemaining(name); remaining > 0 {
+		s.logger.Printf("Rejecting join from %s: kicked, may rejoin in %s", RedactName(name), remaining.Round(time.Second))
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "join",
+			Receiver: name,
+			Data:     JoinResult{Result: false},
+			Version:  version,
+			Error:    "kicked",
+		}, version)
+		return
+	}
+
+	// The guest prefix is reserved for generated names (see guests.go)
+	if allowGuests && isGuestName(name) {
+		s.logger.Printf("Rejecting join from %s: the %s prefix is reserved for guests", RedactName(name), GuestPrefix)
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "join",
+			Receiver: name,
+			Data:     JoinResult{Result: false},
+			Version:  version,
+			Error:    "reservedName",
+		}, version)
+		return
+	}
+
+	// Metadata is checked before anything changes (see metadata.go)
+	metadata, reason := metadataFromData(msg.Data)
+	if reason != "" {
+		s.logger.Printf("Rejecting join from %s: %s", RedactName(name), reason)
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "join",
+			Receiver: name,
+			Data:     JoinResult{Result: false},
+			Version:  version,
+			Error:    "invalidMetadata",
+		}, version)
+		return
+	}
+
+	s.registry.mu.Lock()
+	var releasedPeer *UserSession
+	var releasedCallID string
+
+	// A join without a name gets a generated one no other user can hold
+	guest := name == "" && allowGuests
+	if guest {
+		name = s.registry.newGuestNameLocked()
+		s.logger.Printf("Assigned guest name %s to %s", RedactName(name), describeConn(conn))
+	}
 
 	// Check if user already has a valid session
 	// This prevents duplicate sessions and ensures user uniqueness
-	if existingSession, exists := nameToUserSession[name]; exists {
-		// Check if the existing connection is still valid
-		// If connection is nil, it means the previous session was invalid
-		if existingSession.Conn != nil {
-			signalingLogger.Printf("User %s already has an active session, rejecting join", name)
-			mu.Unlock()
-			conn.WriteJSON(SignalingMessage{
-				Type:     "join",
-				Receiver: name,
-				Data:     JoinResult{Result: false},
-			})
-			return
-		}
+	// The decision and the map updates below happen under one lock, so
+	// racing joins for the same name can't interleave (see rejoin.go)
+	decision, replaced := s.registry.joinDecisionLocked(conn, name, sessionTokenFromJoin(msg))
+	if decision == joinReject {
+		s.logger.Printf("User %s already has an active session, rejecting join from %s", RedactName(name), describeConn(conn))
+		s.registry.mu.Unlock()
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "join",
+			Receiver: name,
+			Data:     JoinResult{Result: false},
+			Version:  version,
+			Error:    "alreadyJoined",
+		}, version)
+		return
+	}
+	// The tenant may be at its user limit (see tenants.go)
+	if s.registry.tenantFullLocked(name) {
+		s.logger.Printf("Rejecting join from %s: tenant is at its limit of %d users", RedactName(name), s.registry.limits.MaxUsers)
+		s.registry.mu.Unlock()
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "join",
+			Receiver: name,
+			Data:     JoinResult{Result: false},
+			Version:  version,
+			Error:    "tenantFull",
+		}, version)
+		return
 	}
 
-	// Remove any existing session for this user (force rejoin only if connection was invalid)
+	// Remove any existing session for this user: a detached one, or the
+	// same client's live one being replaced
 	// This cleans up stale session data and allows user to rejoin
-	if _, exists := nameToUserSession[name]; exists {
-		signalingLogger.Printf("Removing existing session for user %s to allow rejoin", name)
-		delete(nameToUserSession, name)
+	var replacedConn Conn
+	var replacedVersion int
+	var handover *callHandover
+	if existingSession, exists := s.registry.nameToUserSession[name]; exists {
+		if decision == joinReplace {
+			replaced.mu.Lock()
+			replacedConn, replacedVersion = replaced.Conn, replaced.Version
+			replaced.mu.Unlock()
+			s.logger.Printf("Replacing the session of user %s on %s with a new join", RedactName(name), describeConn(replacedConn))
+			// An accepted call carries over to the new session (see rejoin.go)
+			handover = s.registry.handOverCallLocked(replaced)
+		} else {
+			s.logger.Printf("Removing existing session for user %s to allow rejoin", RedactName(name))
+		}
+		// A detached session waiting for resume is superseded by this join
+		// Its unacked messages can still be replayed via the session token
+		existingSession.mu.Lock()
+		if existingSession.graceTimer != nil {
+			existingSession.graceTimer.Stop()
+			existingSession.graceTimer = nil
+		}
+		existingSession.mu.Unlock()
+		existingSession.stopWriters()
+		retainOutbox(existingSession)
+		delete(s.registry.nameToUserSession, name)
+		if handover == nil {
+			// A call ringing on the old session is missed (see missedcalls.go)
+			s.registry.missRingingCallLocked(existingSession, "rejectedElsewhere")
+			// The new session starts out of any call, so the old one's peer is freed
+			releasedPeer, releasedCallID = s.registry.releasePeerLocked(existingSession)
+		}
 		// Clean up sessionIdToName entries for this user
 		// This maintains consistency between the two mapping structures
 		var keysToDelete []string
-		for sessionId, userName := range sessionIdToName {
+		for sessionId, userName := range s.registry.sessionIdToName {
 			if userName == name {
 				keysToDelete = append(keysToDelete, sessionId)
 			}
 		}
 		// Delete collected keys
 		for _, sessionId := range keysToDelete {
-			delete(sessionIdToName, sessionId)
+			delete(s.registry.sessionIdToName, sessionId)
 		}
 	}
 
 	// Create new user session
 	// This establishes the user's presence in the system
-	userSession := &UserSession{Name: name, Conn: conn}
-	nameToUserSession[name] = userSession
-	sessionIdToName[conn.RemoteAddr().String()] = name
-	signalingLogger.Printf("User %s joined successfully", name)
-	mu.Unlock()
+	// Presence status always starts out as available
+	now := time.Now()
+	userSession := &UserSession{
+		Name:         name,
+		Conn:         conn,
+		ClientIP:     conn.ClientIP(),
+		ConnectedAt:  now,
+		LastActivity: now,
+		Metadata:     metadata,
+		Guest:        guest,
+		Version:      version,
+		Status:       StatusAvailable,
+		logger:       s.logger,
+		service:      s,
+		presence:     newPresenceQueue(),
+		outbound:     newOutboundQueue(),
+	}
+	if version >= ProtocolV2 {
+		userSession.Token = newResumeToken(name)
+	}
+	if handover != nil {
+		handover.takeOver(userSession)
+	}
+
+	// A reconnecting client may present the token of its previous session
+	// to get the messages it never acknowledged replayed
+	var replay []SignalingMessage
+	if retained := takeRetainedOutbox(sessionTokenFromJoin(msg), name); retained != nil && userSession.reliable() {
+		userSession.seq = retained.seq
+		replay = retained.outbox
+		s.logger.Printf("Replaying %d unacked messages to user %s", len(replay), RedactName(name))
+	}
+
+	s.registry.nameToUserSession[name] = userSession
+	s.registry.sessionIdToName[conn.RemoteAddr().String()] = name
+	s.logger.Printf("User %s joined successfully from %s", RedactName(name), describeConn(conn))
+	s.registry.publishUserJoined(userSession, conn.RemoteAddr().String())
+	var callState *CallState
+	var handoverPeer *UserSession
+	if handover != nil {
+		callState = s.registry.callStateLocked(userSession)
+		handoverPeer = s.registry.nameToUserSession[handover.peer]
+	}
+	s.registry.mu.Unlock()
+	// The replaced connection's own cleanup finds no session to remove
+	if replacedConn != nil {
+		s.closeReplaced(replacedConn, name, replacedVersion)
+	}
+	s.hangUpPeer(ctx, name, releasedPeer, releasedCallID)
+	userSession.startOutbound(s.logger)
 
 	// Send successful join response to client
 	// This confirms that the user has been registered
-	conn.WriteJSON(SignalingMessage{
+	// v2 clients also learn which protocol version was negotiated
+	userSession.Send(ctx, SignalingMessage{
 		Type:     "join",
 		Receiver: name,
-		Data:     JoinResult{Result: true},
+		Data:     JoinResult{Result: true, SessionToken: userSession.Token, Username: joinedName(name, guest), CallState: callState, ServerInfo: serverInfo},
+		Version:  version,
 	})
+	if len(replay) > 0 {
+		userSession.replay(replay)
+	}
+	if handoverPeer != nil {
+		s.logger.Printf("Call between %s and %s carried over to %s's new session%s", RedactName(name), RedactName(handover.peer), RedactName(name), callLabel(handover.callID))
+		handoverPeer.Send(ctx, SignalingMessage{
+			Type:     "peerReplaced",
+			Sender:   name,
+			Receiver: handover.peer,
+			CallID:   handover.callID,
+		})
+	}
+
+	// Deliver chat messages that were sent before this user joined
+	s.deliverPendingChats(ctx, userSession)
+	s.deliverMissedCalls(ctx, userSession)
+
+	// Only now start writing user list broadcasts, so none can overtake the join response
+	userSession.startPresence(s.logger)
 
 	// Broadcast updated user list to all connected clients
 	// This ensures all clients have current information about available users
-	signalingLogger.Printf("Broadcasting active users after %s joined", name)
-	BroadcastActiveUsers(signalingLogger)
+	s.logger.Printf("Broadcasting active users after %s joined", RedactName(name))
+	s.registry.Broadcast()
 }
 
 // HandleActiveUsers sends the list of active users to the requesting user
@@ -179,21 +418,62 @@ func HandleJoin(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log
 // ===============
 // Returns structured data with user names and call status
 // This allows clients to show who's available for calls
-func HandleActiveUsers(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
-	mu.RLock()
-	activeUsers := make([]ActiveUser, 0, len(nameToUserSession))
-	for name, session := range nameToUserSession {
-		activeUsers = append(activeUsers, ActiveUser{
-			Name:   name,
-			InCall: session.InCall,
-		})
+//
+// PAGING:
+// =======
+// With thousands of users the full list may not fit in a client's frame
+// limit, so the request data may carry "offset", "limit" and "prefix":
+//
+//	{"type":"activeUsers","data":{"offset":200,"limit":100,"prefix":"al"}}
+//
+// The reply is then a single page plus the total number of matching users.
+// Without any of these fields the full list is sent, as before.
+func (s *Service) HandleActiveUsers(ctx context.Context, conn Conn, msg SignalingMessage) {
+	s.registry.mu.RLock()
+	activeUsers := s.registry.listActiveUsersLocked()
+	requester, _, joined := s.registry.connSessionLocked(conn)
+	s.registry.mu.RUnlock()
+	// Hidden guests are left out before paging, so totals add up
+	if allowGuests && guestsHidden && !(joined && requester.Guest) {
+		activeUsers = withoutGuests(activeUsers)
+	}
+
+	if page, paged := parsePageRequest(msg.Data); paged {
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type: "activeUsers",
+			Data: page.apply(activeUsers),
+		}, msg.Version)
+		return
 	}
-	mu.RUnlock()
 
-	conn.WriteJSON(SignalingMessage{
+	s.sendToConn(ctx, conn, SignalingMessage{
 		Type: "activeUsers",
 		Data: ActiveUsers{Users: activeUsers},
-	})
+	}, msg.Version)
+}
+
+// sendToConn sends a message to whoever owns the connection
+// If the connection belongs to a joined user, the message goes through their
+// session so it is rendered for their protocol version and serialized with
+// other writes. Otherwise it is written directly using the given version.
+// Nothing is sent once ctx is done.
+func (s *Service) sendToConn(ctx context.Context, conn Conn, msg SignalingMessage, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.registry.mu.RLock()
+	session, _, owned := s.registry.connSessionLocked(conn)
+	s.registry.mu.RUnlock()
+	if owned {
+		return session.Send(ctx, msg)
+	}
+	rendered := renderMessage(msg, version, 0)
+	err := conn.WriteMessage(rendered)
+	if err == nil {
+		captureMessage("out", rendered.Receiver, msg.CallID, conn, rendered)
+		recordEvent("out", msg.CallID, rendered)
+	}
+	return err
 }
 
 // HandleCall initiates a call between two users
@@ -208,8 +488,10 @@ func HandleActiveUsers(conn *websocket.Conn, msg SignalingMessage, signalingLogg
 //
 // VALIDATION:
 // ===========
+// - Ensures the sender is the user of the connection, or answers "forbidden"
 // - Ensures both sender and receiver exist
 // - Checks that neither user is already in a call
+// - Refuses calls to users in do-not-disturb with a callFailed message
 // - Prevents invalid call attempts
 //
 // STATE MANAGEMENT:
@@ -217,26 +499,132 @@ func HandleActiveUsers(conn *websocket.Conn, msg SignalingMessage, signalingLogg
 // - Updates call status for both users
 // - Prevents other users from calling users who are busy
 // - Maintains consistent state across all clients
-func HandleCall(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleCall(ctx context.Context, conn Conn, msg SignalingMessage) {
 	sender := msg.Sender
 	receiver := msg.Receiver
-	mu.Lock()
-	senderSession, senderExists := nameToUserSession[sender]
-	receiverSession, receiverExists := nameToUserSession[receiver]
+	s.registry.mu.Lock()
+	senderSession, senderExists := s.registry.nameToUserSession[sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	// Only the user of the connection can place a call; a call in another
+	// user's name would ring as if they had called, and dodge their call
+	// rate
+	if _, connUser, owned := s.registry.connSessionLocked(conn); !owned || connUser != sender {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Dropping call from %s to %s: not sent from %s's connection", RedactName(sender), RedactName(receiver), RedactName(sender))
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "error",
+			Receiver: sender,
+			Error:    "forbidden",
+			Data:     map[string]string{"error": "forbidden", "type": "call"},
+		}, msg.Version)
+		return
+	}
+	// Every attempt counts towards the caller's call rate (see calllimits.go)
+	if !s.registry.allowCallAttemptLocked(sender) {
+		s.registry.mu.Unlock()
+		s.refuseRateLimitedCall(ctx, senderSession, receiver, "call attempt rate exceeded")
+		return
+	}
+	// A call to someone who isn't joined is missed (see missedcalls.go)
+	if !receiverExists && !senderSession.InCall {
+		s.registry.recordMissedCall(receiver, sender, "offline")
+		s.registry.mu.Unlock()
+		s.logger.Printf("Call from %s to %s failed: receiver is offline", RedactName(sender), RedactName(receiver))
+		senderSession.Send(ctx, SignalingMessage{
+			Type:     "callFailed",
+			Sender:   receiver,
+			Receiver: sender,
+			Data:     map[string]interface{}{"reason": "offline"},
+			Error:    "offline",
+		})
+		return
+	}
 	if !senderExists || !receiverExists || senderSession.InCall || receiverSession.InCall {
-		mu.Unlock()
+		s.registry.mu.Unlock()
+		return
+	}
+	// Guests can only place so many calls (see guests.go)
+	if senderSession.Guest && !senderSession.allowGuestCall() {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Call from guest %s to %s refused: call rate exceeded", RedactName(sender), RedactName(receiver))
+		senderSession.Send(ctx, SignalingMessage{
+			Type:     "callFailed",
+			Sender:   receiver,
+			Receiver: sender,
+			Data:     map[string]interface{}{"reason": "rateLimited"},
+			Error:    "rateLimited",
+		})
+		return
+	}
+	// Users in do-not-disturb can't be called; the caller is told why
+	receiverSession.mu.Lock()
+	doNotDisturb := receiverSession.Status == StatusDND
+	receiverSession.mu.Unlock()
+	if doNotDisturb {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Call from %s to %s refused: receiver is in do-not-disturb", RedactName(sender), RedactName(receiver))
+		senderSession.Send(ctx, SignalingMessage{
+			Type:     "callFailed",
+			Sender:   receiver,
+			Receiver: sender,
+			Data:     map[string]interface{}{"reason": "doNotDisturb"},
+			Error:    "doNotDisturb",
+		})
+		return
+	}
+	// The tenant may be at its call limit (see tenants.go)
+	if s.registry.callLimitReachedLocked() {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Call from %s to %s refused: tenant is at its limit of %d calls", RedactName(sender), RedactName(receiver), s.registry.limits.MaxCalls)
+		senderSession.Send(ctx, SignalingMessage{
+			Type:     "callFailed",
+			Sender:   receiver,
+			Receiver: sender,
+			Data:     map[string]interface{}{"reason": "callLimit"},
+			Error:    "callLimit",
+		})
 		return
 	}
+	// The server may be at its call limit, or the receiver rung too often
+	// (see calllimits.go)
+	if serverCallLimitReached() {
+		s.registry.mu.Unlock()
+		s.refuseRateLimitedCall(ctx, senderSession, receiver, "server is at its limit of calls")
+		return
+	}
+	if !s.registry.allowRingLocked(receiver) {
+		s.registry.mu.Unlock()
+		s.refuseRateLimitedCall(ctx, senderSession, receiver, "receiver's ring rate exceeded")
+		return
+	}
+	// Ringing until the receiver accepts; only they can accept it
+	call := s.registry.newCallLocked(sender, receiver)
 	senderSession.SetInCall(true)
 	receiverSession.SetInCall(true)
-	mu.Unlock()
+	senderSession.SetPeer(receiver, call.id)
+	receiverSession.SetPeer(sender, call.id)
+	s.startRingLocked(call)
+	s.registry.mu.Unlock()
+	s.logger.Printf("Call from %s to %s ringing%s", RedactName(sender), RedactName(receiver), callLabel(call.id))
 
-	receiverSession.Send(SignalingMessage{
+	// If the receiver never hears it ring, nobody is in the call after all
+	s.forward(ctx, senderSession, receiverSession, SignalingMessage{
 		Type:     "call",
 		Sender:   sender,
 		Receiver: receiver,
+		CallID:   call.id,
+	}, func() {
+		s.registry.mu.Lock()
+		defer s.registry.mu.Unlock()
+		if s.registry.calls[call.id] != call || call.accepted {
+			return
+		}
+		s.registry.endCallLocked(call, CallPeerDisconnected)
+		s.registry.leaveCallLocked(sender, call)
+		s.registry.leaveCallLocked(receiver, call)
+		s.registry.recordMissedCall(receiver, sender, "offline")
 	})
-	BroadcastActiveUsers(signalingLogger)
+	s.registry.Broadcast()
 }
 
 // HandleCancelCall cancels an ongoing call between two users
@@ -244,7 +632,7 @@ func HandleCall(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log
 //
 // CALL CANCELLATION:
 // ==================
-// 1. Validates both users exist
+// 1. Validates the sender is in a call with the receiver, as for a hangUp
 // 2. Resets both users' call status to "available"
 // 3. Notifies target user that call was cancelled
 // 4. Broadcasts updated user list to all clients
@@ -260,26 +648,35 @@ func HandleCall(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log
 // - Resets call status for both users
 // - Makes users available for new calls
 // - Maintains consistent state across clients
-func HandleCancelCall(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleCancelCall(ctx context.Context, conn Conn, msg SignalingMessage) {
+	// Between a transfer's target and the user transferring, this ends
+	// the transfer only (see transfer.go)
+	if s.handleTransferReply(conn, msg) {
+		return
+	}
+
 	sender := msg.Sender
 	receiver := msg.Receiver
-	mu.Lock()
-	senderSession, senderExists := nameToUserSession[sender]
-	receiverSession, receiverExists := nameToUserSession[receiver]
-	if !senderExists || !receiverExists {
-		mu.Unlock()
+	s.registry.mu.Lock()
+	call := s.registry.hangUpLocked(conn, sender, receiver)
+	senderSession := s.registry.nameToUserSession[sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	s.registry.mu.Unlock()
+	if call == nil {
+		s.refuseHangUp(ctx, conn, msg)
 		return
 	}
-	senderSession.SetInCall(false)
-	receiverSession.SetInCall(false)
-	mu.Unlock()
+	s.logger.Printf("Call between %s and %s cancelled by %s%s", RedactName(sender), RedactName(receiver), RedactName(sender), callLabel(call.id))
 
-	receiverSession.Send(SignalingMessage{
-		Type:     "cancelCall",
-		Sender:   sender,
-		Receiver: receiver,
-	})
-	BroadcastActiveUsers(signalingLogger)
+	if receiverExists {
+		s.forward(ctx, senderSession, receiverSession, SignalingMessage{
+			Type:     "cancelCall",
+			Sender:   sender,
+			Receiver: receiver,
+			CallID:   call.id,
+		}, nil)
+	}
+	s.registry.Broadcast()
 }
 
 // HandleAcceptCall marks the call as accepted by the receiver
@@ -287,10 +684,18 @@ func HandleCancelCall(conn *websocket.Conn, msg SignalingMessage, signalingLogge
 //
 // CALL ACCEPTANCE:
 // ================
-// 1. Validates receiver exists
+// 1. Validates the sender is being called by the receiver
 // 2. Forwards acceptance message to caller
 // 3. Initiates WebRTC connection establishment
 //
+// VALIDATION:
+// ===========
+// The sender must be the user of the connection and the callee of a
+// ringing call from the receiver (recorded by HandleCall). Any other
+// acceptCall is answered with an error "noPendingCall" and not forwarded,
+// so a client can't make another user believe their call was accepted. A
+// call can only be accepted once.
+//
 // WEBRTC COORDINATION:
 // ====================
 // This message triggers the start of WebRTC signaling:
@@ -303,21 +708,46 @@ func HandleCancelCall(conn *websocket.Conn, msg SignalingMessage, signalingLogge
 // Caller -> Server -> Receiver: "call"
 // Receiver -> Server -> Caller: "acceptCall"
 // Then WebRTC signaling begins...
-func HandleAcceptCall(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleAcceptCall(ctx context.Context, conn Conn, msg SignalingMessage) {
 	sender := msg.Sender
 	receiver := msg.Receiver
-	mu.RLock()
-	receiverSession, receiverExists := nameToUserSession[receiver]
-	mu.RUnlock()
-	if !receiverExists {
+	s.registry.mu.Lock()
+	senderSession, connUser, owned := s.registry.connSessionLocked(conn)
+	call := s.registry.ringingCallLocked(sender)
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	// A callId naming another call is a late accept for one that ended
+	if !owned || connUser != sender || call == nil || call.caller != receiver || !receiverExists ||
+		(msg.CallID != "" && msg.CallID != call.id) {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Rejecting acceptCall from %s to %s: no such call ringing%s", RedactName(sender), RedactName(receiver), callLabel(msg.CallID))
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "error",
+			Receiver: sender,
+			Error:    "noPendingCall",
+			Data:     map[string]string{"error": "noPendingCall", "type": "acceptCall"},
+		}, msg.Version)
+		return
+	}
+	// A transfer target accepting takes over the call (see transfer.go)
+	if s.completeTransferLocked(ctx, sender) {
+		s.registry.mu.Unlock()
+		s.registry.Broadcast()
 		return
 	}
+	call.accepted = true
+	history.callAnswered(call)
+	if call.ring != nil {
+		call.ring.Stop()
+	}
+	s.registry.mu.Unlock()
+	s.logger.Printf("Call from %s to %s accepted%s", RedactName(receiver), RedactName(sender), callLabel(call.id))
 
-	receiverSession.Send(SignalingMessage{
+	s.forward(ctx, senderSession, receiverSession, SignalingMessage{
 		Type:     "acceptCall",
 		Sender:   sender,
 		Receiver: receiver,
-	})
+		CallID:   call.id,
+	}, nil)
 }
 
 // HandleOffer forwards an SDP offer from the sender to the receiver
@@ -345,34 +775,53 @@ func HandleAcceptCall(conn *websocket.Conn, msg SignalingMessage, signalingLogge
 // - Logs offer content for debugging
 // - Handles send errors gracefully
 // - Provides detailed logging for troubleshooting
-func HandleOffer(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleOffer(ctx context.Context, conn Conn, msg SignalingMessage) {
 	sender := msg.Sender
 	receiver := msg.Receiver
-	offer := msg.Data
 
-	signalingLogger.Printf("Received offer from %s to %s", sender, receiver)
+	s.logger.Printf("Received offer from %s to %s%s", RedactName(sender), RedactName(receiver), callLabel(msg.CallID))
 
-	mu.RLock()
-	receiverSession, receiverExists := nameToUserSession[receiver]
-	mu.RUnlock()
+	// Only the two users of an accepted call may exchange these (see callauth.go)
+	if !s.callMessageAllowed(ctx, conn, msg) || !s.payloadAllowed(ctx, conn, msg) {
+		return
+	}
+	// Tag it with its negotiation epoch so stragglers from before an ICE
+	// restart can be told apart (see icerestart.go)
+	epoch, ok := s.negotiationEpoch(msg)
+	if !ok {
+		return
+	}
+	callID := s.callID(msg)
+	// Server-side policy may rewrite or veto it (see intercept.go)
+	msg, ok = s.intercept(ctx, conn, msg)
+	if !ok {
+		return
+	}
+
+	s.registry.mu.RLock()
+	senderSession := s.registry.nameToUserSession[sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	s.registry.mu.RUnlock()
 
 	if !receiverExists {
-		signalingLogger.Printf("Receiver %s not found for offer from %s", receiver, sender)
+		s.logger.Printf("Receiver %s not found for offer from %s%s", RedactName(receiver), RedactName(sender), callLabel(callID))
 		return
 	}
 
-	err := receiverSession.Send(SignalingMessage{
-		Type:     "offer",
-		Sender:   sender,
-		Receiver: receiver,
-		Data:     offer,
-	})
-	if err != nil {
-		signalingLogger.Printf("Error sending offer from %s to %s: %v", sender, receiver, err)
+	forwarded := s.forward(ctx, senderSession, receiverSession, SignalingMessage{
+		Type:             "offer",
+		Sender:           sender,
+		Receiver:         receiver,
+		Data:             msg.Data,
+		NegotiationEpoch: epoch,
+		CallID:           callID,
+	}, nil)
+	if !forwarded {
 		return
 	}
+	s.registry.noteRelayCandidates(callID, msg)
 
-	signalingLogger.Printf("Offer forwarded from %s to %s", sender, receiver)
+	s.logger.Printf("Offer forwarded from %s to %s%s", RedactName(sender), RedactName(receiver), callLabel(callID))
 }
 
 // HandleAnswer forwards an SDP answer from the sender to the receiver
@@ -400,34 +849,53 @@ func HandleOffer(conn *websocket.Conn, msg SignalingMessage, signalingLogger *lo
 // - Agreed on media parameters
 // - Established connection parameters
 // - Ready to exchange ICE candidates
-func HandleAnswer(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleAnswer(ctx context.Context, conn Conn, msg SignalingMessage) {
 	sender := msg.Sender
 	receiver := msg.Receiver
-	answer := msg.Data
 
-	signalingLogger.Printf("Received answer from %s to %s", sender, receiver)
+	s.logger.Printf("Received answer from %s to %s%s", RedactName(sender), RedactName(receiver), callLabel(msg.CallID))
+
+	// Only the two users of an accepted call may exchange these (see callauth.go)
+	if !s.callMessageAllowed(ctx, conn, msg) || !s.payloadAllowed(ctx, conn, msg) {
+		return
+	}
+	// Tag it with its negotiation epoch so stragglers from before an ICE
+	// restart can be told apart (see icerestart.go)
+	epoch, ok := s.negotiationEpoch(msg)
+	if !ok {
+		return
+	}
+	callID := s.callID(msg)
+	// Server-side policy may rewrite or veto it (see intercept.go)
+	msg, ok = s.intercept(ctx, conn, msg)
+	if !ok {
+		return
+	}
 
-	mu.RLock()
-	receiverSession, receiverExists := nameToUserSession[receiver]
-	mu.RUnlock()
+	s.registry.mu.RLock()
+	senderSession := s.registry.nameToUserSession[sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	s.registry.mu.RUnlock()
 
 	if !receiverExists {
-		signalingLogger.Printf("Receiver %s not found for answer from %s", receiver, sender)
+		s.logger.Printf("Receiver %s not found for answer from %s%s", RedactName(receiver), RedactName(sender), callLabel(callID))
 		return
 	}
 
-	err := receiverSession.Send(SignalingMessage{
-		Type:     "answer",
-		Sender:   sender,
-		Receiver: receiver,
-		Data:     answer,
-	})
-	if err != nil {
-		signalingLogger.Printf("Error sending answer from %s to %s: %v", sender, receiver, err)
+	forwarded := s.forward(ctx, senderSession, receiverSession, SignalingMessage{
+		Type:             "answer",
+		Sender:           sender,
+		Receiver:         receiver,
+		Data:             msg.Data,
+		NegotiationEpoch: epoch,
+		CallID:           callID,
+	}, nil)
+	if !forwarded {
 		return
 	}
+	s.registry.noteRelayCandidates(callID, msg)
 
-	signalingLogger.Printf("Answer forwarded from %s to %s", sender, receiver)
+	s.logger.Printf("Answer forwarded from %s to %s%s", RedactName(sender), RedactName(receiver), callLabel(callID))
 }
 
 // HandleIceCandidate forwards an ICE candidate from the sender to the receiver
@@ -463,34 +931,53 @@ func HandleAnswer(conn *websocket.Conn, msg SignalingMessage, signalingLogger *l
 // - ICE testing finds the optimal path
 // - Fallback to relay if direct connection fails
 // - Minimizes latency and maximizes bandwidth
-func HandleIceCandidate(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleIceCandidate(ctx context.Context, conn Conn, msg SignalingMessage) {
 	sender := msg.Sender
 	receiver := msg.Receiver
-	candidate := msg.Data
 
-	signalingLogger.Printf("Received ICE candidate from %s to %s", sender, receiver)
+	s.logger.Printf("Received ICE candidate from %s to %s%s", RedactName(sender), RedactName(receiver), callLabel(msg.CallID))
 
-	mu.RLock()
-	receiverSession, receiverExists := nameToUserSession[receiver]
-	mu.RUnlock()
+	// Only the two users of an accepted call may exchange these (see callauth.go)
+	if !s.callMessageAllowed(ctx, conn, msg) || !s.payloadAllowed(ctx, conn, msg) {
+		return
+	}
+	// Tag it with its negotiation epoch so stragglers from before an ICE
+	// restart can be told apart (see icerestart.go)
+	epoch, ok := s.negotiationEpoch(msg)
+	if !ok {
+		return
+	}
+	callID := s.callID(msg)
+	// Server-side policy may rewrite or veto it (see intercept.go)
+	msg, ok = s.intercept(ctx, conn, msg)
+	if !ok {
+		return
+	}
+
+	s.registry.mu.RLock()
+	senderSession := s.registry.nameToUserSession[sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	s.registry.mu.RUnlock()
 
 	if !receiverExists {
-		signalingLogger.Printf("Receiver %s not found for ICE candidate from %s", receiver, sender)
+		s.logger.Printf("Receiver %s not found for ICE candidate from %s%s", RedactName(receiver), RedactName(sender), callLabel(callID))
 		return
 	}
 
-	err := receiverSession.Send(SignalingMessage{
-		Type:     "candidate",
-		Sender:   sender,
-		Receiver: receiver,
-		Data:     candidate,
-	})
-	if err != nil {
-		signalingLogger.Printf("Error sending ICE candidate from %s to %s: %v", sender, receiver, err)
+	forwarded := s.forward(ctx, senderSession, receiverSession, SignalingMessage{
+		Type:             "candidate",
+		Sender:           sender,
+		Receiver:         receiver,
+		Data:             msg.Data,
+		NegotiationEpoch: epoch,
+		CallID:           callID,
+	}, nil)
+	if !forwarded {
 		return
 	}
+	s.registry.noteRelayCandidates(callID, msg)
 
-	signalingLogger.Printf("ICE candidate forwarded from %s to %s", sender, receiver)
+	s.logger.Printf("ICE candidate forwarded from %s to %s%s", RedactName(sender), RedactName(receiver), callLabel(callID))
 }
 
 // HandleHangUp ends an active call between two users
@@ -498,11 +985,18 @@ func HandleIceCandidate(conn *websocket.Conn, msg SignalingMessage, signalingLog
 //
 // CALL TERMINATION:
 // =================
-// 1. Validates both users exist
+// 1. Validates the sender is in a call with the receiver
 // 2. Resets both users' call status to "available"
 // 3. Notifies both users that call has ended
 // 4. Broadcasts updated user list to all clients
 //
+// VALIDATION:
+// ===========
+// The sender must be the user of the connection and the receiver their
+// peer in their current call. Any other hangUp is dropped and answered
+// with an error "forbidden", so naming two users can't end calls they
+// have with someone else.
+//
 // WEBRTC CLEANUP:
 // ===============
 // - Terminates WebRTC peer connection
@@ -523,26 +1017,53 @@ func HandleIceCandidate(conn *websocket.Conn, msg SignalingMessage, signalingLog
 // - Users can immediately start new calls
 // - UI is updated to reflect available status
 // - Clean transition from call to idle state
-func HandleHangUp(conn *websocket.Conn, msg SignalingMessage, signalingLogger *log.Logger) {
+func (s *Service) HandleHangUp(ctx context.Context, conn Conn, msg SignalingMessage) {
+	// Between a transfer's target and the user transferring, this ends
+	// the transfer only (see transfer.go)
+	if s.handleTransferReply(conn, msg) {
+		return
+	}
+
+	// A hangUp for a call that has ended mustn't end the next one
+	if !s.callIDAllowed(ctx, conn, msg) {
+		return
+	}
+
 	sender := msg.Sender
 	receiver := msg.Receiver
-	mu.Lock()
-	senderSession, senderExists := nameToUserSession[sender]
-	receiverSession, receiverExists := nameToUserSession[receiver]
-	if !senderExists || !receiverExists {
-		mu.Unlock()
+	s.registry.mu.Lock()
+	call := s.registry.hangUpLocked(conn, sender, receiver)
+	senderSession := s.registry.nameToUserSession[sender]
+	receiverSession, receiverExists := s.registry.nameToUserSession[receiver]
+	s.registry.mu.Unlock()
+	if call == nil {
+		s.refuseHangUp(ctx, conn, msg)
 		return
 	}
-	senderSession.SetInCall(false)
-	receiverSession.SetInCall(false)
-	mu.Unlock()
+	s.logger.Printf("Call between %s and %s hung up by %s%s", RedactName(sender), RedactName(receiver), RedactName(sender), callLabel(call.id))
 
-	receiverSession.Send(SignalingMessage{
-		Type:     "hangUp",
-		Sender:   sender,
-		Receiver: receiver,
-	})
-	BroadcastActiveUsers(signalingLogger)
+	if receiverExists {
+		s.forward(ctx, senderSession, receiverSession, SignalingMessage{
+			Type:     "hangUp",
+			Sender:   sender,
+			Receiver: receiver,
+			CallID:   call.id,
+		}, nil)
+	}
+	s.registry.Broadcast()
+}
+
+// refuseHangUp drops a hangUp or cancelCall that doesn't come from its
+// sender's connection or names a receiver the sender isn't in a call with,
+// and answers it with an error "forbidden"
+func (s *Service) refuseHangUp(ctx context.Context, conn Conn, msg SignalingMessage) {
+	s.logger.Printf("Dropping %s from %s to %s: not in a call together%s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), callLabel(msg.CallID))
+	s.sendToConn(ctx, conn, SignalingMessage{
+		Type:     "error",
+		Receiver: msg.Sender,
+		Error:    "forbidden",
+		Data:     map[string]string{"error": "forbidden", "type": msg.Type},
+	}, msg.Version)
 }
 
 // HandleDisconnect manages user disconnection and session cleanup
@@ -560,8 +1081,9 @@ func HandleHangUp(conn *websocket.Conn, msg SignalingMessage, signalingLogger *l
 // 1. Identifies user by connection address
 // 2. Removes user from active sessions
 // 3. Cleans up session mappings
-// 4. Notifies other users of departure
-// 5. Broadcasts updated user list
+// 4. Ends the user's call, sending the peer a hangUp
+// 5. Notifies other users of departure
+// 6. Broadcasts updated user list
 //
 // RESOURCE MANAGEMENT:
 // ===================
@@ -576,30 +1098,58 @@ func HandleHangUp(conn *websocket.Conn, msg SignalingMessage, signalingLogger *l
 // - Logs disconnection events for monitoring
 // - Continues operation even if cleanup fails
 // - Maintains system integrity
-func HandleDisconnect(conn *websocket.Conn, signalingLogger *log.Logger) {
+func (s *Service) HandleDisconnect(ctx context.Context, conn Conn) {
 	// Find user by connection address
 	// This reverse lookup helps identify which user disconnected
-	mu.Lock()
-	userName, exists := sessionIdToName[conn.RemoteAddr().String()]
+	// Only the session this connection serves is removed, so a second
+	// cleanup for the same connection (leave, then the socket closing)
+	// is a no-op even if the user has rejoined in between
+	s.registry.mu.Lock()
+	session, userName, exists := s.registry.connSessionLocked(conn)
 	if !exists {
-		mu.Unlock()
+		s.registry.mu.Unlock()
 		return
 	}
 
 	// Clean up session data
 	// Remove user from all session mappings
-	delete(nameToUserSession, userName)
-	delete(sessionIdToName, conn.RemoteAddr().String())
-	mu.Unlock()
+	delete(s.registry.nameToUserSession, userName)
+	delete(s.registry.sessionIdToName, conn.RemoteAddr().String())
+	s.registry.missRingingCallLocked(session, "offline")
+	// A user in a call frees their peer, who would otherwise stay busy
+	peer, callID := s.registry.releasePeerLocked(session)
+	s.registry.mu.Unlock()
 
-	signalingLogger.Printf("User %s disconnected", userName)
+	// Keep unacknowledged messages around in case the client reconnects
+	session.stopWriters()
+	retainOutbox(session)
+
+	s.logger.Printf("User %s disconnected", RedactName(userName))
+	s.registry.publishUserLeft(userName, events.LeftDisconnected)
+	s.hangUpPeer(ctx, userName, peer, callID)
 
 	// Broadcast updated user list to remaining clients
 	// This ensures all clients have current information
-	BroadcastActiveUsers(signalingLogger)
+	s.registry.Broadcast()
+}
+
+// hangUpPeer tells the peer released by releasePeerLocked that the call
+// with a departed user has ended, as if that user had hung up. The user
+// list broadcast that follows shows the peer as available again.
+func (s *Service) hangUpPeer(ctx context.Context, name string, peer *UserSession, callID string) {
+	if peer == nil {
+		return
+	}
+	s.logger.Printf("Call between %s and %s ended: %s left%s", RedactName(name), RedactName(peer.Name), RedactName(name), callLabel(callID))
+	peer.Send(ctx, SignalingMessage{
+		Type:     "hangUp",
+		Sender:   name,
+		Receiver: peer.Name,
+		CallID:   callID,
+	})
 }
 
-// BroadcastActiveUsers sends the current user list to all connected clients
+// Broadcast sends the current user list to all of the registry's clients
 // This function ensures all clients have synchronized user information
 //
 // BROADCAST PURPOSE:
@@ -611,17 +1161,17 @@ func HandleDisconnect(conn *websocket.Conn, signalingLogger *log.Logger) {
 //
 // MESSAGE CONTENT:
 // ================
-// - List of all currently connected users
-// - Call status for each user (available/busy)
-// - User names for display purposes
+// - v1 clients: list of all currently connected users
+// - v2 clients: only the users added, removed or updated (see broadcast.go)
+// - Call status and presence status for each user
 // - Structured data for easy client processing
 //
 // PERFORMANCE CONSIDERATIONS:
 // ===========================
 // - Uses read lock for concurrent access
-// - Efficiently builds user list once
-// - Sends same data to all clients
-// - Minimizes server load during broadcasts
+// - Efficiently builds user list and deltas once
+// - Returns immediately; a pool of workers fans out to per-session queues
+// - A slow client only delays its own updates
 //
 // CLIENT SYNCHRONIZATION:
 // =======================
@@ -629,29 +1179,34 @@ func HandleDisconnect(conn *websocket.Conn, signalingLogger *log.Logger) {
 // - UI updates happen simultaneously
 // - Prevents inconsistent user states
 // - Enables coordinated user interactions
-func BroadcastActiveUsers(signalingLogger *log.Logger) {
-	mu.RLock()
-	activeUsers := make([]ActiveUser, 0, len(nameToUserSession))
-	for name, session := range nameToUserSession {
-		activeUsers = append(activeUsers, ActiveUser{
-			Name:   name,
-			InCall: session.InCall,
-		})
+func (r *Registry) Broadcast() {
+	r.broadcasterOnce.Do(r.startBroadcaster)
+
+	// Held until the job is queued so jobs reach the worker in the
+	// same order their deltas were computed
+	r.lastBroadcastMu.Lock()
+	defer r.lastBroadcastMu.Unlock()
+
+	r.mu.RLock()
+	activeUsers := r.listActiveUsersLocked()
+	r.mu.RUnlock()
+
+	deltas := r.diffActiveUsers(activeUsers)
+	if len(deltas) == 0 {
+		return
 	}
-	mu.RUnlock()
 
 	// Send updated user list to all connected clients
 	// This ensures everyone has current information
-	message := SignalingMessage{
-		Type: "activeUsers",
-		Data: ActiveUsers{Users: activeUsers},
-	}
-
-	mu.RLock()
-	for _, session := range nameToUserSession {
-		if session.Conn != nil {
-			session.Send(message)
-		}
+	// Once the registry is closed there is no worker to take the job
+	select {
+	case r.broadcastJobs <- broadcastJob{
+		full: SignalingMessage{
+			Type: "activeUsers",
+			Data: ActiveUsers{Users: activeUsers},
+		},
+		deltas: deltas,
+	}:
+	case <-r.ctx.Done():
 	}
-	mu.RUnlock()
 }
@@ -0,0 +1,101 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+)
+
+// equalJSON reports whether got decodes to the same value as want encodes to
+func equalJSON(t *testing.T, got json.RawMessage, want any) bool {
+	t.Helper()
+	var gotValue, wantValue any
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("decode %s: %v", got, err)
+	}
+	encoded, _ := json.Marshal(want)
+	json.Unmarshal(encoded, &wantValue)
+	return reflect.DeepEqual(gotValue, wantValue)
+}
+
+// A call, its offer, answer and candidates go from one Go client to the
+// other unchanged
+func TestCallAndNegotiationRoundTrip(t *testing.T) {
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+	lists := make(chan []webrtc.ActiveUser, 16)
+	alice.OnActiveUsers(func(users []webrtc.ActiveUser) { lists <- users })
+	bob := dial(t, url, client.Options{Username: "bob"})
+
+	for {
+		users := receive(t, lists, "a user list with bob")
+		names := make([]string, 0, len(users))
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		if slices.Contains(names, "bob") {
+			break
+		}
+	}
+
+	startCall(t, alice, bob)
+
+	offers := make(chan json.RawMessage, 1)
+	bob.OnOffer(func(from string, offer json.RawMessage) {
+		if from == "alice" {
+			offers <- offer
+		}
+	})
+	if err := alice.SendOffer("bob", testOffer); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+	if offer := receive(t, offers, "offer"); !equalJSON(t, offer, testOffer) {
+		t.Fatalf("bob got offer %s, want %v", offer, testOffer)
+	}
+
+	answers := make(chan json.RawMessage, 1)
+	alice.OnAnswer(func(from string, answer json.RawMessage) {
+		if from == "bob" {
+			answers <- answer
+		}
+	})
+	answer := webrtc.AnswerPayload{Type: "answer", SDP: testOffer["sdp"]}
+	if err := bob.SendAnswer("alice", answer); err != nil {
+		t.Fatalf("send answer: %v", err)
+	}
+	if got := receive(t, answers, "answer"); !equalJSON(t, got, answer) {
+		t.Fatalf("alice got answer %s, want %+v", got, answer)
+	}
+
+	candidates := make(chan json.RawMessage, 1)
+	bob.OnCandidate(func(from string, candidate json.RawMessage) {
+		if from == "alice" {
+			candidates <- candidate
+		}
+	})
+	candidate := map[string]any{"candidate": "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host", "sdpMid": "0", "sdpMLineIndex": 0}
+	if err := alice.SendCandidate("bob", candidate); err != nil {
+		t.Fatalf("send candidate: %v", err)
+	}
+	if got := receive(t, candidates, "candidate"); !equalJSON(t, got, candidate) {
+		t.Fatalf("bob got candidate %s, want %v", got, candidate)
+	}
+}
+
+// A call to a user who isn't connected fails back to the caller
+func TestCallToUnknownUserFails(t *testing.T) {
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice"})
+	failures := make(chan string, 1)
+	alice.OnCallFailed(func(to, reason string) { failures <- to })
+	if err := alice.Call("nobody"); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if to := receive(t, failures, "callFailed"); to != "nobody" {
+		t.Fatalf("call failed to %q, want nobody", to)
+	}
+}
@@ -0,0 +1,88 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitGoroutines waits for the number of goroutines to fall to at most n,
+// and fails with every goroutine's stack if it doesn't
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > n; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			stacks := make([]byte, 1<<20)
+			stacks = stacks[:runtime.Stack(stacks, true)]
+			t.Fatalf("%d goroutines left, want at most %d:\n%s", runtime.NumGoroutine(), n, stacks)
+		}
+	}
+}
+
+// The broadcaster of a service stops with it, and broadcasts after the
+// shutdown neither block nor start it again
+func TestShutdownStopsBroadcaster(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for range 50 {
+		s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+		session := newTestSession(s, "alice", newListConn(50001))
+		s.Registry().Add(session)
+		s.Registry().Broadcast()
+		s.Shutdown()
+
+		s.Registry().Remove("alice")
+		s.Registry().Broadcast()
+		s.Registry().Close()
+	}
+	waitGoroutines(t, before)
+}
+
+// The stale session reaper of a service stops with it
+func TestShutdownStopsReaper(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for range 50 {
+		s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+		s.startReaper()
+		s.Shutdown()
+		// Not restarted once the service is shut down
+		s.startReaper()
+	}
+	waitGoroutines(t, before)
+}
+
+// Shutdown ends every goroutine of the sessions it closes: the outbound
+// and presence writers of v1 and v2 sessions, and the v2 sessions held
+// for a resume
+func TestShutdownEndsSessionGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for range 10 {
+		s := NewService(NewRegistry(), log.New(io.Discard, "", 0))
+		var served sync.WaitGroup
+		for i := range 20 {
+			version := ProtocolV1 + i%2
+			conn := &scriptConn{
+				listConn: newListConn(50000 + i),
+				script:   []SignalingMessage{{Type: "join", Sender: fmt.Sprintf("user%d", i), Version: version}},
+			}
+			served.Add(1)
+			go func() {
+				defer served.Done()
+				s.serveConn(context.Background(), conn, version, "")
+			}()
+		}
+		for deadline := time.Now().Add(5 * time.Second); s.Registry().Len() < 20; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d of 20 users joined", s.Registry().Len())
+			}
+		}
+
+		s.Shutdown()
+		served.Wait()
+	}
+	waitGoroutines(t, before)
+}
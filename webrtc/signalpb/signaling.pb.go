@@ -0,0 +1,224 @@
+// Signaling protocol for clients that speak gRPC instead of WebSocket.
+//
+// SignalingMessage mirrors webrtc.SignalingMessage field for field, and the
+// Signal stream carries exactly the same message types as /signal, so a gRPC
+// client and a WebSocket client can call each other.
+//
+// Regenerate with protoc-gen-go and protoc-gen-go-grpc using
+// paths=source_relative from this directory.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: signaling.proto
+
+package signalpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// SignalingMessage is one signaling message (join, call, offer, candidate...).
+type SignalingMessage struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Type     string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Sender   string                 `protobuf:"bytes,2,opt,name=sender,proto3" json:"sender,omitempty"`
+	Receiver string                 `protobuf:"bytes,3,opt,name=receiver,proto3" json:"receiver,omitempty"`
+	// Arbitrary JSON payload: SDP, ICE candidate, user list...
+	Data    *structpb.Value `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Version int32           `protobuf:"varint,5,opt,name=version,proto3" json:"version,omitempty"`
+	Error   string          `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	Seq     uint64          `protobuf:"varint,7,opt,name=seq,proto3" json:"seq,omitempty"`
+	Room    string          `protobuf:"bytes,8,opt,name=room,proto3" json:"room,omitempty"`
+	// Negotiation epoch of an offer, answer or candidate, bumped by iceRestart
+	NegotiationEpoch uint64 `protobuf:"varint,9,opt,name=negotiation_epoch,json=negotiationEpoch,proto3" json:"negotiation_epoch,omitempty"`
+	// Call the message belongs to, assigned by the server when the call starts
+	CallId        string `protobuf:"bytes,10,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalingMessage) Reset() {
+	*x = SignalingMessage{}
+	mi := &file_signaling_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalingMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalingMessage) ProtoMessage() {}
+
+func (x *SignalingMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_signaling_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalingMessage.ProtoReflect.Descriptor instead.
+func (*SignalingMessage) Descriptor() ([]byte, []int) {
+	return file_signaling_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SignalingMessage) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *SignalingMessage) GetSender() string {
+	if x != nil {
+		return x.Sender
+	}
+	return ""
+}
+
+func (x *SignalingMessage) GetReceiver() string {
+	if x != nil {
+		return x.Receiver
+	}
+	return ""
+}
+
+func (x *SignalingMessage) GetData() *structpb.Value {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *SignalingMessage) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *SignalingMessage) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *SignalingMessage) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *SignalingMessage) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *SignalingMessage) GetNegotiationEpoch() uint64 {
+	if x != nil {
+		return x.NegotiationEpoch
+	}
+	return 0
+}
+
+func (x *SignalingMessage) GetCallId() string {
+	if x != nil {
+		return x.CallId
+	}
+	return ""
+}
+
+var File_signaling_proto protoreflect.FileDescriptor
+
+const file_signaling_proto_rawDesc = "" +
+	"\n" +
+	"\x0fsignaling.proto\x12\fsignaling.v1\x1a\x1cgoogle/protobuf/struct.proto\"\xa2\x02\n" +
+	"\x10SignalingMessage\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x16\n" +
+	"\x06sender\x18\x02 \x01(\tR\x06sender\x12\x1a\n" +
+	"\breceiver\x18\x03 \x01(\tR\breceiver\x12*\n" +
+	"\x04data\x18\x04 \x01(\v2\x16.google.protobuf.ValueR\x04data\x12\x18\n" +
+	"\aversion\x18\x05 \x01(\x05R\aversion\x12\x14\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\x12\x10\n" +
+	"\x03seq\x18\a \x01(\x04R\x03seq\x12\x12\n" +
+	"\x04room\x18\b \x01(\tR\x04room\x12+\n" +
+	"\x11negotiation_epoch\x18\t \x01(\x04R\x10negotiationEpoch\x12\x17\n" +
+	"\acall_id\x18\n" +
+	" \x01(\tR\x06callId2Y\n" +
+	"\tSignaling\x12L\n" +
+	"\x06Signal\x12\x1e.signaling.v1.SignalingMessage\x1a\x1e.signaling.v1.SignalingMessage(\x010\x01B\x1bZ\x19go-server/webrtc/signalpbb\x06proto3"
+
+var (
+	file_signaling_proto_rawDescOnce sync.Once
+	file_signaling_proto_rawDescData []byte
+)
+
+func file_signaling_proto_rawDescGZIP() []byte {
+	file_signaling_proto_rawDescOnce.Do(func() {
+		file_signaling_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_signaling_proto_rawDesc), len(file_signaling_proto_rawDesc)))
+	})
+	return file_signaling_proto_rawDescData
+}
+
+var file_signaling_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_signaling_proto_goTypes = []any{
+	(*SignalingMessage)(nil), // 0: signaling.v1.SignalingMessage
+	(*structpb.Value)(nil),   // 1: google.protobuf.Value
+}
+var file_signaling_proto_depIdxs = []int32{
+	1, // 0: signaling.v1.SignalingMessage.data:type_name -> google.protobuf.Value
+	0, // 1: signaling.v1.Signaling.Signal:input_type -> signaling.v1.SignalingMessage
+	0, // 2: signaling.v1.Signaling.Signal:output_type -> signaling.v1.SignalingMessage
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_signaling_proto_init() }
+func file_signaling_proto_init() {
+	if File_signaling_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_signaling_proto_rawDesc), len(file_signaling_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_signaling_proto_goTypes,
+		DependencyIndexes: file_signaling_proto_depIdxs,
+		MessageInfos:      file_signaling_proto_msgTypes,
+	}.Build()
+	File_signaling_proto = out.File
+	file_signaling_proto_goTypes = nil
+	file_signaling_proto_depIdxs = nil
+}
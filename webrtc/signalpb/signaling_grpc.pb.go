@@ -0,0 +1,134 @@
+// Signaling protocol for clients that speak gRPC instead of WebSocket.
+//
+// SignalingMessage mirrors webrtc.SignalingMessage field for field, and the
+// Signal stream carries exactly the same message types as /signal, so a gRPC
+// client and a WebSocket client can call each other.
+//
+// Regenerate with protoc-gen-go and protoc-gen-go-grpc using
+// paths=source_relative from this directory.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: signaling.proto
+
+package signalpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Signaling_Signal_FullMethodName = "/signaling.v1.Signaling/Signal"
+)
+
+// SignalingClient is the client API for Signaling service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Signaling exchanges signaling messages with the server.
+type SignalingClient interface {
+	// Signal opens a signaling session. The client sends a join first, exactly
+	// as it would over WebSocket. The protocol version may be passed in the
+	// "signal-version" metadata and a resume token in "signal-resume".
+	Signal(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SignalingMessage, SignalingMessage], error)
+}
+
+type signalingClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSignalingClient(cc grpc.ClientConnInterface) SignalingClient {
+	return &signalingClient{cc}
+}
+
+func (c *signalingClient) Signal(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SignalingMessage, SignalingMessage], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Signaling_ServiceDesc.Streams[0], Signaling_Signal_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SignalingMessage, SignalingMessage]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Signaling_SignalClient = grpc.BidiStreamingClient[SignalingMessage, SignalingMessage]
+
+// SignalingServer is the server API for Signaling service.
+// All implementations must embed UnimplementedSignalingServer
+// for forward compatibility.
+//
+// Signaling exchanges signaling messages with the server.
+type SignalingServer interface {
+	// Signal opens a signaling session. The client sends a join first, exactly
+	// as it would over WebSocket. The protocol version may be passed in the
+	// "signal-version" metadata and a resume token in "signal-resume".
+	Signal(grpc.BidiStreamingServer[SignalingMessage, SignalingMessage]) error
+	mustEmbedUnimplementedSignalingServer()
+}
+
+// UnimplementedSignalingServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSignalingServer struct{}
+
+func (UnimplementedSignalingServer) Signal(grpc.BidiStreamingServer[SignalingMessage, SignalingMessage]) error {
+	return status.Error(codes.Unimplemented, "method Signal not implemented")
+}
+func (UnimplementedSignalingServer) mustEmbedUnimplementedSignalingServer() {}
+func (UnimplementedSignalingServer) testEmbeddedByValue()                   {}
+
+// UnsafeSignalingServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SignalingServer will
+// result in compilation errors.
+type UnsafeSignalingServer interface {
+	mustEmbedUnimplementedSignalingServer()
+}
+
+func RegisterSignalingServer(s grpc.ServiceRegistrar, srv SignalingServer) {
+	// If the following call panics, it indicates UnimplementedSignalingServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Signaling_ServiceDesc, srv)
+}
+
+func _Signaling_Signal_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SignalingServer).Signal(&grpc.GenericServerStream[SignalingMessage, SignalingMessage]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Signaling_SignalServer = grpc.BidiStreamingServer[SignalingMessage, SignalingMessage]
+
+// Signaling_ServiceDesc is the grpc.ServiceDesc for Signaling service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Signaling_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "signaling.v1.Signaling",
+	HandlerType: (*SignalingServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Signal",
+			Handler:       _Signaling_Signal_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "signaling.proto",
+}
@@ -0,0 +1,58 @@
+/*
+WebRTC Signaling Session Snapshot
+=================================
+
+This file gives the embedding server a read-only view of the signaling
+sessions, for its admin endpoints.
+
+WHY IS THIS NEEDED?
+===================
+The session maps are unexported and guarded by the registry's locks, so
+nothing outside the package could tell who is connected or in a call. A
+snapshot (Registry.Snapshot) copies what an operator needs under those
+locks; changing it doesn't affect the sessions.
+*/
+
+package webrtc
+
+import "time"
+
+// SessionInfo describes one signaling session at the time of the snapshot
+type SessionInfo struct {
+	Tenant         string    `json:"tenant,omitempty"` // See tenants.go, empty for the default tenant
+	Username       string    `json:"username"`
+	SessionID      string    `json:"sessionId,omitempty"` // Address of the current connection, empty while detached
+	RemoteIP       string    `json:"remoteIP"`            // Client IP of the latest connection, behind any trusted proxies
+	ConnectedSince time.Time `json:"connectedSince"`      // When the user joined; a resumed session keeps it
+	LastActivity   time.Time `json:"lastActivity"`        // When a message or pong was last read from the user
+	InCall         bool      `json:"inCall"`
+	Peer           string    `json:"peer,omitempty"`   // User on the other end of the current call
+	CallID         string    `json:"callId,omitempty"` // ID of the current call, see callid.go
+	Status         string    `json:"status"`           // Presence status, see presence.go
+	Version        int       `json:"version"`          // Negotiated signaling protocol version
+	Detached       bool      `json:"detached"`         // Connection lost, waiting for the client to resume
+	Guest          bool      `json:"guest,omitempty"`  // Joined without a name, see guests.go
+}
+
+// info copies the session's state into a SessionInfo
+func (u *UserSession) info() SessionInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	info := SessionInfo{
+		Username:       u.Name,
+		RemoteIP:       u.ClientIP,
+		ConnectedSince: u.ConnectedAt,
+		LastActivity:   u.LastActivity,
+		InCall:         u.InCall,
+		Peer:           u.Peer,
+		CallID:         u.CallID,
+		Status:         u.Status,
+		Version:        u.Version,
+		Detached:       u.Conn == nil,
+		Guest:          u.Guest,
+	}
+	if u.Conn != nil {
+		info.SessionID = u.Conn.RemoteAddr().String()
+	}
+	return info
+}
@@ -0,0 +1,43 @@
+/*
+WebRTC Signaling Source Policy Hook
+===================================
+
+This file lets the embedding server refuse signaling clients by where they
+connect from, e.g. by country, before they get a WebSocket.
+
+WHY IS THIS NEEDED?
+===================
+Some deployments must not serve certain regions. The server decides from
+its GeoIP databases (see GEO POLICY in main.go); the package only asks it
+about each client IP before the upgrade.
+
+WHERE THE POLICY IS CHECKED:
+============================
+- "websocket": before the WebSocket upgrade (403)
+- "sse": before a new SSE session is opened (403), so the fallback
+  transport isn't a way around the policy
+
+Refusals aren't logged here: a refused client tends to retry, so the
+policy function counts them and rate-limits its own log lines.
+*/
+
+package webrtc
+
+// SourcePolicyFunc reports whether a client IP may use the signaling
+// service; check names where the check is made
+type SourcePolicyFunc func(clientIP, check string) bool
+
+// sourcePolicy is the current policy, set once at startup by
+// ConfigureSourcePolicy; nil allows everyone
+var sourcePolicy SourcePolicyFunc
+
+// ConfigureSourcePolicy sets the policy client IPs are checked against
+func ConfigureSourcePolicy(fn SourcePolicyFunc) {
+	sourcePolicy = fn
+}
+
+// sourceAllowed reports whether a client IP passes the policy, if one is
+// configured
+func sourceAllowed(clientIP, check string) bool {
+	return sourcePolicy == nil || sourcePolicy(clientIP, check)
+}
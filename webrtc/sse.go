@@ -0,0 +1,359 @@
+/*
+WebRTC Signaling over Server-Sent Events
+========================================
+
+This file implements a fallback signaling transport for networks where
+WebSockets don't get through: server-to-client messages are streamed with
+Server-Sent Events and client-to-server messages are plain HTTP POSTs.
+
+WHY IS THIS NEEDED?
+===================
+Some corporate proxies terminate WebSocket upgrades but let ordinary HTTPS
+requests through. SSE is a normal long-lived GET response, so it passes
+those proxies and browsers support it natively with EventSource.
+
+HOW IT WORKS:
+=============
+1. GET /signal/events opens the event stream. The first event ("session")
+   carries the session id the client uses for everything else.
+2. POST /signal/send?session=<id> sends one SignalingMessage as a JSON body.
+3. Each SSE session is wrapped in an sseConn, which implements Conn, and is
+   served by the same serveConn loop as WebSocket and gRPC connections. SSE
+   and WebSocket users can therefore call each other, and activeUsers
+   broadcasts reach SSE clients like any other.
+4. If the stream drops, GET /signal/events?session=<id> reattaches to the
+   session; messages sent in the meantime are buffered.
+
+KEEPALIVES AND IDLE TIMEOUT:
+============================
+- A comment line is sent every keepalive interval so proxies don't time out
+  the quiet stream and the server notices dead clients.
+- A session with no open stream for the idle timeout is closed and the user
+  disconnected, since there is no socket close to tell us the client left.
+
+The query parameters ?v= and ?resume= work on GET /signal/events as they do
+on the WebSocket URL. Messages are always JSON.
+*/
+
+package webrtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Default SSE settings
+const (
+	DefaultSSEKeepalive   = 15 * time.Second // Interval between keepalive comments
+	DefaultSSEIdleTimeout = 30 * time.Second // How long a session may go without an open stream
+)
+
+// sseEventBuffer is how many events a session buffers while its stream is
+// reconnecting; the outbound queue holds the rest
+const sseEventBuffer = 64
+
+var (
+	// Current SSE configuration, set once at startup by ConfigureSSE
+	sseKeepalive   = DefaultSSEKeepalive
+	sseIdleTimeout = DefaultSSEIdleTimeout
+
+	// sseSessions maps session ids to open SSE sessions
+	sseSessions   = make(map[string]*sseConn)
+	sseSessionsMu sync.Mutex
+)
+
+// ConfigureSSE sets the keepalive interval and idle timeout of SSE sessions
+func ConfigureSSE(keepalive, idleTimeout time.Duration) {
+	sseKeepalive = keepalive
+	sseIdleTimeout = idleTimeout
+}
+
+// sseConn is a signaling connection over SSE and HTTP POST
+type sseConn struct {
+	id       string
+	addr     sseAddr
+	clientIP string
+
+	incoming chan SignalingMessage // Messages POSTed by the client
+	events   chan []byte           // Encoded messages waiting for the stream
+	done     chan struct{}
+
+	mu        sync.Mutex
+	deadline  time.Time     // Write deadline set by the outbound writer
+	stream    chan struct{} // Closed to stop the currently attached stream
+	idleTimer *time.Timer   // Closes the session while no stream is attached
+	closeOnce sync.Once
+	closeMsg  string // Reason sent in the final "close" event, if any
+}
+
+// sseAddr identifies an SSE session in logs and session lookups. Each
+// session needs its own address because several POSTs and streams from the
+// same client share nothing else.
+type sseAddr string
+
+func (a sseAddr) Network() string { return "sse" }
+func (a sseAddr) String() string  { return string(a) }
+
+// newSSEConn creates and registers a session for a client
+func newSSEConn(remoteAddr, clientIP string) (*sseConn, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	c := &sseConn{
+		id:       id,
+		addr:     sseAddr(remoteAddr + "/sse/" + id),
+		clientIP: clientIP,
+		incoming: make(chan SignalingMessage, sseEventBuffer),
+		events:   make(chan []byte, sseEventBuffer),
+		done:     make(chan struct{}),
+	}
+	sseSessionsMu.Lock()
+	sseSessions[id] = c
+	sseSessionsMu.Unlock()
+	return c, nil
+}
+
+// lookupSSEConn returns the open session with the given id
+func lookupSSEConn(id string) *sseConn {
+	sseSessionsMu.Lock()
+	defer sseSessionsMu.Unlock()
+	return sseSessions[id]
+}
+
+func (c *sseConn) ReadMessage(msg *SignalingMessage) error {
+	select {
+	case <-c.done:
+		return errConnClosed
+	case *msg = <-c.incoming:
+		return nil
+	}
+}
+
+func (c *sseConn) WriteMessage(msg SignalingMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	// Block like a socket write would, until the deadline
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.events <- data:
+		payloadBytesWritten.Add(uint64(len(data)))
+		return nil
+	case <-c.done:
+		return errConnClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *sseConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *sseConn) CloseWithCode(code int, reason string) {
+	c.close(fmt.Sprintf("%d %s", code, reason))
+}
+
+func (c *sseConn) Close() error {
+	c.close("")
+	return nil
+}
+
+func (c *sseConn) close(reason string) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closeMsg = reason
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		c.mu.Unlock()
+		close(c.done)
+
+		sseSessionsMu.Lock()
+		delete(sseSessions, c.id)
+		sseSessionsMu.Unlock()
+	})
+}
+
+func (c *sseConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *sseConn) ClientIP() string {
+	return c.clientIP
+}
+
+// attach makes a new stream the session's only stream and stops the idle
+// timer. The returned channel is closed when another stream takes over.
+func (c *sseConn) attach() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream != nil {
+		close(c.stream)
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.stream = make(chan struct{})
+	return c.stream
+}
+
+// detach records that a stream ended. If it was the current stream, the
+// session is closed unless the client reattaches within the idle timeout.
+func (c *sseConn) detach(stream chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream != stream {
+		return
+	}
+	c.stream = nil
+	c.idleTimer = time.AfterFunc(sseIdleTimeout, func() {
+		c.close("")
+	})
+}
+
+// HandleSSEEvents serves GET /signal/events, streaming a session's messages
+// as Server-Sent Events. Without ?session= it starts a new session.
+func (s *Service) HandleSSEEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	var c *sseConn
+	if id := query.Get("session"); id != "" {
+		// Reattach to an existing session after the stream dropped
+		if c = lookupSSEConn(id); c == nil {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+	} else {
+		if clientIP := requestClientIP(r); isBanned("", clientIP, "sse") {
+			s.logger.Printf("Refusing SSE session from banned client %s", clientIP)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !sourceAllowed(requestClientIP(r), "sse") {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		version, err := parseVersionParam(query.Get("v"))
+		if err != nil {
+			s.logger.Printf("Rejecting SSE session from %s: %v", requestClientIP(r), err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c, err = newSSEConn(r.RemoteAddr, requestClientIP(r)); err != nil {
+			s.logger.Printf("Error creating SSE session: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("SSE session %s opened from %s", c.id, describeConn(c))
+		go s.serveConn(s.registry.ctx, c, version, query.Get("resume"))
+	}
+
+	stream := c.attach()
+	defer c.detach(stream)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", c.id)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case data := <-c.events:
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-c.done:
+			c.mu.Lock()
+			reason := c.closeMsg
+			c.mu.Unlock()
+			if reason != "" {
+				fmt.Fprintf(w, "event: close\ndata: %s\n\n", reason)
+				flusher.Flush()
+			}
+			return
+		case <-stream:
+			// Another stream took over the session
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// HandleSSESend serves POST /signal/send?session=<id>, handing one JSON
+// SignalingMessage to the session's read loop.
+func (s *Service) HandleSSESend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := lookupSSEConn(r.URL.Query().Get("session"))
+	if c == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	var msg SignalingMessage
+	body := http.MaxBytesReader(w, r.Body, maxMessageBytes)
+	if err := json.NewDecoder(body).Decode(&msg); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		parseErrorCount.Add(1)
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case c.incoming <- msg:
+		w.WriteHeader(http.StatusNoContent)
+	case <-c.done:
+		http.Error(w, "session closed", http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
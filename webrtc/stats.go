@@ -0,0 +1,164 @@
+/*
+WebRTC Signaling Message Counters
+=================================
+
+This file counts the signaling messages clients send, per message type, for
+capacity planning and for spotting unusual traffic.
+
+WHY IS THIS NEEDED?
+===================
+How many offers, answers, candidates and calls flow through the server
+decides how it has to be sized, and none of it was visible before. A
+sudden candidate storm (a client stuck re-gathering ICE candidates) is
+only obvious as a rate, so rates are kept next to the totals.
+
+COUNTERS:
+=========
+- One counter per known message type, incremented by the countMessages
+  middleware (see dispatch.go)
+- Messages with an unknown type
+- Messages that couldn't be decoded (malformed JSON or MessagePack on
+  WebSocket, malformed POST bodies on SSE)
+- Offers, answers and candidates with invalid data (see payload.go)
+- Messages whose data is too deeply nested, too big or of the wrong shape
+  (see validate.go)
+
+RATES:
+======
+Rates are messages per second over the last complete statsRateWindow.
+The window moves forward when Stats is called, so if Stats isn't called for
+a while the last window covers that whole time.
+*/
+
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsRateWindow is the interval message rates are averaged over
+const statsRateWindow = time.Minute
+
+// messageTypes are the message types clients may send, the built-in
+// handlers of dispatch.go
+var messageTypes = []string{
+	"join", "activeUsers", "call", "cancelCall", "acceptCall", "offer", "answer",
+	"candidate", "iceRestart", "hangUp", "setStatus", "setMetadata", "callHold",
+	"callResume", "muteState", "callControl", "transferCall", "chat",
+	"clearMissedCalls", "ack", "leave",
+}
+
+var (
+	// messageCounts holds one counter per known message type; the map is
+	// never modified after init, so it can be read concurrently
+	messageCounts = make(map[string]*atomic.Uint64, len(messageTypes))
+
+	unknownMessageCount atomic.Uint64 // Messages with an unknown type
+	parseErrorCount     atomic.Uint64 // Messages that couldn't be decoded
+	invalidPayloadCount atomic.Uint64 // Call messages dropped by payloadAllowed
+	badRequestCount     atomic.Uint64 // Messages dropped by validateMessages
+
+	// Candidates HideLocalCandidates couldn't classify and forwarded (see intercept.go)
+	malformedCandidateCount atomic.Uint64
+
+	// Rate window state, see Stats
+	rateMu             sync.Mutex
+	rateWindowStart    = time.Now()
+	rateWindowCounts   = make(map[string]uint64)  // Totals when the current window started
+	rateWindowUnknown  uint64                     // Unknown-type total when the current window started
+	lastRates          = make(map[string]float64) // Rates over the last complete window
+	lastUnknownRate    float64
+	lastRateWindowSize time.Duration // Length of the last complete window
+)
+
+func init() {
+	for _, messageType := range messageTypes {
+		messageCounts[messageType] = &atomic.Uint64{}
+	}
+}
+
+// countMessage counts a received message by type
+func countMessage(messageType string) {
+	if counter, ok := messageCounts[messageType]; ok {
+		counter.Add(1)
+	} else {
+		unknownMessageCount.Add(1)
+	}
+}
+
+// parseError marks a message that arrived but couldn't be decoded, as
+// opposed to a failed read on the connection
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string { return "invalid message: " + e.err.Error() }
+func (e *parseError) Unwrap() error { return e.err }
+
+// countReadError counts a failed ReadMessage if the message was malformed
+func countReadError(err error) {
+	var parseErr *parseError
+	if errors.As(err, &parseErr) {
+		parseErrorCount.Add(1)
+	}
+}
+
+// SignalingStats is a snapshot of the signaling message counters
+type SignalingStats struct {
+	Messages     map[string]uint64  // Messages received per type since startup
+	UnknownTypes uint64             // Messages with an unknown type since startup
+	ParseErrors  uint64             // Malformed messages since startup
+	InvalidData  uint64             // Offers, answers and candidates dropped for invalid data since startup
+	BadRequests  uint64             // Messages dropped for data of the wrong shape since startup
+	Unclassified uint64             // Candidates -filter-host-candidates couldn't classify and forwarded since startup
+	Rates        map[string]float64 // Messages per second per type over the last complete window
+	UnknownRate  float64            // Unknown-type messages per second over the same window
+	RateWindow   time.Duration      // Length of that window, 0 until the first one completes
+}
+
+// Stats returns the current signaling message counters and rates
+func Stats() SignalingStats {
+	stats := SignalingStats{
+		Messages:     make(map[string]uint64, len(messageTypes)),
+		UnknownTypes: unknownMessageCount.Load(),
+		ParseErrors:  parseErrorCount.Load(),
+		InvalidData:  invalidPayloadCount.Load(),
+		BadRequests:  badRequestCount.Load(),
+		Unclassified: malformedCandidateCount.Load(),
+		Rates:        make(map[string]float64, len(messageTypes)),
+	}
+	for messageType, counter := range messageCounts {
+		stats.Messages[messageType] = counter.Load()
+	}
+
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	now := time.Now()
+	if elapsed := now.Sub(rateWindowStart); elapsed >= statsRateWindow {
+		// Close the current window and start a new one
+		seconds := elapsed.Seconds()
+		for messageType, count := range stats.Messages {
+			lastRates[messageType] = float64(count-rateWindowCounts[messageType]) / seconds
+			rateWindowCounts[messageType] = count
+		}
+		lastUnknownRate = float64(stats.UnknownTypes-rateWindowUnknown) / seconds
+		rateWindowUnknown = stats.UnknownTypes
+		lastRateWindowSize = elapsed
+		rateWindowStart = now
+	}
+	for messageType, rate := range lastRates {
+		stats.Rates[messageType] = rate
+	}
+	stats.UnknownRate = lastUnknownRate
+	stats.RateWindow = lastRateWindowSize
+	return stats
+}
+
+// MessageTypes returns the known message types in protocol order, for
+// callers that print Stats in a stable order
+func MessageTypes() []string {
+	return append([]string(nil), messageTypes...)
+}
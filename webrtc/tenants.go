@@ -0,0 +1,218 @@
+/*
+WebRTC Signaling Tenants
+========================
+
+This file lets one signaling server host several independent apps, each in
+its own namespace of users.
+
+WHY IS THIS NEEDED?
+===================
+Apps sharing a server used to share one set of users: everyone saw everyone
+else in activeUsers and could call them, and one app's users counted
+against everyone's capacity.
+
+HOW IT WORKS:
+=============
+Every tenant is a Service with its own Registry, so sessions, user list
+broadcasts, calls, missed calls, chats and kicks are all kept per tenant,
+by (tenant, username). The default tenant, named "", serves the signaling
+path as before; a tenant named acme serves the same endpoints under
+<path>/acme:
+
+	ws://host:8080/signal/acme           WebSocket signaling
+	http://host:8080/signal/acme/events  SSE event stream (see sse.go)
+	http://host:8080/signal/acme/send    HTTP POST messages
+
+A call to a user of another tenant finds nobody of that name and fails as
+"offline", like a call to anyone else who isn't joined. gRPC clients (see
+grpc.go) are served by the default tenant.
+
+Tenants are fixed at startup with -tenants, so clients can't create them:
+
+	-tenants="acme:max-users=500:max-calls=50,globex"
+
+LIMITS:
+=======
+- max-users: joins beyond it are refused with the error "tenantFull". A
+  user replacing their own session, or rejoining while theirs waits to be
+  resumed, isn't counted twice.
+- max-calls: calls beyond it, ringing or in progress, fail with a
+  callFailed with the reason "callLimit".
+
+0, the default, leaves either unlimited. The default tenant is unlimited.
+
+ADMIN:
+======
+/admin/sessions, /admin/calls and kicks take ?tenant=<name> to pick a tenant
+(see main.go); without it they cover the default tenant, or for listings
+every tenant. Sessions and calls show their tenant as "tenant".
+*/
+
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TenantLimits bounds what one tenant may use; 0 leaves a limit off
+type TenantLimits struct {
+	MaxUsers int // Joined users
+	MaxCalls int // Calls ringing or in progress
+}
+
+// TenantSpec names a tenant and its limits, as parsed from -tenants
+type TenantSpec struct {
+	Name   string
+	Limits TenantLimits
+}
+
+// ParseTenants parses a comma-separated list of tenants, each a name
+// followed by optional ":max-users=N" and ":max-calls=N" limits, e.g.
+// "acme:max-users=500:max-calls=50,globex". An empty string means no tenants
+// besides the default one.
+func ParseTenants(spec string) ([]TenantSpec, error) {
+	var tenants []TenantSpec
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		tenant := TenantSpec{Name: fields[0]}
+		if !isTenantName(tenant.Name) {
+			return nil, fmt.Errorf("invalid tenant name %q: use 1-32 letters, digits, dashes or underscores", tenant.Name)
+		}
+		if seen[tenant.Name] {
+			return nil, fmt.Errorf("tenant %q listed twice", tenant.Name)
+		}
+		seen[tenant.Name] = true
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("tenant %q: invalid %s %q", tenant.Name, key, value)
+			}
+			switch key {
+			case "max-users":
+				tenant.Limits.MaxUsers = n
+			case "max-calls":
+				tenant.Limits.MaxCalls = n
+			default:
+				return nil, fmt.Errorf("tenant %q: unknown limit %q, expected max-users or max-calls", tenant.Name, key)
+			}
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// isTenantName reports whether a tenant name can be used as a path segment.
+// The names of the SSE endpoints are taken.
+func isTenantName(name string) bool {
+	if name == "" || len(name) > 32 || name == "events" || name == "send" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewTenantRegistry creates the registry of a named tenant with its limits
+func NewTenantRegistry(name string, limits TenantLimits) *Registry {
+	r := NewRegistry()
+	r.tenant = name
+	r.limits = limits
+	return r
+}
+
+// Tenant returns the name of the registry's tenant, "" for the default one
+func (r *Registry) Tenant() string {
+	return r.tenant
+}
+
+// tenantFullLocked reports whether a join for name would take the tenant
+// over its user limit. The caller must hold mu.
+func (r *Registry) tenantFullLocked(name string) bool {
+	if r.limits.MaxUsers <= 0 {
+		return false
+	}
+	_, rejoining := r.nameToUserSession[name]
+	return !rejoining && len(r.nameToUserSession) >= r.limits.MaxUsers
+}
+
+// callLimitReachedLocked reports whether the tenant has as many calls as it
+// may have. The caller must hold mu.
+func (r *Registry) callLimitReachedLocked() bool {
+	return r.limits.MaxCalls > 0 && len(r.calls) >= r.limits.MaxCalls
+}
+
+// Tenants is the set of signaling services of a server, one per tenant
+type Tenants struct {
+	services map[string]*Service
+	names    []string // Sorted, the default tenant "" first
+}
+
+// NewTenants creates a service for every tenant next to the default one,
+// logging to signalingLogger with the tenant's name in the prefix
+func NewTenants(defaultService *Service, specs []TenantSpec, signalingLogger *log.Logger) *Tenants {
+	t := &Tenants{services: map[string]*Service{"": defaultService}}
+	for _, spec := range specs {
+		logger := log.New(signalingLogger.Writer(), signalingLogger.Prefix()+"["+spec.Name+"] ", signalingLogger.Flags())
+		t.services[spec.Name] = NewService(NewTenantRegistry(spec.Name, spec.Limits), logger)
+	}
+	for name := range t.services {
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+	return t
+}
+
+// Names returns the tenants' names, the default tenant "" first
+func (t *Tenants) Names() []string {
+	return t.names
+}
+
+// Service returns a tenant's service, or nil if there is no such tenant
+func (t *Tenants) Service(name string) *Service {
+	return t.services[name]
+}
+
+// Snapshot describes the sessions of every tenant
+func (t *Tenants) Snapshot() []SessionInfo {
+	var sessions []SessionInfo
+	for _, name := range t.names {
+		sessions = append(sessions, t.services[name].Registry().Snapshot()...)
+	}
+	return sessions
+}
+
+// Shutdown shuts down every tenant's service (see Service.Shutdown)
+func (t *Tenants) Shutdown() {
+	for _, name := range t.names {
+		t.services[name].Shutdown()
+	}
+}
+
+// Routes returns a handler serving the default tenant's endpoints under
+// path and every other tenant's under path/<tenant> (see Service.Routes)
+func (t *Tenants) Routes(path string) http.Handler {
+	base := strings.TrimRight("/"+strings.TrimLeft(path, "/"), "/")
+	mux := http.NewServeMux()
+	mux.Handle("/", t.services[""].Routes(path))
+	for _, name := range t.names[1:] {
+		tenantPath := base + "/" + name
+		routes := t.services[name].Routes(tenantPath)
+		mux.Handle(tenantPath, routes)
+		mux.Handle(tenantPath+"/", routes)
+	}
+	return mux
+}
@@ -0,0 +1,185 @@
+/*
+WebRTC Signaling Tracing
+========================
+
+This file records OpenTelemetry spans for the signaling messages the server
+handles, and ties the messages that set up a call into one trace.
+
+WHY IS THIS NEEDED?
+===================
+When setting up a call takes 8 seconds, the logs show when each message
+arrived but not where the time went: in the server forwarding it, in TURN
+allocation (traced in main.go) or in the clients. A trace per call setup
+shows the gaps between offer, answer and candidates at a glance.
+
+HOW IT WORKS:
+=============
+Tracing is off until ConfigureTracing is called (see -otel-endpoint in
+main.go); until then the middleware below returns straight away, so it
+costs one branch per message.
+
+Once on, the outermost middleware (see dispatch.go) starts a span
+"signaling <type>" around the handling of every message, with the
+attributes:
+- signaling.type, signaling.sender (redacted like the logs, see redact.go)
+- signaling.session_id, signaling.tenant (see context.go)
+- signaling.call_id, the call the message belongs to, if any
+
+The first offer of a call starts a span "call setup" in a trace of its own,
+with the call ID as signaling.call_id. The spans of the call's offers,
+answers and candidates are its children, and it ends at the first candidate
+after an answer, once both sides have their descriptions and ICE is under
+way, or when the call ends before that. Renegotiations later in the call
+aren't traced as setups.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the signaling spans
+const tracerName = "go-server/webrtc"
+
+var (
+	// tracer records the signaling spans, set once at startup by
+	// ConfigureTracing; nil while tracing is off
+	tracer trace.Tracer
+
+	// callSetups are the call setup spans by call ID, kept until the call
+	// ends so a call is only set up once
+	callSetups   = make(map[string]*callSetup)
+	callSetupsMu sync.Mutex
+)
+
+// callSetup is the call setup span of a call
+type callSetup struct {
+	span     trace.Span
+	answered bool // An answer was handled
+	ended    bool // The span has ended
+}
+
+// ConfigureTracing turns tracing on, recording spans with provider, or off
+// again when provider is nil
+func ConfigureTracing(provider trace.TracerProvider) {
+	if provider == nil {
+		tracer = nil
+		return
+	}
+	tracer = provider.Tracer(tracerName)
+}
+
+// isCallSetupMessage reports whether a message type takes part in setting
+// up a call
+func isCallSetupMessage(msgType string) bool {
+	switch msgType {
+	case "offer", "answer", "candidate":
+		return true
+	}
+	return false
+}
+
+// traceMessages records a span for every message handled, see above
+func (s *Service) traceMessages(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+		if tracer == nil {
+			return next(ctx, conn, msg)
+		}
+
+		// v1 clients don't name the call; it is the sender's current one
+		callID := msg.CallID
+		if callID == "" && isCallSetupMessage(msg.Type) {
+			callID = s.callID(msg)
+		}
+		parent := ctx
+		if isCallSetupMessage(msg.Type) && callID != "" {
+			parent = callSetupContext(ctx, callID, msg.Type)
+		}
+
+		attrs := []attribute.KeyValue{
+			attribute.String("signaling.type", msg.Type),
+			attribute.String("signaling.sender", RedactName(msg.Sender)),
+			attribute.String("signaling.session_id", SessionIDFromContext(ctx)),
+			attribute.String("signaling.tenant", TenantFromContext(ctx)),
+		}
+		if callID != "" {
+			attrs = append(attrs, attribute.String("signaling.call_id", callID))
+		}
+		spanCtx, span := tracer.Start(parent, "signaling "+msg.Type,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...))
+		defer span.End()
+		keepReading := next(spanCtx, conn, msg)
+		if err := ctx.Err(); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		if msg.Type == "candidate" && callID != "" {
+			endCallSetupAfterCandidate(callID)
+		}
+		return keepReading
+	}
+}
+
+// callSetupContext returns ctx with the call setup span of a call as the
+// current span, starting the span on the call's first offer. Messages of a
+// call whose setup has ended, or hasn't started with an offer, keep ctx.
+func callSetupContext(ctx context.Context, callID, msgType string) context.Context {
+	callSetupsMu.Lock()
+	defer callSetupsMu.Unlock()
+	setup, exists := callSetups[callID]
+	if !exists {
+		if msgType != "offer" {
+			return ctx
+		}
+		_, span := tracer.Start(ctx, "call setup",
+			trace.WithNewRoot(),
+			trace.WithAttributes(attribute.String("signaling.call_id", callID)))
+		setup = &callSetup{span: span}
+		callSetups[callID] = setup
+	}
+	if setup.ended {
+		return ctx
+	}
+	if msgType == "answer" {
+		setup.answered = true
+	}
+	return trace.ContextWithSpan(ctx, setup.span)
+}
+
+// endCallSetupAfterCandidate ends the call setup span of a call at the
+// first candidate handled after an answer
+func endCallSetupAfterCandidate(callID string) {
+	callSetupsMu.Lock()
+	defer callSetupsMu.Unlock()
+	if setup, exists := callSetups[callID]; exists && setup.answered && !setup.ended {
+		setup.ended = true
+		setup.span.End()
+	}
+}
+
+// endCallSetup forgets the call setup span of a call that ended, ending it
+// with the call's outcome if the setup never completed
+func endCallSetup(callID, outcome string) {
+	if tracer == nil {
+		return
+	}
+	callSetupsMu.Lock()
+	defer callSetupsMu.Unlock()
+	setup, exists := callSetups[callID]
+	if !exists {
+		return
+	}
+	delete(callSetups, callID)
+	if !setup.ended {
+		setup.span.SetAttributes(attribute.String("signaling.call_outcome", outcome))
+		setup.span.SetStatus(codes.Error, "call ended during setup")
+		setup.span.End()
+	}
+}
@@ -0,0 +1,141 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// useTracing records the signaling spans in memory until the test ends.
+// Call it before newTestServer, so the server is gone when tracing is
+// turned off again.
+func useTracing(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	webrtc.ConfigureTracing(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { webrtc.ConfigureTracing(nil) })
+	return recorder
+}
+
+// endedSpans waits for n spans named name to end and returns them
+func endedSpans(t *testing.T, recorder *tracetest.SpanRecorder, name string, n int) []sdktrace.ReadOnlySpan {
+	t.Helper()
+	var named []sdktrace.ReadOnlySpan
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		named = named[:0]
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				named = append(named, span)
+			}
+		}
+		if len(named) >= n {
+			return named
+		}
+	}
+	t.Fatalf("%d %q spans ended, want %d", len(named), name, n)
+	return nil
+}
+
+// spanAttribute returns the value of a span's attribute, "" without it
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+// The offer, answer and first candidate of a call are children of one
+// "call setup" span, which ends at that candidate
+func TestTraceCallSetup(t *testing.T) {
+	recorder := useTracing(t)
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	bob := dial(t, url, client.Options{Username: "bob", Version: webrtc.ProtocolV2})
+	startCall(t, alice, bob)
+	callID := alice.CallID()
+
+	offers := make(chan string, 1)
+	bob.OnOffer(func(from string, _ json.RawMessage) { offers <- from })
+	answers := make(chan string, 1)
+	alice.OnAnswer(func(from string, _ json.RawMessage) { answers <- from })
+	candidates := make(chan string, 2)
+	bob.OnCandidate(func(from string, _ json.RawMessage) { candidates <- from })
+	if err := alice.SendOffer("bob", testOffer); err != nil {
+		t.Fatalf("offer: %v", err)
+	}
+	receive(t, offers, "offer")
+	if err := bob.SendAnswer("alice", map[string]string{"type": "answer", "sdp": testOffer["sdp"]}); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	receive(t, answers, "answer")
+	candidate := map[string]any{"candidate": "candidate:1 1 udp 2122260223 192.0.2.1 50000 typ host", "sdpMid": "0", "sdpMLineIndex": 0}
+	for range 2 {
+		if err := alice.SendCandidate("bob", candidate); err != nil {
+			t.Fatalf("candidate: %v", err)
+		}
+		receive(t, candidates, "candidate")
+	}
+
+	setup := endedSpans(t, recorder, "call setup", 1)[0]
+	if got := spanAttribute(setup, "signaling.call_id"); got != callID {
+		t.Fatalf("call setup of call %q, want %q", got, callID)
+	}
+	if setup.Parent().IsValid() || setup.Status().Code == codes.Error {
+		t.Fatalf("call setup has parent %v and status %v, want a root span without error", setup.Parent(), setup.Status())
+	}
+	for _, name := range []string{"signaling offer", "signaling answer"} {
+		span := endedSpans(t, recorder, name, 1)[0]
+		if span.Parent().SpanID() != setup.SpanContext().SpanID() {
+			t.Fatalf("%s isn't a child of the call setup", name)
+		}
+		if got := spanAttribute(span, "signaling.call_id"); got != callID {
+			t.Fatalf("%s of call %q, want %q", name, got, callID)
+		}
+		if spanAttribute(span, "signaling.session_id") == "" {
+			t.Fatalf("%s has no session ID", name)
+		}
+	}
+	// Only the first candidate belongs to the setup
+	spans := endedSpans(t, recorder, "signaling candidate", 2)
+	if spans[0].Parent().SpanID() != setup.SpanContext().SpanID() || spans[1].SpanContext().TraceID() == setup.SpanContext().TraceID() {
+		t.Fatal("want the first candidate in the call setup and the second outside it")
+	}
+	if got := spanAttribute(spans[1], "signaling.sender"); got != webrtc.RedactName("alice") {
+		t.Fatalf("candidate sender %q, want %q", got, webrtc.RedactName("alice"))
+	}
+}
+
+// A call that ends before its setup completes ends the setup span with an
+// error and the call's outcome
+func TestTraceCallEndedDuringSetup(t *testing.T) {
+	recorder := useTracing(t)
+	_, url := newTestServer(t)
+	alice := dial(t, url, client.Options{Username: "alice", Version: webrtc.ProtocolV2})
+	bob := dial(t, url, client.Options{Username: "bob", Version: webrtc.ProtocolV2})
+	startCall(t, alice, bob)
+	hangUps := make(chan string, 1)
+	bob.OnHangUp(func(from string) { hangUps <- from })
+
+	if err := alice.SendOffer("bob", testOffer); err != nil {
+		t.Fatalf("offer: %v", err)
+	}
+	if err := alice.HangUp("bob"); err != nil {
+		t.Fatalf("hang up: %v", err)
+	}
+	receive(t, hangUps, "hangUp")
+
+	setup := endedSpans(t, recorder, "call setup", 1)[0]
+	if setup.Status().Code != codes.Error || spanAttribute(setup, "signaling.call_outcome") == "" {
+		t.Fatalf("call setup ended with status %v and attributes %v, want an error and the outcome", setup.Status(), setup.Attributes())
+	}
+}
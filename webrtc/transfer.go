@@ -0,0 +1,335 @@
+/*
+WebRTC Signaling Call Transfer
+==============================
+
+This file lets a user hand their side of an accepted call over to another
+user, e.g. a support agent transferring a customer to a colleague.
+
+WHY IS THIS NEEDED?
+===================
+Without it the agent had to hang up and ask the customer to call the
+colleague themselves.
+
+HOW IT WORKS:
+=============
+Agent and customer are in an accepted call; the agent names the target:
+
+	{"type":"transferCall","sender":"agent","receiver":"colleague"}
+
+1. The target must exist, not be in a call and not be in do-not-disturb.
+   It is rung like any call, from the agent, with the customer named as
+   the transfer context:
+     {"type":"call","sender":"agent","receiver":"colleague","callId":"...","data":{"transfer":{"caller":"customer"}}}
+   Agent and customer stay in their call while it rings.
+2. If the target accepts (acceptCall to the agent), the agent leaves the
+   call and customer and target become each other's peer, in a new call
+   with its own ID (see callid.go):
+   - agent:     {"type":"transferResult","data":{"result":true,"target":"colleague"}}
+   - customer:  {"type":"callTransferred","sender":"agent","callId":"...","data":{"peer":"colleague"}}
+   - colleague: {"type":"callTransferred","sender":"agent","callId":"...","data":{"peer":"customer"}}
+   The customer then starts a new offer/answer exchange with the target.
+3. Otherwise the transfer ends and everyone is back where they were: the
+   target is out of any call, and agent and customer are still in theirs.
+   The agent gets a transferResult with result false and a reason:
+   - declined: the target sent hangUp or cancelCall to the agent
+   - cancelled: the agent sent cancelCall or hangUp to the target
+   - timeout: nobody answered within the transfer timeout
+   - targetLeft: the target disconnected
+   - callEnded: agent and customer hung up or one of them disconnected
+   The target gets a cancelCall from the agent unless it ended it itself.
+
+A transfer that can't start fails right away with a transferResult whose
+reason is notInCall, invalidTarget, targetUnavailable, doNotDisturb or
+transferPending. A call can only have one transfer ringing at a time.
+
+STATE:
+======
+While ringing, the target is InCall with the agent as its peer, in a call
+from the agent that hasn't been accepted (see HandleCall), so nobody else
+can call it and it can't exchange offers with anyone. The agent's current
+call is still the one with the customer. The transfer itself is kept in
+the registry keyed by the target.
+*/
+
+package webrtc
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTransferTimeout is how long a transfer target rings by default
+const DefaultTransferTimeout = 30 * time.Second
+
+// transferTimeout is how long a transfer target rings, set once at startup
+// by ConfigureTransfers
+var transferTimeout = DefaultTransferTimeout
+
+// ConfigureTransfers sets how long a transfer target rings before the
+// transfer is abandoned
+func ConfigureTransfers(timeout time.Duration) {
+	transferTimeout = timeout
+}
+
+// callTransfer is a transfer ringing its target
+type callTransfer struct {
+	by      string      // User handing over their side of the call
+	caller  string      // User staying in the call
+	target  string      // User taking it over
+	call    *activeCall // Call ringing the target
+	timer   *time.Timer
+	service *Service // For logging and broadcasting when the timer fires
+}
+
+// TransferContext is the data of the call message ringing a transfer target
+type TransferContext struct {
+	Transfer struct {
+		Caller string `json:"caller"` // User the target will be talking to
+	} `json:"transfer"`
+}
+
+// HandleTransferCall starts transferring the sender's call to the receiver
+func (s *Service) HandleTransferCall(ctx context.Context, conn Conn, msg SignalingMessage) {
+	sender := msg.Sender
+	target := msg.Receiver
+
+	s.registry.mu.Lock()
+	senderSession, connUser, owned := s.registry.connSessionLocked(conn)
+	if !owned || connUser != sender {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Rejected transferCall from unknown sender %s", RedactName(sender))
+		return
+	}
+	senderSession.mu.Lock()
+	caller := senderSession.Peer
+	senderSession.mu.Unlock()
+
+	reason := ""
+	var call *activeCall
+	targetSession, targetExists := s.registry.nameToUserSession[target]
+	switch {
+	case caller == "" || !s.registry.inAcceptedCallLocked(conn, sender, caller):
+		reason = "notInCall"
+	case target == sender || target == caller:
+		reason = "invalidTarget"
+	case s.registry.transferringLocked(sender) || s.registry.transferringLocked(caller):
+		reason = "transferPending"
+	case !targetExists:
+		reason = "targetUnavailable"
+	}
+	if reason == "" {
+		targetSession.mu.Lock()
+		switch {
+		case targetSession.InCall:
+			reason = "targetUnavailable"
+		case targetSession.Status == StatusDND:
+			reason = "doNotDisturb"
+		default:
+			// Ring the target the way HandleCall would, from the sender
+			call = s.registry.newCallLocked(sender, target)
+			targetSession.InCall = true
+			targetSession.Peer = sender
+			targetSession.CallID = call.id
+			targetSession.callControls = callControlState{}
+		}
+		targetSession.mu.Unlock()
+	}
+	if reason != "" {
+		s.registry.mu.Unlock()
+		s.logger.Printf("Transfer of %s's call with %s to %s refused: %s", RedactName(sender), RedactName(caller), RedactName(target), reason)
+		senderSession.Send(ctx, SignalingMessage{
+			Type:     "transferResult",
+			Receiver: sender,
+			Data:     map[string]interface{}{"result": false, "target": target, "reason": reason},
+			Error:    reason,
+		})
+		return
+	}
+
+	t := &callTransfer{by: sender, caller: caller, target: target, call: call, service: s}
+	s.registry.transfers[target] = t
+	if transferTimeout > 0 {
+		t.timer = time.AfterFunc(transferTimeout, func() {
+			s.endTransfer(t, "timeout")
+		})
+	}
+	s.registry.mu.Unlock()
+	s.logger.Printf("User %s is transferring their call with %s to %s%s", RedactName(sender), RedactName(caller), RedactName(target), callLabel(call.id))
+
+	var context TransferContext
+	context.Transfer.Caller = caller
+	targetSession.Send(ctx, SignalingMessage{
+		Type:     "call",
+		Sender:   sender,
+		Receiver: target,
+		Data:     context,
+		CallID:   call.id,
+	})
+	s.registry.Broadcast()
+}
+
+// completeTransferLocked hands the call over once the target accepted.
+// It reports false if target isn't ringing for a transfer. The caller
+// must hold r.mu and have checked the accept.
+func (s *Service) completeTransferLocked(ctx context.Context, target string) bool {
+	t, exists := s.registry.transfers[target]
+	if !exists {
+		return false
+	}
+	bySession, byExists := s.registry.nameToUserSession[t.by]
+	callerSession, callerExists := s.registry.nameToUserSession[t.caller]
+	targetSession, targetExists := s.registry.nameToUserSession[t.target]
+	if !byExists || !callerExists || !targetExists {
+		// Not expected: leaving users abort their transfers
+		s.registry.abortTransferLocked(t, "callEnded")
+		return true
+	}
+	s.registry.dropTransferLocked(t, CallTransferred)
+
+	// Customer and target start a call of their own, already accepted
+	s.registry.endCallLocked(s.registry.sessionCallLocked(bySession), CallTransferred)
+	call := s.registry.newCallLocked(t.caller, t.target)
+	call.accepted = true
+	history.callAnswered(call)
+	bySession.SetInCall(false)
+	bySession.SetPeer("", "")
+	callerSession.SetPeer(t.target, call.id)
+	targetSession.SetPeer(t.caller, call.id)
+	s.logger.Printf("User %s transferred their call with %s to %s%s", RedactName(t.by), RedactName(t.caller), RedactName(t.target), callLabel(call.id))
+
+	bySession.Send(ctx, SignalingMessage{
+		Type:     "transferResult",
+		Receiver: t.by,
+		Data:     map[string]interface{}{"result": true, "target": t.target},
+	})
+	callerSession.Send(ctx, SignalingMessage{
+		Type:     "callTransferred",
+		Sender:   t.by,
+		Receiver: t.caller,
+		Data:     map[string]string{"peer": t.target},
+		CallID:   call.id,
+	})
+	targetSession.Send(ctx, SignalingMessage{
+		Type:     "callTransferred",
+		Sender:   t.by,
+		Receiver: t.target,
+		Data:     map[string]string{"peer": t.caller},
+		CallID:   call.id,
+	})
+	return true
+}
+
+// handleTransferReply treats a hangUp or cancelCall between a transfer's
+// target and the user transferring as the end of the transfer. It reports
+// false if the message isn't about a transfer.
+func (s *Service) handleTransferReply(conn Conn, msg SignalingMessage) bool {
+	s.registry.mu.RLock()
+	_, connUser, owned := s.registry.connSessionLocked(conn)
+	var t *callTransfer
+	reason := ""
+	if candidate, exists := s.registry.transfers[msg.Sender]; exists && candidate.by == msg.Receiver {
+		t, reason = candidate, "declined"
+	} else if candidate, exists := s.registry.transfers[msg.Receiver]; exists && candidate.by == msg.Sender {
+		t, reason = candidate, "cancelled"
+	}
+	s.registry.mu.RUnlock()
+	if t == nil || !owned || connUser != msg.Sender {
+		return false
+	}
+
+	s.endTransfer(t, reason)
+	return true
+}
+
+// endTransfer abandons a transfer, unless it already ended, and broadcasts
+// the target's change
+func (s *Service) endTransfer(t *callTransfer, reason string) {
+	s.registry.mu.Lock()
+	ended := s.registry.abortTransferLocked(t, reason)
+	s.registry.mu.Unlock()
+	if ended {
+		s.registry.Broadcast()
+	}
+}
+
+// abortTransfersLocked abandons the transfers a user takes part in, when
+// they disconnect or their call ends. The caller must hold r.mu and
+// broadcast afterwards.
+func (r *Registry) abortTransfersLocked(name string) {
+	for _, t := range r.transfers {
+		switch name {
+		case t.target:
+			r.abortTransferLocked(t, "targetLeft")
+		case t.by, t.caller:
+			r.abortTransferLocked(t, "callEnded")
+		}
+	}
+}
+
+// abortTransferLocked puts everyone back where they were before the
+// transfer and tells the user transferring why it failed. It reports false
+// if the transfer had ended already. The caller must hold r.mu.
+func (r *Registry) abortTransferLocked(t *callTransfer, reason string) bool {
+	if r.transfers[t.target] != t {
+		return false
+	}
+	r.dropTransferLocked(t, transferOutcome(reason))
+	t.service.logger.Printf("Transfer of %s's call with %s to %s failed: %s%s", RedactName(t.by), RedactName(t.caller), RedactName(t.target), reason, callLabel(t.call.id))
+
+	// Transfers also fail from timers and disconnects, so the users are
+	// told under the root context (see context.go)
+	ctx := r.ctx
+	// A target that declined or left knows already
+	if targetSession := r.leaveCallLocked(t.target, t.call); targetSession != nil && reason != "declined" && reason != "targetLeft" {
+		targetSession.Send(ctx, SignalingMessage{
+			Type:     "cancelCall",
+			Sender:   t.by,
+			Receiver: t.target,
+			CallID:   t.call.id,
+		})
+	}
+	if bySession, exists := r.nameToUserSession[t.by]; exists {
+		bySession.Send(ctx, SignalingMessage{
+			Type:     "transferResult",
+			Receiver: t.by,
+			Data:     map[string]interface{}{"result": false, "target": t.target, "reason": reason},
+			Error:    reason,
+		})
+	}
+	return true
+}
+
+// transferOutcome is the outcome of a transfer's ringing call in the event
+// history (see history.go) when the transfer fails for the given reason
+func transferOutcome(reason string) string {
+	switch reason {
+	case "timeout":
+		return CallTimeout
+	case "declined":
+		return CallDeclined
+	case "targetLeft":
+		return CallPeerDisconnected
+	}
+	return CallCancelled
+}
+
+// dropTransferLocked forgets a transfer and ends its ringing call with the
+// given outcome. The caller must hold r.mu.
+func (r *Registry) dropTransferLocked(t *callTransfer, outcome string) {
+	delete(r.transfers, t.target)
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	r.endCallLocked(t.call, outcome)
+}
+
+// transferringLocked reports whether a call the user is in has a transfer
+// ringing. The caller must hold r.mu.
+func (r *Registry) transferringLocked(name string) bool {
+	for _, t := range r.transfers {
+		if t.by == name || t.caller == name {
+			return true
+		}
+	}
+	return false
+}
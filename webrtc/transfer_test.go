@@ -0,0 +1,168 @@
+package webrtc_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+	"go-server/webrtc/client"
+)
+
+// transferResult is what the transferring user is told
+type transferResult struct {
+	target string
+	ok     bool
+	reason string
+}
+
+// transferParties joins a customer in an accepted call with an agent, and
+// a colleague to transfer it to
+func transferParties(t *testing.T, url string) (customer, agent, colleague *client.Client) {
+	t.Helper()
+	customer = dial(t, url, client.Options{Username: "customer"})
+	agent = dial(t, url, client.Options{Username: "agent"})
+	colleague = dial(t, url, client.Options{Username: "colleague"})
+	startCall(t, customer, agent)
+	return customer, agent, colleague
+}
+
+// ringTransfer has the agent transfer its call and waits for the colleague
+// to ring, then returns the agent's transfer results
+func ringTransfer(t *testing.T, agent, colleague *client.Client) <-chan transferResult {
+	t.Helper()
+	results := make(chan transferResult, 1)
+	agent.OnTransferResult(func(target string, ok bool, reason string) { results <- transferResult{target, ok, reason} })
+	calls := make(chan string, 1)
+	colleague.OnCall(func(from string) { calls <- from })
+	if err := agent.TransferCall("colleague"); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if from := receive(t, calls, "transfer call"); from != "agent" {
+		t.Fatalf("colleague was rung by %q, want agent", from)
+	}
+	return results
+}
+
+// callPeers returns each user's peer, "" if not in a call
+func callPeers(s *webrtc.Service) map[string]string {
+	peers := make(map[string]string)
+	for _, session := range s.Registry().Snapshot() {
+		if session.InCall {
+			peers[session.Username] = session.Peer
+		} else {
+			peers[session.Username] = ""
+		}
+	}
+	return peers
+}
+
+// expectPeers fails unless every user's peer is as wanted
+func expectPeers(t *testing.T, s *webrtc.Service, want map[string]string) {
+	t.Helper()
+	got := callPeers(s)
+	for name, peer := range want {
+		if got[name] != peer {
+			t.Fatalf("peers %v, want %v", got, want)
+		}
+	}
+}
+
+// expectOffer fails unless an offer from one user reaches the other
+func expectOffer(t *testing.T, from, to *client.Client) {
+	t.Helper()
+	offers := make(chan string, 1)
+	to.OnOffer(func(sender string, _ json.RawMessage) { offers <- sender })
+	if err := from.SendOffer(to.Name, testOffer); err != nil {
+		t.Fatalf("send offer: %v", err)
+	}
+	if sender := receive(t, offers, "offer"); sender != from.Name {
+		t.Fatalf("%s got an offer from %q, want %q", to.Name, sender, from.Name)
+	}
+}
+
+// An accepted transfer frees the agent and puts the customer and the
+// colleague in a call of their own
+func TestTransferAccepted(t *testing.T) {
+	s, url := newTestServer(t)
+	customer, agent, colleague := transferParties(t, url)
+	results := ringTransfer(t, agent, colleague)
+	expectPeers(t, s, map[string]string{"customer": "agent", "agent": "customer", "colleague": "agent"})
+
+	transferred := make(chan [2]string, 2)
+	onTransferred := func(by, peer string) { transferred <- [2]string{by, peer} }
+	customer.OnCallTransferred(onTransferred)
+	colleague.OnCallTransferred(onTransferred)
+	if err := colleague.AcceptCall("agent"); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	if result := receive(t, results, "transferResult"); result != (transferResult{"colleague", true, ""}) {
+		t.Fatalf("agent got %+v, want a successful transfer to colleague", result)
+	}
+	got := map[[2]string]bool{
+		receive(t, transferred, "callTransferred"): true,
+		receive(t, transferred, "callTransferred"): true,
+	}
+	if !got[[2]string{"agent", "colleague"}] || !got[[2]string{"agent", "customer"}] {
+		t.Fatalf("callTransferred %v, want customer told of colleague and colleague of customer", got)
+	}
+	expectPeers(t, s, map[string]string{"customer": "colleague", "agent": "", "colleague": "customer"})
+	expectOffer(t, customer, colleague)
+}
+
+// A declined transfer leaves the agent and customer in their call
+func TestTransferDeclined(t *testing.T) {
+	s, url := newTestServer(t)
+	customer, agent, colleague := transferParties(t, url)
+	results := ringTransfer(t, agent, colleague)
+
+	if err := colleague.HangUp("agent"); err != nil {
+		t.Fatalf("decline: %v", err)
+	}
+	if result := receive(t, results, "transferResult"); result != (transferResult{"colleague", false, "declined"}) {
+		t.Fatalf("agent got %+v, want the transfer declined", result)
+	}
+	expectPeers(t, s, map[string]string{"customer": "agent", "agent": "customer", "colleague": ""})
+	expectOffer(t, customer, agent)
+}
+
+// A transfer nobody answers is cancelled at the target and leaves the agent
+// and customer in their call
+func TestTransferTimeout(t *testing.T) {
+	// Set before the server starts and restored after its handlers return
+	webrtc.ConfigureTransfers(100 * time.Millisecond)
+	t.Cleanup(func() { webrtc.ConfigureTransfers(webrtc.DefaultTransferTimeout) })
+	s, url := newTestServer(t)
+	customer, agent, colleague := transferParties(t, url)
+	cancels := make(chan string, 1)
+	colleague.OnCancelCall(func(from string) { cancels <- from })
+	results := ringTransfer(t, agent, colleague)
+
+	if result := receive(t, results, "transferResult"); result != (transferResult{"colleague", false, "timeout"}) {
+		t.Fatalf("agent got %+v, want the transfer timed out", result)
+	}
+	if from := receive(t, cancels, "cancelCall"); from != "agent" {
+		t.Fatalf("colleague got a cancelCall from %q, want agent", from)
+	}
+	expectPeers(t, s, map[string]string{"customer": "agent", "agent": "customer", "colleague": ""})
+	expectOffer(t, customer, agent)
+}
+
+// A transfer to a user already in a call is refused and changes nothing
+func TestTransferToBusyTargetRefused(t *testing.T) {
+	s, url := newTestServer(t)
+	_, agent, colleague := transferParties(t, url)
+	other := dial(t, url, client.Options{Username: "other"})
+	startCall(t, other, colleague)
+
+	results := make(chan transferResult, 1)
+	agent.OnTransferResult(func(target string, ok bool, reason string) { results <- transferResult{target, ok, reason} })
+	if err := agent.TransferCall("colleague"); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if result := receive(t, results, "transferResult"); result != (transferResult{"colleague", false, "targetUnavailable"}) {
+		t.Fatalf("agent got %+v, want the target unavailable", result)
+	}
+	expectPeers(t, s, map[string]string{"customer": "agent", "agent": "customer", "colleague": "other", "other": "colleague"})
+}
@@ -0,0 +1,112 @@
+/*
+WebRTC Signaling Transports
+===========================
+
+This file defines Conn, the connection a signaling client talks to the
+server over, and its WebSocket implementation. The gRPC implementation
+lives in grpc.go and the SSE one in sse.go.
+
+WHY AN INTERFACE?
+=================
+Sessions, handlers and the outbound writer only need to read messages,
+write messages and close the connection. Keeping them behind an interface
+lets WebSocket and gRPC clients share one session registry, so a user on
+one transport can call a user on the other and every offer, answer and
+candidate flows across transparently.
+*/
+
+package webrtc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errConnClosed is returned by reads and writes on a connection the server
+// closed, for transports that don't report their own error
+var errConnClosed = errors.New("connection closed by server")
+
+// Conn is a signaling client connection on any transport
+type Conn interface {
+	// ReadMessage blocks until the client sends the next message
+	ReadMessage(msg *SignalingMessage) error
+	// WriteMessage sends one message to the client, already rendered
+	// for its protocol version
+	WriteMessage(msg SignalingMessage) error
+	// SetWriteDeadline bounds how long the next writes may block.
+	// Transports without deadlines ignore it.
+	SetWriteDeadline(t time.Time) error
+	// CloseWithCode tells the client why the connection is being closed,
+	// using WebSocket close codes, and closes it
+	CloseWithCode(code int, reason string)
+	// Close closes the connection
+	Close() error
+	// RemoteAddr identifies the connection in session lookups
+	RemoteAddr() net.Addr
+	// ClientIP is the client's IP address, as reported by trusted proxies
+	// (see proxy.go) or else the address the connection came from
+	ClientIP() string
+}
+
+// wsConn is a signaling connection over WebSocket
+type wsConn struct {
+	conn     *websocket.Conn
+	clientIP string
+	// gorilla/websocket allows only one concurrent writer
+	writeMu sync.Mutex
+}
+
+// newWSConn wraps an upgraded WebSocket connection
+func newWSConn(conn *websocket.Conn, clientIP string) *wsConn {
+	return &wsConn{conn: conn, clientIP: clientIP}
+}
+
+func (c *wsConn) ReadMessage(msg *SignalingMessage) error {
+	return readMessage(c.conn, msg)
+}
+
+func (c *wsConn) WriteMessage(msg SignalingMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeMessage(c.conn, msg)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *wsConn) CloseWithCode(code int, reason string) {
+	// WriteControl may be called concurrently with other writes
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *wsConn) ClientIP() string {
+	return c.clientIP
+}
+
+func (c *wsConn) ping() error {
+	// WriteControl may be called concurrently with other writes
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+}
+
+func (c *wsConn) setPongHandler(onPong func()) {
+	c.conn.SetPongHandler(func(string) error {
+		onPong()
+		return nil
+	})
+}
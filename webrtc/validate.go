@@ -0,0 +1,220 @@
+/*
+WebRTC Signaling Message Validation
+===================================
+
+This file checks the shape of every message's data before its handler
+runs, and decodes the data of the message types the server reads into
+typed payloads.
+
+WHY IS THIS NEEDED?
+===================
+The data field is decoded as untyped JSON and encoded again when it is
+forwarded, logged or recorded. A client could nest it thousands of levels
+deep or pack it with tiny values to make every encode slow, or send a
+number where the peer expects an object. The handlers read fields with
+type assertions that quietly treat a wrong type as missing, so such
+messages were forwarded anyway.
+
+HOW IT WORKS:
+=============
+validateMessages is the innermost built-in middleware (see dispatch.go), so
+a rejected message is still counted, captured, recorded and logged. For
+every message it:
+
+1. Walks the data, without encoding it, and rejects it if it is nested more
+   than maxPayloadDepth levels deep or holds more than maxPayloadValues
+   values.
+2. For offer, answer, candidate, join and chat, decodes the data into
+   OfferPayload, AnswerPayload, CandidatePayload, JoinPayload or
+   ChatPayload. A field of the wrong type is rejected, and so is a field
+   the payload doesn't have, except in chat, whose data clients may extend
+   with their own fields (see chat.go).
+
+Messages without data pass; the handlers decide whether they need it. What
+the fields hold, such as a valid SDP or candidate line, is still checked by
+the handlers (see payload.go and metadata.go).
+
+A rejected message is dropped, logged, counted (see stats.go) and answered
+with the path of the offending field:
+
+	{"type":"error","error":"badRequest","data":{"error":"badRequest","type":"candidate",
+	 "field":"data.sdpMLineIndex","reason":"wrongType"}}
+
+where reason is tooDeep, tooManyValues, wrongType or unknownField.
+
+Browsers' RTCSessionDescription and RTCIceCandidate toJSON() output, pion's
+SessionDescription and ICECandidateInit, and the messages of the Go client
+(see client/) all decode unchanged.
+*/
+
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Shape limits of a message's data, checked before it is decoded
+const (
+	maxPayloadDepth  = 32    // Levels of nested objects and arrays
+	maxPayloadValues = 10000 // Values of any kind, containers included
+)
+
+// maxFieldPath bounds the field path in a badRequest reply; paths are made
+// of client-chosen keys
+const maxFieldPath = 128
+
+// OfferPayload is the data of an offer, an RTCSessionDescription
+type OfferPayload struct {
+	Type string `json:"type"` // "offer"
+	SDP  string `json:"sdp"`
+}
+
+// AnswerPayload is the data of an answer, an RTCSessionDescription
+type AnswerPayload struct {
+	Type string `json:"type"` // "answer" or "pranswer"
+	SDP  string `json:"sdp"`
+}
+
+// CandidatePayload is the data of a candidate, an RTCIceCandidateInit
+type CandidatePayload struct {
+	Candidate        string  `json:"candidate"` // Empty for the end of candidates
+	SDPMid           *string `json:"sdpMid"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex"`
+	UsernameFragment *string `json:"usernameFragment"`
+}
+
+// JoinPayload is the data of a join, which may be left out
+type JoinPayload struct {
+	SessionToken string `json:"sessionToken"` // To resume a session, see reliability.go
+	// Checked by metadataFromData, so invalid metadata fails the join with
+	// invalidMetadata
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// ChatPayload is the data of a chat message; clients may add fields
+type ChatPayload struct {
+	Text string `json:"text"`
+}
+
+// validateMessages drops messages whose data is too deeply nested, too big
+// or doesn't decode into the payload of its type
+func (s *Service) validateMessages(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, conn Conn, msg SignalingMessage) bool {
+		field, reason := checkPayloadShape(msg.Data)
+		if reason == "" {
+			field, reason = decodePayload(msg)
+		}
+		if reason == "" {
+			return next(ctx, conn, msg)
+		}
+		if len(field) > maxFieldPath {
+			field = field[:maxFieldPath]
+		}
+		badRequestCount.Add(1)
+		s.logger.Printf("Dropping %s from %s to %s: %s at %s", msg.Type, RedactName(msg.Sender), RedactName(msg.Receiver), reason, field)
+		s.sendToConn(ctx, conn, SignalingMessage{
+			Type:     "error",
+			Receiver: msg.Sender,
+			Error:    "badRequest",
+			Data:     map[string]string{"error": "badRequest", "type": msg.Type, "field": field, "reason": reason},
+		}, msg.Version)
+		return true
+	}
+}
+
+// checkPayloadShape returns the path of the first value of data beyond
+// maxPayloadDepth or maxPayloadValues and why, or "" if there is none
+func checkPayloadShape(data interface{}) (field, reason string) {
+	values := 0
+	var path []string // Built backwards as walk returns
+	var walk func(value interface{}, depth int) string
+	walk = func(value interface{}, depth int) string {
+		values++
+		switch {
+		case values > maxPayloadValues:
+			return "tooManyValues"
+		case depth > maxPayloadDepth:
+			return "tooDeep"
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for key, child := range value {
+				if reason := walk(child, depth+1); reason != "" {
+					path = append(path, "."+key)
+					return reason
+				}
+			}
+		case []interface{}:
+			for i, child := range value {
+				if reason := walk(child, depth+1); reason != "" {
+					path = append(path, "["+strconv.Itoa(i)+"]")
+					return reason
+				}
+			}
+		}
+		return ""
+	}
+	if reason = walk(data, 0); reason == "" {
+		return "", ""
+	}
+	slices.Reverse(path)
+	return "data" + strings.Join(path, ""), reason
+}
+
+// decodePayload decodes the data of an offer, answer, candidate, join or
+// chat message into its payload, and returns the path of the offending
+// field and why if it doesn't fit
+func decodePayload(msg SignalingMessage) (field, reason string) {
+	var payload interface{}
+	strict := true
+	switch msg.Type {
+	case "offer":
+		payload = &OfferPayload{}
+	case "answer":
+		payload = &AnswerPayload{}
+	case "candidate":
+		payload = &CandidatePayload{}
+	case "join":
+		payload = &JoinPayload{}
+	case "chat":
+		payload, strict = &ChatPayload{}, false
+	default:
+		return "", ""
+	}
+	if msg.Data == nil {
+		return "", ""
+	}
+	encoded, err := json.Marshal(msg.Data)
+	if err != nil {
+		return "data", "wrongType"
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(payload)
+	if err == nil {
+		return "", ""
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "" {
+			return "data", "wrongType"
+		}
+		return "data." + typeErr.Field, "wrongType"
+	}
+	// The json package reports unknown fields as `json: unknown field "name"`
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			name = unquoted
+		}
+		return "data." + name, "unknownField"
+	}
+	return "data", "wrongType"
+}
@@ -0,0 +1,130 @@
+package webrtc_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go-server/webrtc"
+
+	"github.com/gorilla/websocket"
+)
+
+// nested returns a value nested depth arrays deep
+func nested(depth int) any {
+	var value any = "bottom"
+	for range depth {
+		value = []any{value}
+	}
+	return value
+}
+
+// Data of the wrong shape is answered with badRequest and the path of the
+// offending field, and isn't forwarded; the connection carries on
+func TestValidateMessagesRejects(t *testing.T) {
+	many := make([]any, 10001)
+	for i := range many {
+		many[i] = 0
+	}
+	cases := []struct {
+		name   string
+		msg    webrtc.SignalingMessage
+		field  string
+		reason string
+	}{
+		{"offer that isn't an object", webrtc.SignalingMessage{Type: "offer", Data: 5}, "data", "wrongType"},
+		{"SDP that isn't a string", webrtc.SignalingMessage{Type: "offer", Data: map[string]any{"type": "offer", "sdp": []any{"v=0"}}}, "data.sdp", "wrongType"},
+		{"unknown answer field", webrtc.SignalingMessage{Type: "answer", Data: map[string]any{"type": "answer", "sdp": "v=0\r\n", "extra": true}}, "data.extra", "unknownField"},
+		{"line index as a string", webrtc.SignalingMessage{Type: "candidate", Data: map[string]any{"candidate": "", "sdpMid": "0", "sdpMLineIndex": "0"}}, "data.sdpMLineIndex", "wrongType"},
+		{"negative line index", webrtc.SignalingMessage{Type: "candidate", Data: map[string]any{"candidate": "", "sdpMLineIndex": -1}}, "data.sdpMLineIndex", "wrongType"},
+		{"chat text that isn't a string", webrtc.SignalingMessage{Type: "chat", Data: map[string]any{"text": map[string]any{}}}, "data.text", "wrongType"},
+		{"too deep", webrtc.SignalingMessage{Type: "callControl", Data: map[string]any{"control": "x", "a": nested(40)}}, "data.a" + strings.Repeat("[0]", 32), "tooDeep"},
+		{"too many values", webrtc.SignalingMessage{Type: "muteState", Data: map[string]any{"list": many}}, "data.list[9998]", "tooManyValues"},
+	}
+	_, url := newTestServer(t)
+	alice := joinRaw(t, url, "alice")
+	bob := joinRaw(t, url, "bob")
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"})
+	callID := expectRaw(t, bob, "call").CallID
+	sendRaw(t, bob, webrtc.SignalingMessage{Type: "acceptCall", Sender: "bob", Receiver: "alice", CallID: callID})
+	expectRaw(t, alice, "acceptCall")
+
+	for _, c := range cases {
+		before := webrtc.Stats().BadRequests
+		c.msg.Sender, c.msg.Receiver, c.msg.CallID = "alice", "bob", callID
+		sendRaw(t, alice, c.msg)
+		reply := expectRaw(t, alice, "error")
+		data, _ := reply.Data.(map[string]any)
+		if reply.Error != "badRequest" || data["type"] != c.msg.Type || data["field"] != c.field || data["reason"] != c.reason {
+			t.Fatalf("%s: answered %+v, want badRequest at %s for %s", c.name, reply, c.field, c.reason)
+		}
+		if counted := webrtc.Stats().BadRequests - before; counted != 1 {
+			t.Fatalf("%s: counted %d bad requests, want 1", c.name, counted)
+		}
+	}
+
+	// None of them reached bob, and the next valid message does
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "chat", Sender: "alice", Receiver: "bob", Data: map[string]any{"text": "still here"}})
+	expectNextOf(t, bob, "chat", "offer", "answer", "candidate", "callControl", "muteState")
+
+	// A join is checked before it is handled
+	carol, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial as carol: %v", err)
+	}
+	defer carol.Close()
+	sendRaw(t, carol, webrtc.SignalingMessage{Type: "join", Sender: "carol", Version: webrtc.ProtocolV2, Data: map[string]any{"sessionToken": 5}})
+	if reply := expectNextOf(t, carol, "error", "join"); reply.Data.(map[string]any)["field"] != "data.sessionToken" {
+		t.Fatalf("join answered %+v, want badRequest at data.sessionToken", reply)
+	}
+}
+
+// expectNextOf reads until a message of one of types, or of want,
+// arrives, and fails unless it is want
+func expectNextOf(t *testing.T, ws *websocket.Conn, want string, types ...string) webrtc.SignalingMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg webrtc.SignalingMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", want, err)
+		}
+		if msg.Type == want {
+			return msg
+		}
+		if slices.Contains(types, msg.Type) {
+			t.Fatalf("got %s %+v, want %s", msg.Type, msg.Data, want)
+		}
+	}
+}
+
+// What browsers, pion and the Go client send passes unchanged, extra chat
+// fields included
+func TestValidateMessagesAccepts(t *testing.T) {
+	_, url := newTestServer(t)
+	alice := joinRaw(t, url, "alice")
+	bob := joinRaw(t, url, "bob")
+	sendRaw(t, alice, webrtc.SignalingMessage{Type: "call", Sender: "alice", Receiver: "bob"})
+	callID := expectRaw(t, bob, "call").CallID
+	sendRaw(t, bob, webrtc.SignalingMessage{Type: "acceptCall", Sender: "bob", Receiver: "alice", CallID: callID})
+	expectRaw(t, alice, "acceptCall")
+
+	before := webrtc.Stats().BadRequests
+	messages := []webrtc.SignalingMessage{
+		// RTCSessionDescription.toJSON() and pion's SessionDescription
+		{Type: "offer", Data: map[string]any{"type": "offer", "sdp": testOffer["sdp"]}},
+		// RTCIceCandidate.toJSON(), and pion's ICECandidateInit without a username fragment
+		{Type: "candidate", Data: map[string]any{"candidate": "candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host", "sdpMid": "0", "sdpMLineIndex": 0, "usernameFragment": "Qx7z"}},
+		{Type: "candidate", Data: map[string]any{"candidate": "", "sdpMid": nil, "sdpMLineIndex": nil}},
+		{Type: "chat", Data: map[string]any{"text": "hi", "clientMessageId": "m1", "mentions": []any{"bob"}}},
+	}
+	for _, msg := range messages {
+		msg.Sender, msg.Receiver, msg.CallID = "alice", "bob", callID
+		sendRaw(t, alice, msg)
+		expectNextOf(t, bob, msg.Type, "offer", "candidate", "chat")
+	}
+	if counted := webrtc.Stats().BadRequests - before; counted != 0 {
+		t.Fatalf("%d well-formed messages rejected", counted)
+	}
+}